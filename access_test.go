@@ -0,0 +1,80 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system whose inodes may be read and searched but not written.
+type noWriteFS struct {
+	fuseutil.NotImplementedFileSystem
+	masks []uint32
+}
+
+func (fs *noWriteFS) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	fs.masks = append(fs.masks, op.Mask)
+	if op.Mask&fuseops.AccessWrite != 0 {
+		return syscall.EACCES
+	}
+
+	return nil
+}
+
+func sendAccess(t *testing.T, kernel *os.File, unique uint64, mask uint32) {
+	in := fusekernel.AccessIn{Mask: mask}
+	sendRequest(t, kernel, fusekernel.OpAccess, unique, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+}
+
+func TestAccess(t *testing.T) {
+	fs := &noWriteFS{}
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	sendAccess(t, kernel, 1, fuseops.AccessRead|fuseops.AccessExecute)
+	if r := readReply(t, kernel); r.unique != 1 || r.errno != 0 || len(r.data) != 0 {
+		t.Errorf("Reply to R_OK|X_OK: %+v", r)
+	}
+
+	sendAccess(t, kernel, 2, fuseops.AccessRead|fuseops.AccessWrite)
+	if r := readReply(t, kernel); r.unique != 2 || r.errno != -int32(syscall.EACCES) {
+		t.Errorf("Reply to R_OK|W_OK: %+v", r)
+	}
+
+	if len(fs.masks) != 2 || fs.masks[0] != 5 || fs.masks[1] != 6 {
+		t.Errorf("Masks received: %v", fs.masks)
+	}
+}
+
+func TestAccessNotImplemented(t *testing.T) {
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}))
+	defer hangUp()
+
+	// The kernel takes ENOSYS as leave to stop asking.
+	sendAccess(t, kernel, 1, fuseops.AccessRead)
+	if r := readReply(t, kernel); r.errno != -int32(syscall.ENOSYS) {
+		t.Errorf("Reply: %+v", r)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Report whether the op works on a file or directory already open, or only
+// drops references, so that it is let through whoever sends it.
+func isOpenHandleOp(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.ReadFileOp,
+		*fuseops.WriteFileOp,
+		*fuseops.SyncFileOp,
+		*fuseops.ReleaseFileHandleOp,
+		*fuseops.ReadDirOp,
+		*fuseops.ReadDirPlusOp,
+		*fuseops.ReleaseDirHandleOp,
+		*fuseops.ForgetInodeOp,
+		*fuseops.BatchForgetOp:
+		return true
+	}
+
+	return false
+}
+
+// Return EACCES for an op that MountConfig.AllowRoot doesn't let the sender
+// make, as libfuse does for allow_root: the kernel lets everyone through with
+// allow_other, leaving us to refuse users other than root and the one who
+// mounted the file system.
+func (c *Connection) checkAllowRoot(op interface{}, uid uint32) error {
+	if !c.cfg.AllowRoot || uid == 0 || uid == c.owner || isOpenHandleOp(op) {
+		return nil
+	}
+
+	return syscall.EACCES
+}
@@ -0,0 +1,53 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+func TestAllowRoot(t *testing.T) {
+	cfg := &fuse.MountConfig{AllowRoot: true}
+	server := fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{})
+	kernel, _, hangUp := serveWithConfig(t, cfg, server)
+	defer hangUp()
+
+	getattr := make([]byte, unsafe.Sizeof(fusekernel.GetattrIn{}))
+
+	// Root gets through to the file system.
+	sendRequestAs(t, kernel, fusekernel.OpGetattr, 1, 0, getattr)
+	if r := readReply(t, kernel); r.unique != 1 || r.errno != -int32(syscall.ENOSYS) {
+		t.Errorf("Reply to root: %+v", r)
+	}
+
+	// Other users are turned away.
+	sendRequestAs(t, kernel, fusekernel.OpGetattr, 2, 4242, getattr)
+	if r := readReply(t, kernel); r.unique != 2 || r.errno != -int32(syscall.EACCES) {
+		t.Errorf("Reply to another user: %+v", r)
+	}
+
+	// Except for ops on what they already have open.
+	in := fusekernel.ReadIn{Size: 4}
+	sendRequestAs(t, kernel, fusekernel.OpRead, 3, 4242, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+	if r := readReply(t, kernel); r.unique != 3 || r.errno != -int32(syscall.ENOSYS) {
+		t.Errorf("Reply to a read by another user: %+v", r)
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// A file system recording the batches it is handed. Reads fill the buffer
+// with the low byte of their offset, except those at offset 1, which fail.
+type batchRecorder struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu      sync.Mutex
+	batches [][]int64
+}
+
+func (fs *batchRecorder) HandleBatch(ops []fuseutil.BatchedOp) []error {
+	var offsets []int64
+	errs := make([]error, len(ops))
+	for i, o := range ops {
+		op := o.Op.(*fuseops.ReadFileOp)
+		offsets = append(offsets, op.Offset)
+		if op.Offset == 1 {
+			errs[i] = fuse.EIO
+			continue
+		}
+
+		for j := range op.Dst {
+			op.Dst[j] = byte(op.Offset)
+		}
+
+		op.BytesRead = len(op.Dst)
+	}
+
+	fs.mu.Lock()
+	fs.batches = append(fs.batches, offsets)
+	fs.mu.Unlock()
+
+	return errs
+}
+
+func (fs *batchRecorder) Batches() [][]int64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([][]int64(nil), fs.batches...)
+}
+
+// Serve the file system with the batching server over a socket pair standing
+// in for /dev/fuse, returning our end of it, the kernel's, and a function
+// that hangs up and waits for the server to return.
+func serveBatching(
+	t *testing.T,
+	fs fuseutil.BatchingFileSystem,
+	window fuseutil.BatchWindow) (kernel *os.File, hangUp func()) {
+	kernel, _, hangUp = serve(t, fuseutil.NewBatchingFileSystemServer(fs, window))
+	return kernel, hangUp
+}
+
+// Serve with the supplied server over a socket pair standing in for
+// /dev/fuse, returning the kernel's end of it, the connection, and a function
+// that hangs up and waits for the server to return.
+func serve(
+	t *testing.T,
+	server fuse.Server) (kernel *os.File, c *fuse.Connection, hangUp func()) {
+	return serveWithConfig(t, &fuse.MountConfig{}, server)
+}
+
+// Like serve, but with the supplied config.
+func serveWithConfig(
+	t *testing.T,
+	cfg *fuse.MountConfig,
+	server fuse.Server) (kernel *os.File, c *fuse.Connection, hangUp func()) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	dev := os.NewFile(uintptr(fds[0]), "dev")
+	kernel = os.NewFile(uintptr(fds[1]), "kernel")
+
+	// Queue up the init op, which NewConnection consumes before returning.
+	in := fusekernel.InitIn{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+	sendRequest(t, kernel, fusekernel.OpInit, 0, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+
+	c, err = fuse.NewConnection(cfg, dev)
+	if err != nil {
+		t.Fatalf("NewConnection: %v", err)
+	}
+
+	if r := readReply(t, kernel); r.errno != 0 {
+		t.Fatalf("Init reply: %+v", r)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.ServeOps(c)
+		close(done)
+	}()
+
+	hangUp = func() {
+		kernel.Close()
+		<-done
+		c.Close()
+	}
+
+	return kernel, c, hangUp
+}
+
+// Send a request with the supplied body, as the kernel would.
+func sendRequest(
+	t *testing.T,
+	kernel *os.File,
+	opcode uint32,
+	unique uint64,
+	body []byte) {
+	sendRequestAs(t, kernel, opcode, unique, 0, body)
+}
+
+// Like sendRequest, but on behalf of the supplied user.
+func sendRequestAs(
+	t *testing.T,
+	kernel *os.File,
+	opcode uint32,
+	unique uint64,
+	uid uint32,
+	body []byte) {
+	h := fusekernel.InHeader{
+		Len:    uint32(unsafe.Sizeof(fusekernel.InHeader{})) + uint32(len(body)),
+		Opcode: opcode,
+		Unique: unique,
+		Nodeid: 2,
+		Uid:    uid,
+	}
+
+	b := append([]byte(nil), (*[unsafe.Sizeof(h)]byte)(unsafe.Pointer(&h))[:]...)
+	if _, err := kernel.Write(append(b, body...)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+// Send a 4-byte read at the supplied offset.
+func sendRead(t *testing.T, kernel *os.File, unique uint64, offset int64) {
+	in := fusekernel.ReadIn{Offset: uint64(offset), Size: 4}
+	sendRequest(t, kernel, fusekernel.OpRead, unique, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+}
+
+// A reply read by the kernel.
+type reply struct {
+	unique uint64
+	errno  int32
+	data   []byte
+}
+
+func readReply(t *testing.T, kernel *os.File) reply {
+	b := make([]byte, 1<<16)
+	n, err := kernel.Read(b)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if n < 16 {
+		t.Fatalf("Short reply: %d bytes", n)
+	}
+
+	return reply{
+		unique: binary.LittleEndian.Uint64(b[8:]),
+		errno:  int32(binary.LittleEndian.Uint32(b[4:])),
+		data:   b[16:n],
+	}
+}
+
+func TestBatchingServerFillsBatches(t *testing.T) {
+	fs := &batchRecorder{}
+	kernel, hangUp := serveBatching(t, fs, fuseutil.BatchWindow{
+		MaxOps:   3,
+		MaxDelay: time.Hour,
+	})
+	defer hangUp()
+
+	// Other ops are served while a batch is being collected.
+	sendRead(t, kernel, 1, 0)
+	sendRequest(t, kernel, fusekernel.OpStatfs, 2, nil)
+	if r := readReply(t, kernel); r.unique != 2 || r.errno != -int32(syscall.ENOSYS) {
+		t.Errorf("StatFS reply: %+v", r)
+	}
+
+	// The batch is handed over as soon as it is full, without waiting for
+	// MaxDelay, and each op gets its own reply, in the order of the batch.
+	sendRead(t, kernel, 3, 1)
+	sendRead(t, kernel, 4, 2)
+
+	want := []reply{
+		{unique: 1, data: []byte{0, 0, 0, 0}},
+		{unique: 3, errno: -int32(syscall.EIO), data: []byte{}},
+		{unique: 4, data: []byte{2, 2, 2, 2}},
+	}
+
+	for _, w := range want {
+		r := readReply(t, kernel)
+		if r.unique != w.unique || r.errno != w.errno || string(r.data) != string(w.data) {
+			t.Errorf("Reply: got %+v, want %+v", r, w)
+		}
+	}
+
+	if b := fs.Batches(); len(b) != 1 || len(b[0]) != 3 {
+		t.Errorf("Batches: %v", b)
+	}
+}
+
+func TestBatchingServerFlushesAfterDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	fs := &batchRecorder{}
+	kernel, hangUp := serveBatching(t, fs, fuseutil.BatchWindow{
+		MaxOps:   64,
+		MaxDelay: delay,
+	})
+	defer hangUp()
+
+	start := time.Now()
+	sendRead(t, kernel, 1, 0)
+	sendRead(t, kernel, 2, 2)
+	readReply(t, kernel)
+	readReply(t, kernel)
+
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("Batch handed over after %v, before MaxDelay", elapsed)
+	}
+
+	if b := fs.Batches(); len(b) != 1 || len(b[0]) != 2 {
+		t.Errorf("Batches: %v", b)
+	}
+}
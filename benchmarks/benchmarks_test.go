@@ -0,0 +1,174 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package benchmarks
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// Mount benchFS in a temporary directory for the rest of the benchmark,
+// returning the mount point. The benchmark is skipped if that isn't possible.
+func mount(b *testing.B) string {
+	dir := b.TempDir()
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&benchFS{}),
+		&fuse.MountConfig{FSName: "benchfs", DisableWritebackCaching: true})
+	if err != nil {
+		b.Skipf("Mount: %v", err)
+	}
+
+	b.Cleanup(func() {
+		if err := mfs.Shutdown(context.Background()); err != nil {
+			b.Errorf("Shutdown: %v", err)
+		}
+	})
+
+	return dir
+}
+
+// Open a file in the mount. os.OpenFile would register the file with the
+// runtime's poller, and epoll_ctl(2) then waits for the file system to answer
+// a PollOp without the runtime knowing, which can stall the whole process and
+// so the file system. A file made by os.NewFile from a blocking descriptor is
+// left alone.
+func open(b *testing.B, p string, flags int) *os.File {
+	fd, err := syscall.Open(p, flags|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+
+	return os.NewFile(uintptr(fd), p)
+}
+
+// Per-op latencies, reported as percentiles.
+type latencies []time.Duration
+
+func (l *latencies) time(f func() error) error {
+	start := time.Now()
+	err := f()
+	*l = append(*l, time.Since(start))
+	return err
+}
+
+func (l latencies) report(b *testing.B) {
+	if len(l) == 0 {
+		return
+	}
+
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	b.ReportMetric(float64(l[len(l)/2].Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(l[len(l)*99/100].Nanoseconds()), "p99-ns")
+}
+
+func BenchmarkStat(b *testing.B) {
+	p := path.Join(mount(b), "file")
+	l := make(latencies, 0, b.N)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := l.time(func() error {
+			_, err := os.Stat(p)
+			return err
+		})
+
+		if err != nil {
+			b.Fatalf("Stat: %v", err)
+		}
+	}
+
+	b.StopTimer()
+	l.report(b)
+}
+
+func BenchmarkRandomRead(b *testing.B) {
+	f := open(b, path.Join(mount(b), "file"), syscall.O_RDONLY)
+	defer f.Close()
+
+	buf := make([]byte, readSize)
+	r := rand.New(rand.NewSource(1))
+	l := make(latencies, 0, b.N)
+
+	b.SetBytes(readSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		off := r.Int63n(fileSize/readSize) * readSize
+		err := l.time(func() error {
+			_, err := f.ReadAt(buf, off)
+			return err
+		})
+
+		if err != nil {
+			b.Fatalf("ReadAt: %v", err)
+		}
+	}
+
+	b.StopTimer()
+	l.report(b)
+}
+
+func BenchmarkSequentialWrite(b *testing.B) {
+	const (
+		total = 1 << 30
+		chunk = 1 << 20
+	)
+
+	f := open(b, path.Join(mount(b), "sink"), syscall.O_WRONLY)
+	defer f.Close()
+
+	buf := make([]byte, chunk)
+
+	b.SetBytes(total)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for off := int64(0); off < total; off += chunk {
+			if _, err := f.WriteAt(buf, off); err != nil {
+				b.Fatalf("WriteAt: %v", err)
+			}
+		}
+	}
+}
+
+func BenchmarkReadDir(b *testing.B) {
+	p := path.Join(mount(b), "dir")
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		f := open(b, p, syscall.O_RDONLY|syscall.O_DIRECTORY)
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			b.Fatalf("Readdirnames: %v", err)
+		}
+
+		if len(names) != dirEntries {
+			b.Fatalf("Read %d entries, want %d", len(names), dirEntries)
+		}
+	}
+
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)*dirEntries/time.Since(start).Seconds(), "entries/s")
+}
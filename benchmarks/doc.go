@@ -0,0 +1,35 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package benchmarks measures the throughput and latency of ops going through
+// this package's connection and dispatch path. Its benchmarks mount a trivial
+// in-memory file system, whose own work is next to nothing, and time:
+//
+//   - A storm of stat(2) calls, each looking up and getting the attributes of
+//     a file as the kernel is told to cache neither.
+//   - Small random reads, with direct IO so that each reaches the file system.
+//   - A sequential 1 GiB write, likewise with direct IO.
+//   - Reading a directory of a million entries.
+//
+// Latency percentiles are reported as extra metrics alongside ns/op. To
+// compare commits, run the benchmarks several times on each and feed the
+// outputs to benchstat:
+//
+//	go test ./benchmarks -run XXX -bench . -count 10 > new.txt
+//	benchstat old.txt new.txt
+//
+// They need to be able to mount file systems, and are skipped otherwise. See
+// package fusebench for comparing whole file systems, e.g. with ones built on
+// other FUSE libraries.
+package benchmarks
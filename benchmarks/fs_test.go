@@ -0,0 +1,217 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package benchmarks
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+const (
+	// The sizes of the file read by BenchmarkRandomRead, and of its reads.
+	fileSize = 1 << 20
+	readSize = 4 << 10
+
+	// The number of entries in the directory read by BenchmarkReadDir.
+	dirEntries = 1000000
+)
+
+const (
+	rootInode fuseops.InodeID = fuseops.RootInodeID + iota
+
+	// A read-only file of fileSize zero bytes.
+	fileInode
+
+	// A file discarding what is written to it.
+	sinkInode
+
+	// A directory of dirEntries entries, all referring to entryInode.
+	dirInode
+	entryInode
+)
+
+// Zero bytes to read from fileInode.
+var zeros = make([]byte, readSize)
+
+// A file system with a fixed tree that answers ops with as little work as it
+// can, so that the benchmarks measure what this package costs.
+type benchFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+// The attributes of the supplied inode, or nil if there is none.
+func attributes(id fuseops.InodeID) *fuseops.InodeAttributes {
+	switch id {
+	case rootInode, dirInode:
+		return &fuseops.InodeAttributes{Nlink: 1, Mode: 0755 | os.ModeDir}
+
+	case fileInode:
+		return &fuseops.InodeAttributes{Nlink: 1, Mode: 0444, Size: fileSize}
+
+	case sinkInode, entryInode:
+		return &fuseops.InodeAttributes{Nlink: 1, Mode: 0666}
+	}
+
+	return nil
+}
+
+func (fs *benchFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *benchFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	child := fuseops.InodeID(0)
+	switch op.Parent {
+	case rootInode:
+		switch op.Name {
+		case "file":
+			child = fileInode
+		case "sink":
+			child = sinkInode
+		case "dir":
+			child = dirInode
+		}
+
+	case dirInode:
+		if i, err := strconv.Atoi(op.Name); err == nil && i >= 0 && i < dirEntries {
+			child = entryInode
+		}
+	}
+
+	if child == 0 {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = child
+	op.Entry.Attributes = *attributes(child)
+	return nil
+}
+
+func (fs *benchFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	attrs := attributes(op.Inode)
+	if attrs == nil {
+		return fuse.ENOENT
+	}
+
+	op.Attributes = *attrs
+	return nil
+}
+
+func (fs *benchFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	attrs := attributes(op.Inode)
+	if attrs == nil {
+		return fuse.ENOENT
+	}
+
+	op.Attributes = *attrs
+	return nil
+}
+
+func (fs *benchFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *benchFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if op.Inode != dirInode {
+		return nil
+	}
+
+	for i := int(op.Offset); i < dirEntries; i++ {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  entryInode,
+			Name:   fmt.Sprintf("%07d", i),
+			Type:   fuseutil.DT_File,
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *benchFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+func (fs *benchFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.UseDirectIO = true
+	return nil
+}
+
+func (fs *benchFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	n := int64(len(zeros))
+	if rest := fileSize - op.Offset; rest < n {
+		n = rest
+	}
+
+	if op.Size < n {
+		n = op.Size
+	}
+
+	if n <= 0 {
+		return nil
+	}
+
+	op.Data = [][]byte{zeros[:n]}
+	op.BytesRead = int(n)
+	return nil
+}
+
+func (fs *benchFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return nil
+}
+
+func (fs *benchFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func (fs *benchFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
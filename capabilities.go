@@ -0,0 +1,209 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A feature that file systems can rely on only with some operating systems,
+// kernels or mount configurations. See Capabilities.
+type Capability string
+
+const (
+	// The kernel caches writes, per MountConfig.DisableWritebackCaching.
+	CapWritebackCache Capability = "WritebackCache"
+
+	// The kernel may send ReadDirPlusOp, per MountConfig.EnableReadDirPlus.
+	CapReadDirPlus Capability = "ReadDirPlus"
+
+	// Failing OpenFileOp or OpenDirOp with ENOSYS stops the kernel from sending
+	// them, per MountConfig.EnableNoOpenSupport and EnableNoOpendirSupport.
+	CapNoOpen    Capability = "NoOpen"
+	CapNoOpenDir Capability = "NoOpenDir"
+
+	// The kernel caches symlink targets, per MountConfig.EnableSymlinkCaching.
+	CapSymlinkCache Capability = "SymlinkCache"
+
+	// The kernel sends GetLkOp and SetLkOp for fcntl(2) and flock(2) locks, per
+	// MountConfig.EnablePosixLocks and EnableFlockLocks.
+	CapPosixLocks Capability = "PosixLocks"
+	CapFlockLocks Capability = "FlockLocks"
+
+	// The kernel sends IoctlOp for directories as well as files.
+	CapDirIoctl Capability = "DirIoctl"
+
+	// Ops creating inodes carry a security context, per
+	// MountConfig.EnableSecurityContext.
+	CapSecurityContext Capability = "SecurityContext"
+
+	// The kernel does I/O on the backing files of opens, per
+	// MountConfig.EnablePassthrough.
+	CapPassthrough Capability = "Passthrough"
+
+	// The kernel may send LseekOp for SEEK_DATA and SEEK_HOLE.
+	CapLseek Capability = "Lseek"
+
+	// MountConfig.MaxWrite is honoured.
+	CapMaxWrite Capability = "MaxWrite"
+
+	// Connection.NotifyStore and RetrieveCache work.
+	CapStoreRetrieve Capability = "StoreRetrieve"
+
+	// SetInodeAttributesOp may set the creation time, and
+	// InodeAttributes.Crtime is shown to users.
+	CapCrtime Capability = "Crtime"
+)
+
+// What a capability depends on.
+type capabilityInfo struct {
+	// The operating systems supporting it, or nil for all.
+	os func() bool
+
+	// The least minor version of the protocol it requires, if any.
+	minor uint32
+
+	// The init flags the kernel must have agreed to, if any.
+	flags  fusekernel.InitFlags
+	flags2 fusekernel.InitFlags2
+}
+
+var capabilities = map[Capability]capabilityInfo{
+	CapWritebackCache: {
+		os:    func() bool { return isLinux() || isFreeBSD() },
+		minor: 23,
+		flags: fusekernel.InitWritebackCache,
+	},
+	CapReadDirPlus: {
+		minor: 21,
+		flags: fusekernel.InitDoReaddirplus,
+	},
+	CapNoOpen: {
+		minor: 23,
+		flags: fusekernel.InitNoOpenSupport,
+	},
+	CapNoOpenDir: {
+		minor: 29,
+		flags: fusekernel.InitNoOpendirSupport,
+	},
+	CapSymlinkCache: {
+		minor: 28,
+		flags: fusekernel.InitCacheSymlinks,
+	},
+	CapPosixLocks: {
+		flags: fusekernel.InitPosixLocks,
+	},
+	CapFlockLocks: {
+		flags: fusekernel.InitFlockLocks,
+	},
+	CapDirIoctl: {
+		flags: fusekernel.InitHasIoctlDir,
+	},
+	CapSecurityContext: {
+		os:     isLinux,
+		flags2: fusekernel.InitSecurityCtx,
+	},
+	CapPassthrough: {
+		os:     isLinux,
+		flags2: fusekernel.InitPassthrough,
+	},
+	CapLseek: {
+		minor: 24,
+	},
+	CapMaxWrite: {
+		os: isLinux,
+	},
+	CapStoreRetrieve: {
+		os: isLinux,
+	},
+	CapCrtime: {
+		os: func() bool { return runtime.GOOS == "darwin" },
+	},
+}
+
+// Capabilities reports which capabilities the FUSE implementation of the
+// operating system the program runs on can provide, given a kernel speaking
+// the newest version of the protocol this package does. Whether a mount gets
+// them also depends on its kernel and configuration; see
+// Connection.Capabilities.
+func Capabilities() map[Capability]bool {
+	m := make(map[Capability]bool, len(capabilities))
+	for k, info := range capabilities {
+		m[k] = (info.os == nil || info.os()) &&
+			info.minor <= fusekernel.ProtoVersionMaxMinor
+	}
+
+	return m
+}
+
+// Capabilities reports which capabilities the connection has, according to
+// the operating system, the version of the protocol agreed with the kernel
+// and the features it agreed to, which depend on the MountConfig.
+func (c *Connection) Capabilities() map[Capability]bool {
+	m := Capabilities()
+	for k, info := range capabilities {
+		m[k] = m[k] &&
+			info.minor <= c.protocol.Minor &&
+			c.initFlags&info.flags == info.flags &&
+			c.initFlags2&info.flags2 == info.flags2
+	}
+
+	return m
+}
+
+// Returned, wrapped, by Mount when the kernel doesn't provide capabilities
+// listed in MountConfig.RequireCapabilities.
+type MissingCapabilitiesError struct {
+	Missing []Capability
+}
+
+func (e *MissingCapabilitiesError) Error() string {
+	names := make([]string, len(e.Missing))
+	for i, k := range e.Missing {
+		names[i] = string(k)
+	}
+
+	return fmt.Sprintf(
+		"required capabilities unavailable: %s",
+		strings.Join(names, ", "))
+}
+
+// Return an error if the connection lacks any of the capabilities the config
+// requires.
+func (c *Connection) checkRequiredCapabilities() error {
+	if len(c.cfg.RequireCapabilities) == 0 {
+		return nil
+	}
+
+	have := c.Capabilities()
+	var missing []Capability
+	for _, k := range c.cfg.RequireCapabilities {
+		if !have[k] {
+			missing = append(missing, k)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	return &MissingCapabilitiesError{Missing: missing}
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"runtime"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+func TestCapabilities(t *testing.T) {
+	caps := fuse.Capabilities()
+	if isDarwin := runtime.GOOS == "darwin"; caps[fuse.CapCrtime] != isDarwin {
+		t.Errorf("Crtime: %v on %s", caps[fuse.CapCrtime], runtime.GOOS)
+	}
+
+	if !caps[fuse.CapLseek] || !caps[fuse.CapPosixLocks] {
+		t.Errorf("Capabilities: %v", caps)
+	}
+
+	// A connection only has those the kernel agreed to; this one offered none.
+	_, c, hangUp := serve(t, fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}))
+	defer hangUp()
+
+	caps = c.Capabilities()
+	if !caps[fuse.CapLseek] {
+		t.Errorf("Lseek missing from %v", caps)
+	}
+
+	for _, k := range []fuse.Capability{fuse.CapWritebackCache, fuse.CapPosixLocks, fuse.CapReadDirPlus} {
+		if caps[k] {
+			t.Errorf("%s without the kernel agreeing to it", k)
+		}
+	}
+}
+
+func TestRequireCapabilities(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	dev := os.NewFile(uintptr(fds[0]), "dev")
+	kernel := os.NewFile(uintptr(fds[1]), "kernel")
+	defer kernel.Close()
+
+	// A kernel offering only POSIX locks.
+	in := fusekernel.InitIn{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+		Flags: uint32(fusekernel.InitPosixLocks),
+	}
+	sendRequest(t, kernel, fusekernel.OpInit, 0, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+
+	cfg := &fuse.MountConfig{
+		EnablePosixLocks:    true,
+		EnableReadDirPlus:   true,
+		RequireCapabilities: []fuse.Capability{fuse.CapReadDirPlus, fuse.CapPosixLocks, fuse.CapLseek},
+	}
+
+	_, err = fuse.NewConnection(cfg, dev)
+	var missing *fuse.MissingCapabilitiesError
+	if !errors.As(err, &missing) || !reflect.DeepEqual(missing.Missing, []fuse.Capability{fuse.CapReadDirPlus}) {
+		t.Fatalf("NewConnection: %v", err)
+	}
+
+	if r := readReply(t, kernel); r.errno != -int32(syscall.EPROTO) {
+		t.Errorf("Init reply: %+v", r)
+	}
+
+	// Unknown capabilities are refused up front.
+	cfg = &fuse.MountConfig{RequireCapabilities: []fuse.Capability{"Teleport"}}
+	if _, err := fuse.NewConnection(cfg, nil); err == nil {
+		t.Errorf("NewConnection accepted an unknown capability")
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"reflect"
+	"runtime/debug"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// How long after its reply an op is compared with its state at the time of
+// the reply, when checking for ops modified after being replied to.
+var concurrencyCheckDelay = 100 * time.Millisecond
+
+// State for an in-flight op kept when MountConfig.CheckConcurrency is set.
+type opCheck struct {
+	mu sync.Mutex
+
+	// The stack of the first call to Reply, if any.
+	//
+	// GUARDED_BY(mu)
+	replied []byte
+}
+
+// Log a diagnostic about the file system's use of an op.
+func (c *Connection) reportMisuse(format string, v ...interface{}) {
+	logger := c.errorLogger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	logger.Printf("fuse: "+format, v...)
+}
+
+// Check a call to Reply for the op with the supplied state, before anything
+// is done with the op. Return false if the reply must be dropped.
+//
+// LOCKS_EXCLUDED(state.check.mu)
+func (c *Connection) checkReply(
+	ctx context.Context,
+	state opState,
+	opErr error) bool {
+	check := state.check
+	check.mu.Lock()
+	first := check.replied
+	if first == nil {
+		check.replied = debug.Stack()
+	}
+	check.mu.Unlock()
+
+	if first != nil {
+		c.reportMisuse(
+			"%T replied to twice; dropping the second reply from:\n%s\n"+
+				"The first reply was from:\n%s",
+			state.op,
+			debug.Stack(),
+			first)
+
+		return false
+	}
+
+	if ctx.Err() != nil && opErr == nil {
+		c.reportMisuse(
+			"%T replied to successfully after its context was cancelled; "+
+				"long-running handlers should return once ctx.Done() is closed",
+			state.op)
+	}
+
+	c.watchForModification(state.op)
+	return true
+}
+
+// Arrange to report the op if its fields change shortly after now, which is
+// when it is replied to: this means that some goroutine kept using it. Only
+// the op struct itself is compared, not the buffers its slices refer to,
+// which are reused once it is replied to.
+func (c *Connection) watchForModification(op interface{}) {
+	v := reflect.ValueOf(op)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+
+	size := v.Elem().Type().Size()
+	if size == 0 {
+		return
+	}
+
+	// Compare the raw bytes of the struct, so that slices and pointers are
+	// compared by address and length rather than by what they refer to.
+	current := (*[1 << 30]byte)(unsafe.Pointer(v.Pointer()))[:size:size]
+	snapshot := append([]byte(nil), current...)
+
+	time.AfterFunc(concurrencyCheckDelay, func() {
+		if !bytes.Equal(snapshot, current) {
+			c.reportMisuse(
+				"%T modified after being replied to; ops must not be used once "+
+					"Reply is called, nor handled from several goroutines without "+
+					"synchronization",
+				op)
+		}
+	})
+}
+
+// Return the state to keep for checking an op, or nil if it isn't being
+// checked.
+func (c *Connection) checkable() *opCheck {
+	if !c.cfg.CheckConcurrency {
+		return nil
+	}
+
+	return &opCheck{}
+}
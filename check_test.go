@@ -0,0 +1,135 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A server that hands each op to a function on its own goroutine, which must
+// reply to it.
+type funcServer func(c *fuse.Connection, ctx context.Context, op interface{})
+
+func (f funcServer) ServeOps(c *fuse.Connection) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f(c, ctx, op)
+		}()
+	}
+}
+
+// An io.Writer passing on each write as a message.
+type messageWriter chan string
+
+func (w messageWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestCheckConcurrency(t *testing.T) {
+	messages := make(messageWriter, 10)
+	cfg := &fuse.MountConfig{
+		ErrorLogger:      log.New(messages, "", 0),
+		CheckConcurrency: true,
+	}
+
+	started := make(chan struct{})
+	kernel, _, hangUp := serveWithConfig(t, cfg, funcServer(
+		func(c *fuse.Connection, ctx context.Context, op interface{}) {
+			switch op := op.(type) {
+			case *fuseops.StatFSOp:
+				// Replying twice.
+				c.Reply(ctx, nil)
+				c.Reply(ctx, nil)
+
+			case *fuseops.GetInodeAttributesOp:
+				// Modifying the op after replying.
+				c.Reply(ctx, nil)
+				op.AttributesExpiration = time.Now()
+
+			case *fuseops.FlushFileOp:
+				// Ignoring an interrupt.
+				close(started)
+				<-ctx.Done()
+				c.Reply(ctx, nil)
+
+			default:
+				c.Reply(ctx, nil)
+			}
+		}))
+	defer hangUp()
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case m := <-messages:
+			if !strings.Contains(m, want) {
+				t.Errorf("Logged %q, want %q", m, want)
+			}
+
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Nothing logged, want %q", want)
+		}
+	}
+
+	sendRequest(t, kernel, fusekernel.OpStatfs, 1, nil)
+	if r := readReply(t, kernel); r.unique != 1 {
+		t.Errorf("StatFS reply: %+v", r)
+	}
+
+	expect("StatFSOp replied to twice")
+
+	// The race detector rightly objects to this one.
+	if !raceEnabled {
+		sendRequest(t, kernel, fusekernel.OpGetattr, 2, make([]byte, unsafe.Sizeof(fusekernel.GetattrIn{})))
+		if r := readReply(t, kernel); r.unique != 2 {
+			t.Errorf("GetInodeAttributes reply: %+v", r)
+		}
+
+		expect("GetInodeAttributesOp modified after being replied to")
+	}
+
+	sendRequest(t, kernel, fusekernel.OpFlush, 3, make([]byte, unsafe.Sizeof(fusekernel.FlushIn{})))
+	<-started
+
+	in := fusekernel.InterruptIn{Unique: 3}
+	sendRequest(t, kernel, fusekernel.OpInterrupt, 4, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+	if r := readReply(t, kernel); r.unique != 3 {
+		t.Errorf("Flush reply: %+v", r)
+	}
+
+	expect("FlushFileOp replied to successfully after its context was cancelled")
+
+}
@@ -0,0 +1,35 @@
+package fuse
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// Open another device attached to the connection of dev, through which
+// requests can be read concurrently with those read through dev. Replies must
+// be written to the device their request was read from.
+func cloneFuseDevice(dev *os.File) (*os.File, error) {
+	// Blocking, like the device passed back by the mount; see directmount.
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	src := uint32(dev.Fd())
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		uintptr(fd),
+		fusekernel.DevIocClone,
+		uintptr(unsafe.Pointer(&src)))
+
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, &os.SyscallError{Syscall: "FUSE_DEV_IOC_CLONE", Err: errno}
+	}
+
+	return os.NewFile(uintptr(fd), "/dev/fuse"), nil
+}
@@ -24,6 +24,7 @@ import (
 	"runtime"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/folays/jacobsa_fuse/fuseops"
 	"github.com/folays/jacobsa_fuse/internal/buffer"
@@ -66,6 +67,26 @@ type Connection struct {
 	dev      *os.File
 	protocol fusekernel.Protocol
 
+	// The user who mounted the file system. See MountConfig.AllowRoot.
+	owner uint32
+
+	// The init flags agreed with the kernel, set once by Init.
+	initFlags  fusekernel.InitFlags
+	initFlags2 fusekernel.InitFlags2
+
+	// The transfer sizes agreed with the kernel, set once by Init. The largest
+	// write sizes the buffers requests are read into.
+	limits TransferLimits
+
+	// The congestion threshold agreed with the kernel, set once by Init, and
+	// the soft timeout of ops when below it. See deadline.go.
+	congestionThreshold uint16
+	softOpTimeout       time.Duration
+
+	// Serializes writes to the device when it is a stream socket (fuse-t), on
+	// which concurrent replies could otherwise interleave.
+	wmu sync.Mutex
+
 	mu sync.Mutex
 
 	// A map from fuse "unique" request ID (*not* the op ID for logging used
@@ -74,6 +95,91 @@ type Connection struct {
 	// GUARDED_BY(mu)
 	cancelFuncs map[uint64]func()
 
+	// Set once we conclude that the kernel end of the connection was torn down
+	// rather than unmounted in an orderly fashion.
+	//
+	// GUARDED_BY(mu)
+	lost *ConnectionLostError
+
+	// While the file system is frozen, a channel closed when it is thawed, and
+	// the policy for ops that would modify it. See freeze.go.
+	//
+	// GUARDED_BY(mu)
+	thawed       chan struct{}
+	freezePolicy FreezePolicy
+
+	// The request IDs of the ops admitted by WaitForThaw that haven't been
+	// replied to, and a channel to close when the last of them is, if Freeze
+	// is waiting for that.
+	//
+	// GUARDED_BY(mu)
+	mutating map[uint64]struct{}
+	drained  chan struct{}
+
+	// Once Shutdown has been called, a channel closed when no ops are left in
+	// flight. See shutdown.go.
+	//
+	// GUARDED_BY(mu)
+	idle chan struct{}
+
+	// The ops in flight whose replies are tracked for the interrupt policy,
+	// by request ID. See interrupt.go.
+	//
+	// GUARDED_BY(mu)
+	claims map[uint64]*replyClaim
+
+	// The calls to RetrieveCache waiting for the kernel's answer, by the
+	// unique ID sent with them, and the next ID to use. See notify.go.
+	//
+	// GUARDED_BY(mu)
+	retrievals    map[uint64]*retrieval
+	nextRetrieval uint64
+
+	// The file handles opened with direct IO. See short_io.go.
+	//
+	// GUARDED_BY(mu)
+	directIO map[fuseops.HandleID]struct{}
+
+	// The offset following the last read on each file handle. See
+	// readahead.go.
+	//
+	// GUARDED_BY(mu)
+	readEnds map[fuseops.HandleID]int64
+
+	// The statistics of the open file handles, if
+	// MountConfig.EnableHandleStats is set. See handle_stats.go.
+	//
+	// GUARDED_BY(mu)
+	handleStats map[fuseops.HandleID]*fuseops.HandleStats
+
+	// The IDs of the backing files registered for open handles. See
+	// passthrough.go.
+	//
+	// GUARDED_BY(mu)
+	backingIDs map[fuseops.HandleID]int32
+
+	// The ops in flight by request ID, and the errors replied with recently,
+	// if MountConfig.EnableDebugServer is set. See debug_server.go.
+	//
+	// GUARDED_BY(mu)
+	debugOps     map[uint64]debugOp
+	errorBuckets []errorBucket
+
+	// Runs the handlers of ops for servers. See schedule.go.
+	sched *scheduler
+
+	// The readers started if MountConfig.DeviceReaders is above one, the
+	// channel through which they pass what they read on to ReadOp, and the
+	// channel closed to stop them. Set once by newConnection. See readers.go.
+	readers     []*deviceReader
+	reads       chan readResult
+	stopReading chan struct{}
+	readersDone sync.WaitGroup
+
+	// The immutable and append-only inodes we know of, on Linux, whose kernel
+	// leaves enforcing them to us. Nil elsewhere.
+	inodeFlags *inodeFlagTracker
+
 	// Freelists, serviced by freelists.go.
 	inMessages  freelist.Freelist // GUARDED_BY(mu)
 	outMessages freelist.Freelist // GUARDED_BY(mu)
@@ -85,6 +191,28 @@ type opState struct {
 	inMsg  *buffer.InMessage
 	outMsg *buffer.OutMessage
 	op     interface{}
+
+	// The reader that read the op, if MountConfig.DeviceReaders is above one.
+	// See readers.go.
+	reader *deviceReader
+
+	// When the op was read, if MountConfig.OpObserver is set.
+	start time.Time
+
+	// For ops whose buffer may outlive the reply. See retain.go.
+	retain *retention
+
+	// If MountConfig.CheckConcurrency is set. See check.go.
+	check *opCheck
+
+	// Unless MountConfig.InterruptPolicy is InterruptCancel. See interrupt.go.
+	claim *replyClaim
+
+	// Ends the op's span, if MountConfig.OpTracer is set.
+	endSpan func(err error, bytes int)
+
+	// The op's soft deadline, if any. See deadline.go.
+	softDeadline time.Time
 }
 
 // Create a connection wrapping the supplied file descriptor connected to the
@@ -96,21 +224,54 @@ func newConnection(
 	debugLogger *log.Logger,
 	errorLogger *log.Logger,
 	dev *os.File) (*Connection, error) {
+	c := makeConnection(cfg, debugLogger, errorLogger, dev)
+
+	// Initialize.
+	if err := c.Init(); err != nil {
+		c.close()
+		return nil, fmt.Errorf("Init: %w", err)
+	}
+
+	if err := c.startReaders(); err != nil {
+		c.close()
+		return nil, fmt.Errorf("startReaders: %w", err)
+	}
+
+	return c, nil
+}
+
+// Create a connection over dev that has yet to perform its handshake with the
+// kernel.
+func makeConnection(
+	cfg MountConfig,
+	debugLogger *log.Logger,
+	errorLogger *log.Logger,
+	dev *os.File) *Connection {
 	c := &Connection{
 		cfg:         cfg,
 		debugLogger: debugLogger,
 		errorLogger: errorLogger,
 		dev:         dev,
+		owner:       uint32(os.Getuid()),
 		cancelFuncs: make(map[uint64]func()),
+		mutating:    make(map[uint64]struct{}),
+		claims:      make(map[uint64]*replyClaim),
+		retrievals:  make(map[uint64]*retrieval),
+		directIO:    make(map[fuseops.HandleID]struct{}),
+		readEnds:    make(map[fuseops.HandleID]int64),
+		handleStats: make(map[fuseops.HandleID]*fuseops.HandleStats),
+		backingIDs:  make(map[fuseops.HandleID]int32),
+		debugOps:    make(map[uint64]debugOp),
 	}
 
-	// Initialize.
-	if err := c.Init(); err != nil {
-		c.close()
-		return nil, fmt.Errorf("Init: %v", err)
+	c.sched = newScheduler(&c.cfg)
+	c.softOpTimeout = softOpTimeout(&c.cfg)
+
+	if isLinux() {
+		c.inodeFlags = newInodeFlagTracker()
 	}
 
-	return c, nil
+	return c
 }
 
 // Init performs the work necessary to cause the mount process to complete.
@@ -148,16 +309,38 @@ func (c *Connection) Init() error {
 		c.protocol = initOp.Kernel
 	}
 
+	kernelFlags := initOp.Flags
+	kernelFlags2 := initOp.Flags2
+	kernel := InitRequest{
+		Major:        initOp.Kernel.Major,
+		Minor:        initOp.Kernel.Minor,
+		MaxReadahead: initOp.MaxReadahead,
+		Flags:        uint32(initOp.Flags),
+		Flags2:       uint32(initOp.Flags2),
+	}
+
 	cacheSymlinks := initOp.Flags&fusekernel.InitCacheSymlinks > 0
 	noOpenSupport := initOp.Flags&fusekernel.InitNoOpenSupport > 0
 	noOpendirSupport := initOp.Flags&fusekernel.InitNoOpendirSupport > 0
+	readDirPlus := initOp.Flags&fusekernel.InitDoReaddirplus > 0
 
 	// Respond to the init op.
 	initOp.Library = c.protocol
 	initOp.MaxReadahead = maxReadahead
+	if c.cfg.MaxReadahead != 0 {
+		initOp.MaxReadahead = c.cfg.MaxReadahead
+	}
+
 	initOp.MaxWrite = buffer.MaxWriteSize
+	if isLinux() && c.cfg.MaxWrite != 0 {
+		initOp.MaxWrite = c.cfg.MaxWrite
+	}
+
+	initOp.MaxBackground = 12
+	initOp.CongestionThreshold = 9
 
 	initOp.Flags = 0
+	initOp.Flags2 = 0
 
 	// Tell the kernel not to use pitifully small 4 KiB writes.
 	initOp.Flags |= fusekernel.InitBigWrites
@@ -168,7 +351,10 @@ func (c *Connection) Init() error {
 
 	// kernel 4.20 increases the max from 32 -> 256
 	initOp.Flags |= fusekernel.InitMaxPages
-	initOp.MaxPages = 256
+	initOp.MaxPages = maxInitMaxPages
+	if c.cfg.MaxPages != 0 {
+		initOp.MaxPages = c.cfg.MaxPages
+	}
 
 	// Enable writeback caching if the user hasn't asked us not to.
 	if !c.cfg.DisableWritebackCaching {
@@ -193,10 +379,81 @@ func (c *Connection) Init() error {
 		initOp.Flags |= fusekernel.InitNoOpendirSupport
 	}
 
+	// Let the kernel use ReadDirPlus when it thinks it worthwhile (Linux >= 3.9):
+	if c.cfg.EnableReadDirPlus && readDirPlus {
+		initOp.Flags |= fusekernel.InitDoReaddirplus | fusekernel.InitReaddirplusAuto
+	}
+
+	// Receive ioctls on directories too, so that chattr(1) works on them.
+	initOp.Flags |= fusekernel.InitHasIoctlDir
+
+	// Have the kernel send lock requests rather than handle locks itself.
+	if c.cfg.EnablePosixLocks {
+		initOp.Flags |= fusekernel.InitPosixLocks
+	}
+
+	if c.cfg.EnableFlockLocks {
+		initOp.Flags |= fusekernel.InitFlockLocks
+	}
+
+	// Receive the security context of new inodes (Linux >= 5.17).
+	if c.cfg.EnableSecurityContext && kernelFlags2&fusekernel.InitSecurityCtx != 0 {
+		initOp.Flags |= fusekernel.InitInitExt
+		initOp.Flags2 |= fusekernel.InitSecurityCtx
+	}
+
+	// Let the kernel do I/O on backing files (Linux >= 6.9).
+	if c.cfg.EnablePassthrough && kernelFlags2&fusekernel.InitPassthrough != 0 {
+		initOp.Flags |= fusekernel.InitInitExt
+		initOp.Flags2 |= fusekernel.InitPassthrough
+	}
+
+	c.adjustInit(initOp, kernel)
+
+	// Only ask for what the kernel offered. Kernels that restrict the features
+	// available to mounts made from within a user namespace don't advertise
+	// them, and we mustn't go on to assume we got them.
+	if isLinux() || isFreeBSD() {
+		initOp.Flags &= kernelFlags
+		initOp.Flags2 &= kernelFlags2
+	}
+
+	// Backing files may not themselves be on a stacked file system.
+	if initOp.Flags2&fusekernel.InitPassthrough != 0 {
+		initOp.MaxStackDepth = 1
+	}
+
+	c.initFlags = initOp.Flags
+	c.initFlags2 = initOp.Flags2
+	c.limits = agreedLimits(kernel, kernelFlags, initOp)
+	c.congestionThreshold = initOp.CongestionThreshold
+
+	// Refuse to go on without what the file system requires.
+	if err := c.checkRequiredCapabilities(); err != nil {
+		c.Reply(ctx, syscall.EPROTO)
+		return err
+	}
+
 	c.Reply(ctx, nil)
 	return nil
 }
 
+// Return the largest write the buffers requests are read into must have room
+// for.
+func (c *Connection) maxWrite() int {
+	if c.limits.MaxWrite == 0 {
+		return buffer.MaxWriteSize
+	}
+
+	return int(c.limits.MaxWrite)
+}
+
+// WritebackCaching reports whether the kernel caches writes to the file
+// system, as described by MountConfig.DisableWritebackCaching.
+func (c *Connection) WritebackCaching() bool {
+	return (isLinux() || isFreeBSD()) && c.initFlags&fusekernel.InitWritebackCache != 0
+}
+
 // Log information for an operation with the given ID. calldepth is the depth
 // to use when recovering file:line information with runtime.Caller.
 func (c *Connection) debugLog(
@@ -300,13 +557,16 @@ func (c *Connection) finishOp(
 
 		cancel()
 		delete(c.cancelFuncs, fuseID)
+		delete(c.debugOps, fuseID)
 	}
+
+	c.finishMutating(fuseID)
+	c.finishDraining()
 }
 
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) handleInterrupt(fuseID uint64) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 
 	// NOTE(jacobsa): fuse.txt in the Linux kernel documentation
 	// (https://goo.gl/H55Dnr) defines the kernel <-> userspace protocol for
@@ -318,32 +578,109 @@ func (c *Connection) handleInterrupt(fuseID uint64) {
 	// concurrently process requests (cf. http://goo.gl/BES2rs).
 	//
 	// So in this method if we can't find the ID to be interrupted, it means that
-	// the request has already been replied to.
+	// the request has already been replied to. That doesn't hold with several
+	// device readers, one of which may pass on an interrupt before another
+	// passes on the request; such interrupts are lost. See
+	// MountConfig.DeviceReaders.
 	//
 	// Cf. https://github.com/osxfuse/osxfuse/issues/208
 	// Cf. http://comments.gmane.org/gmane.comp.file-systems.fuse.devel/14675
 	cancel, ok := c.cancelFuncs[fuseID]
 	if !ok {
+		c.mu.Unlock()
 		return
 	}
 
 	cancel()
+
+	claim := c.claims[fuseID]
+	replyNow := c.interrupted(fuseID)
+	c.mu.Unlock()
+
+	if replyNow {
+		c.replyInterrupted(fuseID, claim)
+	}
+}
+
+// Return the number of ops read from the connection that have not yet been
+// responded to, not counting forget ops.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) opsInFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.cancelFuncs)
+}
+
+// Record that the connection was lost with the supplied error, unless an
+// earlier loss has already been recorded.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) noteLost(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lost == nil {
+		c.lost = &ConnectionLostError{
+			Err:      err,
+			InFlight: len(c.cancelFuncs),
+		}
+	}
+}
+
+// Called when reading from the device fails with ENODEV, which the kernel
+// returns both once an orderly unmount has completed and once the connection
+// has been aborted. An orderly unmount can't complete while the kernel is
+// waiting on us, so ops in flight mean the connection was aborted. Without
+// any, the two can't be told apart here; see isAbortedMount for what the
+// mount point tells us afterwards.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) noteHangUp() {
+	if c.opsInFlight() > 0 {
+		c.noteLost(syscall.ENODEV)
+	}
 }
 
-// Read the next message from the kernel. The message must later be destroyed
-// using destroyInMessage.
-func (c *Connection) readMessage() (*buffer.InMessage, error) {
+// Return the error recorded by noteLost, or nil if the connection has not been
+// lost.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) lostError() *ConnectionLostError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lost
+}
+
+// Read the next message from the kernel through the supplied reader's device,
+// or the connection's if nil. The message must later be returned with
+// putInMessage.
+func (c *Connection) readMessage(r *deviceReader) (*buffer.InMessage, error) {
+	dev := c.replyDevice(r)
+
 	// Allocate a message.
-	m := c.getInMessage()
+	m := c.getInMessage(r)
 
 	// Loop past transient errors.
 	for {
-		// Attempt a read.
-		err := m.Init(c.dev)
+		// Attempt a read. fuse-t relays messages over a stream socket, which
+		// doesn't preserve their boundaries.
+		var err error
+		if c.cfg.FuseImpl == FUSEImplFuseT {
+			err = m.InitFromStream(dev)
+		} else {
+			err = m.Init(dev)
+		}
 
 		// Special cases:
 		//
-		//  *  ENODEV means fuse has hung up.
+		//  *  ENODEV means fuse has hung up, perhaps by aborting the connection
+		//     (see noteHangUp).
+		//
+		//  *  EBADF means the device was closed underneath us, which is never
+		//     part of an orderly shutdown.
 		//
 		//  *  EINTR means we should try again. (This seems to happen often on
 		//     OS X, cf. http://golang.org/issue/11180)
@@ -351,6 +688,11 @@ func (c *Connection) readMessage() (*buffer.InMessage, error) {
 		if pe, ok := err.(*os.PathError); ok {
 			switch pe.Err {
 			case syscall.ENODEV:
+				c.noteHangUp()
+				err = io.EOF
+
+			case syscall.EBADF:
+				c.noteLost(pe.Err)
 				err = io.EOF
 
 			case syscall.EINTR:
@@ -360,7 +702,7 @@ func (c *Connection) readMessage() (*buffer.InMessage, error) {
 		}
 
 		if err != nil {
-			c.putInMessage(m)
+			c.putInMessage(r, m)
 			return nil, err
 		}
 
@@ -368,10 +710,10 @@ func (c *Connection) readMessage() (*buffer.InMessage, error) {
 	}
 }
 
-// Write the supplied message to the kernel.
-func (c *Connection) writeMessage(msg []byte) error {
+// Write the supplied message to the kernel through the supplied device.
+func (c *Connection) writeMessage(dev *os.File, msg []byte) error {
 	// Avoid the retry loop in os.File.Write.
-	n, err := syscall.Write(int(c.dev.Fd()), msg)
+	n, err := syscall.Write(int(dev.Fd()), msg)
 	if err != nil {
 		return err
 	}
@@ -383,38 +725,126 @@ func (c *Connection) writeMessage(msg []byte) error {
 	return nil
 }
 
+// Write all of the supplied segments to the stream socket fuse-t relays
+// messages over, which unlike /dev/fuse may accept only some of them.
+func (c *Connection) writeStream(segments [][]byte) error {
+	// Don't disturb the caller's slices as we skip past what was written.
+	segments = append([][]byte(nil), segments...)
+
+	for {
+		segments = skipWritten(segments, 0)
+		if len(segments) == 0 {
+			return nil
+		}
+
+		n, err := writev(int(c.dev.Fd()), segments)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		segments = skipWritten(segments, n)
+	}
+}
+
+// Return what remains of the supplied segments once n bytes of them have been
+// written, without any leading empty segments.
+func skipWritten(segments [][]byte, n int) [][]byte {
+	for len(segments) != 0 && n >= len(segments[0]) {
+		n -= len(segments[0])
+		segments = segments[1:]
+	}
+
+	if n != 0 {
+		segments[0] = segments[0][n:]
+	}
+
+	return segments
+}
+
+// Write the supplied message to the kernel, along with any segments beyond its
+// header, through the supplied device. Replies must go through the device
+// their request was read from; see replyDevice.
+func (c *Connection) writeOutMessage(
+	dev *os.File,
+	m *buffer.OutMessage) error {
+	if c.cfg.FuseImpl == FUSEImplFuseT {
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+	}
+
+	var err error
+	switch {
+	case c.cfg.FuseImpl == FUSEImplFuseT:
+		segments := m.Sglist
+		if segments == nil {
+			segments = [][]byte{m.OutHeaderBytes()}
+		}
+
+		err = c.writeStream(segments)
+
+	case m.Sglist != nil:
+		_, err = writev(int(dev.Fd()), m.Sglist)
+
+	default:
+		err = c.writeMessage(dev, m.OutHeaderBytes())
+	}
+
+	// The kernel refuses writes once the connection has been aborted.
+	if err == syscall.ENODEV {
+		c.noteLost(err)
+	}
+
+	return err
+}
+
 // ReadOp consumes the next op from the kernel process, returning the op and a
 // context that should be used for work related to the op. It returns io.EOF if
 // the kernel has closed the connection.
 //
+// The context is cancelled if the kernel interrupts the op, e.g. because the
+// process waiting for it got a signal. Replying with context.Canceled then
+// returns EINTR to the kernel.
+//
 // If err != nil, the user is responsible for later calling c.Reply with the
 // returned context.
 //
 // This function delivers ops in exactly the order they are received from
-// /dev/fuse. It must not be called multiple times concurrently.
+// /dev/fuse, unless MountConfig.DeviceReaders is above one, in which case ops
+// read concurrently through different devices are delivered in the order
+// their readers pass them on. It must not be called multiple times
+// concurrently.
 //
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 	// Keep going until we find a request we know how to convert.
 	for {
 		// Read the next message from the kernel.
-		inMsg, err := c.readMessage()
+		inMsg, reader, err := c.nextMessage()
 		if err != nil {
 			return nil, nil, err
 		}
 
 		// Convert the message to an op.
 		outMsg := c.getOutMessage()
-		op, err = convertInMessage(&c.cfg, inMsg, outMsg, c.protocol)
+		op, err = convertInMessage(&c.cfg, inMsg, outMsg, c.protocol, c.initFlags2)
 		if err != nil {
 			c.putOutMessage(outMsg)
 			return nil, nil, fmt.Errorf("convertInMessage: %v", err)
 		}
 
+		// Guess which reads come from readahead. See readahead.go.
+		c.noteRead(op)
+		c.releaseHandleStats(op)
+
 		// Choose an ID for this operation for the purposes of logging, and log it.
 		if c.debugLogger != nil {
 			c.debugLog(inMsg.Header().Unique, 1, "<- %s", describeRequest(op))
 		}
+		c.logRequest(op, inMsg.Header().Unique)
 
 		// Special case: handle interrupt requests inline.
 		if interruptOp, ok := op.(*interruptOp); ok {
@@ -422,9 +852,65 @@ func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 			continue
 		}
 
+		// Likewise for the answers to RetrieveCache.
+		if reply, ok := op.(*notifyReplyOp); ok {
+			c.handleNotifyReply(reply)
+			c.putOutMessage(outMsg)
+			c.putInMessage(reader, inMsg)
+			continue
+		}
+
 		// Set up a context that remembers information about this op.
 		ctx := c.beginOp(inMsg.Header().Opcode, inMsg.Header().Unique)
-		ctx = context.WithValue(ctx, contextKey, opState{inMsg, outMsg, op})
+		c.noteDebugOp(inMsg.Header().Unique, op)
+		state := opState{
+			inMsg:  inMsg,
+			outMsg: outMsg,
+			op:     op,
+			reader: reader,
+			retain: c.retainable(op),
+			check:  c.checkable(),
+			claim:  c.claimable(op, inMsg.Header().Unique, reader),
+
+			softDeadline: c.softDeadline(),
+		}
+		if c.cfg.OpObserver != nil || c.cfg.OpLogger != nil {
+			state.start = time.Now()
+		}
+		if c.cfg.OpTracer != nil {
+			ctx, state.endSpan = c.cfg.OpTracer.StartSpan(ctx, c.opSpan(op))
+		}
+		ctx = context.WithValue(ctx, contextKey, state)
+
+		if c.cfg.OpStartObserver != nil {
+			c.cfg.OpStartObserver(op)
+		}
+
+		// Turn away ops arriving while shutting down. See shutdown.go.
+		if c.shuttingDown(op) {
+			c.Reply(ctx, syscall.ENOTCONN)
+			continue
+		}
+
+		// Refuse names that are too long for file systems to handle.
+		if err := checkNameLengths(op); err != nil {
+			c.Reply(ctx, err)
+			continue
+		}
+
+		// Refuse ops from other users if only root may share the mount.
+		if err := c.checkAllowRoot(op, inMsg.Header().Uid); err != nil {
+			c.Reply(ctx, err)
+			continue
+		}
+
+		// Refuse to modify immutable and append-only inodes.
+		if c.inodeFlags != nil {
+			if err := c.inodeFlags.check(op); err != nil {
+				c.Reply(ctx, err)
+				continue
+			}
+		}
 
 		// Return the op to the user.
 		return ctx, op, nil
@@ -445,26 +931,32 @@ func (c *Connection) shouldLogError(
 		return false
 	}
 
+	return !isExpectedError(op, err)
+}
+
+// Report whether an op failing with the supplied error is a normal occurrence
+// rather than a sign of trouble.
+func isExpectedError(op interface{}, err error) bool {
 	switch op.(type) {
 	case *fuseops.LookUpInodeOp:
 		// It is totally normal for the kernel to ask to look up an inode by name
 		// and find the name doesn't exist. For example, this happens when linking
 		// a new file.
 		if err == syscall.ENOENT {
-			return false
+			return true
 		}
 	case *fuseops.GetXattrOp, *fuseops.ListXattrOp:
-		if err == syscall.ENODATA || err == syscall.ERANGE {
-			return false
+		if err == ENOATTR || err == syscall.ERANGE {
+			return true
 		}
 	case *unknownOp:
 		// Don't bother the user with methods we intentionally don't support.
 		if err == syscall.ENOSYS {
-			return false
+			return true
 		}
 	}
 
-	return true
+	return false
 }
 
 // Reply replies to an op previously read using ReadOp, with the supplied error
@@ -480,15 +972,40 @@ func (c *Connection) Reply(ctx context.Context, opErr error) {
 		panic(fmt.Sprintf("Reply called with invalid context: %#v", ctx))
 	}
 
+	if state.check != nil && !c.checkReply(ctx, state, opErr) {
+		return
+	}
+
 	op := state.op
 	inMsg := state.inMsg
 	outMsg := state.outMsg
 	fuseID := inMsg.Header().Unique
 
 	// Make sure we destroy the messages when we're done.
-	defer c.putInMessage(inMsg)
+	defer c.releaseInMessage(state)
 	defer c.putOutMessage(outMsg)
 
+	// Drop the reply to an op that was given up on when interrupted or timed
+	// out.
+	if state.claim != nil && !c.claimReply(state.claim, fuseID) {
+		sent := state.claim.sent
+		if c.debugLogger != nil {
+			c.debugLog(fuseID, 1, "-> Dropped, error %q already sent", sent.Error())
+		}
+
+		c.logReply(op, fuseID, state.start, sent)
+
+		if state.endSpan != nil {
+			state.endSpan(sent, 0)
+		}
+
+		if c.cfg.OpObserver != nil {
+			c.cfg.OpObserver(op, state.start, sent)
+		}
+
+		return
+	}
+
 	// Clean up state for this op.
 	c.finishOp(inMsg.Header().Opcode, inMsg.Header().Unique)
 
@@ -506,26 +1023,46 @@ func (c *Connection) Reply(ctx context.Context, opErr error) {
 		c.errorLogger.Printf("%T error: %v", op, opErr)
 	}
 
+	c.logReply(op, fuseID, state.start, opErr)
+
+	// Learn of flagged inodes before the kernel can act on the reply.
+	if opErr == nil && c.inodeFlags != nil {
+		c.inodeFlags.observe(op)
+	}
+
+	// Likewise for handles opened with direct IO.
+	c.noteDirectIO(op, opErr)
+	c.noteHandleUse(op, opErr)
+
 	// Send the reply to the kernel, if one is required.
 	noResponse := c.kernelResponse(outMsg, inMsg.Header().Unique, op, opErr)
 
 	if !noResponse {
-		var err error
-		if outMsg.Sglist != nil {
-			_, err = writev(int(c.dev.Fd()), outMsg.Sglist)
-		} else {
-			err = c.writeMessage(outMsg.OutHeaderBytes())
-		}
+		backingID := c.openPassthrough(op, opErr, outMsg)
+		err := c.writeOutMessage(c.replyDevice(state.reader), outMsg)
 		if err != nil && c.errorLogger != nil {
 			c.errorLogger.Printf("writeMessage: %v %v", err, outMsg.OutHeaderBytes())
 		}
 		outMsg.Sglist = nil
+
+		c.noteBacking(op, backingID, err)
+	}
+
+	if state.endSpan != nil {
+		state.endSpan(opErr, opBytes(op, opErr))
+	}
+
+	if c.cfg.OpObserver != nil {
+		c.cfg.OpObserver(op, state.start, opErr)
 	}
 }
 
 // Close the connection. Must not be called until operations that were read
-// from the connection have been responded to.
+// from the connection have been responded to, nor, with several device
+// readers, until the kernel has hung up.
 func (c *Connection) close() error {
+	c.stopReaders()
+
 	// Posix doesn't say that close can be called concurrently with read or
 	// write, but luckily we exclude the possibility of a race by requiring the
 	// user to respond to all ops first.
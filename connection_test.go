@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestConnectionLost(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	c := &Connection{
+		dev:         r,
+		cancelFuncs: make(map[uint64]func()),
+	}
+
+	t.Run("in flight", func(t *testing.T) {
+		c.recordCancelFunc(17, func() {})
+		c.noteLost(syscall.ENODEV)
+		c.finishOp(0, 17)
+
+		lost := c.lostError()
+		if lost == nil || lost.Err != syscall.ENODEV || lost.InFlight != 1 {
+			t.Errorf("expected ENODEV with one op in flight, got %#v", lost)
+		}
+
+		c.lost = nil
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		// With nothing in flight, a hang-up may be an orderly unmount.
+		c.noteHangUp()
+		if lost := c.lostError(); lost != nil {
+			t.Errorf("expected no loss, got %#v", lost)
+		}
+
+		// A plain directory isn't an aborted mount. One whose connection was
+		// aborted fails with ENOTCONN instead, which takes a real mount.
+		if isAbortedMount(t.TempDir()) {
+			t.Errorf("temporary directory reported as an aborted mount")
+		}
+	})
+
+	t.Run("device closed", func(t *testing.T) {
+		// Stand in a descriptor that isn't open, as happens when something else
+		// in the process closes the device behind the os.File's back. Actually
+		// closing r's descriptor would leave r to close it again once
+		// finalized, by which time the number may belong to another test.
+		c.dev = os.NewFile(1<<30, "closed")
+
+		if _, _, err := c.ReadOp(); err != io.EOF {
+			t.Errorf("expected io.EOF, got %v", err)
+		}
+
+		var lost *ConnectionLostError
+		if err := error(c.lostError()); !errors.As(err, &lost) || !errors.Is(err, syscall.EBADF) {
+			t.Errorf("expected a ConnectionLostError wrapping EBADF, got %v", err)
+		}
+	})
+}
+
+func TestSkipWritten(t *testing.T) {
+	segments := [][]byte{[]byte("ab"), nil, []byte("cde"), []byte("f")}
+
+	// Part of the second non-empty segment was written.
+	rest := skipWritten(segments, 3)
+	if len(rest) != 2 || string(rest[0]) != "de" || string(rest[1]) != "f" {
+		t.Errorf("after 3 bytes: %q", rest)
+	}
+
+	// A whole segment was written, and the empty one after it is skipped.
+	rest = skipWritten([][]byte{[]byte("ab"), nil, []byte("c")}, 2)
+	if len(rest) != 1 || string(rest[0]) != "c" {
+		t.Errorf("after 2 bytes: %q", rest)
+	}
+
+	if rest := skipWritten([][]byte{[]byte("ab"), []byte("c"), nil}, 3); len(rest) != 0 {
+		t.Errorf("after everything: %q", rest)
+	}
+}
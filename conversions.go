@@ -16,6 +16,7 @@ package fuse
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -26,6 +27,7 @@ import (
 
 	"github.com/folays/jacobsa_fuse/fuseops"
 	"github.com/folays/jacobsa_fuse/internal/buffer"
+	"github.com/folays/jacobsa_fuse/internal/convert"
 	"github.com/folays/jacobsa_fuse/internal/fusekernel"
 )
 
@@ -41,7 +43,8 @@ func convertInMessage(
 	config *MountConfig,
 	inMsg *buffer.InMessage,
 	outMsg *buffer.OutMessage,
-	protocol fusekernel.Protocol) (o interface{}, err error) {
+	protocol fusekernel.Protocol,
+	flags2 fusekernel.InitFlags2) (o interface{}, err error) {
 	switch inMsg.Header().Opcode {
 	case fusekernel.OpLookup:
 		buf := inMsg.ConsumeBytes(inMsg.Len())
@@ -53,13 +56,13 @@ func convertInMessage(
 		o = &fuseops.LookUpInodeOp{
 			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(buf[:n-1]),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpGetattr:
 		o = &fuseops.GetInodeAttributesOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpSetattr:
@@ -71,7 +74,7 @@ func convertInMessage(
 
 		to := &fuseops.SetInodeAttributesOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 		o = to
 
@@ -96,11 +99,18 @@ func convertInMessage(
 		if valid&fusekernel.SetattrAtime != 0 {
 			t := time.Unix(int64(in.Atime), int64(in.AtimeNsec))
 			to.Atime = &t
+			to.AtimeNow = valid.AtimeNow()
 		}
 
 		if valid&fusekernel.SetattrMtime != 0 {
 			t := time.Unix(int64(in.Mtime), int64(in.MtimeNsec))
 			to.Mtime = &t
+			to.MtimeNow = valid.MtimeNow()
+		}
+
+		if valid.Ctime() {
+			t := time.Unix(int64(in.Ctime), int64(in.CtimeNsec))
+			to.Ctime = &t
 		}
 
 		if valid.Handle() {
@@ -108,6 +118,29 @@ func convertInMessage(
 			to.Handle = &t
 		}
 
+		if valid.Crtime() {
+			t := (*fusekernel.SetattrIn)(in).Crtime()
+			to.Crtime = &t
+		}
+
+		if valid.Bkuptime() {
+			t := (*fusekernel.SetattrIn)(in).BkupTime()
+			to.Bkuptime = &t
+		}
+
+	case fusekernel.OpAccess:
+		type input fusekernel.AccessIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpAccess")
+		}
+
+		o = &fuseops.AccessOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Mask:      in.Mask,
+			OpContext: convertOpContext(inMsg),
+		}
+
 	case fusekernel.OpForget:
 		type input fusekernel.ForgetIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -118,7 +151,7 @@ func convertInMessage(
 		o = &fuseops.ForgetInodeOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			N:         in.Nlookup,
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpBatchForget:
@@ -144,7 +177,7 @@ func convertInMessage(
 
 		o = &fuseops.BatchForgetOp{
 			Entries:   entries,
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpMkdir:
@@ -158,6 +191,11 @@ func convertInMessage(
 		if i < 0 {
 			return nil, errors.New("Corrupt OpMkdir")
 		}
+
+		secctx, ok := convertSecurityContext(flags2, name[i+1:])
+		if !ok {
+			return nil, errors.New("Corrupt OpMkdir")
+		}
 		name = name[:i]
 
 		o = &fuseops.MkDirOp{
@@ -170,8 +208,9 @@ func convertInMessage(
 			// the fact that this is a directory is implicit in the fact that the
 			// opcode is mkdir. But we want the correct mode to go through, so ensure
 			// that os.ModeDir is set.
-			Mode:      convertFileMode(in.Mode) | os.ModeDir,
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			Mode:            convertFileMode(in.Mode) | os.ModeDir,
+			SecurityContext: secctx,
+			OpContext:       convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpMknod:
@@ -185,13 +224,20 @@ func convertInMessage(
 		if i < 0 {
 			return nil, errors.New("Corrupt OpMknod")
 		}
+
+		secctx, ok := convertSecurityContext(flags2, name[i+1:])
+		if !ok {
+			return nil, errors.New("Corrupt OpMknod")
+		}
 		name = name[:i]
 
 		o = &fuseops.MkNodeOp{
-			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:      string(name),
-			Mode:      convertFileMode(in.Mode),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			Parent:          fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:            string(name),
+			Mode:            convertFileMode(in.Mode),
+			Rdev:            in.Rdev,
+			SecurityContext: secctx,
+			OpContext:       convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpCreate:
@@ -205,32 +251,47 @@ func convertInMessage(
 		if i < 0 {
 			return nil, errors.New("Corrupt OpCreate")
 		}
+
+		secctx, ok := convertSecurityContext(flags2, name[i+1:])
+		if !ok {
+			return nil, errors.New("Corrupt OpCreate")
+		}
 		name = name[:i]
 
 		o = &fuseops.CreateFileOp{
-			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:      string(name),
-			Mode:      convertFileMode(in.Mode),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			Parent:          fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:            string(name),
+			Mode:            convertFileMode(in.Mode),
+			OpenFlags:       fusekernel.OpenFlags(in.Flags),
+			SecurityContext: secctx,
+			OpContext:       convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpSymlink:
-		// The message is "newName\0target\0".
+		// The message is "newName\0target\0", followed by the security context
+		// if it was asked for.
 		names := inMsg.ConsumeBytes(inMsg.Len())
-		if len(names) == 0 || names[len(names)-1] != 0 {
-			return nil, errors.New("Corrupt OpSymlink")
-		}
 		i := bytes.IndexByte(names, '\x00')
 		if i < 0 {
 			return nil, errors.New("Corrupt OpSymlink")
 		}
-		newName, target := names[0:i], names[i+1:len(names)-1]
+		j := bytes.IndexByte(names[i+1:], '\x00')
+		if j < 0 {
+			return nil, errors.New("Corrupt OpSymlink")
+		}
+		newName, target := names[0:i], names[i+1:i+1+j]
+
+		secctx, ok := convertSecurityContext(flags2, names[i+1+j+1:])
+		if !ok {
+			return nil, errors.New("Corrupt OpSymlink")
+		}
 
 		o = &fuseops.CreateSymlinkOp{
-			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:      string(newName),
-			Target:    string(target),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			Parent:          fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:            string(newName),
+			Target:          string(target),
+			SecurityContext: secctx,
+			OpContext:       convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpRename:
@@ -254,25 +315,48 @@ func convertInMessage(
 			names[4] == 0 && names[5] == 0 && names[6] == 0 && names[7] == 0 {
 			names = names[8:]
 		}
-		// names should be "old\x00new\x00"
-		if len(names) < 4 {
+		oldName, newName, ok := splitRenameNames(names)
+		if !ok {
 			return nil, errors.New("Corrupt OpRename")
 		}
-		if names[len(names)-1] != '\x00' {
-			return nil, errors.New("Corrupt OpRename")
+
+		o = &fuseops.RenameOp{
+			OldParent: fuseops.InodeID(inMsg.Header().Nodeid),
+			OldName:   oldName,
+			NewParent: fuseops.InodeID(in.Newdir),
+			NewName:   newName,
+			OpContext: convertOpContext(inMsg),
 		}
-		i := bytes.IndexByte(names, '\x00')
-		if i < 0 {
-			return nil, errors.New("Corrupt OpRename")
+
+	case fusekernel.OpRename2:
+		// Without the option, have the kernel fail renameat2(2) calls with flags
+		// with EINVAL, as it does once we answer ENOSYS.
+		if !config.EnableRenameFlags {
+			o = &unknownOp{
+				OpCode: inMsg.Header().Opcode,
+				Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			}
+			break
+		}
+
+		type input fusekernel.Rename2In
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpRename2")
+		}
+
+		oldName, newName, ok := splitRenameNames(inMsg.ConsumeBytes(inMsg.Len()))
+		if !ok {
+			return nil, errors.New("Corrupt OpRename2")
 		}
-		oldName, newName := names[:i], names[i+1:len(names)-1]
 
 		o = &fuseops.RenameOp{
 			OldParent: fuseops.InodeID(inMsg.Header().Nodeid),
-			OldName:   string(oldName),
+			OldName:   oldName,
 			NewParent: fuseops.InodeID(in.Newdir),
-			NewName:   string(newName),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			NewName:   newName,
+			Flags:     fuseops.RenameFlags(in.Flags),
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpUnlink:
@@ -285,7 +369,7 @@ func convertInMessage(
 		o = &fuseops.UnlinkOp{
 			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(buf[:n-1]),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpRmdir:
@@ -298,7 +382,7 @@ func convertInMessage(
 		o = &fuseops.RmDirOp{
 			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(buf[:n-1]),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpOpen:
@@ -311,13 +395,13 @@ func convertInMessage(
 		o = &fuseops.OpenFileOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			OpenFlags: fusekernel.OpenFlags(in.Flags),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpOpendir:
 		o = &fuseops.OpenDirOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpRead:
@@ -331,7 +415,8 @@ func convertInMessage(
 			Handle:    fuseops.HandleID(in.Fh),
 			Offset:    int64(in.Offset),
 			Size:      int64(in.Size),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpenFlags: fusekernel.OpenFlags(in.Flags),
+			OpContext: convertOpContext(inMsg),
 		}
 		if !config.UseVectoredRead {
 			// Use part of the incoming message storage as the read buffer
@@ -340,19 +425,16 @@ func convertInMessage(
 		}
 		o = to
 
-	case fusekernel.OpReaddir:
+	case fusekernel.OpReaddir, fusekernel.OpReaddirplus:
+		plus := inMsg.Header().Opcode == fusekernel.OpReaddirplus
 		in := (*fusekernel.ReadIn)(inMsg.Consume(fusekernel.ReadInSize(protocol)))
-		if in == nil {
-			return nil, errors.New("Corrupt OpReaddir")
+		if in == nil && plus {
+			return nil, errors.New("Corrupt OpReaddirplus")
 		}
 
-		to := &fuseops.ReadDirOp{
-			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle:    fuseops.HandleID(in.Fh),
-			Offset:    fuseops.DirOffset(in.Offset),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+		if in == nil {
+			return nil, errors.New("Corrupt OpReaddir")
 		}
-		o = to
 
 		readSize := int(in.Size)
 		p := outMsg.Grow(readSize)
@@ -360,7 +442,27 @@ func convertInMessage(
 			return nil, fmt.Errorf("Can't grow for %d-byte read", readSize)
 		}
 
-		sh := (*reflect.SliceHeader)(unsafe.Pointer(&to.Dst))
+		// Both ops read into the rest of the out message.
+		var dst *[]byte
+		if plus {
+			to := &fuseops.ReadDirPlusOp{
+				Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+				Handle:    fuseops.HandleID(in.Fh),
+				Offset:    fuseops.DirOffset(in.Offset),
+				OpContext: convertOpContext(inMsg),
+			}
+			o, dst = to, &to.Dst
+		} else {
+			to := &fuseops.ReadDirOp{
+				Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+				Handle:    fuseops.HandleID(in.Fh),
+				Offset:    fuseops.DirOffset(in.Offset),
+				OpContext: convertOpContext(inMsg),
+			}
+			o, dst = to, &to.Dst
+		}
+
+		sh := (*reflect.SliceHeader)(unsafe.Pointer(dst))
 		sh.Data = uintptr(p)
 		sh.Len = readSize
 		sh.Cap = readSize
@@ -374,7 +476,7 @@ func convertInMessage(
 
 		o = &fuseops.ReleaseFileHandleOp{
 			Handle:    fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpReleasedir:
@@ -386,7 +488,7 @@ func convertInMessage(
 
 		o = &fuseops.ReleaseDirHandleOp{
 			Handle:    fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpWrite:
@@ -405,7 +507,10 @@ func convertInMessage(
 			Handle:    fuseops.HandleID(in.Fh),
 			Data:      buf,
 			Offset:    int64(in.Offset),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpenFlags: fusekernel.OpenFlags(in.Flags),
+			OpContext: convertOpContext(inMsg),
+
+			FromPageCache: fusekernel.WriteFlags(in.WriteFlags)&fusekernel.WriteCache != 0,
 		}
 
 	case fusekernel.OpFsync, fusekernel.OpFsyncdir:
@@ -418,7 +523,8 @@ func convertInMessage(
 		o = &fuseops.SyncFileOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			Handle:    fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			Datasync:  in.FsyncFlags&fusekernel.FsyncFdatasync != 0,
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpFlush:
@@ -431,13 +537,25 @@ func convertInMessage(
 		o = &fuseops.FlushFileOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			Handle:    fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			LockOwner: in.LockOwner,
+			OpContext: convertOpContext(inMsg),
+		}
+
+	case fusekernel.OpSyncfs:
+		type input fusekernel.SyncfsIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpSyncfs")
+		}
+
+		o = &fuseops.SyncFSOp{
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpReadlink:
 		o = &fuseops.ReadSymlinkOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpStatfs:
@@ -454,6 +572,24 @@ func convertInMessage(
 			FuseID: in.Unique,
 		}
 
+	case fusekernel.OpNotifyReply:
+		type input fusekernel.NotifyRetrieveIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpNotifyReply")
+		}
+
+		buf := inMsg.ConsumeBytes(inMsg.Len())
+		if len(buf) < int(in.Size) {
+			return nil, errors.New("Corrupt OpNotifyReply")
+		}
+
+		o = &notifyReplyOp{
+			Unique: inMsg.Header().Unique,
+			Offset: in.Offset,
+			Data:   buf[:in.Size],
+		}
+
 	case fusekernel.OpInit:
 		type input fusekernel.InitIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -461,12 +597,34 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpInit")
 		}
 
-		o = &initOp{
+		op := &initOp{
 			Kernel:       fusekernel.Protocol{in.Major, in.Minor},
 			MaxReadahead: in.MaxReadahead,
 			Flags:        fusekernel.InitFlags(in.Flags),
 		}
 
+		// Linux only; OS X uses the bit for something else.
+		if isLinux() && op.Flags&fusekernel.InitInitExt != 0 {
+			type ext fusekernel.InitInExt
+			if in := (*ext)(inMsg.Consume(unsafe.Sizeof(ext{}))); in != nil {
+				op.Flags2 = fusekernel.InitFlags2(in.Flags2)
+			}
+		}
+
+		o = op
+
+	case fusekernel.OpCuseInit:
+		type input fusekernel.CuseInitIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpCuseInit")
+		}
+
+		o = &cuseInitOp{
+			Kernel: fusekernel.Protocol{Major: in.Major, Minor: in.Minor},
+			Flags:  in.Flags,
+		}
+
 	case fusekernel.OpLink:
 		type input fusekernel.LinkIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -488,7 +646,7 @@ func convertInMessage(
 			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(name),
 			Target:    fuseops.InodeID(in.Oldnodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpRemovexattr:
@@ -501,7 +659,7 @@ func convertInMessage(
 		o = &fuseops.RemoveXattrOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(buf[:n-1]),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 
 	case fusekernel.OpGetxattr:
@@ -521,7 +679,8 @@ func convertInMessage(
 		to := &fuseops.GetXattrOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:      string(name),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			Position:  (*fusekernel.GetxattrIn)(in).GetPosition(),
+			OpContext: convertOpContext(inMsg),
 		}
 		o = to
 
@@ -549,7 +708,7 @@ func convertInMessage(
 
 		to := &fuseops.ListXattrOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
 		}
 		o = to
 
@@ -588,8 +747,81 @@ func convertInMessage(
 			Name:      string(name),
 			Value:     value,
 			Flags:     in.Flags,
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			Position:  (*fusekernel.SetxattrIn)(in).GetPosition(),
+			OpContext: convertOpContext(inMsg),
 		}
+	case fusekernel.OpIoctl:
+		type input fusekernel.IoctlIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpIoctl")
+		}
+
+		// The inode flags ioctls get ops of their own, unless the ioctl is
+		// unrestricted and so comes without its argument. Compare just the type
+		// and number of the command, so as to accept the 32-bit variants as
+		// well.
+		cmd := in.Cmd & 0xffff
+		if in.Flags&fusekernel.IoctlUnrestricted != 0 {
+			cmd = 0
+		}
+
+		switch cmd {
+		case fusekernel.IoctlGetFlags:
+			// The kernel expects the flags as an int or a long, depending on the
+			// variant. Set up the response now, while we know which.
+			outSize := int(in.OutSize)
+			if outSize != 4 && outSize != 8 {
+				return nil, errors.New("Corrupt OpIoctl")
+			}
+
+			outMsg.Grow(int(unsafe.Sizeof(fusekernel.IoctlOut{})) + outSize)
+
+			o = &fuseops.GetInodeFlagsOp{
+				Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+				Handle:    fuseops.HandleID(in.Fh),
+				OpContext: convertOpContext(inMsg),
+			}
+
+		case fusekernel.IoctlSetFlags:
+			// The flags come as an int or a long, depending on the variant.
+			var flags uint64
+			switch arg := inMsg.ConsumeBytes(uintptr(in.InSize)); len(arg) {
+			case 4:
+				flags = uint64(*(*uint32)(unsafe.Pointer(&arg[0])))
+			case 8:
+				flags = *(*uint64)(unsafe.Pointer(&arg[0]))
+			default:
+				return nil, errors.New("Corrupt OpIoctl")
+			}
+
+			o = &fuseops.SetInodeFlagsOp{
+				Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+				Handle:    fuseops.HandleID(in.Fh),
+				Flags:     fuseops.InodeFlags(flags),
+				OpContext: convertOpContext(inMsg),
+			}
+
+		default:
+			input := inMsg.ConsumeBytes(uintptr(in.InSize))
+			if input == nil && in.InSize != 0 {
+				return nil, errors.New("Corrupt OpIoctl")
+			}
+
+			o = &fuseops.IoctlOp{
+				Inode:        fuseops.InodeID(inMsg.Header().Nodeid),
+				Handle:       fuseops.HandleID(in.Fh),
+				Dir:          in.Flags&fusekernel.IoctlDir != 0,
+				Cmd:          in.Cmd,
+				Arg:          in.Arg,
+				Input:        input,
+				OutSize:      int(in.OutSize),
+				Unrestricted: in.Flags&fusekernel.IoctlUnrestricted != 0,
+				Compat:       in.Flags&fusekernel.IoctlCompat != 0,
+				OpContext:    convertOpContext(inMsg),
+			}
+		}
+
 	case fusekernel.OpFallocate:
 		type input fusekernel.FallocateIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -603,7 +835,69 @@ func convertInMessage(
 			Offset:    in.Offset,
 			Length:    in.Length,
 			Mode:      in.Mode,
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			OpContext: convertOpContext(inMsg),
+		}
+
+	case fusekernel.OpPoll:
+		type input fusekernel.PollIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpPoll")
+		}
+
+		o = &fuseops.PollOp{
+			Inode:          fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:         fuseops.HandleID(in.Fh),
+			Events:         in.Events,
+			ScheduleNotify: in.Flags&fusekernel.PollScheduleNotify != 0,
+			Kh:             fuseops.PollHandle(in.Kh),
+			OpContext:      convertOpContext(inMsg),
+		}
+
+	case fusekernel.OpLseek:
+		type input fusekernel.LseekIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpLseek")
+		}
+
+		o = &fuseops.LseekOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Offset:    int64(in.Offset),
+			Whence:    int(in.Whence),
+			OpContext: convertOpContext(inMsg),
+		}
+
+	case fusekernel.OpGetlk:
+		in := (*fusekernel.LkIn)(inMsg.Consume(fusekernel.LkInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpGetlk")
+		}
+
+		o = &fuseops.GetLkOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Owner:     in.Owner,
+			Lock:      convertFileLock(in.Lk),
+			Conflict:  fuseops.FileLock{Type: fuseops.LockUnlock},
+			OpContext: convertOpContext(inMsg),
+		}
+
+	case fusekernel.OpSetlk, fusekernel.OpSetlkw:
+		in := (*fusekernel.LkIn)(inMsg.Consume(fusekernel.LkInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpSetlk")
+		}
+
+		o = &fuseops.SetLkOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Owner:     in.Owner,
+			Lock:      convertFileLock(in.Lk),
+			Wait:      inMsg.Header().Opcode == fusekernel.OpSetlkw,
+			Flock:     in.LkFlags&fusekernel.LkFlock != 0,
+			OpContext: convertOpContext(inMsg),
 		}
 
 	default:
@@ -643,6 +937,29 @@ func (c *Connection) kernelResponse(
 		return true
 	}
 
+	// A file system may answer every GetXattr and ListXattr op with the full
+	// size of the value, as it must for the kernel's size probes. If a real
+	// destination buffer was too small for it, the caller must be told ERANGE
+	// so that it can probe again and retry with a larger one.
+	if opErr == nil && xattrTooLarge(op) {
+		opErr = syscall.ERANGE
+	}
+
+	// Likewise, a symlink target must fit the kernel's buffer. See names.go.
+	if opErr == nil && targetTooLong(op) {
+		opErr = syscall.ENAMETOOLONG
+	}
+
+	// Enforce the semantics of short reads and writes. See short_io.go.
+	if opErr == nil {
+		opErr = c.checkShortIO(op)
+	}
+
+	// And the rules for directory offsets. See dir_offsets.go.
+	if opErr == nil {
+		opErr = c.checkDirOffsets(op)
+	}
+
 	// If the user returned the error, fill in the error field of the outgoing
 	// message header.
 	if opErr != nil {
@@ -654,6 +971,20 @@ func (c *Connection) kernelResponse(
 				m.OutHeader().Error = -int32(errno)
 			}
 
+			// A file system shedding load. See Connection.Retry.
+			if errors.Is(opErr, EAGAINRetry) {
+				m.OutHeader().Error = -int32(syscall.EAGAIN)
+			}
+
+			// An op given up on because the kernel interrupted it, which
+			// cancels its context, was interrupted as far as the caller is
+			// concerned.
+			if opErr == context.Canceled {
+				m.OutHeader().Error = -int32(syscall.EINTR)
+			}
+
+			c.noteDebugError(op, syscall.Errno(-m.OutHeader().Error))
+
 			// Special case: for some types, convertInMessage grew the message in order
 			// to obtain a destination buffer. Make sure that we shrink back to just
 			// the header, because on OS X the kernel otherwise returns EINVAL when we
@@ -672,6 +1003,57 @@ func (c *Connection) kernelResponse(
 	return false
 }
 
+// Apply MountConfig.AttributesTimeout to an expiration left at the zero value.
+func (c *Connection) attributesExpiration(t time.Time) time.Time {
+	if t.IsZero() && c.cfg.AttributesTimeout > 0 {
+		return time.Now().Add(c.cfg.AttributesTimeout)
+	}
+
+	return t
+}
+
+// Apply MountConfig.EntryTimeout and AttributesTimeout to an entry that has
+// been converted to out.
+func (c *Connection) defaultExpirations(
+	e *fuseops.ChildInodeEntry,
+	out *fusekernel.EntryOut) {
+	// Leave negative entries alone.
+	if e.Child == 0 {
+		return
+	}
+
+	if e.EntryExpiration.IsZero() && c.cfg.EntryTimeout > 0 {
+		out.EntryValid, out.EntryValidNsec = convert.ExpirationTime(
+			time.Now().Add(c.cfg.EntryTimeout))
+	}
+
+	out.AttrValid, out.AttrValidNsec = convert.ExpirationTime(
+		c.attributesExpiration(e.AttributesExpiration))
+}
+
+// The FOPEN_* flags replying to an op opening a file with the supplied
+// settings, as described on fuseops.OpenFileOp.
+func (c *Connection) openFileFlags(
+	keepPageCache bool,
+	useDirectIO bool,
+	nonSeekable bool,
+	flags fusekernel.OpenFlags) (out uint32) {
+	if keepPageCache {
+		out |= uint32(fusekernel.OpenKeepCache)
+	}
+
+	// See MountConfig.EnableSharedWritableMmap and OpenFileOp.UseDirectIO.
+	if useDirectIO && !c.cfg.EnableSharedWritableMmap && !flags.IsExec() {
+		out |= uint32(fusekernel.OpenDirectIO)
+	}
+
+	if nonSeekable {
+		out |= uint32(fusekernel.OpenNonSeekable)
+	}
+
+	return out
+}
+
 // Like kernelResponse, but assumes the user replied with a nil error to the
 // op.
 func (c *Connection) kernelResponseForOp(
@@ -682,50 +1064,60 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.LookUpInodeOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convert.ChildInodeEntry(&o.Entry, out)
+		c.defaultExpirations(&o.Entry, out)
 
 	case *fuseops.GetInodeAttributesOp:
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
-		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
-			o.AttributesExpiration)
-		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
+		out.AttrValid, out.AttrValidNsec = convert.ExpirationTime(
+			c.attributesExpiration(o.AttributesExpiration))
+		convert.Attributes(o.Inode, &o.Attributes, &out.Attr)
 
 	case *fuseops.SetInodeAttributesOp:
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
-		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
-			o.AttributesExpiration)
-		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
+		out.AttrValid, out.AttrValidNsec = convert.ExpirationTime(
+			c.attributesExpiration(o.AttributesExpiration))
+		convert.Attributes(o.Inode, &o.Attributes, &out.Attr)
+
+	case *fuseops.AccessOp:
+		// Empty response
 
 	case *fuseops.MkDirOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convert.ChildInodeEntry(&o.Entry, out)
+		c.defaultExpirations(&o.Entry, out)
 
 	case *fuseops.MkNodeOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convert.ChildInodeEntry(&o.Entry, out)
+		c.defaultExpirations(&o.Entry, out)
 
 	case *fuseops.CreateFileOp:
 		eSize := int(fusekernel.EntryOutSize(c.protocol))
 
 		e := (*fusekernel.EntryOut)(m.Grow(eSize))
-		convertChildInodeEntry(&o.Entry, e)
+		convert.ChildInodeEntry(&o.Entry, e)
+		c.defaultExpirations(&o.Entry, e)
 
 		oo := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		oo.Fh = uint64(o.Handle)
+		oo.OpenFlags = c.openFileFlags(o.KeepPageCache, o.UseDirectIO, o.NonSeekable, o.OpenFlags)
 
 	case *fuseops.CreateSymlinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convert.ChildInodeEntry(&o.Entry, out)
+		c.defaultExpirations(&o.Entry, out)
 
 	case *fuseops.CreateLinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convert.ChildInodeEntry(&o.Entry, out)
+		c.defaultExpirations(&o.Entry, out)
 
 	case *fuseops.RenameOp:
 		// Empty response
@@ -740,38 +1132,43 @@ func (c *Connection) kernelResponseForOp(
 		out := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		out.Fh = uint64(o.Handle)
 
+		if o.CacheDir {
+			out.OpenFlags |= uint32(fusekernel.OpenCacheDir)
+		}
+
+		if o.KeepCache {
+			out.OpenFlags |= uint32(fusekernel.OpenKeepCache)
+		}
+
 	case *fuseops.ReadDirOp:
 		// convertInMessage already set up the destination buffer to be at the end
 		// of the out message. We need only shrink to the right size based on how
 		// much the user read.
 		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
 
+	case *fuseops.ReadDirPlusOp:
+		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
+
 	case *fuseops.ReleaseDirHandleOp:
 		// Empty response
 
 	case *fuseops.OpenFileOp:
 		out := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		out.Fh = uint64(o.Handle)
-
-		if o.KeepPageCache {
-			out.OpenFlags |= uint32(fusekernel.OpenKeepCache)
-		}
-
-		if o.UseDirectIO {
-			out.OpenFlags |= uint32(fusekernel.OpenDirectIO)
-		}
+		out.OpenFlags = c.openFileFlags(o.KeepPageCache, o.UseDirectIO, o.NonSeekable, o.OpenFlags)
 
 	case *fuseops.ReadFileOp:
-		if o.Dst != nil {
-			m.Append(o.Dst)
-		} else {
+		// Vectored data is sent as is, whether or not Dst was provided.
+		if o.Data != nil {
 			m.Append(o.Data...)
+		} else {
+			m.Append(o.Dst)
 		}
 		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
 
 	case *fuseops.WriteFileOp:
 		out := (*fusekernel.WriteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.WriteOut{}))))
-		out.Size = uint32(len(o.Data))
+		out.Size = uint32(o.Written())
 
 	case *fuseops.SyncFileOp:
 		// Empty response
@@ -779,6 +1176,9 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.FlushFileOp:
 		// Empty response
 
+	case *fuseops.SyncFSOp:
+		// Empty response
+
 	case *fuseops.ReleaseFileHandleOp:
 		// Empty response
 
@@ -792,7 +1192,7 @@ func (c *Connection) kernelResponseForOp(
 		out.St.Bavail = o.BlocksAvailable
 		out.St.Files = o.Inodes
 		out.St.Ffree = o.InodesFree
-		out.St.Namelen = 255
+		out.St.Namelen = fuseops.MaxNameLength
 
 		// The posix spec for sys/statvfs.h (http://goo.gl/LktgrF) defines the
 		// following fields of statvfs, among others:
@@ -848,19 +1248,95 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.FallocateOp:
 		// Empty response
 
+	case *fuseops.GetInodeFlagsOp:
+		// convertInMessage already grew the message for an IoctlOut followed by
+		// an int or a long, and it was zeroed.
+		b := m.Sglist[len(m.Sglist)-1][unsafe.Sizeof(fusekernel.IoctlOut{}):]
+		if len(b) == 4 {
+			*(*uint32)(unsafe.Pointer(&b[0])) = uint32(o.Flags)
+		} else {
+			*(*uint64)(unsafe.Pointer(&b[0])) = uint64(o.Flags)
+		}
+
+	case *fuseops.SetInodeFlagsOp:
+		m.Grow(int(unsafe.Sizeof(fusekernel.IoctlOut{})))
+
+	case *fuseops.IoctlOp:
+		out := (*fusekernel.IoctlOut)(m.Grow(int(unsafe.Sizeof(fusekernel.IoctlOut{}))))
+		if len(o.RetryIn) != 0 || len(o.RetryOut) != 0 {
+			out.Flags = fusekernel.IoctlRetry
+			out.InIovs = uint32(len(o.RetryIn))
+			out.OutIovs = uint32(len(o.RetryOut))
+			for _, iovs := range [][]fuseops.IoctlIovec{o.RetryIn, o.RetryOut} {
+				for _, iov := range iovs {
+					p := (*fusekernel.IoctlIovec)(m.Grow(int(unsafe.Sizeof(fusekernel.IoctlIovec{}))))
+					p.Base = iov.Base
+					p.Len = iov.Len
+				}
+			}
+
+			break
+		}
+
+		out.Result = o.Result
+		output := o.Output
+		if len(output) > o.OutSize {
+			output = output[:o.OutSize]
+		}
+
+		m.Append(output)
+
+	case *fuseops.PollOp:
+		out := (*fusekernel.PollOut)(m.Grow(int(unsafe.Sizeof(fusekernel.PollOut{}))))
+		out.Revents = o.Revents
+
+	case *fuseops.LseekOp:
+		out := (*fusekernel.LseekOut)(m.Grow(int(unsafe.Sizeof(fusekernel.LseekOut{}))))
+		out.Offset = uint64(o.NewOffset)
+
+	case *fuseops.GetLkOp:
+		out := (*fusekernel.LkOut)(m.Grow(int(unsafe.Sizeof(fusekernel.LkOut{}))))
+		out.Lk = fusekernel.FileLock{
+			Start: o.Conflict.Start,
+			End:   o.Conflict.End,
+			Type:  uint32(o.Conflict.Type),
+			Pid:   o.Conflict.PID,
+		}
+
+	case *fuseops.SetLkOp:
+		// Empty response
+
 	case *initOp:
-		out := (*fusekernel.InitOut)(m.Grow(int(unsafe.Sizeof(fusekernel.InitOut{}))))
+		out := (*fusekernel.InitOut)(m.Grow(int(fusekernel.InitOutSize(o.Library))))
 
 		out.Major = o.Library.Major
 		out.Minor = o.Library.Minor
 		out.MaxReadahead = o.MaxReadahead
 		out.Flags = uint32(o.Flags)
-		// Default values
-		out.MaxBackground = 12
-		out.CongestionThreshold = 9
+		out.MaxBackground = o.MaxBackground
+		out.CongestionThreshold = o.CongestionThreshold
+		out.MaxWrite = o.MaxWrite
+
+		// Older kernels don't have room for the rest.
+		if !o.Library.LT(fusekernel.Protocol{Major: 7, Minor: 23}) {
+			out.TimeGran = 1
+			out.MaxPages = o.MaxPages
+			out.Flags2 = uint32(o.Flags2)
+			out.MaxStackDepth = o.MaxStackDepth
+		}
+
+	case *cuseInitOp:
+		out := (*fusekernel.CuseInitOut)(m.Grow(int(unsafe.Sizeof(fusekernel.CuseInitOut{}))))
+
+		out.Major = o.Library.Major
+		out.Minor = o.Library.Minor
+		out.Flags = o.OutFlags
+		out.MaxRead = o.MaxRead
 		out.MaxWrite = o.MaxWrite
-		out.TimeGran = 1
-		out.MaxPages = o.MaxPages
+		out.DevMajor = o.DevMajor
+		out.DevMinor = o.DevMinor
+
+		m.AppendString("DEVNAME=" + o.DevName + "\x00")
 
 	default:
 		panic(fmt.Sprintf("Unexpected op: %#v", op))
@@ -873,85 +1349,85 @@ func (c *Connection) kernelResponseForOp(
 // General conversions
 ////////////////////////////////////////////////////////////////////////
 
-func convertTime(t time.Time) (secs uint64, nsec uint32) {
-	totalNano := t.UnixNano()
-	secs = uint64(totalNano / 1e9)
-	nsec = uint32(totalNano % 1e9)
-	return secs, nsec
-}
-
-func convertAttributes(
-	inodeID fuseops.InodeID,
-	in *fuseops.InodeAttributes,
-	out *fusekernel.Attr) {
-	out.Ino = uint64(inodeID)
-	out.Size = in.Size
-	out.Atime, out.AtimeNsec = convertTime(in.Atime)
-	out.Mtime, out.MtimeNsec = convertTime(in.Mtime)
-	out.Ctime, out.CtimeNsec = convertTime(in.Ctime)
-	out.SetCrtime(convertTime(in.Crtime))
-	out.Nlink = in.Nlink
-	out.Uid = in.Uid
-	out.Gid = in.Gid
-	// round up to the nearest 512 boundary
-	out.Blocks = (in.Size + 512 - 1) / 512
-
-	// Set the mode.
-	out.Mode = uint32(in.Mode) & 0777
-	switch {
-	default:
-		out.Mode |= syscall.S_IFREG
-	case in.Mode&os.ModeDir != 0:
-		out.Mode |= syscall.S_IFDIR
-	case in.Mode&os.ModeDevice != 0:
-		if in.Mode&os.ModeCharDevice != 0 {
-			out.Mode |= syscall.S_IFCHR
-		} else {
-			out.Mode |= syscall.S_IFBLK
-		}
-	case in.Mode&os.ModeNamedPipe != 0:
-		out.Mode |= syscall.S_IFIFO
-	case in.Mode&os.ModeSymlink != 0:
-		out.Mode |= syscall.S_IFLNK
-	case in.Mode&os.ModeSocket != 0:
-		out.Mode |= syscall.S_IFSOCK
+// Parse the security contexts that follow the names in a request creating an
+// inode once InitSecurityCtx has been agreed, reporting whether they are well
+// formed. There are none otherwise.
+func convertSecurityContext(
+	flags2 fusekernel.InitFlags2,
+	b []byte) (ctxs []fuseops.SecurityContext, ok bool) {
+	if flags2&fusekernel.InitSecurityCtx == 0 {
+		return nil, true
 	}
-	if in.Mode&os.ModeSetuid != 0 {
-		out.Mode |= syscall.S_ISUID
+
+	headerSize := int(unsafe.Sizeof(fusekernel.SecctxHeader{}))
+	if len(b) < headerSize {
+		return nil, false
 	}
-	if in.Mode&os.ModeSetgid != 0 {
-		out.Mode |= syscall.S_ISGID
+
+	header := (*fusekernel.SecctxHeader)(unsafe.Pointer(&b[0]))
+	if int(header.Size) < headerSize || int(header.Size) > len(b) {
+		return nil, false
 	}
-	if in.Mode&os.ModeSticky != 0 {
-		out.Mode |= syscall.S_ISVTX
+
+	b = b[headerSize:header.Size]
+	for n := uint32(0); n < header.NrSecctx; n++ {
+		entrySize := int(unsafe.Sizeof(fusekernel.Secctx{}))
+		if len(b) < entrySize {
+			return nil, false
+		}
+
+		size := int((*fusekernel.Secctx)(unsafe.Pointer(&b[0])).Size)
+		rest := b[entrySize:]
+		i := bytes.IndexByte(rest, '\x00')
+		if i < 0 || len(rest)-(i+1) < size {
+			return nil, false
+		}
+
+		ctxs = append(ctxs, fuseops.SecurityContext{
+			Name:  string(rest[:i]),
+			Value: rest[i+1 : i+1+size],
+		})
+
+		// Entries are padded to a multiple of 8 bytes.
+		next := (entrySize + i + 1 + size + 7) &^ 7
+		if next > len(b) {
+			next = len(b)
+		}
+		b = b[next:]
 	}
+
+	return ctxs, true
 }
 
-// Convert an absolute cache expiration time to a relative time from now for
-// consumption by the fuse kernel module.
-func convertExpirationTime(t time.Time) (secs uint64, nsecs uint32) {
-	// Fuse represents durations as unsigned 64-bit counts of seconds and 32-bit
-	// counts of nanoseconds (cf. http://goo.gl/EJupJV). So negative durations
-	// are right out. There is no need to cap the positive magnitude, because
-	// 2^64 seconds is well longer than the 2^63 ns range of time.Duration.
-	d := t.Sub(time.Now())
-	if d > 0 {
-		secs = uint64(d / time.Second)
-		nsecs = uint32((d % time.Second) / time.Nanosecond)
+// Split the names following RenameIn or Rename2In, "old\x00new\x00",
+// reporting whether they are well formed.
+func splitRenameNames(names []byte) (oldName, newName string, ok bool) {
+	if len(names) < 4 || names[len(names)-1] != '\x00' {
+		return "", "", false
 	}
 
-	return secs, nsecs
+	i := bytes.IndexByte(names, '\x00')
+	return string(names[:i]), string(names[i+1 : len(names)-1]), true
 }
 
-func convertChildInodeEntry(
-	in *fuseops.ChildInodeEntry,
-	out *fusekernel.EntryOut) {
-	out.Nodeid = uint64(in.Child)
-	out.Generation = uint64(in.Generation)
-	out.EntryValid, out.EntryValidNsec = convertExpirationTime(in.EntryExpiration)
-	out.AttrValid, out.AttrValidNsec = convertExpirationTime(in.AttributesExpiration)
+// Extract the credentials of the process that caused the kernel to send the
+// supplied message.
+func convertOpContext(inMsg *buffer.InMessage) fuseops.OpContext {
+	h := inMsg.Header()
+	return fuseops.OpContext{
+		Pid: h.Pid,
+		Uid: h.Uid,
+		Gid: h.Gid,
+	}
+}
 
-	convertAttributes(in.Child, &in.Attributes, &out.Attr)
+func convertFileLock(lk fusekernel.FileLock) fuseops.FileLock {
+	return fuseops.FileLock{
+		Start: lk.Start,
+		End:   lk.End,
+		Type:  fuseops.LockType(lk.Type),
+		PID:   lk.Pid,
+	}
 }
 
 func convertFileMode(unixMode uint32) os.FileMode {
@@ -987,6 +1463,19 @@ func convertFileMode(unixMode uint32) os.FileMode {
 	return mode
 }
 
+// Does op report more bytes than fit in its non-empty destination buffer?
+func xattrTooLarge(op interface{}) bool {
+	switch o := op.(type) {
+	case *fuseops.GetXattrOp:
+		return len(o.Dst) != 0 && o.BytesRead > len(o.Dst)
+
+	case *fuseops.ListXattrOp:
+		return len(o.Dst) != 0 && o.BytesRead > len(o.Dst)
+	}
+
+	return false
+}
+
 func writeXattrSize(m *buffer.OutMessage, size uint32) {
 	out := (*fusekernel.GetxattrOut)(m.Grow(int(unsafe.Sizeof(fusekernel.GetxattrOut{}))))
 	out.Size = size
@@ -0,0 +1,85 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/buffer"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// Convert a message with the supplied opcode and body, as the kernel would
+// send it.
+func convertBody(t *testing.T, opcode uint32, body []byte) interface{} {
+	t.Helper()
+
+	h := fusekernel.InHeader{
+		Len:    uint32(unsafe.Sizeof(fusekernel.InHeader{})) + uint32(len(body)),
+		Opcode: opcode,
+		Nodeid: 2,
+	}
+
+	b := append([]byte(nil), (*[unsafe.Sizeof(h)]byte)(unsafe.Pointer(&h))[:]...)
+	inMsg := buffer.NewInMessage(buffer.MaxWriteSize)
+	if err := inMsg.Init(bytes.NewReader(append(b, body...))); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	var outMsg buffer.OutMessage
+	outMsg.Reset()
+
+	op, err := convertInMessage(&MountConfig{}, inMsg, &outMsg, fusekernel.Protocol{Major: 7, Minor: 19}, 0)
+	if err != nil {
+		t.Fatalf("convertInMessage: %v", err)
+	}
+
+	return op
+}
+
+func TestDarwinSetattrTimes(t *testing.T) {
+	crtime := time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	var in fusekernel.SetattrIn
+	in.Valid = uint32(fusekernel.SetattrCrtime)
+	in.Crtime_ = uint64(crtime.Unix())
+
+	op := convertBody(t, fusekernel.OpSetattr, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+	to := op.(*fuseops.SetInodeAttributesOp)
+	if to.Crtime == nil || !to.Crtime.Equal(crtime) {
+		t.Errorf("Crtime: %v", to.Crtime)
+	}
+
+	if to.Bkuptime != nil {
+		t.Errorf("Bkuptime: %v", to.Bkuptime)
+	}
+}
+
+func TestDarwinXattrPosition(t *testing.T) {
+	var in fusekernel.GetxattrIn
+	in.Size = 4
+	in.Position = 4096
+
+	b := (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:]
+	op := convertBody(t, fusekernel.OpGetxattr, append(b, "com.apple.ResourceFork\x00"...))
+	to := op.(*fuseops.GetXattrOp)
+	if to.Position != 4096 || len(to.Dst) != 4 {
+		t.Errorf("GetXattrOp: position %d, %d-byte Dst", to.Position, len(to.Dst))
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/buffer"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+func TestXattrTooLargeForBuffer(t *testing.T) {
+	c := &Connection{}
+
+	var m buffer.OutMessage
+	m.Reset()
+	op := &fuseops.GetXattrOp{Dst: make([]byte, 4), BytesRead: 5}
+	m.Append(op.Dst)
+
+	c.kernelResponse(&m, 17, op, nil)
+	if errno := syscall.Errno(-m.OutHeader().Error); errno != syscall.ERANGE {
+		t.Errorf("got %v, want ERANGE", errno)
+	}
+
+	if m.Len() != buffer.OutMessageHeaderSize {
+		t.Errorf("response has %d bytes", m.Len())
+	}
+}
+
+func TestDeviceNumbers(t *testing.T) {
+	c := &Connection{protocol: fusekernel.Protocol{Major: 7, Minor: 31}}
+
+	rdev := fuseops.Mkdev(259, 300)
+	if major, minor := fuseops.Major(rdev), fuseops.Minor(rdev); major != 259 || minor != 300 {
+		t.Fatalf("Mkdev(259, 300) decodes to %d, %d", major, minor)
+	}
+
+	var m buffer.OutMessage
+	m.Reset()
+	op := &fuseops.GetInodeAttributesOp{
+		Inode: 2,
+		Attributes: fuseops.InodeAttributes{
+			Mode: os.ModeDevice | 0600,
+			Rdev: rdev,
+		},
+	}
+
+	c.kernelResponse(&m, 17, op, nil)
+	out := (*fusekernel.AttrOut)(unsafe.Pointer(&m.Sglist[1][0]))
+	if out.Attr.Rdev != rdev || out.Attr.Mode != syscall.S_IFBLK|0600 {
+		t.Errorf("Attr: mode %o, rdev %#x", out.Attr.Mode, out.Attr.Rdev)
+	}
+}
+
+func TestSecurityContext(t *testing.T) {
+	// The kernel's encoding of a single context: a header, an entry, the name
+	// and the value, padded to a multiple of 8 bytes.
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, fusekernel.SecctxHeader{Size: 48, NrSecctx: 1})
+	binary.Write(&b, binary.LittleEndian, fusekernel.Secctx{Size: 13})
+	b.WriteString("security.selinux\x00")
+	b.WriteString("system_u:obj\x00")
+	b.Write(make([]byte, 48-b.Len()))
+
+	ctxs, ok := convertSecurityContext(fusekernel.InitSecurityCtx, b.Bytes())
+	want := []fuseops.SecurityContext{
+		{Name: "security.selinux", Value: []byte("system_u:obj\x00")},
+	}
+
+	if !ok || !reflect.DeepEqual(ctxs, want) {
+		t.Errorf("convertSecurityContext: %+v, %v", ctxs, ok)
+	}
+
+	// Nothing is expected unless it was asked for.
+	if ctxs, ok := convertSecurityContext(0, nil); !ok || ctxs != nil {
+		t.Errorf("convertSecurityContext when not agreed: %+v, %v", ctxs, ok)
+	}
+
+	// A context running past the header's size is corrupt.
+	if _, ok := convertSecurityContext(fusekernel.InitSecurityCtx, b.Bytes()[:40]); ok {
+		t.Errorf("convertSecurityContext accepted a truncated context")
+	}
+
+	// The kernel sends an empty header when the security module has no
+	// context to give.
+	var empty bytes.Buffer
+	binary.Write(&empty, binary.LittleEndian, fusekernel.SecctxHeader{Size: 8})
+	if ctxs, ok := convertSecurityContext(fusekernel.InitSecurityCtx, empty.Bytes()); !ok || len(ctxs) != 0 {
+		t.Errorf("convertSecurityContext of an empty header: %+v, %v", ctxs, ok)
+	}
+}
+
+// Responses are built by a type switch over the ops rather than by reflection.
+// Measure what that costs for the common metadata ops.
+func BenchmarkKernelResponse(b *testing.B) {
+	c := &Connection{protocol: fusekernel.Protocol{Major: 7, Minor: 31}}
+
+	for _, op := range []interface{}{
+		&fuseops.LookUpInodeOp{Entry: fuseops.ChildInodeEntry{Child: 2}},
+		&fuseops.GetInodeAttributesOp{Inode: 2},
+		&fuseops.OpenFileOp{Handle: 3},
+		&fuseops.ReleaseFileHandleOp{Handle: 3},
+	} {
+		b.Run(fmt.Sprintf("%T", op)[len("*fuseops."):], func(b *testing.B) {
+			var m buffer.OutMessage
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m.Reset()
+				c.kernelResponse(&m, 17, op, nil)
+			}
+		})
+	}
+}
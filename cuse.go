@@ -0,0 +1,149 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A character device to register with CUSE (Linux). See NewCUSEConnection.
+type CUSEDevice struct {
+	// The name of the device, which udev gives the node it creates for it in
+	// /dev. Required.
+	Name string
+
+	// The device number. If Major is zero, the kernel allocates one.
+	Major uint32
+	Minor uint32
+
+	// Have the kernel pass on ioctls without copying their arguments, as it
+	// does for file systems with fuseops.IoctlOp's RetryIn and RetryOut. By
+	// default only ioctls whose numbers encode the size of their argument are
+	// passed on.
+	UnrestrictedIoctl bool
+}
+
+// NewCUSEConnection registers a character device with the kernel over dev, an
+// open /dev/cuse, and returns a connection through which the device's
+// requests are served in the same way as a mounted file system's: the kernel
+// sends OpenFileOp, ReadFileOp, WriteFileOp, FlushFileOp, ReleaseFileHandleOp,
+// FallocateOp, IoctlOp and PollOp, with Inode set to zero. Most servers use
+// the cuse package rather than calling this directly.
+//
+// Of cfg, only the options that don't concern mounting apply, such as the
+// loggers, OpContext and the scheduling and timeout options. DeviceReaders is
+// ignored, as /dev/cuse can't be cloned. The caller must call Close once the
+// server has returned.
+func NewCUSEConnection(
+	dev *os.File,
+	device CUSEDevice,
+	cfg *MountConfig) (*Connection, error) {
+	if device.Name == "" || strings.IndexByte(device.Name, 0) >= 0 {
+		return nil, fmt.Errorf("invalid device name %q", device.Name)
+	}
+
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+
+	cfgCopy := *cfg
+	if cfgCopy.OpContext == nil {
+		cfgCopy.OpContext = context.Background()
+	}
+
+	c := makeConnection(cfgCopy, cfg.DebugLogger, cfg.ErrorLogger, dev)
+	if err := c.initCUSE(device); err != nil {
+		c.close()
+		return nil, fmt.Errorf("initCUSE: %w", err)
+	}
+
+	return c, nil
+}
+
+// Perform the CUSE handshake, in place of Init.
+func (c *Connection) initCUSE(device CUSEDevice) error {
+	ctx, op, err := c.ReadOp()
+	if err != nil {
+		return fmt.Errorf("Reading CUSE init op: %v", err)
+	}
+
+	initOp, ok := op.(*cuseInitOp)
+	if !ok {
+		c.Reply(ctx, syscall.EPROTO)
+		return fmt.Errorf("Expected *cuseInitOp, got %T", op)
+	}
+
+	min := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMinMajor,
+		Minor: fusekernel.ProtoVersionMinMinor,
+	}
+
+	if initOp.Kernel.LT(min) {
+		c.Reply(ctx, syscall.EPROTO)
+		return fmt.Errorf("Version too old: %v", initOp.Kernel)
+	}
+
+	c.protocol = fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	if initOp.Kernel.LT(c.protocol) {
+		c.protocol = initOp.Kernel
+	}
+
+	// The kernel splits transfers into requests of at most its default number
+	// of pages, whatever we ask for.
+	size := uint32(defaultMaxPages * os.Getpagesize())
+
+	initOp.Library = c.protocol
+	initOp.MaxRead = size
+	initOp.MaxWrite = size
+	initOp.DevMajor = device.Major
+	initOp.DevMinor = device.Minor
+	initOp.DevName = device.Name
+
+	if device.UnrestrictedIoctl && initOp.Flags&fusekernel.CuseUnrestrictedIoctl != 0 {
+		initOp.OutFlags |= fusekernel.CuseUnrestrictedIoctl
+	}
+
+	c.limits = TransferLimits{
+		MaxWrite: size,
+		MaxRead:  size,
+		MaxPages: defaultMaxPages,
+	}
+
+	// Devices have none of the capabilities file systems may require.
+	if err := c.checkRequiredCapabilities(); err != nil {
+		c.Reply(ctx, syscall.EPROTO)
+		return err
+	}
+
+	c.Reply(ctx, nil)
+	return nil
+}
+
+// Close a connection created with NewCUSEConnection, once the server has
+// returned. Those of mounted file systems are closed by Mount once their
+// server returns.
+func (c *Connection) Close() error {
+	return c.close()
+}
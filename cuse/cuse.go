@@ -0,0 +1,133 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cuse serves character devices from user space through CUSE
+// (Linux), with the same servers and ops as file systems. Opening the device
+// node, reading and writing it, and calling ioctl(2) and poll(2) on it arrive
+// as fuseops.OpenFileOp, ReadFileOp, WriteFileOp, IoctlOp and PollOp, so a
+// device can be implemented as a fuseutil.FileSystem and served with
+// fuseutil.NewFileSystemServer. Ops for devices carry no inode; the handle
+// returned by OpenFile tells opens apart.
+//
+// Registering a device requires access to /dev/cuse, which usually means
+// running as root, and the cuse kernel module.
+package cuse
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Device is a character device registered with Register.
+type Device struct {
+	name string
+	conn *fuse.Connection
+
+	// Closed once the server has returned and the connection has been closed,
+	// after joinStatus has been set.
+	joinStatusAvailable chan struct{}
+	joinStatus          error
+}
+
+// Register registers the device with the kernel and serves its requests with
+// server in the background, the options in cfg applying as described for
+// fuse.NewCUSEConnection. cfg may be nil.
+//
+// The kernel then creates the device, which udev or devtmpfs gives a node in
+// /dev named after it. The device lasts until the process exits: the kernel
+// removes it only once /dev/cuse is closed, which can't happen while the
+// server waits for requests.
+func Register(
+	device fuse.CUSEDevice,
+	server fuse.Server,
+	cfg *fuse.MountConfig) (*Device, error) {
+	if cfg == nil {
+		cfg = &fuse.MountConfig{}
+	}
+
+	// Open in blocking mode, as the connection expects of /dev/fuse.
+	fd, err := syscall.Open("/dev/cuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open /dev/cuse: %w", err)
+	}
+	dev := os.NewFile(uintptr(fd), "/dev/cuse")
+
+	conn, err := fuse.NewCUSEConnection(dev, device, cfg)
+	if err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("NewCUSEConnection: %w", err)
+	}
+
+	d := &Device{
+		name:                device.Name,
+		conn:                conn,
+		joinStatusAvailable: make(chan struct{}),
+	}
+
+	go func() {
+		server.ServeOps(conn)
+		d.joinStatus = conn.Close()
+		close(d.joinStatusAvailable)
+	}()
+
+	return d, nil
+}
+
+// Name returns the name the device was registered with.
+func (d *Device) Name() string {
+	return d.name
+}
+
+// Number returns the device's major and minor numbers, as allocated by the
+// kernel if it wasn't given any, e.g. to create a node for it where udev
+// doesn't.
+func (d *Device) Number() (major, minor uint32, err error) {
+	p := filepath.Join("/sys/class/cuse", d.name, "dev")
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(b)), "%d:%d", &major, &minor); err != nil {
+		return 0, 0, fmt.Errorf("parsing %s: %w", p, err)
+	}
+
+	return major, minor, nil
+}
+
+// NotifyPollWakeup calls fuse.Connection.NotifyPollWakeup on the connection
+// serving the device.
+func (d *Device) NotifyPollWakeup(kh fuseops.PollHandle) error {
+	return d.conn.NotifyPollWakeup(kh)
+}
+
+// Join blocks until the server has returned, which happens only if the
+// connection to the kernel is lost, and all ops read from it have been
+// responded to. May be called multiple times.
+func (d *Device) Join(ctx context.Context) error {
+	select {
+	case <-d.joinStatusAvailable:
+		return d.joinStatus
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
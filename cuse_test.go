@@ -0,0 +1,141 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// A character device whose reads return "tick".
+type tickerDevice struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (d *tickerDevice) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.Handle = 7
+	return nil
+}
+
+func (d *tickerDevice) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if op.Handle != 7 {
+		return unix.EBADF
+	}
+
+	op.BytesRead = copy(op.Dst, "tick")
+	return nil
+}
+
+func TestCUSEConnection(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	dev := os.NewFile(uintptr(fds[0]), "dev")
+	kernel := os.NewFile(uintptr(fds[1]), "kernel")
+	defer kernel.Close()
+
+	// Queue up the CUSE init op, as the kernel sends it on /dev/cuse.
+	in := fusekernel.CuseInitIn{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+		Flags: fusekernel.CuseUnrestrictedIoctl,
+	}
+	sendRequest(t, kernel, fusekernel.OpCuseInit, 1, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+
+	device := fuse.CUSEDevice{
+		Name:              "ticker",
+		Major:             240,
+		Minor:             3,
+		UnrestrictedIoctl: true,
+	}
+
+	c, err := fuse.NewCUSEConnection(dev, device, &fuse.MountConfig{})
+	if err != nil {
+		t.Fatalf("NewCUSEConnection: %v", err)
+	}
+
+	// The reply describes the device, followed by its name.
+	r := readReply(t, kernel)
+	outSize := int(unsafe.Sizeof(fusekernel.CuseInitOut{}))
+	if r.unique != 1 || r.errno != 0 || len(r.data) < outSize {
+		t.Fatalf("CUSE init reply: %+v", r)
+	}
+
+	out := (*fusekernel.CuseInitOut)(unsafe.Pointer(&r.data[0]))
+	if out.Major != fusekernel.ProtoVersionMaxMajor || out.Minor != fusekernel.ProtoVersionMaxMinor {
+		t.Errorf("Protocol: %d.%d", out.Major, out.Minor)
+	}
+
+	if out.DevMajor != 240 || out.DevMinor != 3 {
+		t.Errorf("Device number: %d:%d", out.DevMajor, out.DevMinor)
+	}
+
+	if out.Flags != fusekernel.CuseUnrestrictedIoctl {
+		t.Errorf("Flags: %#x", out.Flags)
+	}
+
+	if out.MaxRead == 0 || out.MaxWrite != out.MaxRead {
+		t.Errorf("MaxRead %d, MaxWrite %d", out.MaxRead, out.MaxWrite)
+	}
+
+	if got := string(r.data[outSize:]); got != "DEVNAME=ticker\x00" {
+		t.Errorf("Device info: %q", got)
+	}
+
+	// Requests are then served as for a file system.
+	done := make(chan struct{})
+	go func() {
+		fuseutil.NewFileSystemServer(&tickerDevice{}).ServeOps(c)
+		close(done)
+	}()
+
+	open := fusekernel.OpenIn{Flags: uint32(os.O_RDONLY)}
+	sendRequest(t, kernel, fusekernel.OpOpen, 2, (*[unsafe.Sizeof(open)]byte)(unsafe.Pointer(&open))[:])
+	if r := readReply(t, kernel); r.unique != 2 || r.errno != 0 {
+		t.Errorf("Open reply: %+v", r)
+	}
+
+	read := fusekernel.ReadIn{Fh: 7, Size: 16}
+	sendRequest(t, kernel, fusekernel.OpRead, 3, (*[unsafe.Sizeof(read)]byte)(unsafe.Pointer(&read))[:])
+	if r := readReply(t, kernel); r.unique != 3 || r.errno != 0 || string(r.data) != "tick" {
+		t.Errorf("Read reply: %+v", r)
+	}
+
+	kernel.Close()
+	<-done
+	if err := c.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+func TestCUSEConnectionRejectsEmptyName(t *testing.T) {
+	if _, err := fuse.NewCUSEConnection(nil, fuse.CUSEDevice{}, &fuse.MountConfig{}); err == nil {
+		t.Errorf("NewCUSEConnection succeeded without a device name")
+	}
+}
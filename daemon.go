@@ -0,0 +1,155 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// The environment variable through which Daemonize tells the daemon which of
+// its file descriptors to report readiness on.
+const daemonReadyFDVar = "_FUSE_DAEMON_READY_FD"
+
+// The first byte of the report written by SignalReady.
+const (
+	daemonReady  = 'R'
+	daemonFailed = 'E'
+)
+
+// Daemonize runs the program in the background, the way mount(8) expects of
+// mount helpers, and of programs used in its place by shell scripts: the
+// command returns once the file system is mounted and being served, with a
+// status saying whether mounting worked.
+//
+// Go programs can't fork, so Daemonize starts another copy of the program
+// with the same arguments and environment, in a session of its own and with
+// its standard streams connected to /dev/null. It then waits for the copy to
+// call SignalReady, and exits with status 0 if mounting succeeded or 1 if it
+// didn't, after printing the error to stderr. In the copy, Daemonize returns
+// nil straight away, so it must be called early on, before the program does
+// anything that shouldn't happen twice:
+//
+//	if err := fuse.Daemonize(); err != nil {
+//		log.Fatalf("Daemonize: %v", err)
+//	}
+//
+//	mfs, err := fuse.Mount(dir, server, cfg)
+//	fuse.SignalReady(err)
+//	if err != nil {
+//		os.Exit(1)
+//	}
+//
+//	mfs.Join(context.Background())
+//
+// Daemonize returns an error, without exiting, if the copy can't be started.
+func Daemonize() error {
+	// In the daemon, keep the descriptor from programs we run before signalling
+	// (e.g. fusermount(1)), which would otherwise hold the pipe open.
+	if s := os.Getenv(daemonReadyFDVar); s != "" {
+		if fd, err := strconv.Atoi(s); err == nil {
+			syscall.CloseOnExec(fd)
+		}
+
+		return nil
+	}
+
+	bin, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Executable: %v", err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("Pipe: %v", err)
+	}
+	defer r.Close()
+
+	cmd := exec.Command(bin, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonReadyFDVar+"=3")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("Starting the daemon: %v", err)
+	}
+
+	if err := waitForDaemon(r); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+	return nil
+}
+
+// Read what the daemon reports through SignalReady.
+func waitForDaemon(r io.Reader) error {
+	report, err := io.ReadAll(r)
+	switch {
+	case err != nil:
+		return fmt.Errorf("Waiting for the daemon: %v", err)
+
+	case len(report) == 0:
+		return errors.New("The daemon exited without signalling readiness")
+
+	case report[0] == daemonReady:
+		return nil
+
+	default:
+		return errors.New(string(report[1:]))
+	}
+}
+
+var signalOnce sync.Once
+
+// SignalReady tells the process that started this one with Daemonize that
+// mounting is done, with the error from Mount if it failed, so that it can
+// exit with the corresponding status. Only the first call has an effect, and
+// none does in a process not started by Daemonize.
+func SignalReady(mountErr error) {
+	signalOnce.Do(func() {
+		s := os.Getenv(daemonReadyFDVar)
+		if s == "" {
+			return
+		}
+
+		// Processes we start have no business with the variable.
+		os.Unsetenv(daemonReadyFDVar)
+
+		fd, err := strconv.Atoi(s)
+		if err != nil {
+			return
+		}
+
+		f := os.NewFile(uintptr(fd), "daemon-ready")
+		defer f.Close()
+
+		report := []byte{daemonReady}
+		if mountErr != nil {
+			report = append([]byte{daemonFailed}, mountErr.Error()...)
+		}
+
+		f.Write(report)
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse"
+)
+
+// The environment variable telling TestDaemonizeHelper to act as a daemonized
+// program, and how.
+const daemonizeModeVar = "FUSE_TEST_DAEMONIZE"
+
+// Daemonize, then report what the mode says: success, a mount error, or
+// nothing at all.
+func TestDaemonizeHelper(t *testing.T) {
+	mode := os.Getenv(daemonizeModeVar)
+	if mode == "" {
+		return
+	}
+
+	if err := fuse.Daemonize(); err != nil {
+		os.Stderr.WriteString(err.Error())
+		os.Exit(2)
+	}
+
+	switch mode {
+	case "ready":
+		fuse.SignalReady(nil)
+
+	case "failed":
+		fuse.SignalReady(errors.New("mount: taco"))
+	}
+
+	os.Exit(0)
+}
+
+func TestDaemonize(t *testing.T) {
+	testCases := []struct {
+		mode   string
+		status int
+		output string
+	}{
+		{"ready", 0, ""},
+		{"failed", 1, "mount: taco"},
+		{"silent", 1, "without signalling readiness"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.mode, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestDaemonizeHelper$")
+			cmd.Env = append(os.Environ(), daemonizeModeVar+"="+tc.mode)
+
+			output, err := cmd.CombinedOutput()
+			status := 0
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				status = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+
+			if status != tc.status || !strings.Contains(string(output), tc.output) {
+				t.Errorf("Exited with %d: %q", status, output)
+			}
+		})
+	}
+}
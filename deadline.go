@@ -0,0 +1,85 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"time"
+)
+
+// SoftDeadline returns the time by which the file system should aim to have
+// replied to the op whose context is supplied, as set by
+// MountConfig.SoftOpTimeout and CongestedOpTimeout, or false if it has none.
+//
+// Unlike a context deadline, a soft deadline passing doesn't cancel the op:
+// the file system may still reply late, rather than fail an op that was about
+// to succeed. It is rather meant for the calls the file system makes to its
+// backend, which otherwise tend to be made with no deadline at all; see
+// BackendContext.
+func SoftDeadline(ctx context.Context) (time.Time, bool) {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok || state.softDeadline.IsZero() {
+		return time.Time{}, false
+	}
+
+	return state.softDeadline, true
+}
+
+// BackendContext returns a context for the calls the file system makes to its
+// backend (e.g. S3, or over gRPC) while handling the op whose context is
+// supplied. It is cancelled along with the op, and its deadline is the op's
+// soft deadline, if any, so that client libraries give up on the backend in
+// time for the file system to reply with an error rather than leave the
+// caller hanging. The cancel function must be called once the calls are done.
+func BackendContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d, ok := SoftDeadline(ctx); ok {
+		return context.WithDeadline(ctx, d)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// Return the time each op is given to be handled when the file system isn't
+// congested: MountConfig.SoftOpTimeout, or if that is zero, half the time
+// after which the kernel gives up on requests and aborts the connection, if
+// it does.
+func softOpTimeout(cfg *MountConfig) time.Duration {
+	if cfg.SoftOpTimeout != 0 {
+		return cfg.SoftOpTimeout
+	}
+
+	return kernelRequestTimeout() / 2
+}
+
+// Return the soft deadline of an op read now, or the zero time if it has
+// none. Ops count as congested when more are in flight, this one included,
+// than the congestion threshold agreed with the kernel, beyond which the
+// kernel holds back background requests such as readahead.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) softDeadline() time.Time {
+	timeout := c.softOpTimeout
+	if c.cfg.CongestedOpTimeout != 0 &&
+		c.congestionThreshold != 0 &&
+		c.opsInFlight() > int(c.congestionThreshold) {
+		timeout = c.cfg.CongestedOpTimeout
+	}
+
+	if timeout == 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(timeout)
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system reporting the soft deadlines of StatFS ops, in which
+// unlinking waits for release to be closed.
+type deadlineFS struct {
+	slowUnlinkFS
+	deadlines chan time.Time
+}
+
+func (fs *deadlineFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	d, _ := fuse.SoftDeadline(ctx)
+
+	backend, cancel := fuse.BackendContext(ctx)
+	defer cancel()
+
+	if bd, _ := backend.Deadline(); !bd.Equal(d) {
+		return fuse.EIO
+	}
+
+	fs.deadlines <- d
+	return nil
+}
+
+func TestSoftDeadline(t *testing.T) {
+	fs := &deadlineFS{
+		slowUnlinkFS: slowUnlinkFS{
+			started: make(chan struct{}),
+			release: make(chan struct{}),
+		},
+		deadlines: make(chan time.Time, 1),
+	}
+
+	cfg := &fuse.MountConfig{
+		SoftOpTimeout:      time.Hour,
+		CongestedOpTimeout: time.Minute,
+		AdjustInit: func(kernel fuse.InitRequest, resp *fuse.InitResponse) {
+			resp.CongestionThreshold = 1
+		},
+	}
+
+	kernel, _, hangUp := serveWithConfig(t, cfg, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	statFS := func(unique uint64, want time.Duration) {
+		t.Helper()
+		start := time.Now()
+		sendRequest(t, kernel, fusekernel.OpStatfs, unique, nil)
+		if r := readReply(t, kernel); r.unique != unique || r.errno != 0 {
+			t.Fatalf("StatFS reply: %+v", r)
+		}
+
+		d := <-fs.deadlines
+		if d.Before(start.Add(want)) || d.After(time.Now().Add(want)) {
+			t.Errorf("Soft deadline %v from now, want %v", d.Sub(start), want)
+		}
+	}
+
+	statFS(1, time.Hour)
+
+	// With an op in flight, the file system is above the congestion threshold.
+	sendUnlink(t, kernel, 2, "slow")
+	<-fs.started
+	statFS(3, time.Minute)
+
+	close(fs.release)
+	if r := readReply(t, kernel); r.unique != 2 || r.errno != 0 {
+		t.Errorf("Unlink reply: %+v", r)
+	}
+
+	// Contexts other than those of ops have no soft deadline.
+	if _, ok := fuse.SoftDeadline(context.Background()); ok {
+		t.Errorf("Soft deadline for a background context")
+	}
+}
@@ -78,43 +78,121 @@ func describeRequest(op interface{}) (s string) {
 			addComponent("mode %v", *typed.Mode)
 		}
 
-		if typed.Atime != nil {
+		if typed.AtimeNow {
+			addComponent("atime now")
+		} else if typed.Atime != nil {
 			addComponent("atime %v", *typed.Atime)
 		}
 
-		if typed.Mtime != nil {
+		if typed.MtimeNow {
+			addComponent("mtime now")
+		} else if typed.Mtime != nil {
 			addComponent("mtime %v", *typed.Mtime)
 		}
 
+		if typed.Ctime != nil {
+			addComponent("ctime %v", *typed.Ctime)
+		}
+
+		if typed.Crtime != nil {
+			addComponent("crtime %v", *typed.Crtime)
+		}
+
+		if typed.Bkuptime != nil {
+			addComponent("bkuptime %v", *typed.Bkuptime)
+		}
+
+	case *fuseops.AccessOp:
+		addComponent("mask %#o", typed.Mask)
+
 	case *fuseops.RenameOp:
 		addComponent("old_parent %v", typed.OldParent)
 		addComponent("old_name %q", typed.OldName)
 		addComponent("new_parent %v", typed.NewParent)
 		addComponent("new_name %q", typed.NewName)
+		if typed.Flags != 0 {
+			addComponent("flags %#x", typed.Flags)
+		}
 
 	case *fuseops.ReadFileOp:
 		addComponent("handle %d", typed.Handle)
 		addComponent("offset %d", typed.Offset)
 		addComponent("%d bytes", typed.Size)
+		if typed.Readahead {
+			addComponent("readahead")
+		}
 
 	case *fuseops.WriteFileOp:
 		addComponent("handle %d", typed.Handle)
 		addComponent("offset %d", typed.Offset)
 		addComponent("%d bytes", len(typed.Data))
 
+	case *fuseops.SyncFileOp:
+		addComponent("handle %d", typed.Handle)
+		if typed.Datasync {
+			addComponent("datasync")
+		}
+
+	case *fuseops.FlushFileOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("owner %#x", typed.LockOwner)
+
 	case *fuseops.RemoveXattrOp:
 		addComponent("name %s", typed.Name)
 
 	case *fuseops.GetXattrOp:
 		addComponent("name %s", typed.Name)
+		if typed.Position != 0 {
+			addComponent("position %d", typed.Position)
+		}
 
 	case *fuseops.SetXattrOp:
 		addComponent("name %s", typed.Name)
+		if typed.Position != 0 {
+			addComponent("position %d", typed.Position)
+		}
 
 	case *fuseops.FallocateOp:
 		addComponent("offset %d", typed.Offset)
 		addComponent("length %d", typed.Length)
 		addComponent("mode %d", typed.Mode)
+
+	case *fuseops.SetInodeFlagsOp:
+		addComponent("flags %v", typed.Flags)
+
+	case *fuseops.IoctlOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("cmd %#x", typed.Cmd)
+		addComponent("in %d bytes", len(typed.Input))
+		addComponent("out %d bytes", typed.OutSize)
+
+	case *fuseops.PollOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("events %#x", typed.Events)
+		if typed.ScheduleNotify {
+			addComponent("kh %d", typed.Kh)
+		}
+
+	case *fuseops.LseekOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("offset %d", typed.Offset)
+		addComponent("whence %d", typed.Whence)
+
+	case *fuseops.GetLkOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("type %d", typed.Lock.Type)
+		addComponent("range %d-%d", typed.Lock.Start, typed.Lock.End)
+
+	case *fuseops.SetLkOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("type %d", typed.Lock.Type)
+		addComponent("range %d-%d", typed.Lock.Start, typed.Lock.End)
+		if typed.Wait {
+			addComponent("wait")
+		}
+		if typed.Flock {
+			addComponent("flock")
+		}
 	}
 
 	// Use just the name if there is no extra info.
@@ -0,0 +1,259 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"golang.org/x/sys/unix"
+)
+
+// How far back DebugState.RecentErrors goes.
+const debugErrorWindow = 10 * time.Minute
+
+// A snapshot of what a connection is up to, for finding out why a mount
+// misbehaves. See Connection.DebugServer.
+type DebugState struct {
+	// The init flags agreed with the kernel.
+	InitFlags  string
+	InitFlags2 string
+
+	// The number of ops read from the kernel and not yet replied to, not
+	// counting forget ops, and the number of those waiting for
+	// Connection.Schedule to run their handlers, held back by
+	// MountConfig.MaxConcurrentOps or SerializeWritesPerInode.
+	OpsInFlight int
+	OpsQueued   int
+
+	// If MountConfig.EnableDebugServer is set, the ops in flight, oldest first.
+	// Ops replied to on the file system's behalf, on being interrupted or
+	// timing out, are no longer listed even if their handlers are still
+	// running.
+	InFlight []InFlightOp
+
+	// If MountConfig.EnableDebugServer is set, the number of each error
+	// replied with to each type of op over the last ten minutes, most frequent
+	// first.
+	RecentErrors []ErrorCount
+}
+
+// An op read from the kernel and not yet replied to.
+type InFlightOp struct {
+	// The kernel's ID for the request, as shown in debug logs.
+	FuseID uint64
+
+	// The op's name, e.g. "ReadFile", and a description of it, e.g.
+	// "inode 4, handle 2, offset 0, 4096 bytes".
+	Op      string
+	Request string
+
+	// How long ago the op was read.
+	Age time.Duration
+}
+
+// The number of times an error was replied with to a type of op.
+type ErrorCount struct {
+	Op    string
+	Errno syscall.Errno
+	Count int
+}
+
+// The state recorded for an op in flight, if MountConfig.EnableDebugServer is
+// set.
+type debugOp struct {
+	op    interface{}
+	start time.Time
+}
+
+// The errors replied with during one minute, if MountConfig.EnableDebugServer
+// is set.
+type errorBucket struct {
+	minute int64
+	counts map[errorKey]int
+}
+
+type errorKey struct {
+	op    string
+	errno syscall.Errno
+}
+
+// Record an op being read, if MountConfig.EnableDebugServer is set.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) noteDebugOp(fuseID uint64, op interface{}) {
+	if !c.cfg.EnableDebugServer {
+		return
+	}
+
+	// Forget ops aren't replied to, and their IDs may be reused straight away.
+	// See beginOp.
+	switch op.(type) {
+	case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.debugOps[fuseID] = debugOp{op: op, start: time.Now()}
+}
+
+// Record the error replied with to an op, if MountConfig.EnableDebugServer is
+// set.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) noteDebugError(op interface{}, errno syscall.Errno) {
+	if !c.cfg.EnableDebugServer {
+		return
+	}
+
+	minute := time.Now().Unix() / 60
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pruneErrorBuckets(minute)
+	if n := len(c.errorBuckets); n == 0 || c.errorBuckets[n-1].minute != minute {
+		c.errorBuckets = append(c.errorBuckets, errorBucket{
+			minute: minute,
+			counts: make(map[errorKey]int),
+		})
+	}
+
+	c.errorBuckets[len(c.errorBuckets)-1].counts[errorKey{opName(op), errno}]++
+}
+
+// Drop the error counts that are too old to report as of the supplied minute.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Connection) pruneErrorBuckets(minute int64) {
+	oldest := minute - int64(debugErrorWindow/time.Minute) + 1
+
+	i := 0
+	for i < len(c.errorBuckets) && c.errorBuckets[i].minute < oldest {
+		i++
+	}
+
+	c.errorBuckets = c.errorBuckets[i:]
+}
+
+// DebugState returns a snapshot of the connection's state.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) DebugState() DebugState {
+	s := DebugState{
+		InitFlags:  c.initFlags.String(),
+		InitFlags2: c.initFlags2.String(),
+		OpsQueued:  c.sched.waiting(),
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	s.OpsInFlight = len(c.cancelFuncs)
+
+	for id, d := range c.debugOps {
+		s.InFlight = append(s.InFlight, InFlightOp{
+			FuseID:  id,
+			Op:      opName(d.op),
+			Request: describeRequest(d.op),
+			Age:     now.Sub(d.start),
+		})
+	}
+
+	c.pruneErrorBuckets(now.Unix() / 60)
+	counts := make(map[errorKey]int)
+	for _, b := range c.errorBuckets {
+		for k, n := range b.counts {
+			counts[k] += n
+		}
+	}
+	c.mu.Unlock()
+
+	for k, n := range counts {
+		s.RecentErrors = append(s.RecentErrors, ErrorCount{k.op, k.errno, n})
+	}
+
+	sort.Slice(s.InFlight, func(i, j int) bool {
+		return s.InFlight[i].Age > s.InFlight[j].Age
+	})
+
+	sort.Slice(s.RecentErrors, func(i, j int) bool {
+		a, b := s.RecentErrors[i], s.RecentErrors[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+
+		return a.Op < b.Op || a.Op == b.Op && a.Errno < b.Errno
+	})
+
+	return s
+}
+
+// DebugServer returns a handler serving a plain text report of the
+// connection's DebugState, for mounting on a debug HTTP server that only
+// trusted users can reach, since the report may include file names:
+//
+//	http.Handle("/debug/fuse", mfs.DebugServer())
+//
+// The ops in flight and the recent errors are only reported if
+// MountConfig.EnableDebugServer is set.
+func (c *Connection) DebugServer() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, c.DebugState().String())
+	})
+}
+
+// String renders the state as DebugServer does.
+func (s DebugState) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "init flags: %s\n", s.InitFlags)
+	fmt.Fprintf(&b, "init flags 2: %s\n", s.InitFlags2)
+	fmt.Fprintf(&b, "ops in flight: %d (%d queued)\n", s.OpsInFlight, s.OpsQueued)
+
+	for _, op := range s.InFlight {
+		fmt.Fprintf(
+			&b,
+			"  %12v  0x%08x  %s (%s)\n",
+			op.Age.Round(time.Millisecond),
+			op.FuseID,
+			op.Op,
+			op.Request)
+	}
+
+	fmt.Fprintf(&b, "errors in the last %v:\n", debugErrorWindow)
+	for _, e := range s.RecentErrors {
+		fmt.Fprintf(&b, "  %8d  %s %s\n", e.Count, e.Op, errnoName(e.Errno))
+	}
+
+	return b.String()
+}
+
+// Return the symbolic name of an errno, e.g. "EIO".
+func errnoName(errno syscall.Errno) string {
+	if name := unix.ErrnoName(errno); name != "" {
+		return name
+	}
+
+	return fmt.Sprintf("errno %d", int(errno))
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system whose StatFS waits for release to be closed, and in which
+// nothing can be unlinked.
+type stuckStatFS struct {
+	fuseutil.NotImplementedFileSystem
+	started chan struct{}
+	release chan struct{}
+}
+
+func (fs *stuckStatFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	close(fs.started)
+	<-fs.release
+	return nil
+}
+
+func (fs *stuckStatFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return syscall.ENOENT
+}
+
+func TestDebugServer(t *testing.T) {
+	fs := &stuckStatFS{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	cfg := &fuse.MountConfig{EnableDebugServer: true}
+	kernel, c, hangUp := serveWithConfig(t, cfg, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	sendUnlink(t, kernel, 1, "a")
+	sendUnlink(t, kernel, 2, "b")
+	for i := 0; i < 2; i++ {
+		if r := readReply(t, kernel); r.errno != -int32(syscall.ENOENT) {
+			t.Fatalf("Unlink reply: %+v", r)
+		}
+	}
+
+	sendRequest(t, kernel, fusekernel.OpStatfs, 3, nil)
+	<-fs.started
+
+	s := c.DebugState()
+	if s.OpsInFlight != 1 || len(s.InFlight) != 1 || s.InFlight[0].FuseID != 3 || s.InFlight[0].Op != "StatFS" {
+		t.Errorf("In flight: %d, %+v", s.OpsInFlight, s.InFlight)
+	}
+
+	want := []fuse.ErrorCount{{Op: "Unlink", Errno: syscall.ENOENT, Count: 2}}
+	if len(s.RecentErrors) != 1 || s.RecentErrors[0] != want[0] {
+		t.Errorf("Recent errors: %+v, want %+v", s.RecentErrors, want)
+	}
+
+	rec := httptest.NewRecorder()
+	c.DebugServer().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	for _, line := range []string{
+		"ops in flight: 1 (0 queued)",
+		"0x00000003  StatFS",
+		"2  Unlink ENOENT",
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("Report doesn't contain %q:\n%s", line, rec.Body.String())
+		}
+	}
+
+	close(fs.release)
+	if r := readReply(t, kernel); r.unique != 3 || r.errno != 0 {
+		t.Errorf("StatFS reply: %+v", r)
+	}
+
+	if s := c.DebugState(); len(s.InFlight) != 0 {
+		t.Errorf("In flight after replying: %+v", s.InFlight)
+	}
+}
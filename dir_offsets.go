@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// The fields of a fuse_dirent preceding its name, which WriteDirent in
+// fuseutil writes in host order, and the alignment of each entry.
+type direntHeader struct {
+	ino     uint64
+	off     uint64
+	namelen uint32
+	type_   uint32
+}
+
+const direntAlignment = 8
+
+// Return EIO for a successful ReadDirOp or ReadDirPlusOp replying with entries
+// whose offsets break the rules set out for fuseops.DirOffset. Offsets that
+// are zero, or equal to the one read from, would have the kernel read the same
+// entries again, and ones above fuseops.MaxDirOffset can't be seeked to.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) checkDirOffsets(op interface{}) error {
+	var name string
+	var from fuseops.DirOffset
+	var dst []byte
+	var bytesRead int
+	var skip int
+
+	switch o := op.(type) {
+	case *fuseops.ReadDirOp:
+		name, from, dst, bytesRead = "ReadDirOp", o.Offset, o.Dst, o.BytesRead
+
+	case *fuseops.ReadDirPlusOp:
+		name, from, dst, bytesRead = "ReadDirPlusOp", o.Offset, o.Dst, o.BytesRead
+
+		// Each entry follows the child's fuse_entry_out.
+		skip = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+
+	default:
+		return nil
+	}
+
+	if bytesRead < 0 || bytesRead > len(dst) {
+		if c.errorLogger != nil {
+			c.errorLogger.Printf(
+				"%s: BytesRead %d out of range for a read of %d bytes",
+				name,
+				bytesRead,
+				len(dst))
+		}
+
+		return syscall.EIO
+	}
+
+	const headerSize = int(unsafe.Sizeof(direntHeader{}))
+	seen := make(map[fuseops.DirOffset]struct{})
+	for b := dst[:bytesRead]; len(b) >= skip+headerSize; {
+		b = b[skip:]
+
+		var h direntHeader
+		copy((*[headerSize]byte)(unsafe.Pointer(&h))[:], b)
+
+		n := headerSize + int(h.namelen)
+		if n > len(b) {
+			break
+		}
+
+		off := fuseops.DirOffset(h.off)
+		if _, dup := seen[off]; dup || off == 0 || off > fuseops.MaxDirOffset || off == from {
+			if c.errorLogger != nil {
+				c.errorLogger.Printf(
+					"%s: entry %q has offset %d, reading from offset %d",
+					name,
+					b[headerSize:n],
+					off,
+					from)
+			}
+
+			return syscall.EIO
+		}
+
+		seen[off] = struct{}{}
+
+		if n%direntAlignment != 0 {
+			n += direntAlignment - n%direntAlignment
+		}
+
+		if n > len(b) {
+			break
+		}
+
+		b = b[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system whose directories list the same entries from any offset.
+type fixedDirFS struct {
+	fuseutil.NotImplementedFileSystem
+	entries []fuseutil.Dirent
+}
+
+func (fs *fixedDirFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	for _, e := range fs.entries {
+		op.BytesRead += fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+	}
+
+	return nil
+}
+
+func (fs *fixedDirFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	for _, e := range fs.entries {
+		op.BytesRead += fuseutil.WriteDirentPlus(op.Dst[op.BytesRead:], fuseutil.DirentPlus{Dirent: e})
+	}
+
+	return nil
+}
+
+func TestDirOffsets(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opcode  uint32
+		from    uint64
+		offsets []fuseops.DirOffset
+		errno   syscall.Errno
+	}{
+		{"increasing", fusekernel.OpReaddir, 0, []fuseops.DirOffset{1, 2}, 0},
+		{"any order", fusekernel.OpReaddir, 7, []fuseops.DirOffset{9, 8}, 0},
+		{"zero", fusekernel.OpReaddir, 0, []fuseops.DirOffset{1, 0}, syscall.EIO},
+		{"repeated", fusekernel.OpReaddir, 0, []fuseops.DirOffset{3, 3}, syscall.EIO},
+		{"read from", fusekernel.OpReaddir, 2, []fuseops.DirOffset{2}, syscall.EIO},
+		{"too large", fusekernel.OpReaddir, 0, []fuseops.DirOffset{fuseops.MaxDirOffset + 1}, syscall.EIO},
+		{"plus", fusekernel.OpReaddirplus, 0, []fuseops.DirOffset{1, 2}, 0},
+		{"plus repeated", fusekernel.OpReaddirplus, 0, []fuseops.DirOffset{1, 1}, syscall.EIO},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &fixedDirFS{}
+			for i, off := range tc.offsets {
+				fs.entries = append(fs.entries, fuseutil.Dirent{
+					Offset: off,
+					Inode:  fuseops.InodeID(i + 2),
+					Name:   string(rune('a' + i)),
+				})
+			}
+
+			kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(fs))
+			defer hangUp()
+
+			in := fusekernel.ReadIn{Offset: tc.from, Size: 4096}
+			sendRequest(t, kernel, tc.opcode, 1, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+
+			if r := readReply(t, kernel); r.errno != -int32(tc.errno) {
+				t.Errorf("Reply: %+v, want errno %d", r, tc.errno)
+			}
+		})
+	}
+}
@@ -29,8 +29,25 @@
 // Make sure to see the examples in the sub-packages of samples/, which double
 // as tests for this package: http://godoc.org/github.com/jacobsa/fuse/samples
 //
+// The package speaks the kernel's wire protocol itself, without depending on
+// another FUSE library: Connection reads requests from the device, converts
+// each into the corresponding op struct from fuseops, and writes the reply the
+// kernel expects for it. The protocol version is negotiated during init,
+// between 7.19 and 7.31 (see internal/fusekernel).
+//
+// On Linux, a process that may not mount file systems itself, as is usually
+// the case when not running as root, has the setuid fusermount3(1) (or
+// fusermount(1)) helper mount them instead, which passes the connection to the
+// kernel back over a socket pair. Such file systems are unmounted through the
+// helper too.
+//
 // In order to use this package to mount file systems on OS X, the system must
 // have FUSE for OS X installed (see http://osxfuse.github.io/). Do note that
 // there are several OS X-specific oddities; grep through the documentation for
 // more info.
+//
+// On FreeBSD, file systems are mounted with mount_fusefs(8), which requires
+// the fusefs kernel module to be loaded (kldload fusefs). The kernel speaks the
+// same variant of the protocol as Linux, without some of its newer features;
+// options documented as Linux only may be ignored there.
 package fuse
@@ -0,0 +1,340 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A harness running the tests of this package and its samples against a real
+// kernel inside a virtual machine, so that they can run in CI without
+// mounting anything on the machine running them, and without hanging it.
+// From the root of the repository:
+//
+//	go run ./e2e
+//
+// builds a test binary for each package with tests, then boots the running
+// kernel in a VM with virtme-ng (vng), sharing the host's file system, and
+// runs itself there as root with --guest. The guest runs each test binary
+// with a timeout, then mounts memfs and runs fsstress from xfstests on it, if
+// given its path with --fsstress:
+//
+//	go run ./e2e --fsstress /usr/lib/xfstests/ltp/fsstress --run TestMemFS
+//
+// On a disposable machine or container with /dev/fuse, --guest may be used
+// directly, skipping the VM, once the binaries have been built with
+// --build_only.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/samples/memfs"
+)
+
+var fGuest = flag.Bool("guest", false, "Run the tests built in --dir, rather than booting a VM to do so.")
+var fBuildOnly = flag.Bool("build_only", false, "Build the tests in --dir, without running them.")
+var fDir = flag.String("dir", "", "Where to build the tests. Defaults to a temporary directory.")
+var fPackages = flag.String("packages", ".,./samples/...", "Comma-separated patterns of the packages to test.")
+var fRun = flag.String("run", "", "Run only the tests matching this regexp.")
+var fTestTimeout = flag.Duration("test_timeout", 10*time.Minute, "How long each package's tests may run for.")
+var fTimeout = flag.Duration("timeout", time.Hour, "How long the VM may run for.")
+var fFsstress = flag.String("fsstress", "", "The path of fsstress, to run on memfs after the tests.")
+var fFsstressArgs = flag.String("fsstress_args", "-n 10000 -p 4", "The arguments to fsstress, besides -d.")
+var fVng = flag.String("vng", "vng", "The path of virtme-ng's vng command.")
+
+// The files in --dir listing the test binaries, with the directories of their
+// packages, and recording the guest's result.
+const (
+	manifestName = "tests"
+	resultName   = "result"
+)
+
+func main() {
+	flag.Parse()
+
+	if *fGuest {
+		if *fDir == "" {
+			log.Fatalf("You must set --dir.")
+		}
+
+		if err := runGuest(*fDir); err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		return
+	}
+
+	dir := *fDir
+	if dir == "" {
+		var err error
+		if dir, err = os.MkdirTemp("", "fuse_e2e"); err != nil {
+			log.Fatalf("MkdirTemp: %v", err)
+		}
+		defer os.RemoveAll(dir)
+	}
+
+	if err := build(dir); err != nil {
+		log.Fatalf("build: %v", err)
+	}
+
+	if *fBuildOnly {
+		return
+	}
+
+	if err := runVM(dir); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Host
+////////////////////////////////////////////////////////////////////////
+
+// Build a binary in dir for each package with tests, and copy this program
+// there for the guest to run.
+func build(dir string) error {
+	args := []string{
+		"list",
+		"-e",
+		"-f", "{{if or .TestGoFiles .XTestGoFiles}}{{.ImportPath}} {{.Dir}}{{end}}",
+	}
+	args = append(args, strings.Split(*fPackages, ",")...)
+
+	out, err := exec.Command("go", args...).Output()
+	if err != nil {
+		return fmt.Errorf("go list: %w", err)
+	}
+
+	var manifest strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line == "" {
+			continue
+		}
+
+		pkg, pkgDir, _ := strings.Cut(line, " ")
+		bin := filepath.Join(dir, strings.ReplaceAll(pkg, "/", "_")+".test")
+
+		log.Printf("Building %s", pkg)
+		cmd := exec.Command("go", "test", "-c", "-o", bin, pkg)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("go test -c %s: %w", pkg, err)
+		}
+
+		fmt.Fprintf(&manifest, "%s %s\n", bin, pkgDir)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, manifestName), []byte(manifest.String()), 0644); err != nil {
+		return err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	return copyFile(self, filepath.Join(dir, "e2e"))
+}
+
+func copyFile(from string, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
+
+// Boot a VM running the guest half on dir, and report its result.
+func runVM(dir string) error {
+	guest := []string{
+		filepath.Join(dir, "e2e"),
+		"--guest",
+		"--dir", dir,
+		"--run", quote(*fRun),
+		"--test_timeout", fTestTimeout.String(),
+		"--fsstress", quote(*fFsstress),
+		"--fsstress_args", quote(*fFsstressArgs),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *fTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(
+		ctx,
+		*fVng,
+		"--run",
+		"--rwdir", dir,
+		"--exec", strings.Join(guest, " "))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("vng: %w", err)
+	}
+
+	// Don't rely on vng passing on the guest's exit status: a guest that
+	// didn't get to the end, e.g. because its kernel panicked, leaves no
+	// result.
+	result, err := os.ReadFile(filepath.Join(dir, resultName))
+	if err != nil {
+		return fmt.Errorf("no result from the guest: %w", err)
+	}
+
+	if s := strings.TrimSpace(string(result)); s != "PASS" {
+		return fmt.Errorf("guest: %s", s)
+	}
+
+	return nil
+}
+
+// Quote a string for the shell running the guest's command.
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+////////////////////////////////////////////////////////////////////////
+// Guest
+////////////////////////////////////////////////////////////////////////
+
+// Run the test binaries listed in dir, then fsstress if asked to, recording
+// the failures in dir.
+func runGuest(dir string) error {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		if out, err := exec.Command("modprobe", "fuse").CombinedOutput(); err != nil {
+			return fmt.Errorf("modprobe fuse: %v: %s", err, out)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, manifestName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var failures []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		bin, pkgDir, _ := strings.Cut(s.Text(), " ")
+		if err := runTest(bin, pkgDir); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", filepath.Base(bin), err))
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	if *fFsstress != "" {
+		if err := runFsstress(); err != nil {
+			failures = append(failures, fmt.Sprintf("fsstress: %v", err))
+		}
+	}
+
+	result := "PASS"
+	if len(failures) != 0 {
+		result = "FAIL " + strings.Join(failures, "; ")
+	}
+
+	log.Printf("%s", result)
+	if err := os.WriteFile(filepath.Join(dir, resultName), []byte(result+"\n"), 0644); err != nil {
+		return err
+	}
+
+	if len(failures) != 0 {
+		return fmt.Errorf("%d failures", len(failures))
+	}
+
+	return nil
+}
+
+// Run a test binary in its package's directory, where it may expect to find
+// test data.
+func runTest(bin string, pkgDir string) error {
+	args := []string{"-test.timeout", fTestTimeout.String()}
+	if *fRun != "" {
+		args = append(args, "-test.run", *fRun)
+	}
+
+	log.Printf("Running %s", filepath.Base(bin))
+	start := time.Now()
+
+	cmd := exec.Command(bin, args...)
+	cmd.Dir = pkgDir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+
+	log.Printf("%s: %v after %v", filepath.Base(bin), errOrOK(err), time.Since(start))
+	return err
+}
+
+func errOrOK(err error) interface{} {
+	if err == nil {
+		return "ok"
+	}
+
+	return err
+}
+
+// Mount memfs and run fsstress on it.
+func runFsstress() error {
+	mountPoint, err := os.MkdirTemp("", "fuse_e2e_memfs")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mountPoint)
+
+	mfs, err := fuse.Mount(
+		mountPoint,
+		memfs.NewMemFS(0, 0),
+		&fuse.MountConfig{FSName: "memfs"})
+	if err != nil {
+		return fmt.Errorf("Mount: %w", err)
+	}
+
+	args := append([]string{"-d", filepath.Join(mountPoint, "stress")}, strings.Fields(*fFsstressArgs)...)
+	log.Printf("Running fsstress %s", strings.Join(args, " "))
+
+	cmd := exec.Command(*fFsstress, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	runErr := cmd.Run()
+
+	// The guest may have no fusermount, which Shutdown can do without as
+	// root.
+	if err := mfs.Shutdown(context.Background()); err != nil {
+		return fmt.Errorf("Shutdown: %w", err)
+	}
+
+	return runErr
+}
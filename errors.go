@@ -14,7 +14,10 @@
 
 package fuse
 
-import "syscall"
+import (
+	"fmt"
+	"syscall"
+)
 
 const (
 	// Errors corresponding to kernel error numbers. These may be treated
@@ -22,9 +25,39 @@ const (
 	EEXIST    = syscall.EEXIST
 	EINVAL    = syscall.EINVAL
 	EIO       = syscall.EIO
-	ENOATTR   = syscall.ENODATA
+	ENOATTR   = enoattr
 	ENOENT    = syscall.ENOENT
 	ENOSYS    = syscall.ENOSYS
 	ENOTDIR   = syscall.ENOTDIR
 	ENOTEMPTY = syscall.ENOTEMPTY
 )
+
+// ConnectionLostError is returned by MountedFileSystem.Join when serving
+// stopped because the connection to the kernel was torn down from outside the
+// daemon (e.g. by `umount -f`, or by writing to the connection's abort file in
+// /sys/fs/fuse/connections) rather than by an orderly unmount.
+//
+// A connection torn down while no ops were in flight is only detected if it
+// leaves the mount point behind, as aborting it does. A forced unmount of an
+// idle file system looks to the daemon just like an orderly one, and is
+// reported as such.
+type ConnectionLostError struct {
+	// The error reported by the device: ENODEV if the kernel aborted the
+	// connection, EBADF if the device was closed underneath us.
+	Err error
+
+	// The number of ops that had been read from the connection but not yet
+	// responded to when the loss was detected.
+	InFlight int
+}
+
+func (e *ConnectionLostError) Error() string {
+	return fmt.Sprintf(
+		"connection to the kernel lost with %d ops in flight: %v",
+		e.InFlight,
+		e.Err)
+}
+
+func (e *ConnectionLostError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,8 @@
+//go:build !freebsd
+// +build !freebsd
+
+package fuse
+
+import "syscall"
+
+const enoattr = syscall.ENODATA
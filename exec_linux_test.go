@@ -0,0 +1,76 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system opening every file for direct IO, and sending on the flags of
+// each open.
+type directIOFS struct {
+	fuseutil.NotImplementedFileSystem
+	flags chan fusekernel.OpenFlags
+}
+
+func (fs *directIOFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.flags <- op.OpenFlags
+	op.UseDirectIO = true
+	return nil
+}
+
+func TestExec(t *testing.T) {
+	fs := &directIOFS{flags: make(chan fusekernel.OpenFlags, 2)}
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	open := func(unique uint64, flags fusekernel.OpenFlags) fusekernel.OpenResponseFlags {
+		t.Helper()
+
+		in := fusekernel.OpenIn{Flags: uint32(flags)}
+		sendRequest(t, kernel, fusekernel.OpOpen, unique, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+
+		r := readReply(t, kernel)
+		if r.errno != 0 {
+			t.Fatalf("Open: %+v", r)
+		}
+
+		return fusekernel.OpenResponseFlags((*fusekernel.OpenOut)(unsafe.Pointer(&r.data[0])).OpenFlags)
+	}
+
+	// Ordinary opens get direct IO...
+	if flags := open(1, fusekernel.OpenReadOnly); flags&fusekernel.OpenDirectIO == 0 {
+		t.Errorf("Open for reading: %v", flags)
+	}
+
+	// ...while executables are read through the page cache.
+	flags := open(2, fusekernel.OpenReadOnly|fusekernel.OpenExec)
+	if flags&fusekernel.OpenDirectIO != 0 {
+		t.Errorf("Open for execution: %v", flags)
+	}
+
+	<-fs.flags
+	if flags := <-fs.flags; !flags.IsExec() || !flags.IsReadOnly() {
+		t.Errorf("OpenFlags: %v", flags)
+	}
+}
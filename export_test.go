@@ -0,0 +1,49 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"os"
+)
+
+// Perform the init handshake over dev, which a test holds the other end of in
+// place of the kernel, and return a connection ready to be served. The caller
+// must call Close once the server has returned.
+func NewConnection(cfg *MountConfig, dev *os.File) (*Connection, error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+
+	cfgCopy := *cfg
+	if cfgCopy.OpContext == nil {
+		cfgCopy.OpContext = context.Background()
+	}
+
+	return newConnection(cfgCopy, cfg.DebugLogger, cfg.ErrorLogger, dev)
+}
+
+// Start draining the connection as MountedFileSystem.Shutdown does.
+func (c *Connection) Drain() <-chan struct{} {
+	return c.drain()
+}
+
+// Replace the cloning of the fuse device for MountConfig.DeviceReaders,
+// returning a function that restores it.
+func SetCloneDevice(f func(dev *os.File) (*os.File, error)) (restore func()) {
+	old := cloneDevice
+	cloneDevice = f
+	return func() { cloneDevice = old }
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system answering attribute requests from a cache, whose unlinks
+// block until release is closed.
+type fastPathFS struct {
+	fuseutil.NotImplementedFileSystem
+	offered chan string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (fs *fastPathFS) TryFastPath(
+	ctx context.Context,
+	op interface{}) (bool, error) {
+	fs.offered <- fmt.Sprintf("%T", op)
+
+	if o, ok := op.(*fuseops.GetInodeAttributesOp); ok {
+		o.Attributes.Size = 42
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (fs *fastPathFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes.Size = 1
+	return nil
+}
+
+func (fs *fastPathFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	close(fs.started)
+	<-fs.release
+	return nil
+}
+
+func TestFastPath(t *testing.T) {
+	fs := &fastPathFS{
+		offered: make(chan string, 10),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	cfg := &fuse.MountConfig{MaxConcurrentOps: 1}
+	kernel, _, hangUp := serveWithConfig(t, cfg, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	// Take up the only slot for calls to the file system.
+	sendUnlink(t, kernel, 1, "a")
+	<-fs.started
+
+	// Cache hits are answered all the same.
+	sendRequest(t, kernel, fusekernel.OpGetattr, 2, make([]byte, unsafe.Sizeof(fusekernel.GetattrIn{})))
+	r := readReply(t, kernel)
+	if r.unique != 2 || r.errno != 0 {
+		t.Fatalf("GetAttr reply: %+v", r)
+	}
+
+	if size := (*fusekernel.AttrOut)(unsafe.Pointer(&r.data[0])).Attr.Size; size != 42 {
+		t.Errorf("Size: %d, want 42", size)
+	}
+
+	close(fs.release)
+	if r := readReply(t, kernel); r.unique != 1 || r.errno != 0 {
+		t.Errorf("Unlink reply: %+v", r)
+	}
+
+	// Ops that modify the file system were never offered.
+	if op := <-fs.offered; op != "*fuseops.GetInodeAttributesOp" {
+		t.Errorf("Offered %s", op)
+	}
+
+	select {
+	case op := <-fs.offered:
+		t.Errorf("Offered %s", op)
+	default:
+	}
+}
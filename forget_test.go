@@ -0,0 +1,87 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system recording the forget ops it receives.
+type forgetRecorder struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	batches [][]fuseops.BatchForgetEntry
+}
+
+func (fs *forgetRecorder) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *forgetRecorder) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.batches = append(fs.batches, op.Entries)
+	return nil
+}
+
+func TestBatchForget(t *testing.T) {
+	fs := &forgetRecorder{}
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	const n = 1000
+	count := fusekernel.BatchForgetCountIn{Count: n}
+	body := append([]byte(nil), (*[unsafe.Sizeof(count)]byte)(unsafe.Pointer(&count))[:]...)
+	for i := 0; i < n; i++ {
+		e := fusekernel.BatchForgetEntryIn{Inode: int64(i + 2), Nlookup: uint64(i + 1)}
+		body = append(body, (*[unsafe.Sizeof(e)]byte)(unsafe.Pointer(&e))[:]...)
+	}
+
+	// The kernel doesn't expect a reply to forgets, so follow with an op that
+	// gets one. The batch is handled before that op is read.
+	sendRequest(t, kernel, fusekernel.OpBatchForget, 1, body)
+	sendRequest(t, kernel, fusekernel.OpStatfs, 2, nil)
+	if r := readReply(t, kernel); r.unique != 2 {
+		t.Fatalf("Reply: %+v", r)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if len(fs.batches) != 1 || len(fs.batches[0]) != n {
+		t.Fatalf("Batches: %d", len(fs.batches))
+	}
+
+	for i, e := range fs.batches[0] {
+		if e.Inode != fuseops.InodeID(i+2) || e.N != uint64(i+1) {
+			t.Errorf("Entry %d: %+v", i, e)
+		}
+	}
+}
@@ -24,24 +24,44 @@ import (
 // buffer.InMessage
 ////////////////////////////////////////////////////////////////////////
 
-// LOCKS_EXCLUDED(c.mu)
-func (c *Connection) getInMessage() *buffer.InMessage {
-	c.mu.Lock()
-	x := (*buffer.InMessage)(c.inMessages.Get())
-	c.mu.Unlock()
+// Get a buffer to read a message into through the supplied reader, which is
+// nil for ReadOp itself. Each reader has a freelist of its own, so that they
+// don't contend for c.mu.
+//
+// LOCKS_EXCLUDED(c.mu, r.mu)
+func (c *Connection) getInMessage(r *deviceReader) *buffer.InMessage {
+	var x *buffer.InMessage
+	if r == nil {
+		c.mu.Lock()
+		x = (*buffer.InMessage)(c.inMessages.Get())
+		c.mu.Unlock()
+	} else {
+		r.mu.Lock()
+		x = (*buffer.InMessage)(r.inMessages.Get())
+		r.mu.Unlock()
+	}
 
 	if x == nil {
-		x = buffer.NewInMessage()
+		x = buffer.NewInMessage(c.maxWrite())
 	}
 
 	return x
 }
 
-// LOCKS_EXCLUDED(c.mu)
-func (c *Connection) putInMessage(x *buffer.InMessage) {
-	c.mu.Lock()
-	c.inMessages.Put(unsafe.Pointer(x))
-	c.mu.Unlock()
+// Return a buffer obtained with getInMessage to the freelist it came from.
+//
+// LOCKS_EXCLUDED(c.mu, r.mu)
+func (c *Connection) putInMessage(r *deviceReader, x *buffer.InMessage) {
+	if r == nil {
+		c.mu.Lock()
+		c.inMessages.Put(unsafe.Pointer(x))
+		c.mu.Unlock()
+		return
+	}
+
+	r.mu.Lock()
+	r.inMessages.Put(unsafe.Pointer(x))
+	r.mu.Unlock()
 }
 
 ////////////////////////////////////////////////////////////////////////
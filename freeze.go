@@ -0,0 +1,185 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// What happens to ops that would modify a frozen file system. See
+// Connection.Freeze.
+type FreezePolicy int
+
+const (
+	// Hold the ops until the file system is thawed.
+	FreezeQueue FreezePolicy = iota
+
+	// Fail the ops with EROFS.
+	FreezeFail
+)
+
+// Returned by Connection.Freeze when the connection is already frozen.
+var ErrFrozen = errors.New("file system already frozen")
+
+// Report whether the op modifies the file system's namespace, metadata or
+// contents.
+func isMutatingOp(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.SetInodeAttributesOp,
+		*fuseops.MkDirOp,
+		*fuseops.MkNodeOp,
+		*fuseops.CreateFileOp,
+		*fuseops.CreateLinkOp,
+		*fuseops.CreateSymlinkOp,
+		*fuseops.RenameOp,
+		*fuseops.RmDirOp,
+		*fuseops.UnlinkOp,
+		*fuseops.WriteFileOp,
+		*fuseops.SetXattrOp,
+		*fuseops.RemoveXattrOp,
+		*fuseops.FallocateOp,
+		*fuseops.SetInodeFlagsOp:
+		return true
+	}
+
+	return false
+}
+
+// Freeze quiesces the file system so that a backup or snapshot of its backing
+// store can be taken at a consistent point: ops that would modify it are held
+// or failed according to the policy, and Freeze returns once those already
+// being handled have been replied to. Ops that don't modify the file system
+// carry on as usual. If ctx is cancelled first, the file system is thawed and
+// ctx's error returned.
+//
+// Only ops for which the server calls WaitForThaw are held back;
+// fuseutil.NewFileSystemServer does so for every op. Note that the backing
+// store may still change in the meantime if the file system buffers writes,
+// or the kernel writes back dirty pages, before a freeze: such file systems
+// should flush them when FlushFileOp or SyncFileOp arrive, and callers sync(2)
+// the mount point before freezing.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) Freeze(ctx context.Context, policy FreezePolicy) error {
+	c.mu.Lock()
+	if c.thawed != nil {
+		c.mu.Unlock()
+		return ErrFrozen
+	}
+
+	c.thawed = make(chan struct{})
+	c.freezePolicy = policy
+
+	var drained chan struct{}
+	if len(c.mutating) != 0 {
+		drained = make(chan struct{})
+		c.drained = drained
+	}
+	c.mu.Unlock()
+
+	if drained == nil {
+		return nil
+	}
+
+	select {
+	case <-drained:
+		return nil
+
+	case <-ctx.Done():
+		c.Thaw()
+		return ctx.Err()
+	}
+}
+
+// Thaw lets ops that modify the file system proceed again after Freeze,
+// starting with those being held. It does nothing if the file system isn't
+// frozen.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) Thaw() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.thawed == nil {
+		return
+	}
+
+	close(c.thawed)
+	c.thawed = nil
+	c.drained = nil
+}
+
+// WaitForThaw must be called by servers before handling each op read with
+// ReadOp, if they are to support Freeze. For an op that modifies the file
+// system, it blocks while the file system is frozen under FreezeQueue, and
+// returns EROFS while it is frozen under FreezeFail; the caller must then
+// reply to the op with the error returned, which is EINTR if ctx is cancelled
+// while waiting. For other ops it returns nil straight away.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) WaitForThaw(ctx context.Context, op interface{}) error {
+	if !isMutatingOp(op) {
+		return nil
+	}
+
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		panic(fmt.Sprintf("WaitForThaw called with invalid context: %#v", ctx))
+	}
+
+	fuseID := state.inMsg.Header().Unique
+	for {
+		c.mu.Lock()
+		thawed := c.thawed
+		if thawed == nil {
+			c.mutating[fuseID] = struct{}{}
+			c.mu.Unlock()
+			return nil
+		}
+
+		policy := c.freezePolicy
+		c.mu.Unlock()
+
+		if policy == FreezeFail {
+			return syscall.EROFS
+		}
+
+		select {
+		case <-thawed:
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+	}
+}
+
+// Note that an op admitted by WaitForThaw has been replied to.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Connection) finishMutating(fuseID uint64) {
+	if _, ok := c.mutating[fuseID]; !ok {
+		return
+	}
+
+	delete(c.mutating, fuseID)
+	if len(c.mutating) == 0 && c.drained != nil {
+		close(c.drained)
+		c.drained = nil
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system in which unlinking "slow" waits for release to be closed.
+type slowUnlinkFS struct {
+	fuseutil.NotImplementedFileSystem
+	started chan struct{}
+	release chan struct{}
+}
+
+func (fs *slowUnlinkFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if op.Name == "slow" {
+		close(fs.started)
+		<-fs.release
+	}
+
+	return nil
+}
+
+func sendUnlink(t *testing.T, kernel *os.File, unique uint64, name string) {
+	sendRequest(t, kernel, fusekernel.OpUnlink, unique, []byte(name+"\x00"))
+}
+
+func TestFreeze(t *testing.T) {
+	ctx := context.Background()
+	fs := &slowUnlinkFS{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	kernel, c, hangUp := serve(t, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	// Freezing waits for modifications already being handled.
+	sendUnlink(t, kernel, 1, "slow")
+	<-fs.started
+
+	frozen := make(chan error, 1)
+	go func() { frozen <- c.Freeze(ctx, fuse.FreezeQueue) }()
+
+	select {
+	case err := <-frozen:
+		t.Fatalf("Freeze returned %v with an unlink in flight", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(fs.release)
+	if r := readReply(t, kernel); r.unique != 1 || r.errno != 0 {
+		t.Errorf("Unlink reply: %+v", r)
+	}
+
+	if err := <-frozen; err != nil {
+		t.Fatalf("Freeze: %v", err)
+	}
+
+	if err := c.Freeze(ctx, fuse.FreezeQueue); err != fuse.ErrFrozen {
+		t.Errorf("Freezing twice: %v", err)
+	}
+
+	// Modifications are then held, while other ops carry on.
+	sendUnlink(t, kernel, 2, "a")
+	sendRequest(t, kernel, fusekernel.OpStatfs, 3, nil)
+	if r := readReply(t, kernel); r.unique != 3 {
+		t.Errorf("Reply while frozen: %+v", r)
+	}
+
+	c.Thaw()
+	if r := readReply(t, kernel); r.unique != 2 || r.errno != 0 {
+		t.Errorf("Unlink reply after thawing: %+v", r)
+	}
+
+	// Or failed, if so chosen.
+	if err := c.Freeze(ctx, fuse.FreezeFail); err != nil {
+		t.Fatalf("Freeze: %v", err)
+	}
+
+	sendUnlink(t, kernel, 4, "b")
+	if r := readReply(t, kernel); r.unique != 4 || r.errno != -int32(syscall.EROFS) {
+		t.Errorf("Unlink reply while frozen: %+v", r)
+	}
+
+	c.Thaw()
+}
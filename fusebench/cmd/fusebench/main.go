@@ -0,0 +1,188 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A tool for comparing the performance of FUSE file systems, e.g. loopback
+// file systems built on this package, hanwen/go-fuse and bazil.org/fuse, all
+// mirroring the same directory. First create the tree the benchmarks read:
+//
+//	fusebench --populate --dir /tmp/backing
+//
+// Then mount each file system over it and run the benchmarks through the
+// mount point, e.g. for this package's loopback:
+//
+//	mount_roloopbackfs --path /tmp/backing --mount_point /tmp/mnt &
+//	fusebench --dir /tmp/mnt --label jacobsa --out jacobsa.json
+//
+// and likewise for go-fuse's loopback example and a bazil-based loopback,
+// mounted with the same kernel caching options. Finally, compare the reports,
+// each with the first:
+//
+//	fusebench --compare gofuse.json,jacobsa.json,bazil.json
+//
+// With --max_slowdown, the tool exits non-zero when a workload runs slower
+// than in the first report by more than that fraction, so that regressions
+// against a saved baseline can fail a build.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/folays/jacobsa_fuse/fusebench"
+)
+
+var fDir = flag.String("dir", "", "The mount point to benchmark, or directory to populate.")
+var fPopulate = flag.Bool("populate", false, "Create the benchmarks' tree in --dir and exit.")
+var fLabel = flag.String("label", "", "What is being benchmarked, recorded in the report.")
+var fOut = flag.String("out", "", "Where to write the report as JSON, in addition to printing it.")
+var fCompare = flag.String("compare", "", "Comma-separated reports to compare with the first.")
+var fMaxSlowdown = flag.Float64("max_slowdown", 0, "With --compare, fail if a workload is slower than in the first report by more than this fraction.")
+
+var fFiles = flag.Int("files", 0, "The number of small files.")
+var fFileSize = flag.Int64("file_size", 0, "The size of the small files.")
+var fLargeFileSize = flag.Int64("large_file_size", 0, "The size of the large file.")
+var fDuration = flag.Duration("duration", 0, "How long each workload runs for.")
+
+func main() {
+	flag.Parse()
+
+	if *fCompare != "" {
+		if !compare(strings.Split(*fCompare, ",")) {
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if *fDir == "" {
+		log.Fatalf("You must set --dir.")
+	}
+
+	cfg := fusebench.Config{
+		Files:         *fFiles,
+		FileSize:      *fFileSize,
+		LargeFileSize: *fLargeFileSize,
+		Duration:      *fDuration,
+	}
+
+	if *fPopulate {
+		if err := fusebench.Populate(*fDir, cfg); err != nil {
+			log.Fatalf("Populate: %v", err)
+		}
+
+		return
+	}
+
+	r, err := fusebench.Run(*fDir, *fLabel, cfg)
+	if err != nil {
+		log.Fatalf("Run: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "WORKLOAD\tOPS/S\tMB/S\tP50\tP99\n")
+	for _, res := range r.Results {
+		fmt.Fprintf(
+			w,
+			"%s\t%.0f\t%.1f\t%v\t%v\n",
+			res.Workload,
+			res.OpsPerSecond(),
+			float64(res.Bytes)/res.Elapsed.Seconds()/(1<<20),
+			res.P50,
+			res.P99)
+	}
+	w.Flush()
+
+	if *fOut == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		log.Fatalf("Marshal: %v", err)
+	}
+
+	if err := os.WriteFile(*fOut, data, 0644); err != nil {
+		log.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func readReport(path string) *fusebench.Report {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("ReadFile: %v", err)
+	}
+
+	r := &fusebench.Report{}
+	if err := json.Unmarshal(data, r); err != nil {
+		log.Fatalf("Unmarshal %s: %v", path, err)
+	}
+
+	if r.Label == "" {
+		r.Label = path
+	}
+
+	return r
+}
+
+// Print each report's results next to the first's, returning false if any is
+// slower than allowed by --max_slowdown.
+func compare(paths []string) bool {
+	base := readReport(paths[0])
+	ok := true
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "WORKLOAD\tREPORT\tOPS/S\tRATIO\tP50\tP99\n")
+	for _, path := range paths[1:] {
+		other := readReport(path)
+		for _, c := range fusebench.Compare(base, other) {
+			fmt.Fprintf(
+				w,
+				"%s\t%s\t%.0f\t-\t%v\t%v\n",
+				c.Workload,
+				base.Label,
+				c.Base.OpsPerSecond(),
+				c.Base.P50,
+				c.Base.P99)
+
+			fmt.Fprintf(
+				w,
+				"%s\t%s\t%.0f\t%.2f\t%v\t%v\n",
+				c.Workload,
+				other.Label,
+				c.Other.OpsPerSecond(),
+				c.Ratio,
+				c.Other.P50,
+				c.Other.P99)
+
+			if *fMaxSlowdown > 0 && c.Ratio < 1-*fMaxSlowdown {
+				ok = false
+			}
+		}
+	}
+	w.Flush()
+
+	if !ok {
+		log.Printf(
+			"Some workloads are more than %.0f%% slower than in %s.",
+			*fMaxSlowdown*100,
+			base.Label)
+	}
+
+	return ok
+}
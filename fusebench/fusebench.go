@@ -0,0 +1,289 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fusebench measures the throughput and latency of common file system
+// operations through a mount point, so that a file system built on this
+// package can be compared with equivalent ones built on other FUSE libraries,
+// such as hanwen/go-fuse and bazil.org/fuse, and regressions tracked as this
+// package changes.
+//
+// The workloads only read, so that read-only file systems can be measured
+// too. They expect the tree created by Populate, typically in the directory
+// that loopback file systems built on each library mirror, e.g. with
+// samples/mount_roloopbackfs for this package. Results depend on the kernel
+// caching each file system allows, so the file systems compared should ask
+// for the same. See cmd/fusebench for a command running the workloads and
+// comparing their results.
+package fusebench
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Options for Populate and Run, which must agree on the tree's shape.
+type Config struct {
+	// The number of small files, and their size. Default to 100 and 4 KiB.
+	Files    int
+	FileSize int64
+
+	// The size of the large file read by SeqRead and RandRead. Defaults to
+	// 64 MiB.
+	LargeFileSize int64
+
+	// How long each workload runs for. Defaults to two seconds.
+	Duration time.Duration
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.Files <= 0 {
+		cfg.Files = 100
+	}
+
+	if cfg.FileSize <= 0 {
+		cfg.FileSize = 4 << 10
+	}
+
+	if cfg.LargeFileSize <= 0 {
+		cfg.LargeFileSize = 64 << 20
+	}
+
+	if cfg.Duration <= 0 {
+		cfg.Duration = 2 * time.Second
+	}
+}
+
+// The sizes of the reads made by SeqRead and RandRead.
+const (
+	seqReadSize  = 128 << 10
+	randReadSize = 4 << 10
+)
+
+// The measurements of a workload.
+type Result struct {
+	Workload string
+
+	// The number of operations made, the bytes they read, if any, and the
+	// time they took altogether.
+	Ops     int
+	Bytes   int64
+	Elapsed time.Duration
+
+	// The median and 99th percentile latencies of the operations.
+	P50 time.Duration
+	P99 time.Duration
+}
+
+// OpsPerSecond returns the throughput of the workload in operations.
+func (r Result) OpsPerSecond() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+
+	return float64(r.Ops) / r.Elapsed.Seconds()
+}
+
+// The results of running the workloads on a mount, e.g. as saved as JSON by
+// cmd/fusebench.
+type Report struct {
+	// What was measured, e.g. "go-fuse loopback".
+	Label string
+
+	Time    time.Time
+	Results []Result
+}
+
+// Create the tree the workloads expect in dir, which must exist: a directory
+// "small" of small files, and a large file "large".
+func Populate(dir string, cfg Config) error {
+	cfg.setDefaults()
+
+	small := filepath.Join(dir, "small")
+	if err := os.MkdirAll(small, 0755); err != nil {
+		return err
+	}
+
+	data := make([]byte, cfg.FileSize)
+	rand.Read(data)
+	for i := 0; i < cfg.Files; i++ {
+		if err := os.WriteFile(smallFile(dir, i), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(filepath.Join(dir, "large"))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(f, rand.New(rand.NewSource(1)), cfg.LargeFileSize)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+func smallFile(dir string, i int) string {
+	return filepath.Join(dir, "small", fmt.Sprintf("f%d", i))
+}
+
+// A workload, making one operation each time it is called with the count of
+// operations made so far, and returning the bytes read.
+type workload struct {
+	name string
+	op   func(i int) (int64, error)
+}
+
+// Run the workloads, one after the other, on the tree created by Populate in
+// dir, typically a mount point.
+func Run(dir string, label string, cfg Config) (*Report, error) {
+	cfg.setDefaults()
+
+	large, err := os.Open(filepath.Join(dir, "large"))
+	if err != nil {
+		return nil, err
+	}
+	defer large.Close()
+
+	fi, err := large.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Size() < seqReadSize {
+		return nil, errors.New("large file too small; was the tree populated?")
+	}
+
+	buf := make([]byte, seqReadSize)
+	rng := rand.New(rand.NewSource(1))
+	workloads := []workload{
+		{"Stat", func(i int) (int64, error) {
+			_, err := os.Lstat(smallFile(dir, i%cfg.Files))
+			return 0, err
+		}},
+		{"ReadDir", func(i int) (int64, error) {
+			_, err := os.ReadDir(filepath.Join(dir, "small"))
+			return 0, err
+		}},
+		{"OpenClose", func(i int) (int64, error) {
+			f, err := os.Open(smallFile(dir, i%cfg.Files))
+			if err != nil {
+				return 0, err
+			}
+
+			return 0, f.Close()
+		}},
+		{"ReadSmall", func(i int) (int64, error) {
+			data, err := os.ReadFile(smallFile(dir, i%cfg.Files))
+			return int64(len(data)), err
+		}},
+		{"SeqRead", func(i int) (int64, error) {
+			off := int64(i) * seqReadSize % (fi.Size() - seqReadSize + 1)
+			n, err := large.ReadAt(buf, off)
+			return int64(n), err
+		}},
+		{"RandRead", func(i int) (int64, error) {
+			off := rng.Int63n(fi.Size() - randReadSize + 1)
+			n, err := large.ReadAt(buf[:randReadSize], off)
+			return int64(n), err
+		}},
+	}
+
+	r := &Report{
+		Label: label,
+		Time:  time.Now(),
+	}
+
+	for _, w := range workloads {
+		result, err := measure(w, cfg.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", w.name, err)
+		}
+
+		r.Results = append(r.Results, result)
+	}
+
+	return r, nil
+}
+
+// Run a workload for the supplied duration.
+func measure(w workload, d time.Duration) (Result, error) {
+	r := Result{Workload: w.name}
+	var latencies []time.Duration
+
+	start := time.Now()
+	for time.Since(start) < d {
+		opStart := time.Now()
+		n, err := w.op(r.Ops)
+		if err != nil {
+			return r, err
+		}
+
+		latencies = append(latencies, time.Since(opStart))
+		r.Ops++
+		r.Bytes += n
+	}
+
+	r.Elapsed = time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	r.P50 = latencies[len(latencies)/2]
+	r.P99 = latencies[len(latencies)*99/100]
+
+	return r, nil
+}
+
+// The results of a workload in two reports.
+type Comparison struct {
+	Workload string
+	Base     Result
+	Other    Result
+
+	// The other report's throughput as a fraction of the base's, e.g. 0.9 if
+	// it is 10% slower.
+	Ratio float64
+}
+
+// Compare the results of the workloads found in both reports, in the base's
+// order.
+func Compare(base *Report, other *Report) []Comparison {
+	byName := make(map[string]Result)
+	for _, r := range other.Results {
+		byName[r.Workload] = r
+	}
+
+	var cs []Comparison
+	for _, b := range base.Results {
+		o, ok := byName[b.Workload]
+		if !ok {
+			continue
+		}
+
+		c := Comparison{Workload: b.Workload, Base: b, Other: o}
+		if b.OpsPerSecond() != 0 {
+			c.Ratio = o.OpsPerSecond() / b.OpsPerSecond()
+		}
+
+		cs = append(cs, c)
+	}
+
+	return cs
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusebench_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fusebench"
+)
+
+func TestRunAndCompare(t *testing.T) {
+	dir := t.TempDir()
+	cfg := fusebench.Config{
+		Files:         3,
+		LargeFileSize: 1 << 20,
+		Duration:      10 * time.Millisecond,
+	}
+
+	if err := fusebench.Populate(dir, cfg); err != nil {
+		t.Fatalf("Populate: %v", err)
+	}
+
+	r, err := fusebench.Run(dir, "plain", cfg)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	for _, res := range r.Results {
+		if res.Ops == 0 || res.P50 > res.P99 {
+			t.Errorf("Result: %+v", res)
+		}
+	}
+
+	// A report twice as fast, missing a workload.
+	faster := &fusebench.Report{Label: "faster"}
+	for _, res := range r.Results[1:] {
+		res.Ops *= 2
+		faster.Results = append(faster.Results, res)
+	}
+
+	cs := fusebench.Compare(r, faster)
+	if len(cs) != len(r.Results)-1 {
+		t.Fatalf("Compared %d workloads, want %d", len(cs), len(r.Results)-1)
+	}
+
+	for _, c := range cs {
+		if c.Workload == r.Results[0].Workload || c.Ratio < 1.99 || c.Ratio > 2.01 {
+			t.Errorf("Comparison: %+v", c)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusedebug
+
+import (
+	"sync"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// The use a caller made of a file system.
+type Usage struct {
+	Ops          uint64
+	Errors       uint64
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+func (u *Usage) add(other Usage) {
+	u.Ops += other.Ops
+	u.Errors += other.Errors
+	u.BytesRead += other.BytesRead
+	u.BytesWritten += other.BytesWritten
+}
+
+// A client's request for the usage recorded by a Server's Accountant, sent in
+// place of a Filter.
+type UsageQuery struct {
+	// Only windows ending after this time are summed. The zero value selects
+	// all of those kept.
+	Since time.Time
+}
+
+// The answer to a UsageQuery.
+type UsageReport struct {
+	ByUID map[uint32]Usage
+	ByPID map[uint32]Usage
+}
+
+// Configuration for NewAccountant.
+type AccountingConfig struct {
+	// The granularity of the accounting. Defaults to one minute.
+	Window time.Duration
+
+	// The number of windows kept, the older ones being discarded. Defaults to
+	// 60.
+	Windows int
+
+	// Defaults to timeutil.RealClock().
+	Clock timeutil.Clock
+}
+
+// An Accountant aggregates the ops served by a file system and the bytes they
+// read and wrote, per caller UID and PID and per time window, for chargeback
+// and abuse detection on shared mounts.
+//
+// Note that the kernel sends some ops on its own behalf rather than on behalf
+// of a process, notably page cache writeback when writeback caching is
+// enabled; these are accounted to PID 0 and UID 0.
+type Accountant struct {
+	cfg AccountingConfig
+
+	mu sync.Mutex
+
+	// Oldest first.
+	//
+	// GUARDED_BY(mu)
+	windows []*usageWindow
+}
+
+type usageWindow struct {
+	start time.Time
+	byUID map[uint32]*Usage
+	byPID map[uint32]*Usage
+}
+
+// NewAccountant creates an accountant that has seen no ops.
+func NewAccountant(cfg AccountingConfig) *Accountant {
+	if cfg.Window <= 0 {
+		cfg.Window = time.Minute
+	}
+
+	if cfg.Windows <= 0 {
+		cfg.Windows = 60
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = timeutil.RealClock()
+	}
+
+	return &Accountant{cfg: cfg}
+}
+
+// Observe accounts for an op. It has the signature of
+// fuse.MountConfig.OpObserver.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *Accountant) Observe(op interface{}, start time.Time, err error) {
+	u := Usage{Ops: 1}
+	if err != nil {
+		u.Errors = 1
+	}
+
+	u.BytesRead, u.BytesWritten = opBytes(op, err)
+
+	e := NewEvent(op, start, err)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	w := a.currentWindow()
+	for _, k := range []struct {
+		m  map[uint32]*Usage
+		id uint32
+	}{{w.byUID, e.UID}, {w.byPID, e.PID}} {
+		total := k.m[k.id]
+		if total == nil {
+			total = &Usage{}
+			k.m[k.id] = total
+		}
+
+		total.add(u)
+	}
+}
+
+// Return the number of bytes of file contents that an op read and wrote.
+func opBytes(op interface{}, err error) (read, written uint64) {
+	switch typed := op.(type) {
+	case *fuseops.ReadFileOp:
+		read = uint64(typed.BytesRead)
+	case *fuseops.WriteFileOp:
+		if err == nil {
+			written = uint64(typed.Written())
+		}
+	}
+
+	return
+}
+
+// LOCKS_REQUIRED(a.mu)
+func (a *Accountant) currentWindow() *usageWindow {
+	start := a.cfg.Clock.Now().Truncate(a.cfg.Window)
+	if n := len(a.windows); n != 0 && !a.windows[n-1].start.Before(start) {
+		return a.windows[n-1]
+	}
+
+	w := &usageWindow{
+		start: start,
+		byUID: make(map[uint32]*Usage),
+		byPID: make(map[uint32]*Usage),
+	}
+
+	a.windows = append(a.windows, w)
+	if len(a.windows) > a.cfg.Windows {
+		a.windows = a.windows[len(a.windows)-a.cfg.Windows:]
+	}
+
+	return w
+}
+
+// ByUID returns the usage of each UID over the windows ending after since.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *Accountant) ByUID(since time.Time) map[uint32]Usage {
+	return a.sum(since, func(w *usageWindow) map[uint32]*Usage { return w.byUID })
+}
+
+// ByPID returns the usage of each PID over the windows ending after since.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *Accountant) ByPID(since time.Time) map[uint32]Usage {
+	return a.sum(since, func(w *usageWindow) map[uint32]*Usage { return w.byPID })
+}
+
+// LOCKS_EXCLUDED(a.mu)
+func (a *Accountant) sum(
+	since time.Time,
+	m func(*usageWindow) map[uint32]*Usage) map[uint32]Usage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	totals := make(map[uint32]Usage)
+	for _, w := range a.windows {
+		if !w.start.Add(a.cfg.Window).After(since) {
+			continue
+		}
+
+		for id, u := range m(w) {
+			total := totals[id]
+			total.add(*u)
+			totals[id] = total
+		}
+	}
+
+	return totals
+}
@@ -0,0 +1,220 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A tool that tails the ops served by a file system daemon publishing them
+// with package fusedebug, e.g.:
+//
+//	fusedebug --socket /run/myfs.debug --op ReadFile,WriteFile --pid 1234
+//
+// or that prints the usage recorded by its accountant, e.g. over the last
+// hour:
+//
+//	fusedebug --socket /run/myfs.debug --usage 1h
+//
+// or that prints the last ops kept by its recorder, e.g. those that failed:
+//
+//	fusedebug --socket /run/myfs.debug --recent --errors
+//
+// or that prints the locks held and waited for on each inode:
+//
+//	fusedebug --socket /run/myfs.debug --locks
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fusedebug"
+)
+
+var fSocket = flag.String("socket", "", "Path to the daemon's debug socket.")
+var fNetwork = flag.String("network", "unix", "Network of the debug socket, e.g. tcp.")
+var fOps = flag.String("op", "", "Comma-separated op names to show, e.g. ReadFile,WriteFile.")
+var fInode = flag.Uint64("inode", 0, "Only show ops about this inode.")
+var fPID = flag.Uint("pid", 0, "Only show ops caused by this process.")
+var fErrors = flag.Bool("errors", false, "Only show ops that failed.")
+var fDetails = flag.Bool("details", false, "Show the fields of each op.")
+var fJSON = flag.Bool("json", false, "Print events as JSON, one per line.")
+var fUsage = flag.Duration("usage", 0, "Instead of tailing ops, print the usage by UID and PID over this long.")
+var fRecent = flag.Bool("recent", false, "Instead of tailing ops, print the last ones kept by the daemon.")
+var fLocks = flag.Bool("locks", false, "Instead of tailing ops, print the locks held and waited for.")
+
+func main() {
+	flag.Parse()
+
+	if *fSocket == "" {
+		log.Fatalf("You must set --socket.")
+	}
+
+	if *fUsage != 0 {
+		printUsage(time.Now().Add(-*fUsage))
+		return
+	}
+
+	if *fLocks {
+		printLocks()
+		return
+	}
+
+	filter := fusedebug.Filter{
+		Inode: *fInode,
+		PID:   uint32(*fPID),
+	}
+
+	if *fOps != "" {
+		filter.Ops = strings.Split(*fOps, ",")
+	}
+
+	if *fRecent {
+		events, err := fusedebug.QueryRecent(*fNetwork, *fSocket, filter)
+		if err != nil {
+			log.Fatalf("fusedebug: %v", err)
+		}
+
+		for _, e := range events {
+			if !printEvent(e) {
+				break
+			}
+		}
+
+		return
+	}
+
+	err := fusedebug.Dial(*fNetwork, *fSocket, filter, printEvent)
+	if err != nil {
+		log.Fatalf("fusedebug: %v", err)
+	}
+}
+
+var enc = json.NewEncoder(os.Stdout)
+
+// Print an event selected by the flags, returning false if stdout is gone.
+func printEvent(e *fusedebug.Event) bool {
+	if *fErrors && e.Error == "" {
+		return true
+	}
+
+	if e.Dropped != 0 {
+		fmt.Fprintf(os.Stderr, "(%d events dropped)\n", e.Dropped)
+	}
+
+	if *fJSON {
+		return enc.Encode(e) == nil
+	}
+
+	result := "OK"
+	if e.Error != "" {
+		result = e.Error
+	}
+
+	line := fmt.Sprintf(
+		"%s pid %d uid %d %s inode %d %v -> %s",
+		e.Time.Format("15:04:05.000000"),
+		e.PID,
+		e.UID,
+		e.Op,
+		e.Inode,
+		e.Duration,
+		result)
+
+	if *fDetails {
+		line += " " + string(e.Details)
+	}
+
+	_, err := fmt.Println(line)
+	return err == nil
+}
+
+func printUsage(since time.Time) {
+	report, err := fusedebug.QueryUsage(*fNetwork, *fSocket, since)
+	if err != nil {
+		log.Fatalf("fusedebug: %v", err)
+	}
+
+	if *fJSON {
+		json.NewEncoder(os.Stdout).Encode(report)
+		return
+	}
+
+	for _, by := range []struct {
+		name  string
+		usage map[uint32]fusedebug.Usage
+	}{{"uid", report.ByUID}, {"pid", report.ByPID}} {
+		var ids []uint32
+		for id := range by.usage {
+			ids = append(ids, id)
+		}
+
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			u := by.usage[id]
+			fmt.Printf(
+				"%s %d: %d ops, %d errors, %d bytes read, %d bytes written\n",
+				by.name,
+				id,
+				u.Ops,
+				u.Errors,
+				u.BytesRead,
+				u.BytesWritten)
+		}
+	}
+}
+
+func printLocks() {
+	locks, err := fusedebug.QueryLocks(*fNetwork, *fSocket)
+	if err != nil {
+		log.Fatalf("fusedebug: %v", err)
+	}
+
+	for _, il := range locks {
+		if *fJSON {
+			enc.Encode(&il)
+			continue
+		}
+
+		for _, l := range il.Held {
+			fmt.Printf("inode %d: %s held by owner %#x pid %d\n", il.Inode, describeLock(&l), l.Owner, l.PID)
+		}
+
+		for _, w := range il.Waiters {
+			fmt.Printf(
+				"inode %d: %s wanted by owner %#x pid %d for %v\n",
+				il.Inode,
+				describeLock(&w.Lock),
+				w.Owner,
+				w.PID,
+				time.Since(w.Since).Round(time.Millisecond))
+		}
+	}
+}
+
+func describeLock(l *fusedebug.Lock) string {
+	if l.Flock {
+		return l.Type + " flock"
+	}
+
+	end := fmt.Sprint(l.End)
+	if l.End == math.MaxInt64 {
+		end = "EOF"
+	}
+
+	return fmt.Sprintf("%s lock on %d-%s", l.Type, l.Start, end)
+}
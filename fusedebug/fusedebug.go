@@ -0,0 +1,541 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fusedebug lets a file system daemon publish the ops it serves on a
+// debug socket, so that they can be tailed live, tcpdump-style, by the
+// fusedebug tool (see the cmd/fusedebug directory) or anything else speaking
+// the protocol.
+//
+// To enable it, create a Server, install its Observe method as
+// fuse.MountConfig.OpObserver, and serve it on a listener:
+//
+//	debug := fusedebug.NewServer(fusedebug.Config{})
+//	cfg.OpObserver = debug.Observe
+//	l, err := net.Listen("unix", "/run/myfs.debug")
+//	...
+//	go debug.Serve(l)
+//
+// The protocol is line-based JSON: a client sends a Filter, then receives an
+// Event for each matching op until it hangs up. Events that can't be sent
+// quickly enough are dropped rather than slowing down the file system, and
+// counted in the Dropped field of the next event sent. To keep the debug
+// socket enabled on a busy production mount, publish a sample of the ops:
+//
+//	sampler := fuse.NewOpSampler(fuse.SamplingConfig{OneIn: 100, Errors: true})
+//	cfg.OpObserver = sampler.Observer(debug.Observe)
+//
+// A client may instead send a UsageQuery, answered with a single UsageReport
+// from the Accountant set in Config. The accountant must see every op, so it
+// is installed alongside the server rather than behind the sampler:
+//
+//	accountant := fusedebug.NewAccountant(fusedebug.AccountingConfig{})
+//	debug := fusedebug.NewServer(fusedebug.Config{Accountant: accountant})
+//	cfg.OpObserver = fuse.MultiOpObserver(
+//		accountant.Observe,
+//		sampler.Observer(debug.Observe))
+//
+// Similarly, a Recorder keeps the last ops served whatever the sampling, so
+// that those leading up to a failure can be looked at after the fact, through
+// QueryRecent or by dumping them when something goes wrong:
+//
+//	recorder := fusedebug.NewRecorder(fusedebug.RecorderConfig{Size: 10000})
+//	cfg.OnConnectionLost = func(err *fuse.ConnectionLostError) {
+//		recorder.Dump(os.Stderr)
+//	}
+//
+// A LockTracker, set in Config, answers QueryLocks with the byte-range and
+// flock(2) locks held and waited for on each inode, which shows what a
+// process stuck in fcntl(2) is waiting on. It must see every SetLkOp, from
+// when it is read:
+//
+//	locks := fusedebug.NewLockTracker()
+//	cfg.OpStartObserver = locks.Start
+//	cfg.OpObserver = fuse.MultiOpObserver(locks.Observe, debug.Observe)
+//
+// For monitoring rather than debugging, Metrics aggregates counters and
+// latency histograms per op type, and serves them to Prometheus.
+package fusedebug
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// An op served by the file system.
+type Event struct {
+	// When the op was read from the kernel, and how long it took to respond.
+	Time     time.Time
+	Duration time.Duration
+
+	// The name of the op, e.g. "LookUpInode".
+	Op string
+
+	// The inode the op is about, or the parent directory for ops about a name
+	// within one. Zero if neither applies.
+	Inode uint64
+
+	// The process that caused the op, and its user, when known.
+	PID uint32
+	UID uint32
+
+	// The error the op was responded to with, or empty on success.
+	Error string `json:",omitempty"`
+
+	// The op's fields, rendered by fuseops.MarshalJSON.
+	Details json.RawMessage `json:",omitempty"`
+
+	// The number of events that matched the filter but were dropped since the
+	// previous one sent, because the client didn't keep up.
+	Dropped uint64 `json:",omitempty"`
+}
+
+// A client's selection of events. Zero-valued fields select everything.
+type Filter struct {
+	// Op names, e.g. "ReadFile".
+	Ops []string
+
+	Inode uint64
+	PID   uint32
+}
+
+// Match reports whether the event is selected by the filter.
+func (f *Filter) Match(e *Event) bool {
+	if len(f.Ops) != 0 {
+		found := false
+		for _, op := range f.Ops {
+			if strings.EqualFold(op, e.Op) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if f.Inode != 0 && f.Inode != e.Inode {
+		return false
+	}
+
+	if f.PID != 0 && f.PID != e.PID {
+		return false
+	}
+
+	return true
+}
+
+// Configuration for NewServer.
+type Config struct {
+	// Options for rendering ops in Event.Details. By default data payloads are
+	// reduced to their length.
+	JSON fuseops.JSONOptions
+
+	// The number of events buffered for each client. Defaults to 1024.
+	Buffer int
+
+	// If set, the accountant that UsageQueries are answered from. The server
+	// doesn't feed it ops; install its Observe method as well.
+	Accountant *Accountant
+
+	// If set, the recorder whose events QueryRecent is answered from. As for
+	// the accountant, install its Observe method as well.
+	Recorder *Recorder
+
+	// If set, the tracker QueryLocks is answered from. Install its Start and
+	// Observe methods as well.
+	Locks *LockTracker
+}
+
+// A Server publishes ops to the clients connected to it.
+type Server struct {
+	cfg Config
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	clients map[*client]struct{}
+}
+
+type client struct {
+	filter Filter
+	events chan *Event
+
+	// GUARDED_BY(Server.mu)
+	dropped uint64
+}
+
+// NewServer creates a server with no clients.
+func NewServer(cfg Config) *Server {
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = 1024
+	}
+
+	return &Server{
+		cfg:     cfg,
+		clients: make(map[*client]struct{}),
+	}
+}
+
+// Observe publishes an op to interested clients. It has the signature of
+// fuse.MountConfig.OpObserver, and does little work when nobody is listening.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *Server) Observe(op interface{}, start time.Time, err error) {
+	s.mu.Lock()
+	idle := len(s.clients) == 0
+	s.mu.Unlock()
+
+	if idle {
+		return
+	}
+
+	// Describe the op without holding the lock, so that ops completing
+	// concurrently aren't serialized behind the reflection.
+	e := NewEvent(op, start, err)
+
+	s.mu.Lock()
+	var matched []*client
+	for c := range s.clients {
+		if c.filter.Match(e) {
+			matched = append(matched, c)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(matched) == 0 {
+		return
+	}
+
+	// Render the op once, and only if someone wants it.
+	e.Details, _ = fuseops.MarshalJSON(op, s.cfg.JSON)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Clients that hung up in the meantime are sent to harmlessly, since
+	// nobody reads their buffered channel any more.
+	for _, c := range matched {
+		sent := *e
+		sent.Dropped = c.dropped
+		select {
+		case c.events <- &sent:
+			c.dropped = 0
+		default:
+			c.dropped++
+		}
+	}
+}
+
+// NewEvent describes an op, without rendering its details.
+func NewEvent(op interface{}, start time.Time, err error) *Event {
+	e := new(Event)
+	describe(e, op, start, err)
+	return e
+}
+
+// Return the name of an op, e.g. "LookUpInode" for *fuseops.LookUpInodeOp.
+func opName(op interface{}) string {
+	t := reflect.TypeOf(op)
+	if t == nil || t.Kind() != reflect.Ptr {
+		return ""
+	}
+
+	return strings.TrimSuffix(t.Elem().Name(), "Op")
+}
+
+// Fill in e to describe an op, without rendering its details.
+func describe(e *Event, op interface{}, start time.Time, err error) {
+	*e = Event{
+		Time:     start,
+		Duration: time.Since(start),
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	v := reflect.ValueOf(op)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+
+	v = v.Elem()
+	e.Op = opName(op)
+
+	for _, name := range []string{"Inode", "Parent", "OldParent"} {
+		if f := v.FieldByName(name); f.IsValid() && f.Kind() == reflect.Uint64 {
+			e.Inode = f.Uint()
+			break
+		}
+	}
+
+	if f := v.FieldByName("OpContext"); f.IsValid() {
+		if opCtx, ok := f.Interface().(fuseops.OpContext); ok {
+			e.PID = opCtx.Pid
+			e.UID = opCtx.Uid
+		}
+	}
+}
+
+// Serve accepts clients from l until Accept fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return
+	}
+
+	var req request
+	if err := json.Unmarshal(line, &req); err != nil {
+		return
+	}
+
+	if req.Usage != nil {
+		s.serveUsage(conn, req.Usage)
+		return
+	}
+
+	if req.Recent {
+		s.serveRecent(conn, &req.Filter)
+		return
+	}
+
+	if req.Locks {
+		s.serveLocks(conn)
+		return
+	}
+
+	c := &client{
+		filter: req.Filter,
+		events: make(chan *Event, s.cfg.Buffer),
+	}
+
+	s.mu.Lock()
+	s.clients[c] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+	}()
+
+	// Notice the client hanging up, which it signals by closing its end.
+	hungUp := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, r)
+		close(hungUp)
+	}()
+
+	enc := json.NewEncoder(conn)
+	for {
+		select {
+		case e := <-c.events:
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+
+		case <-hungUp:
+			return
+		}
+	}
+}
+
+// The first line sent by a client: either a Filter, a UsageQuery, a Filter
+// for the events kept by the Recorder, or a query for the locks.
+type request struct {
+	Filter
+	Usage  *UsageQuery `json:",omitempty"`
+	Recent bool        `json:",omitempty"`
+	Locks  bool        `json:",omitempty"`
+}
+
+func (s *Server) serveUsage(conn net.Conn, q *UsageQuery) {
+	// Hang up without an answer if there is nothing to answer from.
+	if s.cfg.Accountant == nil {
+		return
+	}
+
+	report := &UsageReport{
+		ByUID: s.cfg.Accountant.ByUID(q.Since),
+		ByPID: s.cfg.Accountant.ByPID(q.Since),
+	}
+
+	json.NewEncoder(conn).Encode(report)
+}
+
+func (s *Server) serveRecent(conn net.Conn, filter *Filter) {
+	if s.cfg.Recorder == nil {
+		return
+	}
+
+	enc := json.NewEncoder(conn)
+	for _, e := range s.cfg.Recorder.Events() {
+		if !filter.Match(e) {
+			continue
+		}
+
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) serveLocks(conn net.Conn) {
+	if s.cfg.Locks == nil {
+		return
+	}
+
+	enc := json.NewEncoder(conn)
+	for _, il := range s.cfg.Locks.Locks() {
+		if err := enc.Encode(&il); err != nil {
+			return
+		}
+	}
+}
+
+// Dial connects to a server, subscribing to the events selected by the
+// filter, and calls f with each of them until f returns false or the
+// connection fails.
+func Dial(network, address string, filter Filter, f func(*Event) bool) error {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(&filter); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			return err
+		}
+
+		if !f(&e) {
+			return nil
+		}
+	}
+}
+
+// QueryUsage asks a server for the usage its Accountant recorded over the
+// windows ending after since.
+func QueryUsage(network, address string, since time.Time) (*UsageReport, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := request{Usage: &UsageQuery{Since: since}}
+	if err := json.NewEncoder(conn).Encode(&req); err != nil {
+		return nil, err
+	}
+
+	report := new(UsageReport)
+	err = json.NewDecoder(bufio.NewReader(conn)).Decode(report)
+	if err == io.EOF {
+		err = errors.New("the server doesn't account for usage")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// QueryRecent asks a server for the events kept by its Recorder that are
+// selected by the filter, oldest first. A server without a recorder answers
+// with none.
+func QueryRecent(network, address string, filter Filter) ([]*Event, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := request{Filter: filter, Recent: true}
+	if err := json.NewEncoder(conn).Encode(&req); err != nil {
+		return nil, err
+	}
+
+	var events []*Event
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		e := new(Event)
+		if err := dec.Decode(e); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+}
+
+// QueryLocks asks a server for the locks held and waited for, as seen by its
+// LockTracker, by inode in increasing order. A server without a tracker
+// answers with none.
+func QueryLocks(network, address string) ([]InodeLocks, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := request{Locks: true}
+	if err := json.NewEncoder(conn).Encode(&req); err != nil {
+		return nil, err
+	}
+
+	var locks []InodeLocks
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var il InodeLocks
+		if err := dec.Decode(&il); err == io.EOF {
+			return locks, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		locks = append(locks, il)
+	}
+}
@@ -0,0 +1,418 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusedebug
+
+import (
+	"math"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+func (s *Server) numClients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.clients)
+}
+
+func TestTail(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	s := NewServer(Config{})
+	go s.Serve(l)
+
+	events := make(chan *Event)
+	go Dial("tcp", l.Addr().String(), Filter{Ops: []string{"lookupinode"}, PID: 7}, func(e *Event) bool {
+		events <- e
+		return false
+	})
+
+	for s.numClients() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	ctx := fuseops.OpContext{Pid: 7, Uid: 1000}
+
+	// Neither of these match the filter.
+	s.Observe(&fuseops.GetInodeAttributesOp{Inode: 1, OpContext: ctx}, start, nil)
+	s.Observe(&fuseops.LookUpInodeOp{Parent: 1, Name: "a"}, start, nil)
+
+	s.Observe(&fuseops.LookUpInodeOp{Parent: 3, Name: "taco", OpContext: ctx}, start, syscall.ENOENT)
+
+	e := <-events
+	if e.Op != "LookUpInode" || e.Inode != 3 || e.PID != 7 || e.UID != 1000 {
+		t.Errorf("Unexpected event: %+v", e)
+	}
+
+	if e.Error != syscall.ENOENT.Error() || len(e.Details) == 0 {
+		t.Errorf("Unexpected event: %+v", e)
+	}
+
+	// Once the client has hung up, it is unregistered.
+	for s.numClients() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSessionTracker(t *testing.T) {
+	var ended []*Session
+	tracker := NewSessionTracker(SessionConfig{
+		OnSessionEnd: func(s *Session) { ended = append(ended, s) },
+		MaxSpans:     3,
+	})
+
+	start := time.Now()
+	ctx := fuseops.OpContext{Pid: 7}
+	observe := func(op interface{}, err error) { tracker.Observe(op, start, err) }
+
+	observe(&fuseops.OpenFileOp{Inode: 2, Handle: 5, OpContext: ctx}, nil)
+	observe(&fuseops.OpenDirOp{Inode: 1, Handle: 5}, nil)
+	observe(&fuseops.ReadFileOp{Inode: 2, Handle: 5, BytesRead: 100}, nil)
+	observe(&fuseops.ReadFileOp{Inode: 2, Handle: 5, BytesRead: 20}, nil)
+	observe(&fuseops.WriteFileOp{Inode: 2, Handle: 5, Data: []byte("x")}, syscall.ENOSPC)
+	observe(&fuseops.FlushFileOp{Inode: 2, Handle: 5}, nil)
+
+	if open := tracker.Open(); len(open) != 2 {
+		t.Errorf("%d open sessions, want 2", len(open))
+	}
+
+	observe(&fuseops.ReleaseFileHandleOp{Handle: 5}, nil)
+
+	if len(ended) != 1 {
+		t.Fatalf("%d sessions ended, want 1", len(ended))
+	}
+
+	s := ended[0]
+	if s.Inode != 2 || s.Dir || s.PID != 7 || s.Ops != 6 || s.Errors != 1 {
+		t.Errorf("Unexpected session: %+v", s)
+	}
+
+	if s.Reads != 2 || s.BytesRead != 120 || s.Writes != 1 || s.BytesWritten != 0 || s.Flushes != 1 {
+		t.Errorf("Unexpected session: %+v", s)
+	}
+
+	if len(s.Spans) != 3 || s.Spans[0].Op != "OpenFile" || s.Spans[2].Bytes != 20 {
+		t.Errorf("Unexpected spans: %+v", s.Spans)
+	}
+
+	// The directory session is still open.
+	if open := tracker.Open(); len(open) != 1 || !open[0].Dir {
+		t.Errorf("Unexpected open sessions: %+v", open)
+	}
+}
+
+func TestSessionTrackerSharedHandle(t *testing.T) {
+	var ended []*Session
+	tracker := NewSessionTracker(SessionConfig{
+		OnSessionEnd: func(s *Session) { ended = append(ended, s) },
+	})
+
+	start := time.Now()
+	observe := func(op interface{}) { tracker.Observe(op, start, nil) }
+
+	// A file system answering every open with handle zero.
+	observe(&fuseops.OpenFileOp{Inode: 2})
+	observe(&fuseops.OpenFileOp{Inode: 2})
+	observe(&fuseops.ReleaseFileHandleOp{})
+	observe(&fuseops.ReadFileOp{Inode: 2, BytesRead: 10})
+
+	if len(ended) != 0 {
+		t.Fatalf("Session ended with an open outstanding: %+v", ended[0])
+	}
+
+	observe(&fuseops.ReleaseFileHandleOp{})
+
+	if len(ended) != 1 || ended[0].Ops != 5 || ended[0].BytesRead != 10 {
+		t.Errorf("Unexpected sessions: %+v", ended)
+	}
+}
+
+func TestAccountant(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC))
+
+	a := NewAccountant(AccountingConfig{
+		Window:  time.Minute,
+		Windows: 2,
+		Clock:   &clock,
+	})
+
+	alice := fuseops.OpContext{Uid: 1000, Pid: 10}
+	bob := fuseops.OpContext{Uid: 1001, Pid: 11}
+	start := clock.Now()
+
+	a.Observe(&fuseops.ReadFileOp{BytesRead: 100, OpContext: alice}, start, nil)
+	a.Observe(&fuseops.WriteFileOp{Data: []byte("taco"), OpContext: bob}, start, nil)
+	a.Observe(&fuseops.WriteFileOp{Data: []byte("taco"), BytesWritten: 1, OpContext: bob}, start, nil)
+
+	clock.AdvanceTime(time.Minute)
+	a.Observe(&fuseops.ReadFileOp{BytesRead: 10, OpContext: alice}, start, syscall.EIO)
+
+	byUID := a.ByUID(time.Time{})
+	if u := byUID[1000]; u != (Usage{Ops: 2, Errors: 1, BytesRead: 110}) {
+		t.Errorf("alice: %+v", u)
+	}
+
+	if u := a.ByPID(time.Time{})[11]; u != (Usage{Ops: 2, BytesWritten: 5}) {
+		t.Errorf("bob: %+v", u)
+	}
+
+	// Only the last window ends after the current minute started.
+	if u := a.ByUID(clock.Now())[1000]; u.Ops != 1 {
+		t.Errorf("alice this minute: %+v", u)
+	}
+
+	// Older windows are discarded.
+	clock.AdvanceTime(time.Minute)
+	a.Observe(&fuseops.StatFSOp{}, start, nil)
+	if u, ok := a.ByUID(time.Time{})[1001]; ok {
+		t.Errorf("bob after two minutes: %+v", u)
+	}
+}
+
+func TestQueryUsage(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	a := NewAccountant(AccountingConfig{})
+	s := NewServer(Config{Accountant: a})
+	go s.Serve(l)
+
+	alice := fuseops.OpContext{Uid: 1000, Pid: 10}
+	a.Observe(&fuseops.ReadFileOp{BytesRead: 100, OpContext: alice}, time.Now(), nil)
+
+	report, err := QueryUsage("tcp", l.Addr().String(), time.Time{})
+	if err != nil {
+		t.Fatalf("QueryUsage: %v", err)
+	}
+
+	if u := report.ByUID[1000]; u != (Usage{Ops: 1, BytesRead: 100}) {
+		t.Errorf("alice by UID: %+v", u)
+	}
+
+	if u := report.ByPID[10]; u != (Usage{Ops: 1, BytesRead: 100}) {
+		t.Errorf("alice by PID: %+v", u)
+	}
+
+	// A server without an accountant can't answer.
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l2.Close()
+
+	go NewServer(Config{}).Serve(l2)
+	if _, err := QueryUsage("tcp", l2.Addr().String(), time.Time{}); err == nil {
+		t.Errorf("QueryUsage succeeded without an accountant")
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder(RecorderConfig{Size: 3})
+	start := time.Now()
+	for i := 1; i <= 5; i++ {
+		r.Observe(&fuseops.GetInodeAttributesOp{Inode: fuseops.InodeID(i)}, start, nil)
+	}
+
+	// Only the last ops are kept, oldest first.
+	var inodes []uint64
+	for _, e := range r.Events() {
+		inodes = append(inodes, e.Inode)
+	}
+
+	if len(inodes) != 3 || inodes[0] != 3 || inodes[2] != 5 {
+		t.Errorf("Inodes recorded: %v", inodes)
+	}
+
+	var buf strings.Builder
+	if err := r.Dump(&buf); err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+
+	if n := strings.Count(buf.String(), "\n"); n != 3 {
+		t.Errorf("Dumped %d lines: %q", n, buf.String())
+	}
+}
+
+func TestQueryRecent(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	r := NewRecorder(RecorderConfig{})
+	s := NewServer(Config{Recorder: r})
+	go s.Serve(l)
+
+	start := time.Now()
+	r.Observe(&fuseops.LookUpInodeOp{Parent: 1, Name: "a"}, start, nil)
+	r.Observe(&fuseops.LookUpInodeOp{Parent: 1, Name: "b"}, start, syscall.ENOENT)
+	r.Observe(&fuseops.ReadFileOp{Inode: 2}, start, nil)
+
+	events, err := QueryRecent("tcp", l.Addr().String(), Filter{Ops: []string{"LookUpInode"}})
+	if err != nil {
+		t.Fatalf("QueryRecent: %v", err)
+	}
+
+	if len(events) != 2 || events[1].Error != syscall.ENOENT.Error() {
+		t.Errorf("Events: %+v", events)
+	}
+}
+
+func TestLockTracker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	locks := NewLockTracker()
+	s := NewServer(Config{Locks: locks})
+	go s.Serve(l)
+
+	setLk := func(owner uint64, start, end uint64, typ fuseops.LockType, wait bool) *fuseops.SetLkOp {
+		return &fuseops.SetLkOp{
+			Inode: 2,
+			Owner: owner,
+			Lock:  fuseops.FileLock{Start: start, End: end, Type: typ, PID: uint32(owner)},
+			Wait:  wait,
+		}
+	}
+
+	// Owner 1 locks bytes 0-99, then unlocks the middle of the range.
+	now := time.Now()
+	for _, op := range []*fuseops.SetLkOp{
+		setLk(1, 0, 99, fuseops.LockWrite, false),
+		setLk(1, 40, 59, fuseops.LockUnlock, false),
+	} {
+		locks.Start(op)
+		locks.Observe(op, now, nil)
+	}
+
+	// Owner 2 fails to take a lock, and waits for another.
+	failed := setLk(2, 0, 9, fuseops.LockRead, false)
+	locks.Start(failed)
+	locks.Observe(failed, now, syscall.EAGAIN)
+
+	waiting := setLk(2, 50, 69, fuseops.LockRead, true)
+	locks.Start(waiting)
+
+	got, err := QueryLocks("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("QueryLocks: %v", err)
+	}
+
+	if len(got) != 1 || got[0].Inode != 2 {
+		t.Fatalf("Locks: %+v", got)
+	}
+
+	held := got[0].Held
+	if len(held) != 2 ||
+		held[0].Start != 0 || held[0].End != 39 ||
+		held[1].Start != 60 || held[1].End != 99 ||
+		held[0].Owner != 1 || held[0].Type != "write" {
+		t.Errorf("Held: %+v", held)
+	}
+
+	if w := got[0].Waiters; len(w) != 1 || w[0].Owner != 2 || w[0].Start != 50 {
+		t.Errorf("Waiters: %+v", w)
+	}
+
+	// Once the wait is over and the locks released, nothing is left.
+	locks.Observe(waiting, now, syscall.EINTR)
+	unlock := setLk(1, 0, math.MaxInt64, fuseops.LockUnlock, false)
+	locks.Observe(unlock, now, nil)
+
+	if got := locks.Locks(); len(got) != 0 {
+		t.Errorf("Locks after unlocking: %+v", got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics(MetricsConfig{})
+
+	read := &fuseops.ReadFileOp{BytesRead: 100}
+	m.Start(read)
+	m.Start(&fuseops.ReadFileOp{})
+	m.Observe(read, time.Now().Add(-50*time.Millisecond), nil)
+	m.Observe(&fuseops.WriteFileOp{Data: []byte("taco")}, time.Now(), syscall.EIO)
+
+	om := m.Snapshot()["ReadFile"]
+	if om.InFlight != 1 || om.Ops != 1 || om.Errors != 0 || om.BytesRead != 100 {
+		t.Errorf("ReadFile: %+v", om)
+	}
+
+	// 50ms falls in the bucket of ops taking up to 100ms.
+	if om.Latencies[3] != 1 {
+		t.Errorf("ReadFile latencies: %v", om.Latencies)
+	}
+
+	if om := m.Snapshot()["WriteFile"]; om.Ops != 1 || om.Errors != 1 || om.BytesWritten != 0 {
+		t.Errorf("WriteFile: %+v", om)
+	}
+
+	// Failed writes don't count towards the sizes, nor the suggestion.
+	if w := m.SuggestMaxWrite(); w != 0 {
+		t.Errorf("SuggestMaxWrite with no writes: %d", w)
+	}
+
+	for i := 0; i < 99; i++ {
+		m.Observe(&fuseops.WriteFileOp{Data: make([]byte, 10000)}, time.Now(), nil)
+	}
+	m.Observe(&fuseops.WriteFileOp{Data: make([]byte, 100000)}, time.Now(), nil)
+
+	if om := m.Snapshot()["WriteFile"]; om.Sizes[1] != 99 || om.Sizes[3] != 1 {
+		t.Errorf("WriteFile sizes: %v", om.Sizes)
+	}
+
+	if w := m.SuggestMaxWrite(); w != 16<<10 {
+		t.Errorf("SuggestMaxWrite: %d", w)
+	}
+
+	var b strings.Builder
+	if err := m.WritePrometheus(&b); err != nil {
+		t.Fatalf("WritePrometheus: %v", err)
+	}
+
+	for _, want := range []string{
+		`fuse_ops_in_flight{op="ReadFile"} 1`,
+		`fuse_op_errors_total{op="WriteFile"} 1`,
+		`fuse_op_latency_seconds_bucket{op="ReadFile",le="0.01"} 0`,
+		`fuse_op_latency_seconds_bucket{op="ReadFile",le="0.1"} 1`,
+		`fuse_op_latency_seconds_count{op="WriteFile"} 101`,
+		`fuse_op_size_bytes_bucket{op="ReadFile",le="4096"} 1`,
+		`fuse_op_size_bytes_bucket{op="WriteFile",le="16384"} 99`,
+		`fuse_op_size_bytes_sum{op="WriteFile"} 1090000`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Missing %q in:\n%s", want, b.String())
+		}
+	}
+}
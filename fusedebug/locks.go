@@ -0,0 +1,233 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusedebug
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// A byte-range or flock(2) lock, as seen by a LockTracker.
+type Lock struct {
+	// The owner of the lock and the process that took it. See
+	// fuseops.SetLkOp.
+	Owner uint64
+	PID   uint32
+
+	// The first and last bytes of the range, inclusive.
+	Start uint64
+	End   uint64
+
+	// "read" or "write".
+	Type string
+
+	// Whether this is a flock(2) lock rather than a POSIX record lock.
+	Flock bool `json:",omitempty"`
+}
+
+// A request for a lock that is waiting for conflicting locks to be released.
+type LockWaiter struct {
+	Lock
+
+	// When the request was read from the kernel.
+	Since time.Time
+}
+
+// The locks on an inode, and the requests waiting for them.
+type InodeLocks struct {
+	Inode   fuseops.InodeID
+	Held    []Lock       `json:",omitempty"`
+	Waiters []LockWaiter `json:",omitempty"`
+}
+
+// A LockTracker follows the locks taken and released by the SetLkOps a file
+// system answers, so that waits stuck on a lock can be diagnosed: who holds
+// the lock, over which range, and who else is waiting. It doesn't know of
+// locks the file system took or dropped of its own accord, e.g. on behalf of
+// other clients of shared storage.
+//
+// Install its Start and Observe methods as fuse.MountConfig.OpStartObserver
+// and OpObserver, unsampled, and set it as Config.Locks to have the fusedebug
+// tool show its state.
+type LockTracker struct {
+	mu sync.Mutex
+
+	// The locks held, per inode, ordered by start.
+	//
+	// GUARDED_BY(mu)
+	held map[fuseops.InodeID][]Lock
+
+	// The requests waiting for a lock, by op. The ops are only used as keys,
+	// and are forgotten when Observe sees them again.
+	//
+	// GUARDED_BY(mu)
+	waiters map[*fuseops.SetLkOp]inodeWaiter
+}
+
+type inodeWaiter struct {
+	inode  fuseops.InodeID
+	waiter LockWaiter
+}
+
+// NewLockTracker creates a tracker that knows of no locks.
+func NewLockTracker() *LockTracker {
+	return &LockTracker{
+		held:    make(map[fuseops.InodeID][]Lock),
+		waiters: make(map[*fuseops.SetLkOp]inodeWaiter),
+	}
+}
+
+func lockTypeName(t fuseops.LockType) string {
+	if t == fuseops.LockRead {
+		return "read"
+	}
+
+	return "write"
+}
+
+func newLock(op *fuseops.SetLkOp) Lock {
+	return Lock{
+		Owner: op.Owner,
+		PID:   op.Lock.PID,
+		Start: op.Lock.Start,
+		End:   op.Lock.End,
+		Type:  lockTypeName(op.Lock.Type),
+		Flock: op.Flock,
+	}
+}
+
+// Start notes a request waiting for a lock. It has the signature of
+// fuse.MountConfig.OpStartObserver.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *LockTracker) Start(op interface{}) {
+	o, ok := op.(*fuseops.SetLkOp)
+	if !ok || !o.Wait || o.Lock.Type == fuseops.LockUnlock {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.waiters[o] = inodeWaiter{
+		inode: o.Inode,
+		waiter: LockWaiter{
+			Lock:  newLock(o),
+			Since: time.Now(),
+		},
+	}
+}
+
+// Observe applies the lock taken or released by a successful SetLkOp. It has
+// the signature of fuse.MountConfig.OpObserver.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *LockTracker) Observe(op interface{}, start time.Time, err error) {
+	o, ok := op.(*fuseops.SetLkOp)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.waiters, o)
+	if err != nil {
+		return
+	}
+
+	held := setLock(t.held[o.Inode], newLock(o), o.Lock.Type == fuseops.LockUnlock)
+	if len(held) == 0 {
+		delete(t.held, o.Inode)
+		return
+	}
+
+	t.held[o.Inode] = held
+}
+
+// Apply a lock taken or released to the locks held on an inode. The owner's
+// locks of the same kind over the range are replaced, being split where they
+// extend beyond it.
+func setLock(held []Lock, l Lock, unlock bool) []Lock {
+	var result []Lock
+	for _, h := range held {
+		if h.Owner != l.Owner || h.Flock != l.Flock || h.End < l.Start || h.Start > l.End {
+			result = append(result, h)
+			continue
+		}
+
+		if h.Start < l.Start {
+			before := h
+			before.End = l.Start - 1
+			result = append(result, before)
+		}
+
+		if h.End > l.End {
+			after := h
+			after.Start = l.End + 1
+			result = append(result, after)
+		}
+	}
+
+	if !unlock {
+		result = append(result, l)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Start < result[j].Start })
+	return result
+}
+
+// Locks returns the locks held and waited for, by inode in increasing order.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *LockTracker) Locks() []InodeLocks {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	byInode := make(map[fuseops.InodeID]*InodeLocks)
+	get := func(inode fuseops.InodeID) *InodeLocks {
+		il := byInode[inode]
+		if il == nil {
+			il = &InodeLocks{Inode: inode}
+			byInode[inode] = il
+		}
+
+		return il
+	}
+
+	for inode, held := range t.held {
+		get(inode).Held = append([]Lock(nil), held...)
+	}
+
+	for _, w := range t.waiters {
+		il := get(w.inode)
+		il.Waiters = append(il.Waiters, w.waiter)
+	}
+
+	var locks []InodeLocks
+	for _, il := range byInode {
+		sort.Slice(il.Waiters, func(i, j int) bool {
+			return il.Waiters[i].Since.Before(il.Waiters[j].Since)
+		})
+
+		locks = append(locks, *il)
+	}
+
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Inode < locks[j].Inode })
+	return locks
+}
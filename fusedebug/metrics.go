@@ -0,0 +1,335 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusedebug
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// The upper bounds of the latency buckets used by default by Metrics.
+var DefaultLatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// The upper bounds of the size buckets used by default by Metrics, in bytes.
+var DefaultSizeBuckets = []int{
+	4 << 10,
+	16 << 10,
+	64 << 10,
+	256 << 10,
+	1 << 20,
+}
+
+// Configuration for NewMetrics.
+type MetricsConfig struct {
+	// The upper bounds of the latency histogram's buckets, in increasing
+	// order. Defaults to DefaultLatencyBuckets.
+	LatencyBuckets []time.Duration
+
+	// The upper bounds of the size histogram's buckets, in bytes, in
+	// increasing order. Defaults to DefaultSizeBuckets.
+	SizeBuckets []int
+}
+
+// Counters for the ops of one type.
+type OpMetrics struct {
+	// The number of ops read but not yet responded to. Only maintained if
+	// Metrics.Start is installed.
+	InFlight int64
+
+	Ops          uint64
+	Errors       uint64
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// The sum of the ops' latencies, and a histogram of them: Latencies[i] is
+	// the number of ops that took at most LatencyBuckets[i] and more than the
+	// previous bound, and the extra last element counts the slower ones.
+	TotalLatency time.Duration
+	Latencies    []uint64
+
+	// For ReadFile and WriteFile, a histogram of the bytes read or written by
+	// each op that succeeded, bucketed likewise by SizeBuckets. Nil for other
+	// ops.
+	Sizes []uint64
+}
+
+// Metrics aggregates counters and latency histograms per op type, for
+// monitoring a mount in production. Install its Observe method as
+// fuse.MountConfig.OpObserver, and optionally its Start method as
+// fuse.MountConfig.OpStartObserver to track the ops in flight. It serves the
+// metrics over HTTP in the Prometheus text format:
+//
+//	metrics := fusedebug.NewMetrics(fusedebug.MetricsConfig{})
+//	cfg.OpStartObserver = metrics.Start
+//	cfg.OpObserver = metrics.Observe
+//	http.Handle("/metrics", metrics)
+type Metrics struct {
+	cfg MetricsConfig
+
+	mu sync.Mutex
+
+	// Keyed by op name, e.g. "ReadFile".
+	//
+	// GUARDED_BY(mu)
+	byOp map[string]*OpMetrics
+}
+
+// NewMetrics creates metrics that have seen no ops.
+func NewMetrics(cfg MetricsConfig) *Metrics {
+	if len(cfg.LatencyBuckets) == 0 {
+		cfg.LatencyBuckets = DefaultLatencyBuckets
+	}
+
+	if len(cfg.SizeBuckets) == 0 {
+		cfg.SizeBuckets = DefaultSizeBuckets
+	}
+
+	return &Metrics{
+		cfg:  cfg,
+		byOp: make(map[string]*OpMetrics),
+	}
+}
+
+// LOCKS_REQUIRED(m.mu)
+func (m *Metrics) get(name string) *OpMetrics {
+	om := m.byOp[name]
+	if om == nil {
+		om = &OpMetrics{Latencies: make([]uint64, len(m.cfg.LatencyBuckets)+1)}
+		m.byOp[name] = om
+	}
+
+	return om
+}
+
+// Start notes that an op is in flight. It has the signature of
+// fuse.MountConfig.OpStartObserver.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *Metrics) Start(op interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.get(opName(op)).InFlight++
+}
+
+// Observe accounts for an op that has been responded to. It has the signature
+// of fuse.MountConfig.OpObserver.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *Metrics) Observe(op interface{}, start time.Time, err error) {
+	latency := time.Since(start)
+	read, written := opBytes(op, err)
+	bucket := sort.Search(len(m.cfg.LatencyBuckets), func(i int) bool {
+		return latency <= m.cfg.LatencyBuckets[i]
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	om := m.get(opName(op))
+	if om.InFlight > 0 {
+		om.InFlight--
+	}
+
+	om.Ops++
+	if err != nil {
+		om.Errors++
+	}
+
+	om.BytesRead += read
+	om.BytesWritten += written
+	om.TotalLatency += latency
+	om.Latencies[bucket]++
+
+	if carriesData(op) && err == nil {
+		size := int(read + written)
+		bucket := sort.Search(len(m.cfg.SizeBuckets), func(i int) bool {
+			return size <= m.cfg.SizeBuckets[i]
+		})
+
+		if om.Sizes == nil {
+			om.Sizes = make([]uint64, len(m.cfg.SizeBuckets)+1)
+		}
+
+		om.Sizes[bucket]++
+	}
+}
+
+// Report whether the op reads or writes file data.
+func carriesData(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.ReadFileOp, *fuseops.WriteFileOp:
+		return true
+	}
+
+	return false
+}
+
+// SuggestMaxWrite suggests a value for fuse.MountConfig.MaxWrite from the
+// writes seen so far: the smallest size bucket bound, of at least 4 KiB, that
+// 99% of them fit in. It returns zero, which leaves the default, if no writes
+// have been seen or too many were larger than the largest bound.
+//
+// Note that the kernel splits writes larger than the MaxWrite in force, and
+// with writeback caching gathers small ones up to it, so writes seen under a
+// small MaxWrite don't tell whether a larger one would be better.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *Metrics) SuggestMaxWrite() uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	om := m.byOp["WriteFile"]
+	if om == nil || om.Sizes == nil {
+		return 0
+	}
+
+	var total uint64
+	for _, n := range om.Sizes {
+		total += n
+	}
+
+	var cumulative uint64
+	for i, bound := range m.cfg.SizeBuckets {
+		cumulative += om.Sizes[i]
+		if cumulative*100 >= total*99 {
+			if bound < 4096 {
+				bound = 4096
+			}
+
+			return uint32(bound)
+		}
+	}
+
+	return 0
+}
+
+// Snapshot returns the metrics of each op type seen so far, keyed by op name.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *Metrics) Snapshot() map[string]OpMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[string]OpMetrics, len(m.byOp))
+	for name, om := range m.byOp {
+		c := *om
+		c.Latencies = append([]uint64(nil), om.Latencies...)
+		if om.Sizes != nil {
+			c.Sizes = append([]uint64(nil), om.Sizes...)
+		}
+		snapshot[name] = c
+	}
+
+	return snapshot
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format,
+// with the op name as the "op" label.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	snapshot := m.Snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	counters := []struct {
+		name  string
+		help  string
+		typ   string
+		value func(om *OpMetrics) string
+	}{
+		{"fuse_ops_in_flight", "Ops read but not yet responded to.", "gauge",
+			func(om *OpMetrics) string { return fmt.Sprint(om.InFlight) }},
+		{"fuse_ops_total", "Ops responded to.", "counter",
+			func(om *OpMetrics) string { return fmt.Sprint(om.Ops) }},
+		{"fuse_op_errors_total", "Ops responded to with an error.", "counter",
+			func(om *OpMetrics) string { return fmt.Sprint(om.Errors) }},
+		{"fuse_read_bytes_total", "Bytes read.", "counter",
+			func(om *OpMetrics) string { return fmt.Sprint(om.BytesRead) }},
+		{"fuse_written_bytes_total", "Bytes written.", "counter",
+			func(om *OpMetrics) string { return fmt.Sprint(om.BytesWritten) }},
+	}
+
+	for _, c := range counters {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, c.typ)
+		for _, name := range names {
+			om := snapshot[name]
+			fmt.Fprintf(bw, "%s{op=%q} %s\n", c.name, name, c.value(&om))
+		}
+	}
+
+	const latency = "fuse_op_latency_seconds"
+	fmt.Fprintf(bw, "# HELP %s Time taken to respond to ops.\n", latency)
+	fmt.Fprintf(bw, "# TYPE %s histogram\n", latency)
+	for _, name := range names {
+		om := snapshot[name]
+		var cumulative uint64
+		for i, bound := range m.cfg.LatencyBuckets {
+			cumulative += om.Latencies[i]
+			fmt.Fprintf(bw, "%s_bucket{op=%q,le=\"%g\"} %d\n", latency, name, bound.Seconds(), cumulative)
+		}
+
+		fmt.Fprintf(bw, "%s_bucket{op=%q,le=\"+Inf\"} %d\n", latency, name, om.Ops)
+		fmt.Fprintf(bw, "%s_sum{op=%q} %g\n", latency, name, om.TotalLatency.Seconds())
+		fmt.Fprintf(bw, "%s_count{op=%q} %d\n", latency, name, om.Ops)
+	}
+
+	const size = "fuse_op_size_bytes"
+	fmt.Fprintf(bw, "# HELP %s Bytes read or written by ops that succeeded.\n", size)
+	fmt.Fprintf(bw, "# TYPE %s histogram\n", size)
+	for _, name := range names {
+		om := snapshot[name]
+		if om.Sizes == nil {
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range m.cfg.SizeBuckets {
+			cumulative += om.Sizes[i]
+			fmt.Fprintf(bw, "%s_bucket{op=%q,le=\"%d\"} %d\n", size, name, bound, cumulative)
+		}
+
+		cumulative += om.Sizes[len(m.cfg.SizeBuckets)]
+		fmt.Fprintf(bw, "%s_bucket{op=%q,le=\"+Inf\"} %d\n", size, name, cumulative)
+		fmt.Fprintf(bw, "%s_sum{op=%q} %d\n", size, name, om.BytesRead+om.BytesWritten)
+		fmt.Fprintf(bw, "%s_count{op=%q} %d\n", size, name, cumulative)
+	}
+
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WritePrometheus(w)
+}
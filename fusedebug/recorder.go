@@ -0,0 +1,119 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusedebug
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Configuration for NewRecorder.
+type RecorderConfig struct {
+	// The number of ops kept, the older ones being discarded. Defaults to
+	// 1000.
+	Size int
+
+	// Whether to render each op's fields into Event.Details, which makes
+	// recording several times as expensive.
+	Details bool
+}
+
+// A Recorder keeps the most recent ops served by a file system in a ring
+// buffer, like a flight recorder, at a cost low enough to leave it on in
+// production.
+type Recorder struct {
+	cfg RecorderConfig
+
+	mu sync.Mutex
+
+	// The events recorded, the oldest at next once the buffer has wrapped.
+	//
+	// GUARDED_BY(mu)
+	events []Event
+	next   int
+	full   bool
+}
+
+// NewRecorder creates a recorder that hasn't seen any ops.
+func NewRecorder(cfg RecorderConfig) *Recorder {
+	if cfg.Size <= 0 {
+		cfg.Size = 1000
+	}
+
+	return &Recorder{
+		cfg:    cfg,
+		events: make([]Event, cfg.Size),
+	}
+}
+
+// Observe records an op. It has the signature of fuse.MountConfig.OpObserver.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *Recorder) Observe(op interface{}, start time.Time, err error) {
+	var e Event
+	describe(&e, op, start, err)
+	if r.cfg.Details {
+		e.Details, _ = fuseops.MarshalJSON(op, fuseops.JSONOptions{})
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events[r.next] = e
+	r.next++
+	if r.next == len(r.events) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// Events returns copies of the events recorded, oldest first.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *Recorder) Events() []*Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var events []*Event
+	add := func(recorded []Event) {
+		for i := range recorded {
+			e := recorded[i]
+			events = append(events, &e)
+		}
+	}
+
+	if r.full {
+		add(r.events[r.next:])
+	}
+
+	add(r.events[:r.next])
+	return events
+}
+
+// Dump writes the events recorded to w as JSON, one per line, oldest first.
+func (r *Recorder) Dump(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, e := range r.Events() {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,280 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusedebug
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/jacobsa/reqtrace"
+)
+
+// A file or directory session: everything that happened to a handle between
+// the op that opened it and the one that released it.
+type Session struct {
+	Inode  uint64
+	Handle uint64
+	Dir    bool
+
+	// The process that opened the handle, and its user.
+	PID uint32
+	UID uint32
+
+	// The number of opens of the handle not yet released. See SessionTracker.
+	Opens int
+
+	// When the opening op was read from the kernel, and when the release was
+	// responded to.
+	Start time.Time
+	End   time.Time
+
+	// Aggregate statistics. Ops counts every op on the handle, including the
+	// ones that opened and released it.
+	Ops          int
+	Errors       int
+	Reads        int
+	Writes       int
+	Flushes      int
+	Syncs        int
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// The ops on the handle in the order they completed, if
+	// SessionConfig.MaxSpans is positive, and up to that many of them.
+	Spans []Span `json:",omitempty"`
+
+	// The reqtrace trace of the session, whose spans are its ops.
+	trace    context.Context
+	endTrace reqtrace.ReportFunc
+}
+
+// An op within a session.
+type Span struct {
+	Op       string
+	Start    time.Time
+	Duration time.Duration
+	Bytes    int    `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+// Configuration for NewSessionTracker.
+type SessionConfig struct {
+	// Called with each session once its handle has been released. Must not
+	// block for long, as it runs on the goroutine of the releasing op.
+	OnSessionEnd func(s *Session)
+
+	// The maximum number of spans recorded for each session. Zero records none.
+	MaxSpans int
+}
+
+// A SessionTracker groups the ops on each file and directory handle into a
+// Session, which is far more useful for analysing a workload than the ops on
+// their own: which process read a file, how much of it, in how many reads,
+// and for how long it held it open.
+//
+// When tracing is enabled with reqtrace's flag, each session is also a trace
+// whose spans are the session's ops, logged once the handle is released.
+//
+// Sessions are told apart by their handles, so the file system must give each
+// open a handle of its own for each of them to get a session. Opens of a
+// handle that is already open, as with file systems answering every open with
+// handle zero, are merged into the session already open, which ends once
+// all of them have been released.
+type SessionTracker struct {
+	cfg SessionConfig
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	sessions map[sessionKey]*Session
+}
+
+// Directory and file handles may be numbered independently.
+type sessionKey struct {
+	dir    bool
+	handle fuseops.HandleID
+}
+
+// NewSessionTracker creates a tracker with no open sessions.
+func NewSessionTracker(cfg SessionConfig) *SessionTracker {
+	return &SessionTracker{
+		cfg:      cfg,
+		sessions: make(map[sessionKey]*Session),
+	}
+}
+
+// Observe accounts for an op. It has the signature of
+// fuse.MountConfig.OpObserver.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *SessionTracker) Observe(op interface{}, start time.Time, err error) {
+	var key sessionKey
+	var opened, released bool
+	var bytes int
+
+	switch typed := op.(type) {
+	case *fuseops.OpenFileOp:
+		key, opened = sessionKey{false, typed.Handle}, true
+	case *fuseops.CreateFileOp:
+		key, opened = sessionKey{false, typed.Handle}, true
+	case *fuseops.OpenDirOp:
+		key, opened = sessionKey{true, typed.Handle}, true
+	case *fuseops.ReadFileOp:
+		key, bytes = sessionKey{false, typed.Handle}, typed.BytesRead
+	case *fuseops.WriteFileOp:
+		key, bytes = sessionKey{false, typed.Handle}, typed.Written()
+	case *fuseops.ReadDirOp:
+		key, bytes = sessionKey{true, typed.Handle}, typed.BytesRead
+	case *fuseops.ReadDirPlusOp:
+		key, bytes = sessionKey{true, typed.Handle}, typed.BytesRead
+	case *fuseops.FlushFileOp:
+		key = sessionKey{false, typed.Handle}
+	case *fuseops.SyncFileOp:
+		key = sessionKey{false, typed.Handle}
+	case *fuseops.FallocateOp:
+		key = sessionKey{false, typed.Handle}
+	case *fuseops.LseekOp:
+		key = sessionKey{false, typed.Handle}
+	case *fuseops.PollOp:
+		key = sessionKey{false, typed.Handle}
+	case *fuseops.IoctlOp:
+		key = sessionKey{typed.Dir, typed.Handle}
+	case *fuseops.ReleaseFileHandleOp:
+		key, released = sessionKey{false, typed.Handle}, true
+	case *fuseops.ReleaseDirHandleOp:
+		key, released = sessionKey{true, typed.Handle}, true
+	default:
+		return
+	}
+
+	// A failed open creates no handle.
+	if opened && err != nil {
+		return
+	}
+
+	e := NewEvent(op, start, err)
+
+	t.mu.Lock()
+	s := t.sessions[key]
+	if opened && s == nil {
+		s = &Session{
+			Inode:  e.Inode,
+			Handle: uint64(key.handle),
+			Dir:    key.dir,
+			PID:    e.PID,
+			UID:    e.UID,
+			Start:  start,
+		}
+
+		// CreateFile names its parent; the session is about the new file.
+		if create, ok := op.(*fuseops.CreateFileOp); ok {
+			s.Inode = uint64(create.Entry.Child)
+		}
+
+		kind := "file"
+		if key.dir {
+			kind = "directory"
+		}
+
+		s.trace, s.endTrace = reqtrace.Trace(
+			context.Background(),
+			fmt.Sprintf("%s session: inode %d, handle %d", kind, s.Inode, s.Handle))
+
+		t.sessions[key] = s
+	}
+
+	if opened {
+		s.Opens++
+	}
+
+	// Ops on handles opened before we started tracking are ignored.
+	if s == nil {
+		t.mu.Unlock()
+		return
+	}
+
+	s.Ops++
+	if err != nil {
+		s.Errors++
+	}
+
+	switch op.(type) {
+	case *fuseops.ReadFileOp, *fuseops.ReadDirOp, *fuseops.ReadDirPlusOp:
+		s.Reads++
+		s.BytesRead += uint64(bytes)
+	case *fuseops.WriteFileOp:
+		s.Writes++
+		if err == nil {
+			s.BytesWritten += uint64(bytes)
+		}
+	case *fuseops.FlushFileOp:
+		s.Flushes++
+	case *fuseops.SyncFileOp:
+		s.Syncs++
+	}
+
+	_, report := reqtrace.StartSpan(s.trace, e.Op)
+	report(err)
+
+	if len(s.Spans) < t.cfg.MaxSpans {
+		s.Spans = append(s.Spans, Span{
+			Op:       e.Op,
+			Start:    start,
+			Duration: e.Duration,
+			Bytes:    bytes,
+			Error:    e.Error,
+		})
+	}
+
+	if released {
+		s.Opens--
+		released = s.Opens <= 0
+	}
+
+	if released {
+		delete(t.sessions, key)
+		s.End = time.Now()
+	}
+	t.mu.Unlock()
+
+	if !released {
+		return
+	}
+
+	s.endTrace(nil)
+	if t.cfg.OnSessionEnd != nil {
+		t.cfg.OnSessionEnd(s)
+	}
+}
+
+// Open returns copies of the sessions whose handles are currently open.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *SessionTracker) Open() []Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sessions := make([]Session, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		c := *s
+		c.Spans = append([]Span(nil), s.Spans...)
+		sessions = append(sessions, c)
+	}
+
+	return sessions
+}
@@ -13,5 +13,6 @@
 // limitations under the License.
 
 // Package fuseops contains ops that may be returned by fuse.Connection.ReadOp.
-// See documentation in that package for more.
+// See documentation in that package for more, and OPS.md or Ops for a
+// summary of every op.
 package fuseops
@@ -0,0 +1,354 @@
+//go:build ignore
+// +build ignore
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Generate optable.go and OPS.md, which describe the op types of ops.go, from
+// their definitions and from what conversions.go sends back to the kernel for
+// them.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type field struct {
+	name     string
+	typ      string
+	response bool
+}
+
+type op struct {
+	name    string
+	summary string
+	fields  []field
+	errors  []string
+}
+
+// Errno names, as mentioned in documentation.
+var errnoRE = regexp.MustCompile(`\bE[A-Z0-9]{2,}\b`)
+
+func main() {
+	fset := token.NewFileSet()
+	opsFile, err := parser.ParseFile(fset, "ops.go", nil, parser.ParseComments)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	convFile, err := parser.ParseFile(fset, "../conversions.go", nil, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sent := sentFields(convFile)
+	requested := requestFields(convFile)
+	var ops []op
+	for _, decl := range opsFile.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok || !strings.HasSuffix(ts.Name.Name, "Op") {
+				continue
+			}
+
+			ops = append(ops, describe(
+				fset,
+				ts.Name.Name,
+				gd.Doc.Text(),
+				st,
+				sent[ts.Name.Name],
+				requested[ts.Name.Name]))
+		}
+	}
+
+	write("optable.go", goSource(ops))
+	write("OPS.md", markdown(ops))
+}
+
+// Return the fields of each op type that kernelResponseForOp reads from the
+// op, by type.
+func sentFields(f *ast.File) map[string]map[string]bool {
+	sent := make(map[string]map[string]bool)
+	inspectFunc(f, "kernelResponseForOp", func(n ast.Node) bool {
+		cc, ok := n.(*ast.CaseClause)
+		if !ok {
+			return true
+		}
+
+		fields := make(map[string]bool)
+		for _, stmt := range cc.Body {
+			ast.Inspect(stmt, func(n ast.Node) bool {
+				if sel, ok := n.(*ast.SelectorExpr); ok {
+					if id, ok := sel.X.(*ast.Ident); ok && id.Name == "o" {
+						fields[sel.Sel.Name] = true
+					}
+				}
+
+				return true
+			})
+		}
+
+		for _, e := range cc.List {
+			if star, ok := e.(*ast.StarExpr); ok {
+				sent[opType(star.X)] = fields
+			}
+		}
+
+		return false
+	})
+
+	return sent
+}
+
+// Return the fields of each op type that convertInMessage sets from the
+// request, by type: those set in composite literals of the type, and those
+// of variables holding such literals that are assigned to or whose address
+// is taken.
+func requestFields(f *ast.File) map[string]map[string]bool {
+	fields := make(map[string]map[string]bool)
+	set := func(typ string, field string) {
+		if fields[typ] == nil {
+			fields[typ] = make(map[string]bool)
+		}
+
+		fields[typ][field] = true
+	}
+
+	// The op type of each variable, as of the node being inspected.
+	vars := make(map[string]string)
+	setVia := func(e ast.Expr) {
+		if sel, ok := e.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok && vars[id.Name] != "" {
+				set(vars[id.Name], sel.Sel.Name)
+			}
+		}
+	}
+
+	inspectFunc(f, "convertInMessage", func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CompositeLit:
+			if typ := opType(n.Type); typ != "" {
+				for _, elt := range n.Elts {
+					if kv, ok := elt.(*ast.KeyValueExpr); ok {
+						set(typ, kv.Key.(*ast.Ident).Name)
+					}
+				}
+			}
+
+		case *ast.AssignStmt:
+			for i, lhs := range n.Lhs {
+				setVia(lhs)
+				if id, ok := lhs.(*ast.Ident); ok && n.Tok == token.DEFINE && i < len(n.Rhs) {
+					vars[id.Name] = ""
+					if u, ok := n.Rhs[i].(*ast.UnaryExpr); ok && u.Op == token.AND {
+						if lit, ok := u.X.(*ast.CompositeLit); ok {
+							vars[id.Name] = opType(lit.Type)
+						}
+					}
+				}
+			}
+
+		case *ast.UnaryExpr:
+			if n.Op == token.AND {
+				setVia(n.X)
+			}
+		}
+
+		return true
+	})
+
+	return fields
+}
+
+// Call ast.Inspect with the body of the named function.
+func inspectFunc(f *ast.File, name string, fn func(ast.Node) bool) {
+	for _, decl := range f.Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && fd.Name.Name == name {
+			ast.Inspect(fd.Body, fn)
+		}
+	}
+}
+
+// Return the name of the op type of the supplied type expression, such as
+// fuseops.MkDirOp, or the empty string.
+func opType(e ast.Expr) string {
+	if sel, ok := e.(*ast.SelectorExpr); ok {
+		if id, ok := sel.X.(*ast.Ident); ok && id.Name == "fuseops" {
+			return sel.Sel.Name
+		}
+	}
+
+	return ""
+}
+
+// Return the first sentence of the supplied documentation, on one line.
+func synopsis(text string) string {
+	para := strings.Fields(strings.SplitN(text, "\n\n", 2)[0])
+	for i, word := range para {
+		switch word {
+		case "e.g.", "i.e.", "cf.":
+			continue
+		}
+
+		if strings.HasSuffix(word, ".") {
+			return strings.Join(para[:i+1], " ")
+		}
+	}
+
+	return strings.Join(para, " ")
+}
+
+func describe(
+	fset *token.FileSet,
+	name string,
+	docText string,
+	st *ast.StructType,
+	sent map[string]bool,
+	requested map[string]bool) op {
+	o := op{
+		name:    name,
+		summary: synopsis(docText),
+	}
+
+	mentioned := make(map[string]bool)
+	mention := func(text string) {
+		for _, e := range errnoRE.FindAllString(text, -1) {
+			if e != "EOF" && !mentioned[e] {
+				mentioned[e] = true
+				o.errors = append(o.errors, e)
+			}
+		}
+	}
+
+	mention(docText)
+
+	// A comment describes the fields that follow it up to a blank line.
+	var groupDoc string
+	lastLine := -1
+	for _, f := range st.Fields.List {
+		line := fset.Position(f.Pos()).Line
+		if f.Doc != nil {
+			groupDoc = f.Doc.Text()
+			mention(groupDoc)
+		} else if line != lastLine+1 {
+			groupDoc = ""
+		}
+
+		lastLine = fset.Position(f.End()).Line
+
+		var typ bytes.Buffer
+		format.Node(&typ, fset, f.Type)
+		for _, n := range f.Names {
+			setByFS := strings.Contains(groupDoc, "by the file system") &&
+				(strings.HasPrefix(groupDoc, "Set by") ||
+					strings.Contains(groupDoc, "filled out by the file system"))
+
+			o.fields = append(o.fields, field{
+				name:     n.Name,
+				typ:      typ.String(),
+				response: n.Name != "OpContext" && (setByFS || sent[n.Name] && !requested[n.Name]),
+			})
+		}
+	}
+
+	return o
+}
+
+func goSource(ops []op) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by gen_optable.go; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package fuseops\n\n")
+	fmt.Fprintf(&b, "// The op types of this package, in the order of their definitions.\n")
+	fmt.Fprintf(&b, "var Ops = []OpInfo{\n")
+	for _, o := range ops {
+		fmt.Fprintf(&b, "{\n")
+		fmt.Fprintf(&b, "Name: %q,\n", o.name)
+		fmt.Fprintf(&b, "New: func() interface{} { return &%s{} },\n", o.name)
+		fmt.Fprintf(&b, "Summary: %q,\n", o.summary)
+		fmt.Fprintf(&b, "Fields: []FieldInfo{\n")
+		for _, f := range o.fields {
+			fmt.Fprintf(&b, "{Name: %q, Type: %q, Response: %v},\n", f.name, f.typ, f.response)
+		}
+
+		fmt.Fprintf(&b, "},\n")
+		if len(o.errors) != 0 {
+			fmt.Fprintf(&b, "Errors: %#v,\n", o.errors)
+		}
+
+		fmt.Fprintf(&b, "},\n")
+	}
+
+	fmt.Fprintf(&b, "}\n")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return src
+}
+
+func markdown(ops []op) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<!-- Code generated by gen_optable.go; DO NOT EDIT. -->\n\n")
+	fmt.Fprintf(&b, "# Ops\n\n")
+	fmt.Fprintf(&b, "The ops a file system may receive, as defined in ops.go. Response fields\n")
+	fmt.Fprintf(&b, "are set by the file system and sent back to the kernel; the others are\n")
+	fmt.Fprintf(&b, "set from the kernel's request. Errors are those the documentation of the\n")
+	fmt.Fprintf(&b, "op mentions.\n\n")
+	fmt.Fprintf(&b, "| Op | Summary | Request fields | Response fields | Errors |\n")
+	fmt.Fprintf(&b, "| --- | --- | --- | --- | --- |\n")
+	for _, o := range ops {
+		var request, response []string
+		for _, f := range o.fields {
+			if f.response {
+				response = append(response, "`"+f.name+"`")
+			} else {
+				request = append(request, "`"+f.name+"`")
+			}
+		}
+
+		fmt.Fprintf(
+			&b,
+			"| `%s` | %s | %s | %s | %s |\n",
+			o.name,
+			strings.ReplaceAll(o.summary, "|", `\|`),
+			strings.Join(request, ", "),
+			strings.Join(response, ", "),
+			strings.Join(o.errors, ", "))
+	}
+
+	return b.Bytes()
+}
+
+func write(name string, b []byte) {
+	if err := os.WriteFile(name, b, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseops
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// JSONOptions controls how ops are rendered by MarshalJSON.
+type JSONOptions struct {
+	// By default data payloads (file contents, directory buffers, extended
+	// attribute values and lists) are rendered as their length only. Set this
+	// to include them, base64-encoded, truncated to MaxData bytes if MaxData is
+	// positive.
+	IncludeData bool
+	MaxData     int
+
+	// Replace names and symlink targets with "<redacted>", for logs that must
+	// not reveal the contents of the file system.
+	RedactNames bool
+}
+
+// The rendering of a redacted name.
+const redacted = "<redacted>"
+
+// MarshalJSON renders an op, including the fields set by the file system in
+// response to it, as a JSON object whose "Op" member holds the name of the op
+// (e.g. "ReadFile") and whose other members are the op's fields. Buffers
+// filled by the file system are rendered up to the number of bytes it
+// reported.
+//
+// Each op's MarshalJSON method calls this with the zero JSONOptions.
+func MarshalJSON(op interface{}, opts JSONOptions) ([]byte, error) {
+	v := reflect.ValueOf(op)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("not a pointer to an op: %T", op)
+	}
+
+	m := structJSON(v.Elem(), opts)
+	m["Op"] = strings.TrimSuffix(v.Elem().Type().Name(), "Op")
+	return json.Marshal(m)
+}
+
+// OpFields returns the members MarshalJSON renders for an op's fields, other
+// than "Op", as values that encoding/json can encode, e.g. for structured
+// logging. It returns nil if op isn't a pointer to a struct.
+func OpFields(op interface{}, opts JSONOptions) map[string]interface{} {
+	v := reflect.ValueOf(op)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+
+	return structJSON(v.Elem(), opts)
+}
+
+func structJSON(v reflect.Value, opts JSONOptions) map[string]interface{} {
+	m := make(map[string]interface{})
+
+	// Buffers are only meaningful up to BytesRead, when present.
+	bytesRead := -1
+	if f := v.FieldByName("BytesRead"); f.IsValid() && f.Kind() == reflect.Int {
+		bytesRead = int(f.Int())
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		f := v.Field(i)
+		switch {
+		case sf.Name == "Dst" && f.Kind() == reflect.Slice && bytesRead >= 0:
+			if bytesRead <= f.Len() {
+				f = f.Slice(0, bytesRead)
+			}
+			m[sf.Name] = payloadJSON(f.Bytes(), opts)
+
+		case opts.RedactNames && f.Kind() == reflect.String && isNameField(sf.Name):
+			m[sf.Name] = redacted
+
+		default:
+			m[sf.Name] = valueJSON(f, opts)
+		}
+	}
+
+	return m
+}
+
+func isNameField(name string) bool {
+	switch name {
+	case "Name", "OldName", "NewName", "Target":
+		return true
+	}
+
+	return false
+}
+
+var (
+	byteSliceType = reflect.TypeOf([]byte(nil))
+	timeType      = reflect.TypeOf(time.Time{})
+	stringerType  = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+)
+
+func valueJSON(v reflect.Value, opts JSONOptions) interface{} {
+	switch {
+	case v.Type() == byteSliceType:
+		return payloadJSON(v.Bytes(), opts)
+
+	case v.Type() == timeType:
+		return v.Interface()
+
+	case v.Kind() != reflect.Struct && v.Type().Implements(stringerType):
+		// Modes and flags.
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			return nil
+		}
+		return v.Interface().(fmt.Stringer).String()
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return valueJSON(v.Elem(), opts)
+
+	case reflect.Struct:
+		return structJSON(v, opts)
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+
+		l := make([]interface{}, v.Len())
+		for i := range l {
+			l[i] = valueJSON(v.Index(i), opts)
+		}
+		return l
+
+	case reflect.Func, reflect.Chan:
+		return nil
+	}
+
+	return v.Interface()
+}
+
+// Render a data payload according to the options: its length, or the data
+// itself, which encoding/json encodes in base64.
+func payloadJSON(b []byte, opts JSONOptions) interface{} {
+	if b == nil {
+		return nil
+	}
+
+	if !opts.IncludeData {
+		return map[string]int{"Len": len(b)}
+	}
+
+	if opts.MaxData > 0 && len(b) > opts.MaxData {
+		b = b[:opts.MaxData]
+	}
+
+	return b
+}
+
+func (o *StatFSOp) MarshalJSON() ([]byte, error)             { return MarshalJSON(o, JSONOptions{}) }
+func (o *LookUpInodeOp) MarshalJSON() ([]byte, error)        { return MarshalJSON(o, JSONOptions{}) }
+func (o *GetInodeAttributesOp) MarshalJSON() ([]byte, error) { return MarshalJSON(o, JSONOptions{}) }
+func (o *SetInodeAttributesOp) MarshalJSON() ([]byte, error) { return MarshalJSON(o, JSONOptions{}) }
+func (o *AccessOp) MarshalJSON() ([]byte, error)             { return MarshalJSON(o, JSONOptions{}) }
+func (o *ForgetInodeOp) MarshalJSON() ([]byte, error)        { return MarshalJSON(o, JSONOptions{}) }
+func (o *BatchForgetOp) MarshalJSON() ([]byte, error)        { return MarshalJSON(o, JSONOptions{}) }
+func (o *MkDirOp) MarshalJSON() ([]byte, error)              { return MarshalJSON(o, JSONOptions{}) }
+func (o *MkNodeOp) MarshalJSON() ([]byte, error)             { return MarshalJSON(o, JSONOptions{}) }
+func (o *CreateFileOp) MarshalJSON() ([]byte, error)         { return MarshalJSON(o, JSONOptions{}) }
+func (o *CreateSymlinkOp) MarshalJSON() ([]byte, error)      { return MarshalJSON(o, JSONOptions{}) }
+func (o *CreateLinkOp) MarshalJSON() ([]byte, error)         { return MarshalJSON(o, JSONOptions{}) }
+func (o *RenameOp) MarshalJSON() ([]byte, error)             { return MarshalJSON(o, JSONOptions{}) }
+func (o *RmDirOp) MarshalJSON() ([]byte, error)              { return MarshalJSON(o, JSONOptions{}) }
+func (o *UnlinkOp) MarshalJSON() ([]byte, error)             { return MarshalJSON(o, JSONOptions{}) }
+func (o *OpenDirOp) MarshalJSON() ([]byte, error)            { return MarshalJSON(o, JSONOptions{}) }
+func (o *ReadDirOp) MarshalJSON() ([]byte, error)            { return MarshalJSON(o, JSONOptions{}) }
+func (o *ReadDirPlusOp) MarshalJSON() ([]byte, error)        { return MarshalJSON(o, JSONOptions{}) }
+func (o *ReleaseDirHandleOp) MarshalJSON() ([]byte, error)   { return MarshalJSON(o, JSONOptions{}) }
+func (o *OpenFileOp) MarshalJSON() ([]byte, error)           { return MarshalJSON(o, JSONOptions{}) }
+func (o *ReadFileOp) MarshalJSON() ([]byte, error)           { return MarshalJSON(o, JSONOptions{}) }
+func (o *WriteFileOp) MarshalJSON() ([]byte, error)          { return MarshalJSON(o, JSONOptions{}) }
+func (o *SyncFileOp) MarshalJSON() ([]byte, error)           { return MarshalJSON(o, JSONOptions{}) }
+func (o *FlushFileOp) MarshalJSON() ([]byte, error)          { return MarshalJSON(o, JSONOptions{}) }
+func (o *SyncFSOp) MarshalJSON() ([]byte, error)             { return MarshalJSON(o, JSONOptions{}) }
+func (o *ReleaseFileHandleOp) MarshalJSON() ([]byte, error)  { return MarshalJSON(o, JSONOptions{}) }
+func (o *ReadSymlinkOp) MarshalJSON() ([]byte, error)        { return MarshalJSON(o, JSONOptions{}) }
+func (o *RemoveXattrOp) MarshalJSON() ([]byte, error)        { return MarshalJSON(o, JSONOptions{}) }
+func (o *GetXattrOp) MarshalJSON() ([]byte, error)           { return MarshalJSON(o, JSONOptions{}) }
+func (o *ListXattrOp) MarshalJSON() ([]byte, error)          { return MarshalJSON(o, JSONOptions{}) }
+func (o *SetXattrOp) MarshalJSON() ([]byte, error)           { return MarshalJSON(o, JSONOptions{}) }
+func (o *FallocateOp) MarshalJSON() ([]byte, error)          { return MarshalJSON(o, JSONOptions{}) }
+func (o *LseekOp) MarshalJSON() ([]byte, error)              { return MarshalJSON(o, JSONOptions{}) }
+func (o *PollOp) MarshalJSON() ([]byte, error)               { return MarshalJSON(o, JSONOptions{}) }
+func (o *IoctlOp) MarshalJSON() ([]byte, error)              { return MarshalJSON(o, JSONOptions{}) }
+func (o *GetInodeFlagsOp) MarshalJSON() ([]byte, error)      { return MarshalJSON(o, JSONOptions{}) }
+func (o *SetInodeFlagsOp) MarshalJSON() ([]byte, error)      { return MarshalJSON(o, JSONOptions{}) }
+func (o *GetLkOp) MarshalJSON() ([]byte, error)              { return MarshalJSON(o, JSONOptions{}) }
+func (o *SetLkOp) MarshalJSON() ([]byte, error)              { return MarshalJSON(o, JSONOptions{}) }
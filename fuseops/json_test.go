@@ -0,0 +1,98 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseops_test
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+func decode(t *testing.T, b []byte) map[string]interface{} {
+	t.Helper()
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", b, err)
+	}
+
+	return m
+}
+
+func TestMarshalJSONDefault(t *testing.T) {
+	op := &fuseops.ReadFileOp{
+		Inode:     17,
+		Handle:    3,
+		Offset:    4096,
+		Size:      8,
+		Dst:       []byte("tacosXXX"),
+		BytesRead: 5,
+		OpContext: fuseops.OpContext{Pid: 42},
+	}
+
+	b, err := json.Marshal(op)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	m := decode(t, b)
+	if m["Op"] != "ReadFile" || m["Inode"] != 17.0 || m["Offset"] != 4096.0 {
+		t.Errorf("Unexpected rendering: %s", b)
+	}
+
+	// The payload is reduced to the length read.
+	if dst, _ := m["Dst"].(map[string]interface{}); dst["Len"] != 5.0 {
+		t.Errorf("Dst: %v", m["Dst"])
+	}
+
+	if ctx, _ := m["OpContext"].(map[string]interface{}); ctx["Pid"] != 42.0 {
+		t.Errorf("OpContext: %v", m["OpContext"])
+	}
+}
+
+func TestMarshalJSONOptions(t *testing.T) {
+	mode := os.FileMode(0644)
+	op := &fuseops.CreateFileOp{
+		Parent: 1,
+		Name:   "secret.txt",
+		Mode:   mode,
+	}
+
+	b, err := fuseops.MarshalJSON(op, fuseops.JSONOptions{RedactNames: true})
+	if err != nil {
+		t.Fatalf("MarshalJSON: %v", err)
+	}
+
+	m := decode(t, b)
+	if m["Name"] != "<redacted>" || m["Mode"] != "-rw-r--r--" {
+		t.Errorf("Unexpected rendering: %s", b)
+	}
+
+	write := &fuseops.WriteFileOp{Data: []byte("burrito")}
+	b, err = fuseops.MarshalJSON(write, fuseops.JSONOptions{
+		IncludeData: true,
+		MaxData:     4,
+	})
+	if err != nil {
+		t.Fatalf("MarshalJSON: %v", err)
+	}
+
+	// "burr", base64-encoded.
+	if m := decode(t, b); m["Data"] != "YnVycg==" {
+		t.Errorf("Data: %v", m["Data"])
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseops
+
+//go:generate go run gen_optable.go
+
+// A description of an op type, generated from its definition. See Ops, and
+// OPS.md for the same as a table.
+type OpInfo struct {
+	// The name of the type, such as "LookUpInodeOp".
+	Name string
+
+	// Return a new, zero op of the type.
+	New func() interface{}
+
+	// The first sentence of the type's documentation.
+	Summary string
+
+	// The fields of the type, in order.
+	Fields []FieldInfo
+
+	// The errnos the documentation of the type mentions, such as "ENOENT",
+	// in order of first mention. Every op may also fail with other errors, and
+	// ENOSYS makes the kernel stop sending some ops.
+	Errors []string
+}
+
+// A description of a field of an op type.
+type FieldInfo struct {
+	// The name of the field, and its type as written in the definition.
+	Name string
+	Type string
+
+	// Whether the field is set by the file system and sent back to the kernel,
+	// rather than set from the kernel's request.
+	Response bool
+}
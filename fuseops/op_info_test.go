@@ -0,0 +1,60 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseops_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Catch changes to the op types that weren't followed by go generate.
+func TestOpsAreUpToDate(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, info := range fuseops.Ops {
+		typ := reflect.TypeOf(info.New()).Elem()
+		if typ.Name() != info.Name {
+			t.Errorf("%s: New returns a %v", info.Name, typ)
+			continue
+		}
+
+		if seen[info.Name] {
+			t.Errorf("%s: described twice", info.Name)
+		}
+
+		seen[info.Name] = true
+
+		var names []string
+		for i := 0; i < typ.NumField(); i++ {
+			names = append(names, typ.Field(i).Name)
+		}
+
+		var described []string
+		for _, f := range info.Fields {
+			described = append(described, f.Name)
+		}
+
+		if !reflect.DeepEqual(described, names) {
+			t.Errorf("%s: described fields %v, want %v", info.Name, described, names)
+		}
+	}
+
+	for _, name := range []string{"LookUpInodeOp", "ReadFileOp", "AccessOp"} {
+		if !seen[name] {
+			t.Errorf("%s not described", name)
+		}
+	}
+}
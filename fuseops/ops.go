@@ -16,6 +16,7 @@ package fuseops
 
 import (
 	"os"
+	"syscall"
 	"time"
 
 	"github.com/folays/jacobsa_fuse/internal/fusekernel"
@@ -29,8 +30,15 @@ import (
 // See https://libfuse.github.io/doxygen/structfuse__context.html as a reference.
 type OpContext struct {
 	// PID of the process that is invoking the operation.
-	// Not filled in case of a writepage operation.
+	// Not filled in case of a writepage operation. See fuseutil.LookUpProcess
+	// to find out more about the process.
 	Pid uint32
+
+	// The effective user and group IDs of that process. Like Pid, these don't
+	// necessarily identify the process that dirtied the data for a writepage
+	// operation.
+	Uid uint32
+	Gid uint32
 }
 
 // Return statistics about the file system's capacity and available resources.
@@ -157,7 +165,8 @@ type SetInodeAttributesOp struct {
 	// The inode of interest.
 	Inode InodeID
 
-	// If set, this is ftruncate(2), otherwise it's truncate(2)
+	// The handle through which the inode is being truncated, if any: set for
+	// ftruncate(2) and for open(2) with O_TRUNC, and nil for truncate(2).
 	Handle *HandleID
 
 	// The attributes to modify, or nil for attributes that don't need a change.
@@ -168,6 +177,26 @@ type SetInodeAttributesOp struct {
 	Atime *time.Time
 	Mtime *time.Time
 
+	// Set along with Atime and Mtime respectively when the caller asked for
+	// the current time, e.g. with touch(1) or UTIME_NOW, rather than for a
+	// given time. The time the kernel sends is then its own clock's, and the
+	// file system may use its backend's clock instead. POSIX also only
+	// requires write access to the inode to set its times to the current
+	// time, while setting them to a given time requires owning it.
+	AtimeNow bool
+	MtimeNow bool
+
+	// Linux only. The new ctime, which the kernel sends along with Mtime when
+	// writing back the times it has kept for a file whose writes it cached. See
+	// notes on fuse.MountConfig.DisableWritebackCaching. Otherwise the file
+	// system is expected to set the ctime itself for any change it makes.
+	Ctime *time.Time
+
+	// OS X only. The new creation and backup times, as set with setattrlist(2)
+	// and shown by GetFileInfo(1). See InodeAttributes.Crtime.
+	Crtime   *time.Time
+	Bkuptime *time.Time
+
 	// Set by the file system: the new attributes for the inode, and the time at
 	// which they should expire. See notes on
 	// ChildInodeEntry.AttributesExpiration for more.
@@ -176,6 +205,33 @@ type SetInodeAttributesOp struct {
 	OpContext            OpContext
 }
 
+// Check whether the caller may access an inode, for access(2) and chdir(2).
+//
+// The kernel sends this only when the file system is mounted with
+// fuse.MountConfig.DisableDefaultPermissions set; otherwise it checks the
+// inode's mode itself. Other ops such as OpenFileOp aren't preceded by it, so
+// file systems doing their own permission checks must repeat them there.
+// File systems that don't check permissions needn't implement it: the first
+// ENOSYS makes the kernel stop sending it for the mount, and allow all access.
+//
+// Return EACCES to deny access.
+type AccessOp struct {
+	// The inode of interest.
+	Inode InodeID
+
+	// The access requested, a combination of AccessRead, AccessWrite and
+	// AccessExecute, or zero to check only that the inode exists.
+	Mask      uint32
+	OpContext OpContext
+}
+
+// Bits of AccessOp.Mask, as for access(2).
+const (
+	AccessExecute = 1
+	AccessWrite   = 2
+	AccessRead    = 4
+)
+
 // Decrement the reference count for an inode ID previously issued by the file
 // system.
 //
@@ -242,6 +298,12 @@ type BatchForgetEntry struct {
 // This operation is a batch of ForgetInodeOp operations. Every entry in
 // Entries is one ForgetInodeOp operation. See the docs of ForgetInodeOp
 // for further details.
+//
+// The kernel sends this with up to thousands of entries when it evicts inodes
+// under memory pressure. File systems should drop the references in bulk,
+// e.g. under a single acquisition of their lock, and without blocking:
+// fuseutil.NewFileSystemServer handles this op in the goroutine reading ops,
+// as it does ForgetInodeOp.
 type BatchForgetOp struct {
 	// Entries is a list of Forget operations. One could treat every entry in the
 	// list as a single ForgetInodeOp operation.
@@ -273,6 +335,9 @@ type MkDirOp struct {
 	Name string
 	Mode os.FileMode
 
+	// The security contexts for the new inode, if any. See SecurityContext.
+	SecurityContext []SecurityContext
+
 	// Set by the file system: information about the inode that was created.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
@@ -301,6 +366,14 @@ type MkNodeOp struct {
 	Name string
 	Mode os.FileMode
 
+	// For a character or block device, the device the node stands for, to be
+	// reported back as InodeAttributes.Rdev. See there for what opening it
+	// does.
+	Rdev uint32
+
+	// The security contexts for the new inode, if any. See SecurityContext.
+	SecurityContext []SecurityContext
+
 	// Set by the file system: information about the inode that was created.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
@@ -327,6 +400,9 @@ type CreateFileOp struct {
 	Name string
 	Mode os.FileMode
 
+	// The security contexts for the new inode, if any. See SecurityContext.
+	SecurityContext []SecurityContext
+
 	// Set by the file system: information about the inode that was created.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
@@ -341,7 +417,20 @@ type CreateFileOp struct {
 	// The handle may be supplied in future ops like ReadFileOp that contain a
 	// file handle. The file system must ensure this ID remains valid until a
 	// later call to ReleaseFileHandle.
-	Handle    HandleID
+	Handle HandleID
+
+	// Set by the file system: how the kernel is to cache the file's contents
+	// for the handle, as for OpenFileOp.
+	KeepPageCache bool
+	UseDirectIO   bool
+	NonSeekable   bool
+
+	// Set by the file system: the file to serve the handle's contents from, as
+	// for OpenFileOp.
+	BackingFile *os.File
+
+	// The flags passed to open(2). See OpenFileOp.OpenFlags.
+	OpenFlags fusekernel.OpenFlags
 	OpContext OpContext
 }
 
@@ -357,6 +446,9 @@ type CreateSymlinkOp struct {
 	// The target of the symlink.
 	Target string
 
+	// The security contexts for the new inode, if any. See SecurityContext.
+	SecurityContext []SecurityContext
+
 	// Set by the file system: information about the symlink inode that was
 	// created.
 	//
@@ -434,9 +526,29 @@ type RenameOp struct {
 	// overwritten within it.
 	NewParent InodeID
 	NewName   string
+
+	// The flags passed to renameat2(2), if MountConfig.EnableRenameFlags is
+	// set; zero otherwise. File systems must fail the op with EINVAL if any
+	// flag they don't implement is set, rather than rename as usual.
+	Flags     RenameFlags
 	OpContext OpContext
 }
 
+// Flags changing how RenameOp behaves, as passed to renameat2(2).
+type RenameFlags uint32
+
+const (
+	// Fail with EEXIST rather than replace the entry at the new name, if any.
+	RenameNoReplace RenameFlags = 1 << 0
+
+	// Atomically swap the two entries, which must both exist.
+	RenameExchange RenameFlags = 1 << 1
+
+	// Leave a whiteout, a character device numbered 0:0, in place of the
+	// entry renamed, as overlay file systems do.
+	RenameWhiteout RenameFlags = 1 << 2
+)
+
 // Unlink a directory from its parent. Because directories cannot have a link
 // count above one, this means the directory inode should be deleted as well
 // once the kernel sends ForgetInodeOp.
@@ -488,7 +600,16 @@ type OpenDirOp struct {
 	// The handle may be supplied in future ops like ReadDirOp that contain a
 	// directory handle. The file system must ensure this ID remains valid until
 	// a later call to ReleaseDirHandle.
-	Handle    HandleID
+	Handle HandleID
+
+	// Set by the file system: let the kernel cache the directory's entries as
+	// they are read, and serve later reads of the directory from its cache
+	// rather than with ReadDirOp (Linux >= 4.20). As with file contents, the
+	// cache is dropped when the directory is next opened, unless KeepCache is
+	// set then, and can be dropped with Connection.InvalidateInode.
+	CacheDir  bool
+	KeepCache bool
+
 	OpContext OpContext
 }
 
@@ -557,6 +678,15 @@ type ReadDirOp struct {
 	// something that looks like a newly-opened directory. So FUSE file systems
 	// may e.g. cache an entire fresh listing for each ReadDir with a zero
 	// offset, and return array offsets into that cached listing.
+	//
+	// The offset is always zero or one that the file system returned with an
+	// entry of the directory, though not necessarily the last one returned,
+	// nor through this handle. Entries are to be returned from the one
+	// following it, which need not be the next entry returned earlier if that
+	// entry has since been removed. See DirOffset for the rules offsets must
+	// follow. A reply with an entry whose offset is zero, too large, equal to
+	// this one or to that of another entry in the reply fails with EIO, as it
+	// would send readdir(3) round in circles.
 	Offset DirOffset
 
 	// The destination buffer, whose length gives the size of the read.
@@ -585,6 +715,41 @@ type ReadDirOp struct {
 	OpContext OpContext
 }
 
+// Read entries from a directory previously opened with OpenDir, along with the
+// attributes of the children they name, saving the kernel a LookUpInodeOp for
+// each when e.g. `ls -l` follows. The kernel sends this instead of ReadDirOp
+// only if enabled with MountConfig.EnableReadDirPlus, and then only when it
+// guesses the attributes will be wanted, so file systems enabling it must
+// implement both.
+type ReadDirPlusOp struct {
+	// The directory inode that we are reading, and the handle previously
+	// returned by OpenDir when opening that inode.
+	Inode  InodeID
+	Handle HandleID
+
+	// The offset within the directory at which to read, with the same meaning
+	// as ReadDirOp.Offset. The two ops share the directory's offsets, and the
+	// kernel may switch between them while reading a handle.
+	Offset DirOffset
+
+	// The destination buffer, whose length gives the size of the read.
+	//
+	// The output data should consist of a sequence of fuse_direntplus
+	// entries, each a fuse_entry_out followed by a fuse_dirent, as consumed by
+	// parse_dirplusfile in the kernel's fs/fuse/readdir.c. Use
+	// fuseutil.WriteDirentPlus to generate this data.
+	//
+	// Each entry with a non-zero child inode counts as a lookup of that inode,
+	// exactly as if returned by LookUpInodeOp, except for the entries named "."
+	// and "..". Set the child to zero to return an entry without attributes.
+	Dst []byte
+
+	// Set by the file system: the number of bytes read into Dst. As for
+	// ReadDirOp, zero means that the end of the directory has been reached.
+	BytesRead int
+	OpContext OpContext
+}
+
 // Release a previously-minted directory handle. The kernel sends this when
 // there are no more references to an open directory: all file descriptors are
 // closed and all memory mappings are unmapped.
@@ -647,13 +812,69 @@ type OpenFileOp struct {
 	// Enabling direct IO ensures that all client operations reach the fuse
 	// layer. This allows for filesystems whose file sizes are not known in
 	// advance, for example, because contents are generated on the fly.
+	//
+	// This is ignored when the kernel opens the file to execute it (see
+	// OpenFlags.IsExec). Executables are mapped from the page cache whatever
+	// the handle's mode, and direct IO would only have the kernel drop the
+	// cached pages, including those of running copies of the program, on each
+	// execution. Note that mapped pages beyond the size in the file's
+	// attributes can't be read, so a file executed must report its true size.
 	UseDirectIO bool
 
+	// Mark the handle as not seekable, for files such as pipes or sockets
+	// whose reads and writes don't have offsets, so that lseek(2), pread(2)
+	// and pwrite(2) fail on it. Not supported on OS X.
+	NonSeekable bool
+
+	// Set by the file system, with fuse.MountConfig.EnablePassthrough: a file
+	// whose contents the kernel is to read and write directly instead of
+	// sending ReadFileOp and WriteFileOp for the handle, such as the file of
+	// the underlying layer opened with the same access mode. The kernel still
+	// asks the file system for the attributes of the inode, whose size should
+	// match the backing file's. Ignored when UseDirectIO is set.
+	//
+	// The file must stay open until ReleaseFileHandleOp arrives for the
+	// handle, and handles with backing files must not be reissued before
+	// then.
+	BackingFile *os.File
+
+	// The flags passed to open(2), from which the kernel has removed
+	// OpenCreate, OpenExclusive and usually OpenTruncate.
+	//
+	// OpenFlags.IsDirect reports O_DIRECT, with which databases ask to bypass
+	// the page cache. The kernel honors it by itself, sending each read and
+	// write straight through as if UseDirectIO were set for this handle, so the
+	// file system needs to do nothing for the flag to take effect. The contract
+	// for the resulting reads and writes, which carry the same flags, is:
+	//
+	//  *  Their offsets and sizes are those of the application's requests, split
+	//     at the maximum read or write size. The kernel doesn't check their
+	//     alignment, unlike local file systems, and the file system must accept
+	//     any alignment as for other reads and writes. Well-behaved applications
+	//     align to DirectIOAlignment or to the file's block size.
+	//
+	//  *  With no page cache in between, a write must be visible to reads made
+	//     through any handle once it has returned. It need not be durable until
+	//     SyncFileOp, as O_DIRECT doesn't imply O_SYNC.
+	//
+	// A backend that itself only supports aligned direct IO, e.g. a file opened
+	// with O_DIRECT, can use fuseutil.ReadAtAligned and fuseutil.WriteAtAligned.
+	//
+	// OpenFlags.IsExec reports that the kernel is opening the file for
+	// execve(2). The access mode is then OpenReadOnly although the caller need
+	// only have permission to execute the file, which file systems checking
+	// permissions themselves must allow. Shared libraries are opened by the
+	// dynamic loader like any other file, and mapped with PROT_EXEC.
 	OpenFlags fusekernel.OpenFlags
 
 	OpContext OpContext
 }
 
+// The alignment that applications using O_DIRECT conventionally respect in
+// their offsets, sizes and buffers: the logical block size of most disks.
+// See OpenFileOp.OpenFlags.
+const DirectIOAlignment = 512
+
 // Read data from a file previously opened with CreateFile or OpenFile.
 //
 // Note that this op is not sent for every call to read(2) by the end user;
@@ -675,8 +896,12 @@ type ReadFileOp struct {
 	// For vectored reads, this field is always nil as the buffer is not provided.
 	Dst []byte
 
-	// Set by the file system:
-	// A list of slices of data to send back to the client for vectored reads.
+	// Set by the file system, instead of filling Dst, to a list of slices
+	// holding the data read, e.g. chunks of a backend's cache. They are written
+	// to the kernel with writev(2) rather than being copied into one buffer, so
+	// must not be modified until the op has been replied to. BytesRead must be
+	// set as well, to at most their total length. This works whether or not
+	// MountConfig.UseVectoredRead is set.
 	Data [][]byte
 
 	// Set by the file system: the number of bytes read.
@@ -689,7 +914,35 @@ type ReadFileOp struct {
 	// by a previous call to LookUpInode, GetInodeAttributes, etc.
 	//
 	// If direct IO is enabled, semantics should match those of read(2).
+	//
+	// A value less than Size therefore means the end of the file, unless
+	// Incomplete is set. The connection fails the read with EIO if the value is
+	// negative or greater than Size.
 	BytesRead int
+
+	// Set by the file system, along with a BytesRead less than Size, if the
+	// read stopped short before the end of the file, e.g. because the backend
+	// returns data in chunks. Without direct IO (see OpenFileOp.UseDirectIO and
+	// OpenFileOp.OpenFlags), the kernel would take the short read for the end
+	// of the file, shrinking its idea of the file's size and zero-filling the
+	// rest of the page, so the connection fails the read with EINTR instead,
+	// which callers may retry. With direct IO, the caller's read(2) returns
+	// the short count, which it may read on from.
+	Incomplete bool
+
+	// Set if the read appears to come from the kernel reading ahead of a
+	// sequential reader, rather than from a caller blocked on it, so that file
+	// systems under load can serve it after other reads. The protocol doesn't
+	// say, so this is a guess: a read is taken for readahead if it starts
+	// where the previous read on the same handle ended and the handle doesn't
+	// use direct IO. A reader that outruns readahead therefore has its reads
+	// marked too, while the first read of a sequential run, which the kernel
+	// enlarges to take in the start of its readahead window, is not.
+	Readahead bool
+
+	// The flags with which the handle was opened. See OpenFileOp.OpenFlags for
+	// the contract on direct IO.
+	OpenFlags fusekernel.OpenFlags
 	OpContext OpContext
 }
 
@@ -749,10 +1002,41 @@ type WriteFileOp struct {
 	// be written, except on error (http://goo.gl/KUpwwn). This appears to be
 	// because it uses file mmapping machinery (http://goo.gl/SGxnaN) to write a
 	// page at a time.
-	Data      []byte
+	//
+	// Data isn't copied: it refers to the buffer the kernel's request was read
+	// into, which is reused once the op is replied to. Use fuse.RetainWriteData
+	// to keep it for longer.
+	Data []byte
+
+	// Set by the file system to report a short write, of fewer bytes than
+	// len(Data), in which case the caller's write(2) returns that count. Zero
+	// means that all of Data was written. A write from the page cache (see
+	// FromPageCache) can't be short, as no caller is there to carry on
+	// writing, so the connection fails it with EIO instead, as it does if the
+	// value is negative or greater than len(Data).
+	BytesWritten int
+
+	// Set if the kernel is writing back dirty pages from its page cache under
+	// writeback caching, rather than passing on a caller's write.
+	FromPageCache bool
+
+	// The flags with which the handle was opened. See OpenFileOp.OpenFlags for
+	// the contract on direct IO. Writes back from the page cache may carry no
+	// flags.
+	OpenFlags fusekernel.OpenFlags
 	OpContext OpContext
 }
 
+// Written returns the number of bytes the file system reports having written:
+// BytesWritten for a short write, and len(Data) otherwise.
+func (o *WriteFileOp) Written() int {
+	if o.BytesWritten != 0 {
+		return o.BytesWritten
+	}
+
+	return len(o.Data)
+}
+
 // Synchronize the current contents of an open file to storage.
 //
 // vfs.txt documents this as being called for by the fsync(2) system call
@@ -771,8 +1055,13 @@ type WriteFileOp struct {
 // file (but which is not used in "real" file systems).
 type SyncFileOp struct {
 	// The file and handle being sync'd.
-	Inode     InodeID
-	Handle    HandleID
+	Inode  InodeID
+	Handle HandleID
+
+	// Set for fdatasync(2), in which case only the contents, and the metadata
+	// needed to read them back such as the size, must be made durable: a
+	// modification time alone may be left for later.
+	Datasync  bool
 	OpContext OpContext
 }
 
@@ -826,8 +1115,24 @@ type SyncFileOp struct {
 // return any errors that occur.
 type FlushFileOp struct {
 	// The file and handle being flushed.
-	Inode     InodeID
-	Handle    HandleID
+	Inode  InodeID
+	Handle HandleID
+
+	// The owner, as in SetLkOp.Owner, of the file descriptor being closed. On
+	// close(2) the kernel drops the POSIX locks held by the owner on the file,
+	// so a file system implementing them with MountConfig.EnablePosixLocks
+	// must release that owner's locks here.
+	LockOwner uint64
+	OpContext OpContext
+}
+
+// Synchronize the whole file system to storage, for syncfs(2) or sync(2).
+//
+// This was added in Linux 5.15, but at the time of writing the kernel only
+// sends it to trusted servers such as virtiofs, and not over /dev/fuse, so
+// that mounts relying on it today must sync from FlushFileOp and SyncFileOp
+// as well. Returning ENOSYS stops the kernel from sending it again.
+type SyncFSOp struct {
 	OpContext OpContext
 }
 
@@ -843,10 +1148,36 @@ type ReleaseFileHandleOp struct {
 	// The handle ID to be released. The kernel guarantees that this ID will not
 	// be used in further calls to the file system (unless it is reissued by the
 	// file system).
-	Handle    HandleID
+	Handle HandleID
+
+	// What was done with the handle, if fuse.MountConfig.EnableHandleStats is
+	// set, or nil.
+	Stats *HandleStats
+
 	OpContext OpContext
 }
 
+// What was done with a file handle from its opening to its release. See
+// ReleaseFileHandleOp.Stats.
+type HandleStats struct {
+	// When the file system replied to the op opening the handle, and to the
+	// last op on it.
+	Opened   time.Time
+	LastUsed time.Time
+
+	// The numbers of successful reads and writes, and of the bytes they
+	// carried. Writes back from the page cache are counted for the handle
+	// they name.
+	Reads        int
+	Writes       int
+	BytesRead    int64
+	BytesWritten int64
+
+	// The number of other ops on the handle, e.g. FlushFileOp and
+	// SyncFileOp, successful or not.
+	OtherOps int
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Reading symlinks
 ////////////////////////////////////////////////////////////////////////
@@ -856,7 +1187,8 @@ type ReadSymlinkOp struct {
 	// The symlink inode that we are reading.
 	Inode InodeID
 
-	// Set by the file system: the target of the symlink.
+	// Set by the file system: the target of the symlink, of at most
+	// MaxTargetLength bytes. Longer targets fail with ENAMETOOLONG.
 	Target    string
 	OpContext OpContext
 }
@@ -896,7 +1228,17 @@ type GetXattrOp struct {
 	// Set by the file system: the number of bytes read into Dst, or
 	// the number of bytes that would have been read into Dst if Dst was
 	// big enough (return ERANGE in this case).
+	//
+	// An empty Dst is the kernel probing for the size, to which the file system
+	// should respond with the size alone. A file system may also set the full
+	// size without filling a Dst that is too small, in which case ERANGE is
+	// returned on its behalf. See fuseutil.ReadXattr for a helper.
 	BytesRead int
+
+	// OS X only. The offset within the value at which to start reading, which
+	// is only ever non-zero for the resource fork, com.apple.ResourceFork.
+	Position uint32
+
 	OpContext OpContext
 }
 
@@ -917,6 +1259,11 @@ type ListXattrOp struct {
 	// Set by the file system: the number of bytes read into Dst, or
 	// the number of bytes that would have been read into Dst if Dst was
 	// big enough (return ERANGE in this case).
+	//
+	// An empty Dst is the kernel probing for the size, to which the file system
+	// should respond with the size alone. A file system may also set the full
+	// size without filling a Dst that is too small, in which case ERANGE is
+	// returned on its behalf. See fuseutil.ListXattrNames for a helper.
 	BytesRead int
 	OpContext OpContext
 }
@@ -929,36 +1276,335 @@ type SetXattrOp struct {
 	// The inode whose extended attribute we are setting.
 	Inode InodeID
 
-	// The name of the extended attribute
+	// The name of the extended attribute.
 	Name string
 
-	// The value to for the extened attribute.
+	// The value of the extended attribute.
 	Value []byte
 
 	// If Flags is 0x1, and the attribute exists already, EEXIST should be returned.
 	// If Flags is 0x2, and the attribute does not exist, ENOATTR should be returned.
 	// If Flags is 0x0, the extended attribute will be created if need be, or will
 	// simply replace the value if the attribute exists.
-	Flags     uint32
+	Flags uint32
+
+	// OS X only. The offset within the value at which to write Value, which is
+	// only ever non-zero for the resource fork. See GetXattrOp.Position.
+	Position uint32
+
 	OpContext OpContext
 }
 
+// Preallocate or deallocate space for a range of a file.
+//
+// This is sent in response to fallocate(2), e.g. to punch holes in sparse
+// files. Returning ENOSYS makes the kernel fail later calls with EOPNOTSUPP
+// without sending them.
 type FallocateOp struct {
-	// The inode and handle we are fallocating
+	// The inode and handle we are fallocating.
 	Inode  InodeID
 	Handle HandleID
 
-	// Start of the byte range
+	// Start of the byte range.
 	Offset uint64
 
-	// Length of the byte range
+	// Length of the byte range.
 	Length uint64
 
-	// If Mode is 0x0, allocate disk space within the range specified
-	// If Mode has 0x1, allocate the space but don't increase the file size
-	// If Mode has 0x2, deallocate space within the range specified
-	// If Mode has 0x2, it sbould also have 0x1 (deallocate should not increase
-	// file size)
+	// If Mode is 0x0, allocate disk space within the range specified.
+	// If Mode has 0x1, allocate the space but don't increase the file size.
+	// If Mode has 0x2, deallocate space within the range specified.
+	// If Mode has 0x2, it should also have 0x1 (deallocate should not increase
+	// file size).
+	//
+	// See the Fallocate* constants for these and the other flags defined by
+	// fallocate(2). File systems should return syscall.EOPNOTSUPP for modes
+	// they don't support.
 	Mode      uint32
 	OpContext OpContext
 }
+
+// Flags for FallocateOp.Mode, with the same values as the FALLOC_FL_* flags of
+// fallocate(2).
+const (
+	// Don't change the file size, even if the range extends beyond it.
+	FallocateKeepSize uint32 = 0x01
+
+	// Deallocate the range, which subsequently reads as zeroes. Always
+	// accompanied by FallocateKeepSize.
+	FallocatePunchHole uint32 = 0x02
+
+	// Remove the range from the file, shifting the data after it down and
+	// shrinking the file.
+	FallocateCollapseRange uint32 = 0x08
+
+	// Zero the range, allocating space for it.
+	FallocateZeroRange uint32 = 0x10
+
+	// Insert a hole for the range, shifting the data at and after its start up
+	// and growing the file.
+	FallocateInsertRange uint32 = 0x20
+)
+
+// Find the next data or hole in a file, for lseek(2) with SEEK_DATA or
+// SEEK_HOLE, as used by backup and copy tools to skip the holes of sparse
+// files. The kernel handles the other kinds of seek itself.
+//
+// This is sent on Linux >= 4.5. File systems that don't support holes needn't
+// implement it: the first ENOSYS makes the kernel stop sending it for the
+// mount, and answer as if files had no holes instead. See
+// fuseutil.SeekExtents for a helper answering it from a file's data extents.
+type LseekOp struct {
+	// The file and handle being seeked.
+	Inode  InodeID
+	Handle HandleID
+
+	// The offset to search from, and SeekData or SeekHole.
+	Offset int64
+	Whence int
+
+	// Set by the file system: the offset of the first byte at or after Offset
+	// that is data (for SeekData) or in a hole (for SeekHole). The end of the
+	// file counts as a hole. Return ENXIO if Offset is at or beyond the end of
+	// the file, or if there is no data after it for SeekData.
+	NewOffset int64
+	OpContext OpContext
+}
+
+// Values of LseekOp.Whence, as for lseek(2).
+const (
+	SeekData = 3
+	SeekHole = 4
+)
+
+// An opaque identifier chosen by the kernel for a poll(2) waiting on a file,
+// to be passed to Connection.NotifyPollWakeup.
+type PollHandle uint64
+
+// Report which of the given events are ready on a file, for poll(2),
+// select(2) and epoll(7). Files whose readiness changes, such as those of
+// control or event interfaces, implement this so that pollers block until
+// there is something to read, rather than being told that the file is always
+// ready.
+//
+// File systems that don't implement it get the default behaviour of regular
+// files, which are always ready: the first ENOSYS makes the kernel stop sending
+// it for the mount.
+type PollOp struct {
+	// The file and handle being polled.
+	Inode  InodeID
+	Handle HandleID
+
+	// The events the caller is interested in, as a mask of POLLIN, POLLOUT
+	// and so on (see poll(2)). Kernels older than Linux 3.5 leave this zero.
+	Events uint32
+
+	// Set when the caller will block if none of the events is ready. The file
+	// system must then call Connection.NotifyPollWakeup with Kh once one
+	// becomes ready, or the caller waits until it times out. Kh identifies the
+	// poller for as long as the file is open, and is the same for all polls
+	// through one open file.
+	ScheduleNotify bool
+	Kh             PollHandle
+
+	// Set by the file system to the events that are ready, which may include
+	// events the caller didn't ask for, such as POLLERR and POLLHUP.
+	Revents   uint32
+	OpContext OpContext
+}
+
+////////////////////////////////////////////////////////////////////////
+// Inode flags
+////////////////////////////////////////////////////////////////////////
+
+// Read the flags of an inode.
+//
+// This is sent on Linux in response to the FS_IOC_GETFLAGS ioctl, as made by
+// lsattr(1), on an open file or directory. Other ioctls are sent as IoctlOp.
+type GetInodeFlagsOp struct {
+	// The inode whose flags we are reading, and the handle through which the
+	// ioctl was made: a file handle, or a directory handle if the inode is a
+	// directory.
+	Inode  InodeID
+	Handle HandleID
+
+	// Set by the file system: the inode's flags. These should agree with
+	// InodeAttributes.Flags.
+	Flags     InodeFlags
+	OpContext OpContext
+}
+
+// Set the flags of an inode.
+//
+// This is sent on Linux in response to the FS_IOC_SETFLAGS ioctl, as made by
+// chattr(1). Since Linux 5.13 the kernel checks that the caller owns the inode
+// and may change InodeImmutable and InodeAppendOnly before sending it; file
+// systems that must support older kernels should check this themselves.
+//
+// Once the op succeeds, the connection enforces the new flags, without the
+// file system needing to report them in InodeAttributes. Return EOPNOTSUPP
+// for flags that aren't supported.
+type SetInodeFlagsOp struct {
+	// The inode whose flags we are setting, and the handle through which the
+	// ioctl was made.
+	Inode  InodeID
+	Handle HandleID
+
+	// The new flags, replacing the old ones.
+	Flags     InodeFlags
+	OpContext OpContext
+}
+
+////////////////////////////////////////////////////////////////////////
+// Ioctls
+////////////////////////////////////////////////////////////////////////
+
+// A region of the caller's memory, for an unrestricted IoctlOp to ask for.
+type IoctlIovec struct {
+	Base uint64
+	Len  uint64
+}
+
+// Handle an ioctl(2) on an open file or directory, e.g. to let tools send
+// management commands through a control file. FS_IOC_GETFLAGS and
+// FS_IOC_SETFLAGS are sent as GetInodeFlagsOp and SetInodeFlagsOp instead.
+//
+// This is sent on Linux. On FUSE mounts ioctls are restricted: the kernel
+// copies Input from, and Output to, the caller's memory at Arg according to
+// the direction and size encoded in Cmd by the _IOR, _IOW and _IOWR macros,
+// and the argument of commands encoding no size is passed as is. File systems
+// should fail unknown commands with ENOTTY; ENOSYS is reported to the caller
+// as ENOTTY too.
+//
+// Unrestricted ioctls, which CUSE character devices receive, come with no
+// data the first time. The file system asks for the memory it needs, which
+// it may work out from Arg, by setting RetryIn and RetryOut; the kernel then
+// sends the op again with Input holding the contents of RetryIn, and OutSize
+// the total length of RetryOut, which Output fills in order.
+type IoctlOp struct {
+	// The inode and the handle through which the ioctl was made: a file
+	// handle, or a directory handle if Dir is set.
+	Inode  InodeID
+	Handle HandleID
+	Dir    bool
+
+	// The command and its argument, as passed to ioctl(2).
+	Cmd uint32
+	Arg uint64
+
+	// The data the caller passed in, valid until the op is replied to, and the
+	// most it can receive back.
+	Input   []byte
+	OutSize int
+
+	// Whether the ioctl is unrestricted, and whether it was made by a 32-bit
+	// process on a 64-bit kernel, whose pointers and structures the file
+	// system must then decode accordingly.
+	Unrestricted bool
+	Compat       bool
+
+	// Set by the file system: the value for ioctl(2) to return, and the data
+	// to copy back to the caller. Output beyond OutSize is dropped.
+	Result int32
+	Output []byte
+
+	// Set by the file system handling an unrestricted ioctl to have the
+	// kernel retry it with the given memory, rather than reply. At most
+	// 256 iovecs of each kind are allowed.
+	RetryIn  []IoctlIovec
+	RetryOut []IoctlIovec
+
+	OpContext OpContext
+}
+
+////////////////////////////////////////////////////////////////////////
+// File locks
+////////////////////////////////////////////////////////////////////////
+
+// The type of a file lock, with the values of the F_*LCK constants of
+// fcntl(2).
+type LockType uint32
+
+const (
+	LockRead   LockType = syscall.F_RDLCK
+	LockWrite  LockType = syscall.F_WRLCK
+	LockUnlock LockType = syscall.F_UNLCK
+)
+
+// A lock on a range of a file, as described by struct flock of fcntl(2).
+type FileLock struct {
+	// The first and last bytes of the range, inclusive. An End of
+	// math.MaxInt64 extends the range to the end of the file, however large it
+	// grows.
+	Start uint64
+	End   uint64
+
+	Type LockType
+
+	// The process holding the lock, if any. The kernel reports it to callers
+	// of F_GETLK; it means nothing to the file system otherwise.
+	PID uint32
+}
+
+// Test for a POSIX record lock conflicting with the one described.
+//
+// This is sent on Linux for fcntl(2) with F_GETLK or F_OFD_GETLK, once the
+// file system has enabled POSIX locks with MountConfig.EnablePosixLocks.
+// Otherwise the kernel handles locks itself, so that they are only seen by
+// processes on the same machine.
+type GetLkOp struct {
+	// The inode and handle through which the lock is tested.
+	Inode  InodeID
+	Handle HandleID
+
+	// An opaque identifier of the owner of the lock: the process's open file
+	// table for traditional POSIX locks, or the open file description for
+	// open file description locks. Locks held by the same owner never conflict.
+	Owner uint64
+
+	// The lock the caller would take.
+	Lock FileLock
+
+	// Set by the file system to a lock conflicting with Lock, if there is one.
+	// It is initialized with Type set to LockUnlock, which tells the caller
+	// that it may take its lock.
+	Conflict  FileLock
+	OpContext OpContext
+}
+
+// Take or release a POSIX record lock, or a flock(2) lock.
+//
+// This is sent on Linux for fcntl(2) with F_SETLK, F_SETLKW, F_OFD_SETLK and
+// F_OFD_SETLKW, once the file system has enabled POSIX locks with
+// MountConfig.EnablePosixLocks, and for flock(2) once it has enabled flock
+// locks with MountConfig.EnableFlockLocks. Locks are released with a Lock
+// whose Type is LockUnlock: the kernel does so when the owner closes the file
+// or exits, before sending ReleaseFileHandleOp.
+//
+// If the lock conflicts with one held by another owner, the file system
+// should return EAGAIN unless Wait is set, in which case it should wait for
+// the conflicting lock to be released, returning EINTR if the context is
+// cancelled first. It may return EDEADLK if waiting would deadlock.
+type SetLkOp struct {
+	// The inode and handle through which the lock is taken.
+	Inode  InodeID
+	Handle HandleID
+
+	// The owner of the lock, as for GetLkOp. For flock(2) locks, this is the
+	// open file description, and Lock covers the whole file.
+	Owner uint64
+
+	// The lock to take, or the range to unlock. Taking a lock over a range
+	// partly covered by one of the owner's locks replaces the latter's type
+	// over the overlap, splitting or merging it as needed.
+	Lock FileLock
+
+	// Whether to wait for conflicting locks to be released (F_SETLKW, or
+	// flock(2) without LOCK_NB).
+	Wait bool
+
+	// Whether this is a flock(2) lock rather than a POSIX record lock. The two
+	// kinds don't interact.
+	Flock     bool
+	OpContext OpContext
+}
@@ -0,0 +1,523 @@
+// Code generated by gen_optable.go; DO NOT EDIT.
+
+package fuseops
+
+// The op types of this package, in the order of their definitions.
+var Ops = []OpInfo{
+	{
+		Name:    "StatFSOp",
+		New:     func() interface{} { return &StatFSOp{} },
+		Summary: "Return statistics about the file system's capacity and available resources.",
+		Fields: []FieldInfo{
+			{Name: "BlockSize", Type: "uint32", Response: true},
+			{Name: "Blocks", Type: "uint64", Response: true},
+			{Name: "BlocksFree", Type: "uint64", Response: true},
+			{Name: "BlocksAvailable", Type: "uint64", Response: true},
+			{Name: "IoSize", Type: "uint32", Response: true},
+			{Name: "Inodes", Type: "uint64", Response: true},
+			{Name: "InodesFree", Type: "uint64", Response: true},
+		},
+	},
+	{
+		Name:    "LookUpInodeOp",
+		New:     func() interface{} { return &LookUpInodeOp{} },
+		Summary: "Look up a child by name within a parent directory.",
+		Fields: []FieldInfo{
+			{Name: "Parent", Type: "InodeID", Response: false},
+			{Name: "Name", Type: "string", Response: false},
+			{Name: "Entry", Type: "ChildInodeEntry", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "GetInodeAttributesOp",
+		New:     func() interface{} { return &GetInodeAttributesOp{} },
+		Summary: "Refresh the attributes for an inode whose ID was previously returned in a LookUpInodeOp.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Attributes", Type: "InodeAttributes", Response: true},
+			{Name: "AttributesExpiration", Type: "time.Time", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "SetInodeAttributesOp",
+		New:     func() interface{} { return &SetInodeAttributesOp{} },
+		Summary: "Change attributes for an inode.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "*HandleID", Response: false},
+			{Name: "Uid", Type: "*uint32", Response: false},
+			{Name: "Gid", Type: "*uint32", Response: false},
+			{Name: "Size", Type: "*uint64", Response: false},
+			{Name: "Mode", Type: "*os.FileMode", Response: false},
+			{Name: "Atime", Type: "*time.Time", Response: false},
+			{Name: "Mtime", Type: "*time.Time", Response: false},
+			{Name: "AtimeNow", Type: "bool", Response: false},
+			{Name: "MtimeNow", Type: "bool", Response: false},
+			{Name: "Ctime", Type: "*time.Time", Response: false},
+			{Name: "Crtime", Type: "*time.Time", Response: false},
+			{Name: "Bkuptime", Type: "*time.Time", Response: false},
+			{Name: "Attributes", Type: "InodeAttributes", Response: true},
+			{Name: "AttributesExpiration", Type: "time.Time", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "AccessOp",
+		New:     func() interface{} { return &AccessOp{} },
+		Summary: "Check whether the caller may access an inode, for access(2) and chdir(2).",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Mask", Type: "uint32", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"ENOSYS", "EACCES"},
+	},
+	{
+		Name:    "ForgetInodeOp",
+		New:     func() interface{} { return &ForgetInodeOp{} },
+		Summary: "Decrement the reference count for an inode ID previously issued by the file system.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "N", Type: "uint64", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "BatchForgetOp",
+		New:     func() interface{} { return &BatchForgetOp{} },
+		Summary: "Decrement the reference counts for a list of inode IDs previously issued by the file system.",
+		Fields: []FieldInfo{
+			{Name: "Entries", Type: "[]BatchForgetEntry", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "MkDirOp",
+		New:     func() interface{} { return &MkDirOp{} },
+		Summary: "Create a directory inode as a child of an existing directory inode.",
+		Fields: []FieldInfo{
+			{Name: "Parent", Type: "InodeID", Response: false},
+			{Name: "Name", Type: "string", Response: false},
+			{Name: "Mode", Type: "os.FileMode", Response: false},
+			{Name: "SecurityContext", Type: "[]SecurityContext", Response: false},
+			{Name: "Entry", Type: "ChildInodeEntry", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"EEXIST"},
+	},
+	{
+		Name:    "MkNodeOp",
+		New:     func() interface{} { return &MkNodeOp{} },
+		Summary: "Create a file inode as a child of an existing directory inode.",
+		Fields: []FieldInfo{
+			{Name: "Parent", Type: "InodeID", Response: false},
+			{Name: "Name", Type: "string", Response: false},
+			{Name: "Mode", Type: "os.FileMode", Response: false},
+			{Name: "Rdev", Type: "uint32", Response: false},
+			{Name: "SecurityContext", Type: "[]SecurityContext", Response: false},
+			{Name: "Entry", Type: "ChildInodeEntry", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"EEXIST"},
+	},
+	{
+		Name:    "CreateFileOp",
+		New:     func() interface{} { return &CreateFileOp{} },
+		Summary: "Create a file inode and open it.",
+		Fields: []FieldInfo{
+			{Name: "Parent", Type: "InodeID", Response: false},
+			{Name: "Name", Type: "string", Response: false},
+			{Name: "Mode", Type: "os.FileMode", Response: false},
+			{Name: "SecurityContext", Type: "[]SecurityContext", Response: false},
+			{Name: "Entry", Type: "ChildInodeEntry", Response: true},
+			{Name: "Handle", Type: "HandleID", Response: true},
+			{Name: "KeepPageCache", Type: "bool", Response: true},
+			{Name: "UseDirectIO", Type: "bool", Response: true},
+			{Name: "NonSeekable", Type: "bool", Response: true},
+			{Name: "BackingFile", Type: "*os.File", Response: true},
+			{Name: "OpenFlags", Type: "fusekernel.OpenFlags", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"EEXIST"},
+	},
+	{
+		Name:    "CreateSymlinkOp",
+		New:     func() interface{} { return &CreateSymlinkOp{} },
+		Summary: "Create a symlink inode.",
+		Fields: []FieldInfo{
+			{Name: "Parent", Type: "InodeID", Response: false},
+			{Name: "Name", Type: "string", Response: false},
+			{Name: "Target", Type: "string", Response: false},
+			{Name: "SecurityContext", Type: "[]SecurityContext", Response: false},
+			{Name: "Entry", Type: "ChildInodeEntry", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"EEXIST"},
+	},
+	{
+		Name:    "CreateLinkOp",
+		New:     func() interface{} { return &CreateLinkOp{} },
+		Summary: "Create a hard link to an inode.",
+		Fields: []FieldInfo{
+			{Name: "Parent", Type: "InodeID", Response: false},
+			{Name: "Name", Type: "string", Response: false},
+			{Name: "Target", Type: "InodeID", Response: false},
+			{Name: "Entry", Type: "ChildInodeEntry", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"EEXIST"},
+	},
+	{
+		Name:    "RenameOp",
+		New:     func() interface{} { return &RenameOp{} },
+		Summary: "Rename a file or directory, given the IDs of the original parent directory and the new one (which may be the same).",
+		Fields: []FieldInfo{
+			{Name: "OldParent", Type: "InodeID", Response: false},
+			{Name: "OldName", Type: "string", Response: false},
+			{Name: "NewParent", Type: "InodeID", Response: false},
+			{Name: "NewName", Type: "string", Response: false},
+			{Name: "Flags", Type: "RenameFlags", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"ENOTEMPTY", "EINVAL"},
+	},
+	{
+		Name:    "RmDirOp",
+		New:     func() interface{} { return &RmDirOp{} },
+		Summary: "Unlink a directory from its parent.",
+		Fields: []FieldInfo{
+			{Name: "Parent", Type: "InodeID", Response: false},
+			{Name: "Name", Type: "string", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "UnlinkOp",
+		New:     func() interface{} { return &UnlinkOp{} },
+		Summary: "Unlink a file or symlink from its parent.",
+		Fields: []FieldInfo{
+			{Name: "Parent", Type: "InodeID", Response: false},
+			{Name: "Name", Type: "string", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "OpenDirOp",
+		New:     func() interface{} { return &OpenDirOp{} },
+		Summary: "Open a directory inode.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: true},
+			{Name: "CacheDir", Type: "bool", Response: true},
+			{Name: "KeepCache", Type: "bool", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "ReadDirOp",
+		New:     func() interface{} { return &ReadDirOp{} },
+		Summary: "Read entries from a directory previously opened with OpenDir.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "Offset", Type: "DirOffset", Response: false},
+			{Name: "Dst", Type: "[]byte", Response: false},
+			{Name: "BytesRead", Type: "int", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"EIO"},
+	},
+	{
+		Name:    "ReadDirPlusOp",
+		New:     func() interface{} { return &ReadDirPlusOp{} },
+		Summary: "Read entries from a directory previously opened with OpenDir, along with the attributes of the children they name, saving the kernel a LookUpInodeOp for each when e.g. `ls -l` follows.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "Offset", Type: "DirOffset", Response: false},
+			{Name: "Dst", Type: "[]byte", Response: false},
+			{Name: "BytesRead", Type: "int", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "ReleaseDirHandleOp",
+		New:     func() interface{} { return &ReleaseDirHandleOp{} },
+		Summary: "Release a previously-minted directory handle.",
+		Fields: []FieldInfo{
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "OpenFileOp",
+		New:     func() interface{} { return &OpenFileOp{} },
+		Summary: "Open a file inode.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: true},
+			{Name: "KeepPageCache", Type: "bool", Response: true},
+			{Name: "UseDirectIO", Type: "bool", Response: true},
+			{Name: "NonSeekable", Type: "bool", Response: true},
+			{Name: "BackingFile", Type: "*os.File", Response: true},
+			{Name: "OpenFlags", Type: "fusekernel.OpenFlags", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "ReadFileOp",
+		New:     func() interface{} { return &ReadFileOp{} },
+		Summary: "Read data from a file previously opened with CreateFile or OpenFile.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "Offset", Type: "int64", Response: false},
+			{Name: "Size", Type: "int64", Response: false},
+			{Name: "Dst", Type: "[]byte", Response: false},
+			{Name: "Data", Type: "[][]byte", Response: true},
+			{Name: "BytesRead", Type: "int", Response: true},
+			{Name: "Incomplete", Type: "bool", Response: true},
+			{Name: "Readahead", Type: "bool", Response: false},
+			{Name: "OpenFlags", Type: "fusekernel.OpenFlags", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"EIO", "EINTR"},
+	},
+	{
+		Name:    "WriteFileOp",
+		New:     func() interface{} { return &WriteFileOp{} },
+		Summary: "Write data to a file previously opened with CreateFile or OpenFile.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "Offset", Type: "int64", Response: false},
+			{Name: "Data", Type: "[]byte", Response: false},
+			{Name: "BytesWritten", Type: "int", Response: true},
+			{Name: "FromPageCache", Type: "bool", Response: false},
+			{Name: "OpenFlags", Type: "fusekernel.OpenFlags", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"EIO"},
+	},
+	{
+		Name:    "SyncFileOp",
+		New:     func() interface{} { return &SyncFileOp{} },
+		Summary: "Synchronize the current contents of an open file to storage.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "Datasync", Type: "bool", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "FlushFileOp",
+		New:     func() interface{} { return &FlushFileOp{} },
+		Summary: "Flush the current state of an open file to storage upon closing a file descriptor.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "LockOwner", Type: "uint64", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "SyncFSOp",
+		New:     func() interface{} { return &SyncFSOp{} },
+		Summary: "Synchronize the whole file system to storage, for syncfs(2) or sync(2).",
+		Fields: []FieldInfo{
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"ENOSYS"},
+	},
+	{
+		Name:    "ReleaseFileHandleOp",
+		New:     func() interface{} { return &ReleaseFileHandleOp{} },
+		Summary: "Release a previously-minted file handle.",
+		Fields: []FieldInfo{
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "Stats", Type: "*HandleStats", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "ReadSymlinkOp",
+		New:     func() interface{} { return &ReadSymlinkOp{} },
+		Summary: "Read the target of a symlink inode.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Target", Type: "string", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"ENAMETOOLONG"},
+	},
+	{
+		Name:    "RemoveXattrOp",
+		New:     func() interface{} { return &RemoveXattrOp{} },
+		Summary: "Remove an extended attribute.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Name", Type: "string", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"ENOATTR"},
+	},
+	{
+		Name:    "GetXattrOp",
+		New:     func() interface{} { return &GetXattrOp{} },
+		Summary: "Get an extended attribute.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Name", Type: "string", Response: false},
+			{Name: "Dst", Type: "[]byte", Response: false},
+			{Name: "BytesRead", Type: "int", Response: true},
+			{Name: "Position", Type: "uint32", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"ENOATTR", "ERANGE"},
+	},
+	{
+		Name:    "ListXattrOp",
+		New:     func() interface{} { return &ListXattrOp{} },
+		Summary: "List all the extended attributes for a file.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Dst", Type: "[]byte", Response: false},
+			{Name: "BytesRead", Type: "int", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"ERANGE"},
+	},
+	{
+		Name:    "SetXattrOp",
+		New:     func() interface{} { return &SetXattrOp{} },
+		Summary: "Set an extended attribute.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Name", Type: "string", Response: false},
+			{Name: "Value", Type: "[]byte", Response: false},
+			{Name: "Flags", Type: "uint32", Response: false},
+			{Name: "Position", Type: "uint32", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"ENOSPC", "EEXIST", "ENOATTR"},
+	},
+	{
+		Name:    "FallocateOp",
+		New:     func() interface{} { return &FallocateOp{} },
+		Summary: "Preallocate or deallocate space for a range of a file.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "Offset", Type: "uint64", Response: false},
+			{Name: "Length", Type: "uint64", Response: false},
+			{Name: "Mode", Type: "uint32", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"ENOSYS", "EOPNOTSUPP"},
+	},
+	{
+		Name:    "LseekOp",
+		New:     func() interface{} { return &LseekOp{} },
+		Summary: "Find the next data or hole in a file, for lseek(2) with SEEK_DATA or SEEK_HOLE, as used by backup and copy tools to skip the holes of sparse files.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "Offset", Type: "int64", Response: false},
+			{Name: "Whence", Type: "int", Response: false},
+			{Name: "NewOffset", Type: "int64", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"ENOSYS", "ENXIO"},
+	},
+	{
+		Name:    "PollOp",
+		New:     func() interface{} { return &PollOp{} },
+		Summary: "Report which of the given events are ready on a file, for poll(2), select(2) and epoll(7).",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "Events", Type: "uint32", Response: false},
+			{Name: "ScheduleNotify", Type: "bool", Response: false},
+			{Name: "Kh", Type: "PollHandle", Response: false},
+			{Name: "Revents", Type: "uint32", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"ENOSYS"},
+	},
+	{
+		Name:    "GetInodeFlagsOp",
+		New:     func() interface{} { return &GetInodeFlagsOp{} },
+		Summary: "Read the flags of an inode.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "Flags", Type: "InodeFlags", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "SetInodeFlagsOp",
+		New:     func() interface{} { return &SetInodeFlagsOp{} },
+		Summary: "Set the flags of an inode.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "Flags", Type: "InodeFlags", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"EOPNOTSUPP"},
+	},
+	{
+		Name:    "IoctlOp",
+		New:     func() interface{} { return &IoctlOp{} },
+		Summary: "Handle an ioctl(2) on an open file or directory, e.g. to let tools send management commands through a control file.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "Dir", Type: "bool", Response: false},
+			{Name: "Cmd", Type: "uint32", Response: false},
+			{Name: "Arg", Type: "uint64", Response: false},
+			{Name: "Input", Type: "[]byte", Response: false},
+			{Name: "OutSize", Type: "int", Response: false},
+			{Name: "Unrestricted", Type: "bool", Response: false},
+			{Name: "Compat", Type: "bool", Response: false},
+			{Name: "Result", Type: "int32", Response: true},
+			{Name: "Output", Type: "[]byte", Response: true},
+			{Name: "RetryIn", Type: "[]IoctlIovec", Response: true},
+			{Name: "RetryOut", Type: "[]IoctlIovec", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"ENOTTY", "ENOSYS"},
+	},
+	{
+		Name:    "GetLkOp",
+		New:     func() interface{} { return &GetLkOp{} },
+		Summary: "Test for a POSIX record lock conflicting with the one described.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "Owner", Type: "uint64", Response: false},
+			{Name: "Lock", Type: "FileLock", Response: false},
+			{Name: "Conflict", Type: "FileLock", Response: true},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+	},
+	{
+		Name:    "SetLkOp",
+		New:     func() interface{} { return &SetLkOp{} },
+		Summary: "Take or release a POSIX record lock, or a flock(2) lock.",
+		Fields: []FieldInfo{
+			{Name: "Inode", Type: "InodeID", Response: false},
+			{Name: "Handle", Type: "HandleID", Response: false},
+			{Name: "Owner", Type: "uint64", Response: false},
+			{Name: "Lock", Type: "FileLock", Response: false},
+			{Name: "Wait", Type: "bool", Response: false},
+			{Name: "Flock", Type: "bool", Response: false},
+			{Name: "OpContext", Type: "OpContext", Response: false},
+		},
+		Errors: []string{"EAGAIN", "EINTR", "EDEADLK"},
+	},
+}
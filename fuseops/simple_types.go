@@ -17,6 +17,7 @@ package fuseops
 import (
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/folays/jacobsa_fuse/internal/fusekernel"
@@ -96,6 +97,48 @@ type InodeAttributes struct {
 	// Ownership information
 	Uid uint32
 	Gid uint32
+
+	// For a character or block device (see Mode), the device it stands for, as
+	// encoded by Mkdev. Opening the inode opens that device, entirely within the
+	// kernel: no OpenFileOp or ReadFileOp reaches the file system. This requires
+	// the file system to be mounted with the "dev" option (see
+	// MountConfig.Options), which only root may use.
+	Rdev uint32
+
+	// The inode number shown as st_ino by stat(2). If zero, the inode's ID is
+	// shown, which is unique among the inodes the kernel knows about but only
+	// stable for as long as the file system keeps using the same ID for the
+	// same file. Tools such as tar, rsync and find detect hard links and loops
+	// by inode number, and expect it to stay the same across lookups and
+	// remounts; file systems that can't give such guarantees with their IDs
+	// can present a backend's native numbers here instead. See
+	// fuseutil.HashInodeNumber and fuseutil.InodeNumberTable for backends whose
+	// identifiers don't fit in 64 bits.
+	//
+	// The kernel shows the inode number of directory entries as given in
+	// fuseutil.Dirent.Inode, which should then be the same number.
+	Ino uint64
+
+	// Flags as shown by lsattr(1). The kernel doesn't know about these, so on
+	// Linux the connection enforces InodeImmutable and InodeAppendOnly itself
+	// for the inodes whose attributes it has seen with them set.
+	Flags InodeFlags
+}
+
+// Encode a device's major and minor numbers the way the kernel expects in
+// InodeAttributes.Rdev and MkNodeOp.Rdev.
+func Mkdev(major, minor uint32) uint32 {
+	return minor&0xff | (major&0xfff)<<8 | (minor&^0xff)<<12
+}
+
+// Return the major number of a device encoded by Mkdev.
+func Major(dev uint32) uint32 {
+	return (dev & 0xfff00) >> 8
+}
+
+// Return the minor number of a device encoded by Mkdev.
+func Minor(dev uint32) uint32 {
+	return dev&0xff | (dev>>12)&0xfff00
 }
 
 func (a *InodeAttributes) DebugString() string {
@@ -108,6 +151,49 @@ func (a *InodeAttributes) DebugString() string {
 		a.Gid)
 }
 
+// InodeFlags are the flags read and set by lsattr(1) and chattr(1), with the
+// values of the FS_*_FL constants of <linux/fs.h>. See GetInodeFlagsOp.
+type InodeFlags uint32
+
+const (
+	// The inode may not be modified in any way: its contents, attributes and
+	// extended attributes are frozen, and if it is a directory, no entries may
+	// be added to or removed from it. (chattr +i)
+	InodeImmutable InodeFlags = 0x10
+
+	// The file may only be opened for writing in append mode, and may not be
+	// truncated; its attributes and extended attributes are frozen, and if it
+	// is a directory, entries may be added to it but not removed. (chattr +a)
+	InodeAppendOnly InodeFlags = 0x20
+)
+
+func (f InodeFlags) String() string {
+	var parts []string
+	if f&InodeImmutable != 0 {
+		parts = append(parts, "InodeImmutable")
+	}
+
+	if f&InodeAppendOnly != 0 {
+		parts = append(parts, "InodeAppendOnly")
+	}
+
+	if rest := f &^ (InodeImmutable | InodeAppendOnly); rest != 0 || f == 0 {
+		parts = append(parts, fmt.Sprintf("%#x", uint32(rest)))
+	}
+
+	return strings.Join(parts, "+")
+}
+
+// A security label for a new inode, as computed by the kernel's security
+// module for the process creating it, and passed on once the file system has
+// enabled MountConfig.EnableSecurityContext. The file system should store it
+// as the extended attribute with the given name, e.g. "security.selinux",
+// together with the inode.
+type SecurityContext struct {
+	Name  string
+	Value []byte
+}
+
 // GenerationNumber represents a generation of an inode. It is irrelevant for
 // file systems that won't be exported over NFS. For those that will and that
 // reuse inode IDs when they become free, the generation number must change
@@ -131,11 +217,23 @@ type GenerationNumber uint64
 // This corresponds to fuse_file_info::fh.
 type HandleID uint64
 
-// DirOffset is an offset into an open directory handle. This is opaque to
-// FUSE, and can be used for whatever purpose the file system desires. See
-// notes on ReadDirOp.Offset for details.
+// DirOffset is an offset into an open directory handle: an opaque cookie
+// chosen by the file system for the position following each entry, which the
+// kernel hands back in ReadDirOp.Offset to resume a listing there. Zero is the
+// start of the directory. See notes on ReadDirOp.Offset for details.
+//
+// Cookies must be non-zero, at most MaxDirOffset, and distinct from those of
+// the other entries in the directory. Reading from a cookie must resume after
+// the entry it was returned with for as long as the handle is open, even if
+// entries have been added or removed since, as seekdir(3) users and NFS
+// clients of a re-exported mount rely on. fuseutil.DirentIndex and
+// fuseutil.HashDirents generate such cookies.
 type DirOffset uint64
 
+// The largest directory offset, file positions being signed in the kernel,
+// which fails seekdir(3) to larger ones.
+const MaxDirOffset DirOffset = 1<<63 - 1
+
 // ChildInodeEntry contains information about a child inode within its parent
 // directory. It is shared by LookUpInodeOp, MkDirOp, CreateFileOp, etc, and is
 // consumed by the kernel in order to set up a dcache entry.
@@ -189,7 +287,8 @@ type ChildInodeEntry struct {
 	//
 	// This field controls when the attributes returned in this response and
 	// stashed in the struct inode should be re-queried. Leave at the zero value
-	// to disable caching.
+	// to disable caching, or to use MountConfig.AttributesTimeout if set; set
+	// it to NoCache to disable caching regardless.
 	//
 	// More reading:
 	//     http://stackoverflow.com/q/21540315/1505451
@@ -213,9 +312,25 @@ type ChildInodeEntry struct {
 	//     inode if fuse_dentry_time(entry) hasn't passed. Otherwise it sends a
 	//     lookup request.
 	//
-	// Leave at the zero value to disable caching.
+	// Leave at the zero value to disable caching, or to use
+	// MountConfig.EntryTimeout if set; set it to NoCache to disable caching
+	// regardless.
 	//
 	// Beware: this value is ignored on OS X, where entry caching is disabled by
 	// default. See notes on MountConfig.EnableVnodeCaching for more.
 	EntryExpiration time.Time
 }
+
+// An expiration time long past, which disables the kernel's caching of an
+// entry or attributes even where the MountConfig supplies a default for
+// expirations left at the zero value.
+var NoCache = time.Unix(0, 0)
+
+// The longest name of a directory entry, and the longest symlink target, in
+// bytes, as for NAME_MAX and PATH_MAX on Linux (less the terminating NUL).
+// Ops carrying longer ones fail with ENAMETOOLONG without reaching the file
+// system, and so does a ReadSymlinkOp replying with a longer target.
+const (
+	MaxNameLength   = 255
+	MaxTargetLength = 4095
+)
@@ -0,0 +1,656 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusepath
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// Create a fuseutil.FileSystem serving the supplied path-based file system.
+func NewFileSystem(fs FileSystem) fuseutil.FileSystem {
+	return &fileSystem{
+		fs: fs,
+		inodes: map[fuseops.InodeID]*inode{
+			fuseops.RootInodeID: {path: "/"},
+		},
+		byPath:     map[string]fuseops.InodeID{"/": fuseops.RootInodeID},
+		nextInode:  fuseops.RootInodeID + 1,
+		files:      make(map[fuseops.HandleID]File),
+		dirs:       make(map[fuseops.HandleID][]DirEntry),
+		nextHandle: 1,
+	}
+}
+
+// An inode the kernel knows of.
+type inode struct {
+	// The inode's current path, or empty once it has been removed.
+	path string
+
+	// The number of lookups the kernel holds on the inode. The root is never
+	// forgotten, and isn't counted.
+	lookups uint64
+}
+
+type fileSystem struct {
+	fuseutil.NotImplementedFileSystem
+	fs FileSystem
+
+	mu sync.Mutex
+
+	// The inodes the kernel knows of, and the inode at each of their paths.
+	//
+	// INVARIANT: byPath[inodes[id].path] == id for each inode not removed
+	// INVARIANT: For each path p in byPath, inodes[byPath[p]].path == p
+	//
+	// GUARDED_BY(mu)
+	inodes    map[fuseops.InodeID]*inode
+	byPath    map[string]fuseops.InodeID
+	nextInode fuseops.InodeID
+
+	// The open files, and the listing of the open directories.
+	//
+	// GUARDED_BY(mu)
+	files      map[fuseops.HandleID]File
+	dirs       map[fuseops.HandleID][]DirEntry
+	nextHandle fuseops.HandleID
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Translate an error returned by the path-based file system into one for the
+// kernel.
+func errno(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var e syscall.Errno
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, os.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, os.ErrExist):
+		return syscall.EEXIST
+	case errors.Is(err, os.ErrPermission):
+		return syscall.EACCES
+	case errors.Is(err, os.ErrInvalid):
+		return syscall.EINVAL
+	}
+
+	return err
+}
+
+// Return the current path of an inode, or ENOENT if it has been removed.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) pathOf(id fuseops.InodeID) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.inodes[id]
+	if in == nil || in.path == "" {
+		return "", syscall.ENOENT
+	}
+
+	return in.path, nil
+}
+
+// Return the path of the child with the supplied name of a directory inode.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) childPath(
+	parent fuseops.InodeID,
+	name string) (string, error) {
+	dir, err := fs.pathOf(parent)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(dir, name), nil
+}
+
+// Fill in an entry for the file or directory at p, counting a lookup of its
+// inode.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) lookUp(
+	ctx context.Context,
+	p string,
+	e *fuseops.ChildInodeEntry) error {
+	attrs, err := fs.fs.GetAttr(ctx, p)
+	if err != nil {
+		return errno(err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id, ok := fs.byPath[p]
+	if !ok {
+		id = fs.nextInode
+		fs.nextInode++
+		fs.inodes[id] = &inode{path: p}
+		fs.byPath[p] = id
+	}
+
+	if id != fuseops.RootInodeID {
+		fs.inodes[id].lookups++
+	}
+
+	e.Child = id
+	e.Attributes = attrs
+	return nil
+}
+
+// Drop n of the lookups held on an inode.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) forget(id fuseops.InodeID, n uint64) {
+	in := fs.inodes[id]
+	if in == nil || id == fuseops.RootInodeID {
+		return
+	}
+
+	if n < in.lookups {
+		in.lookups -= n
+		return
+	}
+
+	delete(fs.inodes, id)
+	if in.path != "" {
+		delete(fs.byPath, in.path)
+	}
+}
+
+// Note that the file or directory at p is gone, if the kernel knows of it.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) removed(p string) {
+	if id, ok := fs.byPath[p]; ok {
+		fs.inodes[id].path = ""
+		delete(fs.byPath, p)
+	}
+}
+
+// Note that what was at oldPath, and beneath it, is now at newPath.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) moved(oldPath string, newPath string) {
+	fs.removed(newPath)
+
+	var ids []fuseops.InodeID
+	for p, id := range fs.byPath {
+		if p == oldPath || strings.HasPrefix(p, oldPath+"/") {
+			ids = append(ids, id)
+			delete(fs.byPath, p)
+		}
+	}
+
+	for _, id := range ids {
+		in := fs.inodes[id]
+		in.path = newPath + strings.TrimPrefix(in.path, oldPath)
+		fs.byPath[in.path] = id
+	}
+}
+
+// Choose the inode number reported for a directory entry: that of its inode
+// if the kernel knows of it, or else one derived from its path, which the
+// kernel doesn't use but readdir(3) callers may.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) direntInode(p string) fuseops.InodeID {
+	if id, ok := fs.byPath[p]; ok {
+		return id
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(p))
+	return fuseops.InodeID(h.Sum64() | 1<<63)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) newFileHandle(f File) fuseops.HandleID {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	h := fs.nextHandle
+	fs.nextHandle++
+	fs.files[h] = f
+	return h
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) file(h fuseops.HandleID) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, ok := fs.files[h]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	return f, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Inodes
+////////////////////////////////////////////////////////////////////////
+
+func (fs *fileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	return fs.lookUp(ctx, p, &op.Entry)
+}
+
+func (fs *fileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes, err = fs.fs.GetAttr(ctx, p)
+	return errno(err)
+}
+
+func (fs *fileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	change := AttrChange{
+		Size:  op.Size,
+		Mode:  op.Mode,
+		Uid:   op.Uid,
+		Gid:   op.Gid,
+		Atime: op.Atime,
+		Mtime: op.Mtime,
+	}
+
+	if change != (AttrChange{}) {
+		if err := fs.fs.SetAttr(ctx, p, change); err != nil {
+			return errno(err)
+		}
+	}
+
+	op.Attributes, err = fs.fs.GetAttr(ctx, p)
+	return errno(err)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.forget(op.Inode, op.N)
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, e := range op.Entries {
+		fs.forget(e.Inode, e.N)
+	}
+
+	return nil
+}
+
+func (fs *fileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Target, err = fs.fs.ReadLink(ctx, p)
+	return errno(err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Namespace
+////////////////////////////////////////////////////////////////////////
+
+func (fs *fileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.fs.Mkdir(ctx, p, op.Mode); err != nil {
+		return errno(err)
+	}
+
+	return fs.lookUp(ctx, p, &op.Entry)
+}
+
+func (fs *fileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	f, err := fs.fs.Create(ctx, p, int(op.OpenFlags), op.Mode)
+	if err != nil {
+		return errno(err)
+	}
+
+	if err := fs.lookUp(ctx, p, &op.Entry); err != nil {
+		if c, ok := f.(io.Closer); ok {
+			c.Close()
+		}
+
+		return err
+	}
+
+	op.Handle = fs.newFileHandle(f)
+	return nil
+}
+
+func (fs *fileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.fs.Symlink(ctx, op.Target, p); err != nil {
+		return errno(err)
+	}
+
+	return fs.lookUp(ctx, p, &op.Entry)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	// FileSystem.Rename has no flags.
+	if op.Flags != 0 {
+		return syscall.EINVAL
+	}
+
+	oldPath, err := fs.childPath(op.OldParent, op.OldName)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := fs.childPath(op.NewParent, op.NewName)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.fs.Rename(ctx, oldPath, newPath); err != nil {
+		return errno(err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.moved(oldPath, newPath)
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.fs.Rmdir(ctx, p); err != nil {
+		return errno(err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.removed(p)
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	p, err := fs.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.fs.Unlink(ctx, p); err != nil {
+		return errno(err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.removed(p)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Directory handles
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	if _, err := fs.pathOf(op.Inode); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Handle = fs.nextHandle
+	fs.nextHandle++
+	fs.dirs[op.Handle] = nil
+	return nil
+}
+
+// The directory is listed when read from the start, and the listing served
+// from memory as the kernel reads on.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	dir, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if op.Offset == 0 {
+		entries, err := fs.fs.ReadDir(ctx, dir)
+		if err != nil {
+			return errno(err)
+		}
+
+		fs.mu.Lock()
+		fs.dirs[op.Handle] = entries
+		fs.mu.Unlock()
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	entries, ok := fs.dirs[op.Handle]
+	if !ok {
+		return syscall.EBADF
+	}
+
+	for i := int(op.Offset); i < len(entries); i++ {
+		d := fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  fs.direntInode(path.Join(dir, entries[i].Name)),
+			Name:   entries[i].Name,
+			Type:   entries[i].Type,
+		}
+
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], d)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.dirs, op.Handle)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// File handles
+////////////////////////////////////////////////////////////////////////
+
+func (fs *fileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	f, err := fs.fs.Open(ctx, p, int(op.OpenFlags))
+	if err != nil {
+		return errno(err)
+	}
+
+	op.Handle = fs.newFileHandle(f)
+	return nil
+}
+
+func (fs *fileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	f, err := fs.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	op.BytesRead, err = f.ReadAt(op.Dst, op.Offset)
+	if err == io.EOF {
+		err = nil
+	}
+
+	return errno(err)
+}
+
+func (fs *fileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	f, err := fs.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	w, ok := f.(io.WriterAt)
+	if !ok {
+		return syscall.EBADF
+	}
+
+	_, err = w.WriteAt(op.Data, op.Offset)
+	return errno(err)
+}
+
+func (fs *fileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	f, err := fs.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if s, ok := f.(interface{ Sync() error }); ok {
+		return errno(s.Sync())
+	}
+
+	return nil
+}
+
+func (fs *fileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	f, ok := fs.files[op.Handle]
+	delete(fs.files, op.Handle)
+	fs.mu.Unlock()
+
+	if !ok {
+		return syscall.EBADF
+	}
+
+	if c, ok := f.(io.Closer); ok {
+		return errno(c.Close())
+	}
+
+	return nil
+}
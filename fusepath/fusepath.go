@@ -0,0 +1,205 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fusepath lets a file system be written in terms of paths rather
+// than inodes. It implements the inode bookkeeping that package fuse leaves
+// to file systems (allocating inode IDs, counting the kernel's lookups and
+// forgetting inodes once it is done with them), as well as the allocation of
+// file and directory handles, translating the ops in package fuseops into
+// calls on a FileSystem:
+//
+//	server := fuseutil.NewFileSystemServer(fusepath.NewFileSystem(myFS))
+//	mfs, err := fuse.Mount(dir, server, &cfg)
+//
+// NewNameTransformer wraps such a file system to change the names it stores
+// files under, e.g. to encrypt them, while the kernel sees them unchanged.
+//
+// This comes at a cost: each op looks up the path of its inode, and a file
+// or directory removed while still open can't be inspected through its
+// handle. File systems that need the full power of the kernel interface
+// should implement fuseutil.FileSystem instead.
+package fusepath
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// FileSystem is implemented by file systems addressing files by path. Paths
+// are absolute, slash-separated and clean, e.g. "/" or "/dir/file".
+//
+// Errors may be syscall.Errno values, or errors for which errors.Is reports
+// os.ErrNotExist, os.ErrExist, os.ErrPermission or os.ErrInvalid, as returned
+// by package os; these are translated into the corresponding error numbers.
+// Other errors are reported to the kernel as EIO.
+//
+// Methods may be called concurrently. Embed NotImplementedFileSystem to
+// inherit implementations returning ENOSYS for the methods you don't need.
+type FileSystem interface {
+	// Return the attributes of the file or directory at path, or ENOENT if
+	// there is none.
+	GetAttr(ctx context.Context, path string) (fuseops.InodeAttributes, error)
+
+	// Change the attributes of the file or directory at path.
+	SetAttr(ctx context.Context, path string, change AttrChange) error
+
+	// Return the contents of the directory at path, excluding "." and "..".
+	ReadDir(ctx context.Context, path string) ([]DirEntry, error)
+
+	// Return the target of the symlink at path.
+	ReadLink(ctx context.Context, path string) (string, error)
+
+	// Open the file at path, with flags as passed to open(2), e.g.
+	// os.O_RDWR.
+	Open(ctx context.Context, path string, flags int) (File, error)
+
+	// Create and open a file at path, which doesn't exist.
+	Create(
+		ctx context.Context,
+		path string,
+		flags int,
+		mode os.FileMode) (File, error)
+
+	// Create a directory at path, which doesn't exist.
+	Mkdir(ctx context.Context, path string, mode os.FileMode) error
+
+	// Create a symlink to target at path, which doesn't exist.
+	Symlink(ctx context.Context, target string, path string) error
+
+	// Remove the file or symlink at path.
+	Unlink(ctx context.Context, path string) error
+
+	// Remove the empty directory at path.
+	Rmdir(ctx context.Context, path string) error
+
+	// Move the file or directory at oldPath to newPath, replacing what is
+	// there if anything, as with rename(2).
+	Rename(ctx context.Context, oldPath string, newPath string) error
+}
+
+// An entry of a directory listed by FileSystem.ReadDir.
+type DirEntry struct {
+	Name string
+
+	// May be fuseutil.DT_Unknown.
+	Type fuseutil.DirentType
+}
+
+// Changes requested to a file or directory's attributes. Nil fields are left
+// alone.
+type AttrChange struct {
+	Size  *uint64
+	Mode  *os.FileMode
+	Uid   *uint32
+	Gid   *uint32
+	Atime *time.Time
+	Mtime *time.Time
+}
+
+// A file opened by FileSystem.Open or FileSystem.Create. Reading at or
+// beyond the end of the file may return io.EOF, as usual.
+//
+// A File may also implement io.WriterAt to be written to, Sync() error to be
+// synced by fsync(2), and io.Closer to be told when the kernel is done with
+// it. An *os.File implements them all.
+type File interface {
+	io.ReaderAt
+}
+
+// A FileSystem whose methods all return ENOSYS. Embed it in your struct to
+// inherit implementations for the methods you don't need, ensuring that your
+// struct keeps implementing FileSystem as methods are added.
+type NotImplementedFileSystem struct {
+}
+
+var _ FileSystem = &NotImplementedFileSystem{}
+
+func (fs *NotImplementedFileSystem) GetAttr(
+	ctx context.Context,
+	path string) (fuseops.InodeAttributes, error) {
+	return fuseops.InodeAttributes{}, fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) SetAttr(
+	ctx context.Context,
+	path string,
+	change AttrChange) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) ReadDir(
+	ctx context.Context,
+	path string) ([]DirEntry, error) {
+	return nil, fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) ReadLink(
+	ctx context.Context,
+	path string) (string, error) {
+	return "", fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Open(
+	ctx context.Context,
+	path string,
+	flags int) (File, error) {
+	return nil, fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Create(
+	ctx context.Context,
+	path string,
+	flags int,
+	mode os.FileMode) (File, error) {
+	return nil, fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Mkdir(
+	ctx context.Context,
+	path string,
+	mode os.FileMode) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Symlink(
+	ctx context.Context,
+	target string,
+	path string) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Unlink(
+	ctx context.Context,
+	path string) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Rmdir(
+	ctx context.Context,
+	path string) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Rename(
+	ctx context.Context,
+	oldPath string,
+	newPath string) error {
+	return fuse.ENOSYS
+}
@@ -0,0 +1,329 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusepath_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fusepath"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// An in-memory file system keyed by path.
+type mapFS struct {
+	fusepath.NotImplementedFileSystem
+
+	mu    sync.Mutex
+	dirs  map[string]bool
+	files map[string]*memFile
+}
+
+func newMapFS() *mapFS {
+	return &mapFS{
+		dirs:  map[string]bool{"/": true},
+		files: make(map[string]*memFile),
+	}
+}
+
+type memFile struct {
+	fs   *mapFS
+	data []byte
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	return copy(p, f.data[off:]), nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if end := int(off) + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+
+	return copy(f.data[off:], p), nil
+}
+
+func (fs *mapFS) GetAttr(
+	ctx context.Context,
+	p string) (fuseops.InodeAttributes, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.dirs[p] {
+		return fuseops.InodeAttributes{Mode: os.ModeDir | 0755}, nil
+	}
+
+	if f, ok := fs.files[p]; ok {
+		return fuseops.InodeAttributes{Mode: 0644, Size: uint64(len(f.data))}, nil
+	}
+
+	return fuseops.InodeAttributes{}, os.ErrNotExist
+}
+
+func (fs *mapFS) ReadDir(
+	ctx context.Context,
+	p string) ([]fusepath.DirEntry, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var entries []fusepath.DirEntry
+	for d := range fs.dirs {
+		if d != "/" && path.Dir(d) == p {
+			entries = append(entries, fusepath.DirEntry{Name: path.Base(d), Type: fuseutil.DT_Directory})
+		}
+	}
+
+	for f := range fs.files {
+		if path.Dir(f) == p {
+			entries = append(entries, fusepath.DirEntry{Name: path.Base(f), Type: fuseutil.DT_File})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+func (fs *mapFS) Open(
+	ctx context.Context,
+	p string,
+	flags int) (fusepath.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, ok := fs.files[p]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return f, nil
+}
+
+func (fs *mapFS) Create(
+	ctx context.Context,
+	p string,
+	flags int,
+	mode os.FileMode) (fusepath.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f := &memFile{fs: fs}
+	fs.files[p] = f
+	return f, nil
+}
+
+func (fs *mapFS) Mkdir(
+	ctx context.Context,
+	p string,
+	mode os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.dirs[p] {
+		return os.ErrExist
+	}
+
+	fs.dirs[p] = true
+	return nil
+}
+
+func (fs *mapFS) Rename(
+	ctx context.Context,
+	oldPath string,
+	newPath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	move := func(p string) (string, bool) {
+		if p == oldPath || strings.HasPrefix(p, oldPath+"/") {
+			return newPath + strings.TrimPrefix(p, oldPath), true
+		}
+
+		return p, false
+	}
+
+	for d := range fs.dirs {
+		if n, ok := move(d); ok {
+			delete(fs.dirs, d)
+			fs.dirs[n] = true
+		}
+	}
+
+	for p, f := range fs.files {
+		if n, ok := move(p); ok {
+			delete(fs.files, p)
+			fs.files[n] = f
+		}
+	}
+
+	return nil
+}
+
+func TestFileSystem(t *testing.T) {
+	ctx := context.Background()
+	fs := fusepath.NewFileSystem(newMapFS())
+
+	// Create /dir/f and write to it.
+	mkdir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir", Mode: 0755}
+	if err := fs.MkDir(ctx, mkdir); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	dir := mkdir.Entry.Child
+	create := &fuseops.CreateFileOp{Parent: dir, Name: "f", Mode: 0644}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	file := create.Entry.Child
+	if dir == file || dir == fuseops.RootInodeID {
+		t.Fatalf("Inodes: dir %v, file %v", dir, file)
+	}
+
+	write := &fuseops.WriteFileOp{Inode: file, Handle: create.Handle, Data: []byte("taco")}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// Looking the file up again yields the same inode.
+	lookUp := &fuseops.LookUpInodeOp{Parent: dir, Name: "f"}
+	if err := fs.LookUpInode(ctx, lookUp); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	if lookUp.Entry.Child != file || lookUp.Entry.Attributes.Size != 4 {
+		t.Errorf("Entry: %+v", lookUp.Entry)
+	}
+
+	// Inodes follow renames of their ancestors.
+	rename := &fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "dir",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "moved",
+	}
+	if err := fs.Rename(ctx, rename); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	open := &fuseops.OpenFileOp{Inode: file}
+	if err := fs.OpenFile(ctx, open); err != nil {
+		t.Fatalf("OpenFile after rename: %v", err)
+	}
+
+	read := &fuseops.ReadFileOp{Inode: file, Handle: open.Handle, Dst: make([]byte, 10)}
+	if err := fs.ReadFile(ctx, read); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if got := string(read.Dst[:read.BytesRead]); got != "taco" {
+		t.Errorf("Read %q", got)
+	}
+
+	// Directories list their contents.
+	openDir := &fuseops.OpenDirOp{Inode: dir}
+	if err := fs.OpenDir(ctx, openDir); err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	readDir := &fuseops.ReadDirOp{Inode: dir, Handle: openDir.Handle, Dst: make([]byte, 1024)}
+	if err := fs.ReadDir(ctx, readDir); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	var want [1024]byte
+	n := fuseutil.WriteDirent(want[:], fuseutil.Dirent{Offset: 1, Inode: file, Name: "f", Type: fuseutil.DT_File})
+	if string(readDir.Dst[:readDir.BytesRead]) != string(want[:n]) {
+		t.Errorf("ReadDir returned %d bytes, want %d", readDir.BytesRead, n)
+	}
+
+	// Once the kernel forgets the file, looking it up yields a new inode.
+	// CreateFile and LookUpInode each counted a lookup of it.
+	if err := fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: file, N: 2}); err != nil {
+		t.Fatalf("ForgetInode: %v", err)
+	}
+
+	lookUp = &fuseops.LookUpInodeOp{Parent: dir, Name: "f"}
+	if err := fs.LookUpInode(ctx, lookUp); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	if lookUp.Entry.Child == file {
+		t.Errorf("Forgotten inode reused")
+	}
+
+	// Missing files aren't found.
+	lookUp = &fuseops.LookUpInodeOp{Parent: dir, Name: "missing"}
+	if err := fs.LookUpInode(ctx, lookUp); err != syscall.ENOENT {
+		t.Errorf("LookUpInode of a missing file: %v", err)
+	}
+}
+
+func TestNameTransformer(t *testing.T) {
+	ctx := context.Background()
+	backend := newMapFS()
+	backend.files["/stray"] = &memFile{fs: backend}
+	fs := fusepath.NewFileSystem(
+		fusepath.NewNameTransformer(backend, fusepath.PrefixNames("x.")))
+
+	mkdir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir", Mode: 0755}
+	if err := fs.MkDir(ctx, mkdir); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	create := &fuseops.CreateFileOp{Parent: mkdir.Entry.Child, Name: "f", Mode: 0644}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	// The backend sees transformed names.
+	if !backend.dirs["/x.dir"] || backend.files["/x.dir/x.f"] == nil {
+		t.Errorf("Backend dirs %v, files %v", backend.dirs, backend.files)
+	}
+
+	// The kernel sees the original ones, and not the backend's other entries.
+	openDir := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	if err := fs.OpenDir(ctx, openDir); err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	readDir := &fuseops.ReadDirOp{Inode: fuseops.RootInodeID, Handle: openDir.Handle, Dst: make([]byte, 1024)}
+	if err := fs.ReadDir(ctx, readDir); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	var want [1024]byte
+	n := fuseutil.WriteDirent(want[:], fuseutil.Dirent{Offset: 1, Inode: mkdir.Entry.Child, Name: "dir", Type: fuseutil.DT_Directory})
+	if string(readDir.Dst[:readDir.BytesRead]) != string(want[:n]) {
+		t.Errorf("ReadDir returned %d bytes, want %d", readDir.BytesRead, n)
+	}
+
+	lookUp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "stray"}
+	if err := fs.LookUpInode(ctx, lookUp); err != syscall.ENOENT {
+		t.Errorf("LookUpInode of an untransformed name: %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusepath
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// How names are transformed between the kernel and a backend by
+// NewNameTransformer, e.g. to encrypt, hash or prefix them.
+type NameTransform struct {
+	// Return the name under which the backend stores the file or directory
+	// the kernel knows by name. Required. Must be deterministic, and map
+	// distinct names to distinct ones. Errors are returned to the kernel as
+	// for FileSystem methods, e.g. syscall.ENAMETOOLONG if the result would be
+	// too long for the backend.
+	Encode func(name string) (string, error)
+
+	// Return the name under which the kernel sees a file or directory listed
+	// by the backend, undoing Encode. Entries for which it returns an error,
+	// such as files that weren't created through the transform, are left out
+	// of directory listings. If nil, directories are listed as empty, which
+	// suits one-way transforms such as hashing: their entries can still be
+	// looked up by name.
+	Decode func(name string) (string, error)
+}
+
+// Create a file system that passes each component of the paths it is given
+// through t before calling the wrapped file system, and the names it lists
+// back through t, so that privacy layers can change how names are stored
+// while the kernel sees them unchanged. Symlink targets are passed through as
+// they are.
+func NewNameTransformer(wrapped FileSystem, t NameTransform) FileSystem {
+	return &nameTransformer{
+		wrapped: wrapped,
+		t:       t,
+	}
+}
+
+// A NameTransform storing names with the supplied prefix, and hiding the
+// entries of the backend that lack it.
+func PrefixNames(prefix string) NameTransform {
+	return NameTransform{
+		Encode: func(name string) (string, error) {
+			return prefix + name, nil
+		},
+		Decode: func(name string) (string, error) {
+			if !strings.HasPrefix(name, prefix) {
+				return "", os.ErrNotExist
+			}
+
+			return strings.TrimPrefix(name, prefix), nil
+		},
+	}
+}
+
+type nameTransformer struct {
+	wrapped FileSystem
+	t       NameTransform
+}
+
+// Encode each component of a path.
+func (fs *nameTransformer) encode(p string) (string, error) {
+	if p == "/" {
+		return p, nil
+	}
+
+	names := strings.Split(p[1:], "/")
+	for i, name := range names {
+		var err error
+		if names[i], err = fs.t.Encode(name); err != nil {
+			return "", err
+		}
+	}
+
+	return "/" + strings.Join(names, "/"), nil
+}
+
+func (fs *nameTransformer) GetAttr(
+	ctx context.Context,
+	path string) (fuseops.InodeAttributes, error) {
+	path, err := fs.encode(path)
+	if err != nil {
+		return fuseops.InodeAttributes{}, err
+	}
+
+	return fs.wrapped.GetAttr(ctx, path)
+}
+
+func (fs *nameTransformer) SetAttr(
+	ctx context.Context,
+	path string,
+	change AttrChange) error {
+	path, err := fs.encode(path)
+	if err != nil {
+		return err
+	}
+
+	return fs.wrapped.SetAttr(ctx, path, change)
+}
+
+func (fs *nameTransformer) ReadDir(
+	ctx context.Context,
+	path string) ([]DirEntry, error) {
+	path, err := fs.encode(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := fs.wrapped.ReadDir(ctx, path)
+	if err != nil || fs.t.Decode == nil {
+		return nil, err
+	}
+
+	var decoded []DirEntry
+	for _, e := range entries {
+		if e.Name, err = fs.t.Decode(e.Name); err == nil {
+			decoded = append(decoded, e)
+		}
+	}
+
+	return decoded, nil
+}
+
+func (fs *nameTransformer) ReadLink(
+	ctx context.Context,
+	path string) (string, error) {
+	path, err := fs.encode(path)
+	if err != nil {
+		return "", err
+	}
+
+	return fs.wrapped.ReadLink(ctx, path)
+}
+
+func (fs *nameTransformer) Open(
+	ctx context.Context,
+	path string,
+	flags int) (File, error) {
+	path, err := fs.encode(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.wrapped.Open(ctx, path, flags)
+}
+
+func (fs *nameTransformer) Create(
+	ctx context.Context,
+	path string,
+	flags int,
+	mode os.FileMode) (File, error) {
+	path, err := fs.encode(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.wrapped.Create(ctx, path, flags, mode)
+}
+
+func (fs *nameTransformer) Mkdir(
+	ctx context.Context,
+	path string,
+	mode os.FileMode) error {
+	path, err := fs.encode(path)
+	if err != nil {
+		return err
+	}
+
+	return fs.wrapped.Mkdir(ctx, path, mode)
+}
+
+func (fs *nameTransformer) Symlink(
+	ctx context.Context,
+	target string,
+	path string) error {
+	path, err := fs.encode(path)
+	if err != nil {
+		return err
+	}
+
+	return fs.wrapped.Symlink(ctx, target, path)
+}
+
+func (fs *nameTransformer) Unlink(
+	ctx context.Context,
+	path string) error {
+	path, err := fs.encode(path)
+	if err != nil {
+		return err
+	}
+
+	return fs.wrapped.Unlink(ctx, path)
+}
+
+func (fs *nameTransformer) Rmdir(
+	ctx context.Context,
+	path string) error {
+	path, err := fs.encode(path)
+	if err != nil {
+		return err
+	}
+
+	return fs.wrapped.Rmdir(ctx, path)
+}
+
+func (fs *nameTransformer) Rename(
+	ctx context.Context,
+	oldPath string,
+	newPath string) error {
+	oldPath, err := fs.encode(oldPath)
+	if err != nil {
+		return err
+	}
+
+	newPath, err = fs.encode(newPath)
+	if err != nil {
+		return err
+	}
+
+	return fs.wrapped.Rename(ctx, oldPath, newPath)
+}
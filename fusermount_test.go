@@ -0,0 +1,89 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The environment variable telling TestFusermountHelper to act as
+// fusermount(1) with auto_unmount, noting the unmount in the named file.
+const fusermountMarkerVar = "FUSE_TEST_FUSERMOUNT_MARKER"
+
+// Pass /dev/null back over the socket as the device, then wait for the other
+// end of the socket to close before "unmounting".
+func TestFusermountHelper(t *testing.T) {
+	marker := os.Getenv(fusermountMarkerVar)
+	if marker == "" {
+		return
+	}
+
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		os.Exit(2)
+	}
+
+	c, err := net.FileConn(os.NewFile(3, "commfd"))
+	if err != nil {
+		os.Exit(2)
+	}
+
+	uc := c.(*net.UnixConn)
+	if _, _, err := uc.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(null.Fd())), nil); err != nil {
+		os.Exit(2)
+	}
+
+	io.Copy(io.Discard, uc)
+	os.WriteFile(marker, nil, 0644)
+	os.Exit(0)
+}
+
+func TestFusermountKeepsSocket(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "unmounted")
+	dev, sock, err := fusermount(
+		os.Args[0],
+		[]string{"-test.run=^TestFusermountHelper$"},
+		[]string{fusermountMarkerVar + "=" + marker},
+		false,
+		true,
+		nil)
+	if err != nil {
+		t.Fatalf("fusermount: %v", err)
+	}
+	defer dev.Close()
+
+	// The helper waits for as long as we hold the socket open.
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(marker); err == nil {
+		t.Fatalf("Helper unmounted with the socket open")
+	}
+
+	sock.Close()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(marker); err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Helper didn't unmount once the socket was closed")
+		}
+	}
+}
@@ -0,0 +1,598 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A Harness stands in for the kernel in front of a file system, so that it can
+// be tested with plain `go test`, without /dev/fuse or the privileges needed
+// to mount. It hands ops synthesized by the test directly to the file system,
+// keeps the lookup counts and open handles the kernel would, and reports to
+// the test any response that breaks the promises the kernel relies on:
+//
+//   - entries returned by ops that create inodes name a non-zero inode, and
+//     an inode with outstanding lookups keeps its generation number;
+//   - an inode with outstanding lookups stays valid, so that fetching its
+//     attributes or opening it doesn't fail with ENOENT;
+//   - a non-zero handle isn't returned again while it is still open;
+//   - reads don't return more bytes than were asked for.
+//
+// It also reports ops the kernel would never send, such as ops on inodes that
+// haven't been looked up or on handles that are closed, and forgetting more
+// lookups than were made, which are mistakes in the test. Close reports the
+// handles left open.
+//
+// A Harness may be used from several goroutines at once.
+type Harness struct {
+	t  testing.TB
+	fs fuseutil.FileSystem
+
+	mu sync.Mutex
+
+	// The inodes with outstanding lookups, other than the root, which the
+	// kernel holds from the start.
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*harnessInode
+
+	// The number of times each handle is open. Zero handles are counted too,
+	// since file systems that keep no per-handle state return zero every time.
+	//
+	// GUARDED_BY(mu)
+	handles map[harnessHandle]int
+}
+
+type harnessInode struct {
+	lookups    uint64
+	generation fuseops.GenerationNumber
+}
+
+type harnessHandle struct {
+	handle fuseops.HandleID
+	dir    bool
+}
+
+// NewHarness returns a harness driving fs, reporting violations to t.
+func NewHarness(t testing.TB, fs fuseutil.FileSystem) *Harness {
+	return &Harness{
+		t:       t,
+		fs:      fs,
+		inodes:  make(map[fuseops.InodeID]*harnessInode),
+		handles: make(map[harnessHandle]int),
+	}
+}
+
+// Do hands the op (a pointer to one of the structs in package fuseops) to the
+// file system, as fuseutil.NewFileSystemServer would, checks its response and
+// accounts for its effect on lookup counts and open handles.
+//
+// LOCKS_EXCLUDED(h.mu)
+func (h *Harness) Do(ctx context.Context, op interface{}) error {
+	h.before(op)
+	err := fuseutil.Dispatch(ctx, h.fs, op)
+	h.after(op, err)
+
+	return err
+}
+
+// Report ops the kernel wouldn't send in the current state.
+//
+// LOCKS_EXCLUDED(h.mu)
+func (h *Harness) before(op interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	name := opName(op)
+	for _, inode := range inodesOf(op) {
+		if inode != fuseops.RootInodeID && h.inodes[inode] == nil {
+			h.t.Errorf("%s on inode %d, which hasn't been looked up", name, inode)
+		}
+	}
+
+	if hh, ok := handleOf(op); ok && h.handles[hh] == 0 {
+		h.t.Errorf("%s on handle %d, which isn't open", name, hh.handle)
+	}
+}
+
+// Check the file system's response to the op and account for it.
+//
+// LOCKS_EXCLUDED(h.mu)
+func (h *Harness) after(op interface{}, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	name := opName(op)
+
+	// Inodes referenced by the kernel must stay valid until forgotten.
+	if err == syscall.ENOENT {
+		switch op.(type) {
+		case *fuseops.GetInodeAttributesOp, *fuseops.OpenFileOp, *fuseops.OpenDirOp:
+			for _, inode := range inodesOf(op) {
+				if h.inodes[inode] != nil {
+					h.t.Errorf("%s: ENOENT for inode %d, which has outstanding lookups", name, inode)
+				}
+			}
+		}
+	}
+
+	switch typed := op.(type) {
+	case *fuseops.ForgetInodeOp:
+		h.forget(typed.Inode, typed.N)
+
+	case *fuseops.BatchForgetOp:
+		for _, e := range typed.Entries {
+			h.forget(e.Inode, e.N)
+		}
+
+	case *fuseops.ReleaseFileHandleOp:
+		h.release(harnessHandle{typed.Handle, false})
+
+	case *fuseops.ReleaseDirHandleOp:
+		h.release(harnessHandle{typed.Handle, true})
+	}
+
+	if err != nil {
+		return
+	}
+
+	switch typed := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		// A zero child is a negative entry, which isn't counted.
+		if typed.Entry.Child != 0 {
+			h.lookedUp(name, &typed.Entry)
+		}
+
+	case *fuseops.MkDirOp:
+		h.lookedUp(name, &typed.Entry)
+
+	case *fuseops.MkNodeOp:
+		h.lookedUp(name, &typed.Entry)
+
+	case *fuseops.CreateSymlinkOp:
+		h.lookedUp(name, &typed.Entry)
+
+	case *fuseops.CreateLinkOp:
+		h.lookedUp(name, &typed.Entry)
+
+	case *fuseops.CreateFileOp:
+		h.lookedUp(name, &typed.Entry)
+		h.opened(name, harnessHandle{typed.Handle, false})
+
+	case *fuseops.OpenFileOp:
+		h.opened(name, harnessHandle{typed.Handle, false})
+
+	case *fuseops.OpenDirOp:
+		h.opened(name, harnessHandle{typed.Handle, true})
+
+	case *fuseops.ReadFileOp:
+		if typed.BytesRead < 0 || int64(typed.BytesRead) > typed.Size {
+			h.t.Errorf("%s: read %d bytes of %d", name, typed.BytesRead, typed.Size)
+		}
+
+	case *fuseops.ReadDirOp:
+		if typed.BytesRead < 0 || typed.BytesRead > len(typed.Dst) {
+			h.t.Errorf("%s: read %d bytes of %d", name, typed.BytesRead, len(typed.Dst))
+		}
+
+	case *fuseops.ReadDirPlusOp:
+		if typed.BytesRead < 0 || typed.BytesRead > len(typed.Dst) {
+			h.t.Errorf("%s: read %d bytes of %d", name, typed.BytesRead, len(typed.Dst))
+			break
+		}
+
+		for _, e := range readDirentsPlus(typed.Dst[:typed.BytesRead]) {
+			if e.Entry.Child != 0 && e.Name != "." && e.Name != ".." {
+				h.lookedUp(name, &e.Entry)
+			}
+		}
+	}
+}
+
+// LOCKS_REQUIRED(h.mu)
+func (h *Harness) lookedUp(name string, e *fuseops.ChildInodeEntry) {
+	if e.Child == 0 {
+		h.t.Errorf("%s returned an entry for inode zero", name)
+		return
+	}
+
+	if e.Child == fuseops.RootInodeID {
+		return
+	}
+
+	in := h.inodes[e.Child]
+	if in == nil {
+		in = &harnessInode{generation: e.Generation}
+		h.inodes[e.Child] = in
+	}
+
+	if e.Generation != in.generation {
+		h.t.Errorf(
+			"%s returned generation %d for inode %d, which has outstanding lookups at generation %d",
+			name,
+			e.Generation,
+			e.Child,
+			in.generation)
+	}
+
+	in.lookups++
+}
+
+// LOCKS_REQUIRED(h.mu)
+func (h *Harness) forget(inode fuseops.InodeID, n uint64) {
+	if inode == fuseops.RootInodeID {
+		return
+	}
+
+	in := h.inodes[inode]
+	if in == nil || n > in.lookups {
+		h.t.Errorf("Forgetting %d lookups of inode %d, which has fewer", n, inode)
+		delete(h.inodes, inode)
+		return
+	}
+
+	in.lookups -= n
+	if in.lookups == 0 {
+		delete(h.inodes, inode)
+	}
+}
+
+// LOCKS_REQUIRED(h.mu)
+func (h *Harness) opened(name string, hh harnessHandle) {
+	if hh.handle != 0 && h.handles[hh] != 0 {
+		h.t.Errorf("%s returned handle %d, which is already open", name, hh.handle)
+	}
+
+	h.handles[hh]++
+}
+
+// LOCKS_REQUIRED(h.mu)
+func (h *Harness) release(hh harnessHandle) {
+	if h.handles[hh] == 0 {
+		return
+	}
+
+	h.handles[hh]--
+	if h.handles[hh] == 0 {
+		delete(h.handles, hh)
+	}
+}
+
+// LookupCount returns the number of outstanding lookups of the inode.
+//
+// LOCKS_EXCLUDED(h.mu)
+func (h *Harness) LookupCount(inode fuseops.InodeID) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if in := h.inodes[inode]; in != nil {
+		return in.lookups
+	}
+
+	return 0
+}
+
+// Close reports the handles left open, forgets the lookups outstanding, as
+// the kernel does when dropping its caches, and destroys the file system.
+//
+// LOCKS_EXCLUDED(h.mu)
+func (h *Harness) Close(ctx context.Context) {
+	h.mu.Lock()
+	for hh, n := range h.handles {
+		h.t.Errorf("Handle %d left open %d time(s)", hh.handle, n)
+	}
+
+	op := &fuseops.BatchForgetOp{}
+	for inode, in := range h.inodes {
+		op.Entries = append(op.Entries, fuseops.BatchForgetEntry{Inode: inode, N: in.lookups})
+	}
+	h.mu.Unlock()
+
+	// Like the kernel, ignore errors forgetting.
+	if len(op.Entries) != 0 {
+		h.Do(ctx, op)
+	}
+
+	h.fs.Destroy()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Convenience methods
+////////////////////////////////////////////////////////////////////////
+
+// LookUp looks up the named child of the directory.
+func (h *Harness) LookUp(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string) (fuseops.ChildInodeEntry, error) {
+	op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+	err := h.Do(ctx, op)
+	return op.Entry, err
+}
+
+// Forget forgets n lookups of the inode.
+func (h *Harness) Forget(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	n uint64) error {
+	return h.Do(ctx, &fuseops.ForgetInodeOp{Inode: inode, N: n})
+}
+
+// GetAttributes returns the inode's attributes.
+func (h *Harness) GetAttributes(
+	ctx context.Context,
+	inode fuseops.InodeID) (fuseops.InodeAttributes, error) {
+	op := &fuseops.GetInodeAttributesOp{Inode: inode}
+	err := h.Do(ctx, op)
+	return op.Attributes, err
+}
+
+// MkDir creates a directory within the parent.
+func (h *Harness) MkDir(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string,
+	mode os.FileMode) (fuseops.ChildInodeEntry, error) {
+	op := &fuseops.MkDirOp{Parent: parent, Name: name, Mode: mode | os.ModeDir}
+	err := h.Do(ctx, op)
+	return op.Entry, err
+}
+
+// Create creates and opens a file within the parent.
+func (h *Harness) Create(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string,
+	mode os.FileMode) (fuseops.ChildInodeEntry, fuseops.HandleID, error) {
+	op := &fuseops.CreateFileOp{Parent: parent, Name: name, Mode: mode}
+	err := h.Do(ctx, op)
+	return op.Entry, op.Handle, err
+}
+
+// Unlink removes the named file from the directory.
+func (h *Harness) Unlink(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string) error {
+	return h.Do(ctx, &fuseops.UnlinkOp{Parent: parent, Name: name})
+}
+
+// Open opens the file.
+func (h *Harness) Open(
+	ctx context.Context,
+	inode fuseops.InodeID) (fuseops.HandleID, error) {
+	op := &fuseops.OpenFileOp{Inode: inode}
+	err := h.Do(ctx, op)
+	return op.Handle, err
+}
+
+// Read reads up to size bytes at the offset through the handle.
+func (h *Harness) Read(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	offset int64,
+	size int) ([]byte, error) {
+	op := &fuseops.ReadFileOp{
+		Inode:  inode,
+		Handle: handle,
+		Offset: offset,
+		Size:   int64(size),
+		Dst:    make([]byte, size),
+	}
+
+	if err := h.Do(ctx, op); err != nil {
+		return nil, err
+	}
+
+	// File systems may return vectored data instead of filling Dst.
+	if op.Data != nil {
+		var b []byte
+		for _, d := range op.Data {
+			b = append(b, d...)
+		}
+
+		return b, nil
+	}
+
+	if op.BytesRead > size {
+		return op.Dst, nil
+	}
+
+	return op.Dst[:op.BytesRead], nil
+}
+
+// Write writes the data at the offset through the handle.
+func (h *Harness) Write(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	offset int64,
+	data []byte) error {
+	return h.Do(ctx, &fuseops.WriteFileOp{
+		Inode:  inode,
+		Handle: handle,
+		Offset: offset,
+		Data:   data,
+	})
+}
+
+// Release releases the file handle. The handle is closed even if this
+// returns an error, which the kernel ignores.
+func (h *Harness) Release(
+	ctx context.Context,
+	handle fuseops.HandleID) error {
+	return h.Do(ctx, &fuseops.ReleaseFileHandleOp{Handle: handle})
+}
+
+// OpenDir opens the directory.
+func (h *Harness) OpenDir(
+	ctx context.Context,
+	inode fuseops.InodeID) (fuseops.HandleID, error) {
+	op := &fuseops.OpenDirOp{Inode: inode}
+	err := h.Do(ctx, op)
+	return op.Handle, err
+}
+
+// ReadDir reads all of the directory's entries through the handle.
+func (h *Harness) ReadDir(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	handle fuseops.HandleID) ([]fuseutil.Dirent, error) {
+	var entries []fuseutil.Dirent
+	var offset fuseops.DirOffset
+	for {
+		op := &fuseops.ReadDirOp{
+			Inode:  inode,
+			Handle: handle,
+			Offset: offset,
+			Dst:    make([]byte, 4096),
+		}
+
+		if err := h.Do(ctx, op); err != nil {
+			return entries, err
+		}
+
+		if op.BytesRead <= 0 || op.BytesRead > len(op.Dst) {
+			return entries, nil
+		}
+
+		buf := op.Dst[:op.BytesRead]
+		for {
+			d, n := fuseutil.ReadDirent(buf)
+			if n == 0 {
+				break
+			}
+
+			entries = append(entries, d)
+			offset = d.Offset
+			buf = buf[n:]
+		}
+	}
+}
+
+// ReleaseDir releases the directory handle, as Release does file handles.
+func (h *Harness) ReleaseDir(
+	ctx context.Context,
+	handle fuseops.HandleID) error {
+	return h.Do(ctx, &fuseops.ReleaseDirHandleOp{Handle: handle})
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// The name of the op, e.g. "ReadFile".
+func opName(op interface{}) string {
+	t := reflect.TypeOf(op)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	name := t.Name()
+	if len(name) > 2 && name[len(name)-2:] == "Op" {
+		name = name[:len(name)-2]
+	}
+
+	return name
+}
+
+var inodeIDType = reflect.TypeOf(fuseops.InodeID(0))
+
+// The inodes the op is about, from its fields of type InodeID, e.g. Inode,
+// Parent or Target.
+func inodesOf(op interface{}) (inodes []fuseops.InodeID) {
+	v := reflect.ValueOf(op)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+
+	v = v.Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Type() == inodeIDType {
+			inodes = append(inodes, fuseops.InodeID(v.Field(i).Uint()))
+		}
+	}
+
+	return inodes
+}
+
+// The handle the op uses, if it uses one it must have opened.
+func handleOf(op interface{}) (harnessHandle, bool) {
+	switch typed := op.(type) {
+	case *fuseops.ReadFileOp:
+		return harnessHandle{typed.Handle, false}, true
+	case *fuseops.WriteFileOp:
+		return harnessHandle{typed.Handle, false}, true
+	case *fuseops.SyncFileOp:
+		return harnessHandle{typed.Handle, false}, true
+	case *fuseops.FlushFileOp:
+		return harnessHandle{typed.Handle, false}, true
+	case *fuseops.ReleaseFileHandleOp:
+		return harnessHandle{typed.Handle, false}, true
+	case *fuseops.ReadDirOp:
+		return harnessHandle{typed.Handle, true}, true
+	case *fuseops.ReadDirPlusOp:
+		return harnessHandle{typed.Handle, true}, true
+	case *fuseops.ReleaseDirHandleOp:
+		return harnessHandle{typed.Handle, true}, true
+	}
+
+	return harnessHandle{}, false
+}
+
+// An entry of a ReadDirPlusOp's response.
+type direntPlus struct {
+	Name  string
+	Entry fuseops.ChildInodeEntry
+}
+
+// Parse the entries written by fuseutil.WriteDirentPlus, as far as the
+// lookups they make are concerned.
+func readDirentsPlus(buf []byte) (entries []direntPlus) {
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	for len(buf) > entrySize {
+		var out fusekernel.EntryOut
+		copy((*[entrySize]byte)(unsafe.Pointer(&out))[:], buf)
+
+		d, n := fuseutil.ReadDirent(buf[entrySize:])
+		if n == 0 {
+			break
+		}
+
+		entries = append(entries, direntPlus{
+			Name: d.Name,
+			Entry: fuseops.ChildInodeEntry{
+				Child:      fuseops.InodeID(out.Nodeid),
+				Generation: fuseops.GenerationNumber(out.Generation),
+			},
+		})
+
+		buf = buf[entrySize+n:]
+	}
+
+	return entries
+}
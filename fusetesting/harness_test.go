@@ -0,0 +1,162 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fusetesting"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/samples/memfs"
+)
+
+func TestHarness(t *testing.T) {
+	ctx := context.Background()
+	h := fusetesting.NewHarness(t, memfs.NewMemFileSystem(0, 0))
+	defer h.Close(ctx)
+
+	dir, err := h.MkDir(ctx, fuseops.RootInodeID, "dir", 0755)
+	if err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	file, handle, err := h.Create(ctx, dir.Child, "foo", 0644)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if err := h.Write(ctx, file.Child, handle, 0, []byte("taco")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if b, err := h.Read(ctx, file.Child, handle, 1, 10); err != nil || string(b) != "aco" {
+		t.Errorf("Read: %q, %v", b, err)
+	}
+
+	h.Release(ctx, handle)
+
+	// Each entry returned counts as a lookup.
+	if _, err := h.LookUp(ctx, dir.Child, "foo"); err != nil {
+		t.Fatalf("LookUp: %v", err)
+	}
+
+	if n := h.LookupCount(file.Child); n != 2 {
+		t.Errorf("Lookup count %d, want 2", n)
+	}
+
+	// An unlinked file stays valid until forgotten.
+	if err := h.Unlink(ctx, dir.Child, "foo"); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	if _, err := h.GetAttributes(ctx, file.Child); err != nil {
+		t.Errorf("GetAttributes after unlinking: %v", err)
+	}
+
+	h.Forget(ctx, file.Child, 2)
+	if n := h.LookupCount(file.Child); n != 0 {
+		t.Errorf("Lookup count %d after forgetting", n)
+	}
+
+	dh, err := h.OpenDir(ctx, dir.Child)
+	if err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	if entries, err := h.ReadDir(ctx, dir.Child, dh); err != nil || len(entries) != 0 {
+		t.Errorf("ReadDir: %v, %v", entries, err)
+	}
+
+	h.ReleaseDir(ctx, dh)
+}
+
+// A testing.TB recording the errors reported to it.
+type recordingT struct {
+	testing.TB
+
+	mu     sync.Mutex
+	errors []string
+}
+
+func (t *recordingT) Errorf(format string, v ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.errors = append(t.errors, fmt.Sprintf(format, v...))
+}
+
+// A file system that forgets its inodes too soon and hands out the same
+// handle every time.
+type forgetfulFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *forgetfulFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	op.Entry.Child = 17
+	return nil
+}
+
+func (fs *forgetfulFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return fuse.ENOENT
+}
+
+func (fs *forgetfulFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.Handle = 1
+	return nil
+}
+
+func TestHarnessViolations(t *testing.T) {
+	ctx := context.Background()
+	rt := &recordingT{TB: t}
+	h := fusetesting.NewHarness(rt, &forgetfulFS{})
+
+	h.LookUp(ctx, fuseops.RootInodeID, "foo")
+	h.GetAttributes(ctx, 17)
+	h.Open(ctx, 17)
+	h.Open(ctx, 17)
+	h.Read(ctx, 17, 2, 0, 1)
+	h.Forget(ctx, 17, 2)
+	h.Close(ctx)
+
+	want := []string{
+		"GetInodeAttributes: ENOENT for inode 17",
+		"OpenFile returned handle 1, which is already open",
+		"ReadFile on handle 2, which isn't open",
+		"Forgetting 2 lookups of inode 17",
+		"Handle 1 left open 2 time(s)",
+	}
+
+	if len(rt.errors) != len(want) {
+		t.Fatalf("Errors reported: %q", rt.errors)
+	}
+
+	for i, e := range rt.errors {
+		if !strings.HasPrefix(e, want[i]) {
+			t.Errorf("Error %d: %q, want %q...", i, e, want[i])
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// Options for NewAdaptiveTTLFileSystem.
+type AdaptiveTTLConfig struct {
+	// Bounds on the TTLs handed out. Default to one second and ten minutes.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// The TTL handed out for a directory is this fraction of the time it has
+	// gone without changing. Defaults to 0.1, so that a directory that hasn't
+	// changed for an hour is cached for six minutes.
+	Fraction float64
+
+	// Defaults to timeutil.RealClock().
+	Clock timeutil.Clock
+}
+
+// AdaptiveTTLFileSystem sets the entry and attribute expiration times of the
+// wrapped file system's responses according to how often each directory is
+// observed to change in the backend, caching cold, stable data for longer and
+// hot data for shorter. See NewAdaptiveTTLFileSystem.
+type AdaptiveTTLFileSystem struct {
+	FileSystem
+	cfg AdaptiveTTLConfig
+
+	mu sync.Mutex
+
+	// When each directory was first seen or last changed.
+	//
+	// GUARDED_BY(mu)
+	stableSince map[fuseops.InodeID]time.Time
+
+	// The directory in which each inode was last looked up, which decides the
+	// TTL of its attributes.
+	//
+	// GUARDED_BY(mu)
+	parents map[fuseops.InodeID]fuseops.InodeID
+}
+
+// Create a file system that overrides the wrapped file system's entry and
+// attribute expiration times with ones derived from the directory each entry
+// is in: the longer a directory has gone without changing, the longer its
+// entries and their attributes are cached, within the configured bounds.
+//
+// The file system must call Invalidated when it learns of a change made in
+// the backend behind the kernel's back, as it would when invalidating the
+// kernel's caches. Changes made through the mount need not be reported, since
+// the kernel keeps its caches up to date with them.
+func NewAdaptiveTTLFileSystem(
+	wrapped FileSystem,
+	cfg AdaptiveTTLConfig) *AdaptiveTTLFileSystem {
+	if cfg.MinTTL <= 0 {
+		cfg.MinTTL = time.Second
+	}
+
+	if cfg.MaxTTL <= 0 {
+		cfg.MaxTTL = 10 * time.Minute
+	}
+
+	if cfg.Fraction <= 0 {
+		cfg.Fraction = 0.1
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = timeutil.RealClock()
+	}
+
+	return &AdaptiveTTLFileSystem{
+		FileSystem:  wrapped,
+		cfg:         cfg,
+		stableSince: make(map[fuseops.InodeID]time.Time),
+		parents:     make(map[fuseops.InodeID]fuseops.InodeID),
+	}
+}
+
+// Invalidated records that the contents of the directory, or the attributes
+// of an entry within it, changed in the backend. This shortens the TTLs of its
+// entries from now on.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *AdaptiveTTLFileSystem) Invalidated(dir fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.stableSince[dir] = fs.cfg.Clock.Now()
+}
+
+// TTL returns the TTL currently handed out for entries in the directory.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *AdaptiveTTLFileSystem) TTL(dir fuseops.InodeID) time.Duration {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.ttl(dir, fs.cfg.Clock.Now())
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *AdaptiveTTLFileSystem) ttl(
+	dir fuseops.InodeID,
+	now time.Time) time.Duration {
+	since, ok := fs.stableSince[dir]
+	if !ok {
+		since = now
+		fs.stableSince[dir] = since
+	}
+
+	ttl := time.Duration(float64(now.Sub(since)) * fs.cfg.Fraction)
+	switch {
+	case ttl < fs.cfg.MinTTL:
+		ttl = fs.cfg.MinTTL
+	case ttl > fs.cfg.MaxTTL:
+		ttl = fs.cfg.MaxTTL
+	}
+
+	return ttl
+}
+
+// Set the expiration times of an entry in the directory.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *AdaptiveTTLFileSystem) setEntryExpiration(
+	dir fuseops.InodeID,
+	e *fuseops.ChildInodeEntry) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	now := fs.cfg.Clock.Now()
+	expiration := now.Add(fs.ttl(dir, now))
+	e.EntryExpiration = expiration
+	e.AttributesExpiration = expiration
+	fs.parents[e.Child] = dir
+}
+
+// Set the expiration time of an inode's attributes, according to the
+// directory it was last looked up in.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *AdaptiveTTLFileSystem) attributesExpiration(
+	id fuseops.InodeID) time.Time {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, ok := fs.parents[id]
+	if !ok {
+		dir = id
+	}
+
+	now := fs.cfg.Clock.Now()
+	return now.Add(fs.ttl(dir, now))
+}
+
+func (fs *AdaptiveTTLFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	err := fs.FileSystem.LookUpInode(ctx, op)
+	if err == nil {
+		fs.setEntryExpiration(op.Parent, &op.Entry)
+	}
+
+	return err
+}
+
+func (fs *AdaptiveTTLFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	err := fs.FileSystem.GetInodeAttributes(ctx, op)
+	if err == nil {
+		op.AttributesExpiration = fs.attributesExpiration(op.Inode)
+	}
+
+	return err
+}
+
+func (fs *AdaptiveTTLFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	err := fs.FileSystem.SetInodeAttributes(ctx, op)
+	if err == nil {
+		op.AttributesExpiration = fs.attributesExpiration(op.Inode)
+	}
+
+	return err
+}
+
+func (fs *AdaptiveTTLFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	err := fs.FileSystem.MkDir(ctx, op)
+	if err == nil {
+		fs.setEntryExpiration(op.Parent, &op.Entry)
+	}
+
+	return err
+}
+
+func (fs *AdaptiveTTLFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	err := fs.FileSystem.MkNode(ctx, op)
+	if err == nil {
+		fs.setEntryExpiration(op.Parent, &op.Entry)
+	}
+
+	return err
+}
+
+func (fs *AdaptiveTTLFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	err := fs.FileSystem.CreateFile(ctx, op)
+	if err == nil {
+		fs.setEntryExpiration(op.Parent, &op.Entry)
+	}
+
+	return err
+}
+
+func (fs *AdaptiveTTLFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	err := fs.FileSystem.CreateSymlink(ctx, op)
+	if err == nil {
+		fs.setEntryExpiration(op.Parent, &op.Entry)
+	}
+
+	return err
+}
+
+func (fs *AdaptiveTTLFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	err := fs.FileSystem.CreateLink(ctx, op)
+	if err == nil {
+		fs.setEntryExpiration(op.Parent, &op.Entry)
+	}
+
+	return err
+}
+
+// Everything known of forgotten inodes is dropped, so that the state is
+// bounded by the number of inodes the kernel knows of. Should the kernel still
+// hold a reference, which it may after a partial forget, the inode's
+// attributes are then cached according to its own stability, as for inodes
+// that were never looked up, and a directory's stability is measured afresh.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *AdaptiveTTLFileSystem) forget(ids ...fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, id := range ids {
+		delete(fs.parents, id)
+		delete(fs.stableSince, id)
+	}
+}
+
+func (fs *AdaptiveTTLFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.forget(op.Inode)
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+func (fs *AdaptiveTTLFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		fs.forget(e.Inode)
+	}
+
+	return fs.FileSystem.BatchForget(ctx, op)
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+// A file system in which every name exists, as inode 17.
+type everythingFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *everythingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	op.Entry.Child = 17
+	return nil
+}
+
+func (fs *everythingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return nil
+}
+
+func TestAdaptiveTTLFileSystem(t *testing.T) {
+	ctx := context.Background()
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC))
+
+	fs := fuseutil.NewAdaptiveTTLFileSystem(&everythingFS{}, fuseutil.AdaptiveTTLConfig{
+		MinTTL:   time.Second,
+		MaxTTL:   time.Minute,
+		Fraction: 0.1,
+		Clock:    &clock,
+	})
+
+	lookUp := func() time.Duration {
+		op := &fuseops.LookUpInodeOp{Parent: 1, Name: "taco"}
+		if err := fs.LookUpInode(ctx, op); err != nil {
+			t.Fatalf("LookUpInode: %v", err)
+		}
+
+		if op.Entry.AttributesExpiration != op.Entry.EntryExpiration {
+			t.Errorf("Expirations differ: %v", op.Entry)
+		}
+
+		return op.Entry.EntryExpiration.Sub(clock.Now())
+	}
+
+	// A directory we know nothing about gets the minimum.
+	if ttl := lookUp(); ttl != time.Second {
+		t.Errorf("Initial TTL: %v", ttl)
+	}
+
+	// It grows as the directory stays unchanged.
+	clock.AdvanceTime(100 * time.Second)
+	if ttl := lookUp(); ttl != 10*time.Second {
+		t.Errorf("TTL after 100s: %v", ttl)
+	}
+
+	// Attributes of the child follow the directory.
+	attrsOp := &fuseops.GetInodeAttributesOp{Inode: 17}
+	fs.GetInodeAttributes(ctx, attrsOp)
+	if ttl := attrsOp.AttributesExpiration.Sub(clock.Now()); ttl != 10*time.Second {
+		t.Errorf("Attributes TTL: %v", ttl)
+	}
+
+	// Up to the maximum.
+	clock.AdvanceTime(time.Hour)
+	if ttl := lookUp(); ttl != time.Minute {
+		t.Errorf("TTL after an hour: %v", ttl)
+	}
+
+	// A change resets it.
+	fs.Invalidated(1)
+	if ttl := lookUp(); ttl != time.Second {
+		t.Errorf("TTL after invalidation: %v", ttl)
+	}
+
+	// Forgetting the directory drops what was learned of it.
+	clock.AdvanceTime(100 * time.Second)
+	fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: 1, N: 1})
+	if ttl := lookUp(); ttl != time.Second {
+		t.Errorf("TTL after forgetting: %v", ttl)
+	}
+}
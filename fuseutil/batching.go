@@ -0,0 +1,221 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"time"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// An op received from the kernel, along with the context with which it was
+// received.
+type BatchedOp struct {
+	Ctx context.Context
+
+	// A *fuseops.ReadFileOp or a *fuseops.WriteFileOp.
+	Op interface{}
+}
+
+// A FileSystem that can handle several reads and writes at once, for example
+// to merge adjacent ones before sending them to a backend. See
+// NewBatchingFileSystemServer.
+type BatchingFileSystem interface {
+	FileSystem
+
+	// Handle the supplied ops, which the kernel sent at about the same time and
+	// which may be executed in any order, returning the error with which to
+	// respond to each one. The returned slice must have the same length as ops.
+	//
+	// The ops' ReadFile and WriteFile methods are not called by the server.
+	HandleBatch(ops []BatchedOp) []error
+}
+
+// Limits on the batches delivered by the server returned by
+// NewBatchingFileSystemServer.
+type BatchWindow struct {
+	// The maximum number of ops in a batch. Defaults to 64.
+	MaxOps int
+
+	// How long to wait for further ops after the first op of a batch has
+	// arrived. If zero, a batch contains only the ops that have already been
+	// received from the kernel, so that no op is delayed.
+	MaxDelay time.Duration
+}
+
+// Create a fuse.Server that behaves like the one returned by
+// NewFileSystemServer, except that ReadFileOp and WriteFileOp are collected
+// into batches as they arrive and handed to the file system's HandleBatch
+// method. Other ops are dispatched individually as usual, without waiting for
+// a batch to finish.
+//
+// Batching pays off only when the kernel has several reads or writes in
+// flight at once, e.g. with fuse.MountConfig.EnableAsyncReads or writeback
+// caching.
+func NewBatchingFileSystemServer(
+	fs BatchingFileSystem,
+	window BatchWindow) fuse.Server {
+	if window.MaxOps <= 0 {
+		window.MaxOps = 64
+	}
+
+	return &batchingFileSystemServer{
+		fileSystemServer: newFileSystemServer(fs),
+		bfs:              fs,
+		window:           window,
+	}
+}
+
+type batchingFileSystemServer struct {
+	*fileSystemServer
+	bfs    BatchingFileSystem
+	window BatchWindow
+}
+
+func isBatchable(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.ReadFileOp, *fuseops.WriteFileOp:
+		return true
+	}
+
+	return false
+}
+
+func (s *batchingFileSystemServer) ServeOps(c *fuse.Connection) {
+	defer func() {
+		s.opsInFlight.Wait()
+		s.fs.Destroy()
+	}()
+
+	// Read from the kernel on a separate goroutine, so that we can tell which
+	// ops are ready without blocking.
+	ops := make(chan BatchedOp, s.window.MaxOps)
+	go func() {
+		defer close(ops)
+		for {
+			// Stop at EOF, or at any other error reading from the kernel, leaving
+			// the ops already read to be handled below.
+			ctx, op, err := c.ReadOp()
+			if err != nil {
+				return
+			}
+
+			ops <- BatchedOp{Ctx: ctx, Op: op}
+		}
+	}()
+
+	for o := range ops {
+		if !isBatchable(o.Op) {
+			s.dispatch(c, o.Ctx, o.Op)
+			continue
+		}
+
+		// Reads answered straight away needn't wait for a batch.
+		if s.tryFastPath(c, o.Ctx, o.Op) {
+			continue
+		}
+
+		batch, closed := s.collectBatch(c, o, ops)
+		s.opsInFlight.Add(1)
+		go s.handleBatch(c, batch)
+
+		if closed {
+			break
+		}
+	}
+}
+
+// Gather further batchable ops to go with first, dispatching any others that
+// arrive in the meantime. Return true if the channel was closed.
+func (s *batchingFileSystemServer) collectBatch(
+	c *fuse.Connection,
+	first BatchedOp,
+	ops <-chan BatchedOp) (batch []BatchedOp, closed bool) {
+	batch = []BatchedOp{first}
+
+	var deadline <-chan time.Time
+	if s.window.MaxDelay > 0 {
+		t := time.NewTimer(s.window.MaxDelay)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	for len(batch) < s.window.MaxOps {
+		var o BatchedOp
+		var ok bool
+
+		if deadline == nil {
+			select {
+			case o, ok = <-ops:
+			default:
+				return batch, false
+			}
+		} else {
+			select {
+			case o, ok = <-ops:
+			case <-deadline:
+				return batch, false
+			}
+		}
+
+		if !ok {
+			return batch, true
+		}
+
+		switch {
+		case !isBatchable(o.Op):
+			s.dispatch(c, o.Ctx, o.Op)
+
+		case !s.tryFastPath(c, o.Ctx, o.Op):
+			batch = append(batch, o)
+		}
+	}
+
+	return batch, false
+}
+
+func (s *batchingFileSystemServer) handleBatch(
+	c *fuse.Connection,
+	batch []BatchedOp) {
+	defer s.opsInFlight.Done()
+
+	// Hold back writes while the file system is frozen.
+	admitted := batch[:0]
+	for _, o := range batch {
+		if err := c.WaitForThaw(o.Ctx, o.Op); err != nil {
+			c.Reply(o.Ctx, err)
+			continue
+		}
+
+		admitted = append(admitted, o)
+	}
+
+	batch = admitted
+	if len(batch) == 0 {
+		return
+	}
+
+	errs := s.bfs.HandleBatch(batch)
+	for i, o := range batch {
+		err := error(fuse.EIO)
+		if i < len(errs) {
+			err = errs[i]
+		}
+
+		c.Reply(o.Ctx, err)
+	}
+}
@@ -0,0 +1,539 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// Options for NewCachingFileSystem.
+type CacheConfig struct {
+	// How long results are reused for. Defaults to one second.
+	TTL time.Duration
+
+	// The most results kept at once, counting entries, attributes and
+	// directory reads alike. Expired results are dropped to make room, then
+	// others at random. Defaults to 10000.
+	MaxEntries int
+
+	// Defaults to timeutil.RealClock().
+	Clock timeutil.Clock
+}
+
+// Create a file system that remembers the results of the wrapped file
+// system's LookUpInode, GetInodeAttributes and ReadDir methods for a while,
+// and answers the same ops from memory in the meantime. This spares slow
+// backends the requests the kernel repeats once its own caches expire, or
+// sends for each handle opened on a directory.
+//
+// Results are dropped when ops made through the file system change what they
+// describe: attribute changes, writes and extended attribute changes for the
+// inode, and the creation, removal or renaming of entries for the entries and
+// their parent directories. Changes made in the backend by other means are
+// only seen once results expire.
+//
+// Directory reads are reused across handles, so the wrapped file system must
+// answer ReadDirOp from the inode and offset alone. Lookups answered from
+// memory are counted on the wrapped file system's behalf, and the
+// corresponding forgets withheld from it, so that its lookup counts stay
+// right.
+func NewCachingFileSystem(
+	wrapped FileSystem,
+	cfg CacheConfig) FileSystem {
+	if cfg.TTL <= 0 {
+		cfg.TTL = time.Second
+	}
+
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = 10000
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = timeutil.RealClock()
+	}
+
+	return &cachingFileSystem{
+		FileSystem: wrapped,
+		cfg:        cfg,
+		entries:    make(map[cachedName]cachedEntry),
+		attrs:      make(map[fuseops.InodeID]cachedAttrs),
+		listings:   make(map[cachedRead]cachedListing),
+		served:     make(map[fuseops.InodeID]uint64),
+	}
+}
+
+type cachedName struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+type cachedEntry struct {
+	entry   fuseops.ChildInodeEntry
+	expires time.Time
+}
+
+type cachedAttrs struct {
+	attrs           fuseops.InodeAttributes
+	attrsExpiration time.Time
+	expires         time.Time
+}
+
+type cachedRead struct {
+	inode  fuseops.InodeID
+	offset fuseops.DirOffset
+	size   int
+}
+
+type cachedListing struct {
+	data    []byte
+	expires time.Time
+}
+
+type cachingFileSystem struct {
+	FileSystem
+	cfg CacheConfig
+
+	mu sync.Mutex
+
+	// The results remembered.
+	//
+	// GUARDED_BY(mu)
+	entries  map[cachedName]cachedEntry
+	attrs    map[fuseops.InodeID]cachedAttrs
+	listings map[cachedRead]cachedListing
+
+	// Incremented whenever results are dropped, so that results obtained from
+	// the wrapped file system meanwhile, which may predate the change, aren't
+	// remembered.
+	//
+	// GUARDED_BY(mu)
+	gen uint64
+
+	// The number of lookups of each inode answered from memory, which the
+	// kernel will forget but the wrapped file system doesn't know of.
+	//
+	// GUARDED_BY(mu)
+	served map[fuseops.InodeID]uint64
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cachingFileSystem) generation() uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.gen
+}
+
+// Return whether a result obtained from the wrapped file system since the
+// supplied generation may be remembered, making room for it if so.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *cachingFileSystem) admit(gen uint64, now time.Time) bool {
+	if gen != fs.gen {
+		return false
+	}
+
+	if len(fs.entries)+len(fs.attrs)+len(fs.listings) < fs.cfg.MaxEntries {
+		return true
+	}
+
+	for k, e := range fs.entries {
+		if !now.Before(e.expires) {
+			delete(fs.entries, k)
+		}
+	}
+
+	for k, a := range fs.attrs {
+		if !now.Before(a.expires) {
+			delete(fs.attrs, k)
+		}
+	}
+
+	for k, l := range fs.listings {
+		if !now.Before(l.expires) {
+			delete(fs.listings, k)
+		}
+	}
+
+	// Map iteration order being random, this drops arbitrary results.
+	for len(fs.entries)+len(fs.attrs)+len(fs.listings) >= fs.cfg.MaxEntries {
+		for k := range fs.entries {
+			delete(fs.entries, k)
+			break
+		}
+
+		for k := range fs.attrs {
+			delete(fs.attrs, k)
+			break
+		}
+
+		for k := range fs.listings {
+			delete(fs.listings, k)
+			break
+		}
+	}
+
+	return true
+}
+
+// Drop what is remembered about an inode: its attributes, its listing if a
+// directory, and the entries naming it.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cachingFileSystem) invalidateInode(id fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.dropInode(id)
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *cachingFileSystem) dropInode(id fuseops.InodeID) {
+	fs.gen++
+	delete(fs.attrs, id)
+
+	for k := range fs.listings {
+		if k.inode == id {
+			delete(fs.listings, k)
+		}
+	}
+
+	for k, e := range fs.entries {
+		if e.entry.Child == id {
+			delete(fs.entries, k)
+		}
+	}
+}
+
+// Drop what is remembered about an entry of a directory, the inode it named
+// and the directory itself.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cachingFileSystem) invalidateName(
+	parent fuseops.InodeID,
+	name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	k := cachedName{parent, name}
+	if e, ok := fs.entries[k]; ok {
+		delete(fs.entries, k)
+		fs.dropInode(e.entry.Child)
+	}
+
+	fs.dropInode(parent)
+}
+
+// Withhold from a forget of n lookups of an inode those answered from memory,
+// returning how many remain to be passed on.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *cachingFileSystem) forget(id fuseops.InodeID, n uint64) uint64 {
+	s := fs.served[id]
+	if s > n {
+		fs.served[id] = s - n
+		return 0
+	}
+
+	delete(fs.served, id)
+	if n -= s; n != 0 {
+		// The wrapped file system may be done with the inode, and reuse its ID.
+		fs.dropInode(id)
+	}
+
+	return n
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cachingFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	k := cachedName{op.Parent, op.Name}
+	now := fs.cfg.Clock.Now()
+
+	fs.mu.Lock()
+	if e, ok := fs.entries[k]; ok && now.Before(e.expires) {
+		fs.served[e.entry.Child]++
+		op.Entry = e.entry
+		fs.mu.Unlock()
+		return nil
+	}
+
+	gen := fs.gen
+	fs.mu.Unlock()
+
+	if err := fs.FileSystem.LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.admit(gen, now) {
+		fs.entries[k] = cachedEntry{op.Entry, now.Add(fs.cfg.TTL)}
+	}
+
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cachingFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	now := fs.cfg.Clock.Now()
+
+	fs.mu.Lock()
+	if a, ok := fs.attrs[op.Inode]; ok && now.Before(a.expires) {
+		op.Attributes = a.attrs
+		op.AttributesExpiration = a.attrsExpiration
+		fs.mu.Unlock()
+		return nil
+	}
+
+	gen := fs.gen
+	fs.mu.Unlock()
+
+	if err := fs.FileSystem.GetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.admit(gen, now) {
+		fs.attrs[op.Inode] = cachedAttrs{
+			attrs:           op.Attributes,
+			attrsExpiration: op.AttributesExpiration,
+			expires:         now.Add(fs.cfg.TTL),
+		}
+	}
+
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cachingFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	k := cachedRead{op.Inode, op.Offset, len(op.Dst)}
+	now := fs.cfg.Clock.Now()
+
+	fs.mu.Lock()
+	if l, ok := fs.listings[k]; ok && now.Before(l.expires) {
+		op.BytesRead = copy(op.Dst, l.data)
+		fs.mu.Unlock()
+		return nil
+	}
+
+	gen := fs.gen
+	fs.mu.Unlock()
+
+	if err := fs.FileSystem.ReadDir(ctx, op); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.admit(gen, now) {
+		data := append([]byte(nil), op.Dst[:op.BytesRead]...)
+		fs.listings[k] = cachedListing{data, now.Add(fs.cfg.TTL)}
+	}
+
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cachingFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	n := fs.forget(op.Inode, op.N)
+	fs.mu.Unlock()
+
+	if n == 0 {
+		return nil
+	}
+
+	withheld := op.N
+	op.N = n
+	defer func() { op.N = withheld }()
+
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cachingFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	var entries []fuseops.BatchForgetEntry
+
+	fs.mu.Lock()
+	for _, e := range op.Entries {
+		if e.N = fs.forget(e.Inode, e.N); e.N != 0 {
+			entries = append(entries, e)
+		}
+	}
+	fs.mu.Unlock()
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	all := op.Entries
+	op.Entries = entries
+	defer func() { op.Entries = all }()
+
+	// Dispatch would fall back to ForgetInode with all the entries, so do it
+	// here with those left.
+	err := fs.FileSystem.BatchForget(ctx, op)
+	if err == fuse.ENOSYS {
+		for _, e := range entries {
+			err = fs.FileSystem.ForgetInode(ctx, &fuseops.ForgetInodeOp{
+				Inode:     e.Inode,
+				N:         e.N,
+				OpContext: op.OpContext,
+			})
+
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	return err
+}
+
+func (fs *cachingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	defer fs.invalidateInode(op.Inode)
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+func (fs *cachingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	defer fs.invalidateInode(op.Inode)
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+func (fs *cachingFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	defer fs.invalidateInode(op.Inode)
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *cachingFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	defer fs.invalidateInode(op.Inode)
+	return fs.FileSystem.SetXattr(ctx, op)
+}
+
+func (fs *cachingFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	defer fs.invalidateInode(op.Inode)
+	return fs.FileSystem.RemoveXattr(ctx, op)
+}
+
+func (fs *cachingFileSystem) SetInodeFlags(
+	ctx context.Context,
+	op *fuseops.SetInodeFlagsOp) error {
+	defer fs.invalidateInode(op.Inode)
+	return fs.FileSystem.SetInodeFlags(ctx, op)
+}
+
+// Ioctls may change anything about an inode, its flags included.
+func (fs *cachingFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	defer fs.invalidateInode(op.Inode)
+	return fs.FileSystem.Ioctl(ctx, op)
+}
+
+func (fs *cachingFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	defer fs.invalidateName(op.Parent, op.Name)
+	return fs.FileSystem.MkDir(ctx, op)
+}
+
+func (fs *cachingFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	defer fs.invalidateName(op.Parent, op.Name)
+	return fs.FileSystem.MkNode(ctx, op)
+}
+
+func (fs *cachingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	defer fs.invalidateName(op.Parent, op.Name)
+	return fs.FileSystem.CreateFile(ctx, op)
+}
+
+func (fs *cachingFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	defer fs.invalidateName(op.Parent, op.Name)
+	return fs.FileSystem.CreateSymlink(ctx, op)
+}
+
+func (fs *cachingFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	defer fs.invalidateInode(op.Target)
+	defer fs.invalidateName(op.Parent, op.Name)
+	return fs.FileSystem.CreateLink(ctx, op)
+}
+
+func (fs *cachingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	defer fs.invalidateName(op.NewParent, op.NewName)
+	defer fs.invalidateName(op.OldParent, op.OldName)
+	return fs.FileSystem.Rename(ctx, op)
+}
+
+func (fs *cachingFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	defer fs.invalidateName(op.Parent, op.Name)
+	return fs.FileSystem.RmDir(ctx, op)
+}
+
+func (fs *cachingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	defer fs.invalidateName(op.Parent, op.Name)
+	return fs.FileSystem.Unlink(ctx, op)
+}
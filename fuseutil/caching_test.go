@@ -0,0 +1,190 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+// A file system in which every name exists, as inode 17, counting the ops it
+// is sent.
+type countingFS struct {
+	fuseutil.NotImplementedFileSystem
+	lookUps   int
+	getAttrs  int
+	forgotten uint64
+}
+
+func (fs *countingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.lookUps++
+	op.Entry.Child = 17
+	return nil
+}
+
+func (fs *countingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.getAttrs++
+	op.Attributes.Size = uint64(fs.getAttrs)
+	return nil
+}
+
+func (fs *countingFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.forgotten += op.N
+	return nil
+}
+
+func (fs *countingFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return nil
+}
+
+func (fs *countingFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return nil
+}
+
+func (fs *countingFS) SetInodeFlags(
+	ctx context.Context,
+	op *fuseops.SetInodeFlagsOp) error {
+	return nil
+}
+
+func (fs *countingFS) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	return nil
+}
+
+func TestCachingFileSystem(t *testing.T) {
+	ctx := context.Background()
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC))
+
+	wrapped := &countingFS{}
+	fs := fuseutil.NewCachingFileSystem(wrapped, fuseutil.CacheConfig{
+		TTL:   time.Second,
+		Clock: &clock,
+	})
+
+	lookUp := func() {
+		op := &fuseops.LookUpInodeOp{Parent: 1, Name: "taco"}
+		if err := fs.LookUpInode(ctx, op); err != nil || op.Entry.Child != 17 {
+			t.Fatalf("LookUpInode: %v, %+v", err, op.Entry)
+		}
+	}
+
+	getAttrs := func() uint64 {
+		op := &fuseops.GetInodeAttributesOp{Inode: 17}
+		if err := fs.GetInodeAttributes(ctx, op); err != nil {
+			t.Fatalf("GetInodeAttributes: %v", err)
+		}
+
+		return op.Attributes.Size
+	}
+
+	// Results are reused until they expire.
+	lookUp()
+	lookUp()
+	if size := getAttrs(); size != 1 || getAttrs() != 1 {
+		t.Errorf("Attributes not reused: size %v", size)
+	}
+
+	if wrapped.lookUps != 1 || wrapped.getAttrs != 1 {
+		t.Errorf("Wrapped file system saw %d lookups, %d getattrs", wrapped.lookUps, wrapped.getAttrs)
+	}
+
+	clock.AdvanceTime(time.Second)
+	lookUp()
+	if size := getAttrs(); size != 2 {
+		t.Errorf("Attributes after expiring: size %v", size)
+	}
+
+	// Or until changed through the file system.
+	err := fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: 17})
+	if err != nil {
+		t.Fatalf("SetInodeAttributes: %v", err)
+	}
+
+	if size := getAttrs(); size != 3 {
+		t.Errorf("Attributes after changing: size %v", size)
+	}
+
+	// Including their flags.
+	err = fs.SetInodeFlags(ctx, &fuseops.SetInodeFlagsOp{Inode: 17, Flags: fuseops.InodeImmutable})
+	if err != nil {
+		t.Fatalf("SetInodeFlags: %v", err)
+	}
+
+	if size := getAttrs(); size != 4 {
+		t.Errorf("Attributes after setting flags: size %v", size)
+	}
+
+	if err := fs.Ioctl(ctx, &fuseops.IoctlOp{Inode: 17}); err != nil {
+		t.Fatalf("Ioctl: %v", err)
+	}
+
+	if size := getAttrs(); size != 5 {
+		t.Errorf("Attributes after an ioctl: size %v", size)
+	}
+
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "taco"}); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	lookUp()
+	if wrapped.lookUps != 3 {
+		t.Errorf("Wrapped file system saw %d lookups", wrapped.lookUps)
+	}
+
+	// The lookup answered from memory is withheld from forgets.
+	err = fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: 17, N: 4})
+	if err != nil {
+		t.Fatalf("ForgetInode: %v", err)
+	}
+
+	if wrapped.forgotten != 3 {
+		t.Errorf("Wrapped file system forgot %d lookups", wrapped.forgotten)
+	}
+
+	// Including by batches the wrapped file system handles one by one.
+	lookUp()
+	clock.AdvanceTime(time.Second)
+	lookUp()
+	lookUp()
+
+	err = fs.BatchForget(ctx, &fuseops.BatchForgetOp{
+		Entries: []fuseops.BatchForgetEntry{{Inode: 17, N: 3}},
+	})
+	if err != nil {
+		t.Fatalf("BatchForget: %v", err)
+	}
+
+	if wrapped.forgotten != 5 {
+		t.Errorf("Wrapped file system forgot %d lookups", wrapped.forgotten)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Options for NewChangeDetectingFileSystem.
+type ChangeDetectionConfig struct {
+	// Return an identifier of the version of the inode's contents in the
+	// backend, such as an HTTP ETag, given the attributes the wrapped file
+	// system returned for it. Defaults to one made of the modification time
+	// and size.
+	Version func(inode fuseops.InodeID, attrs fuseops.InodeAttributes) string
+
+	// Called when the backend is found to have changed an inode behind the
+	// kernel's back, to drop the kernel's caches of it; typically calls
+	// MountedFileSystem.InvalidateInode(inode, 0, 0). Required. It is called on
+	// a goroutine of its own, since the kernel may wait on ops of the file
+	// system while invalidating.
+	Invalidate func(inode fuseops.InodeID)
+}
+
+// ChangeDetectingFileSystem notices the changes made to the backend by other
+// clients, which network file systems must otherwise poll for, by comparing
+// versions of inodes' contents each time their attributes are fetched. See
+// NewChangeDetectingFileSystem.
+type ChangeDetectingFileSystem struct {
+	FileSystem
+	cfg ChangeDetectionConfig
+
+	mu sync.Mutex
+
+	// What is known of the inodes the kernel knows of.
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*inodeVersion
+}
+
+type inodeVersion struct {
+	// The version last seen, unless changed through the file system since.
+	version string
+	known   bool
+
+	// The number of changes made by other clients detected so far.
+	generation uint64
+}
+
+// Create a file system that compares the version of each inode whose
+// attributes the wrapped file system returns, for LookUpInodeOp and
+// GetInodeAttributesOp, with the one last seen. When they differ, the inode's
+// generation is bumped and the kernel's caches of it dropped, so that reads
+// see the new contents rather than stale cached pages.
+//
+// Versions changing due to ops made through the file system, i.e. writes,
+// attribute changes and preallocation, aren't taken for changes by other
+// clients: the version seen next becomes the one compared with.
+func NewChangeDetectingFileSystem(
+	wrapped FileSystem,
+	cfg ChangeDetectionConfig) *ChangeDetectingFileSystem {
+	if cfg.Version == nil {
+		cfg.Version = func(
+			inode fuseops.InodeID,
+			attrs fuseops.InodeAttributes) string {
+			return fmt.Sprintf("%d-%d", attrs.Mtime.UnixNano(), attrs.Size)
+		}
+	}
+
+	return &ChangeDetectingFileSystem{
+		FileSystem: wrapped,
+		cfg:        cfg,
+		inodes:     make(map[fuseops.InodeID]*inodeVersion),
+	}
+}
+
+// Generation returns the number of changes made to the inode by other clients
+// that have been detected since the kernel learned of it, e.g. for the file
+// system to tell its own cached data apart from newer data.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *ChangeDetectingFileSystem) Generation(inode fuseops.InodeID) uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if v := fs.inodes[inode]; v != nil {
+		return v.generation
+	}
+
+	return 0
+}
+
+// Compare the version of the inode described by attrs with the one last
+// seen, and invalidate it if they differ.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *ChangeDetectingFileSystem) observe(
+	id fuseops.InodeID,
+	attrs fuseops.InodeAttributes) {
+	version := fs.cfg.Version(id, attrs)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	v := fs.inodes[id]
+	switch {
+	case v == nil:
+		fs.inodes[id] = &inodeVersion{version: version, known: true}
+
+	case !v.known:
+		v.version = version
+		v.known = true
+
+	case v.version != version:
+		v.version = version
+		v.generation++
+		go fs.cfg.Invalidate(id)
+	}
+}
+
+// Note that the inode is being changed through the file system, so that the
+// version seen next is taken as it is.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *ChangeDetectingFileSystem) changing(id fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if v := fs.inodes[id]; v != nil {
+		v.known = false
+	}
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *ChangeDetectingFileSystem) forget(ids ...fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, id := range ids {
+		delete(fs.inodes, id)
+	}
+}
+
+func (fs *ChangeDetectingFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := fs.FileSystem.LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.observe(op.Entry.Child, op.Entry.Attributes)
+	return nil
+}
+
+func (fs *ChangeDetectingFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if err := fs.FileSystem.GetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	fs.observe(op.Inode, op.Attributes)
+	return nil
+}
+
+func (fs *ChangeDetectingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.changing(op.Inode)
+	if err := fs.FileSystem.SetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	fs.observe(op.Inode, op.Attributes)
+	return nil
+}
+
+func (fs *ChangeDetectingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.changing(op.Inode)
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+func (fs *ChangeDetectingFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	fs.changing(op.Inode)
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *ChangeDetectingFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.forget(op.Inode)
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+func (fs *ChangeDetectingFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		fs.forget(e.Inode)
+	}
+
+	return fs.FileSystem.BatchForget(ctx, op)
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A file system with a single file, inode 17, whose size is that of the
+// file in the backend.
+type sizedFS struct {
+	fuseutil.NotImplementedFileSystem
+	size uint64
+}
+
+func (fs *sizedFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes.Size = fs.size
+	return nil
+}
+
+func (fs *sizedFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.size += uint64(len(op.Data))
+	return nil
+}
+
+func TestChangeDetectingFileSystem(t *testing.T) {
+	ctx := context.Background()
+	backend := &sizedFS{size: 4}
+	invalidated := make(chan fuseops.InodeID, 1)
+	fs := fuseutil.NewChangeDetectingFileSystem(backend, fuseutil.ChangeDetectionConfig{
+		Invalidate: func(inode fuseops.InodeID) { invalidated <- inode },
+	})
+
+	getAttrs := func() {
+		if err := fs.GetInodeAttributes(ctx, &fuseops.GetInodeAttributesOp{Inode: 17}); err != nil {
+			t.Fatalf("GetInodeAttributes: %v", err)
+		}
+	}
+
+	expectNone := func(when string) {
+		select {
+		case inode := <-invalidated:
+			t.Errorf("Inode %v invalidated %s", inode, when)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	// Nothing is invalidated while the backend doesn't change.
+	getAttrs()
+	getAttrs()
+	expectNone("without changes")
+
+	// Or when it is changed through the file system.
+	if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 17, Data: []byte("taco")}); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	getAttrs()
+	expectNone("after writing")
+
+	// Changes by other clients are.
+	backend.size = 100
+	getAttrs()
+
+	select {
+	case inode := <-invalidated:
+		if inode != 17 {
+			t.Errorf("Invalidated inode %v", inode)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Nothing invalidated after a change")
+	}
+
+	if g := fs.Generation(17); g != 1 {
+		t.Errorf("Generation %v", g)
+	}
+}
@@ -0,0 +1,581 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// ErrChangesTruncated is returned by ChangeJournal.Since when changes made
+// after the supplied sequence number have already been discarded. The caller
+// must fall back to a full scan.
+var ErrChangesTruncated = errors.New("changes no longer in the journal")
+
+// The kinds of change recorded in a ChangeJournal.
+type ChangeKind int
+
+const (
+	// A file, directory, device, symlink or hard link was created.
+	ChangeCreate ChangeKind = iota
+
+	// The contents, attributes or extended attributes of an inode changed.
+	ChangeModify
+
+	// An entry was renamed.
+	ChangeRename
+
+	// An entry was unlinked or a directory removed.
+	ChangeDelete
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeCreate:
+		return "create"
+	case ChangeModify:
+		return "modify"
+	case ChangeRename:
+		return "rename"
+	case ChangeDelete:
+		return "delete"
+	}
+
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+// A change recorded in a ChangeJournal.
+type Change struct {
+	// Increases by one with each change recorded.
+	Seq uint64
+
+	Kind ChangeKind
+	Time time.Time
+
+	// The inode changed, or zero for a deletion of an entry whose inode the
+	// kernel had not looked up.
+	Inode fuseops.InodeID
+
+	// The path of the entry from the root of the file system, after the change
+	// for renames. Empty if it isn't known, e.g. because the inode modified was
+	// never reached by a lookup, or has been unlinked.
+	// An inode with several hard links is known by the name through which it
+	// was last reached.
+	Path string
+
+	// The path of the entry before a rename.
+	OldPath string
+}
+
+// Options for NewChangeJournal.
+type ChangeJournalConfig struct {
+	// The number of changes retained. Defaults to 65536.
+	MaxChanges int
+
+	// Defaults to timeutil.RealClock().
+	Clock timeutil.Clock
+}
+
+// A ChangeJournal is an append-only record of the changes made through a file
+// system created by NewChangeJournalingFileSystem, so that backup and sync
+// tools working above the mount can scan incrementally rather than walk the
+// tree. The oldest changes are discarded once MaxChanges are retained.
+//
+// Consecutive modifications of the same inode are recorded once, as the tools
+// only need to know that it changed since they last looked.
+type ChangeJournal struct {
+	cfg ChangeJournalConfig
+
+	mu sync.Mutex
+
+	// The retained changes, oldest first, and the sequence number of the
+	// latest one.
+	//
+	// GUARDED_BY(mu)
+	changes []Change
+	lastSeq uint64
+}
+
+// Create an empty journal.
+func NewChangeJournal(cfg ChangeJournalConfig) *ChangeJournal {
+	if cfg.MaxChanges <= 0 {
+		cfg.MaxChanges = 65536
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = timeutil.RealClock()
+	}
+
+	return &ChangeJournal{cfg: cfg}
+}
+
+// LOCKS_EXCLUDED(j.mu)
+func (j *ChangeJournal) record(c Change) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if n := len(j.changes); n != 0 && c.Kind == ChangeModify {
+		last := j.changes[n-1]
+		if last.Kind == ChangeModify && last.Inode == c.Inode {
+			return
+		}
+	}
+
+	if len(j.changes) == j.cfg.MaxChanges {
+		copy(j.changes, j.changes[1:])
+		j.changes = j.changes[:len(j.changes)-1]
+	}
+
+	j.lastSeq++
+	c.Seq = j.lastSeq
+	c.Time = j.cfg.Clock.Now()
+	j.changes = append(j.changes, c)
+}
+
+// LastSeq returns the sequence number of the latest change recorded, or zero
+// if there is none. A tool starting a full scan should note it first, and ask
+// for the changes since then afterwards.
+//
+// LOCKS_EXCLUDED(j.mu)
+func (j *ChangeJournal) LastSeq() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.lastSeq
+}
+
+// Since returns the changes recorded after the one with the supplied sequence
+// number, oldest first. It returns ErrChangesTruncated if some of them have
+// been discarded.
+//
+// LOCKS_EXCLUDED(j.mu)
+func (j *ChangeJournal) Since(seq uint64) ([]Change, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if seq >= j.lastSeq {
+		return nil, nil
+	}
+
+	first := j.lastSeq - uint64(len(j.changes)) + 1
+	if seq+1 < first {
+		return nil, ErrChangesTruncated
+	}
+
+	return append([]Change(nil), j.changes[seq+1-first:]...), nil
+}
+
+// ControlFile returns a control file with the supplied name, for use with
+// NewControlFileSystem, listing the retained changes one per line, oldest
+// first, as the sequence number, kind, inode, quoted path and, for renames,
+// quoted old path, separated by spaces.
+func (j *ChangeJournal) ControlFile(name string) ControlFile {
+	return ControlFile{
+		Name: name,
+		Read: func(ctx context.Context, opCtx fuseops.OpContext) ([]byte, error) {
+			j.mu.Lock()
+			changes := append([]Change(nil), j.changes...)
+			j.mu.Unlock()
+
+			var buf bytes.Buffer
+			for _, c := range changes {
+				fmt.Fprintf(&buf, "%d %v %d %q", c.Seq, c.Kind, c.Inode, c.Path)
+				if c.Kind == ChangeRename {
+					fmt.Fprintf(&buf, " %q", c.OldPath)
+				}
+
+				buf.WriteByte('\n')
+			}
+
+			return buf.Bytes(), nil
+		},
+	}
+}
+
+// Create a file system that records the changes made through it in the
+// supplied journal, once the wrapped file system has made them. Paths are
+// learned from lookups and creations.
+func NewChangeJournalingFileSystem(
+	wrapped FileSystem,
+	j *ChangeJournal) FileSystem {
+	return &changeJournalingFileSystem{
+		FileSystem: wrapped,
+		journal:    j,
+		names:      make(map[fuseops.InodeID]*journaledName),
+		children:   make(map[journaledEntry]fuseops.InodeID),
+	}
+}
+
+type changeJournalingFileSystem struct {
+	FileSystem
+	journal *ChangeJournal
+
+	mu sync.Mutex
+
+	// The last known name of each inode the kernel knows, other than the root,
+	// and the inverse mapping.
+	//
+	// GUARDED_BY(mu)
+	names    map[fuseops.InodeID]*journaledName
+	children map[journaledEntry]fuseops.InodeID
+}
+
+type journaledEntry struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+type journaledName struct {
+	journaledEntry
+
+	// The kernel's lookup count for the inode.
+	lookupCount uint64
+}
+
+// Return the path of the inode, or the empty string if it isn't known.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *changeJournalingFileSystem) path(id fuseops.InodeID) string {
+	if id == fuseops.RootInodeID {
+		return "/"
+	}
+
+	n := fs.names[id]
+	if n == nil {
+		return ""
+	}
+
+	dir := fs.path(n.parent)
+	if dir == "" {
+		return ""
+	}
+
+	return path.Join(dir, n.name)
+}
+
+// Return the path of the named child of the directory, or the empty string if
+// the directory's path isn't known.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *changeJournalingFileSystem) childPath(
+	parent fuseops.InodeID,
+	name string) string {
+	dir := fs.path(parent)
+	if dir == "" {
+		return ""
+	}
+
+	return path.Join(dir, name)
+}
+
+// Return the inode known by the named child of the directory, if any.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *changeJournalingFileSystem) child(
+	parent fuseops.InodeID,
+	name string) (fuseops.InodeID, bool) {
+	id, ok := fs.children[journaledEntry{parent, name}]
+	return id, ok
+}
+
+// Give the inode a new name.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *changeJournalingFileSystem) rename(
+	id fuseops.InodeID,
+	e journaledEntry) {
+	n := fs.names[id]
+	if fs.children[n.journaledEntry] == id {
+		delete(fs.children, n.journaledEntry)
+	}
+
+	n.journaledEntry = e
+	fs.children[e] = id
+}
+
+// Forget the inode's name.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *changeJournalingFileSystem) drop(id fuseops.InodeID) {
+	if n := fs.names[id]; n != nil && fs.children[n.journaledEntry] == id {
+		delete(fs.children, n.journaledEntry)
+	}
+
+	delete(fs.names, id)
+}
+
+// Record that the kernel looked up the child of the directory, and return its
+// path.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *changeJournalingFileSystem) learn(
+	parent fuseops.InodeID,
+	name string,
+	child fuseops.InodeID) string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n := fs.names[child]
+	if n == nil {
+		n = &journaledName{}
+		fs.names[child] = n
+	}
+
+	fs.rename(child, journaledEntry{parent, name})
+	n.lookupCount++
+
+	return fs.path(child)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *changeJournalingFileSystem) forget(id fuseops.InodeID, count uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n := fs.names[id]
+	if n == nil {
+		return
+	}
+
+	if n.lookupCount <= count {
+		fs.drop(id)
+		return
+	}
+
+	n.lookupCount -= count
+}
+
+// Record a creation once it has succeeded.
+func (fs *changeJournalingFileSystem) created(
+	parent fuseops.InodeID,
+	name string,
+	child fuseops.InodeID,
+	err error) error {
+	if err != nil {
+		return err
+	}
+
+	fs.journal.record(Change{
+		Kind:  ChangeCreate,
+		Inode: child,
+		Path:  fs.learn(parent, name, child),
+	})
+
+	return nil
+}
+
+// Record a modification once it has succeeded.
+func (fs *changeJournalingFileSystem) modified(
+	id fuseops.InodeID,
+	err error) error {
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	p := fs.path(id)
+	fs.mu.Unlock()
+
+	fs.journal.record(Change{
+		Kind:  ChangeModify,
+		Inode: id,
+		Path:  p,
+	})
+
+	return nil
+}
+
+func (fs *changeJournalingFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := fs.FileSystem.LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.learn(op.Parent, op.Name, op.Entry.Child)
+	return nil
+}
+
+func (fs *changeJournalingFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.forget(op.Inode, op.N)
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+func (fs *changeJournalingFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	// On ENOSYS the entries come back to ForgetInode one by one.
+	err := fs.FileSystem.BatchForget(ctx, op)
+	if err == nil {
+		for _, entry := range op.Entries {
+			fs.forget(entry.Inode, entry.N)
+		}
+	}
+
+	return err
+}
+
+func (fs *changeJournalingFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	err := fs.FileSystem.MkDir(ctx, op)
+	return fs.created(op.Parent, op.Name, op.Entry.Child, err)
+}
+
+func (fs *changeJournalingFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	err := fs.FileSystem.MkNode(ctx, op)
+	return fs.created(op.Parent, op.Name, op.Entry.Child, err)
+}
+
+func (fs *changeJournalingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	err := fs.FileSystem.CreateFile(ctx, op)
+	return fs.created(op.Parent, op.Name, op.Entry.Child, err)
+}
+
+func (fs *changeJournalingFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	err := fs.FileSystem.CreateSymlink(ctx, op)
+	return fs.created(op.Parent, op.Name, op.Entry.Child, err)
+}
+
+func (fs *changeJournalingFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	err := fs.FileSystem.CreateLink(ctx, op)
+	return fs.created(op.Parent, op.Name, op.Entry.Child, err)
+}
+
+func (fs *changeJournalingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	// The journal has no way of recording exchanges and whiteouts.
+	if op.Flags&^fuseops.RenameNoReplace != 0 {
+		return syscall.EINVAL
+	}
+
+	if err := fs.FileSystem.Rename(ctx, op); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	c := Change{
+		Kind:    ChangeRename,
+		Path:    fs.childPath(op.NewParent, op.NewName),
+		OldPath: fs.childPath(op.OldParent, op.OldName),
+	}
+
+	// The entry replaced by the rename, if any, is gone.
+	if id, ok := fs.child(op.NewParent, op.NewName); ok {
+		fs.drop(id)
+	}
+
+	if id, ok := fs.child(op.OldParent, op.OldName); ok {
+		c.Inode = id
+		fs.rename(id, journaledEntry{op.NewParent, op.NewName})
+	}
+	fs.mu.Unlock()
+
+	fs.journal.record(c)
+	return nil
+}
+
+// Record the removal of the named child of the directory.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *changeJournalingFileSystem) removed(
+	parent fuseops.InodeID,
+	name string) {
+	fs.mu.Lock()
+	c := Change{
+		Kind: ChangeDelete,
+		Path: fs.childPath(parent, name),
+	}
+
+	if id, ok := fs.child(parent, name); ok {
+		c.Inode = id
+		fs.drop(id)
+	}
+	fs.mu.Unlock()
+
+	fs.journal.record(c)
+}
+
+func (fs *changeJournalingFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	if err := fs.FileSystem.RmDir(ctx, op); err != nil {
+		return err
+	}
+
+	fs.removed(op.Parent, op.Name)
+	return nil
+}
+
+func (fs *changeJournalingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if err := fs.FileSystem.Unlink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.removed(op.Parent, op.Name)
+	return nil
+}
+
+func (fs *changeJournalingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.modified(op.Inode, fs.FileSystem.WriteFile(ctx, op))
+}
+
+func (fs *changeJournalingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return fs.modified(op.Inode, fs.FileSystem.SetInodeAttributes(ctx, op))
+}
+
+func (fs *changeJournalingFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return fs.modified(op.Inode, fs.FileSystem.Fallocate(ctx, op))
+}
+
+func (fs *changeJournalingFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return fs.modified(op.Inode, fs.FileSystem.SetXattr(ctx, op))
+}
+
+func (fs *changeJournalingFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return fs.modified(op.Inode, fs.FileSystem.RemoveXattr(ctx, op))
+}
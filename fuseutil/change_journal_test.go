@@ -0,0 +1,196 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+// A file system that accepts every mutation, minting a new inode ID for each
+// creation.
+type acceptingFS struct {
+	fuseutil.NotImplementedFileSystem
+	next fuseops.InodeID
+}
+
+func (fs *acceptingFS) mint(e *fuseops.ChildInodeEntry) error {
+	fs.next++
+	e.Child = fuseops.RootInodeID + fs.next
+	return nil
+}
+
+func (fs *acceptingFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.mint(&op.Entry)
+}
+
+func (fs *acceptingFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.mint(&op.Entry)
+}
+
+func (fs *acceptingFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return nil
+}
+
+func (fs *acceptingFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return nil
+}
+
+func (fs *acceptingFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return nil
+}
+
+func (fs *acceptingFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	op.Entry.Child = op.Target
+	return nil
+}
+
+func (fs *acceptingFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return nil
+}
+
+func TestChangeJournal(t *testing.T) {
+	ctx := context.Background()
+	clock := &timeutil.SimulatedClock{}
+	clock.SetTime(time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC))
+
+	j := fuseutil.NewChangeJournal(fuseutil.ChangeJournalConfig{
+		MaxChanges: 6,
+		Clock:      clock,
+	})
+
+	fs := fuseutil.NewChangeJournalingFileSystem(&acceptingFS{}, j)
+
+	mkdir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir"}
+	if err := fs.MkDir(ctx, mkdir); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	dir := mkdir.Entry.Child
+	create := &fuseops.CreateFileOp{Parent: dir, Name: "a"}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	file := create.Entry.Child
+	mark := j.LastSeq()
+
+	// Consecutive writes are recorded once.
+	for i := 0; i < 3; i++ {
+		if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: file}); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	err := fs.Rename(ctx, &fuseops.RenameOp{
+		OldParent: dir,
+		OldName:   "a",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "b",
+	})
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: file}); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "b"}); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	changes, err := j.Since(mark)
+	if err != nil {
+		t.Fatalf("Since: %v", err)
+	}
+
+	for i := range changes {
+		if !changes[i].Time.Equal(clock.Now()) {
+			t.Errorf("Change %d at %v", i, changes[i].Time)
+		}
+
+		changes[i].Time = time.Time{}
+	}
+
+	want := []fuseutil.Change{
+		{Seq: 3, Kind: fuseutil.ChangeModify, Inode: file, Path: "/dir/a"},
+		{Seq: 4, Kind: fuseutil.ChangeRename, Inode: file, Path: "/b", OldPath: "/dir/a"},
+		{Seq: 5, Kind: fuseutil.ChangeModify, Inode: file, Path: "/b"},
+		{Seq: 6, Kind: fuseutil.ChangeDelete, Inode: file, Path: "/b"},
+	}
+
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Changes:\n%v\nwant:\n%v", changes, want)
+	}
+
+	// Once the journal is full, the oldest changes are discarded.
+	if _, err := j.Since(0); err != nil {
+		t.Errorf("Since(0) while all retained: %v", err)
+	}
+
+	if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: dir}); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if _, err := j.Since(0); err != fuseutil.ErrChangesTruncated {
+		t.Errorf("Since(0) once truncated: %v", err)
+	}
+
+	if changes, _ := j.Since(6); len(changes) != 1 || changes[0].Path != "/dir" {
+		t.Errorf("Since(6): %v", changes)
+	}
+
+	// The control file lists what is retained.
+	read := j.ControlFile("changes").Read
+	contents, err := read(ctx, fuseops.OpContext{})
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	wantContents := fmt.Sprintf(
+		"2 create %d \"/dir/a\"\n"+
+			"3 modify %d \"/dir/a\"\n"+
+			"4 rename %d \"/b\" \"/dir/a\"\n"+
+			"5 modify %d \"/b\"\n"+
+			"6 delete %d \"/b\"\n"+
+			"7 modify %d \"/dir\"\n",
+		file, file, file, file, file, dir)
+
+	if string(contents) != wantContents {
+		t.Errorf("Control file:\n%s\nwant:\n%s", contents, wantContents)
+	}
+}
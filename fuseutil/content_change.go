@@ -0,0 +1,219 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Wrappers that hold state derived from file contents, such as a cache of
+// data or sizes, or a layer that encrypts or compresses contents in blocks,
+// must not lose track of changes that don't go through WriteFileOp. The
+// contract is as follows:
+//
+//  *  WriteFileOp, SetInodeAttributesOp with a Size, and FallocateOp are the
+//     ops that change contents. DescribeContentChange says what each did.
+//
+//  *  A wrapper that caches must apply the change to its cache only once the
+//     wrapped file system has succeeded, and must drop any cached size when
+//     ContentChange.MayResize is set, since the resulting size is known only
+//     below it. NewContentChangeNotifier does this bookkeeping for callers.
+//
+//  *  A wrapper that stores contents in a transformed layout must translate
+//     truncations and fallocate ranges rather than forwarding them verbatim.
+//     BlockAlignedRange splits a range into whole blocks, which may be passed
+//     down, and partial edges, which must be rewritten as zeroes through the
+//     wrapper's own write path. Modes that can't be translated, such as
+//     collapsing a range that isn't block aligned, must fail with
+//     syscall.EOPNOTSUPP, which callers of fallocate(2) handle by falling back
+//     to writes.
+
+// The ways in which an op may change the contents of a file.
+type ContentChangeKind int
+
+const (
+	// The range was overwritten with new data.
+	ContentWritten ContentChangeKind = iota
+
+	// The range now reads as zeroes, and may or may not occupy storage.
+	ContentZeroed
+
+	// Storage was allocated for the range without changing what it reads as.
+	ContentAllocated
+
+	// The file was truncated or extended to Offset bytes. Length is zero.
+	ContentTruncated
+
+	// Data from Offset onward moved, by inserting or removing Length bytes at
+	// Offset. Everything from Offset to the end of the file is affected.
+	ContentShifted
+)
+
+// A description of how a successful op changed the contents of a file.
+type ContentChange struct {
+	Inode  fuseops.InodeID
+	Kind   ContentChangeKind
+	Offset uint64
+	Length uint64
+
+	// Set if the file's size may have changed. For everything but
+	// ContentTruncated and ContentShifted the size can only have grown, to at
+	// most Offset+Length.
+	MayResize bool
+}
+
+// Describe the change to file contents made by the supplied op, assuming the
+// op succeeded. Return false if the op doesn't change file contents.
+func DescribeContentChange(op interface{}) (c ContentChange, ok bool) {
+	switch typed := op.(type) {
+	case *fuseops.WriteFileOp:
+		c = ContentChange{
+			Inode:     typed.Inode,
+			Kind:      ContentWritten,
+			Offset:    uint64(typed.Offset),
+			Length:    uint64(typed.Written()),
+			MayResize: true,
+		}
+
+	case *fuseops.SetInodeAttributesOp:
+		if typed.Size == nil {
+			return c, false
+		}
+
+		c = ContentChange{
+			Inode:     typed.Inode,
+			Kind:      ContentTruncated,
+			Offset:    *typed.Size,
+			MayResize: true,
+		}
+
+	case *fuseops.FallocateOp:
+		c = ContentChange{
+			Inode:     typed.Inode,
+			Offset:    typed.Offset,
+			Length:    typed.Length,
+			MayResize: typed.Mode&fuseops.FallocateKeepSize == 0,
+		}
+
+		switch {
+		case typed.Mode&fuseops.FallocatePunchHole != 0:
+			c.Kind = ContentZeroed
+			c.MayResize = false
+
+		case typed.Mode&fuseops.FallocateZeroRange != 0:
+			c.Kind = ContentZeroed
+
+		case typed.Mode&
+			(fuseops.FallocateCollapseRange|fuseops.FallocateInsertRange) != 0:
+			c.Kind = ContentShifted
+			c.MayResize = true
+
+		default:
+			c.Kind = ContentAllocated
+		}
+
+	default:
+		return c, false
+	}
+
+	return c, true
+}
+
+// A byte range within a file.
+type ByteRange struct {
+	Offset uint64
+	Length uint64
+}
+
+// Split a range into the largest sub-range made of whole blocks of the given
+// size, and the partial blocks before and after it. Any of the results may be
+// empty. If the range lies within a single block, it is returned as head.
+//
+// A zero block size, as reported by file systems that don't set one, is taken
+// to be one byte, making the whole range the body.
+func BlockAlignedRange(
+	r ByteRange,
+	blockSize uint64) (head, body, tail ByteRange) {
+	if blockSize == 0 {
+		blockSize = 1
+	}
+
+	end := r.Offset + r.Length
+	first := (r.Offset + blockSize - 1) / blockSize * blockSize
+	last := end / blockSize * blockSize
+
+	if first > last || first == last && first == r.Offset {
+		return r, ByteRange{Offset: end}, ByteRange{Offset: end}
+	}
+
+	head = ByteRange{Offset: r.Offset, Length: first - r.Offset}
+	body = ByteRange{Offset: first, Length: last - first}
+	tail = ByteRange{Offset: last, Length: end - last}
+	return
+}
+
+// Create a file system that forwards every op to the wrapped file system, and
+// calls notify with a description of each change to file contents once the
+// wrapped file system has successfully made it. notify is called before the
+// op is answered, and may be used to keep a cache above the wrapped file
+// system coherent with it.
+func NewContentChangeNotifier(
+	wrapped FileSystem,
+	notify func(ctx context.Context, c ContentChange)) FileSystem {
+	return &contentChangeNotifier{
+		FileSystem: wrapped,
+		notify:     notify,
+	}
+}
+
+type contentChangeNotifier struct {
+	FileSystem
+	notify func(ctx context.Context, c ContentChange)
+}
+
+func (fs *contentChangeNotifier) report(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	if err != nil {
+		return err
+	}
+
+	if c, ok := DescribeContentChange(op); ok {
+		fs.notify(ctx, c)
+	}
+
+	return nil
+}
+
+func (fs *contentChangeNotifier) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return fs.report(ctx, op, fs.FileSystem.SetInodeAttributes(ctx, op))
+}
+
+func (fs *contentChangeNotifier) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.report(ctx, op, fs.FileSystem.WriteFile(ctx, op))
+}
+
+func (fs *contentChangeNotifier) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return fs.report(ctx, op, fs.FileSystem.Fallocate(ctx, op))
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+func TestDescribeContentChange(t *testing.T) {
+	size := uint64(10)
+	testCases := []struct {
+		op   interface{}
+		want fuseutil.ContentChange
+		ok   bool
+	}{
+		{
+			op:   &fuseops.GetInodeAttributesOp{Inode: 2},
+			want: fuseutil.ContentChange{},
+			ok:   false,
+		},
+		{
+			op:   &fuseops.SetInodeAttributesOp{Inode: 2},
+			want: fuseutil.ContentChange{},
+			ok:   false,
+		},
+		{
+			op: &fuseops.SetInodeAttributesOp{Inode: 2, Size: &size},
+			want: fuseutil.ContentChange{
+				Inode:     2,
+				Kind:      fuseutil.ContentTruncated,
+				Offset:    10,
+				MayResize: true,
+			},
+			ok: true,
+		},
+		{
+			op: &fuseops.FallocateOp{
+				Inode:  2,
+				Offset: 4,
+				Length: 8,
+				Mode:   fuseops.FallocatePunchHole | fuseops.FallocateKeepSize,
+			},
+			want: fuseutil.ContentChange{
+				Inode:  2,
+				Kind:   fuseutil.ContentZeroed,
+				Offset: 4,
+				Length: 8,
+			},
+			ok: true,
+		},
+		{
+			// A short write changes only the bytes written.
+			op: &fuseops.WriteFileOp{
+				Inode:        2,
+				Offset:       4,
+				Data:         []byte("taco"),
+				BytesWritten: 3,
+			},
+			want: fuseutil.ContentChange{
+				Inode:     2,
+				Kind:      fuseutil.ContentWritten,
+				Offset:    4,
+				Length:    3,
+				MayResize: true,
+			},
+			ok: true,
+		},
+		{
+			op: &fuseops.FallocateOp{Inode: 2, Offset: 4, Length: 8},
+			want: fuseutil.ContentChange{
+				Inode:     2,
+				Kind:      fuseutil.ContentAllocated,
+				Offset:    4,
+				Length:    8,
+				MayResize: true,
+			},
+			ok: true,
+		},
+	}
+
+	for i, tc := range testCases {
+		got, ok := fuseutil.DescribeContentChange(tc.op)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("Case %d: got %+v, %v; want %+v, %v", i, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestBlockAlignedRange(t *testing.T) {
+	type r = fuseutil.ByteRange
+	testCases := []struct {
+		in               r
+		head, body, tail r
+	}{
+		{r{0, 8192}, r{0, 0}, r{0, 8192}, r{8192, 0}},
+		{r{100, 8000}, r{100, 3996}, r{4096, 0}, r{4096, 4004}},
+		{r{100, 9000}, r{100, 3996}, r{4096, 4096}, r{8192, 908}},
+		{r{100, 10}, r{100, 10}, r{110, 0}, r{110, 0}},
+		{r{4096, 10}, r{4096, 10}, r{4106, 0}, r{4106, 0}},
+	}
+
+	for i, tc := range testCases {
+		head, body, tail := fuseutil.BlockAlignedRange(tc.in, 4096)
+		if head != tc.head || body != tc.body || tail != tc.tail {
+			t.Errorf(
+				"Case %d: got %v %v %v; want %v %v %v",
+				i, head, body, tail, tc.head, tc.body, tc.tail)
+		}
+	}
+
+	// Without a block size, the whole range is the body.
+	head, body, tail := fuseutil.BlockAlignedRange(r{100, 10}, 0)
+	if head != (r{100, 0}) || body != (r{100, 10}) || tail != (r{110, 0}) {
+		t.Errorf("Block size 0: got %v %v %v", head, body, tail)
+	}
+}
@@ -0,0 +1,755 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"golang.org/x/sys/unix"
+)
+
+// ControlInodeBase is the first inode ID used by the synthetic inodes of
+// NewControlFileSystem, and ControlHandleBase the first handle ID. File
+// systems wrapped by it must not mint inode or handle IDs with the top bit
+// set.
+const (
+	ControlInodeBase  fuseops.InodeID  = 1 << 63
+	ControlHandleBase fuseops.HandleID = 1 << 63
+)
+
+// A synthetic file registered with NewControlFileSystem, in the spirit of the
+// files in /proc.
+type ControlFile struct {
+	// The name of the file within the control directory.
+	Name string
+
+	// Called each time the file is opened for reading, to generate the content
+	// that is seen through the resulting file handle. May be nil, in which case
+	// the file cannot be opened for reading.
+	Read func(ctx context.Context, opCtx fuseops.OpContext) ([]byte, error)
+
+	// Called for each write(2) to the file with the data written. The error is
+	// returned to the writer. May be nil, in which case the file cannot be
+	// opened for writing.
+	Write func(
+		ctx context.Context,
+		opCtx fuseops.OpContext,
+		data []byte) error
+
+	// The permission bits and ownership of the file. If Mode is zero, a mode is
+	// derived from which of Read and Write are set.
+	Mode os.FileMode
+	Uid  uint32
+	Gid  uint32
+}
+
+func (f *ControlFile) attributes() fuseops.InodeAttributes {
+	mode := f.Mode.Perm()
+	if mode == 0 {
+		if f.Read != nil {
+			mode |= 0444
+		}
+
+		if f.Write != nil {
+			mode |= 0200
+		}
+	}
+
+	return fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  mode,
+		Uid:   f.Uid,
+		Gid:   f.Gid,
+	}
+}
+
+// Create a file system that adds a directory with the given name to the root
+// of the wrapped file system, containing the supplied control files. The
+// directory shadows any entry of the same name in the wrapped file system, and
+// is not listed when reading the root directory; it is reachable by name only.
+//
+// Content is generated afresh for each open file handle, so the kernel is told
+// to bypass the page cache (see fuseops.OpenFileOp.UseDirectIO) and the files
+// have a size of zero. Each write(2) is delivered to the Write callback as a
+// single call, regardless of the file offset.
+func NewControlFileSystem(
+	wrapped FileSystem,
+	dirName string,
+	files []ControlFile) FileSystem {
+	fs := &controlFileSystem{
+		FileSystem: wrapped,
+		dirName:    dirName,
+		files:      files,
+		byName:     make(map[string]int),
+		handles:    make(map[fuseops.HandleID]*controlHandle),
+		nextHandle: ControlHandleBase,
+	}
+
+	for i, f := range files {
+		fs.byName[f.Name] = i
+	}
+
+	return fs
+}
+
+type controlFileSystem struct {
+	FileSystem
+
+	dirName string
+	files   []ControlFile
+	byName  map[string]int
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	handles    map[fuseops.HandleID]*controlHandle
+	nextHandle fuseops.HandleID
+}
+
+type controlHandle struct {
+	// Nil for directory handles.
+	file    *ControlFile
+	content []byte
+}
+
+const controlDirInode = ControlInodeBase
+
+func isControlInode(id fuseops.InodeID) bool {
+	return id >= ControlInodeBase
+}
+
+func isControlHandle(h fuseops.HandleID) bool {
+	return h >= ControlHandleBase
+}
+
+// Return the control file with the given inode ID, or nil if it is the
+// directory. IDs beyond the files registered, which the kernel was never given,
+// fail with ENOENT.
+func (fs *controlFileSystem) file(id fuseops.InodeID) (*ControlFile, error) {
+	if id == controlDirInode {
+		return nil, nil
+	}
+
+	i := uint64(id - controlDirInode - 1)
+	if i >= uint64(len(fs.files)) {
+		return nil, fuse.ENOENT
+	}
+
+	return &fs.files[i], nil
+}
+
+func (fs *controlFileSystem) attributes(
+	id fuseops.InodeID) (fuseops.InodeAttributes, error) {
+	f, err := fs.file(id)
+	if err != nil {
+		return fuseops.InodeAttributes{}, err
+	}
+
+	if f != nil {
+		return f.attributes(), nil
+	}
+
+	return fuseops.InodeAttributes{
+		Nlink: 2,
+		Mode:  0555 | os.ModeDir,
+	}, nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *controlFileSystem) newHandle(h *controlHandle) fuseops.HandleID {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id := fs.nextHandle
+	fs.nextHandle++
+	fs.handles[id] = h
+
+	return id
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *controlFileSystem) handle(id fuseops.HandleID) (*controlHandle, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	h, ok := fs.handles[id]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	return h, nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *controlFileSystem) releaseHandle(id fuseops.HandleID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.handles, id)
+}
+
+func (fs *controlFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	var child fuseops.InodeID
+	switch {
+	case op.Parent == fuseops.RootInodeID && op.Name == fs.dirName:
+		child = controlDirInode
+
+	case op.Parent == controlDirInode:
+		i, ok := fs.byName[op.Name]
+		if !ok {
+			return fuse.ENOENT
+		}
+		child = controlDirInode + 1 + fuseops.InodeID(i)
+
+	default:
+		return fs.FileSystem.LookUpInode(ctx, op)
+	}
+
+	attrs, err := fs.attributes(child)
+	if err != nil {
+		return err
+	}
+
+	op.Entry = fuseops.ChildInodeEntry{
+		Child:      child,
+		Attributes: attrs,
+	}
+
+	return nil
+}
+
+func (fs *controlFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if !isControlInode(op.Inode) {
+		return fs.FileSystem.GetInodeAttributes(ctx, op)
+	}
+
+	var err error
+	op.Attributes, err = fs.attributes(op.Inode)
+	return err
+}
+
+func (fs *controlFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if !isControlInode(op.Inode) {
+		return fs.FileSystem.SetInodeAttributes(ctx, op)
+	}
+
+	// Allow the truncation implied by open(2) with O_TRUNC, which is what shell
+	// redirections do, but nothing else.
+	if op.Uid != nil || op.Gid != nil || op.Mode != nil {
+		return syscall.EPERM
+	}
+
+	var err error
+	op.Attributes, err = fs.attributes(op.Inode)
+	return err
+}
+
+func (fs *controlFileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	if !isControlInode(op.Inode) {
+		return fs.FileSystem.Access(ctx, op)
+	}
+
+	// Grant what the owner of the control file would be granted.
+	attrs, err := fs.attributes(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if uint32(attrs.Mode.Perm()>>6)&op.Mask != op.Mask {
+		return syscall.EACCES
+	}
+
+	return nil
+}
+
+func (fs *controlFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	// Control inodes are never deleted, so there is nothing to do for them.
+	if isControlInode(op.Inode) {
+		return nil
+	}
+
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+func (fs *controlFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	entries := make([]fuseops.BatchForgetEntry, 0, len(op.Entries))
+	for _, e := range op.Entries {
+		if !isControlInode(e.Inode) {
+			entries = append(entries, e)
+		}
+	}
+
+	if len(entries) == len(op.Entries) {
+		return fs.FileSystem.BatchForget(ctx, op)
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// Mirror the fallback used by the server, since the wrapped file system may
+	// not implement batch forgets.
+	filtered := *op
+	filtered.Entries = entries
+	err := fs.FileSystem.BatchForget(ctx, &filtered)
+	if err == fuse.ENOSYS {
+		for _, e := range entries {
+			err = fs.FileSystem.ForgetInode(ctx, &fuseops.ForgetInodeOp{
+				Inode:     e.Inode,
+				N:         e.N,
+				OpContext: op.OpContext,
+			})
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	return err
+}
+
+func (fs *controlFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	if isControlInode(op.Parent) {
+		return syscall.EPERM
+	}
+
+	return fs.FileSystem.MkDir(ctx, op)
+}
+
+func (fs *controlFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	if isControlInode(op.Parent) {
+		return syscall.EPERM
+	}
+
+	return fs.FileSystem.MkNode(ctx, op)
+}
+
+func (fs *controlFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if isControlInode(op.Parent) {
+		return syscall.EPERM
+	}
+
+	return fs.FileSystem.CreateFile(ctx, op)
+}
+
+func (fs *controlFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	if isControlInode(op.Parent) || isControlInode(op.Target) {
+		return syscall.EPERM
+	}
+
+	return fs.FileSystem.CreateLink(ctx, op)
+}
+
+func (fs *controlFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	if isControlInode(op.Parent) {
+		return syscall.EPERM
+	}
+
+	return fs.FileSystem.CreateSymlink(ctx, op)
+}
+
+func (fs *controlFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	if isControlInode(op.OldParent) || isControlInode(op.NewParent) {
+		return syscall.EPERM
+	}
+
+	return fs.FileSystem.Rename(ctx, op)
+}
+
+func (fs *controlFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	if isControlInode(op.Parent) {
+		return syscall.EPERM
+	}
+
+	return fs.FileSystem.RmDir(ctx, op)
+}
+
+func (fs *controlFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if isControlInode(op.Parent) {
+		return syscall.EPERM
+	}
+
+	return fs.FileSystem.Unlink(ctx, op)
+}
+
+func (fs *controlFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	if !isControlInode(op.Inode) {
+		return fs.FileSystem.OpenDir(ctx, op)
+	}
+
+	if op.Inode != controlDirInode {
+		return fuse.ENOTDIR
+	}
+
+	op.Handle = fs.newHandle(&controlHandle{})
+	return nil
+}
+
+func (fs *controlFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if !isControlInode(op.Inode) {
+		return fs.FileSystem.ReadDir(ctx, op)
+	}
+
+	for i := int(op.Offset); i < len(fs.files); i++ {
+		n := WriteDirent(op.Dst[op.BytesRead:], Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  controlDirInode + 1 + fuseops.InodeID(i),
+			Name:   fs.files[i].Name,
+			Type:   DT_File,
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *controlFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	if !isControlInode(op.Inode) {
+		return fs.FileSystem.ReadDirPlus(ctx, op)
+	}
+
+	for i := int(op.Offset); i < len(fs.files); i++ {
+		child := controlDirInode + 1 + fuseops.InodeID(i)
+		attrs, err := fs.attributes(child)
+		if err != nil {
+			return err
+		}
+
+		n := WriteDirentPlus(op.Dst[op.BytesRead:], DirentPlus{
+			Dirent: Dirent{
+				Offset: fuseops.DirOffset(i + 1),
+				Inode:  child,
+				Name:   fs.files[i].Name,
+				Type:   DT_File,
+			},
+			Entry: fuseops.ChildInodeEntry{
+				Child:      child,
+				Attributes: attrs,
+			},
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *controlFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	if !isControlHandle(op.Handle) {
+		return fs.FileSystem.ReleaseDirHandle(ctx, op)
+	}
+
+	fs.releaseHandle(op.Handle)
+	return nil
+}
+
+func (fs *controlFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if !isControlInode(op.Inode) {
+		return fs.FileSystem.OpenFile(ctx, op)
+	}
+
+	f, err := fs.file(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if f == nil {
+		return syscall.EISDIR
+	}
+
+	h := &controlHandle{file: f}
+	if !op.OpenFlags.IsWriteOnly() {
+		if f.Read == nil {
+			return syscall.EACCES
+		}
+
+		content, err := f.Read(ctx, op.OpContext)
+		if err != nil {
+			return err
+		}
+		h.content = content
+	}
+
+	if !op.OpenFlags.IsReadOnly() && f.Write == nil {
+		return syscall.EACCES
+	}
+
+	op.Handle = fs.newHandle(h)
+	op.UseDirectIO = true
+	return nil
+}
+
+func (fs *controlFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if !isControlInode(op.Inode) {
+		return fs.FileSystem.ReadFile(ctx, op)
+	}
+
+	h, err := fs.handle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if op.Offset >= int64(len(h.content)) {
+		return nil
+	}
+
+	data := h.content[op.Offset:]
+	if op.Dst != nil {
+		op.BytesRead = copy(op.Dst, data)
+		return nil
+	}
+
+	if int64(len(data)) > op.Size {
+		data = data[:op.Size]
+	}
+
+	op.Data = [][]byte{data}
+	op.BytesRead = len(data)
+	return nil
+}
+
+func (fs *controlFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if !isControlInode(op.Inode) {
+		return fs.FileSystem.WriteFile(ctx, op)
+	}
+
+	h, err := fs.handle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	return h.file.Write(ctx, op.OpContext, op.Data)
+}
+
+func (fs *controlFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	if !isControlInode(op.Inode) {
+		return fs.FileSystem.SyncFile(ctx, op)
+	}
+
+	return nil
+}
+
+func (fs *controlFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	if !isControlInode(op.Inode) {
+		return fs.FileSystem.FlushFile(ctx, op)
+	}
+
+	return nil
+}
+
+func (fs *controlFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	if !isControlHandle(op.Handle) {
+		return fs.FileSystem.ReleaseFileHandle(ctx, op)
+	}
+
+	fs.releaseHandle(op.Handle)
+	return nil
+}
+
+func (fs *controlFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	if isControlInode(op.Inode) {
+		return syscall.EPERM
+	}
+
+	return fs.FileSystem.RemoveXattr(ctx, op)
+}
+
+func (fs *controlFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	if isControlInode(op.Inode) {
+		return fuse.ENOATTR
+	}
+
+	return fs.FileSystem.GetXattr(ctx, op)
+}
+
+func (fs *controlFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	if isControlInode(op.Inode) {
+		return nil
+	}
+
+	return fs.FileSystem.ListXattr(ctx, op)
+}
+
+func (fs *controlFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	if isControlInode(op.Inode) {
+		return syscall.EPERM
+	}
+
+	return fs.FileSystem.SetXattr(ctx, op)
+}
+
+func (fs *controlFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	if isControlInode(op.Inode) {
+		return syscall.EPERM
+	}
+
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *controlFileSystem) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	if !isControlInode(op.Inode) {
+		return fs.FileSystem.Lseek(ctx, op)
+	}
+
+	// Control files have no holes. Answer anyway, since ENOSYS would stop the
+	// kernel from sending LseekOp for the wrapped file system's files too.
+	h, err := fs.handle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	size := uint64(len(h.content))
+	return SeekExtents(op, size, []ByteRange{{Length: size}})
+}
+
+func (fs *controlFileSystem) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	if !isControlInode(op.Inode) {
+		return fs.FileSystem.Poll(ctx, op)
+	}
+
+	// Control files are always ready, like regular files. As for Lseek,
+	// ENOSYS would disable polling for the whole mount.
+	op.Revents = unix.POLLIN | unix.POLLOUT
+	return nil
+}
+
+func (fs *controlFileSystem) GetInodeFlags(
+	ctx context.Context,
+	op *fuseops.GetInodeFlagsOp) error {
+	if isControlInode(op.Inode) {
+		op.Flags = 0
+		return nil
+	}
+
+	return fs.FileSystem.GetInodeFlags(ctx, op)
+}
+
+func (fs *controlFileSystem) SetInodeFlags(
+	ctx context.Context,
+	op *fuseops.SetInodeFlagsOp) error {
+	if isControlInode(op.Inode) {
+		return syscall.EPERM
+	}
+
+	return fs.FileSystem.SetInodeFlags(ctx, op)
+}
+
+func (fs *controlFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	if isControlInode(op.Inode) {
+		return syscall.ENOTTY
+	}
+
+	return fs.FileSystem.Ioctl(ctx, op)
+}
+
+// Control files can't be locked: their handles are our own, and they have no
+// contents to protect.
+func (fs *controlFileSystem) GetLk(
+	ctx context.Context,
+	op *fuseops.GetLkOp) error {
+	if isControlInode(op.Inode) {
+		return syscall.ENOLCK
+	}
+
+	return fs.FileSystem.GetLk(ctx, op)
+}
+
+func (fs *controlFileSystem) SetLk(
+	ctx context.Context,
+	op *fuseops.SetLkOp) error {
+	if isControlInode(op.Inode) {
+		return syscall.ENOLCK
+	}
+
+	return fs.FileSystem.SetLk(ctx, op)
+}
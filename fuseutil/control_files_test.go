@@ -0,0 +1,169 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// Look up a control file under the "ctl" directory.
+func lookUpControlFile(
+	t *testing.T,
+	fs fuseutil.FileSystem,
+	name string) fuseops.ChildInodeEntry {
+	ctx := context.Background()
+	dir := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "ctl"}
+	if err := fs.LookUpInode(ctx, dir); err != nil {
+		t.Fatalf("LookUpInode(ctl): %v", err)
+	}
+
+	op := &fuseops.LookUpInodeOp{Parent: dir.Entry.Child, Name: name}
+	if err := fs.LookUpInode(ctx, op); err != nil {
+		t.Fatalf("LookUpInode(%s): %v", name, err)
+	}
+
+	return op.Entry
+}
+
+func TestControlFiles(t *testing.T) {
+	ctx := context.Background()
+	generation := 0
+	var written []string
+	fs := fuseutil.NewControlFileSystem(
+		&fuseutil.NotImplementedFileSystem{},
+		"ctl",
+		[]fuseutil.ControlFile{
+			{
+				Name: "status",
+				Read: func(ctx context.Context, opCtx fuseops.OpContext) ([]byte, error) {
+					generation++
+					return []byte{byte('0' + generation)}, nil
+				},
+			},
+			{
+				Name: "command",
+				Write: func(
+					ctx context.Context,
+					opCtx fuseops.OpContext,
+					data []byte) error {
+					if string(data) == "bad" {
+						return syscall.EINVAL
+					}
+
+					written = append(written, string(data))
+					return nil
+				},
+			},
+		})
+
+	status := lookUpControlFile(t, fs, "status")
+
+	// The size is zero, whatever the content, and the mode follows from the
+	// callbacks set.
+	attrOp := &fuseops.GetInodeAttributesOp{Inode: status.Child}
+	if err := fs.GetInodeAttributes(ctx, attrOp); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	if attrOp.Attributes.Size != 0 || attrOp.Attributes.Mode != 0444 {
+		t.Errorf("Attributes: %+v", attrOp.Attributes)
+	}
+
+	// Each open sees the content generated when it was opened, read directly
+	// rather than through the page cache.
+	open := func(inode fuseops.InodeID, flags fusekernel.OpenFlags) *fuseops.OpenFileOp {
+		op := &fuseops.OpenFileOp{Inode: inode, OpenFlags: flags}
+		if err := fs.OpenFile(ctx, op); err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+
+		if !op.UseDirectIO {
+			t.Errorf("UseDirectIO not set")
+		}
+
+		return op
+	}
+
+	read := func(op *fuseops.OpenFileOp) string {
+		r := &fuseops.ReadFileOp{
+			Inode:  op.Inode,
+			Handle: op.Handle,
+			Size:   16,
+			Dst:    make([]byte, 16),
+		}
+
+		if err := fs.ReadFile(ctx, r); err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+
+		return string(r.Dst[:r.BytesRead])
+	}
+
+	first := open(status.Child, fusekernel.OpenReadOnly)
+	second := open(status.Child, fusekernel.OpenReadOnly)
+	if got := read(second); got != "2" {
+		t.Errorf("Second open read %q", got)
+	}
+
+	if got := read(first); got != "1" {
+		t.Errorf("First open read %q", got)
+	}
+
+	// Files without a Write callback can't be opened for writing.
+	err := fs.OpenFile(ctx, &fuseops.OpenFileOp{
+		Inode:     status.Child,
+		OpenFlags: fusekernel.OpenReadWrite,
+	})
+
+	if err != syscall.EACCES {
+		t.Errorf("OpenFile for writing: %v", err)
+	}
+
+	// Each write is handed to the callback, whose error the writer gets.
+	command := lookUpControlFile(t, fs, "command")
+	h := open(command.Child, fusekernel.OpenWriteOnly)
+	write := func(data string) error {
+		return fs.WriteFile(ctx, &fuseops.WriteFileOp{
+			Inode:  command.Child,
+			Handle: h.Handle,
+			Data:   []byte(data),
+		})
+	}
+
+	if err := write("start"); err != nil {
+		t.Errorf("WriteFile: %v", err)
+	}
+
+	if err := write("bad"); err != syscall.EINVAL {
+		t.Errorf("WriteFile: %v, want EINVAL", err)
+	}
+
+	if len(written) != 1 || written[0] != "start" {
+		t.Errorf("Written: %v", written)
+	}
+
+	// Control inode IDs beyond the files registered aren't served.
+	attrOp = &fuseops.GetInodeAttributesOp{Inode: command.Child + 1}
+	if err := fs.GetInodeAttributes(ctx, attrOp); err != fuse.ENOENT {
+		t.Errorf("GetInodeAttributes beyond the files: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Sort directory entries from a backend that lists them in no particular
+// order by name, and number their offsets in that order, so that repeated
+// listings of an unchanged directory come out the same and ReadDirOp.Offset
+// can be used as an index into them. If the directory may change between
+// the calls making up one listing, use a DirentIndex instead: adding or
+// removing an entry shifts the offsets of those after it here.
+func SortDirents(entries []Dirent) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	for i := range entries {
+		entries[i].Offset = fuseops.DirOffset(i + 1)
+	}
+}
+
+// Set the offsets of directory entries to cookies derived from their names,
+// and sort them by offset. A listing can then be resumed at an offset returned
+// by any earlier listing of the directory, by this process or a previous run
+// of it, without repeating or skipping the entries that were there all along
+// and without keeping any state, which suits NFS re-export, whose clients
+// hold on to offsets indefinitely. The few names whose cookies collide are
+// given consecutive offsets, in name order, so that the later ones move if
+// the first is removed.
+func HashDirents(entries []Dirent) {
+	for i := range entries {
+		h := fnv.New64a()
+		h.Write([]byte(entries[i].Name))
+
+		// Leave room above the cookies for those of colliding names, below
+		// fuseops.MaxDirOffset.
+		off := fuseops.DirOffset(h.Sum64() >> 2)
+		if off == 0 {
+			off = 1
+		}
+
+		entries[i].Offset = off
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Offset != entries[j].Offset {
+			return entries[i].Offset < entries[j].Offset
+		}
+
+		return entries[i].Name < entries[j].Name
+	})
+
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Offset <= entries[i-1].Offset {
+			entries[i].Offset = entries[i-1].Offset + 1
+		}
+	}
+}
+
+// A DirentIndex orders the entries of directories from a backend that lists
+// them in no particular order by when each name was first seen, and gives
+// each name an offset that stays the same for as long as the name stays in
+// the directory. A listing resumed at an offset after entries were added or
+// removed then neither repeats nor skips the entries that were there all
+// along: new names come last, and removed names leave gaps.
+//
+// A DirentIndex is safe for concurrent use.
+type DirentIndex struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	dirs map[fuseops.InodeID]*direntOffsets
+}
+
+type direntOffsets struct {
+	offsets map[string]fuseops.DirOffset
+	next    fuseops.DirOffset
+}
+
+// Create an index that has seen no directories yet.
+func NewDirentIndex() *DirentIndex {
+	return &DirentIndex{
+		dirs: make(map[fuseops.InodeID]*direntOffsets),
+	}
+}
+
+// Set the offsets of the entries of the directory, as listed by the backend,
+// and sort them by offset. Names that are no longer listed are forgotten;
+// their offsets are not reused.
+//
+// LOCKS_EXCLUDED(x.mu)
+func (x *DirentIndex) Order(dir fuseops.InodeID, entries []Dirent) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	d := x.dirs[dir]
+	if d == nil {
+		d = &direntOffsets{offsets: make(map[string]fuseops.DirOffset)}
+		x.dirs[dir] = d
+	}
+
+	// Names seen before keep their offsets. New ones are numbered in the order
+	// listed, after sorting them by name so that a batch of names seen at once
+	// is numbered the same way whatever the backend's order.
+	var fresh []int
+	offsets := make(map[string]fuseops.DirOffset, len(entries))
+	for i, e := range entries {
+		if off, ok := d.offsets[e.Name]; ok {
+			entries[i].Offset = off
+			offsets[e.Name] = off
+		} else {
+			fresh = append(fresh, i)
+		}
+	}
+
+	sort.Slice(fresh, func(i, j int) bool { return entries[fresh[i]].Name < entries[fresh[j]].Name })
+	for _, i := range fresh {
+		d.next++
+		entries[i].Offset = d.next
+		offsets[entries[i].Name] = d.next
+	}
+
+	d.offsets = offsets
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+}
+
+// Forget the offsets of a directory, e.g. when its inode is forgotten.
+//
+// LOCKS_EXCLUDED(x.mu)
+func (x *DirentIndex) Forget(dir fuseops.InodeID) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	delete(x.dirs, dir)
+}
+
+// Write to op.Dst the entries following op.Offset, out of entries ordered by
+// SortDirents, HashDirents or DirentIndex.Order, for as long as they fit. The
+// listing resumes after op.Offset even if no entry has that offset any more,
+// having been removed since it was returned.
+func WriteDirents(op *fuseops.ReadDirOp, entries []Dirent) {
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Offset > op.Offset })
+	for _, e := range entries[i:] {
+		n := WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+}
+
+// Like WriteDirents, for ReadDirPlusOp. entries are ordered by the offsets of
+// their Dirent.
+func WriteDirentsPlus(op *fuseops.ReadDirPlusOp, entries []DirentPlus) {
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Offset > op.Offset })
+	for _, e := range entries[i:] {
+		n := WriteDirentPlus(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+func direntNames(entries []fuseutil.Dirent) (names []string) {
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+
+	return names
+}
+
+func listing(names ...string) (entries []fuseutil.Dirent) {
+	for i, name := range names {
+		entries = append(entries, fuseutil.Dirent{Inode: fuseops.InodeID(i + 2), Name: name})
+	}
+
+	return entries
+}
+
+// Read the entries following offset one at a time, as a small buffer would.
+func readDirents(entries []fuseutil.Dirent, offset fuseops.DirOffset) []string {
+	op := &fuseops.ReadDirOp{Offset: offset, Dst: make([]byte, 32)}
+	fuseutil.WriteDirents(op, entries)
+
+	var names []string
+	for b := op.Dst[:op.BytesRead]; len(b) != 0; {
+		d, n := fuseutil.ReadDirent(b)
+		names = append(names, d.Name)
+		b = b[n:]
+	}
+
+	return names
+}
+
+func TestSortDirents(t *testing.T) {
+	entries := listing("c", "a", "b")
+	fuseutil.SortDirents(entries)
+
+	if got, want := direntNames(entries), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Sorted: %v, want %v", got, want)
+	}
+
+	for i, e := range entries {
+		if e.Offset != fuseops.DirOffset(i+1) {
+			t.Errorf("Offset of %q: %d", e.Name, e.Offset)
+		}
+	}
+
+	if got := readDirents(entries, 1); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("Read from offset 1: %v", got)
+	}
+}
+
+func TestDirentIndex(t *testing.T) {
+	x := fuseutil.NewDirentIndex()
+
+	entries := listing("c", "a", "b")
+	x.Order(1, entries)
+	if got, want := direntNames(entries), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("First listing: %v, want %v", got, want)
+	}
+
+	// Read "a", then have "b" removed and "0" added before reading on.
+	offset := entries[0].Offset
+
+	entries = listing("0", "c", "a")
+	x.Order(1, entries)
+	if got, want := direntNames(entries), []string{"a", "c", "0"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Second listing: %v, want %v", got, want)
+	}
+
+	var rest []string
+	for {
+		names := readDirents(entries, offset)
+		if len(names) == 0 {
+			break
+		}
+
+		rest = append(rest, names...)
+		for _, e := range entries {
+			if e.Name == names[len(names)-1] {
+				offset = e.Offset
+			}
+		}
+	}
+
+	if want := []string{"c", "0"}; !reflect.DeepEqual(rest, want) {
+		t.Errorf("Resumed listing: %v, want %v", rest, want)
+	}
+
+	// Other directories and forgotten ones start afresh.
+	entries = listing("b")
+	x.Order(2, entries)
+	if entries[0].Offset != 1 {
+		t.Errorf("Offset in another directory: %d", entries[0].Offset)
+	}
+
+	x.Forget(1)
+	entries = listing("c")
+	x.Order(1, entries)
+	if entries[0].Offset != 1 {
+		t.Errorf("Offset in a forgotten directory: %d", entries[0].Offset)
+	}
+}
+
+func TestHashDirents(t *testing.T) {
+	entries := listing("c", "a", "b", "d")
+	fuseutil.HashDirents(entries)
+
+	// The offsets depend on the names alone.
+	again := listing("d", "b", "a", "c")
+	fuseutil.HashDirents(again)
+	if !reflect.DeepEqual(direntNames(entries), direntNames(again)) {
+		t.Errorf("Orders differ: %v and %v", direntNames(entries), direntNames(again))
+	}
+
+	offsets := make(map[string]fuseops.DirOffset)
+	for i, e := range entries {
+		if e.Offset == 0 || e.Offset > fuseops.MaxDirOffset {
+			t.Errorf("Offset of %q out of range: %d", e.Name, e.Offset)
+		}
+
+		if i > 0 && e.Offset <= entries[i-1].Offset {
+			t.Errorf("Offset of %q not increasing: %d", e.Name, e.Offset)
+		}
+
+		if again[i].Offset != e.Offset {
+			t.Errorf("Offset of %q: %d, then %d", e.Name, e.Offset, again[i].Offset)
+		}
+
+		offsets[e.Name] = e.Offset
+	}
+
+	// Resuming after an entry that has since been removed carries on with the
+	// next one.
+	names := direntNames(entries)
+	removed := listing(names[0], names[2], names[3])
+	fuseutil.HashDirents(removed)
+
+	if got, want := readDirents(removed, offsets[names[1]]), names[2:3]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Read after removed %q: %v, want %v", names[1], got, want)
+	}
+}
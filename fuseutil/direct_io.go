@@ -0,0 +1,155 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+// A file that only supports IO aligned to some boundary in its offsets,
+// sizes and buffer addresses, such as an *os.File opened with O_DIRECT.
+type AlignedFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+}
+
+// Return a zeroed buffer of n bytes whose address is a multiple of alignment,
+// which must be a power of two.
+func AlignedBuffer(n int, alignment int) []byte {
+	b := make([]byte, n+alignment)
+	skew := int(uintptr(unsafe.Pointer(&b[0])) & uintptr(alignment-1))
+	if skew != 0 {
+		skew = alignment - skew
+	}
+
+	return b[skew : skew+n : skew+n]
+}
+
+func isAligned(b []byte, off int64, alignment int) bool {
+	mask := int64(alignment - 1)
+	return off&mask == 0 &&
+		int64(len(b))&mask == 0 &&
+		(len(b) == 0 || int64(uintptr(unsafe.Pointer(&b[0])))&mask == 0)
+}
+
+// Return the aligned range enclosing [off, off+n).
+func alignRange(off int64, n int, alignment int) (start int64, end int64) {
+	mask := int64(alignment - 1)
+	start = off &^ mask
+	end = (off + int64(n) + mask) &^ mask
+	return
+}
+
+// Read len(p) bytes at off from r, which only supports IO aligned to
+// alignment (a power of two, typically fuseops.DirectIOAlignment), with the
+// semantics of io.ReaderAt. A read that isn't aligned goes through a bounce
+// buffer covering the enclosing aligned range.
+func ReadAtAligned(
+	r io.ReaderAt,
+	p []byte,
+	off int64,
+	alignment int) (int, error) {
+	if isAligned(p, off, alignment) {
+		return r.ReadAt(p, off)
+	}
+
+	start, end := alignRange(off, len(p), alignment)
+	buf := AlignedBuffer(int(end-start), alignment)
+	n, err := r.ReadAt(buf, start)
+
+	skip := int(off - start)
+	if n < skip {
+		n = skip
+	}
+
+	copied := copy(p, buf[skip:n])
+	if copied == len(p) {
+		return copied, nil
+	}
+
+	if err == nil {
+		err = io.EOF
+	}
+
+	return copied, err
+}
+
+// Write p at off to f, which only supports IO aligned to alignment (a power of
+// two), with the semantics of io.WriterAt. A write that isn't aligned reads
+// the partial blocks at either end, and writes them back whole along with p.
+// If that padded the file beyond both its former size and off+len(p), it is
+// then truncated back.
+//
+// The read-modify-write of partial blocks makes concurrent unaligned writes to
+// the same block race; the caller must serialize writes to each file.
+func WriteAtAligned(
+	f AlignedFile,
+	p []byte,
+	off int64,
+	alignment int) (int, error) {
+	if len(p) == 0 || isAligned(p, off, alignment) {
+		return f.WriteAt(p, off)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	size := fi.Size()
+
+	start, end := alignRange(off, len(p), alignment)
+	buf := AlignedBuffer(int(end-start), alignment)
+
+	// Fill in the partial blocks at either end with their current contents,
+	// which read as zeroes past the end of the file.
+	headPartial := off != start
+	if headPartial {
+		if _, err := f.ReadAt(buf[:alignment], start); err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+
+	tailStart := end - int64(alignment)
+	tailPartial := off+int64(len(p)) != end
+	if tailPartial && !(headPartial && tailStart == start) {
+		if _, err := f.ReadAt(buf[tailStart-start:], tailStart); err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+
+	copy(buf[off-start:], p)
+	if _, err := f.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+
+	// Undo any padding written past the end of the file.
+	want := size
+	if off+int64(len(p)) > want {
+		want = off + int64(len(p))
+	}
+
+	if end > want {
+		if err := f.Truncate(want); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+const testAlignment = 512
+
+// An in-memory file that fails IO not aligned to testAlignment with EINVAL,
+// like a file opened with O_DIRECT.
+type alignedOnlyFile struct {
+	contents []byte
+}
+
+type sizeOnlyInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi sizeOnlyInfo) Size() int64 { return fi.size }
+
+func checkAligned(p []byte, off int64) error {
+	if off%testAlignment != 0 ||
+		len(p)%testAlignment != 0 ||
+		uintptr(unsafe.Pointer(&p[0]))%testAlignment != 0 {
+		return syscall.EINVAL
+	}
+
+	return nil
+}
+
+func (f *alignedOnlyFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := checkAligned(p, off); err != nil {
+		return 0, err
+	}
+
+	if off >= int64(len(f.contents)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.contents[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *alignedOnlyFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := checkAligned(p, off); err != nil {
+		return 0, err
+	}
+
+	if end := off + int64(len(p)); end > int64(len(f.contents)) {
+		f.contents = append(f.contents, make([]byte, end-int64(len(f.contents)))...)
+	}
+
+	return copy(f.contents[off:], p), nil
+}
+
+func (f *alignedOnlyFile) Truncate(size int64) error {
+	f.contents = f.contents[:size]
+	return nil
+}
+
+func (f *alignedOnlyFile) Stat() (os.FileInfo, error) {
+	return sizeOnlyInfo{size: int64(len(f.contents))}, nil
+}
+
+func TestAlignedIO(t *testing.T) {
+	f := &alignedOnlyFile{}
+	var want []byte
+
+	write := func(s string, off int) {
+		if n, err := fuseutil.WriteAtAligned(f, []byte(s), int64(off), testAlignment); err != nil || n != len(s) {
+			t.Fatalf("WriteAtAligned(%d bytes at %d): %d, %v", len(s), off, n, err)
+		}
+
+		if end := off + len(s); end > len(want) {
+			want = append(want, make([]byte, end-len(want))...)
+		}
+		copy(want[off:], s)
+
+		if !bytes.Equal(f.contents, want) {
+			t.Fatalf("After writing %d bytes at %d: %d bytes, want %d", len(s), off, len(f.contents), len(want))
+		}
+	}
+
+	write("taco", 10)
+	write(string(bytes.Repeat([]byte("b"), 1000)), 300)
+	write("burrito", 1300)
+	write(string(bytes.Repeat([]byte("e"), testAlignment)), 0)
+
+	// Reads clipped at the end of the file.
+	p := make([]byte, 100)
+	n, err := fuseutil.ReadAtAligned(f, p, 1250, testAlignment)
+	if err != io.EOF || !bytes.Equal(p[:n], want[1250:]) {
+		t.Errorf("ReadAtAligned: %d, %v", n, err)
+	}
+
+	// And within it.
+	n, err = fuseutil.ReadAtAligned(f, p, 500, testAlignment)
+	if err != nil || !bytes.Equal(p[:n], want[500:600]) {
+		t.Errorf("ReadAtAligned: %d, %v", n, err)
+	}
+}
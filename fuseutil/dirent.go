@@ -15,10 +15,13 @@
 package fuseutil
 
 import (
+	"os"
 	"syscall"
 	"unsafe"
 
 	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/convert"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
 )
 
 type DirentType uint32
@@ -34,6 +37,29 @@ const (
 	DT_FIFO      DirentType = syscall.DT_FIFO
 )
 
+// Return the dirent type of an inode with the supplied mode, e.g. for a FIFO,
+// socket or device node created by fuseops.MkNodeOp.
+func DirentTypeForMode(mode os.FileMode) DirentType {
+	switch {
+	case mode&os.ModeDir != 0:
+		return DT_Directory
+	case mode&os.ModeSymlink != 0:
+		return DT_Link
+	case mode&os.ModeNamedPipe != 0:
+		return DT_FIFO
+	case mode&os.ModeSocket != 0:
+		return DT_Socket
+	case mode&os.ModeCharDevice != 0:
+		return DT_Char
+	case mode&os.ModeDevice != 0:
+		return DT_Block
+	case mode&os.ModeType == 0:
+		return DT_File
+	}
+
+	return DT_Unknown
+}
+
 // A struct representing an entry within a directory file, describing a child.
 // See notes on fuseops.ReadDirOp and on WriteDirent for details.
 type Dirent struct {
@@ -42,6 +68,8 @@ type Dirent struct {
 	Offset fuseops.DirOffset
 
 	// The inode of the child file or directory, and its name within the parent.
+	// The kernel shows Inode as the entry's inode number, so for a child whose
+	// attributes set fuseops.InodeAttributes.Ino it should be that number.
 	Inode fuseops.InodeID
 	Name  string
 
@@ -103,3 +131,83 @@ func WriteDirent(buf []byte, d Dirent) (n int) {
 
 	return n
 }
+
+// A directory entry along with the child's attributes, for
+// fuseops.ReadDirPlusOp. See notes on WriteDirentPlus for details.
+type DirentPlus struct {
+	Dirent
+
+	// The child's inode entry, as would be returned by LookUpInodeOp. Entry.Child
+	// should equal Dirent.Inode, except that a zero Entry.Child returns the
+	// entry without attributes and doesn't count as a lookup.
+	Entry fuseops.ChildInodeEntry
+}
+
+// Write the supplied directory entry and attributes into the given buffer in
+// the format expected in fuseops.ReadDirPlusOp.Dst, returning the number of
+// bytes written. Return zero if the entry would not fit.
+//
+// Note that unless named "." or "..", an entry with a non-zero Entry.Child that
+// is part of the op's response increments the child's lookup count.
+func WriteDirentPlus(buf []byte, d DirentPlus) (n int) {
+	// fuse_direntplus is a fuse_entry_out followed by a fuse_dirent, which
+	// keeps the whole aligned since fuse_entry_out's size is a multiple of 8.
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	if entrySize > len(buf) {
+		return 0
+	}
+
+	direntLen := WriteDirent(buf[entrySize:], d.Dirent)
+	if direntLen == 0 {
+		return 0
+	}
+
+	var out fusekernel.EntryOut
+	if d.Entry.Child != 0 {
+		convert.ChildInodeEntry(&d.Entry, &out)
+	}
+
+	copy(buf, (*[entrySize]byte)(unsafe.Pointer(&out))[:])
+	return entrySize + direntLen
+}
+
+// ReadDirent parses a directory entry written by WriteDirent at the start of
+// buf, returning the entry and its length including padding. It returns zero if
+// buf does not begin with a complete entry.
+func ReadDirent(buf []byte) (d Dirent, n int) {
+	type fuse_dirent struct {
+		ino     uint64
+		off     uint64
+		namelen uint32
+		type_   uint32
+	}
+
+	const direntAlignment = 8
+	const direntSize = 8 + 8 + 4 + 4
+
+	if len(buf) < direntSize {
+		return d, 0
+	}
+
+	var de fuse_dirent
+	copy((*[direntSize]byte)(unsafe.Pointer(&de))[:], buf)
+
+	nameLen := int(de.namelen)
+	totalLen := direntSize + nameLen
+	if totalLen%direntAlignment != 0 {
+		totalLen += direntAlignment - totalLen%direntAlignment
+	}
+
+	if totalLen > len(buf) {
+		return d, 0
+	}
+
+	d = Dirent{
+		Offset: fuseops.DirOffset(de.off),
+		Inode:  fuseops.InodeID(de.ino),
+		Name:   string(buf[direntSize : direntSize+nameLen]),
+		Type:   DirentType(de.type_),
+	}
+
+	return d, totalLen
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+func TestWriteDirentPlus(t *testing.T) {
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	d := fuseutil.DirentPlus{
+		Dirent: fuseutil.Dirent{
+			Offset: 1,
+			Inode:  17,
+			Name:   "taco",
+			Type:   fuseutil.DT_File,
+		},
+		Entry: fuseops.ChildInodeEntry{
+			Child:      17,
+			Generation: 2,
+			Attributes: fuseops.InodeAttributes{Size: 100, Nlink: 1, Mode: 0644},
+		},
+	}
+
+	// Entries that don't fit aren't written.
+	buf := make([]byte, 4096)
+	if n := fuseutil.WriteDirentPlus(buf[:entrySize+8], d); n != 0 {
+		t.Errorf("Wrote %d bytes into a short buffer", n)
+	}
+
+	n := fuseutil.WriteDirentPlus(buf, d)
+	if want := entrySize + 24 + 8; n != want {
+		t.Fatalf("Wrote %d bytes, want %d", n, want)
+	}
+
+	// The entry comes first, followed by the dirent.
+	var e fusekernel.EntryOut
+	copy((*[entrySize]byte)(unsafe.Pointer(&e))[:], buf)
+	if e.Nodeid != 17 || e.Generation != 2 || e.Attr.Ino != 17 || e.Attr.Size != 100 {
+		t.Errorf("Entry: %+v", e)
+	}
+
+	got, direntLen := fuseutil.ReadDirent(buf[entrySize:n])
+	if got != d.Dirent || entrySize+direntLen != n {
+		t.Errorf("Dirent: %+v (%d bytes)", got, direntLen)
+	}
+
+	// A zero child leaves the entry blank, so the kernel takes no reference.
+	d.Entry = fuseops.ChildInodeEntry{}
+	n = fuseutil.WriteDirentPlus(buf, d)
+	for _, b := range buf[:entrySize] {
+		if b != 0 {
+			t.Fatalf("Entry written for a zero child: %x", buf[:entrySize])
+		}
+	}
+
+	if got, _ := fuseutil.ReadDirent(buf[entrySize:n]); got != d.Dirent {
+		t.Errorf("Dirent without attributes: %+v", got)
+	}
+}
+
+func TestDirentTypeForMode(t *testing.T) {
+	for mode, want := range map[os.FileMode]fuseutil.DirentType{
+		0644:                              fuseutil.DT_File,
+		os.ModeDir | 0755:                 fuseutil.DT_Directory,
+		os.ModeSymlink | 0777:             fuseutil.DT_Link,
+		os.ModeNamedPipe | 0600:           fuseutil.DT_FIFO,
+		os.ModeSocket | 0600:              fuseutil.DT_Socket,
+		os.ModeDevice | os.ModeCharDevice: fuseutil.DT_Char,
+		os.ModeDevice | 0600:              fuseutil.DT_Block,
+		os.ModeIrregular | 0600:           fuseutil.DT_Unknown,
+	} {
+		if got := fuseutil.DirentTypeForMode(mode); got != want {
+			t.Errorf("DirentTypeForMode(%v): %v, want %v", mode, got, want)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// The extended attribute through which NewUsageTrackingFileSystem exposes the
+// recursive usage of a directory, as the decimal byte and inode counts
+// separated by a space.
+const UsageXattrName = "user.fuse.du"
+
+// The recursive usage of a directory: the apparent sizes of, and the number
+// of, the inodes in the tree it roots, including itself.
+type DirUsage struct {
+	Bytes  uint64
+	Inodes uint64
+}
+
+// A UsageTracker maintains the recursive usage of every directory of a file
+// system, so that du-style queries over huge trees can be answered without
+// walking them. A file linked from several directories counts towards each of
+// them, and twice towards a directory containing two of its links.
+//
+// The tracker starts out knowing only the root directory. The file system
+// should populate it with Add from its own store when starting, which is much
+// cheaper than the kernel walking the tree, and NewUsageTrackingFileSystem
+// keeps it up to date as changes are made through the mount.
+type UsageTracker struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*usageInode
+}
+
+type usageInode struct {
+	size uint64
+
+	// The number of links to the inode from each directory.
+	parents map[fuseops.InodeID]int
+
+	// For directories, the entries within and the recursive usage.
+	children map[string]fuseops.InodeID
+	usage    DirUsage
+}
+
+func (in *usageInode) isDir() bool {
+	return in.children != nil
+}
+
+// Create a tracker for a file system with an empty root directory.
+func NewUsageTracker() *UsageTracker {
+	return &UsageTracker{
+		inodes: map[fuseops.InodeID]*usageInode{
+			fuseops.RootInodeID: {
+				children: make(map[string]fuseops.InodeID),
+				usage:    DirUsage{Inodes: 1},
+			},
+		},
+	}
+}
+
+// Add the change to the usage of the directory and all of its ancestors.
+//
+// LOCKS_REQUIRED(t.mu)
+func (t *UsageTracker) adjust(dir fuseops.InodeID, bytes, inodes int64) {
+	for {
+		d := t.inodes[dir]
+		if d == nil {
+			return
+		}
+
+		d.usage.Bytes += uint64(bytes)
+		d.usage.Inodes += uint64(inodes)
+
+		// Directories have a single parent, except the root, which has none.
+		var parent fuseops.InodeID
+		for p := range d.parents {
+			parent = p
+		}
+
+		if parent == 0 {
+			return
+		}
+
+		dir = parent
+	}
+}
+
+// Return the usage an inode contributes to each directory linking to it.
+//
+// LOCKS_REQUIRED(t.mu)
+func (t *UsageTracker) contribution(in *usageInode) (bytes, inodes int64) {
+	if in.isDir() {
+		return int64(in.usage.Bytes), int64(in.usage.Inodes)
+	}
+
+	return int64(in.size), 1
+}
+
+// Add records that the directory has an entry with the supplied name for the
+// child, whose attributes are given, replacing any existing entry with that
+// name. The directory must already be known to the tracker.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *UsageTracker) Add(
+	dir fuseops.InodeID,
+	name string,
+	child fuseops.InodeID,
+	attrs fuseops.InodeAttributes) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.add(dir, name, child, attrs)
+}
+
+// LOCKS_REQUIRED(t.mu)
+func (t *UsageTracker) add(
+	dir fuseops.InodeID,
+	name string,
+	child fuseops.InodeID,
+	attrs fuseops.InodeAttributes) {
+	d := t.inodes[dir]
+	if d == nil || !d.isDir() {
+		return
+	}
+
+	t.remove(dir, name)
+
+	in := t.inodes[child]
+	if in == nil {
+		in = &usageInode{
+			size:    attrs.Size,
+			parents: make(map[fuseops.InodeID]int),
+		}
+
+		if attrs.Mode.IsDir() {
+			in.children = make(map[string]fuseops.InodeID)
+			in.usage = DirUsage{Bytes: attrs.Size, Inodes: 1}
+		}
+
+		t.inodes[child] = in
+	}
+
+	in.parents[dir]++
+	d.children[name] = child
+	bytes, inodes := t.contribution(in)
+	t.adjust(dir, bytes, inodes)
+}
+
+// Remove records that the named entry of the directory is gone.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *UsageTracker) Remove(dir fuseops.InodeID, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.remove(dir, name)
+}
+
+// LOCKS_REQUIRED(t.mu)
+func (t *UsageTracker) remove(dir fuseops.InodeID, name string) {
+	d := t.inodes[dir]
+	if d == nil || !d.isDir() {
+		return
+	}
+
+	id, ok := d.children[name]
+	if !ok {
+		return
+	}
+
+	in := t.inodes[id]
+	bytes, inodes := t.contribution(in)
+	t.adjust(dir, -bytes, -inodes)
+
+	delete(d.children, name)
+	if in.parents[dir]--; in.parents[dir] == 0 {
+		delete(in.parents, dir)
+	}
+
+	if len(in.parents) == 0 {
+		t.forget(id)
+	}
+}
+
+// Drop the inode, and any tree it roots, from the tracker.
+//
+// LOCKS_REQUIRED(t.mu)
+func (t *UsageTracker) forget(id fuseops.InodeID) {
+	in := t.inodes[id]
+	delete(t.inodes, id)
+
+	for _, child := range in.children {
+		c := t.inodes[child]
+		if c == nil {
+			continue
+		}
+
+		delete(c.parents, id)
+		if len(c.parents) == 0 {
+			t.forget(child)
+		}
+	}
+}
+
+// Move records a rename, replacing any entry with the new name.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *UsageTracker) Move(
+	oldDir fuseops.InodeID,
+	oldName string,
+	newDir fuseops.InodeID,
+	newName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d := t.inodes[oldDir]
+	if d == nil || !d.isDir() {
+		return
+	}
+
+	id, ok := d.children[oldName]
+	if !ok {
+		t.remove(newDir, newName)
+		return
+	}
+
+	in := t.inodes[id]
+	bytes, inodes := t.contribution(in)
+	t.adjust(oldDir, -bytes, -inodes)
+	delete(d.children, oldName)
+	if in.parents[oldDir]--; in.parents[oldDir] == 0 {
+		delete(in.parents, oldDir)
+	}
+
+	nd := t.inodes[newDir]
+	if nd == nil || !nd.isDir() {
+		if len(in.parents) == 0 {
+			t.forget(id)
+		}
+
+		return
+	}
+
+	t.remove(newDir, newName)
+	in.parents[newDir]++
+	nd.children[newName] = id
+	t.adjust(newDir, bytes, inodes)
+}
+
+// Resize records that the apparent size of the inode changed.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *UsageTracker) Resize(id fuseops.InodeID, size uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	in := t.inodes[id]
+	if in == nil {
+		return
+	}
+
+	delta := int64(size - in.size)
+	in.size = size
+	if in.isDir() {
+		t.adjust(id, delta, 0)
+		return
+	}
+
+	for dir, links := range in.parents {
+		t.adjust(dir, delta*int64(links), 0)
+	}
+}
+
+// Return the size of the inode, if it is known.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *UsageTracker) size(id fuseops.InodeID) (uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	in := t.inodes[id]
+	if in == nil {
+		return 0, false
+	}
+
+	return in.size, true
+}
+
+// Usage returns the recursive usage of the directory, or false if the tracker
+// doesn't know it.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *UsageTracker) Usage(dir fuseops.InodeID) (DirUsage, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d := t.inodes[dir]
+	if d == nil || !d.isDir() {
+		return DirUsage{}, false
+	}
+
+	return d.usage, true
+}
+
+// Create a file system that keeps the tracker up to date with the changes
+// made through it, once the wrapped file system has made them, and exposes
+// the usage of each directory known to the tracker through the extended
+// attribute named by UsageXattrName. The attribute isn't listed, so that
+// tools copying extended attributes leave it alone.
+func NewUsageTrackingFileSystem(
+	wrapped FileSystem,
+	t *UsageTracker) FileSystem {
+	return &usageTrackingFileSystem{
+		FileSystem: wrapped,
+		tracker:    t,
+	}
+}
+
+type usageTrackingFileSystem struct {
+	FileSystem
+	tracker *UsageTracker
+}
+
+// Record a creation once it has succeeded.
+func (fs *usageTrackingFileSystem) created(
+	parent fuseops.InodeID,
+	name string,
+	e fuseops.ChildInodeEntry,
+	err error) error {
+	if err == nil {
+		fs.tracker.Add(parent, name, e.Child, e.Attributes)
+	}
+
+	return err
+}
+
+func (fs *usageTrackingFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	err := fs.FileSystem.MkDir(ctx, op)
+	return fs.created(op.Parent, op.Name, op.Entry, err)
+}
+
+func (fs *usageTrackingFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	err := fs.FileSystem.MkNode(ctx, op)
+	return fs.created(op.Parent, op.Name, op.Entry, err)
+}
+
+func (fs *usageTrackingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	err := fs.FileSystem.CreateFile(ctx, op)
+	return fs.created(op.Parent, op.Name, op.Entry, err)
+}
+
+func (fs *usageTrackingFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	err := fs.FileSystem.CreateSymlink(ctx, op)
+	return fs.created(op.Parent, op.Name, op.Entry, err)
+}
+
+func (fs *usageTrackingFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	err := fs.FileSystem.CreateLink(ctx, op)
+	return fs.created(op.Parent, op.Name, op.Entry, err)
+}
+
+func (fs *usageTrackingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	// The tracker only knows how to move entries.
+	if op.Flags&^fuseops.RenameNoReplace != 0 {
+		return syscall.EINVAL
+	}
+
+	if err := fs.FileSystem.Rename(ctx, op); err != nil {
+		return err
+	}
+
+	fs.tracker.Move(op.OldParent, op.OldName, op.NewParent, op.NewName)
+	return nil
+}
+
+func (fs *usageTrackingFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	if err := fs.FileSystem.RmDir(ctx, op); err != nil {
+		return err
+	}
+
+	fs.tracker.Remove(op.Parent, op.Name)
+	return nil
+}
+
+func (fs *usageTrackingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if err := fs.FileSystem.Unlink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.tracker.Remove(op.Parent, op.Name)
+	return nil
+}
+
+func (fs *usageTrackingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if err := fs.FileSystem.WriteFile(ctx, op); err != nil {
+		return err
+	}
+
+	end := uint64(op.Offset) + uint64(op.Written())
+	if size, ok := fs.tracker.size(op.Inode); ok && end > size {
+		fs.tracker.Resize(op.Inode, end)
+	}
+
+	return nil
+}
+
+func (fs *usageTrackingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if err := fs.FileSystem.SetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	if op.Size != nil {
+		fs.tracker.Resize(op.Inode, op.Attributes.Size)
+	}
+
+	return nil
+}
+
+func (fs *usageTrackingFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	if err := fs.FileSystem.Fallocate(ctx, op); err != nil {
+		return err
+	}
+
+	// Only the wrapped file system knows what size e.g. collapsing a range
+	// left the file with.
+	if c, _ := DescribeContentChange(op); c.MayResize {
+		getOp := &fuseops.GetInodeAttributesOp{
+			Inode:     op.Inode,
+			OpContext: op.OpContext,
+		}
+
+		if err := fs.FileSystem.GetInodeAttributes(ctx, getOp); err == nil {
+			fs.tracker.Resize(op.Inode, getOp.Attributes.Size)
+		}
+	}
+
+	return nil
+}
+
+func (fs *usageTrackingFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	if op.Name != UsageXattrName {
+		return fs.FileSystem.GetXattr(ctx, op)
+	}
+
+	u, ok := fs.tracker.Usage(op.Inode)
+	if !ok {
+		return fs.FileSystem.GetXattr(ctx, op)
+	}
+
+	value := []byte(fmt.Sprintf("%d %d", u.Bytes, u.Inodes))
+	return ReadXattr(op, bytes.NewReader(value), len(value))
+}
@@ -0,0 +1,108 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+func TestUsageTracker(t *testing.T) {
+	ctx := context.Background()
+	tracker := fuseutil.NewUsageTracker()
+
+	// Populate the tracker as a file system would when starting: /a/b/f holds
+	// 100 bytes.
+	dirAttrs := fuseops.InodeAttributes{Mode: os.ModeDir | 0755}
+	tracker.Add(fuseops.RootInodeID, "a", 10, dirAttrs)
+	tracker.Add(10, "b", 11, dirAttrs)
+	tracker.Add(11, "f", 12, fuseops.InodeAttributes{Size: 100, Mode: 0644})
+
+	fs := fuseutil.NewUsageTrackingFileSystem(&acceptingFS{next: 100}, tracker)
+
+	check := func(dir fuseops.InodeID, want fuseutil.DirUsage) {
+		t.Helper()
+		if u, ok := tracker.Usage(dir); !ok || u != want {
+			t.Errorf("Usage(%d): %+v, %v; want %+v", dir, u, ok, want)
+		}
+	}
+
+	check(fuseops.RootInodeID, fuseutil.DirUsage{Bytes: 100, Inodes: 4})
+	check(11, fuseutil.DirUsage{Bytes: 100, Inodes: 2})
+
+	// Writing beyond the end grows the file.
+	err := fs.WriteFile(ctx, &fuseops.WriteFileOp{
+		Inode:  12,
+		Offset: 90,
+		Data:   make([]byte, 30),
+	})
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	check(10, fuseutil.DirUsage{Bytes: 120, Inodes: 3})
+
+	// Creations count towards all ancestors.
+	create := &fuseops.CreateFileOp{Parent: 10, Name: "g"}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	check(fuseops.RootInodeID, fuseutil.DirUsage{Bytes: 120, Inodes: 5})
+
+	// Moving a directory moves its usage.
+	err = fs.Rename(ctx, &fuseops.RenameOp{
+		OldParent: 10,
+		OldName:   "b",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "b",
+	})
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	check(10, fuseutil.DirUsage{Bytes: 0, Inodes: 2})
+	check(fuseops.RootInodeID, fuseutil.DirUsage{Bytes: 120, Inodes: 5})
+
+	// Unlinking drops the file's usage.
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 11, Name: "f"}); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	check(fuseops.RootInodeID, fuseutil.DirUsage{Bytes: 0, Inodes: 4})
+	if _, ok := tracker.Usage(12); ok {
+		t.Errorf("Usage of an unlinked file")
+	}
+
+	// The usage is readable as an extended attribute.
+	tracker.Resize(create.Entry.Child, 7)
+	op := &fuseops.GetXattrOp{
+		Inode: fuseops.RootInodeID,
+		Name:  fuseutil.UsageXattrName,
+		Dst:   make([]byte, 64),
+	}
+
+	if err := fs.GetXattr(ctx, op); err != nil {
+		t.Fatalf("GetXattr: %v", err)
+	}
+
+	if got := string(op.Dst[:op.BytesRead]); got != "7 4" {
+		t.Errorf("Extended attribute: %q", got)
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+// NumWriteBuckets returns the number of per-UID write buckets kept by a file
+// system created by NewThrottlingFileSystem.
+func NumWriteBuckets(fs FileSystem) int {
+	t := fs.(*throttlingFileSystem)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.uidWrite)
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// A FileSystem that can answer some ops straight away, for example a wrapper
+// serving attributes or small reads from a cache it keeps. The servers
+// returned by NewFileSystemServer and NewBatchingFileSystemServer offer it
+// each op that only reads from the file system before handing the op to a
+// goroutine of its own, saving the cost of doing so for cache hits.
+type FastPathFileSystem interface {
+	FileSystem
+
+	// Handle the op if that can be done without blocking, returning true along
+	// with the error to respond with, or return false to have the op handled
+	// by calling the usual method. The op is one of GetInodeAttributesOp,
+	// LookUpInodeOp, ReadFileOp, ReadSymlinkOp, GetXattrOp, ListXattrOp and
+	// StatFSOp.
+	//
+	// This is called on the goroutine reading ops from the kernel, so no
+	// further ops are read until it returns, and it must be cheap. Errors
+	// aren't retried, unlike those of the usual methods.
+	TryFastPath(ctx context.Context, op interface{}) (handled bool, err error)
+}
+
+// Report whether the op may be offered to FastPathFileSystem.TryFastPath.
+func isFastPathOp(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.GetInodeAttributesOp,
+		*fuseops.LookUpInodeOp,
+		*fuseops.ReadFileOp,
+		*fuseops.ReadSymlinkOp,
+		*fuseops.GetXattrOp,
+		*fuseops.ListXattrOp,
+		*fuseops.StatFSOp:
+		return true
+	}
+
+	return false
+}
+
+// Offer the op to the file system's fast path, if it has one, replying to the
+// op and returning true if it was handled there.
+func (s *fileSystemServer) tryFastPath(
+	c *fuse.Connection,
+	ctx context.Context,
+	op interface{}) bool {
+	if s.fast == nil || !isFastPathOp(op) {
+		return false
+	}
+
+	// An op on which the fast path panics counts as handled, failing with the
+	// error from Recover.
+	handled := true
+	err := c.Recover(op, func() (err error) {
+		handled, err = s.fast.TryFastPath(ctx, op)
+		return err
+	})
+
+	if !handled {
+		return false
+	}
+
+	c.Reply(ctx, err)
+	return true
+}
@@ -0,0 +1,594 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// The faults injected into an op type by a FaultInjectingFileSystem.
+type Fault struct {
+	// The fraction of ops, between zero and one, failing with Errno without
+	// reaching the wrapped file system. Errno defaults to EIO.
+	ErrorRate float64
+	Errno     syscall.Errno
+
+	// How long ops are held before being passed on, plus a random extra of up
+	// to Jitter. Ops interrupted meanwhile fail with EINTR.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// The fraction of reads and writes cut short at a random length. Short
+	// reads are marked ReadFileOp.Incomplete, and only the data up to the
+	// short length of a write is passed on. Writes back from the page cache,
+	// which can't be short, are left alone.
+	ShortRate float64
+}
+
+// Options for NewFaultInjectingFileSystem.
+type FaultConfig struct {
+	// The faults injected into each op type, named as for
+	// fuse.MountConfig.OpLogLevels, e.g. "ReadFile", with the entry for ""
+	// applying to op types without one of their own. May be changed later
+	// with SetFault.
+	Faults map[string]Fault
+
+	// Seeds the choice of the ops to fault, so that runs can be replayed.
+	// Defaults to the time of creation.
+	Seed int64
+}
+
+// Create a file system that injects errors, latency and short reads and
+// writes into the ops passed to the wrapped file system, so that chaos tests
+// can check how applications cope with a misbehaving file system. Forgets and
+// handle releases, whose errors the kernel ignores, are passed on untouched.
+func NewFaultInjectingFileSystem(
+	wrapped FileSystem,
+	cfg FaultConfig) *FaultInjectingFileSystem {
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+
+	fs := &FaultInjectingFileSystem{
+		FileSystem: wrapped,
+		faults:     make(map[string]Fault),
+		rand:       rand.New(rand.NewSource(cfg.Seed)),
+	}
+
+	for name, f := range cfg.Faults {
+		fs.faults[name] = f
+	}
+
+	return fs
+}
+
+// A file system created by NewFaultInjectingFileSystem, whose faults may be
+// changed while it is mounted.
+type FaultInjectingFileSystem struct {
+	FileSystem
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	faults map[string]Fault
+	rand   *rand.Rand
+}
+
+// SetFault sets the faults injected into the named op type, or into op types
+// without faults of their own if name is "". The zero Fault injects none.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *FaultInjectingFileSystem) SetFault(name string, f Fault) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if f == (Fault{}) {
+		delete(fs.faults, name)
+		return
+	}
+
+	fs.faults[name] = f
+}
+
+// ClearFaults stops injecting faults into any op.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *FaultInjectingFileSystem) ClearFaults() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.faults = make(map[string]Fault)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// The name of the op, e.g. "ReadFile".
+func faultOpName(op interface{}) string {
+	return strings.TrimSuffix(reflect.TypeOf(op).Elem().Name(), "Op")
+}
+
+// What to do to an op.
+type faultPlan struct {
+	delay time.Duration
+	errno syscall.Errno
+
+	// The fraction of a read or write to keep, or zero to keep it all.
+	short float64
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *FaultInjectingFileSystem) plan(op interface{}) (p faultPlan) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, ok := fs.faults[faultOpName(op)]
+	if !ok {
+		f, ok = fs.faults[""]
+	}
+
+	if !ok {
+		return
+	}
+
+	p.delay = f.Latency
+	if f.Jitter > 0 {
+		p.delay += time.Duration(fs.rand.Int63n(int64(f.Jitter)))
+	}
+
+	if f.ErrorRate > 0 && fs.rand.Float64() < f.ErrorRate {
+		p.errno = f.Errno
+		if p.errno == 0 {
+			p.errno = syscall.EIO
+		}
+	}
+
+	if f.ShortRate > 0 && fs.rand.Float64() < f.ShortRate {
+		p.short = fs.rand.Float64()
+	}
+
+	return
+}
+
+// Wait out the planned latency, then return the planned error, if any.
+func (fs *FaultInjectingFileSystem) inject(
+	ctx context.Context,
+	p faultPlan) error {
+	if p.delay > 0 {
+		t := time.NewTimer(p.delay)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+	}
+
+	if p.errno != 0 {
+		return p.errno
+	}
+
+	return nil
+}
+
+// Plan and inject the faults for an op other than a read or write.
+func (fs *FaultInjectingFileSystem) fault(
+	ctx context.Context,
+	op interface{}) error {
+	return fs.inject(ctx, fs.plan(op))
+}
+
+// Return a length in [1, n) proportional to the supplied fraction, or n if
+// that range is empty.
+func shortLength(n int, fraction float64) int {
+	if n < 2 {
+		return n
+	}
+
+	return 1 + int(fraction*float64(n-1))
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *FaultInjectingFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	p := fs.plan(op)
+	if err := fs.inject(ctx, p); err != nil {
+		return err
+	}
+
+	if err := fs.FileSystem.ReadFile(ctx, op); err != nil || p.short == 0 {
+		return err
+	}
+
+	short := shortLength(op.BytesRead, p.short)
+	if short == op.BytesRead {
+		return nil
+	}
+
+	op.BytesRead = short
+	op.Incomplete = true
+	return nil
+}
+
+func (fs *FaultInjectingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	p := fs.plan(op)
+	if err := fs.inject(ctx, p); err != nil {
+		return err
+	}
+
+	short := shortLength(len(op.Data), p.short)
+	if p.short == 0 || op.FromPageCache || short == len(op.Data) {
+		return fs.FileSystem.WriteFile(ctx, op)
+	}
+
+	// Pass on the start of the data only, then restore it for the connection
+	// to check BytesWritten against.
+	data := op.Data
+	op.Data = data[:short]
+	err := fs.FileSystem.WriteFile(ctx, op)
+	op.Data = data
+
+	if err == nil && op.BytesWritten == 0 {
+		op.BytesWritten = short
+	}
+
+	return err
+}
+
+func (fs *FaultInjectingFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.StatFS(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.LookUpInode(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.GetInodeAttributes(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Access(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.MkDir(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.MkNode(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.CreateFile(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.CreateLink(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.CreateSymlink(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Rename(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.RmDir(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Unlink(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.OpenDir(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.ReadDir(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.ReadDirPlus(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.OpenFile(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SyncFile(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.FlushFile(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SyncFS(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.ReadSymlink(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.RemoveXattr(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.GetXattr(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.ListXattr(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SetXattr(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Lseek(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Poll(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) GetInodeFlags(
+	ctx context.Context,
+	op *fuseops.GetInodeFlagsOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.GetInodeFlags(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) SetInodeFlags(
+	ctx context.Context,
+	op *fuseops.SetInodeFlagsOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SetInodeFlags(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Ioctl(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) GetLk(
+	ctx context.Context,
+	op *fuseops.GetLkOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.GetLk(ctx, op)
+}
+
+func (fs *FaultInjectingFileSystem) SetLk(
+	ctx context.Context,
+	op *fuseops.SetLkOp) error {
+	if err := fs.fault(ctx, op); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SetLk(ctx, op)
+}
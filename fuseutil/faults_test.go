@@ -0,0 +1,110 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A file system that reads and writes everything asked of it.
+type ioFS struct {
+	fuseutil.NotImplementedFileSystem
+	written int
+}
+
+func (fs *ioFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	op.BytesRead = len(op.Dst)
+	return nil
+}
+
+func (fs *ioFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.written = len(op.Data)
+	return nil
+}
+
+func TestFaultInjectingFileSystem(t *testing.T) {
+	ctx := context.Background()
+	backend := &ioFS{}
+	fs := fuseutil.NewFaultInjectingFileSystem(backend, fuseutil.FaultConfig{
+		Faults: map[string]fuseutil.Fault{
+			"":        {ErrorRate: 1, Errno: syscall.ENOSPC},
+			"StatFS":  {ErrorRate: 1},
+			"GetLk":   {Latency: time.Hour},
+			"ReadDir": {},
+		},
+		Seed: 1,
+	})
+
+	// Errors, with defaults for the errno and op type.
+	if err := fs.StatFS(ctx, &fuseops.StatFSOp{}); err != syscall.EIO {
+		t.Errorf("StatFS: %v", err)
+	}
+
+	if err := fs.MkDir(ctx, &fuseops.MkDirOp{}); err != syscall.ENOSPC {
+		t.Errorf("MkDir: %v", err)
+	}
+
+	if err := fs.ReadDir(ctx, &fuseops.ReadDirOp{}); err != syscall.ENOSYS {
+		t.Errorf("ReadDir: %v", err)
+	}
+
+	// Latency, cut short by interrupts.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := fs.GetLk(cancelled, &fuseops.GetLkOp{}); err != syscall.EINTR {
+		t.Errorf("GetLk: %v", err)
+	}
+
+	// Short reads and writes.
+	fs.SetFault("", fuseutil.Fault{})
+	fs.SetFault("ReadFile", fuseutil.Fault{ShortRate: 1})
+	fs.SetFault("WriteFile", fuseutil.Fault{ShortRate: 1})
+
+	read := &fuseops.ReadFileOp{Dst: make([]byte, 100), Size: 100}
+	if err := fs.ReadFile(ctx, read); err != nil || read.BytesRead >= 100 || !read.Incomplete {
+		t.Errorf("ReadFile: %v, %d bytes, incomplete %v", err, read.BytesRead, read.Incomplete)
+	}
+
+	write := &fuseops.WriteFileOp{Data: make([]byte, 100)}
+	if err := fs.WriteFile(ctx, write); err != nil ||
+		backend.written >= 100 ||
+		write.BytesWritten != backend.written ||
+		len(write.Data) != 100 {
+		t.Errorf("WriteFile: %v, %d of %d bytes passed on, %d written",
+			err, backend.written, len(write.Data), write.BytesWritten)
+	}
+
+	// Write back can't be short.
+	write = &fuseops.WriteFileOp{Data: make([]byte, 100), FromPageCache: true}
+	if err := fs.WriteFile(ctx, write); err != nil || backend.written != 100 {
+		t.Errorf("WriteFile from the page cache: %v, %d bytes passed on", err, backend.written)
+	}
+
+	// Clearing the faults lets everything through.
+	fs.ClearFaults()
+	if err := fs.StatFS(ctx, &fuseops.StatFSOp{}); err != syscall.ENOSYS {
+		t.Errorf("StatFS after clearing: %v", err)
+	}
+}
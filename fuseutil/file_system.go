@@ -38,6 +38,7 @@ type FileSystem interface {
 	LookUpInode(context.Context, *fuseops.LookUpInodeOp) error
 	GetInodeAttributes(context.Context, *fuseops.GetInodeAttributesOp) error
 	SetInodeAttributes(context.Context, *fuseops.SetInodeAttributesOp) error
+	Access(context.Context, *fuseops.AccessOp) error
 	ForgetInode(context.Context, *fuseops.ForgetInodeOp) error
 	BatchForget(context.Context, *fuseops.BatchForgetOp) error
 	MkDir(context.Context, *fuseops.MkDirOp) error
@@ -50,12 +51,14 @@ type FileSystem interface {
 	Unlink(context.Context, *fuseops.UnlinkOp) error
 	OpenDir(context.Context, *fuseops.OpenDirOp) error
 	ReadDir(context.Context, *fuseops.ReadDirOp) error
+	ReadDirPlus(context.Context, *fuseops.ReadDirPlusOp) error
 	ReleaseDirHandle(context.Context, *fuseops.ReleaseDirHandleOp) error
 	OpenFile(context.Context, *fuseops.OpenFileOp) error
 	ReadFile(context.Context, *fuseops.ReadFileOp) error
 	WriteFile(context.Context, *fuseops.WriteFileOp) error
 	SyncFile(context.Context, *fuseops.SyncFileOp) error
 	FlushFile(context.Context, *fuseops.FlushFileOp) error
+	SyncFS(context.Context, *fuseops.SyncFSOp) error
 	ReleaseFileHandle(context.Context, *fuseops.ReleaseFileHandleOp) error
 	ReadSymlink(context.Context, *fuseops.ReadSymlinkOp) error
 	RemoveXattr(context.Context, *fuseops.RemoveXattrOp) error
@@ -63,6 +66,13 @@ type FileSystem interface {
 	ListXattr(context.Context, *fuseops.ListXattrOp) error
 	SetXattr(context.Context, *fuseops.SetXattrOp) error
 	Fallocate(context.Context, *fuseops.FallocateOp) error
+	Lseek(context.Context, *fuseops.LseekOp) error
+	Poll(context.Context, *fuseops.PollOp) error
+	GetInodeFlags(context.Context, *fuseops.GetInodeFlagsOp) error
+	SetInodeFlags(context.Context, *fuseops.SetInodeFlagsOp) error
+	Ioctl(context.Context, *fuseops.IoctlOp) error
+	GetLk(context.Context, *fuseops.GetLkOp) error
+	SetLk(context.Context, *fuseops.SetLkOp) error
 
 	// Regard all inodes (including the root inode) as having their lookup counts
 	// decremented to zero, and clean up any resources associated with the file
@@ -72,26 +82,41 @@ type FileSystem interface {
 
 // Create a fuse.Server that handles ops by calling the associated FileSystem
 // method.Respond with the resulting error. Unsupported ops are responded to
-// directly with ENOSYS.
+// directly with ENOSYS. Ops failing with fuse.EAGAINRetry are retried; see
+// Connection.Retry. Ops on which a method panics fail with EIO, unless
+// MountConfig.PanicPolicy says to crash; see Connection.Recover.
 //
-// Each call to a FileSystem method (except ForgetInode) is made on
-// its own goroutine, and is free to block. ForgetInode may be called
-// synchronously, and should not depend on calls to other methods
-// being received concurrently.
+// Each call to a FileSystem method (except ForgetInode and BatchForget) is
+// made on its own goroutine, and is free to block. ForgetInode and
+// BatchForget may be called synchronously, and should not depend on calls to
+// other methods being received concurrently. How many calls are made at once
+// can be limited with MountConfig.MaxConcurrentOps; see Connection.Schedule.
+// File systems implementing FastPathFileSystem may answer some ops before
+// that happens.
 //
 // (It is safe to naively process ops concurrently because the kernel
 // guarantees to serialize operations that the user expects to happen in order,
 // cf. http://goo.gl/jnkHPO, fuse-devel thread "Fuse guarantees on concurrent
 // requests").
 func NewFileSystemServer(fs FileSystem) fuse.Server {
-	return &fileSystemServer{
+	return newFileSystemServer(fs)
+}
+
+func newFileSystemServer(fs FileSystem) *fileSystemServer {
+	s := &fileSystemServer{
 		fs: fs,
 	}
+
+	s.fast, _ = fs.(FastPathFileSystem)
+	return s
 }
 
 type fileSystemServer struct {
 	fs          FileSystem
 	opsInFlight sync.WaitGroup
+
+	// The file system, if it has a fast path. See fast_path.go.
+	fast FastPathFileSystem
 }
 
 func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
@@ -112,16 +137,33 @@ func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
 			panic(err)
 		}
 
-		s.opsInFlight.Add(1)
-		if _, ok := op.(*fuseops.ForgetInodeOp); ok {
-			// Special case: call in this goroutine for
-			// forget inode ops, which may come in a
-			// flurry from the kernel and are generally
-			// cheap for the file system to handle
-			s.handleOp(c, ctx, op)
-		} else {
-			go s.handleOp(c, ctx, op)
-		}
+		s.dispatch(c, ctx, op)
+	}
+}
+
+// Arrange for the supplied op to be handled and responded to.
+func (s *fileSystemServer) dispatch(
+	c *fuse.Connection,
+	ctx context.Context,
+	op interface{}) {
+	if s.tryFastPath(c, ctx, op) {
+		return
+	}
+
+	s.opsInFlight.Add(1)
+	switch op.(type) {
+	case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
+		// Special case: call in this goroutine for
+		// forget inode ops, which may come in a
+		// flurry from the kernel and are generally
+		// cheap for the file system to handle. Under
+		// memory pressure the kernel sends batches of
+		// thousands of them, which file systems can
+		// handle under a single lock acquisition.
+		s.handleOp(c, ctx, op)
+
+	default:
+		c.Schedule(op, func() { s.handleOp(c, ctx, op) })
 	}
 }
 
@@ -131,33 +173,58 @@ func (s *fileSystemServer) handleOp(
 	op interface{}) {
 	defer s.opsInFlight.Done()
 
-	// Dispatch to the appropriate method.
-	var err error
+	// Hold back modifications while the file system is frozen.
+	if err := c.WaitForThaw(ctx, op); err != nil {
+		c.Reply(ctx, err)
+		return
+	}
+
+	// Retry ops the file system can't handle for the time being, and fail
+	// those on which it panics.
+	err := c.Retry(ctx, op, func() error {
+		return c.Recover(op, func() error { return Dispatch(ctx, s.fs, op) })
+	})
+
+	c.Reply(ctx, err)
+}
+
+// Dispatch calls the method of fs that handles the supplied op, as the server
+// returned by NewFileSystemServer does, and returns its error. Ops that fs has
+// no method for fail with ENOSYS, and a BatchForgetOp is handled as a series of
+// ForgetInodeOps if BatchForget does so. This lets ops synthesized without a
+// connection, e.g. by fusetesting.Harness, be handled as if read from one.
+func Dispatch(
+	ctx context.Context,
+	fs FileSystem,
+	op interface{}) (err error) {
 	switch typed := op.(type) {
 	default:
 		err = fuse.ENOSYS
 
 	case *fuseops.StatFSOp:
-		err = s.fs.StatFS(ctx, typed)
+		err = fs.StatFS(ctx, typed)
 
 	case *fuseops.LookUpInodeOp:
-		err = s.fs.LookUpInode(ctx, typed)
+		err = fs.LookUpInode(ctx, typed)
 
 	case *fuseops.GetInodeAttributesOp:
-		err = s.fs.GetInodeAttributes(ctx, typed)
+		err = fs.GetInodeAttributes(ctx, typed)
 
 	case *fuseops.SetInodeAttributesOp:
-		err = s.fs.SetInodeAttributes(ctx, typed)
+		err = fs.SetInodeAttributes(ctx, typed)
+
+	case *fuseops.AccessOp:
+		err = fs.Access(ctx, typed)
 
 	case *fuseops.ForgetInodeOp:
-		err = s.fs.ForgetInode(ctx, typed)
+		err = fs.ForgetInode(ctx, typed)
 
 	case *fuseops.BatchForgetOp:
-		err = s.fs.BatchForget(ctx, typed)
+		err = fs.BatchForget(ctx, typed)
 		if err == fuse.ENOSYS {
 			// Handle as a series of single-inode forget operations
 			for _, entry := range typed.Entries {
-				err = s.fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{
+				err = fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{
 					Inode:     entry.Inode,
 					N:         entry.N,
 					OpContext: typed.OpContext,
@@ -169,74 +236,101 @@ func (s *fileSystemServer) handleOp(
 		}
 
 	case *fuseops.MkDirOp:
-		err = s.fs.MkDir(ctx, typed)
+		err = fs.MkDir(ctx, typed)
 
 	case *fuseops.MkNodeOp:
-		err = s.fs.MkNode(ctx, typed)
+		err = fs.MkNode(ctx, typed)
 
 	case *fuseops.CreateFileOp:
-		err = s.fs.CreateFile(ctx, typed)
+		err = fs.CreateFile(ctx, typed)
 
 	case *fuseops.CreateLinkOp:
-		err = s.fs.CreateLink(ctx, typed)
+		err = fs.CreateLink(ctx, typed)
 
 	case *fuseops.CreateSymlinkOp:
-		err = s.fs.CreateSymlink(ctx, typed)
+		err = fs.CreateSymlink(ctx, typed)
 
 	case *fuseops.RenameOp:
-		err = s.fs.Rename(ctx, typed)
+		err = fs.Rename(ctx, typed)
 
 	case *fuseops.RmDirOp:
-		err = s.fs.RmDir(ctx, typed)
+		err = fs.RmDir(ctx, typed)
 
 	case *fuseops.UnlinkOp:
-		err = s.fs.Unlink(ctx, typed)
+		err = fs.Unlink(ctx, typed)
 
 	case *fuseops.OpenDirOp:
-		err = s.fs.OpenDir(ctx, typed)
+		err = fs.OpenDir(ctx, typed)
 
 	case *fuseops.ReadDirOp:
-		err = s.fs.ReadDir(ctx, typed)
+		err = fs.ReadDir(ctx, typed)
+
+	case *fuseops.ReadDirPlusOp:
+		err = fs.ReadDirPlus(ctx, typed)
 
 	case *fuseops.ReleaseDirHandleOp:
-		err = s.fs.ReleaseDirHandle(ctx, typed)
+		err = fs.ReleaseDirHandle(ctx, typed)
 
 	case *fuseops.OpenFileOp:
-		err = s.fs.OpenFile(ctx, typed)
+		err = fs.OpenFile(ctx, typed)
 
 	case *fuseops.ReadFileOp:
-		err = s.fs.ReadFile(ctx, typed)
+		err = fs.ReadFile(ctx, typed)
 
 	case *fuseops.WriteFileOp:
-		err = s.fs.WriteFile(ctx, typed)
+		err = fs.WriteFile(ctx, typed)
 
 	case *fuseops.SyncFileOp:
-		err = s.fs.SyncFile(ctx, typed)
+		err = fs.SyncFile(ctx, typed)
 
 	case *fuseops.FlushFileOp:
-		err = s.fs.FlushFile(ctx, typed)
+		err = fs.FlushFile(ctx, typed)
+
+	case *fuseops.SyncFSOp:
+		err = fs.SyncFS(ctx, typed)
 
 	case *fuseops.ReleaseFileHandleOp:
-		err = s.fs.ReleaseFileHandle(ctx, typed)
+		err = fs.ReleaseFileHandle(ctx, typed)
 
 	case *fuseops.ReadSymlinkOp:
-		err = s.fs.ReadSymlink(ctx, typed)
+		err = fs.ReadSymlink(ctx, typed)
 
 	case *fuseops.RemoveXattrOp:
-		err = s.fs.RemoveXattr(ctx, typed)
+		err = fs.RemoveXattr(ctx, typed)
 
 	case *fuseops.GetXattrOp:
-		err = s.fs.GetXattr(ctx, typed)
+		err = fs.GetXattr(ctx, typed)
 
 	case *fuseops.ListXattrOp:
-		err = s.fs.ListXattr(ctx, typed)
+		err = fs.ListXattr(ctx, typed)
 
 	case *fuseops.SetXattrOp:
-		err = s.fs.SetXattr(ctx, typed)
+		err = fs.SetXattr(ctx, typed)
 
 	case *fuseops.FallocateOp:
-		err = s.fs.Fallocate(ctx, typed)
+		err = fs.Fallocate(ctx, typed)
+
+	case *fuseops.LseekOp:
+		err = fs.Lseek(ctx, typed)
+
+	case *fuseops.PollOp:
+		err = fs.Poll(ctx, typed)
+
+	case *fuseops.GetInodeFlagsOp:
+		err = fs.GetInodeFlags(ctx, typed)
+
+	case *fuseops.SetInodeFlagsOp:
+		err = fs.SetInodeFlags(ctx, typed)
+
+	case *fuseops.IoctlOp:
+		err = fs.Ioctl(ctx, typed)
+
+	case *fuseops.GetLkOp:
+		err = fs.GetLk(ctx, typed)
+
+	case *fuseops.SetLkOp:
+		err = fs.SetLk(ctx, typed)
 	}
 
-	c.Reply(ctx, err)
+	return err
 }
@@ -0,0 +1,359 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Handle IDs issued by NewHandleGenerationFileSystem carry the generation in
+// their top bits, and the wrapped file system's ID in the rest.
+const (
+	generationShift     = 48
+	generationLocalMask = 1<<generationShift - 1
+)
+
+// Create a file system that keeps the handles it issues from being mistaken
+// for those issued by a previous run of the daemon, for daemons that restart
+// without unmounting, e.g. by handing the connection to the kernel over to
+// their successor. The kernel then carries on using the handles that the
+// previous run issued, which wrapped knows nothing about or has issued again
+// since for other files.
+//
+// The top 16 bits of each handle are set to generation, which the daemon must
+// change each time it starts, e.g. by incrementing one kept on disk. Ops on a
+// handle of another generation fail with EBADF without reaching wrapped, and
+// releasing one succeeds. Handles issued by wrapped must fit in the remaining
+// 48 bits; opening a file or directory for which it issues a larger one fails
+// with EIO.
+//
+// Inode IDs are not covered: a restarted daemon must recognize the inodes
+// that the previous run told the kernel about, or fail ops on them with
+// ESTALE.
+func NewHandleGenerationFileSystem(
+	wrapped FileSystem,
+	generation uint16) FileSystem {
+	return &handleGenerationFileSystem{
+		FileSystem: wrapped,
+		generation: generation,
+	}
+}
+
+type handleGenerationFileSystem struct {
+	FileSystem
+	generation uint16
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Tag a handle issued by the wrapped file system with the generation, or
+// return EIO if it doesn't fit.
+func (fs *handleGenerationFileSystem) wrapHandle(h *fuseops.HandleID) error {
+	if *h&^generationLocalMask != 0 {
+		return syscall.EIO
+	}
+
+	*h |= fuseops.HandleID(fs.generation) << generationShift
+	return nil
+}
+
+// Replace *h with the wrapped file system's handle, returning a function that
+// undoes the replacement, or EBADF if the handle is from another generation.
+func (fs *handleGenerationFileSystem) localHandle(
+	h *fuseops.HandleID) (restore func(), err error) {
+	orig := *h
+	if uint16(orig>>generationShift) != fs.generation {
+		return nil, syscall.EBADF
+	}
+
+	*h = orig & generationLocalMask
+	return func() { *h = orig }, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Opening and releasing
+////////////////////////////////////////////////////////////////////////
+
+func (fs *handleGenerationFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := fs.FileSystem.CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	if err := fs.wrapHandle(&op.Handle); err != nil {
+		fs.FileSystem.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{
+			Handle:    op.Handle,
+			OpContext: op.OpContext,
+		})
+
+		return err
+	}
+
+	return nil
+}
+
+func (fs *handleGenerationFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if err := fs.FileSystem.OpenFile(ctx, op); err != nil {
+		return err
+	}
+
+	if err := fs.wrapHandle(&op.Handle); err != nil {
+		fs.FileSystem.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{
+			Handle:    op.Handle,
+			OpContext: op.OpContext,
+		})
+
+		return err
+	}
+
+	return nil
+}
+
+func (fs *handleGenerationFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	if err := fs.FileSystem.OpenDir(ctx, op); err != nil {
+		return err
+	}
+
+	if err := fs.wrapHandle(&op.Handle); err != nil {
+		fs.FileSystem.ReleaseDirHandle(ctx, &fuseops.ReleaseDirHandleOp{
+			Handle:    op.Handle,
+			OpContext: op.OpContext,
+		})
+
+		return err
+	}
+
+	return nil
+}
+
+func (fs *handleGenerationFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return nil
+	}
+	defer restore()
+
+	return fs.FileSystem.ReleaseFileHandle(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return nil
+	}
+	defer restore()
+
+	return fs.FileSystem.ReleaseDirHandle(ctx, op)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Ops on handles
+////////////////////////////////////////////////////////////////////////
+
+func (fs *handleGenerationFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if op.Handle != nil {
+		restore, err := fs.localHandle(op.Handle)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.ReadDir(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.ReadDirPlus(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.ReadFile(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.SyncFile(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.FlushFile(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.Lseek(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.Poll(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) GetInodeFlags(
+	ctx context.Context,
+	op *fuseops.GetInodeFlagsOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.GetInodeFlags(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) SetInodeFlags(
+	ctx context.Context,
+	op *fuseops.SetInodeFlagsOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.SetInodeFlags(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.Ioctl(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) GetLk(
+	ctx context.Context,
+	op *fuseops.GetLkOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.GetLk(ctx, op)
+}
+
+func (fs *handleGenerationFileSystem) SetLk(
+	ctx context.Context,
+	op *fuseops.SetLkOp) error {
+	restore, err := fs.localHandle(&op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.SetLk(ctx, op)
+}
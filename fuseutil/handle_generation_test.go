@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A file system issuing handles in sequence, and recording those read from
+// and released.
+type handleFS struct {
+	fuseutil.NotImplementedFileSystem
+	next     fuseops.HandleID
+	read     []fuseops.HandleID
+	released []fuseops.HandleID
+}
+
+func (fs *handleFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.next++
+	op.Handle = fs.next
+	return nil
+}
+
+func (fs *handleFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.read = append(fs.read, op.Handle)
+	return nil
+}
+
+func (fs *handleFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.released = append(fs.released, op.Handle)
+	return nil
+}
+
+func TestHandleGenerationFileSystem(t *testing.T) {
+	ctx := context.Background()
+
+	// Open a file before and after a restart.
+	before := fuseutil.NewHandleGenerationFileSystem(&handleFS{}, 1)
+	open := &fuseops.OpenFileOp{Inode: 2}
+	if err := before.OpenFile(ctx, open); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	stale := open.Handle
+
+	wrapped := &handleFS{}
+	after := fuseutil.NewHandleGenerationFileSystem(wrapped, 2)
+	open = &fuseops.OpenFileOp{Inode: 2}
+	if err := after.OpenFile(ctx, open); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	if open.Handle == stale {
+		t.Fatalf("Same handle issued after restarting: %v", stale)
+	}
+
+	// The current handle reaches the wrapped file system as it issued it, and
+	// is left untouched.
+	read := &fuseops.ReadFileOp{Handle: open.Handle}
+	if err := after.ReadFile(ctx, read); err != nil {
+		t.Errorf("ReadFile: %v", err)
+	}
+
+	if len(wrapped.read) != 1 || wrapped.read[0] != 1 || read.Handle != open.Handle {
+		t.Errorf("Read handles %v, op handle %v", wrapped.read, read.Handle)
+	}
+
+	// The stale one doesn't.
+	if err := after.ReadFile(ctx, &fuseops.ReadFileOp{Handle: stale}); err != syscall.EBADF {
+		t.Errorf("ReadFile on a stale handle: %v", err)
+	}
+
+	if err := after.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: stale}); err != nil {
+		t.Errorf("ReleaseFileHandle on a stale handle: %v", err)
+	}
+
+	if len(wrapped.read) != 1 || len(wrapped.released) != 0 {
+		t.Errorf("Stale handle reached the file system: %v, %v", wrapped.read, wrapped.released)
+	}
+}
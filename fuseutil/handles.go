@@ -0,0 +1,192 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// HandleTable issues the handle IDs for a file system's open files and
+// directories and keeps what it knows about each of them, for file systems
+// that would otherwise keep a map from handle ID to their own state.
+//
+// IDs are never reused, so that a stale handle can't reach another file's
+// state, and the table keeps count of releases of handles it doesn't know
+// about, which the kernel never sends to a correct file system. Check reports
+// those together with the handles still open, e.g. from Destroy, by which
+// point the kernel has released every handle it was given.
+//
+// A HandleTable is safe for concurrent use. The zero value is not; use
+// NewHandleTable.
+type HandleTable struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]*tableHandle
+
+	// The ID to be issued next.
+	//
+	// GUARDED_BY(mu)
+	next fuseops.HandleID
+
+	// The number of calls to Release for handles not in the table.
+	//
+	// GUARDED_BY(mu)
+	unknownReleases int
+}
+
+type tableHandle struct {
+	inode  fuseops.InodeID
+	opened time.Time
+	value  interface{}
+}
+
+// Create an empty handle table.
+func NewHandleTable() *HandleTable {
+	return &HandleTable{
+		handles: make(map[fuseops.HandleID]*tableHandle),
+		next:    1,
+	}
+}
+
+// Issue a new handle for the given inode, associating v with it.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable) Allocate(
+	inode fuseops.InodeID,
+	v interface{}) fuseops.HandleID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h := t.next
+	t.next++
+	t.handles[h] = &tableHandle{
+		inode:  inode,
+		opened: time.Now(),
+		value:  v,
+	}
+
+	return h
+}
+
+// Return the value associated with a handle, and whether it is open.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable) Lookup(h fuseops.HandleID) (interface{}, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	th, ok := t.handles[h]
+	if !ok {
+		return nil, false
+	}
+
+	return th.value, true
+}
+
+// Remove a handle from the table, returning the value associated with it and
+// whether it was open. Releasing a handle that isn't open is counted against
+// the table, and reported by Check.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable) Release(h fuseops.HandleID) (interface{}, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	th, ok := t.handles[h]
+	if !ok {
+		t.unknownReleases++
+		return nil, false
+	}
+
+	delete(t.handles, h)
+	return th.value, true
+}
+
+// Call f for each open handle in increasing order of ID, until it returns
+// false. f must not call other methods on the table.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable) Range(f func(h fuseops.HandleID, v interface{}) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, h := range t.sortedIDs() {
+		if !f(h, t.handles[h].value) {
+			return
+		}
+	}
+}
+
+// Return the number of open handles.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.handles)
+}
+
+// Return an error describing the handles still open and the releases of
+// handles that weren't, or nil if there are neither.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable) Check() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var problems []string
+	now := time.Now()
+	for _, h := range t.sortedIDs() {
+		th := t.handles[h]
+		problems = append(
+			problems,
+			fmt.Sprintf(
+				"handle %d for inode %d leaked after %v",
+				h,
+				th.inode,
+				now.Sub(th.opened).Round(time.Millisecond)))
+	}
+
+	if t.unknownReleases != 0 {
+		problems = append(
+			problems,
+			fmt.Sprintf("%d releases of handles not open", t.unknownReleases))
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("unbalanced handles: %s", strings.Join(problems, "; "))
+}
+
+// LOCKS_REQUIRED(t.mu)
+func (t *HandleTable) sortedIDs() []fuseops.HandleID {
+	ids := make([]fuseops.HandleID, 0, len(t.handles))
+	for h := range t.handles {
+		ids = append(ids, h)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+func TestHandleTable(t *testing.T) {
+	table := fuseutil.NewHandleTable()
+
+	a := table.Allocate(2, "a")
+	b := table.Allocate(3, "b")
+	if a == b {
+		t.Fatalf("Both handles are %d", a)
+	}
+
+	if v, ok := table.Lookup(b); !ok || v != "b" {
+		t.Errorf("Lookup(%d): %v, %v", b, v, ok)
+	}
+
+	if v, ok := table.Release(a); !ok || v != "a" {
+		t.Errorf("Release(%d): %v, %v", a, v, ok)
+	}
+
+	if _, ok := table.Lookup(a); ok {
+		t.Errorf("Handle %d still open after release", a)
+	}
+
+	// IDs aren't reused.
+	c := table.Allocate(2, "c")
+	if c == a || c == b {
+		t.Errorf("Handle %d reissued", c)
+	}
+
+	var seen []fuseops.HandleID
+	table.Range(func(h fuseops.HandleID, v interface{}) bool {
+		seen = append(seen, h)
+		return true
+	})
+
+	if len(seen) != 2 || seen[0] != b || seen[1] != c {
+		t.Errorf("Range saw %v, want [%d %d]", seen, b, c)
+	}
+
+	if n := table.Len(); n != 2 {
+		t.Errorf("Len: %d", n)
+	}
+}
+
+func TestHandleTableCheck(t *testing.T) {
+	table := fuseutil.NewHandleTable()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			table.Release(table.Allocate(2, nil))
+		}()
+	}
+
+	wg.Wait()
+	if err := table.Check(); err != nil {
+		t.Fatalf("Check with balanced releases: %v", err)
+	}
+
+	h := table.Allocate(7, nil)
+	table.Release(1)
+	table.Release(100)
+
+	err := table.Check()
+	if err == nil {
+		t.Fatalf("Check returned nil with a leaked handle")
+	}
+
+	for _, want := range []string{
+		fmt.Sprintf("handle %d for inode 7 leaked", h),
+		"2 releases of handles not open",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Check: %q doesn't mention %q", err, want)
+		}
+	}
+}
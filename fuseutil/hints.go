@@ -0,0 +1,161 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// The prefix of the extended attribute names through which applications send
+// hints, e.g. "user.fuse.hint.prefetch". See NewHintingFileSystem.
+const HintXattrPrefix = "user.fuse.hint."
+
+// The kinds of hint applications may send.
+type HintKind string
+
+const (
+	// The range is about to be read, and should be fetched ahead of time.
+	HintPrefetch HintKind = "prefetch"
+
+	// The range should be kept in the file system's cache until unpinned.
+	HintPin HintKind = "pin"
+
+	// Undo HintPin.
+	HintUnpin HintKind = "unpin"
+
+	// The range won't be needed again soon, and may be evicted from caches.
+	HintDontNeed HintKind = "dontneed"
+)
+
+// A hint from an application about its future use of a file or directory.
+type HintOp struct {
+	Inode fuseops.InodeID
+	Kind  HintKind
+
+	// The range of the file concerned. A zero Length extends to the end of the
+	// file.
+	Offset uint64
+	Length uint64
+
+	OpContext fuseops.OpContext
+}
+
+// Create a file system that turns extended attribute accesses under
+// HintXattrPrefix into calls to handle with a HintOp, letting applications
+// such as training data loaders say what they will need next:
+//
+//	setfattr -n user.fuse.hint.prefetch -v 0,1048576 data/shard-0001
+//	getfattr -n user.fuse.hint.prefetch data/shard-0002
+//
+// Setting the attribute passes the range in its value, as "offset,length", or
+// means the whole file if the value is empty. Since the kernel requires write
+// permission to set a user attribute on a file, reading the attribute is also
+// accepted as a hint about the whole file, needing only read permission; it
+// returns an empty value. Hint attributes are never stored nor listed.
+//
+// Unknown hint kinds fail with ENOTSUP, and malformed ranges with EINVAL.
+// Whatever handle returns is returned to the application, so a file system
+// that ignores a hint should return nil. Handling should be quick, starting
+// any actual fetching in the background.
+func NewHintingFileSystem(
+	wrapped FileSystem,
+	handle func(context.Context, *HintOp) error) FileSystem {
+	return &hintingFileSystem{
+		FileSystem: wrapped,
+		handle:     handle,
+	}
+}
+
+type hintingFileSystem struct {
+	FileSystem
+	handle func(context.Context, *HintOp) error
+}
+
+// Parse a hint from an attribute name and value, returning ok == false if the
+// name isn't a hint's.
+func parseHint(name string, value []byte) (op *HintOp, ok bool, err error) {
+	if !strings.HasPrefix(name, HintXattrPrefix) {
+		return nil, false, nil
+	}
+
+	op = &HintOp{Kind: HintKind(strings.TrimPrefix(name, HintXattrPrefix))}
+	switch op.Kind {
+	case HintPrefetch, HintPin, HintUnpin, HintDontNeed:
+	default:
+		return nil, true, syscall.ENOTSUP
+	}
+
+	s := strings.TrimRight(string(value), "\x00\n")
+	if s == "" {
+		return op, true, nil
+	}
+
+	i := strings.IndexByte(s, ',')
+	if i < 0 {
+		return nil, true, syscall.EINVAL
+	}
+
+	if op.Offset, err = strconv.ParseUint(s[:i], 10, 64); err != nil {
+		return nil, true, syscall.EINVAL
+	}
+
+	if op.Length, err = strconv.ParseUint(s[i+1:], 10, 64); err != nil {
+		return nil, true, syscall.EINVAL
+	}
+
+	return op, true, nil
+}
+
+func (fs *hintingFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	hint, ok, err := parseHint(op.Name, op.Value)
+	if !ok {
+		return fs.FileSystem.SetXattr(ctx, op)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	hint.Inode = op.Inode
+	hint.OpContext = op.OpContext
+	return fs.handle(ctx, hint)
+}
+
+func (fs *hintingFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	hint, ok, err := parseHint(op.Name, nil)
+	if !ok {
+		return fs.FileSystem.GetXattr(ctx, op)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Tools like getfattr probe the size of the value before reading it, which
+	// may deliver the hint twice. Hints being idempotent, this is harmless.
+	hint.Inode = op.Inode
+	hint.OpContext = op.OpContext
+	op.BytesRead = 0
+	return fs.handle(ctx, hint)
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+func TestHintingFileSystem(t *testing.T) {
+	ctx := context.Background()
+
+	var hints []fuseutil.HintOp
+	fs := fuseutil.NewHintingFileSystem(
+		&fuseutil.NotImplementedFileSystem{},
+		func(ctx context.Context, op *fuseutil.HintOp) error {
+			hints = append(hints, *op)
+			return nil
+		})
+
+	set := func(name, value string) error {
+		return fs.SetXattr(ctx, &fuseops.SetXattrOp{
+			Inode: 2,
+			Name:  name,
+			Value: []byte(value),
+		})
+	}
+
+	if err := set("user.fuse.hint.prefetch", "4096,65536"); err != nil {
+		t.Errorf("prefetch: %v", err)
+	}
+
+	if err := set("user.fuse.hint.pin", ""); err != nil {
+		t.Errorf("pin: %v", err)
+	}
+
+	if err := set("user.fuse.hint.prefetch", "4096"); err != syscall.EINVAL {
+		t.Errorf("Malformed range: got %v, want EINVAL", err)
+	}
+
+	if err := set("user.fuse.hint.teleport", ""); err != syscall.ENOTSUP {
+		t.Errorf("Unknown hint: got %v, want ENOTSUP", err)
+	}
+
+	// Other attributes go to the wrapped file system.
+	if err := set("user.taco", ""); err != fuse.ENOSYS {
+		t.Errorf("Other attribute: got %v, want ENOSYS", err)
+	}
+
+	getOp := &fuseops.GetXattrOp{Inode: 3, Name: "user.fuse.hint.dontneed"}
+	if err := fs.GetXattr(ctx, getOp); err != nil || getOp.BytesRead != 0 {
+		t.Errorf("GetXattr: %v, %d bytes", err, getOp.BytesRead)
+	}
+
+	want := []fuseutil.HintOp{
+		{Inode: 2, Kind: fuseutil.HintPrefetch, Offset: 4096, Length: 65536},
+		{Inode: 2, Kind: fuseutil.HintPin},
+		{Inode: 3, Kind: fuseutil.HintDontNeed},
+	}
+
+	if len(hints) != len(want) {
+		t.Fatalf("Hints: %+v", hints)
+	}
+
+	for i := range want {
+		if hints[i] != want[i] {
+			t.Errorf("Hint %d: got %+v, want %+v", i, hints[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// Options for NewIndexingFileSystem.
+type IndexConfig struct {
+	// Called with the inodes whose contents have changed, in increasing order,
+	// e.g. to have a full-text search index reread them. Required. Calls are
+	// made from a background goroutine, one at a time.
+	Index func(inodes []fuseops.InodeID)
+
+	// How long an inode's contents must have stayed unchanged before it is
+	// passed to Index, so that a file being written is indexed once rather
+	// than after every write. Defaults to two seconds.
+	Delay time.Duration
+
+	// Defaults to timeutil.RealClock().
+	Clock timeutil.Clock
+}
+
+// Create a file system that tells an indexer about changes to file contents
+// made through it, so that search integrations can stay in sync with the
+// mount without polling. Changes are those described by
+// DescribeContentChange, and are debounced: an inode is passed to the indexer
+// between one and two delays after the last change to it. Changes still
+// pending when the file system is destroyed are passed on then.
+func NewIndexingFileSystem(
+	wrapped FileSystem,
+	cfg IndexConfig) FileSystem {
+	if cfg.Delay <= 0 {
+		cfg.Delay = 2 * time.Second
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = timeutil.RealClock()
+	}
+
+	fs := &indexingFileSystem{
+		cfg:     cfg,
+		pending: make(map[fuseops.InodeID]time.Time),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	fs.FileSystem = NewContentChangeNotifier(wrapped, fs.changed)
+	go fs.deliverPeriodically()
+
+	return fs
+}
+
+type indexingFileSystem struct {
+	FileSystem
+	cfg IndexConfig
+
+	// Closed to stop the goroutine delivering changes, which then closes
+	// stopped.
+	stop    chan struct{}
+	stopped chan struct{}
+
+	mu sync.Mutex
+
+	// The time of the last change to each inode not yet passed to the indexer.
+	//
+	// GUARDED_BY(mu)
+	pending map[fuseops.InodeID]time.Time
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *indexingFileSystem) changed(ctx context.Context, c ContentChange) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.pending[c.Inode] = fs.cfg.Clock.Now()
+}
+
+// Pass on the inodes that have been left alone for long enough, or all of
+// them if all is set.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *indexingFileSystem) deliver(all bool) {
+	now := fs.cfg.Clock.Now()
+
+	fs.mu.Lock()
+	var due []fuseops.InodeID
+	for id, t := range fs.pending {
+		if all || now.Sub(t) >= fs.cfg.Delay {
+			due = append(due, id)
+			delete(fs.pending, id)
+		}
+	}
+	fs.mu.Unlock()
+
+	if len(due) == 0 {
+		return
+	}
+
+	sort.Slice(due, func(i, j int) bool { return due[i] < due[j] })
+	fs.cfg.Index(due)
+}
+
+func (fs *indexingFileSystem) deliverPeriodically() {
+	defer close(fs.stopped)
+
+	ticker := time.NewTicker(fs.cfg.Delay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fs.deliver(false)
+
+		case <-fs.stop:
+			return
+		}
+	}
+}
+
+func (fs *indexingFileSystem) Destroy() {
+	close(fs.stop)
+	<-fs.stopped
+
+	fs.deliver(true)
+	fs.FileSystem.Destroy()
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestIndexingFileSystem(t *testing.T) {
+	ctx := context.Background()
+	clock := &timeutil.SimulatedClock{}
+	clock.SetTime(time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC))
+
+	indexed := make(chan []fuseops.InodeID, 10)
+	fs := fuseutil.NewIndexingFileSystem(&acceptingFS{}, fuseutil.IndexConfig{
+		Index: func(inodes []fuseops.InodeID) { indexed <- inodes },
+		Delay: time.Millisecond,
+		Clock: clock,
+	})
+
+	write := func(inode fuseops.InodeID) {
+		if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: inode}); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	write(3)
+	write(2)
+	write(3)
+
+	// Nothing is delivered until the inodes have been left alone for a delay.
+	select {
+	case inodes := <-indexed:
+		t.Fatalf("Indexed %v before the delay", inodes)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.AdvanceTime(time.Millisecond)
+	write(4)
+
+	select {
+	case inodes := <-indexed:
+		if want := []fuseops.InodeID{2, 3}; !reflect.DeepEqual(inodes, want) {
+			t.Errorf("Indexed %v, want %v", inodes, want)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Nothing indexed after the delay")
+	}
+
+	// Destroying the file system delivers what is pending.
+	fs.Destroy()
+	select {
+	case inodes := <-indexed:
+		if want := []fuseops.InodeID{4}; !reflect.DeepEqual(inodes, want) {
+			t.Errorf("Indexed %v on destroy, want %v", inodes, want)
+		}
+
+	default:
+		t.Errorf("Nothing indexed on destroy")
+	}
+}
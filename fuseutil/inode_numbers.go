@@ -0,0 +1,110 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Derive an inode number for fuseops.InodeAttributes.Ino from a backend's
+// native identifier for a file, such as a 128-bit object ID or a full path.
+// The same key always gives the same number, across restarts and hosts, but
+// distinct keys collide with a probability of about n²/2⁶⁵ among n files,
+// which tools detecting hard links would take for links to the same file.
+// Zero is never returned.
+func HashInodeNumber(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+
+	if n := h.Sum64(); n != 0 {
+		return n
+	}
+
+	return 1
+}
+
+// A table of inode numbers for fuseops.InodeAttributes.Ino, assigned in
+// sequence to a backend's native identifiers for files. Unlike those from
+// HashInodeNumber, the numbers never collide, but they are only stable for as
+// long as the table is kept. Safe for concurrent use.
+type InodeNumberTable struct {
+	mu sync.Mutex
+
+	// The number of each key seen so far.
+	//
+	// GUARDED_BY(mu)
+	numbers map[string]uint64
+
+	// The last number assigned.
+	//
+	// GUARDED_BY(mu)
+	last uint64
+}
+
+// Create an empty table, whose first number is one.
+func NewInodeNumberTable() *InodeNumberTable {
+	return &InodeNumberTable{
+		numbers: make(map[string]uint64),
+	}
+}
+
+// Return the number for the supplied key, assigning the next one if the key
+// hasn't been seen before.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *InodeNumberTable) Number(key string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n, ok := t.numbers[key]
+	if !ok {
+		t.last++
+		n = t.last
+		t.numbers[key] = n
+	}
+
+	return n
+}
+
+// Move the number of oldKey over to newKey, for backends whose identifiers
+// change over a file's lifetime, e.g. paths when a file is renamed. Any number
+// newKey had is dropped, as for a rename over an existing file. Does nothing if
+// oldKey hasn't been seen.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *InodeNumberTable) Rename(oldKey, newKey string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n, ok := t.numbers[oldKey]
+	if !ok {
+		return
+	}
+
+	delete(t.numbers, oldKey)
+	t.numbers[newKey] = n
+}
+
+// Drop the number of the supplied key, once the file it identifies is gone.
+// Numbers are never reused, so the key gets a new one if seen again.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *InodeNumberTable) Forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.numbers, key)
+}
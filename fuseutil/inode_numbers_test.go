@@ -0,0 +1,72 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+func TestInodeNumbers(t *testing.T) {
+	// Hashing is deterministic.
+	a := fuseutil.HashInodeNumber([]byte("bucket/object-a"))
+	if a == 0 || a != fuseutil.HashInodeNumber([]byte("bucket/object-a")) {
+		t.Errorf("HashInodeNumber: %d", a)
+	}
+
+	if a == fuseutil.HashInodeNumber([]byte("bucket/object-b")) {
+		t.Errorf("HashInodeNumber collides for distinct keys")
+	}
+
+	// Tables assign numbers in sequence, following renames.
+	table := fuseutil.NewInodeNumberTable()
+	if n := table.Number("/a"); n != 1 {
+		t.Errorf("Number(/a): %d", n)
+	}
+
+	if n := table.Number("/b"); n != 2 {
+		t.Errorf("Number(/b): %d", n)
+	}
+
+	table.Rename("/a", "/c")
+	if n := table.Number("/c"); n != 1 {
+		t.Errorf("Number(/c) after rename: %d", n)
+	}
+
+	table.Forget("/c")
+	if n := table.Number("/a"); n != 3 {
+		t.Errorf("Number(/a) after forgetting it: %d", n)
+	}
+
+	// The number is what the kernel is given as st_ino.
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	buf := make([]byte, 4096)
+	fuseutil.WriteDirentPlus(buf, fuseutil.DirentPlus{
+		Dirent: fuseutil.Dirent{Inode: fuseops.InodeID(a), Name: "object-a"},
+		Entry: fuseops.ChildInodeEntry{
+			Child:      17,
+			Attributes: fuseops.InodeAttributes{Ino: a},
+		},
+	})
+
+	e := (*fusekernel.EntryOut)(unsafe.Pointer(&buf[0]))
+	if e.Nodeid != 17 || e.Attr.Ino != a {
+		t.Errorf("Entry: %+v", e)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// The caching rights a client holds on an inode.
+type LeaseType int
+
+const (
+	LeaseNone LeaseType = iota
+
+	// The client may cache the inode's contents. Other clients may hold read
+	// leases too.
+	LeaseRead
+
+	// The client may also cache changes to the contents, i.e. dirty pages. No
+	// other client holds a lease.
+	LeaseWrite
+)
+
+// A LeaseTable arbitrates caching leases on the inodes of a backend shared by
+// several clients, in the manner of NFSv4 delegations, so that each client's
+// kernel may keep caching contents across opens until another client actually
+// needs them. The clients are file systems created by NewLeasingFileSystem
+// with the same table, e.g. one per mount of the backend served by the
+// process, and inode IDs must refer to the same files in all of them. Changes
+// made to the backend other than through them aren't noticed.
+//
+// Any number of clients may hold read leases on an inode, or a single client a
+// write lease. A client acquires a lease when it opens a file, reading or
+// writing, or truncates it, and keeps it once the file is closed; a
+// conflicting request by another client recalls it, and the client's kernel
+// forgetting the inode ends it. The zero value is an empty table.
+type LeaseTable struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	leases map[fuseops.InodeID]map[*leasingFileSystem]LeaseType
+}
+
+// Grant the client a lease of the supplied type on the inode, first recalling
+// those of other clients that conflict with it.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *LeaseTable) acquire(
+	ctx context.Context,
+	c *leasingFileSystem,
+	id fuseops.InodeID,
+	want LeaseType) error {
+	type conflict struct {
+		holder *leasingFileSystem
+		held   LeaseType
+	}
+
+	for {
+		t.mu.Lock()
+		var conflicts []conflict
+		for other, held := range t.leases[id] {
+			if other != c && (want == LeaseWrite || held == LeaseWrite) {
+				conflicts = append(conflicts, conflict{other, held})
+			}
+		}
+
+		if len(conflicts) == 0 {
+			if t.leases == nil {
+				t.leases = make(map[fuseops.InodeID]map[*leasingFileSystem]LeaseType)
+			}
+
+			holders := t.leases[id]
+			if holders == nil {
+				holders = make(map[*leasingFileSystem]LeaseType)
+				t.leases[id] = holders
+			}
+
+			if holders[c] < want {
+				holders[c] = want
+			}
+
+			t.mu.Unlock()
+			return nil
+		}
+
+		t.mu.Unlock()
+
+		// Recall without holding the lock, since the holders' kernels may need
+		// to write back through their own file systems. Another client may get
+		// in first in the meantime, so check again afterwards.
+		for _, cf := range conflicts {
+			if err := cf.holder.recall(ctx, id, cf.held); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Drop the client's lease on the inode, if any.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *LeaseTable) release(c *leasingFileSystem, id fuseops.InodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	holders := t.leases[id]
+	delete(holders, c)
+	if len(holders) == 0 {
+		delete(t.leases, id)
+	}
+}
+
+// Drop all of the client's leases.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *LeaseTable) releaseAll(c *leasingFileSystem) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, holders := range t.leases {
+		delete(holders, c)
+		if len(holders) == 0 {
+			delete(t.leases, id)
+		}
+	}
+}
+
+// Configuration for NewLeasingFileSystem.
+type LeaseConfig struct {
+	// The table shared with the other clients of the backend. Required.
+	Table *LeaseTable
+
+	// Called when another client needs the lease this client holds on an
+	// inode, before that client's request proceeds. It must make the state
+	// this client's kernel caches for the inode safe to lose, typically by
+	// calling MountedFileSystem.InvalidateInode, which with writeback caching
+	// also writes back dirty pages through this file system. It must not wait
+	// on ops of this file system other than those.
+	//
+	// If it returns an error the lease is kept, and the other client's request
+	// fails with that error. It may be called concurrently, and more than once
+	// for the same lease.
+	Recall func(ctx context.Context, inode fuseops.InodeID, held LeaseType) error
+}
+
+// Create a file system that takes part in lease arbitration with the other
+// clients of a shared backend through the table in the supplied config. Files
+// are opened with fuseops.OpenFileOp.KeepPageCache set, since the lease
+// acquired first guarantees that no other client has changed them since this
+// client's kernel last cached them.
+func NewLeasingFileSystem(
+	wrapped FileSystem,
+	cfg LeaseConfig) FileSystem {
+	return &leasingFileSystem{
+		FileSystem: wrapped,
+		cfg:        cfg,
+	}
+}
+
+type leasingFileSystem struct {
+	FileSystem
+	cfg LeaseConfig
+}
+
+// Give up the lease on the inode at another client's request.
+func (fs *leasingFileSystem) recall(
+	ctx context.Context,
+	id fuseops.InodeID,
+	held LeaseType) error {
+	if fs.cfg.Recall != nil {
+		if err := fs.cfg.Recall(ctx, id, held); err != nil {
+			return err
+		}
+	}
+
+	fs.cfg.Table.release(fs, id)
+	return nil
+}
+
+func (fs *leasingFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	want := LeaseWrite
+	if op.OpenFlags.IsReadOnly() {
+		want = LeaseRead
+	}
+
+	if err := fs.cfg.Table.acquire(ctx, fs, op.Inode, want); err != nil {
+		return err
+	}
+
+	if err := fs.FileSystem.OpenFile(ctx, op); err != nil {
+		return err
+	}
+
+	op.KeepPageCache = true
+	return nil
+}
+
+func (fs *leasingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if op.Size != nil {
+		if err := fs.cfg.Table.acquire(ctx, fs, op.Inode, LeaseWrite); err != nil {
+			return err
+		}
+	}
+
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+func (fs *leasingFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.cfg.Table.release(fs, op.Inode)
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+func (fs *leasingFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	// On ENOSYS the entries come back to ForgetInode one by one.
+	err := fs.FileSystem.BatchForget(ctx, op)
+	if err == nil {
+		for _, entry := range op.Entries {
+			fs.cfg.Table.release(fs, entry.Inode)
+		}
+	}
+
+	return err
+}
+
+func (fs *leasingFileSystem) Destroy() {
+	fs.cfg.Table.releaseAll(fs)
+	fs.FileSystem.Destroy()
+}
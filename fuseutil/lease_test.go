@@ -0,0 +1,129 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// An openableFS that can also truncate and forget inodes.
+type leasableFS struct {
+	openableFS
+}
+
+func (fs *leasableFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return nil
+}
+
+func (fs *leasableFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func TestLeasingFileSystem(t *testing.T) {
+	ctx := context.Background()
+	table := &fuseutil.LeaseTable{}
+
+	// Two clients of the same backend, recording the leases recalled from
+	// them.
+	var recalls []string
+	var recallErr error
+	client := func(name string) fuseutil.FileSystem {
+		return fuseutil.NewLeasingFileSystem(&leasableFS{}, fuseutil.LeaseConfig{
+			Table: table,
+			Recall: func(
+				ctx context.Context,
+				inode fuseops.InodeID,
+				held fuseutil.LeaseType) error {
+				recalls = append(recalls, fmt.Sprintf("%s %d %d", name, inode, held))
+				return recallErr
+			},
+		})
+	}
+
+	a := client("a")
+	b := client("b")
+
+	open := func(fs fuseutil.FileSystem, flags fusekernel.OpenFlags) error {
+		op := &fuseops.OpenFileOp{Inode: 2, OpenFlags: flags}
+		if err := fs.OpenFile(ctx, op); err != nil {
+			return err
+		}
+
+		if !op.KeepPageCache {
+			t.Errorf("Open without KeepPageCache")
+		}
+
+		return nil
+	}
+
+	expectRecalls := func(want ...string) {
+		t.Helper()
+		if fmt.Sprint(recalls) != fmt.Sprint(want) {
+			t.Errorf("Recalls: got %q, want %q", recalls, want)
+		}
+
+		recalls = nil
+	}
+
+	// The first writer gets the file to itself.
+	if err := open(a, fusekernel.OpenReadWrite); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	expectRecalls()
+
+	// A reader elsewhere recalls the write lease, and readers share.
+	if err := open(b, fusekernel.OpenReadOnly); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	expectRecalls("a 2 2")
+
+	if err := open(a, fusekernel.OpenReadOnly); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	expectRecalls()
+
+	// Truncating recalls all other leases.
+	var size uint64
+	if err := b.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: 2, Size: &size}); err != nil {
+		t.Fatalf("SetInodeAttributes: %v", err)
+	}
+	expectRecalls("a 2 1")
+
+	// A failed recall fails the conflicting open, and the lease is kept.
+	recallErr = syscall.EAGAIN
+	if err := open(a, fusekernel.OpenReadOnly); err != syscall.EAGAIN {
+		t.Errorf("OpenFile: got %v, want EAGAIN", err)
+	}
+	expectRecalls("b 2 2")
+
+	// Once the kernel forgets the inode, the lease is gone.
+	recallErr = nil
+	b.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: 2, N: 1})
+	if err := open(a, fusekernel.OpenWriteOnly); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	expectRecalls()
+}
@@ -0,0 +1,914 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// ErrNotMirrored is reported to MirrorConfig.OnDivergence when a mutation
+// refers to an inode or handle that the secondary file system never saw, for
+// example because an earlier mirrored op failed.
+var ErrNotMirrored = errors.New("inode or handle not known to the secondary")
+
+// Options for NewMirroringFileSystem.
+type MirrorConfig struct {
+	// If set, mutations are applied to the secondary in the background, in the
+	// order in which they succeeded on the primary, and ops return as soon as
+	// the primary has responded. Otherwise each op waits for the secondary too.
+	Async bool
+
+	// The number of mutations that may be waiting for the secondary in async
+	// mode before ops start blocking. Defaults to 1024.
+	QueueLength int
+
+	// Called when a mutation that succeeded on the primary failed on the
+	// secondary, with the op that was sent to the primary and the secondary's
+	// error. The two file systems should be considered to have diverged. May be
+	// nil.
+	//
+	// In async mode this is called on a background goroutine.
+	OnDivergence func(op interface{}, err error)
+}
+
+// Create a file system that serves all ops from the primary file system, and
+// additionally applies each mutation that succeeds on the primary to the
+// secondary file system, for simple replication and migration scenarios. Only
+// the primary's results are ever returned to the kernel.
+//
+// The two file systems are free to mint different inode and handle IDs; the
+// wrapper learns the correspondence by mirroring lookups and creations, and
+// mirrors forgets so that the secondary's lookup counts stay balanced. Files
+// are opened on the secondary only when they are opened for writing.
+func NewMirroringFileSystem(
+	primary FileSystem,
+	secondary FileSystem,
+	cfg MirrorConfig) FileSystem {
+	fs := &mirroringFileSystem{
+		FileSystem: primary,
+		secondary:  secondary,
+		cfg:        cfg,
+		inodes: map[fuseops.InodeID]*mirroredInode{
+			fuseops.RootInodeID: {id: fuseops.RootInodeID},
+		},
+		handles: make(map[fuseops.HandleID]fuseops.HandleID),
+	}
+
+	if cfg.Async {
+		n := cfg.QueueLength
+		if n <= 0 {
+			n = 1024
+		}
+
+		fs.queue = make(chan func(), n)
+		fs.queueDone = make(chan struct{})
+		go fs.processQueue()
+	}
+
+	return fs
+}
+
+type mirroringFileSystem struct {
+	FileSystem
+
+	secondary FileSystem
+	cfg       MirrorConfig
+
+	// Set to also open files on the secondary when they are opened only for
+	// reading, and to compare the attributes of entries looked up on both.
+	mirrorReads  bool
+	compareAttrs func(op interface{}, p, s fuseops.InodeAttributes)
+
+	// Async mode only: pending mutations, and a channel closed when the
+	// goroutine processing them has exited.
+	queue     chan func()
+	queueDone chan struct{}
+
+	mu sync.Mutex
+
+	// Correspondence from primary IDs to secondary IDs.
+	//
+	// GUARDED_BY(mu)
+	inodes  map[fuseops.InodeID]*mirroredInode
+	handles map[fuseops.HandleID]fuseops.HandleID
+}
+
+type mirroredInode struct {
+	id fuseops.InodeID
+
+	// The lookup count we hold on the secondary's inode.
+	lookupCount uint64
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func (fs *mirroringFileSystem) processQueue() {
+	defer close(fs.queueDone)
+	for f := range fs.queue {
+		f()
+	}
+}
+
+// Arrange for f to be applied to the secondary, reporting an error returned
+// by it as a divergence for the supplied primary op.
+func (fs *mirroringFileSystem) apply(
+	ctx context.Context,
+	op interface{},
+	f func(ctx context.Context) error) {
+	run := func(ctx context.Context) {
+		if err := f(ctx); err != nil && fs.cfg.OnDivergence != nil {
+			fs.cfg.OnDivergence(op, err)
+		}
+	}
+
+	if fs.queue == nil {
+		run(ctx)
+		return
+	}
+
+	// The op's context is canceled once the kernel has been answered, which in
+	// async mode is before the mutation is applied.
+	fs.queue <- func() { run(context.Background()) }
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *mirroringFileSystem) secondaryInode(
+	id fuseops.InodeID) (fuseops.InodeID, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in, ok := fs.inodes[id]
+	if !ok {
+		return 0, ErrNotMirrored
+	}
+
+	return in.id, nil
+}
+
+// Record that the secondary returned an entry for the secondary counterpart
+// of the given primary inode, incrementing its lookup count.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *mirroringFileSystem) recordEntry(primary, secondary fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in, ok := fs.inodes[primary]
+	if !ok {
+		in = &mirroredInode{id: secondary}
+		fs.inodes[primary] = in
+	}
+
+	in.id = secondary
+	in.lookupCount++
+}
+
+// Decrement the lookup count for the counterpart of the given primary inode
+// by up to n, returning the counterpart and the amount by which the
+// secondary's count should be decremented.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *mirroringFileSystem) forget(
+	primary fuseops.InodeID,
+	n uint64) (fuseops.InodeID, uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in, ok := fs.inodes[primary]
+	if !ok {
+		return 0, 0
+	}
+
+	if n > in.lookupCount {
+		n = in.lookupCount
+	}
+
+	in.lookupCount -= n
+	if in.lookupCount == 0 && primary != fuseops.RootInodeID {
+		delete(fs.inodes, primary)
+	}
+
+	return in.id, n
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *mirroringFileSystem) secondaryHandle(
+	h fuseops.HandleID) (fuseops.HandleID, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	sh, ok := fs.handles[h]
+	return sh, ok
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *mirroringFileSystem) recordHandle(primary, secondary fuseops.HandleID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.handles[primary] = secondary
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *mirroringFileSystem) releaseHandle(
+	h fuseops.HandleID) (fuseops.HandleID, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	sh, ok := fs.handles[h]
+	delete(fs.handles, h)
+	return sh, ok
+}
+
+// Translate an inode and an open handle for it.
+func (fs *mirroringFileSystem) secondaryInodeAndHandle(
+	id fuseops.InodeID,
+	h fuseops.HandleID) (fuseops.InodeID, fuseops.HandleID, error) {
+	sid, err := fs.secondaryInode(id)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sh, ok := fs.secondaryHandle(h)
+	if !ok {
+		return 0, 0, ErrNotMirrored
+	}
+
+	return sid, sh, nil
+}
+
+func cloneBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *mirroringFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := fs.FileSystem.LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	parent, name, child, attrs, opCtx :=
+		op.Parent, op.Name, op.Entry.Child, op.Entry.Attributes, op.OpContext
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		sp, err := fs.secondaryInode(parent)
+		if err != nil {
+			return err
+		}
+
+		sop := &fuseops.LookUpInodeOp{
+			Parent:    sp,
+			Name:      name,
+			OpContext: opCtx,
+		}
+
+		if err := fs.secondary.LookUpInode(ctx, sop); err != nil {
+			return err
+		}
+
+		fs.recordEntry(child, sop.Entry.Child)
+		if fs.compareAttrs != nil {
+			fs.compareAttrs(op, attrs, sop.Entry.Attributes)
+		}
+
+		return nil
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if err := fs.FileSystem.SetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	// The pointers in the op may refer to memory that is reused once the kernel
+	// has been answered, so take copies.
+	sop := &fuseops.SetInodeAttributesOp{
+		AtimeNow:  op.AtimeNow,
+		MtimeNow:  op.MtimeNow,
+		OpContext: op.OpContext,
+	}
+	if op.Uid != nil {
+		v := *op.Uid
+		sop.Uid = &v
+	}
+
+	if op.Gid != nil {
+		v := *op.Gid
+		sop.Gid = &v
+	}
+
+	if op.Size != nil {
+		v := *op.Size
+		sop.Size = &v
+	}
+
+	if op.Mode != nil {
+		v := *op.Mode
+		sop.Mode = &v
+	}
+
+	if op.Atime != nil {
+		v := *op.Atime
+		sop.Atime = &v
+	}
+
+	if op.Mtime != nil {
+		v := *op.Mtime
+		sop.Mtime = &v
+	}
+
+	if op.Ctime != nil {
+		v := *op.Ctime
+		sop.Ctime = &v
+	}
+
+	inode, handle := op.Inode, op.Handle
+	if handle != nil {
+		v := *handle
+		handle = &v
+	}
+
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		var err error
+		if sop.Inode, err = fs.secondaryInode(inode); err != nil {
+			return err
+		}
+
+		if handle != nil {
+			if sh, ok := fs.secondaryHandle(*handle); ok {
+				sop.Handle = &sh
+			}
+		}
+
+		return fs.secondary.SetInodeAttributes(ctx, sop)
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	err := fs.FileSystem.ForgetInode(ctx, op)
+
+	inode, n, opCtx := op.Inode, op.N, op.OpContext
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		sid, sn := fs.forget(inode, n)
+		if sn == 0 {
+			return nil
+		}
+
+		return fs.secondary.ForgetInode(ctx, &fuseops.ForgetInodeOp{
+			Inode:     sid,
+			N:         sn,
+			OpContext: opCtx,
+		})
+	})
+
+	return err
+}
+
+func (fs *mirroringFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	// If the primary can't do batches, the server falls back to calling
+	// ForgetInode for each entry, which we mirror individually.
+	err := fs.FileSystem.BatchForget(ctx, op)
+	if err != nil {
+		return err
+	}
+
+	entries := append([]fuseops.BatchForgetEntry(nil), op.Entries...)
+	opCtx := op.OpContext
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		var firstErr error
+		for _, e := range entries {
+			sid, sn := fs.forget(e.Inode, e.N)
+			if sn == 0 {
+				continue
+			}
+
+			err := fs.secondary.ForgetInode(ctx, &fuseops.ForgetInodeOp{
+				Inode:     sid,
+				N:         sn,
+				OpContext: opCtx,
+			})
+
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		return firstErr
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	if err := fs.FileSystem.MkDir(ctx, op); err != nil {
+		return err
+	}
+
+	parent, name, mode, child, opCtx :=
+		op.Parent, op.Name, op.Mode, op.Entry.Child, op.OpContext
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		sp, err := fs.secondaryInode(parent)
+		if err != nil {
+			return err
+		}
+
+		sop := &fuseops.MkDirOp{
+			Parent:    sp,
+			Name:      name,
+			Mode:      mode,
+			OpContext: opCtx,
+		}
+
+		if err := fs.secondary.MkDir(ctx, sop); err != nil {
+			return err
+		}
+
+		fs.recordEntry(child, sop.Entry.Child)
+		return nil
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	if err := fs.FileSystem.MkNode(ctx, op); err != nil {
+		return err
+	}
+
+	parent, name, mode, child, opCtx :=
+		op.Parent, op.Name, op.Mode, op.Entry.Child, op.OpContext
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		sp, err := fs.secondaryInode(parent)
+		if err != nil {
+			return err
+		}
+
+		sop := &fuseops.MkNodeOp{
+			Parent:    sp,
+			Name:      name,
+			Mode:      mode,
+			OpContext: opCtx,
+		}
+
+		if err := fs.secondary.MkNode(ctx, sop); err != nil {
+			return err
+		}
+
+		fs.recordEntry(child, sop.Entry.Child)
+		return nil
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := fs.FileSystem.CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	parent, name, mode, child, handle, opCtx :=
+		op.Parent, op.Name, op.Mode, op.Entry.Child, op.Handle, op.OpContext
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		sp, err := fs.secondaryInode(parent)
+		if err != nil {
+			return err
+		}
+
+		sop := &fuseops.CreateFileOp{
+			Parent:    sp,
+			Name:      name,
+			Mode:      mode,
+			OpContext: opCtx,
+		}
+
+		if err := fs.secondary.CreateFile(ctx, sop); err != nil {
+			return err
+		}
+
+		fs.recordEntry(child, sop.Entry.Child)
+		fs.recordHandle(handle, sop.Handle)
+		return nil
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	if err := fs.FileSystem.CreateLink(ctx, op); err != nil {
+		return err
+	}
+
+	parent, name, target, child, opCtx :=
+		op.Parent, op.Name, op.Target, op.Entry.Child, op.OpContext
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		sp, err := fs.secondaryInode(parent)
+		if err != nil {
+			return err
+		}
+
+		st, err := fs.secondaryInode(target)
+		if err != nil {
+			return err
+		}
+
+		sop := &fuseops.CreateLinkOp{
+			Parent:    sp,
+			Name:      name,
+			Target:    st,
+			OpContext: opCtx,
+		}
+
+		if err := fs.secondary.CreateLink(ctx, sop); err != nil {
+			return err
+		}
+
+		fs.recordEntry(child, sop.Entry.Child)
+		return nil
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	if err := fs.FileSystem.CreateSymlink(ctx, op); err != nil {
+		return err
+	}
+
+	parent, name, target, child, opCtx :=
+		op.Parent, op.Name, op.Target, op.Entry.Child, op.OpContext
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		sp, err := fs.secondaryInode(parent)
+		if err != nil {
+			return err
+		}
+
+		sop := &fuseops.CreateSymlinkOp{
+			Parent:    sp,
+			Name:      name,
+			Target:    target,
+			OpContext: opCtx,
+		}
+
+		if err := fs.secondary.CreateSymlink(ctx, sop); err != nil {
+			return err
+		}
+
+		fs.recordEntry(child, sop.Entry.Child)
+		return nil
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	if err := fs.FileSystem.Rename(ctx, op); err != nil {
+		return err
+	}
+
+	sop := *op
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		var err error
+		if sop.OldParent, err = fs.secondaryInode(op.OldParent); err != nil {
+			return err
+		}
+
+		if sop.NewParent, err = fs.secondaryInode(op.NewParent); err != nil {
+			return err
+		}
+
+		return fs.secondary.Rename(ctx, &sop)
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	if err := fs.FileSystem.RmDir(ctx, op); err != nil {
+		return err
+	}
+
+	sop := *op
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		var err error
+		if sop.Parent, err = fs.secondaryInode(op.Parent); err != nil {
+			return err
+		}
+
+		return fs.secondary.RmDir(ctx, &sop)
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if err := fs.FileSystem.Unlink(ctx, op); err != nil {
+		return err
+	}
+
+	sop := *op
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		var err error
+		if sop.Parent, err = fs.secondaryInode(op.Parent); err != nil {
+			return err
+		}
+
+		return fs.secondary.Unlink(ctx, &sop)
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if err := fs.FileSystem.OpenFile(ctx, op); err != nil {
+		return err
+	}
+
+	// Reads are served by the primary alone.
+	if op.OpenFlags.IsReadOnly() && !fs.mirrorReads {
+		return nil
+	}
+
+	inode, handle, flags, opCtx := op.Inode, op.Handle, op.OpenFlags, op.OpContext
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		sid, err := fs.secondaryInode(inode)
+		if err != nil {
+			return err
+		}
+
+		sop := &fuseops.OpenFileOp{
+			Inode:     sid,
+			OpenFlags: flags,
+			OpContext: opCtx,
+		}
+
+		if err := fs.secondary.OpenFile(ctx, sop); err != nil {
+			return err
+		}
+
+		fs.recordHandle(handle, sop.Handle)
+		return nil
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if err := fs.FileSystem.WriteFile(ctx, op); err != nil {
+		return err
+	}
+
+	sop := *op
+	if fs.queue != nil {
+		sop.Data = cloneBytes(op.Data)
+	}
+
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		var err error
+		sop.Inode, sop.Handle, err = fs.secondaryInodeAndHandle(op.Inode, op.Handle)
+		if err != nil {
+			return err
+		}
+
+		return fs.secondary.WriteFile(ctx, &sop)
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	if err := fs.FileSystem.SyncFile(ctx, op); err != nil {
+		return err
+	}
+
+	sop := *op
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		// Nothing to do for handles that were only opened for reading.
+		if _, ok := fs.secondaryHandle(op.Handle); !ok {
+			return nil
+		}
+
+		var err error
+		sop.Inode, sop.Handle, err = fs.secondaryInodeAndHandle(op.Inode, op.Handle)
+		if err != nil {
+			return err
+		}
+
+		return fs.secondary.SyncFile(ctx, &sop)
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	if err := fs.FileSystem.FlushFile(ctx, op); err != nil {
+		return err
+	}
+
+	sop := *op
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		if _, ok := fs.secondaryHandle(op.Handle); !ok {
+			return nil
+		}
+
+		var err error
+		sop.Inode, sop.Handle, err = fs.secondaryInodeAndHandle(op.Inode, op.Handle)
+		if err != nil {
+			return err
+		}
+
+		return fs.secondary.FlushFile(ctx, &sop)
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	if err := fs.FileSystem.SyncFS(ctx, op); err != nil {
+		return err
+	}
+
+	sop := *op
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		if err := fs.secondary.SyncFS(ctx, &sop); err != fuse.ENOSYS {
+			return err
+		}
+
+		return nil
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	err := fs.FileSystem.ReleaseFileHandle(ctx, op)
+
+	sop := *op
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		sh, ok := fs.releaseHandle(op.Handle)
+		if !ok {
+			return nil
+		}
+
+		sop.Handle = sh
+		return fs.secondary.ReleaseFileHandle(ctx, &sop)
+	})
+
+	return err
+}
+
+func (fs *mirroringFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	if err := fs.FileSystem.RemoveXattr(ctx, op); err != nil {
+		return err
+	}
+
+	sop := *op
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		var err error
+		if sop.Inode, err = fs.secondaryInode(op.Inode); err != nil {
+			return err
+		}
+
+		return fs.secondary.RemoveXattr(ctx, &sop)
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	if err := fs.FileSystem.SetXattr(ctx, op); err != nil {
+		return err
+	}
+
+	sop := *op
+	sop.Value = cloneBytes(op.Value)
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		var err error
+		if sop.Inode, err = fs.secondaryInode(op.Inode); err != nil {
+			return err
+		}
+
+		return fs.secondary.SetXattr(ctx, &sop)
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	if err := fs.FileSystem.Fallocate(ctx, op); err != nil {
+		return err
+	}
+
+	sop := *op
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		var err error
+		sop.Inode, sop.Handle, err = fs.secondaryInodeAndHandle(op.Inode, op.Handle)
+		if err != nil {
+			return err
+		}
+
+		return fs.secondary.Fallocate(ctx, &sop)
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) SetInodeFlags(
+	ctx context.Context,
+	op *fuseops.SetInodeFlagsOp) error {
+	if err := fs.FileSystem.SetInodeFlags(ctx, op); err != nil {
+		return err
+	}
+
+	// The flags belong to the inode. The handle may be a directory handle,
+	// which we don't translate, so don't pass it on.
+	sop := *op
+	sop.Handle = 0
+	fs.apply(ctx, op, func(ctx context.Context) error {
+		var err error
+		if sop.Inode, err = fs.secondaryInode(op.Inode); err != nil {
+			return err
+		}
+
+		return fs.secondary.SetInodeFlags(ctx, &sop)
+	})
+
+	return nil
+}
+
+func (fs *mirroringFileSystem) Destroy() {
+	// Let queued mutations drain before tearing anything down.
+	if fs.queue != nil {
+		close(fs.queue)
+		<-fs.queueDone
+	}
+
+	fs.secondary.Destroy()
+	fs.FileSystem.Destroy()
+}
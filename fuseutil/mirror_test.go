@@ -0,0 +1,154 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A file system that creates directories with sequential IDs starting at next,
+// and records the parent of each one.
+type mkDirRecorder struct {
+	fuseutil.NotImplementedFileSystem
+	next    fuseops.InodeID
+	parents []fuseops.InodeID
+	err     error
+}
+
+func (fs *mkDirRecorder) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	if fs.err != nil {
+		return fs.err
+	}
+
+	fs.parents = append(fs.parents, op.Parent)
+	op.Entry.Child = fs.next
+	fs.next++
+	return nil
+}
+
+func TestMirroringFileSystem(t *testing.T) {
+	ctx := context.Background()
+	primary := &mkDirRecorder{next: 10}
+	secondary := &mkDirRecorder{next: 500}
+
+	var diverged []error
+	fs := fuseutil.NewMirroringFileSystem(
+		primary,
+		secondary,
+		fuseutil.MirrorConfig{
+			OnDivergence: func(op interface{}, err error) {
+				diverged = append(diverged, err)
+			},
+		})
+
+	// Create a/b. The secondary must see its own ID for a.
+	for _, parent := range []fuseops.InodeID{fuseops.RootInodeID, 10} {
+		op := &fuseops.MkDirOp{Parent: parent, Name: "x"}
+		if err := fs.MkDir(ctx, op); err != nil {
+			t.Fatalf("MkDir: %v", err)
+		}
+	}
+
+	if got := secondary.parents; len(got) != 2 || got[0] != fuseops.RootInodeID || got[1] != 500 {
+		t.Errorf("Secondary parents: %v", got)
+	}
+
+	if len(diverged) != 0 {
+		t.Fatalf("Unexpected divergence: %v", diverged)
+	}
+
+	// A failure on the secondary is reported but not returned.
+	secondary.err = syscall.EIO
+	if err := fs.MkDir(ctx, &fuseops.MkDirOp{Parent: 11, Name: "y"}); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	// So is an op referring to an inode the secondary never saw.
+	secondary.err = nil
+	if err := fs.MkDir(ctx, &fuseops.MkDirOp{Parent: 12, Name: "z"}); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	if len(diverged) != 2 || diverged[0] != syscall.EIO || diverged[1] != fuseutil.ErrNotMirrored {
+		t.Errorf("Divergence: %v", diverged)
+	}
+}
+
+// A mkDirRecorder whose MkDir waits for gate to be closed, and which records
+// how many directories it had created when destroyed.
+type gatedRecorder struct {
+	mkDirRecorder
+	gate             chan struct{}
+	createdAtDestroy int
+}
+
+func (fs *gatedRecorder) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	<-fs.gate
+	return fs.mkDirRecorder.MkDir(ctx, op)
+}
+
+func (fs *gatedRecorder) Destroy() {
+	fs.createdAtDestroy = len(fs.parents)
+}
+
+func TestMirroringFileSystemAsync(t *testing.T) {
+	ctx := context.Background()
+	primary := &mkDirRecorder{next: 10}
+	secondary := &gatedRecorder{
+		mkDirRecorder: mkDirRecorder{next: 500},
+		gate:          make(chan struct{}),
+	}
+
+	fs := fuseutil.NewMirroringFileSystem(
+		primary,
+		secondary,
+		fuseutil.MirrorConfig{Async: true, QueueLength: 4})
+
+	// Ops return without waiting for the secondary, which is blocked.
+	for _, parent := range []fuseops.InodeID{fuseops.RootInodeID, 10, 11} {
+		op := &fuseops.MkDirOp{Parent: parent, Name: "x"}
+		if err := fs.MkDir(ctx, op); err != nil {
+			t.Fatalf("MkDir: %v", err)
+		}
+	}
+
+	// Destroy applies the queued mutations, in order, before destroying the
+	// secondary.
+	destroyed := make(chan struct{})
+	go func() {
+		fs.Destroy()
+		close(destroyed)
+	}()
+
+	close(secondary.gate)
+	<-destroyed
+
+	if got := secondary.parents; len(got) != 3 || got[0] != fuseops.RootInodeID || got[1] != 500 || got[2] != 501 {
+		t.Errorf("Secondary parents: %v", got)
+	}
+
+	if secondary.createdAtDestroy != 3 {
+		t.Errorf("Secondary destroyed after %d of 3 mutations", secondary.createdAtDestroy)
+	}
+}
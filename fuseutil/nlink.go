@@ -0,0 +1,436 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// How a LinkCounter reports the link counts of directories.
+type DirLinkConvention int
+
+const (
+	// Count the entry naming the directory in its parent, its own "." entry,
+	// and the ".." entry of each of its subdirectories, as traditional Unix file
+	// systems do. find(1) relies on this to stop looking for subdirectories
+	// once it has seen as many as the link count implies, unless run with
+	// -noleaf.
+	DirLinksUnix DirLinkConvention = iota
+
+	// Report a link count of one for every directory, which find(1) and fts(3)
+	// take to mean that the number of subdirectories is unknown. Suits file
+	// systems whose directories may contain subdirectories not made through
+	// the mount.
+	DirLinksOne
+)
+
+// A LinkCounter maintains the link counts of the inodes of a file system, so
+// that the Nlink attributes it reports stay accurate across links, unlinks
+// and renames. Tools such as find(1) and backup programs rely on these counts
+// to skip work and to detect hard links; an inaccurate count leads them to
+// miss files or copy them twice.
+//
+// The counter starts out knowing only the root directory. The file system
+// should populate it with Add from its own store when starting, and
+// NewLinkCountingFileSystem keeps it up to date as changes are made through
+// the mount.
+type LinkCounter struct {
+	dirs DirLinkConvention
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*linkInode
+}
+
+type linkInode struct {
+	// The number of directory entries naming the inode.
+	links uint32
+
+	// For directories, the entries within and how many of them are
+	// directories.
+	children map[string]fuseops.InodeID
+	subdirs  uint32
+}
+
+func (in *linkInode) isDir() bool {
+	return in.children != nil
+}
+
+// Create a counter for a file system with an empty root directory, counting
+// directory links according to the supplied convention.
+func NewLinkCounter(dirs DirLinkConvention) *LinkCounter {
+	return &LinkCounter{
+		dirs: dirs,
+		inodes: map[fuseops.InodeID]*linkInode{
+			fuseops.RootInodeID: {children: make(map[string]fuseops.InodeID)},
+		},
+	}
+}
+
+// Add records that the directory has an entry with the supplied name for the
+// child, whose attributes are given, replacing any existing entry with that
+// name. The directory must already be known to the counter.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *LinkCounter) Add(
+	dir fuseops.InodeID,
+	name string,
+	child fuseops.InodeID,
+	attrs fuseops.InodeAttributes) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.add(dir, name, child, attrs)
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *LinkCounter) add(
+	dir fuseops.InodeID,
+	name string,
+	child fuseops.InodeID,
+	attrs fuseops.InodeAttributes) {
+	d := c.inodes[dir]
+	if d == nil || !d.isDir() {
+		return
+	}
+
+	c.remove(dir, name)
+
+	in := c.inodes[child]
+	if in == nil {
+		in = &linkInode{}
+		if attrs.Mode.IsDir() {
+			in.children = make(map[string]fuseops.InodeID)
+		}
+
+		c.inodes[child] = in
+	}
+
+	in.links++
+	d.children[name] = child
+	if in.isDir() {
+		d.subdirs++
+	}
+}
+
+// Remove records that the directory's entry with the supplied name, if any,
+// has been removed. Inodes left without links are forgotten.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *LinkCounter) Remove(dir fuseops.InodeID, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(dir, name)
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *LinkCounter) remove(dir fuseops.InodeID, name string) {
+	d := c.inodes[dir]
+	if d == nil {
+		return
+	}
+
+	id, ok := d.children[name]
+	if !ok {
+		return
+	}
+
+	delete(d.children, name)
+	in := c.inodes[id]
+	if in.isDir() {
+		d.subdirs--
+	}
+
+	in.links--
+	if in.links == 0 {
+		c.forget(id)
+	}
+}
+
+// Forget the inode and, for a directory, everything only reachable through
+// it.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *LinkCounter) forget(id fuseops.InodeID) {
+	in := c.inodes[id]
+	delete(c.inodes, id)
+
+	for _, child := range in.children {
+		if cin := c.inodes[child]; cin != nil {
+			cin.links--
+			if cin.links == 0 {
+				c.forget(child)
+			}
+		}
+	}
+}
+
+// Move records a rename, replacing any existing entry with the new name.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *LinkCounter) Move(
+	oldDir fuseops.InodeID,
+	oldName string,
+	newDir fuseops.InodeID,
+	newName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if oldDir == newDir && oldName == newName {
+		return
+	}
+
+	od := c.inodes[oldDir]
+	if od == nil {
+		c.remove(newDir, newName)
+		return
+	}
+
+	id, ok := od.children[oldName]
+	if !ok {
+		c.remove(newDir, newName)
+		return
+	}
+
+	// The inode's own count is unchanged, unless the new directory is unknown.
+	in := c.inodes[id]
+	delete(od.children, oldName)
+	if in.isDir() {
+		od.subdirs--
+	}
+
+	c.remove(newDir, newName)
+
+	nd := c.inodes[newDir]
+	if nd == nil || !nd.isDir() {
+		in.links--
+		if in.links == 0 {
+			c.forget(id)
+		}
+
+		return
+	}
+
+	nd.children[newName] = id
+	if in.isDir() {
+		nd.subdirs++
+	}
+}
+
+// Nlink returns the link count of the inode, or false if it is unknown to the
+// counter.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *LinkCounter) Nlink(inode fuseops.InodeID) (uint32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	in := c.inodes[inode]
+	if in == nil {
+		return 0, false
+	}
+
+	if !in.isDir() {
+		return in.links, true
+	}
+
+	if c.dirs == DirLinksOne {
+		return 1, true
+	}
+
+	// The root directory's ".." names itself in place of an entry in a parent.
+	return 2 + in.subdirs, true
+}
+
+// Set the attributes' link count, if known to the counter.
+func (c *LinkCounter) fill(inode fuseops.InodeID, attrs *fuseops.InodeAttributes) {
+	if n, ok := c.Nlink(inode); ok {
+		attrs.Nlink = n
+	}
+}
+
+// Create a file system that keeps the supplied counter up to date as entries
+// are created, linked, renamed and removed, and reports the link counts it
+// knows of in place of those of the wrapped file system, in entries as in
+// attributes.
+func NewLinkCountingFileSystem(
+	wrapped FileSystem,
+	counter *LinkCounter) FileSystem {
+	return &linkCountingFileSystem{
+		FileSystem: wrapped,
+		counter:    counter,
+	}
+}
+
+type linkCountingFileSystem struct {
+	FileSystem
+	counter *LinkCounter
+}
+
+func (fs *linkCountingFileSystem) created(
+	parent fuseops.InodeID,
+	name string,
+	entry *fuseops.ChildInodeEntry,
+	err error) error {
+	if err != nil {
+		return err
+	}
+
+	fs.counter.Add(parent, name, entry.Child, entry.Attributes)
+	fs.counter.fill(entry.Child, &entry.Attributes)
+	return nil
+}
+
+func (fs *linkCountingFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := fs.FileSystem.LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.counter.fill(op.Entry.Child, &op.Entry.Attributes)
+	return nil
+}
+
+func (fs *linkCountingFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if err := fs.FileSystem.GetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	fs.counter.fill(op.Inode, &op.Attributes)
+	return nil
+}
+
+func (fs *linkCountingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if err := fs.FileSystem.SetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	fs.counter.fill(op.Inode, &op.Attributes)
+	return nil
+}
+
+func (fs *linkCountingFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	err := fs.FileSystem.MkDir(ctx, op)
+	return fs.created(op.Parent, op.Name, &op.Entry, err)
+}
+
+func (fs *linkCountingFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	err := fs.FileSystem.MkNode(ctx, op)
+	return fs.created(op.Parent, op.Name, &op.Entry, err)
+}
+
+func (fs *linkCountingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	err := fs.FileSystem.CreateFile(ctx, op)
+	return fs.created(op.Parent, op.Name, &op.Entry, err)
+}
+
+func (fs *linkCountingFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	err := fs.FileSystem.CreateSymlink(ctx, op)
+	return fs.created(op.Parent, op.Name, &op.Entry, err)
+}
+
+func (fs *linkCountingFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	err := fs.FileSystem.CreateLink(ctx, op)
+	return fs.created(op.Parent, op.Name, &op.Entry, err)
+}
+
+func (fs *linkCountingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	// Exchanges and whiteouts would throw the link counts off.
+	if op.Flags&^fuseops.RenameNoReplace != 0 {
+		return syscall.EINVAL
+	}
+
+	if err := fs.FileSystem.Rename(ctx, op); err != nil {
+		return err
+	}
+
+	fs.counter.Move(op.OldParent, op.OldName, op.NewParent, op.NewName)
+	return nil
+}
+
+func (fs *linkCountingFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	if err := fs.FileSystem.RmDir(ctx, op); err != nil {
+		return err
+	}
+
+	fs.counter.Remove(op.Parent, op.Name)
+	return nil
+}
+
+func (fs *linkCountingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if err := fs.FileSystem.Unlink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.counter.Remove(op.Parent, op.Name)
+	return nil
+}
+
+func (fs *linkCountingFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	if err := fs.FileSystem.ReadDirPlus(ctx, op); err != nil {
+		return err
+	}
+
+	// Fix up the attributes of each entry in place.
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	for b := op.Dst[:op.BytesRead]; len(b) > entrySize; {
+		_, n := ReadDirent(b[entrySize:])
+		if n == 0 {
+			break
+		}
+
+		e := (*fusekernel.EntryOut)(unsafe.Pointer(&b[0]))
+		if e.Nodeid != 0 {
+			if nlink, ok := fs.counter.Nlink(fuseops.InodeID(e.Nodeid)); ok {
+				e.Attr.Nlink = nlink
+			}
+		}
+
+		b = b[entrySize+n:]
+	}
+
+	return nil
+}
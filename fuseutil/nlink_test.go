@@ -0,0 +1,161 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// An acceptingFS whose new directories say they are, and which gets link
+// counts wrong.
+type nlinkFS struct {
+	acceptingFS
+}
+
+func (fs *nlinkFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes.Nlink = 7
+	return nil
+}
+
+func (fs *nlinkFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	op.Entry.Attributes.Mode = os.ModeDir | op.Mode
+	return fs.acceptingFS.MkDir(ctx, op)
+}
+
+func TestLinkCounter(t *testing.T) {
+	ctx := context.Background()
+	counter := fuseutil.NewLinkCounter(fuseutil.DirLinksUnix)
+
+	// Populate the counter as a file system would when starting: /a holds f.
+	counter.Add(fuseops.RootInodeID, "a", 10, fuseops.InodeAttributes{Mode: os.ModeDir | 0755})
+	counter.Add(10, "f", 11, fuseops.InodeAttributes{Mode: 0644})
+
+	fs := fuseutil.NewLinkCountingFileSystem(&nlinkFS{acceptingFS{next: 100}}, counter)
+
+	check := func(inode fuseops.InodeID, want uint32) {
+		t.Helper()
+		if n, ok := counter.Nlink(inode); !ok || n != want {
+			t.Errorf("Nlink(%d): %d, %v; want %d", inode, n, ok, want)
+		}
+	}
+
+	check(fuseops.RootInodeID, 3)
+	check(10, 2)
+	check(11, 1)
+
+	// Subdirectories count towards their parent.
+	mkdir := &fuseops.MkDirOp{Parent: 10, Name: "b", Mode: 0755}
+	if err := fs.MkDir(ctx, mkdir); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	b := mkdir.Entry.Child
+	check(10, 3)
+	if got := mkdir.Entry.Attributes.Nlink; got != 2 {
+		t.Errorf("Nlink in the MkDir entry: %d", got)
+	}
+
+	// Hard links count towards the file, and are reported in the entry.
+	link := &fuseops.CreateLinkOp{Parent: b, Name: "g", Target: 11}
+	if err := fs.CreateLink(ctx, link); err != nil {
+		t.Fatalf("CreateLink: %v", err)
+	}
+
+	check(11, 2)
+	if got := link.Entry.Attributes.Nlink; got != 2 {
+		t.Errorf("Nlink in the CreateLink entry: %d", got)
+	}
+
+	// Moving a directory moves its ".." link.
+	err := fs.Rename(ctx, &fuseops.RenameOp{
+		OldParent: 10,
+		OldName:   "b",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "b",
+	})
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	check(10, 2)
+	check(fuseops.RootInodeID, 4)
+
+	// Renaming over a link drops it.
+	err = fs.Rename(ctx, &fuseops.RenameOp{
+		OldParent: 10,
+		OldName:   "f",
+		NewParent: b,
+		NewName:   "g",
+	})
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	check(11, 1)
+
+	// Attributes are reported with the counter's link count.
+	getOp := &fuseops.GetInodeAttributesOp{Inode: 11}
+	if err := fs.GetInodeAttributes(ctx, getOp); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	if getOp.Attributes.Nlink != 1 {
+		t.Errorf("Nlink in attributes: %d", getOp.Attributes.Nlink)
+	}
+
+	// Unlinking the last link forgets the file, and removing a directory
+	// drops its parent's count.
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: b, Name: "g"}); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	if _, ok := counter.Nlink(11); ok {
+		t.Errorf("Nlink of an unlinked file")
+	}
+
+	if err := fs.RmDir(ctx, &fuseops.RmDirOp{Parent: fuseops.RootInodeID, Name: "b"}); err != nil {
+		t.Fatalf("RmDir: %v", err)
+	}
+
+	check(fuseops.RootInodeID, 3)
+}
+
+func TestLinkCounterDirLinksOne(t *testing.T) {
+	counter := fuseutil.NewLinkCounter(fuseutil.DirLinksOne)
+	counter.Add(fuseops.RootInodeID, "a", 10, fuseops.InodeAttributes{Mode: os.ModeDir | 0755})
+	counter.Add(10, "b", 11, fuseops.InodeAttributes{Mode: os.ModeDir | 0755})
+	counter.Add(10, "f", 12, fuseops.InodeAttributes{Mode: 0644})
+	counter.Add(11, "f", 12, fuseops.InodeAttributes{Mode: 0644})
+
+	for inode, want := range map[fuseops.InodeID]uint32{
+		fuseops.RootInodeID: 1,
+		10:                  1,
+		11:                  1,
+		12:                  2,
+	} {
+		if n, ok := counter.Nlink(inode); !ok || n != want {
+			t.Errorf("Nlink(%d): %d, %v; want %d", inode, n, ok, want)
+		}
+	}
+}
@@ -54,6 +54,12 @@ func (fs *NotImplementedFileSystem) SetInodeAttributes(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) ForgetInode(
 	ctx context.Context,
 	op *fuseops.ForgetInodeOp) error {
@@ -126,6 +132,12 @@ func (fs *NotImplementedFileSystem) ReadDir(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) ReleaseDirHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseDirHandleOp) error {
@@ -162,6 +174,12 @@ func (fs *NotImplementedFileSystem) FlushFile(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) ReleaseFileHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseFileHandleOp) error {
@@ -204,5 +222,47 @@ func (fs *NotImplementedFileSystem) Fallocate(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) GetInodeFlags(
+	ctx context.Context,
+	op *fuseops.GetInodeFlagsOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) SetInodeFlags(
+	ctx context.Context,
+	op *fuseops.SetInodeFlagsOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) GetLk(
+	ctx context.Context,
+	op *fuseops.GetLkOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) SetLk(
+	ctx context.Context,
+	op *fuseops.SetLkOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) Destroy() {
 }
@@ -0,0 +1,451 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// The state of the backend behind a file system created by
+// NewOfflineAwareFileSystem.
+type BackendState int
+
+const (
+	BackendOnline BackendState = iota
+	BackendOffline
+)
+
+func (s BackendState) String() string {
+	switch s {
+	case BackendOnline:
+		return "online"
+	case BackendOffline:
+		return "offline"
+	}
+
+	return fmt.Sprintf("BackendState(%d)", int(s))
+}
+
+// Options for NewOfflineAwareFileSystem.
+type OfflineConfig struct {
+	// Report whether an error returned by the wrapped file system means that
+	// its backend can't be reached. Defaults to matching the errnos for
+	// timeouts, refused connections and unreachable or down networks and hosts.
+	IsOffline func(err error) bool
+
+	// Check whether the backend can be reached again, returning nil if so.
+	// Required. Called every ProbeInterval while offline, from a background
+	// goroutine; it should give up well within the interval.
+	Probe func(ctx context.Context) error
+
+	// Defaults to five seconds.
+	ProbeInterval time.Duration
+
+	// The error with which ops that would modify the file system fail while
+	// offline. Defaults to EROFS.
+	WriteErrno syscall.Errno
+
+	// Called with the new state each time the backend goes offline or comes
+	// back, if non-nil. Calls are made in order, while ops that modify the file
+	// system wait, so the wrapped file system may use this to switch to and
+	// from serving what it has cached.
+	OnStateChange func(BackendState)
+}
+
+// The errnos taken by default to mean the backend can't be reached.
+var offlineErrnos = []syscall.Errno{
+	syscall.ETIMEDOUT,
+	syscall.ECONNREFUSED,
+	syscall.ECONNRESET,
+	syscall.ENETDOWN,
+	syscall.ENETUNREACH,
+	syscall.EHOSTDOWN,
+	syscall.EHOSTUNREACH,
+}
+
+func isOfflineErrno(err error) bool {
+	for _, errno := range offlineErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Create a file system that degrades gracefully while the backend of the
+// wrapped file system is unreachable, as sync clients must. The backend is
+// taken to be offline as soon as an op fails with an error matched by
+// cfg.IsOffline; that op's error is returned as is. From then on, ops that
+// would modify the file system, including opening files for writing, fail
+// with cfg.WriteErrno without reaching the wrapped file system, while other
+// ops are still passed on for it to answer from whatever it has cached. The
+// backend is taken to be back once cfg.Probe succeeds.
+func NewOfflineAwareFileSystem(
+	wrapped FileSystem,
+	cfg OfflineConfig) FileSystem {
+	if cfg.IsOffline == nil {
+		cfg.IsOffline = isOfflineErrno
+	}
+
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = 5 * time.Second
+	}
+
+	fs := &offlineAwareFileSystem{
+		FileSystem: wrapped,
+		readOnly: readOnlyFileSystem{
+			FileSystem: wrapped,
+			errno:      cfg.WriteErrno,
+		},
+		cfg:     cfg,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go fs.probePeriodically()
+
+	return fs
+}
+
+type offlineAwareFileSystem struct {
+	FileSystem
+
+	// Answers ops that would modify the file system while offline.
+	readOnly readOnlyFileSystem
+
+	cfg OfflineConfig
+
+	// Closed to stop the goroutine probing the backend, which then closes
+	// stopped.
+	stop    chan struct{}
+	stopped chan struct{}
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	state BackendState
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *offlineAwareFileSystem) offline() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.state == BackendOffline
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *offlineAwareFileSystem) setState(state BackendState) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.state == state {
+		return
+	}
+
+	fs.state = state
+	if fs.cfg.OnStateChange != nil {
+		fs.cfg.OnStateChange(state)
+	}
+}
+
+// Note the error returned by the wrapped file system for an op, returning it.
+func (fs *offlineAwareFileSystem) observe(err error) error {
+	if err != nil && fs.cfg.IsOffline(err) {
+		fs.setState(BackendOffline)
+	}
+
+	return err
+}
+
+func (fs *offlineAwareFileSystem) probePeriodically() {
+	defer close(fs.stopped)
+
+	ticker := time.NewTicker(fs.cfg.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if fs.offline() && fs.cfg.Probe(context.Background()) == nil {
+				fs.setState(BackendOnline)
+			}
+
+		case <-fs.stop:
+			return
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *offlineAwareFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return fs.observe(fs.FileSystem.StatFS(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.observe(fs.FileSystem.LookUpInode(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return fs.observe(fs.FileSystem.GetInodeAttributes(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if fs.offline() {
+		return fs.readOnly.SetInodeAttributes(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.SetInodeAttributes(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	if fs.offline() {
+		return fs.readOnly.Access(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.Access(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	if fs.offline() {
+		return fs.readOnly.MkDir(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.MkDir(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	if fs.offline() {
+		return fs.readOnly.MkNode(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.MkNode(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if fs.offline() {
+		return fs.readOnly.CreateFile(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.CreateFile(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	if fs.offline() {
+		return fs.readOnly.CreateLink(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.CreateLink(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	if fs.offline() {
+		return fs.readOnly.CreateSymlink(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.CreateSymlink(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	if fs.offline() {
+		return fs.readOnly.Rename(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.Rename(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	if fs.offline() {
+		return fs.readOnly.RmDir(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.RmDir(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if fs.offline() {
+		return fs.readOnly.Unlink(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.Unlink(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return fs.observe(fs.FileSystem.OpenDir(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	return fs.observe(fs.FileSystem.ReadDir(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	return fs.observe(fs.FileSystem.ReadDirPlus(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if fs.offline() {
+		return fs.observe(fs.readOnly.OpenFile(ctx, op))
+	}
+
+	return fs.observe(fs.FileSystem.OpenFile(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	return fs.observe(fs.FileSystem.ReadFile(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if fs.offline() {
+		return fs.readOnly.WriteFile(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.WriteFile(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	return fs.observe(fs.FileSystem.SyncFile(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return fs.observe(fs.FileSystem.FlushFile(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	return fs.observe(fs.FileSystem.SyncFS(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	return fs.observe(fs.FileSystem.ReadSymlink(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	if fs.offline() {
+		return fs.readOnly.RemoveXattr(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.RemoveXattr(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	return fs.observe(fs.FileSystem.GetXattr(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	return fs.observe(fs.FileSystem.ListXattr(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	if fs.offline() {
+		return fs.readOnly.SetXattr(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.SetXattr(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	if fs.offline() {
+		return fs.readOnly.Fallocate(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.Fallocate(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) SetInodeFlags(
+	ctx context.Context,
+	op *fuseops.SetInodeFlagsOp) error {
+	if fs.offline() {
+		return fs.readOnly.SetInodeFlags(ctx, op)
+	}
+
+	return fs.observe(fs.FileSystem.SetInodeFlags(ctx, op))
+}
+
+func (fs *offlineAwareFileSystem) Destroy() {
+	close(fs.stop)
+	<-fs.stopped
+
+	fs.FileSystem.Destroy()
+}
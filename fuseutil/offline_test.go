@@ -0,0 +1,123 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system whose backend can be unplugged. Attributes are always served,
+// as if from a cache.
+type unpluggableFS struct {
+	acceptingFS
+	down   int32
+	mkdirs int32
+}
+
+func (fs *unpluggableFS) probe(ctx context.Context) error {
+	if atomic.LoadInt32(&fs.down) != 0 {
+		return syscall.EHOSTUNREACH
+	}
+
+	return nil
+}
+
+func (fs *unpluggableFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	atomic.AddInt32(&fs.mkdirs, 1)
+	if err := fs.probe(ctx); err != nil {
+		return err
+	}
+
+	return fs.acceptingFS.MkDir(ctx, op)
+}
+
+func (fs *unpluggableFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return nil
+}
+
+func TestOfflineAwareFileSystem(t *testing.T) {
+	ctx := context.Background()
+	wrapped := &unpluggableFS{}
+	states := make(chan fuseutil.BackendState, 10)
+
+	fs := fuseutil.NewOfflineAwareFileSystem(wrapped, fuseutil.OfflineConfig{
+		Probe:         wrapped.probe,
+		ProbeInterval: time.Millisecond,
+		WriteErrno:    syscall.EAGAIN,
+		OnStateChange: func(s fuseutil.BackendState) { states <- s },
+	})
+	defer fs.Destroy()
+
+	mkdir := func() error {
+		return fs.MkDir(ctx, &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "d"})
+	}
+
+	// The backend going away is noticed from the error it causes.
+	atomic.StoreInt32(&wrapped.down, 1)
+	if err := mkdir(); err != syscall.EHOSTUNREACH {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	if s := <-states; s != fuseutil.BackendOffline {
+		t.Fatalf("State: %v", s)
+	}
+
+	// Modifications then fail without reaching the wrapped file system, while
+	// reads are still passed on.
+	if err := mkdir(); err != syscall.EAGAIN {
+		t.Errorf("MkDir while offline: %v", err)
+	}
+
+	open := &fuseops.OpenFileOp{Inode: 2, OpenFlags: fusekernel.OpenReadWrite}
+	if err := fs.OpenFile(ctx, open); err != syscall.EAGAIN {
+		t.Errorf("OpenFile for writing while offline: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&wrapped.mkdirs); n != 1 {
+		t.Errorf("%d MkDir calls reached the wrapped file system", n)
+	}
+
+	if err := fs.GetInodeAttributes(ctx, &fuseops.GetInodeAttributesOp{Inode: 2}); err != nil {
+		t.Errorf("GetInodeAttributes while offline: %v", err)
+	}
+
+	// Modifications are allowed again once the backend is back.
+	atomic.StoreInt32(&wrapped.down, 0)
+	select {
+	case s := <-states:
+		if s != fuseutil.BackendOnline {
+			t.Fatalf("State: %v", s)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Still offline")
+	}
+
+	if err := mkdir(); err != nil {
+		t.Errorf("MkDir after recovery: %v", err)
+	}
+}
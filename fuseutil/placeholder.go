@@ -0,0 +1,377 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// ErrPinned is returned by Placeholders.Evict for pinned inodes.
+var ErrPinned = errors.New("inode is pinned")
+
+// Whether the contents of a placeholder are available locally.
+type HydrationState int
+
+const (
+	// Only the placeholder's attributes are available.
+	Dehydrated HydrationState = iota
+
+	// The contents are being fetched.
+	Hydrating
+
+	// The contents have been fetched, and reads are served from them.
+	Hydrated
+)
+
+func (s HydrationState) String() string {
+	switch s {
+	case Dehydrated:
+		return "dehydrated"
+	case Hydrating:
+		return "hydrating"
+	case Hydrated:
+		return "hydrated"
+	}
+
+	return fmt.Sprintf("HydrationState(%d)", int(s))
+}
+
+// The status of a placeholder, as returned by Placeholders.Status.
+type HydrationStatus struct {
+	State  HydrationState
+	Pinned bool
+
+	// While hydrating, the number of bytes fetched so far and in total, as last
+	// reported by PlaceholderConfig.Hydrate.
+	Done  uint64
+	Total uint64
+}
+
+// Options for NewPlaceholders.
+type PlaceholderConfig struct {
+	// Fetch the contents of a placeholder from the backend and store them
+	// where the wrapped file system will serve reads from, calling progress as
+	// they arrive. Required. It is called from a background goroutine, at most
+	// once at a time for each inode, and is retried on the next read if it
+	// fails.
+	Hydrate func(
+		ctx context.Context,
+		inode fuseops.InodeID,
+		progress func(done, total uint64)) error
+
+	// Called with each progress report, if non-nil, e.g. to show downloads in
+	// a user interface.
+	OnProgress func(inode fuseops.InodeID, done, total uint64)
+}
+
+// Placeholders tracks the files whose contents are fetched on demand by file
+// systems created by NewHydratingFileSystem, in the manner of cloud storage
+// clients offering files on demand. A placeholder is listed and has its full
+// attributes, served by the wrapped file system, from the start; its contents
+// are fetched when it is first read or modified. Hydrated files may be
+// pinned, to keep them available offline, or evicted to free space.
+type Placeholders struct {
+	cfg PlaceholderConfig
+
+	// Hydrations running in the background.
+	hydrations sync.WaitGroup
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*placeholder
+}
+
+type placeholder struct {
+	status HydrationStatus
+
+	// The hydration in progress, if any.
+	attempt *hydration
+}
+
+type hydration struct {
+	// Closed once err has been set.
+	done chan struct{}
+	err  error
+}
+
+// Create an empty set of placeholders.
+func NewPlaceholders(cfg PlaceholderConfig) *Placeholders {
+	return &Placeholders{
+		cfg:    cfg,
+		inodes: make(map[fuseops.InodeID]*placeholder),
+	}
+}
+
+// Add an inode whose contents haven't been fetched yet. Adding an inode that
+// is already tracked leaves it as it is.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *Placeholders) Add(inode fuseops.InodeID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.inodes[inode] == nil {
+		p.inodes[inode] = &placeholder{}
+	}
+}
+
+// Stop tracking an inode, e.g. because it has been deleted. A hydration in
+// progress carries on, but its result is ignored.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *Placeholders) Remove(inode fuseops.InodeID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.inodes, inode)
+}
+
+// Return the status of an inode, and whether it is tracked at all.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *Placeholders) Status(inode fuseops.InodeID) (HydrationStatus, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ph := p.inodes[inode]
+	if ph == nil {
+		return HydrationStatus{}, false
+	}
+
+	return ph.status, true
+}
+
+// Fetch the contents of the inode if it is a placeholder, waiting until they
+// are available. A hydration already in progress is waited for rather than
+// started again; if ctx is cancelled, it carries on in the background and
+// EINTR is returned.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *Placeholders) Hydrate(ctx context.Context, inode fuseops.InodeID) error {
+	p.mu.Lock()
+	ph := p.inodes[inode]
+	if ph == nil || ph.status.State == Hydrated {
+		p.mu.Unlock()
+		return nil
+	}
+
+	h := ph.attempt
+	if h == nil {
+		h = &hydration{done: make(chan struct{})}
+		ph.attempt = h
+		ph.status.State = Hydrating
+		ph.status.Done, ph.status.Total = 0, 0
+
+		p.hydrations.Add(1)
+		go p.hydrate(inode, ph, h)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-h.done:
+		return h.err
+
+	case <-ctx.Done():
+		return syscall.EINTR
+	}
+}
+
+// Hydrate the inode, then pin it so that Evict refuses it. Pinning an inode
+// that isn't tracked starts tracking it as hydrated.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *Placeholders) Pin(ctx context.Context, inode fuseops.InodeID) error {
+	p.mu.Lock()
+	if p.inodes[inode] == nil {
+		p.inodes[inode] = &placeholder{status: HydrationStatus{State: Hydrated}}
+	}
+	p.mu.Unlock()
+
+	// Evict may get in between hydrating and pinning, so try again until both
+	// happen.
+	for {
+		if err := p.Hydrate(ctx, inode); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		ph := p.inodes[inode]
+		if ph == nil || ph.status.State == Hydrated {
+			if ph != nil {
+				ph.status.Pinned = true
+			}
+
+			p.mu.Unlock()
+			return nil
+		}
+		p.mu.Unlock()
+	}
+}
+
+// Undo Pin.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *Placeholders) Unpin(inode fuseops.InodeID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ph := p.inodes[inode]; ph != nil {
+		ph.status.Pinned = false
+	}
+}
+
+// Turn a hydrated inode back into a placeholder, so that its contents are
+// fetched again when next read. The caller is responsible for then dropping
+// the local copy, and the kernel's cached pages with
+// MountedFileSystem.InvalidateInode. Return ErrPinned for pinned inodes and
+// EBUSY for those being hydrated.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *Placeholders) Evict(inode fuseops.InodeID) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ph := p.inodes[inode]
+	switch {
+	case ph == nil:
+		p.inodes[inode] = &placeholder{}
+
+	case ph.status.Pinned:
+		return ErrPinned
+
+	case ph.status.State == Hydrating:
+		return syscall.EBUSY
+
+	default:
+		ph.status = HydrationStatus{}
+	}
+
+	return nil
+}
+
+func (p *Placeholders) hydrate(
+	inode fuseops.InodeID,
+	ph *placeholder,
+	h *hydration) {
+	defer p.hydrations.Done()
+
+	progress := func(done, total uint64) {
+		p.mu.Lock()
+		if ph.attempt == h {
+			ph.status.Done, ph.status.Total = done, total
+		}
+		p.mu.Unlock()
+
+		if p.cfg.OnProgress != nil {
+			p.cfg.OnProgress(inode, done, total)
+		}
+	}
+
+	err := p.cfg.Hydrate(context.Background(), inode, progress)
+
+	p.mu.Lock()
+	ph.attempt = nil
+	ph.status.State = Dehydrated
+	if err == nil {
+		ph.status.State = Hydrated
+	}
+
+	h.err = err
+	p.mu.Unlock()
+
+	close(h.done)
+}
+
+// Create a file system that hydrates the placeholders in p before reading or
+// modifying their contents through the wrapped file system. Reads fail with
+// the error returned by PlaceholderConfig.Hydrate if fetching the contents
+// does, which becomes EIO unless it is a syscall.Errno.
+func NewHydratingFileSystem(
+	wrapped FileSystem,
+	p *Placeholders) FileSystem {
+	return &hydratingFileSystem{
+		FileSystem:   wrapped,
+		placeholders: p,
+	}
+}
+
+type hydratingFileSystem struct {
+	FileSystem
+	placeholders *Placeholders
+}
+
+func (fs *hydratingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if op.Size != nil {
+		if err := fs.placeholders.Hydrate(ctx, op.Inode); err != nil {
+			return err
+		}
+	}
+
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+func (fs *hydratingFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if err := fs.placeholders.Hydrate(ctx, op.Inode); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.ReadFile(ctx, op)
+}
+
+func (fs *hydratingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if err := fs.placeholders.Hydrate(ctx, op.Inode); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+func (fs *hydratingFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	if err := fs.placeholders.Hydrate(ctx, op.Inode); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *hydratingFileSystem) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	if err := fs.placeholders.Hydrate(ctx, op.Inode); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Lseek(ctx, op)
+}
+
+func (fs *hydratingFileSystem) Destroy() {
+	fs.placeholders.hydrations.Wait()
+	fs.FileSystem.Destroy()
+}
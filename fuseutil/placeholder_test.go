@@ -0,0 +1,127 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+func TestHydratingFileSystem(t *testing.T) {
+	ctx := context.Background()
+	wrapped := &contentsFS{}
+
+	var calls int32
+	var fail error
+	release := make(chan struct{})
+	progressed := make(chan struct{}, 10)
+
+	p := fuseutil.NewPlaceholders(fuseutil.PlaceholderConfig{
+		Hydrate: func(
+			ctx context.Context,
+			inode fuseops.InodeID,
+			progress func(done, total uint64)) error {
+			atomic.AddInt32(&calls, 1)
+			if fail != nil {
+				return fail
+			}
+
+			progress(2, 4)
+			<-release
+			return wrapped.WriteFile(ctx, &fuseops.WriteFileOp{
+				Inode: inode,
+				Data:  []byte("taco"),
+			})
+		},
+		OnProgress: func(inode fuseops.InodeID, done, total uint64) {
+			progressed <- struct{}{}
+		},
+	})
+
+	fs := fuseutil.NewHydratingFileSystem(wrapped, p)
+	p.Add(2)
+
+	read := func() (string, error) {
+		op := &fuseops.ReadFileOp{Inode: 2, Dst: make([]byte, 16)}
+		err := fs.ReadFile(ctx, op)
+		return string(op.Dst[:op.BytesRead]), err
+	}
+
+	// Concurrent reads wait for a single hydration.
+	results := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			s, err := read()
+			if err != nil {
+				t.Errorf("ReadFile: %v", err)
+			}
+
+			results <- s
+		}()
+	}
+
+	<-progressed
+	want := fuseutil.HydrationStatus{State: fuseutil.Hydrating, Done: 2, Total: 4}
+	if s, _ := p.Status(2); s != want {
+		t.Errorf("Status while hydrating: %+v", s)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if s := <-results; s != "taco" {
+			t.Errorf("Read %q", s)
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Hydrated %d times", n)
+	}
+
+	// Pinned files can't be evicted.
+	if err := p.Pin(ctx, 2); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+
+	if err := p.Evict(2); err != fuseutil.ErrPinned {
+		t.Errorf("Evicting a pinned file: %v", err)
+	}
+
+	p.Unpin(2)
+	if err := p.Evict(2); err != nil {
+		t.Fatalf("Evict: %v", err)
+	}
+
+	// Failed hydrations fail the read, and are retried by the next one.
+	fail = syscall.ENETDOWN
+	if _, err := read(); err != syscall.ENETDOWN {
+		t.Errorf("ReadFile with the backend down: %v", err)
+	}
+
+	if s, _ := p.Status(2); s.State != fuseutil.Dehydrated {
+		t.Errorf("Status after a failed hydration: %+v", s)
+	}
+
+	fail = nil
+	if _, err := read(); err != nil || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("ReadFile after the backend came back: %v", err)
+	}
+
+	fs.Destroy()
+}
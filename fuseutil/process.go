@@ -0,0 +1,52 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// What LookUpProcess found out about the process making an op.
+type ProcessInfo struct {
+	Pid uint32
+
+	// The path of the process's executable, and its command name, which it may
+	// have changed, e.g. "bash".
+	Executable string
+	Name       string
+
+	// The path of the process's cgroup within the unified (v2) hierarchy, e.g.
+	// "/system.slice/backup.service", or empty if it isn't in one.
+	Cgroup string
+}
+
+// Look up the process making an op, from the PID in the op's context, so that
+// file systems can apply per-process policies, e.g. refusing writes from
+// some executables. Only supported on Linux, where it reads /proc.
+//
+// The answer is only as good as the PID: it is zero for writes back from the
+// page cache and for processes outside the file system's PID namespace, and
+// the process may have exited, and its PID been reused, by the time it is
+// looked up, so don't rely on it to keep out an adversary. Fails with ESRCH
+// if there is no process to look up.
+func LookUpProcess(ctx fuseops.OpContext) (ProcessInfo, error) {
+	if ctx.Pid == 0 {
+		return ProcessInfo{}, syscall.ESRCH
+	}
+
+	return lookUpProcess(ctx.Pid)
+}
@@ -0,0 +1,49 @@
+package fuseutil
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+func lookUpProcess(pid uint32) (ProcessInfo, error) {
+	p := ProcessInfo{Pid: pid}
+	dir := fmt.Sprintf("/proc/%d", pid)
+
+	comm, err := os.ReadFile(dir + "/comm")
+	if errors.Is(err, os.ErrNotExist) {
+		return p, syscall.ESRCH
+	}
+
+	if err != nil {
+		return p, err
+	}
+	p.Name = strings.TrimSuffix(string(comm), "\n")
+
+	// Other users' processes may keep their executables to themselves, unless
+	// the file system runs as root.
+	exe, err := os.Readlink(dir + "/exe")
+	if err != nil && !errors.Is(err, os.ErrPermission) {
+		return p, err
+	}
+	p.Executable = exe
+
+	f, err := os.Open(dir + "/cgroup")
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+
+	// The unified hierarchy is listed as "0::/path".
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := s.Text(); strings.HasPrefix(line, "0::") {
+			p.Cgroup = strings.TrimPrefix(line, "0::")
+		}
+	}
+
+	return p, s.Err()
+}
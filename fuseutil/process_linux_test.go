@@ -0,0 +1,45 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+func TestLookUpProcess(t *testing.T) {
+	p, err := fuseutil.LookUpProcess(fuseops.OpContext{Pid: uint32(os.Getpid())})
+	if err != nil {
+		t.Fatalf("LookUpProcess: %v", err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Executable: %v", err)
+	}
+
+	if p.Executable != exe || p.Name == "" {
+		t.Errorf("Looked up %+v, want executable %q", p, exe)
+	}
+
+	// Write back from the page cache.
+	if _, err := fuseutil.LookUpProcess(fuseops.OpContext{}); err != syscall.ESRCH {
+		t.Errorf("LookUpProcess with no PID: %v", err)
+	}
+}
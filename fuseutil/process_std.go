@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package fuseutil
+
+import (
+	"errors"
+)
+
+func lookUpProcess(pid uint32) (ProcessInfo, error) {
+	return ProcessInfo{Pid: pid}, errors.New("LookUpProcess is only supported on Linux")
+}
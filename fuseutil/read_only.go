@@ -0,0 +1,169 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Create a file system that forwards read-only ops to the wrapped file system
+// and fails everything that would modify it with EROFS, including opening a
+// file for writing and any ioctl.
+//
+// This is a safety net for exporting a writable file system; mounting with
+// fuse.MountConfig.ReadOnly additionally lets the kernel reject most
+// modifications without calling the file system at all.
+func NewReadOnlyFileSystem(wrapped FileSystem) FileSystem {
+	return &readOnlyFileSystem{
+		FileSystem: wrapped,
+	}
+}
+
+type readOnlyFileSystem struct {
+	FileSystem
+
+	// Called with each op that is refused, if non-nil.
+	denied func(op interface{})
+
+	// The error refused ops fail with, if not EROFS.
+	errno syscall.Errno
+}
+
+func (fs *readOnlyFileSystem) deny(op interface{}) error {
+	if fs.denied != nil {
+		fs.denied(op)
+	}
+
+	if fs.errno != 0 {
+		return fs.errno
+	}
+
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return fs.deny(op)
+}
+
+func (fs *readOnlyFileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	if op.Mask&fuseops.AccessWrite != 0 {
+		return fs.deny(op)
+	}
+
+	return fs.FileSystem.Access(ctx, op)
+}
+
+func (fs *readOnlyFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.deny(op)
+}
+
+func (fs *readOnlyFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return fs.deny(op)
+}
+
+func (fs *readOnlyFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.deny(op)
+}
+
+func (fs *readOnlyFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return fs.deny(op)
+}
+
+func (fs *readOnlyFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fs.deny(op)
+}
+
+func (fs *readOnlyFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return fs.deny(op)
+}
+
+func (fs *readOnlyFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.deny(op)
+}
+
+func (fs *readOnlyFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.deny(op)
+}
+
+func (fs *readOnlyFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if !op.OpenFlags.IsReadOnly() {
+		return fs.deny(op)
+	}
+
+	return fs.FileSystem.OpenFile(ctx, op)
+}
+
+func (fs *readOnlyFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.deny(op)
+}
+
+func (fs *readOnlyFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return fs.deny(op)
+}
+
+func (fs *readOnlyFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return fs.deny(op)
+}
+
+func (fs *readOnlyFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return fs.deny(op)
+}
+
+func (fs *readOnlyFileSystem) SetInodeFlags(
+	ctx context.Context,
+	op *fuseops.SetInodeFlagsOp) error {
+	return fs.deny(op)
+}
+
+// Ioctls are opaque to us, and many of them modify the file system, e.g.
+// FS_IOC_SETFLAGS or FICLONE.
+func (fs *readOnlyFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	return fs.deny(op)
+}
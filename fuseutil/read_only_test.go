@@ -0,0 +1,123 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// Calls of ops that modify a file system.
+func mutatingOps(fs fuseutil.FileSystem) map[string]func(context.Context) error {
+	return map[string]func(context.Context) error{
+		"SetInodeAttributes": func(ctx context.Context) error {
+			return fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: 2})
+		},
+		"MkDir": func(ctx context.Context) error {
+			return fs.MkDir(ctx, &fuseops.MkDirOp{Parent: 1, Name: "d"})
+		},
+		"MkNode": func(ctx context.Context) error {
+			return fs.MkNode(ctx, &fuseops.MkNodeOp{Parent: 1, Name: "n"})
+		},
+		"CreateFile": func(ctx context.Context) error {
+			return fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: 1, Name: "f"})
+		},
+		"CreateLink": func(ctx context.Context) error {
+			return fs.CreateLink(ctx, &fuseops.CreateLinkOp{Parent: 1, Name: "l", Target: 2})
+		},
+		"CreateSymlink": func(ctx context.Context) error {
+			return fs.CreateSymlink(ctx, &fuseops.CreateSymlinkOp{Parent: 1, Name: "s", Target: "f"})
+		},
+		"Rename": func(ctx context.Context) error {
+			return fs.Rename(ctx, &fuseops.RenameOp{OldParent: 1, OldName: "f", NewParent: 1, NewName: "g"})
+		},
+		"RmDir": func(ctx context.Context) error {
+			return fs.RmDir(ctx, &fuseops.RmDirOp{Parent: 1, Name: "d"})
+		},
+		"Unlink": func(ctx context.Context) error {
+			return fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "f"})
+		},
+		"OpenFile(write only)": func(ctx context.Context) error {
+			return fs.OpenFile(ctx, &fuseops.OpenFileOp{Inode: 2, OpenFlags: fusekernel.OpenWriteOnly})
+		},
+		"OpenFile(read write)": func(ctx context.Context) error {
+			return fs.OpenFile(ctx, &fuseops.OpenFileOp{Inode: 2, OpenFlags: fusekernel.OpenReadWrite})
+		},
+		"WriteFile": func(ctx context.Context) error {
+			return fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 2, Data: []byte("taco")})
+		},
+		"RemoveXattr": func(ctx context.Context) error {
+			return fs.RemoveXattr(ctx, &fuseops.RemoveXattrOp{Inode: 2, Name: "user.x"})
+		},
+		"SetXattr": func(ctx context.Context) error {
+			return fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: 2, Name: "user.x"})
+		},
+		"Fallocate": func(ctx context.Context) error {
+			return fs.Fallocate(ctx, &fuseops.FallocateOp{Inode: 2, Length: 1})
+		},
+		"SetInodeFlags": func(ctx context.Context) error {
+			return fs.SetInodeFlags(ctx, &fuseops.SetInodeFlagsOp{Inode: 2, Flags: fuseops.InodeImmutable})
+		},
+		"Ioctl": func(ctx context.Context) error {
+			return fs.Ioctl(ctx, &fuseops.IoctlOp{Inode: 2, Cmd: 0x40086602})
+		},
+		"Access(write)": func(ctx context.Context) error {
+			return fs.Access(ctx, &fuseops.AccessOp{Inode: 2, Mask: fuseops.AccessWrite})
+		},
+	}
+}
+
+func TestReadOnlyFileSystem(t *testing.T) {
+	ctx := context.Background()
+	fs := fuseutil.NewReadOnlyFileSystem(&fuseutil.NotImplementedFileSystem{})
+
+	// The wrapped file system would fail with ENOSYS if it got the op.
+	for name, call := range mutatingOps(fs) {
+		if err := call(ctx); err != syscall.EROFS {
+			t.Errorf("%s: got %v, want EROFS", name, err)
+		}
+	}
+
+	// Reads go through.
+	reads := map[string]func(context.Context) error{
+		"OpenFile(read only)": func(ctx context.Context) error {
+			return fs.OpenFile(ctx, &fuseops.OpenFileOp{Inode: 2, OpenFlags: fusekernel.OpenReadOnly})
+		},
+		"ReadFile": func(ctx context.Context) error {
+			return fs.ReadFile(ctx, &fuseops.ReadFileOp{Inode: 2})
+		},
+		"LookUpInode": func(ctx context.Context) error {
+			return fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{Parent: 1, Name: "f"})
+		},
+		"GetXattr": func(ctx context.Context) error {
+			return fs.GetXattr(ctx, &fuseops.GetXattrOp{Inode: 2, Name: "user.x"})
+		},
+		"Access(read)": func(ctx context.Context) error {
+			return fs.Access(ctx, &fuseops.AccessOp{Inode: 2, Mask: fuseops.AccessRead})
+		},
+	}
+
+	for name, call := range reads {
+		if err := call(ctx); err != fuse.ENOSYS {
+			t.Errorf("%s: got %v, want ENOSYS from the wrapped file system", name, err)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// A FileSystem that forwards every op to a wrapped file system, except that
+// references to fuseops.RootInodeID are replaced with an inode of the wrapped
+// file system chosen by the chooseRoot function.
+//
+// The op is modified in place before being forwarded, and restored before
+// returning so that the kernel sees the IDs it asked about.
+type rootRemappingFileSystem struct {
+	FileSystem
+
+	chooseRoot func(context.Context, fuseops.OpContext) (fuseops.InodeID, error)
+
+	// Set if chooseRoot may return different inodes for different callers. In
+	// that case nothing about the root or its entries may be cached by the
+	// kernel, which is shared by all callers.
+	perCaller bool
+}
+
+// If *id refers to the root, replace it with the chosen root and return a
+// function that undoes the replacement.
+func (fs *rootRemappingFileSystem) remap(
+	ctx context.Context,
+	opCtx fuseops.OpContext,
+	id *fuseops.InodeID) (restore func(), err error) {
+	if *id != fuseops.RootInodeID {
+		return func() {}, nil
+	}
+
+	root, err := fs.chooseRoot(ctx, opCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	*id = root
+	return func() { *id = fuseops.RootInodeID }, nil
+}
+
+// Disable kernel caching of an entry within the root if the root is chosen per
+// caller, given the entry's parent as the kernel sent it.
+func (fs *rootRemappingFileSystem) fixEntry(
+	parent fuseops.InodeID,
+	e *fuseops.ChildInodeEntry) {
+	if fs.perCaller && parent == fuseops.RootInodeID {
+		e.EntryExpiration = fuseops.NoCache
+	}
+}
+
+func (fs *rootRemappingFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent := op.Parent
+	restore, err := fs.remap(ctx, op.OpContext, &op.Parent)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	err = fs.FileSystem.LookUpInode(ctx, op)
+	fs.fixEntry(parent, &op.Entry)
+	return err
+}
+
+func (fs *rootRemappingFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	inode := op.Inode
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	err = fs.FileSystem.GetInodeAttributes(ctx, op)
+	if fs.perCaller && inode == fuseops.RootInodeID {
+		op.AttributesExpiration = fuseops.NoCache
+	}
+
+	return err
+}
+
+func (fs *rootRemappingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	inode := op.Inode
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	err = fs.FileSystem.SetInodeAttributes(ctx, op)
+	if fs.perCaller && inode == fuseops.RootInodeID {
+		op.AttributesExpiration = fuseops.NoCache
+	}
+
+	return err
+}
+
+func (fs *rootRemappingFileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.Access(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	parent := op.Parent
+	restore, err := fs.remap(ctx, op.OpContext, &op.Parent)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	err = fs.FileSystem.MkDir(ctx, op)
+	fs.fixEntry(parent, &op.Entry)
+	return err
+}
+
+func (fs *rootRemappingFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	parent := op.Parent
+	restore, err := fs.remap(ctx, op.OpContext, &op.Parent)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	err = fs.FileSystem.MkNode(ctx, op)
+	fs.fixEntry(parent, &op.Entry)
+	return err
+}
+
+func (fs *rootRemappingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	parent := op.Parent
+	restore, err := fs.remap(ctx, op.OpContext, &op.Parent)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	err = fs.FileSystem.CreateFile(ctx, op)
+	fs.fixEntry(parent, &op.Entry)
+	return err
+}
+
+func (fs *rootRemappingFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	parent := op.Parent
+	restore, err := fs.remap(ctx, op.OpContext, &op.Parent)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	err = fs.FileSystem.CreateLink(ctx, op)
+	fs.fixEntry(parent, &op.Entry)
+	return err
+}
+
+func (fs *rootRemappingFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	parent := op.Parent
+	restore, err := fs.remap(ctx, op.OpContext, &op.Parent)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	err = fs.FileSystem.CreateSymlink(ctx, op)
+	fs.fixEntry(parent, &op.Entry)
+	return err
+}
+
+func (fs *rootRemappingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	restoreOld, err := fs.remap(ctx, op.OpContext, &op.OldParent)
+	if err != nil {
+		return err
+	}
+	defer restoreOld()
+
+	restoreNew, err := fs.remap(ctx, op.OpContext, &op.NewParent)
+	if err != nil {
+		return err
+	}
+	defer restoreNew()
+
+	return fs.FileSystem.Rename(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Parent)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.RmDir(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Parent)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.Unlink(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.OpenDir(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.ReadDir(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.ReadDirPlus(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.SyncFile(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.RemoveXattr(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.GetXattr(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.ListXattr(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.SetXattr(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) GetInodeFlags(
+	ctx context.Context,
+	op *fuseops.GetInodeFlagsOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.GetInodeFlags(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) SetInodeFlags(
+	ctx context.Context,
+	op *fuseops.SetInodeFlagsOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.SetInodeFlags(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.Ioctl(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) GetLk(
+	ctx context.Context,
+	op *fuseops.GetLkOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.GetLk(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) SetLk(
+	ctx context.Context,
+	op *fuseops.SetLkOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.SetLk(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.Lseek(ctx, op)
+}
+
+func (fs *rootRemappingFileSystem) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	restore, err := fs.remap(ctx, op.OpContext, &op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.FileSystem.Poll(ctx, op)
+}
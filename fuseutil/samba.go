@@ -0,0 +1,660 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// The extended attribute in which Samba stores DOS attributes when configured
+// with "store dos attributes = yes".
+const DOSAttributesXattr = "user.DOSATTRIB"
+
+// DOS file attributes, as found in Samba's DOSATTRIB extended attribute.
+const (
+	DOSReadOnly = 0x01
+	DOSHidden   = 0x02
+	DOSSystem   = 0x04
+	DOSArchive  = 0x20
+)
+
+// Parse the DOS attributes from the value of a DOSATTRIB extended attribute.
+// Samba has written several formats over time, all of which start with the
+// attributes as a NUL-terminated hexadecimal string such as "0x21".
+func ParseDOSAttributes(value []byte) (attrs uint32, ok bool) {
+	if i := bytes.IndexByte(value, 0); i >= 0 {
+		value = value[:i]
+	}
+
+	s := string(value)
+	if len(s) < 3 || s[:2] != "0x" {
+		return 0, false
+	}
+
+	n, err := strconv.ParseUint(s[2:], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint32(n), true
+}
+
+// Configuration for NewSambaFileSystem.
+type SambaConfig struct {
+	// Keep DOSATTRIB extended attributes in memory rather than in the wrapped
+	// file system, for backends that don't support extended attributes. The
+	// attributes are lost when the file system is unmounted. Other extended
+	// attributes are still forwarded.
+	EmulateDOSAttributes bool
+
+	// Refuse, with EACCES, opening for writing or truncating a file whose DOS
+	// attributes mark it read-only, so that processes accessing the mount
+	// directly honour the flag as Windows clients do. Samba itself enforces it
+	// for SMB clients.
+	EnforceReadOnly bool
+
+	// If non-nil, opens through the kernel take part in share-mode arbitration
+	// with the table, see ShareModeTable. So do unlinks, removals of
+	// directories, and renames, which count as opens for deletion of the inode
+	// renamed and of any inode replaced, as they do on Windows.
+	ShareModes *ShareModeTable
+}
+
+// Create a file system that helps an SMB server such as Samba re-export the
+// wrapped file system to Windows clients, according to the supplied config.
+func NewSambaFileSystem(
+	wrapped FileSystem,
+	cfg SambaConfig) FileSystem {
+	return &sambaFileSystem{
+		FileSystem: wrapped,
+		cfg:        cfg,
+		dosAttrs:   make(map[fuseops.InodeID][]byte),
+		orphans:    make(map[fuseops.InodeID]struct{}),
+		handles:    make(map[fuseops.HandleID]func()),
+	}
+}
+
+type sambaFileSystem struct {
+	FileSystem
+	cfg SambaConfig
+
+	mu sync.Mutex
+
+	// Emulated DOSATTRIB values, when cfg.EmulateDOSAttributes is set.
+	//
+	// GUARDED_BY(mu)
+	dosAttrs map[fuseops.InodeID][]byte
+
+	// Inodes whose last link has been removed, whose emulated attributes are
+	// dropped once the kernel forgets them. Until then they remain reachable
+	// through open files.
+	//
+	// GUARDED_BY(mu)
+	orphans map[fuseops.InodeID]struct{}
+
+	// Share-mode releases for open handles, when cfg.ShareModes is set.
+	//
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]func()
+}
+
+////////////////////////////////////////////////////////////////////////
+// DOS attributes
+////////////////////////////////////////////////////////////////////////
+
+// Forget the emulated attributes of a new inode, whose ID may have been used
+// by a deleted one.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sambaFileSystem) created(id fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.dosAttrs, id)
+	delete(fs.orphans, id)
+}
+
+// Note that the last link to an inode has been removed.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sambaFileSystem) orphaned(id fuseops.InodeID) {
+	if !fs.cfg.EmulateDOSAttributes {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.orphans[id] = struct{}{}
+}
+
+// Drop the emulated attributes of an inode the kernel has forgotten, if it
+// has no links left.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sambaFileSystem) forgotten(id fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.orphans[id]; ok {
+		delete(fs.orphans, id)
+		delete(fs.dosAttrs, id)
+	}
+}
+
+// Return the inode's DOS attributes, or zero if it has none.
+func (fs *sambaFileSystem) dosAttributes(
+	ctx context.Context,
+	id fuseops.InodeID) uint32 {
+	var value []byte
+	if fs.cfg.EmulateDOSAttributes {
+		fs.mu.Lock()
+		value = fs.dosAttrs[id]
+		fs.mu.Unlock()
+	} else {
+		op := &fuseops.GetXattrOp{
+			Inode: id,
+			Name:  DOSAttributesXattr,
+			Dst:   make([]byte, 256),
+		}
+
+		if fs.FileSystem.GetXattr(ctx, op) == nil {
+			value = op.Dst[:op.BytesRead]
+		}
+	}
+
+	attrs, _ := ParseDOSAttributes(value)
+	return attrs
+}
+
+func (fs *sambaFileSystem) checkWritable(
+	ctx context.Context,
+	id fuseops.InodeID) error {
+	if fs.cfg.EnforceReadOnly && fs.dosAttributes(ctx, id)&DOSReadOnly != 0 {
+		return syscall.EACCES
+	}
+
+	return nil
+}
+
+func (fs *sambaFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	if !fs.cfg.EmulateDOSAttributes || op.Name != DOSAttributesXattr {
+		return fs.FileSystem.GetXattr(ctx, op)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	value, ok := fs.dosAttrs[op.Inode]
+	if !ok {
+		return fuse.ENOATTR
+	}
+
+	op.BytesRead = len(value)
+	if len(op.Dst) == 0 {
+		return nil
+	}
+
+	if len(op.Dst) < len(value) {
+		return syscall.ERANGE
+	}
+
+	copy(op.Dst, value)
+	return nil
+}
+
+func (fs *sambaFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	if !fs.cfg.EmulateDOSAttributes || op.Name != DOSAttributesXattr {
+		return fs.FileSystem.SetXattr(ctx, op)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, ok := fs.dosAttrs[op.Inode]
+	switch {
+	case op.Flags == 0x1 && ok:
+		return fuse.EEXIST
+	case op.Flags == 0x2 && !ok:
+		return fuse.ENOATTR
+	}
+
+	fs.dosAttrs[op.Inode] = append([]byte(nil), op.Value...)
+	return nil
+}
+
+func (fs *sambaFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	if !fs.cfg.EmulateDOSAttributes || op.Name != DOSAttributesXattr {
+		return fs.FileSystem.RemoveXattr(ctx, op)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.dosAttrs[op.Inode]; !ok {
+		return fuse.ENOATTR
+	}
+
+	delete(fs.dosAttrs, op.Inode)
+	return nil
+}
+
+func (fs *sambaFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	err := fs.FileSystem.ListXattr(ctx, op)
+	if !fs.cfg.EmulateDOSAttributes {
+		return err
+	}
+
+	switch err {
+	case nil:
+	case fuse.ENOSYS, syscall.ENOTSUP:
+		op.BytesRead = 0
+	default:
+		return err
+	}
+
+	fs.mu.Lock()
+	_, ok := fs.dosAttrs[op.Inode]
+	fs.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	entry := DOSAttributesXattr + "\x00"
+	n := op.BytesRead
+	op.BytesRead += len(entry)
+	if len(op.Dst) == 0 {
+		return nil
+	}
+
+	if len(op.Dst) < op.BytesRead {
+		return syscall.ERANGE
+	}
+
+	copy(op.Dst[n:], entry)
+	return nil
+}
+
+func (fs *sambaFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if op.Size != nil {
+		if err := fs.checkWritable(ctx, op.Inode); err != nil {
+			return err
+		}
+	}
+
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+func (fs *sambaFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	err := fs.FileSystem.MkDir(ctx, op)
+	if err == nil {
+		fs.created(op.Entry.Child)
+	}
+
+	return err
+}
+
+func (fs *sambaFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	err := fs.FileSystem.MkNode(ctx, op)
+	if err == nil {
+		fs.created(op.Entry.Child)
+	}
+
+	return err
+}
+
+func (fs *sambaFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	err := fs.FileSystem.CreateSymlink(ctx, op)
+	if err == nil {
+		fs.created(op.Entry.Child)
+	}
+
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////
+// Share modes
+////////////////////////////////////////////////////////////////////////
+
+// Share access bits, with the meaning of the FILE_SHARE_* flags of Windows'
+// CreateFile: the kinds of access that an open allows others to have
+// concurrently.
+type ShareAccess uint32
+
+const (
+	ShareRead ShareAccess = 1 << iota
+	ShareWrite
+	ShareDelete
+
+	ShareNone ShareAccess = 0
+	ShareAll              = ShareRead | ShareWrite | ShareDelete
+)
+
+// A table of the opens of each inode, arbitrating between them according to
+// Windows share-mode semantics: an open fails with a sharing violation if it
+// wants access that an existing open denies, or denies access that an
+// existing open has.
+//
+// The kernel doesn't convey share modes, so opens through the mount always
+// share everything, and only conflict with opens registered by an SMB gateway
+// running in the same process that calls Open directly. This lets a gateway
+// deny local processes write access to a file a Windows client has opened
+// with FILE_SHARE_READ, and vice versa.
+type ShareModeTable struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	opens map[fuseops.InodeID][]*shareModeOpen
+}
+
+type shareModeOpen struct {
+	access ShareAccess
+	share  ShareAccess
+}
+
+// Register an open of the inode with the supplied access, sharing the
+// supplied kinds of access with others. Return EBUSY, which Samba maps to
+// NT_STATUS_SHARING_VIOLATION, in case of conflict. Otherwise the returned
+// function must be called when the file is closed.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *ShareModeTable) Open(
+	id fuseops.InodeID,
+	access ShareAccess,
+	share ShareAccess) (release func(), err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, o := range t.opens[id] {
+		if access&^o.share != 0 || o.access&^share != 0 {
+			return nil, syscall.EBUSY
+		}
+	}
+
+	if t.opens == nil {
+		t.opens = make(map[fuseops.InodeID][]*shareModeOpen)
+	}
+
+	o := &shareModeOpen{access: access, share: share}
+	t.opens[id] = append(t.opens[id], o)
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() { t.release(id, o) })
+	}
+
+	return release, nil
+}
+
+// LOCKS_EXCLUDED(t.mu)
+func (t *ShareModeTable) release(id fuseops.InodeID, o *shareModeOpen) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	opens := t.opens[id]
+	for i, other := range opens {
+		if other == o {
+			opens = append(opens[:i], opens[i+1:]...)
+			break
+		}
+	}
+
+	if len(opens) == 0 {
+		delete(t.opens, id)
+	} else {
+		t.opens[id] = opens
+	}
+}
+
+// Register a handle opened through the kernel with the share-mode table.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sambaFileSystem) openShared(
+	id fuseops.InodeID,
+	access ShareAccess) (func(), error) {
+	if fs.cfg.ShareModes == nil {
+		return func() {}, nil
+	}
+
+	return fs.cfg.ShareModes.Open(id, access, ShareAll)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sambaFileSystem) noteHandle(h fuseops.HandleID, release func()) {
+	if fs.cfg.ShareModes == nil {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.handles[h] = release
+}
+
+func (fs *sambaFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	access := ShareRead
+	if !op.OpenFlags.IsReadOnly() {
+		access |= ShareWrite
+		if err := fs.checkWritable(ctx, op.Inode); err != nil {
+			return err
+		}
+	}
+
+	release, err := fs.openShared(op.Inode, access)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.FileSystem.OpenFile(ctx, op); err != nil {
+		release()
+		return err
+	}
+
+	fs.noteHandle(op.Handle, release)
+	return nil
+}
+
+func (fs *sambaFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := fs.FileSystem.CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.created(op.Entry.Child)
+
+	// Nobody else can have opened the file yet.
+	release, _ := fs.openShared(op.Entry.Child, ShareRead|ShareWrite)
+	fs.noteHandle(op.Handle, release)
+	return nil
+}
+
+func (fs *sambaFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	err := fs.FileSystem.ForgetInode(ctx, op)
+	fs.forgotten(op.Inode)
+
+	return err
+}
+
+func (fs *sambaFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	// On ENOSYS the entries come back to ForgetInode one by one.
+	err := fs.FileSystem.BatchForget(ctx, op)
+	if err == nil {
+		for _, entry := range op.Entries {
+			fs.forgotten(entry.Inode)
+		}
+	}
+
+	return err
+}
+
+// Prepare to remove or replace the entry for the supplied name, by looking up
+// the inode it refers to and registering an open for its deletion with the
+// share-mode table. Return the entry, or nil if there is none or neither
+// feature needs it, and a function to be called once the operation is done.
+func (fs *sambaFileSystem) openForDelete(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string,
+	opCtx fuseops.OpContext) (*fuseops.ChildInodeEntry, func(), error) {
+	noop := func() {}
+	if fs.cfg.ShareModes == nil && !fs.cfg.EmulateDOSAttributes {
+		return nil, noop, nil
+	}
+
+	lookUpOp := &fuseops.LookUpInodeOp{
+		Parent:    parent,
+		Name:      name,
+		OpContext: opCtx,
+	}
+
+	if fs.FileSystem.LookUpInode(ctx, lookUpOp) != nil {
+		return nil, noop, nil
+	}
+
+	// The lookup isn't the kernel's, so the reference it took is ours to drop.
+	fs.FileSystem.ForgetInode(ctx, &fuseops.ForgetInodeOp{
+		Inode:     lookUpOp.Entry.Child,
+		N:         1,
+		OpContext: opCtx,
+	})
+
+	if fs.cfg.ShareModes == nil {
+		return &lookUpOp.Entry, noop, nil
+	}
+
+	release, err := fs.cfg.ShareModes.Open(
+		lookUpOp.Entry.Child,
+		ShareDelete,
+		ShareAll)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &lookUpOp.Entry, release, nil
+}
+
+// Note that the supplied entry has been removed or replaced.
+func (fs *sambaFileSystem) removed(e *fuseops.ChildInodeEntry) {
+	if e != nil && (e.Attributes.Nlink <= 1 || e.Attributes.Mode.IsDir()) {
+		fs.orphaned(e.Child)
+	}
+}
+
+func (fs *sambaFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	e, release, err := fs.openForDelete(ctx, op.Parent, op.Name, op.OpContext)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := fs.FileSystem.Unlink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.removed(e)
+	return nil
+}
+
+func (fs *sambaFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	e, release, err := fs.openForDelete(ctx, op.Parent, op.Name, op.OpContext)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := fs.FileSystem.RmDir(ctx, op); err != nil {
+		return err
+	}
+
+	fs.removed(e)
+	return nil
+}
+
+func (fs *sambaFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	_, release, err := fs.openForDelete(ctx, op.OldParent, op.OldName, op.OpContext)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	replaced, release, err := fs.openForDelete(ctx, op.NewParent, op.NewName, op.OpContext)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := fs.FileSystem.Rename(ctx, op); err != nil {
+		return err
+	}
+
+	// Exchanging leaves the entry at the new name linked, under the old one.
+	if op.Flags&fuseops.RenameExchange == 0 {
+		fs.removed(replaced)
+	}
+
+	return nil
+}
+
+func (fs *sambaFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	release := fs.handles[op.Handle]
+	delete(fs.handles, op.Handle)
+	fs.mu.Unlock()
+
+	if release != nil {
+		release()
+	}
+
+	return fs.FileSystem.ReleaseFileHandle(ctx, op)
+}
@@ -0,0 +1,312 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system without extended attributes, in which any inode can be
+// opened.
+type openableFS struct {
+	fuseutil.NotImplementedFileSystem
+	next fuseops.HandleID
+}
+
+func (fs *openableFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.next++
+	op.Handle = fs.next
+	return nil
+}
+
+func (fs *openableFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+func TestParseDOSAttributes(t *testing.T) {
+	cases := []struct {
+		value string
+		attrs uint32
+		ok    bool
+	}{
+		{"0x21", 0x21, true},
+		{"0x1\x00\x03\x00blob", 0x1, true},
+		{"", 0, false},
+		{"21", 0, false},
+		{"0xzz", 0, false},
+	}
+
+	for _, c := range cases {
+		attrs, ok := fuseutil.ParseDOSAttributes([]byte(c.value))
+		if attrs != c.attrs || ok != c.ok {
+			t.Errorf("%q: got (%#x, %v), want (%#x, %v)", c.value, attrs, ok, c.attrs, c.ok)
+		}
+	}
+}
+
+func TestSambaFileSystemDOSAttributes(t *testing.T) {
+	ctx := context.Background()
+	fs := fuseutil.NewSambaFileSystem(&openableFS{}, fuseutil.SambaConfig{
+		EmulateDOSAttributes: true,
+		EnforceReadOnly:      true,
+	})
+
+	openForWriting := func() error {
+		return fs.OpenFile(ctx, &fuseops.OpenFileOp{
+			Inode:     2,
+			OpenFlags: fusekernel.OpenWriteOnly,
+		})
+	}
+
+	if err := openForWriting(); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	err := fs.SetXattr(ctx, &fuseops.SetXattrOp{
+		Inode: 2,
+		Name:  fuseutil.DOSAttributesXattr,
+		Value: []byte("0x21\x00"),
+	})
+	if err != nil {
+		t.Fatalf("SetXattr: %v", err)
+	}
+
+	getOp := &fuseops.GetXattrOp{
+		Inode: 2,
+		Name:  fuseutil.DOSAttributesXattr,
+		Dst:   make([]byte, 16),
+	}
+	if err := fs.GetXattr(ctx, getOp); err != nil {
+		t.Fatalf("GetXattr: %v", err)
+	}
+
+	if got := string(getOp.Dst[:getOp.BytesRead]); got != "0x21\x00" {
+		t.Errorf("GetXattr: %q", got)
+	}
+
+	listOp := &fuseops.ListXattrOp{Inode: 2, Dst: make([]byte, 64)}
+	if err := fs.ListXattr(ctx, listOp); err != nil {
+		t.Fatalf("ListXattr: %v", err)
+	}
+
+	if got := string(listOp.Dst[:listOp.BytesRead]); got != "user.DOSATTRIB\x00" {
+		t.Errorf("ListXattr: %q", got)
+	}
+
+	// The file is now read-only.
+	if err := openForWriting(); err != syscall.EACCES {
+		t.Errorf("OpenFile: got %v, want EACCES", err)
+	}
+
+	var size uint64
+	err = fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: 2, Size: &size})
+	if err != syscall.EACCES {
+		t.Errorf("SetInodeAttributes: got %v, want EACCES", err)
+	}
+}
+
+func TestSambaFileSystemShareModes(t *testing.T) {
+	ctx := context.Background()
+	table := &fuseutil.ShareModeTable{}
+	fs := fuseutil.NewSambaFileSystem(&openableFS{}, fuseutil.SambaConfig{
+		ShareModes: table,
+	})
+
+	// A Windows client opens the file for reading, sharing only reads.
+	release, err := table.Open(2, fuseutil.ShareRead, fuseutil.ShareRead)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Local readers are fine, writers aren't.
+	readOp := &fuseops.OpenFileOp{Inode: 2, OpenFlags: fusekernel.OpenReadOnly}
+	if err := fs.OpenFile(ctx, readOp); err != nil {
+		t.Errorf("OpenFile(read only): %v", err)
+	}
+
+	writeOp := &fuseops.OpenFileOp{Inode: 2, OpenFlags: fusekernel.OpenReadWrite}
+	if err := fs.OpenFile(ctx, writeOp); err != syscall.EBUSY {
+		t.Errorf("OpenFile(read write): got %v, want EBUSY", err)
+	}
+
+	// Another Windows client can't get exclusive access while a local reader
+	// holds the file open.
+	release()
+	if _, err := table.Open(2, fuseutil.ShareRead, fuseutil.ShareNone); err != syscall.EBUSY {
+		t.Errorf("Open(exclusive): got %v, want EBUSY", err)
+	}
+
+	fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: readOp.Handle})
+	release, err = table.Open(2, fuseutil.ShareRead, fuseutil.ShareNone)
+	if err != nil {
+		t.Fatalf("Open(exclusive) after release: %v", err)
+	}
+	release()
+}
+
+// An openableFS with a root directory containing files "a" and "b" and a
+// directory "d", which can be removed and renamed without effect.
+type namedFS struct {
+	openableFS
+}
+
+func (fs *namedFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	switch op.Name {
+	case "a":
+		op.Entry.Child = 2
+	case "b":
+		op.Entry.Child = 3
+	case "d":
+		op.Entry.Child = 4
+		op.Entry.Attributes.Mode = os.ModeDir | 0755
+		return nil
+	default:
+		return fuse.ENOENT
+	}
+
+	op.Entry.Attributes.Nlink = 1
+	return nil
+}
+
+func (fs *namedFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func (fs *namedFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return nil
+}
+
+func (fs *namedFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return nil
+}
+
+func (fs *namedFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return nil
+}
+
+func TestSambaFileSystemDenyDelete(t *testing.T) {
+	ctx := context.Background()
+	table := &fuseutil.ShareModeTable{}
+	fs := fuseutil.NewSambaFileSystem(&namedFS{}, fuseutil.SambaConfig{
+		ShareModes: table,
+	})
+
+	// Windows clients open "a" and "d" without sharing deletion.
+	for _, id := range []fuseops.InodeID{2, 4} {
+		release, err := table.Open(id, fuseutil.ShareRead, fuseutil.ShareRead)
+		if err != nil {
+			t.Fatalf("Open(%d): %v", id, err)
+		}
+		defer release()
+	}
+
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "a"}); err != syscall.EBUSY {
+		t.Errorf("Unlink: got %v, want EBUSY", err)
+	}
+
+	if err := fs.RmDir(ctx, &fuseops.RmDirOp{Parent: 1, Name: "d"}); err != syscall.EBUSY {
+		t.Errorf("RmDir: got %v, want EBUSY", err)
+	}
+
+	// Neither renaming the open file nor replacing it is allowed.
+	rename := func(from, to string) error {
+		return fs.Rename(ctx, &fuseops.RenameOp{
+			OldParent: 1,
+			OldName:   from,
+			NewParent: 1,
+			NewName:   to,
+		})
+	}
+
+	if err := rename("a", "c"); err != syscall.EBUSY {
+		t.Errorf("Rename from the open file: got %v, want EBUSY", err)
+	}
+
+	if err := rename("b", "a"); err != syscall.EBUSY {
+		t.Errorf("Rename over the open file: got %v, want EBUSY", err)
+	}
+
+	if err := rename("b", "c"); err != nil {
+		t.Errorf("Rename of another file: %v", err)
+	}
+}
+
+func TestSambaFileSystemDropsDeletedDOSAttributes(t *testing.T) {
+	ctx := context.Background()
+	fs := fuseutil.NewSambaFileSystem(&namedFS{}, fuseutil.SambaConfig{
+		EmulateDOSAttributes: true,
+	})
+
+	for _, id := range []fuseops.InodeID{2, 3} {
+		err := fs.SetXattr(ctx, &fuseops.SetXattrOp{
+			Inode: id,
+			Name:  fuseutil.DOSAttributesXattr,
+			Value: []byte("0x20\x00"),
+		})
+		if err != nil {
+			t.Fatalf("SetXattr(%d): %v", id, err)
+		}
+	}
+
+	hasAttributes := func(id fuseops.InodeID) bool {
+		return fs.GetXattr(ctx, &fuseops.GetXattrOp{
+			Inode: id,
+			Name:  fuseutil.DOSAttributesXattr,
+		}) == nil
+	}
+
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "a"}); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	// The unlinked file may still be open, so its attributes remain until the
+	// kernel forgets it. Forgetting a linked file keeps them.
+	if !hasAttributes(2) {
+		t.Errorf("Attributes of the unlinked file dropped before forget")
+	}
+
+	fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: 2, N: 1})
+	fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: 3, N: 1})
+
+	if hasAttributes(2) {
+		t.Errorf("Attributes of the unlinked file kept after forget")
+	}
+
+	if !hasAttributes(3) {
+		t.Errorf("Attributes of a linked file dropped on forget")
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"io"
+	"sync"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// The occasions on which a scanning file system scans file contents.
+type ScanEvent int
+
+const (
+	// A file is being opened for reading, and its current contents haven't
+	// been scanned yet. The open waits for the verdict.
+	ScanOpen ScanEvent = iota
+
+	// A handle through which the file was changed has been closed. The scan
+	// runs in the background; opens for reading made meanwhile wait for it.
+	ScanCloseWrite
+)
+
+// A request to scan the contents of a file.
+type ScanRequest struct {
+	Event ScanEvent
+	Inode fuseops.InodeID
+
+	// The contents of the file, read through the wrapped file system. Valid
+	// only for the duration of the call.
+	Contents io.ReaderAt
+
+	// The context of the op that led to the scan.
+	OpContext fuseops.OpContext
+}
+
+// Options for NewScanningFileSystem.
+type ScanConfig struct {
+	// Scan the contents of a file, e.g. by streaming them to clamd or an ICAP
+	// server. Required. It may be called concurrently.
+	//
+	// Returning a syscall.Errno, typically EACCES, denies opening the file for
+	// reading with that error until its contents change. Returning any other
+	// error, such as a failure to reach the scanner, fails the open waiting
+	// for the verdict with EIO, and the file is scanned again on the next open.
+	Scan func(ctx context.Context, req ScanRequest) error
+}
+
+// Create a file system that has the contents of files scanned, for
+// deployments that must integrate content scanning at the file system layer.
+// Files are scanned when first opened for reading and after each close of a
+// handle through which they were written, and verdicts are remembered until
+// the contents next change. Opens for writing only are never held up.
+func NewScanningFileSystem(
+	wrapped FileSystem,
+	cfg ScanConfig) FileSystem {
+	return &scanningFileSystem{
+		FileSystem: wrapped,
+		cfg:        cfg,
+		verdicts:   make(map[fuseops.InodeID]*scanVerdict),
+		written:    make(map[fuseops.HandleID]fuseops.InodeID),
+	}
+}
+
+type scanningFileSystem struct {
+	FileSystem
+	cfg ScanConfig
+
+	// Scans running in the background.
+	scans sync.WaitGroup
+
+	mu sync.Mutex
+
+	// The verdict on the current contents of each inode scanned, or being
+	// scanned.
+	//
+	// GUARDED_BY(mu)
+	verdicts map[fuseops.InodeID]*scanVerdict
+
+	// The handles through which contents have been changed, and their inodes.
+	//
+	// GUARDED_BY(mu)
+	written map[fuseops.HandleID]fuseops.InodeID
+}
+
+type scanVerdict struct {
+	// Closed once err has been set.
+	done chan struct{}
+	err  error
+}
+
+// An io.ReaderAt reading a file through an open handle.
+type handleReader struct {
+	ctx   context.Context
+	fs    FileSystem
+	inode fuseops.InodeID
+	h     fuseops.HandleID
+	opCtx fuseops.OpContext
+}
+
+func (r *handleReader) ReadAt(p []byte, off int64) (int, error) {
+	op := &fuseops.ReadFileOp{
+		Inode:     r.inode,
+		Handle:    r.h,
+		Offset:    off,
+		Size:      int64(len(p)),
+		Dst:       p,
+		OpContext: r.opCtx,
+	}
+
+	if err := r.fs.ReadFile(r.ctx, op); err != nil {
+		return 0, err
+	}
+
+	n := op.BytesRead
+	if op.Data != nil {
+		n = 0
+		for _, b := range op.Data {
+			n += copy(p[n:], b)
+		}
+
+		if n > op.BytesRead {
+			n = op.BytesRead
+		}
+	}
+
+	// A short read marks the end of the file.
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Scan the inode through an open handle, and record the verdict.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *scanningFileSystem) scan(
+	ctx context.Context,
+	v *scanVerdict,
+	event ScanEvent,
+	inode fuseops.InodeID,
+	h fuseops.HandleID,
+	opCtx fuseops.OpContext) {
+	err := fs.cfg.Scan(ctx, ScanRequest{
+		Event: event,
+		Inode: inode,
+		Contents: &handleReader{
+			ctx:   ctx,
+			fs:    fs.FileSystem,
+			inode: inode,
+			h:     h,
+			opCtx: opCtx,
+		},
+		OpContext: opCtx,
+	})
+
+	_, denied := err.(syscall.Errno)
+	if err != nil && !denied {
+		err = syscall.EIO
+	}
+
+	fs.settle(v, inode, err, err == nil || denied)
+}
+
+// Publish the verdict of a scan. Unless keep is set, the verdict is forgotten
+// straight away, so that the next open scans again.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *scanningFileSystem) settle(
+	v *scanVerdict,
+	inode fuseops.InodeID,
+	err error,
+	keep bool) {
+	if !keep {
+		fs.mu.Lock()
+		if fs.verdicts[inode] == v {
+			delete(fs.verdicts, inode)
+		}
+		fs.mu.Unlock()
+	}
+
+	v.err = err
+	close(v.done)
+}
+
+// Note that the inode's contents have changed, dropping the verdict on them.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *scanningFileSystem) changed(
+	inode fuseops.InodeID,
+	h fuseops.HandleID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.verdicts, inode)
+	fs.written[h] = inode
+}
+
+func (fs *scanningFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if op.OpenFlags.IsWriteOnly() {
+		return fs.FileSystem.OpenFile(ctx, op)
+	}
+
+	// Wait for any scan already running, or run one ourselves.
+	fs.mu.Lock()
+	v := fs.verdicts[op.Inode]
+	mine := v == nil
+	if mine {
+		v = &scanVerdict{done: make(chan struct{})}
+		fs.verdicts[op.Inode] = v
+	}
+	fs.mu.Unlock()
+
+	if !mine {
+		select {
+		case <-v.done:
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+
+		if v.err != nil {
+			return v.err
+		}
+
+		return fs.FileSystem.OpenFile(ctx, op)
+	}
+
+	if err := fs.FileSystem.OpenFile(ctx, op); err != nil {
+		fs.settle(v, op.Inode, err, false)
+		return err
+	}
+
+	fs.scan(ctx, v, ScanOpen, op.Inode, op.Handle, op.OpContext)
+	if v.err != nil {
+		fs.FileSystem.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{
+			Handle:    op.Handle,
+			OpContext: op.OpContext,
+		})
+
+		return v.err
+	}
+
+	return nil
+}
+
+func (fs *scanningFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.changed(op.Inode, op.Handle)
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+func (fs *scanningFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if op.Size != nil {
+		fs.mu.Lock()
+		delete(fs.verdicts, op.Inode)
+		if op.Handle != nil {
+			fs.written[*op.Handle] = op.Inode
+		}
+		fs.mu.Unlock()
+	}
+
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+func (fs *scanningFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	fs.changed(op.Inode, op.Handle)
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *scanningFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	inode, ok := fs.written[op.Handle]
+	delete(fs.written, op.Handle)
+
+	var v *scanVerdict
+	if ok && fs.verdicts[inode] == nil {
+		v = &scanVerdict{done: make(chan struct{})}
+		fs.verdicts[inode] = v
+	}
+	fs.mu.Unlock()
+
+	if err := fs.FileSystem.ReleaseFileHandle(ctx, op); err != nil {
+		if v != nil {
+			fs.settle(v, inode, err, false)
+		}
+
+		return err
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	// The kernel doesn't wait for the release, so scan through a handle of our
+	// own in the background.
+	fs.scans.Add(1)
+	go func() {
+		defer fs.scans.Done()
+
+		ctx := context.Background()
+		openOp := &fuseops.OpenFileOp{
+			Inode:     inode,
+			OpContext: op.OpContext,
+		}
+
+		if err := fs.FileSystem.OpenFile(ctx, openOp); err != nil {
+			fs.settle(v, inode, err, false)
+			return
+		}
+
+		fs.scan(ctx, v, ScanCloseWrite, inode, openOp.Handle, op.OpContext)
+		fs.FileSystem.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{
+			Handle:    openOp.Handle,
+			OpContext: op.OpContext,
+		})
+	}()
+
+	return nil
+}
+
+func (fs *scanningFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	delete(fs.verdicts, op.Inode)
+	fs.mu.Unlock()
+
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+func (fs *scanningFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	// On ENOSYS the entries come back to ForgetInode one by one.
+	err := fs.FileSystem.BatchForget(ctx, op)
+	if err == nil {
+		fs.mu.Lock()
+		for _, entry := range op.Entries {
+			delete(fs.verdicts, entry.Inode)
+		}
+		fs.mu.Unlock()
+	}
+
+	return err
+}
+
+func (fs *scanningFileSystem) Destroy() {
+	fs.scans.Wait()
+	fs.FileSystem.Destroy()
+}
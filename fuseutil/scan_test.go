@@ -0,0 +1,195 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A contentsFS whose files can be opened, counting the handles left open.
+type scannableFS struct {
+	contentsFS
+
+	next fuseops.HandleID
+	open int
+}
+
+func (fs *scannableFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.next++
+	fs.open++
+	op.Handle = fs.next
+	return nil
+}
+
+func (fs *scannableFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.open--
+	return nil
+}
+
+func TestScanningFileSystem(t *testing.T) {
+	ctx := context.Background()
+	wrapped := &scannableFS{}
+	wrapped.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 2, Data: []byte("clean")})
+
+	// Deny files containing "EICAR", failing while unavailable is set.
+	var mu sync.Mutex
+	var events []fuseutil.ScanEvent
+	var unavailable bool
+	fs := fuseutil.NewScanningFileSystem(wrapped, fuseutil.ScanConfig{
+		Scan: func(ctx context.Context, req fuseutil.ScanRequest) error {
+			mu.Lock()
+			events = append(events, req.Event)
+			down := unavailable
+			mu.Unlock()
+
+			if down {
+				return errors.New("clamd unreachable")
+			}
+
+			contents, err := io.ReadAll(io.NewSectionReader(req.Contents, 0, 1<<20))
+			if err != nil {
+				return err
+			}
+
+			if strings.Contains(string(contents), "EICAR") {
+				return syscall.EACCES
+			}
+
+			return nil
+		},
+	})
+
+	open := func(flags fusekernel.OpenFlags) (fuseops.HandleID, error) {
+		op := &fuseops.OpenFileOp{Inode: 2, OpenFlags: flags}
+		err := fs.OpenFile(ctx, op)
+		return op.Handle, err
+	}
+
+	scans := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events)
+	}
+
+	// The first open for reading is scanned, later ones aren't.
+	for i := 0; i < 2; i++ {
+		h, err := open(fusekernel.OpenReadOnly)
+		if err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+
+		fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: h})
+	}
+
+	if n := scans(); n != 1 || events[0] != fuseutil.ScanOpen {
+		t.Fatalf("Scans after opening: %v", events)
+	}
+
+	// Writing doesn't wait for a scan, but closing afterwards starts one.
+	h, err := open(fusekernel.OpenWriteOnly)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	err = fs.WriteFile(ctx, &fuseops.WriteFileOp{
+		Inode:  2,
+		Handle: h,
+		Data:   []byte("EICAR"),
+	})
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if n := scans(); n != 1 {
+		t.Fatalf("%d scans before closing", n)
+	}
+
+	fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: h})
+
+	// Opening for reading waits for the verdict.
+	if _, err := open(fusekernel.OpenReadWrite); err != syscall.EACCES {
+		t.Fatalf("OpenFile after writing: %v, want EACCES", err)
+	}
+
+	if n := scans(); n != 2 || events[1] != fuseutil.ScanCloseWrite {
+		t.Fatalf("Scans after closing: %v", events)
+	}
+
+	// The verdict sticks until the contents change.
+	if _, err := open(fusekernel.OpenReadOnly); err != syscall.EACCES {
+		t.Fatalf("OpenFile again: %v, want EACCES", err)
+	}
+
+	if n := scans(); n != 2 {
+		t.Fatalf("%d scans after opening again", n)
+	}
+
+	// A scanner that can't be reached fails the open without a lasting verdict.
+	err = fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{
+		Inode: 2,
+		Size:  new(uint64),
+	})
+	if err != nil && err != syscall.ENOSYS {
+		t.Fatalf("SetInodeAttributes: %v", err)
+	}
+
+	mu.Lock()
+	unavailable = true
+	mu.Unlock()
+
+	if _, err := open(fusekernel.OpenReadOnly); err != syscall.EIO {
+		t.Fatalf("OpenFile while unavailable: %v, want EIO", err)
+	}
+
+	mu.Lock()
+	unavailable = false
+	mu.Unlock()
+
+	// contentsFS doesn't truncate, so the contents are still denied.
+	if _, err := open(fusekernel.OpenReadOnly); err != syscall.EACCES {
+		t.Fatalf("OpenFile once available: %v, want EACCES", err)
+	}
+
+	if n := scans(); n != 4 {
+		t.Fatalf("%d scans once available", n)
+	}
+
+	fs.Destroy()
+
+	// Denied opens don't leak the handles opened to scan through.
+	if wrapped.open != 0 {
+		t.Errorf("%d handles left open", wrapped.open)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sort"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Answer a LseekOp for a file of the given size, whose data lies in the given
+// extents, in any order. Everything else up to the size is a hole. File
+// systems that don't track holes can pass a single extent covering the file.
+func SeekExtents(
+	op *fuseops.LseekOp,
+	size uint64,
+	extents []ByteRange) error {
+	if op.Offset < 0 || uint64(op.Offset) >= size {
+		return syscall.ENXIO
+	}
+
+	sorted := make([]ByteRange, 0, len(extents))
+	for _, e := range extents {
+		if e.Length != 0 && e.Offset < size {
+			sorted = append(sorted, e)
+		}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Offset < sorted[j].Offset
+	})
+
+	off := uint64(op.Offset)
+	switch op.Whence {
+	case fuseops.SeekData:
+		for _, e := range sorted {
+			if off < e.Offset+e.Length {
+				if off < e.Offset {
+					off = e.Offset
+				}
+
+				op.NewOffset = int64(off)
+				return nil
+			}
+		}
+
+		return syscall.ENXIO
+
+	case fuseops.SeekHole:
+		// Skip over the extents that cover off, which may overlap or abut.
+		for _, e := range sorted {
+			if e.Offset > off {
+				break
+			}
+
+			if end := e.Offset + e.Length; end > off {
+				off = end
+			}
+		}
+
+		if off > size {
+			off = size
+		}
+
+		op.NewOffset = int64(off)
+		return nil
+
+	default:
+		return syscall.EINVAL
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+func TestSeekExtents(t *testing.T) {
+	// Data in [10, 20), [20, 30) and [50, 120), in a file of 100 bytes.
+	extents := []fuseutil.ByteRange{
+		{Offset: 50, Length: 70},
+		{Offset: 10, Length: 10},
+		{Offset: 20, Length: 10},
+	}
+
+	testCases := []struct {
+		offset int64
+		whence int
+		want   int64
+		err    error
+	}{
+		{0, fuseops.SeekData, 10, nil},
+		{15, fuseops.SeekData, 15, nil},
+		{30, fuseops.SeekData, 50, nil},
+		{0, fuseops.SeekHole, 0, nil},
+		{10, fuseops.SeekHole, 30, nil},
+		{60, fuseops.SeekHole, 100, nil},
+		{100, fuseops.SeekData, 0, syscall.ENXIO},
+		{100, fuseops.SeekHole, 0, syscall.ENXIO},
+		{-1, fuseops.SeekData, 0, syscall.ENXIO},
+		{0, 0, 0, syscall.EINVAL},
+	}
+
+	for _, tc := range testCases {
+		op := &fuseops.LseekOp{Offset: tc.offset, Whence: tc.whence}
+		err := fuseutil.SeekExtents(op, 100, extents)
+		if err != tc.err || (err == nil && op.NewOffset != tc.want) {
+			t.Errorf(
+				"SeekExtents(%d, %d): %d, %v; want %d, %v",
+				tc.offset, tc.whence, op.NewOffset, err, tc.want, tc.err)
+		}
+	}
+}
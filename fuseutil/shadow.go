@@ -0,0 +1,465 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// Create a file system that serves reads from the wrapped file system, and
+// passes each modification to logWrite instead of applying it. This allows
+// the write traffic a workload would send to a new backend to be observed
+// without touching the old one.
+//
+// Files may be opened for writing; the wrapped file system sees them opened
+// read-only. Writes, attribute changes, preallocation, extended attribute
+// and inode flag changes, unlinks and renames are then logged and reported as
+// successful, without being applied. Since later reads come from the wrapped
+// file system, the workload sees none of its own modifications. Ops creating
+// inodes, which can't be answered without one, are logged and refused with
+// EROFS.
+//
+// logWrite is called synchronously, before the op is answered, and must not
+// retain the op or the buffers it refers to.
+func NewDryRunFileSystem(
+	wrapped FileSystem,
+	logWrite func(op interface{})) FileSystem {
+	return &dryRunFileSystem{
+		readOnlyFileSystem: readOnlyFileSystem{
+			FileSystem: wrapped,
+			denied:     logWrite,
+		},
+		logWrite: logWrite,
+	}
+}
+
+type dryRunFileSystem struct {
+	readOnlyFileSystem
+	logWrite func(op interface{})
+}
+
+func (fs *dryRunFileSystem) discard(op interface{}) error {
+	if fs.logWrite != nil {
+		fs.logWrite(op)
+	}
+
+	return nil
+}
+
+func (fs *dryRunFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if op.OpenFlags.IsReadOnly() && op.OpenFlags&fusekernel.OpenTruncate == 0 {
+		return fs.FileSystem.OpenFile(ctx, op)
+	}
+
+	fs.discard(op)
+
+	// Open read-only in the wrapped file system, then restore the flags for
+	// the benefit of the caller.
+	flags := op.OpenFlags
+	op.OpenFlags = flags&^(fusekernel.OpenAccessModeMask|fusekernel.OpenTruncate|fusekernel.OpenAppend) |
+		fusekernel.OpenReadOnly
+
+	err := fs.FileSystem.OpenFile(ctx, op)
+	op.OpenFlags = flags
+
+	return err
+}
+
+func (fs *dryRunFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.discard(op)
+}
+
+// Answer with the inode's current attributes, changed as asked so that the
+// kernel's view is consistent with its request.
+func (fs *dryRunFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.discard(op)
+
+	getOp := &fuseops.GetInodeAttributesOp{
+		Inode:     op.Inode,
+		OpContext: op.OpContext,
+	}
+
+	if err := fs.FileSystem.GetInodeAttributes(ctx, getOp); err != nil {
+		return err
+	}
+
+	attrs := &getOp.Attributes
+	if op.Uid != nil {
+		attrs.Uid = *op.Uid
+	}
+
+	if op.Gid != nil {
+		attrs.Gid = *op.Gid
+	}
+
+	if op.Size != nil {
+		attrs.Size = *op.Size
+	}
+
+	if op.Mode != nil {
+		attrs.Mode = *op.Mode
+	}
+
+	if op.Atime != nil {
+		attrs.Atime = *op.Atime
+	}
+
+	if op.Mtime != nil {
+		attrs.Mtime = *op.Mtime
+	}
+
+	if op.Ctime != nil {
+		attrs.Ctime = *op.Ctime
+	}
+
+	op.Attributes = *attrs
+
+	return nil
+}
+
+func (fs *dryRunFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return fs.discard(op)
+}
+
+func (fs *dryRunFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return fs.discard(op)
+}
+
+func (fs *dryRunFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return fs.discard(op)
+}
+
+func (fs *dryRunFileSystem) SetInodeFlags(
+	ctx context.Context,
+	op *fuseops.SetInodeFlagsOp) error {
+	return fs.discard(op)
+}
+
+func (fs *dryRunFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.discard(op)
+}
+
+func (fs *dryRunFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.discard(op)
+}
+
+func (fs *dryRunFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return fs.discard(op)
+}
+
+// Create a file system that serves all ops from the primary file system, and
+// additionally sends them to the shadow file system in order to validate it
+// against the primary under a real workload, for example before migrating to
+// a new backend. Only the primary's results are ever returned to the kernel.
+//
+// Mutations are mirrored synchronously as with NewMirroringFileSystem, so that
+// the two file systems stay comparable. Lookups, attribute reads, file reads,
+// symlink reads and extended attribute reads are repeated against the shadow,
+// and onMismatch is called with the primary's op whenever the shadow's result
+// differs, or when a mirrored mutation fails. Timestamps and directory
+// listings are not compared, since they are rarely preserved by a migration
+// and offsets within a directory are specific to each backend.
+func NewReadShadowFileSystem(
+	primary FileSystem,
+	shadow FileSystem,
+	onMismatch func(op interface{}, err error)) FileSystem {
+	report := func(op interface{}, err error) {
+		if onMismatch != nil {
+			onMismatch(op, err)
+		}
+	}
+
+	m := NewMirroringFileSystem(
+		primary,
+		shadow,
+		MirrorConfig{OnDivergence: report}).(*mirroringFileSystem)
+
+	fs := &readShadowFileSystem{
+		mirroringFileSystem: m,
+		report:              report,
+	}
+
+	m.mirrorReads = true
+	m.compareAttrs = fs.compareAttrs
+
+	return fs
+}
+
+type readShadowFileSystem struct {
+	*mirroringFileSystem
+	report func(op interface{}, err error)
+}
+
+func (fs *readShadowFileSystem) compareAttrs(
+	op interface{},
+	p, s fuseops.InodeAttributes) {
+	switch {
+	case p.Size != s.Size:
+		fs.report(op, fmt.Errorf("size: %d vs. %d", p.Size, s.Size))
+
+	case p.Nlink != s.Nlink:
+		fs.report(op, fmt.Errorf("nlink: %d vs. %d", p.Nlink, s.Nlink))
+
+	case p.Mode != s.Mode:
+		fs.report(op, fmt.Errorf("mode: %v vs. %v", p.Mode, s.Mode))
+
+	case p.Uid != s.Uid || p.Gid != s.Gid:
+		fs.report(
+			op,
+			fmt.Errorf("owner: %d:%d vs. %d:%d", p.Uid, p.Gid, s.Uid, s.Gid))
+	}
+}
+
+// Report a mismatch if exactly one of the primary and shadow failed, or they
+// failed differently. Return true if both succeeded.
+func (fs *readShadowFileSystem) compareErrors(
+	op interface{},
+	p, s error) bool {
+	if p != s {
+		fs.report(op, fmt.Errorf("error: %v vs. %v", p, s))
+		return false
+	}
+
+	return p == nil
+}
+
+func (fs *readShadowFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	err := fs.FileSystem.GetInodeAttributes(ctx, op)
+
+	sid, serr := fs.secondaryInode(op.Inode)
+	if serr != nil {
+		fs.report(op, serr)
+		return err
+	}
+
+	sop := &fuseops.GetInodeAttributesOp{
+		Inode:     sid,
+		OpContext: op.OpContext,
+	}
+
+	serr = fs.secondary.GetInodeAttributes(ctx, sop)
+	if fs.compareErrors(op, err, serr) {
+		fs.compareAttrs(op, op.Attributes, sop.Attributes)
+	}
+
+	return err
+}
+
+// Return the bytes produced by a read op, whether it filled in Dst or Data.
+func readResult(dst []byte, data [][]byte, n int) []byte {
+	if data == nil {
+		return dst[:n]
+	}
+
+	var b []byte
+	for _, d := range data {
+		b = append(b, d...)
+	}
+
+	if len(b) > n {
+		b = b[:n]
+	}
+
+	return b
+}
+
+func (fs *readShadowFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	err := fs.FileSystem.ReadFile(ctx, op)
+
+	sid, sh, serr := fs.secondaryInodeAndHandle(op.Inode, op.Handle)
+	if serr != nil {
+		fs.report(op, serr)
+		return err
+	}
+
+	sop := &fuseops.ReadFileOp{
+		Inode:     sid,
+		Handle:    sh,
+		Offset:    op.Offset,
+		Size:      op.Size,
+		OpContext: op.OpContext,
+	}
+
+	// Always give the shadow a buffer, even for vectored reads; it is free to
+	// ignore it.
+	if op.Dst != nil {
+		sop.Dst = make([]byte, len(op.Dst))
+	} else {
+		sop.Dst = make([]byte, op.Size)
+	}
+
+	serr = fs.secondary.ReadFile(ctx, sop)
+	if !fs.compareErrors(op, err, serr) {
+		return err
+	}
+
+	p := readResult(op.Dst, op.Data, op.BytesRead)
+
+	sDst := sop.Dst
+	if sop.Data != nil {
+		sDst = nil
+	}
+
+	s := readResult(sDst, sop.Data, sop.BytesRead)
+
+	if !bytes.Equal(p, s) {
+		fs.report(
+			op,
+			fmt.Errorf(
+				"data at offset %d: %d bytes differ from %d bytes",
+				op.Offset,
+				len(p),
+				len(s)))
+	}
+
+	return err
+}
+
+func (fs *readShadowFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	err := fs.FileSystem.ReadSymlink(ctx, op)
+
+	sid, serr := fs.secondaryInode(op.Inode)
+	if serr != nil {
+		fs.report(op, serr)
+		return err
+	}
+
+	sop := &fuseops.ReadSymlinkOp{
+		Inode:     sid,
+		OpContext: op.OpContext,
+	}
+
+	serr = fs.secondary.ReadSymlink(ctx, sop)
+	if fs.compareErrors(op, err, serr) && op.Target != sop.Target {
+		fs.report(op, fmt.Errorf("target: %q vs. %q", op.Target, sop.Target))
+	}
+
+	return err
+}
+
+// Compare the results of two GetXattr or ListXattr ops. An empty destination
+// buffer means that only the size was asked for, as does a count larger than
+// the buffer, which a file system may return instead of ERANGE for the
+// kernel's size probes. For ListXattr, the order of the NUL-terminated names
+// is not significant.
+func xattrResultsEqual(
+	pDst []byte,
+	pn int,
+	sDst []byte,
+	sn int,
+	names bool) bool {
+	if pn != sn {
+		return false
+	}
+
+	if len(pDst) == 0 || pn > len(pDst) || sn > len(sDst) {
+		return true
+	}
+
+	p, s := pDst[:pn], sDst[:sn]
+	if !names {
+		return bytes.Equal(p, s)
+	}
+
+	pNames := bytes.Split(p, []byte{0})
+	sNames := bytes.Split(s, []byte{0})
+	sort.Slice(pNames, func(i, j int) bool { return bytes.Compare(pNames[i], pNames[j]) < 0 })
+	sort.Slice(sNames, func(i, j int) bool { return bytes.Compare(sNames[i], sNames[j]) < 0 })
+
+	return bytes.Equal(bytes.Join(pNames, []byte{0}), bytes.Join(sNames, []byte{0}))
+}
+
+func (fs *readShadowFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	err := fs.FileSystem.GetXattr(ctx, op)
+
+	sid, serr := fs.secondaryInode(op.Inode)
+	if serr != nil {
+		fs.report(op, serr)
+		return err
+	}
+
+	sop := &fuseops.GetXattrOp{
+		Inode:     sid,
+		Name:      op.Name,
+		Dst:       make([]byte, len(op.Dst)),
+		OpContext: op.OpContext,
+	}
+
+	serr = fs.secondary.GetXattr(ctx, sop)
+	if fs.compareErrors(op, err, serr) &&
+		!xattrResultsEqual(op.Dst, op.BytesRead, sop.Dst, sop.BytesRead, false) {
+		fs.report(op, fmt.Errorf("value of %q differs", op.Name))
+	}
+
+	return err
+}
+
+func (fs *readShadowFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	err := fs.FileSystem.ListXattr(ctx, op)
+
+	sid, serr := fs.secondaryInode(op.Inode)
+	if serr != nil {
+		fs.report(op, serr)
+		return err
+	}
+
+	sop := &fuseops.ListXattrOp{
+		Inode:     sid,
+		Dst:       make([]byte, len(op.Dst)),
+		OpContext: op.OpContext,
+	}
+
+	serr = fs.secondary.ListXattr(ctx, sop)
+	if fs.compareErrors(op, err, serr) &&
+		!xattrResultsEqual(op.Dst, op.BytesRead, sop.Dst, sop.BytesRead, true) {
+		fs.report(op, fmt.Errorf("xattr names differ"))
+	}
+
+	return err
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system whose every inode has a single extended attribute "user.x".
+// Without room for the value, the size is reported without an error,
+// as file systems may for the kernel's size probes.
+type xattrValueFS struct {
+	fuseutil.NotImplementedFileSystem
+	value string
+}
+
+func (fs *xattrValueFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	op.BytesRead = len(fs.value)
+	if len(op.Dst) >= len(fs.value) {
+		copy(op.Dst, fs.value)
+	}
+
+	return nil
+}
+
+func (fs *xattrValueFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	op.BytesRead = copy(op.Dst, "user.x\x00")
+	return nil
+}
+
+// Shadow the primary with the shadow file system, returning a function
+// reading their attribute with a buffer of the given size and the list of
+// mismatches reported.
+func shadowXattrs(
+	t *testing.T,
+	primary, shadow fuseutil.FileSystem) (
+	fs fuseutil.FileSystem,
+	getXattr func(size int) *fuseops.GetXattrOp,
+	mismatches *[]string) {
+	mismatches = new([]string)
+	fs = fuseutil.NewReadShadowFileSystem(
+		primary,
+		shadow,
+		func(op interface{}, err error) {
+			*mismatches = append(*mismatches, err.Error())
+		})
+
+	getXattr = func(size int) *fuseops.GetXattrOp {
+		op := &fuseops.GetXattrOp{
+			Inode: fuseops.RootInodeID,
+			Name:  "user.x",
+			Dst:   make([]byte, size),
+		}
+
+		if err := fs.GetXattr(context.Background(), op); err != nil {
+			t.Fatalf("GetXattr: %v", err)
+		}
+
+		return op
+	}
+
+	return fs, getXattr, mismatches
+}
+
+func TestReadShadowFileSystem(t *testing.T) {
+	ctx := context.Background()
+	shadow := &xattrValueFS{value: "taco"}
+	fs, getXattr, mismatches := shadowXattrs(t, &xattrValueFS{value: "taco"}, shadow)
+
+	// Identical results are not reported.
+	getXattr(16)
+	getXattr(0)
+	if err := fs.ListXattr(ctx, &fuseops.ListXattrOp{
+		Inode: fuseops.RootInodeID,
+		Dst:   make([]byte, 16),
+	}); err != nil {
+		t.Fatalf("ListXattr: %v", err)
+	}
+
+	if len(*mismatches) != 0 {
+		t.Fatalf("Unexpected mismatches: %v", *mismatches)
+	}
+
+	// Differing values are, while the primary's is returned.
+	shadow.value = "tofu"
+	if op := getXattr(16); string(op.Dst[:op.BytesRead]) != "taco" {
+		t.Errorf("Value: %q", op.Dst[:op.BytesRead])
+	}
+
+	if len(*mismatches) != 1 || !strings.Contains((*mismatches)[0], `value of "user.x" differs`) {
+		t.Errorf("Mismatches: %v", *mismatches)
+	}
+}
+
+func TestReadShadowFileSystemSizeProbes(t *testing.T) {
+	shadow := &xattrValueFS{value: "tofu"}
+	_, getXattr, mismatches := shadowXattrs(t, &xattrValueFS{value: "taco"}, shadow)
+
+	// Results that don't fit in the buffer only have their sizes compared.
+	if op := getXattr(2); op.BytesRead != 4 {
+		t.Errorf("BytesRead: %d", op.BytesRead)
+	}
+
+	if len(*mismatches) != 0 {
+		t.Errorf("Mismatches for equal sizes: %v", *mismatches)
+	}
+
+	shadow.value = "burrito"
+	getXattr(2)
+	if len(*mismatches) != 1 || !strings.Contains((*mismatches)[0], "differs") {
+		t.Errorf("Mismatches for differing sizes: %v", *mismatches)
+	}
+}
+
+// A read-only backend with a single file of size 4, refusing to be opened for
+// writing.
+type readOnlyBackend struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *readOnlyBackend) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fuseops.InodeAttributes{Size: 4, Mode: 0644}
+	return nil
+}
+
+func (fs *readOnlyBackend) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if !op.OpenFlags.IsReadOnly() || op.OpenFlags&fusekernel.OpenTruncate != 0 {
+		return syscall.EROFS
+	}
+
+	op.Handle = 17
+	return nil
+}
+
+func TestDryRun(t *testing.T) {
+	var logged []string
+	fs := fuseutil.NewDryRunFileSystem(
+		&readOnlyBackend{},
+		func(op interface{}) {
+			logged = append(logged, fmt.Sprintf("%T", op))
+		})
+
+	ctx := context.Background()
+
+	openOp := &fuseops.OpenFileOp{
+		Inode:     2,
+		OpenFlags: fusekernel.OpenReadWrite | fusekernel.OpenTruncate,
+	}
+
+	if err := fs.OpenFile(ctx, openOp); err != nil || openOp.Handle != 17 {
+		t.Fatalf("OpenFile: %v, handle %v", err, openOp.Handle)
+	}
+
+	if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 2, Handle: 17, Data: []byte("taco")}); err != nil {
+		t.Errorf("WriteFile: %v", err)
+	}
+
+	size := uint64(100)
+	setOp := &fuseops.SetInodeAttributesOp{Inode: 2, Size: &size}
+	if err := fs.SetInodeAttributes(ctx, setOp); err != nil || setOp.Attributes.Size != 100 || setOp.Attributes.Mode != 0644 {
+		t.Errorf("SetInodeAttributes: %v, %+v", err, setOp.Attributes)
+	}
+
+	if err := fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: 1, Name: "x"}); err != syscall.EROFS {
+		t.Errorf("CreateFile: %v", err)
+	}
+
+	want := []string{
+		"*fuseops.OpenFileOp",
+		"*fuseops.WriteFileOp",
+		"*fuseops.SetInodeAttributesOp",
+		"*fuseops.CreateFileOp",
+	}
+
+	if strings.Join(logged, ",") != strings.Join(want, ",") {
+		t.Errorf("Logged %v, want %v", logged, want)
+	}
+}
@@ -0,0 +1,1140 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A function that chooses the shard, in [0, n) for n shards, holding the
+// entry with the given name in the root directory and everything beneath it.
+type ShardFunc func(name string) int
+
+// Return a ShardFunc that distributes names over n shards by consistent
+// hashing, with the given number of points per shard on the hash ring. When
+// shards are added to the end of the list, only about 1/n of the names move.
+func ConsistentHashShards(n int, replicas int) ShardFunc {
+	if replicas <= 0 {
+		replicas = 1
+	}
+
+	type point struct {
+		hash  uint64
+		shard int
+	}
+
+	// FNV alone clusters similar keys such as "0-1" and "0-2" on the ring, so
+	// finish with the splitmix64 mixer.
+	hash := func(s string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(s))
+		x := h.Sum64()
+		x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+		x = (x ^ x>>27) * 0x94d049bb133111eb
+		return x ^ x>>31
+	}
+
+	var ring []point
+	for i := 0; i < n; i++ {
+		for r := 0; r < replicas; r++ {
+			ring = append(ring, point{hash(fmt.Sprintf("%d-%d", i, r)), i})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	return func(name string) int {
+		h := hash(name)
+		i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+		if i == len(ring) {
+			i = 0
+		}
+
+		return ring[i].shard
+	}
+}
+
+// The maximum number of shards supported by NewShardedFileSystem.
+const MaxShards = 127
+
+// Inode and handle IDs minted by a shard are tagged with the shard's index
+// plus one in the bits starting here. The top bit remains free for
+// NewControlFileSystem.
+const shardShift = 56
+
+const shardLocalMask = 1<<shardShift - 1
+
+// Create a file system that presents the root directories of the supplied
+// file systems as a single root directory, routing each name within the root
+// (and the whole subtree beneath it) to the shard chosen by the supplied
+// function. This allows metadata-heavy backends to be scaled horizontally.
+//
+// Inode and handle IDs minted by the shards must be less than 1<<56; the
+// router tags them with the shard they came from. Entries that a shard holds
+// in its root directory but that route elsewhere are hidden. Hard links and
+// renames between shards fail with EXDEV. The attributes and extended
+// attributes of the root are those of the first shard's root, except that
+// changes to its attributes are applied to every shard.
+func NewShardedFileSystem(
+	shards []FileSystem,
+	shard ShardFunc) FileSystem {
+	if len(shards) == 0 || len(shards) > MaxShards {
+		panic(fmt.Sprintf("Invalid number of shards: %d", len(shards)))
+	}
+
+	return &shardedFileSystem{
+		shards:      shards,
+		shard:       shard,
+		rootHandles: make(map[fuseops.HandleID][]Dirent),
+		nextHandle:  1,
+	}
+}
+
+type shardedFileSystem struct {
+	shards []FileSystem
+	shard  ShardFunc
+
+	mu sync.Mutex
+
+	// Handles for the merged root directory, with the listing taken at offset
+	// zero.
+	//
+	// GUARDED_BY(mu)
+	rootHandles map[fuseops.HandleID][]Dirent
+
+	// GUARDED_BY(mu)
+	nextHandle fuseops.HandleID
+}
+
+var _ FileSystem = &shardedFileSystem{}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func wrapShardInode(i int, id fuseops.InodeID) fuseops.InodeID {
+	if id == fuseops.RootInodeID {
+		return fuseops.RootInodeID
+	}
+
+	return id | fuseops.InodeID(i+1)<<shardShift
+}
+
+func wrapShardHandle(i int, h fuseops.HandleID) fuseops.HandleID {
+	return h | fuseops.HandleID(i+1)<<shardShift
+}
+
+// Return the shard chosen for a name in the root directory.
+func (fs *shardedFileSystem) shardForName(name string) (int, error) {
+	i := fs.shard(name)
+	if i < 0 || i >= len(fs.shards) {
+		return 0, fuse.EIO
+	}
+
+	return i, nil
+}
+
+// Replace *id, which must not be the root, with the shard-local ID, returning
+// the shard and a function that undoes the replacement.
+func (fs *shardedFileSystem) localInode(
+	id *fuseops.InodeID) (i int, restore func(), err error) {
+	orig := *id
+	i = int(orig>>shardShift) - 1
+	if i < 0 || i >= len(fs.shards) {
+		return 0, nil, fuse.EINVAL
+	}
+
+	*id = orig & shardLocalMask
+	return i, func() { *id = orig }, nil
+}
+
+// Like localInode, but for a directory that may be the root, in which case
+// the name within it determines the shard.
+func (fs *shardedFileSystem) localParent(
+	parent *fuseops.InodeID,
+	name string) (i int, restore func(), err error) {
+	if *parent == fuseops.RootInodeID {
+		i, err = fs.shardForName(name)
+		return i, func() {}, err
+	}
+
+	return fs.localInode(parent)
+}
+
+// Replace *h with the local handle for shard i, returning a function that
+// undoes the replacement.
+func (fs *shardedFileSystem) localHandle(
+	i int,
+	h *fuseops.HandleID) (restore func(), err error) {
+	orig := *h
+	if int(orig>>shardShift)-1 != i {
+		return nil, fuse.EINVAL
+	}
+
+	*h = orig & shardLocalMask
+	return func() { *h = orig }, nil
+}
+
+// Like localInode, for an op that also carries a handle for the inode.
+func (fs *shardedFileSystem) localInodeAndHandle(
+	id *fuseops.InodeID,
+	h *fuseops.HandleID) (i int, restore func(), err error) {
+	i, restoreInode, err := fs.localInode(id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	restoreHandle, err := fs.localHandle(i, h)
+	if err != nil {
+		restoreInode()
+		return 0, nil, err
+	}
+
+	return i, func() { restoreInode(); restoreHandle() }, nil
+}
+
+func (fs *shardedFileSystem) wrapEntry(i int, e *fuseops.ChildInodeEntry) {
+	e.Child = wrapShardInode(i, e.Child)
+}
+
+// Read the complete listing of shard i's root directory, omitting entries
+// that route to other shards.
+func (fs *shardedFileSystem) listShardRoot(
+	ctx context.Context,
+	i int,
+	opCtx fuseops.OpContext) ([]Dirent, error) {
+	s := fs.shards[i]
+
+	openOp := &fuseops.OpenDirOp{
+		Inode:     fuseops.RootInodeID,
+		OpContext: opCtx,
+	}
+
+	if err := s.OpenDir(ctx, openOp); err != nil {
+		return nil, err
+	}
+
+	defer s.ReleaseDirHandle(ctx, &fuseops.ReleaseDirHandleOp{
+		Handle:    openOp.Handle,
+		OpContext: opCtx,
+	})
+
+	var entries []Dirent
+	buf := make([]byte, 64<<10)
+	var offset fuseops.DirOffset
+	for {
+		readOp := &fuseops.ReadDirOp{
+			Inode:     fuseops.RootInodeID,
+			Handle:    openOp.Handle,
+			Offset:    offset,
+			Dst:       buf,
+			OpContext: opCtx,
+		}
+
+		if err := s.ReadDir(ctx, readOp); err != nil {
+			return nil, err
+		}
+
+		if readOp.BytesRead == 0 {
+			return entries, nil
+		}
+
+		for b := buf[:readOp.BytesRead]; len(b) > 0; {
+			d, n := ReadDirent(b)
+			if n == 0 {
+				break
+			}
+
+			b = b[n:]
+			offset = d.Offset
+
+			if d.Name == "." || d.Name == ".." {
+				continue
+			}
+
+			if j, err := fs.shardForName(d.Name); err != nil || j != i {
+				continue
+			}
+
+			d.Inode = wrapShardInode(i, d.Inode)
+			entries = append(entries, d)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *shardedFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	// Report the totals, in units of the first shard's block size.
+	var total fuseops.StatFSOp
+	for i, s := range fs.shards {
+		sop := &fuseops.StatFSOp{}
+		if err := s.StatFS(ctx, sop); err != nil {
+			return err
+		}
+
+		if i == 0 {
+			total.BlockSize = sop.BlockSize
+			total.IoSize = sop.IoSize
+		}
+
+		scale := func(n uint64) uint64 {
+			if total.BlockSize == 0 || sop.BlockSize == total.BlockSize {
+				return n
+			}
+
+			return n * uint64(sop.BlockSize) / uint64(total.BlockSize)
+		}
+
+		total.Blocks += scale(sop.Blocks)
+		total.BlocksFree += scale(sop.BlocksFree)
+		total.BlocksAvailable += scale(sop.BlocksAvailable)
+		total.Inodes += sop.Inodes
+		total.InodesFree += sop.InodesFree
+	}
+
+	*op = total
+	return nil
+}
+
+func (fs *shardedFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	i, restore, err := fs.localParent(&op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	if err := fs.shards[i].LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.wrapEntry(i, &op.Entry)
+	return nil
+}
+
+func (fs *shardedFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if op.Inode == fuseops.RootInodeID {
+		return fs.shards[0].GetInodeAttributes(ctx, op)
+	}
+
+	i, restore, err := fs.localInode(&op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].GetInodeAttributes(ctx, op)
+}
+
+func (fs *shardedFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if op.Inode == fuseops.RootInodeID {
+		// Any handle refers to the merged root directory, which no shard knows.
+		handle := op.Handle
+		op.Handle = nil
+		defer func() { op.Handle = handle }()
+
+		var firstErr error
+		for _, s := range fs.shards {
+			if err := s.SetInodeAttributes(ctx, op); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		return firstErr
+	}
+
+	i, restore, err := fs.localInode(&op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	if op.Handle != nil {
+		restoreHandle, err := fs.localHandle(i, op.Handle)
+		if err != nil {
+			return err
+		}
+		defer restoreHandle()
+	}
+
+	return fs.shards[i].SetInodeAttributes(ctx, op)
+}
+
+func (fs *shardedFileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	i, restore, err := fs.shardForInode(&op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].Access(ctx, op)
+}
+
+func (fs *shardedFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	if op.Inode == fuseops.RootInodeID {
+		return nil
+	}
+
+	i, restore, err := fs.localInode(&op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].ForgetInode(ctx, op)
+}
+
+func (fs *shardedFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	byShard := make([][]fuseops.BatchForgetEntry, len(fs.shards))
+	for _, e := range op.Entries {
+		if e.Inode == fuseops.RootInodeID {
+			continue
+		}
+
+		i := int(e.Inode>>shardShift) - 1
+		if i < 0 || i >= len(fs.shards) {
+			continue
+		}
+
+		e.Inode &= shardLocalMask
+		byShard[i] = append(byShard[i], e)
+	}
+
+	var firstErr error
+	for i, entries := range byShard {
+		if len(entries) == 0 {
+			continue
+		}
+
+		err := fs.shards[i].BatchForget(ctx, &fuseops.BatchForgetOp{
+			Entries:   entries,
+			OpContext: op.OpContext,
+		})
+
+		if err == fuse.ENOSYS {
+			err = nil
+			for _, e := range entries {
+				ferr := fs.shards[i].ForgetInode(ctx, &fuseops.ForgetInodeOp{
+					Inode:     e.Inode,
+					N:         e.N,
+					OpContext: op.OpContext,
+				})
+
+				if ferr != nil && err == nil {
+					err = ferr
+				}
+			}
+		}
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (fs *shardedFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	i, restore, err := fs.localParent(&op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	if err := fs.shards[i].MkDir(ctx, op); err != nil {
+		return err
+	}
+
+	fs.wrapEntry(i, &op.Entry)
+	return nil
+}
+
+func (fs *shardedFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	i, restore, err := fs.localParent(&op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	if err := fs.shards[i].MkNode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.wrapEntry(i, &op.Entry)
+	return nil
+}
+
+func (fs *shardedFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	i, restore, err := fs.localParent(&op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	if err := fs.shards[i].CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.wrapEntry(i, &op.Entry)
+	op.Handle = wrapShardHandle(i, op.Handle)
+	return nil
+}
+
+func (fs *shardedFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	i, restore, err := fs.localParent(&op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	j, restoreTarget, err := fs.localInode(&op.Target)
+	if err != nil {
+		return err
+	}
+	defer restoreTarget()
+
+	if i != j {
+		return syscall.EXDEV
+	}
+
+	if err := fs.shards[i].CreateLink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.wrapEntry(i, &op.Entry)
+	return nil
+}
+
+func (fs *shardedFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	i, restore, err := fs.localParent(&op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	if err := fs.shards[i].CreateSymlink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.wrapEntry(i, &op.Entry)
+	return nil
+}
+
+func (fs *shardedFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	i, restoreOld, err := fs.localParent(&op.OldParent, op.OldName)
+	if err != nil {
+		return err
+	}
+	defer restoreOld()
+
+	j, restoreNew, err := fs.localParent(&op.NewParent, op.NewName)
+	if err != nil {
+		return err
+	}
+	defer restoreNew()
+
+	if i != j {
+		return syscall.EXDEV
+	}
+
+	return fs.shards[i].Rename(ctx, op)
+}
+
+func (fs *shardedFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	i, restore, err := fs.localParent(&op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].RmDir(ctx, op)
+}
+
+func (fs *shardedFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	i, restore, err := fs.localParent(&op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].Unlink(ctx, op)
+}
+
+func (fs *shardedFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	if op.Inode == fuseops.RootInodeID {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+
+		op.Handle = fs.nextHandle
+		fs.nextHandle++
+		fs.rootHandles[op.Handle] = nil
+		return nil
+	}
+
+	i, restore, err := fs.localInode(&op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	if err := fs.shards[i].OpenDir(ctx, op); err != nil {
+		return err
+	}
+
+	op.Handle = wrapShardHandle(i, op.Handle)
+	return nil
+}
+
+// Return the entries of the merged root directory from the given offset on.
+func (fs *shardedFileSystem) rootEntries(
+	ctx context.Context,
+	handle fuseops.HandleID,
+	offset fuseops.DirOffset,
+	opContext fuseops.OpContext) ([]Dirent, error) {
+	fs.mu.Lock()
+	entries, ok := fs.rootHandles[handle]
+	fs.mu.Unlock()
+
+	if !ok {
+		return nil, fuse.EINVAL
+	}
+
+	// Take a fresh listing when reading from the start, as memfs does.
+	if offset == 0 || entries == nil {
+		entries = []Dirent{}
+		for i := range fs.shards {
+			shardEntries, err := fs.listShardRoot(ctx, i, opContext)
+			if err != nil {
+				return nil, err
+			}
+
+			entries = append(entries, shardEntries...)
+		}
+
+		for j := range entries {
+			entries[j].Offset = fuseops.DirOffset(j + 1)
+		}
+
+		fs.mu.Lock()
+		fs.rootHandles[handle] = entries
+		fs.mu.Unlock()
+	}
+
+	if offset > fuseops.DirOffset(len(entries)) {
+		return nil, nil
+	}
+
+	return entries[offset:], nil
+}
+
+func (fs *shardedFileSystem) readRootDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	entries, err := fs.rootEntries(ctx, op.Handle, op.Offset, op.OpContext)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range entries {
+		n := WriteDirent(op.Dst[op.BytesRead:], d)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *shardedFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if op.Inode == fuseops.RootInodeID {
+		return fs.readRootDir(ctx, op)
+	}
+
+	i, restore, err := fs.localInodeAndHandle(&op.Inode, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	if err := fs.shards[i].ReadDir(ctx, op); err != nil {
+		return err
+	}
+
+	// Tag the inode of each entry in place; the lengths don't change.
+	for b := op.Dst[:op.BytesRead]; len(b) > 0; {
+		d, n := ReadDirent(b)
+		if n == 0 {
+			break
+		}
+
+		d.Inode = wrapShardInode(i, d.Inode)
+		WriteDirent(b, d)
+		b = b[n:]
+	}
+
+	return nil
+}
+
+func (fs *shardedFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	// The merged root directory is listed without attributes, leaving the
+	// kernel to look its entries up as usual.
+	if op.Inode == fuseops.RootInodeID {
+		entries, err := fs.rootEntries(ctx, op.Handle, op.Offset, op.OpContext)
+		if err != nil {
+			return err
+		}
+
+		for _, d := range entries {
+			n := WriteDirentPlus(op.Dst[op.BytesRead:], DirentPlus{Dirent: d})
+			if n == 0 {
+				break
+			}
+
+			op.BytesRead += n
+		}
+
+		return nil
+	}
+
+	i, restore, err := fs.localInodeAndHandle(&op.Inode, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	if err := fs.shards[i].ReadDirPlus(ctx, op); err != nil {
+		return err
+	}
+
+	// Tag the inodes of each entry and its attributes in place.
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	for b := op.Dst[:op.BytesRead]; len(b) > entrySize; {
+		d, n := ReadDirent(b[entrySize:])
+		if n == 0 {
+			break
+		}
+
+		// Inode numbers other than the inode's ID were chosen by the shard,
+		// for the entry as for the attributes.
+		e := (*fusekernel.EntryOut)(unsafe.Pointer(&b[0]))
+		presented := e.Nodeid != 0 && e.Attr.Ino != e.Nodeid
+		if e.Nodeid != 0 {
+			e.Nodeid = uint64(wrapShardInode(i, fuseops.InodeID(e.Nodeid)))
+			if !presented {
+				e.Attr.Ino = e.Nodeid
+			}
+		}
+
+		if !presented {
+			d.Inode = wrapShardInode(i, d.Inode)
+		}
+		WriteDirent(b[entrySize:], d)
+		b = b[entrySize+n:]
+	}
+
+	return nil
+}
+
+func (fs *shardedFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	if op.Handle>>shardShift == 0 {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+
+		delete(fs.rootHandles, op.Handle)
+		return nil
+	}
+
+	i := int(op.Handle>>shardShift) - 1
+	if i >= len(fs.shards) {
+		return fuse.EINVAL
+	}
+
+	restore, err := fs.localHandle(i, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].ReleaseDirHandle(ctx, op)
+}
+
+func (fs *shardedFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	i, restore, err := fs.localInode(&op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	if err := fs.shards[i].OpenFile(ctx, op); err != nil {
+		return err
+	}
+
+	op.Handle = wrapShardHandle(i, op.Handle)
+	return nil
+}
+
+func (fs *shardedFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	i, restore, err := fs.localInodeAndHandle(&op.Inode, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].ReadFile(ctx, op)
+}
+
+func (fs *shardedFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	i, restore, err := fs.localInodeAndHandle(&op.Inode, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].WriteFile(ctx, op)
+}
+
+func (fs *shardedFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	if op.Inode == fuseops.RootInodeID {
+		return nil
+	}
+
+	i, restore, err := fs.localInodeAndHandle(&op.Inode, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].SyncFile(ctx, op)
+}
+
+func (fs *shardedFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	i, restore, err := fs.localInodeAndHandle(&op.Inode, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].FlushFile(ctx, op)
+}
+
+func (fs *shardedFileSystem) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	// Sync every shard, failing with ENOSYS only if none of them can.
+	var err error = fuse.ENOSYS
+	for _, s := range fs.shards {
+		switch serr := s.SyncFS(ctx, &fuseops.SyncFSOp{OpContext: op.OpContext}); {
+		case serr == fuse.ENOSYS:
+		case serr != nil:
+			return serr
+		default:
+			err = nil
+		}
+	}
+
+	return err
+}
+
+func (fs *shardedFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	i := int(op.Handle>>shardShift) - 1
+	if i < 0 || i >= len(fs.shards) {
+		return fuse.EINVAL
+	}
+
+	restore, err := fs.localHandle(i, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].ReleaseFileHandle(ctx, op)
+}
+
+func (fs *shardedFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	i, restore, err := fs.localInode(&op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].ReadSymlink(ctx, op)
+}
+
+// Choose the shard for an op on the given inode, which may be the root.
+func (fs *shardedFileSystem) shardForInode(
+	id *fuseops.InodeID) (i int, restore func(), err error) {
+	if *id == fuseops.RootInodeID {
+		return 0, func() {}, nil
+	}
+
+	return fs.localInode(id)
+}
+
+func (fs *shardedFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	i, restore, err := fs.shardForInode(&op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].RemoveXattr(ctx, op)
+}
+
+func (fs *shardedFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	i, restore, err := fs.shardForInode(&op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].GetXattr(ctx, op)
+}
+
+func (fs *shardedFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	i, restore, err := fs.shardForInode(&op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].ListXattr(ctx, op)
+}
+
+func (fs *shardedFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	i, restore, err := fs.shardForInode(&op.Inode)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].SetXattr(ctx, op)
+}
+
+func (fs *shardedFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	i, restore, err := fs.localInodeAndHandle(&op.Inode, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].Fallocate(ctx, op)
+}
+
+func (fs *shardedFileSystem) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	i, restore, err := fs.localInodeAndHandle(&op.Inode, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].Lseek(ctx, op)
+}
+
+func (fs *shardedFileSystem) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	i, restore, err := fs.localInodeAndHandle(&op.Inode, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].Poll(ctx, op)
+}
+
+func (fs *shardedFileSystem) GetInodeFlags(
+	ctx context.Context,
+	op *fuseops.GetInodeFlagsOp) error {
+	// The root's directory handles are our own; its flags are shard 0's root's.
+	if op.Inode == fuseops.RootInodeID {
+		sop := *op
+		sop.Handle = 0
+		err := fs.shards[0].GetInodeFlags(ctx, &sop)
+		op.Flags = sop.Flags
+		return err
+	}
+
+	i, restore, err := fs.localInodeAndHandle(&op.Inode, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].GetInodeFlags(ctx, op)
+}
+
+func (fs *shardedFileSystem) SetInodeFlags(
+	ctx context.Context,
+	op *fuseops.SetInodeFlagsOp) error {
+	if op.Inode == fuseops.RootInodeID {
+		sop := *op
+		sop.Handle = 0
+		return fs.shards[0].SetInodeFlags(ctx, &sop)
+	}
+
+	i, restore, err := fs.localInodeAndHandle(&op.Inode, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].SetInodeFlags(ctx, op)
+}
+
+func (fs *shardedFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	if op.Inode == fuseops.RootInodeID {
+		sop := *op
+		sop.Handle = 0
+		err := fs.shards[0].Ioctl(ctx, &sop)
+		op.Result = sop.Result
+		op.Output = sop.Output
+		op.RetryIn = sop.RetryIn
+		op.RetryOut = sop.RetryOut
+		return err
+	}
+
+	i, restore, err := fs.localInodeAndHandle(&op.Inode, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].Ioctl(ctx, op)
+}
+
+func (fs *shardedFileSystem) GetLk(
+	ctx context.Context,
+	op *fuseops.GetLkOp) error {
+	// As for GetInodeFlags, the root's locks are shard 0's root's.
+	if op.Inode == fuseops.RootInodeID {
+		sop := *op
+		sop.Handle = 0
+		err := fs.shards[0].GetLk(ctx, &sop)
+		op.Conflict = sop.Conflict
+		return err
+	}
+
+	i, restore, err := fs.localInodeAndHandle(&op.Inode, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].GetLk(ctx, op)
+}
+
+func (fs *shardedFileSystem) SetLk(
+	ctx context.Context,
+	op *fuseops.SetLkOp) error {
+	if op.Inode == fuseops.RootInodeID {
+		sop := *op
+		sop.Handle = 0
+		return fs.shards[0].SetLk(ctx, &sop)
+	}
+
+	i, restore, err := fs.localInodeAndHandle(&op.Inode, &op.Handle)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return fs.shards[i].SetLk(ctx, op)
+}
+
+func (fs *shardedFileSystem) Destroy() {
+	for _, s := range fs.shards {
+		s.Destroy()
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+func TestShardedFileSystem(t *testing.T) {
+	ctx := context.Background()
+	shards := []*lookupRecorder{{}, {}}
+	fs := fuseutil.NewShardedFileSystem(
+		[]fuseutil.FileSystem{shards[0], shards[1]},
+		func(name string) int {
+			if name == "b" {
+				return 1
+			}
+			return 0
+		})
+
+	// Names in the root go to their shard, and the resulting IDs are tagged.
+	op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "b"}
+	if err := fs.LookUpInode(ctx, op); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	b := op.Entry.Child
+	if len(shards[1].parents) != 1 || b == 100 {
+		t.Fatalf("Unexpected routing: %v, child %v", shards[1].parents, b)
+	}
+
+	// Names beneath go to the shard that minted the parent, with its own ID.
+	op = &fuseops.LookUpInodeOp{Parent: b, Name: "a"}
+	if err := fs.LookUpInode(ctx, op); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	if op.Parent != b {
+		t.Errorf("Parent not restored: %v", op.Parent)
+	}
+
+	if len(shards[0].parents) != 0 || len(shards[1].parents) != 2 || shards[1].parents[1] != 100 {
+		t.Errorf("Unexpected routing: %v %v", shards[0].parents, shards[1].parents)
+	}
+
+	// Renames between shards are refused.
+	err := fs.Rename(ctx, &fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "a",
+		NewParent: b,
+		NewName:   "a",
+	})
+
+	if err != syscall.EXDEV {
+		t.Errorf("Expected EXDEV, got %v", err)
+	}
+}
+
+func TestConsistentHashShards(t *testing.T) {
+	before := fuseutil.ConsistentHashShards(4, 64)
+	after := fuseutil.ConsistentHashShards(5, 64)
+
+	const n = 10000
+	var moved int
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("file%d", i)
+		b, a := before(name), after(name)
+		if b < 0 || b >= 4 || a < 0 || a >= 5 {
+			t.Fatalf("Out of range: %d %d", b, a)
+		}
+
+		if a != b {
+			if a != 4 {
+				t.Fatalf("%q moved between old shards: %d -> %d", name, b, a)
+			}
+			moved++
+		}
+	}
+
+	// About a fifth of the names should move to the new shard.
+	if moved < n/10 || moved > n*3/10 {
+		t.Errorf("Moved %d of %d names", moved, n)
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// The prefix of the names under which NewSillyRenamingFileSystem hides files
+// that are unlinked while open.
+const SillyRenamePrefix = ".fuse_hidden"
+
+// Create a file system that keeps files unlinked while open readable and
+// writable through their handles, as POSIX requires, for backends that delete
+// a file's contents as soon as its last name is gone. In the manner of NFS
+// clients and libfuse's hard_remove option, unlinking a file that is open, or
+// renaming over it, renames it to a hidden name starting with
+// SillyRenamePrefix in the same directory instead; the hidden name is
+// unlinked once the last handle on the file is released, or when the file
+// system is destroyed.
+//
+// Hidden names show up in directory listings, and keep the directory from
+// being removed while they exist. Unlinks, renames and releases are
+// serialized with each other.
+func NewSillyRenamingFileSystem(wrapped FileSystem) FileSystem {
+	return &sillyRenamingFileSystem{
+		FileSystem: wrapped,
+		handles:    make(map[fuseops.HandleID]fuseops.InodeID),
+		open:       make(map[fuseops.InodeID]int),
+		hidden:     make(map[fuseops.InodeID][]sillyName),
+	}
+}
+
+type sillyName struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+type sillyRenamingFileSystem struct {
+	FileSystem
+
+	// Held while unlinking, renaming and releasing, so that a file can't be
+	// released between deciding to hide it and hiding it.
+	mu sync.Mutex
+
+	// The inode of each open file handle, and the number of handles open on
+	// each inode.
+	//
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]fuseops.InodeID
+	open    map[fuseops.InodeID]int
+
+	// The hidden names of open inodes that were unlinked.
+	//
+	// GUARDED_BY(mu)
+	hidden map[fuseops.InodeID][]sillyName
+
+	// Used to make hidden names unique.
+	//
+	// GUARDED_BY(mu)
+	nextHidden uint32
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sillyRenamingFileSystem) opened(
+	inode fuseops.InodeID,
+	h fuseops.HandleID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.handles[h] = inode
+	fs.open[inode]++
+}
+
+// Return the inode of the named child, or zero if there is none, without
+// holding on to it.
+func (fs *sillyRenamingFileSystem) lookUpChild(
+	ctx context.Context,
+	opCtx fuseops.OpContext,
+	parent fuseops.InodeID,
+	name string) (fuseops.InodeID, error) {
+	op := &fuseops.LookUpInodeOp{
+		Parent:    parent,
+		Name:      name,
+		OpContext: opCtx,
+	}
+
+	err := fs.FileSystem.LookUpInode(ctx, op)
+	if err == fuse.ENOENT {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	fs.FileSystem.ForgetInode(ctx, &fuseops.ForgetInodeOp{
+		Inode:     op.Entry.Child,
+		N:         1,
+		OpContext: opCtx,
+	})
+
+	return op.Entry.Child, nil
+}
+
+// If the named child is open, rename it to a hidden name and report true.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *sillyRenamingFileSystem) hideIfOpen(
+	ctx context.Context,
+	opCtx fuseops.OpContext,
+	parent fuseops.InodeID,
+	name string) (bool, error) {
+	child, err := fs.lookUpChild(ctx, opCtx, parent, name)
+	if err != nil || child == 0 || fs.open[child] == 0 {
+		return false, err
+	}
+
+	// Find a name that isn't taken, giving up after a few tries as libfuse
+	// does.
+	for i := 0; i < 10; i++ {
+		fs.nextHidden++
+		hidden := fmt.Sprintf("%s%016x%08x", SillyRenamePrefix, child, fs.nextHidden)
+
+		taken, err := fs.lookUpChild(ctx, opCtx, parent, hidden)
+		if err != nil {
+			return false, err
+		}
+
+		if taken != 0 {
+			continue
+		}
+
+		err = fs.FileSystem.Rename(ctx, &fuseops.RenameOp{
+			OldParent: parent,
+			OldName:   name,
+			NewParent: parent,
+			NewName:   hidden,
+			OpContext: opCtx,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		fs.hidden[child] = append(fs.hidden[child], sillyName{parent, hidden})
+		return true, nil
+	}
+
+	return false, syscall.EBUSY
+}
+
+// Unlink the hidden names of an inode that is no longer open.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *sillyRenamingFileSystem) unlinkHidden(
+	ctx context.Context,
+	opCtx fuseops.OpContext,
+	inode fuseops.InodeID) error {
+	var firstErr error
+	for _, n := range fs.hidden[inode] {
+		err := fs.FileSystem.Unlink(ctx, &fuseops.UnlinkOp{
+			Parent:    n.parent,
+			Name:      n.name,
+			OpContext: opCtx,
+		})
+		if err != nil && err != fuse.ENOENT && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	delete(fs.hidden, inode)
+	return firstErr
+}
+
+func (fs *sillyRenamingFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if err := fs.FileSystem.OpenFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.opened(op.Inode, op.Handle)
+	return nil
+}
+
+func (fs *sillyRenamingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := fs.FileSystem.CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.opened(op.Entry.Child, op.Handle)
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sillyRenamingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	hidden, err := fs.hideIfOpen(ctx, op.OpContext, op.Parent, op.Name)
+	if err != nil || hidden {
+		return err
+	}
+
+	return fs.FileSystem.Unlink(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sillyRenamingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Renaming a name onto itself, or onto another name of the same inode,
+	// leaves the inode linked.
+	source, err := fs.lookUpChild(ctx, op.OpContext, op.OldParent, op.OldName)
+	if err != nil {
+		return err
+	}
+
+	target, err := fs.lookUpChild(ctx, op.OpContext, op.NewParent, op.NewName)
+	if err != nil {
+		return err
+	}
+
+	// Nor does exchanging it with the source.
+	if target == 0 || target == source || op.Flags&fuseops.RenameExchange != 0 {
+		return fs.FileSystem.Rename(ctx, op)
+	}
+
+	hidden, err := fs.hideIfOpen(ctx, op.OpContext, op.NewParent, op.NewName)
+	if err != nil {
+		return err
+	}
+
+	err = fs.FileSystem.Rename(ctx, op)
+	if err != nil && hidden {
+		// Put the target back where it was.
+		names := fs.hidden[target]
+		n := names[len(names)-1]
+		fs.FileSystem.Rename(ctx, &fuseops.RenameOp{
+			OldParent: n.parent,
+			OldName:   n.name,
+			NewParent: op.NewParent,
+			NewName:   op.NewName,
+			OpContext: op.OpContext,
+		})
+
+		if len(names) == 1 {
+			delete(fs.hidden, target)
+		} else {
+			fs.hidden[target] = names[:len(names)-1]
+		}
+	}
+
+	return err
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sillyRenamingFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	err := fs.FileSystem.ReleaseFileHandle(ctx, op)
+
+	inode, ok := fs.handles[op.Handle]
+	if !ok {
+		return err
+	}
+
+	delete(fs.handles, op.Handle)
+	fs.open[inode]--
+	if fs.open[inode] != 0 {
+		return err
+	}
+
+	delete(fs.open, inode)
+	if unlinkErr := fs.unlinkHidden(ctx, op.OpContext, inode); err == nil {
+		err = unlinkErr
+	}
+
+	return err
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *sillyRenamingFileSystem) Destroy() {
+	fs.mu.Lock()
+	for inode := range fs.hidden {
+		fs.unlinkHidden(context.Background(), fuseops.OpContext{}, inode)
+	}
+	fs.mu.Unlock()
+
+	fs.FileSystem.Destroy()
+}
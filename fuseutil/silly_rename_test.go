@@ -0,0 +1,230 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A file system with a single directory, which deletes a file as soon as its
+// name is gone, failing reads through handles on it with ESTALE.
+type deletingFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu      sync.Mutex
+	names   map[string]fuseops.InodeID
+	handles map[fuseops.HandleID]fuseops.InodeID
+}
+
+func newDeletingFS(names map[string]fuseops.InodeID) *deletingFS {
+	return &deletingFS{
+		names:   names,
+		handles: make(map[fuseops.HandleID]fuseops.InodeID),
+	}
+}
+
+func (fs *deletingFS) Names() (names []string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for name := range fs.names {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func (fs *deletingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	child, ok := fs.names[op.Name]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = child
+	return nil
+}
+
+func (fs *deletingFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func (fs *deletingFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Handle = fuseops.HandleID(len(fs.handles) + 1)
+	fs.handles[op.Handle] = op.Inode
+	return nil
+}
+
+func (fs *deletingFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, id := range fs.names {
+		if id == fs.handles[op.Handle] {
+			return nil
+		}
+	}
+
+	return syscall.ESTALE
+}
+
+func (fs *deletingFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+func (fs *deletingFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.names[op.Name]; !ok {
+		return fuse.ENOENT
+	}
+
+	delete(fs.names, op.Name)
+	return nil
+}
+
+func (fs *deletingFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	child, ok := fs.names[op.OldName]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	delete(fs.names, op.OldName)
+	fs.names[op.NewName] = child
+	return nil
+}
+
+func TestSillyRenamingFileSystem(t *testing.T) {
+	ctx := context.Background()
+	backend := newDeletingFS(map[string]fuseops.InodeID{"a": 2, "b": 3, "c": 4})
+	fs := fuseutil.NewSillyRenamingFileSystem(backend)
+
+	open := func(inode fuseops.InodeID) fuseops.HandleID {
+		t.Helper()
+		op := &fuseops.OpenFileOp{Inode: inode}
+		if err := fs.OpenFile(ctx, op); err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+
+		return op.Handle
+	}
+
+	read := func(h fuseops.HandleID) error {
+		return fs.ReadFile(ctx, &fuseops.ReadFileOp{Handle: h})
+	}
+
+	release := func(h fuseops.HandleID) {
+		t.Helper()
+		if err := fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: h}); err != nil {
+			t.Fatalf("ReleaseFileHandle: %v", err)
+		}
+	}
+
+	hidden := func() (names []string) {
+		for _, name := range backend.Names() {
+			if strings.HasPrefix(name, fuseutil.SillyRenamePrefix) {
+				names = append(names, name)
+			}
+		}
+
+		return names
+	}
+
+	// Unlinking an open file hides it until it is released.
+	h1 := open(2)
+	h2 := open(2)
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "a"}); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	if names := hidden(); len(names) != 1 {
+		t.Fatalf("Hidden names after unlinking an open file: %v", names)
+	}
+
+	release(h1)
+	if err := read(h2); err != nil {
+		t.Errorf("Reading an unlinked file: %v", err)
+	}
+
+	release(h2)
+	if names := hidden(); len(names) != 0 {
+		t.Errorf("Hidden names after releasing: %v", names)
+	}
+
+	// Renaming over an open file hides it too.
+	h := open(4)
+	err := fs.Rename(ctx, &fuseops.RenameOp{
+		OldParent: 1,
+		OldName:   "b",
+		NewParent: 1,
+		NewName:   "c",
+	})
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if err := read(h); err != nil {
+		t.Errorf("Reading a file renamed over: %v", err)
+	}
+
+	// Until the file system is destroyed.
+	fs.Destroy()
+	if got, want := backend.Names(), []string{"c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names after destroying: %v, want %v", got, want)
+	}
+
+	// Files that aren't open are unlinked straight away.
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "c"}); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	if names := backend.Names(); len(names) != 0 {
+		t.Errorf("Names after unlinking a closed file: %v", names)
+	}
+}
@@ -0,0 +1,504 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// A file of a tree served by NewStaticFileSystem. Exactly one of Data,
+// ReaderAt and Generate must be set.
+type StaticFile struct {
+	// Fixed content.
+	Data []byte
+
+	// Content read on demand, e.g. from a file outside the mount, of the given
+	// size.
+	ReaderAt io.ReaderAt
+	Size     int64
+
+	// Called each time the file is opened, to generate the content that is
+	// seen through the resulting file handle, e.g. for a metrics endpoint. As
+	// with ControlFile, such files have a size of zero and are read with direct
+	// IO.
+	Generate func(ctx context.Context, opCtx fuseops.OpContext) ([]byte, error)
+
+	// The permission bits and ownership of the file. Mode defaults to 0444.
+	Mode os.FileMode
+	Uid  uint32
+	Gid  uint32
+
+	// The file's times. Defaults to when the file system was created.
+	Mtime time.Time
+}
+
+// Create a read-only file system serving a fixed tree of files, given by their
+// slash-separated paths relative to the root. Directories are created for
+// every path's parents, and are owned by root with mode 0555. An error is
+// returned if a path is invalid, or is both a file and the parent of another.
+//
+// Inode and handle IDs are managed by the file system, which keeps every
+// inode for as long as it exists. Ops that would modify it fail with EROFS, as
+// for NewReadOnlyFileSystem.
+func NewStaticFileSystem(files map[string]StaticFile) (FileSystem, error) {
+	fs := &staticFileSystem{
+		inodes:  []*staticInode{nil, nil},
+		handles: make(map[fuseops.HandleID][]byte),
+	}
+
+	now := time.Now()
+	root := &staticInode{
+		attrs:    staticDirAttributes(now),
+		children: make(map[string]fuseops.InodeID),
+	}
+	fs.inodes[fuseops.RootInodeID] = root
+
+	// Add files in order, so that inode IDs don't depend on map iteration.
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		f := files[p]
+		if err := fs.add(p, &f, now); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, in := range fs.inodes[fuseops.RootInodeID:] {
+		in.sortEntries()
+	}
+
+	return NewReadOnlyFileSystem(fs), nil
+}
+
+type staticFileSystem struct {
+	NotImplementedFileSystem
+
+	// Indexed by inode ID. Immutable once the file system has been created.
+	inodes []*staticInode
+
+	mu sync.Mutex
+
+	// The content generated for each handle to a file with StaticFile.Generate.
+	//
+	// GUARDED_BY(mu)
+	handles    map[fuseops.HandleID][]byte
+	nextHandle fuseops.HandleID
+}
+
+type staticInode struct {
+	attrs fuseops.InodeAttributes
+
+	// For files.
+	file *StaticFile
+
+	// For directories, the children by name, and as sorted directory entries.
+	children map[string]fuseops.InodeID
+	entries  []Dirent
+}
+
+func staticDirAttributes(t time.Time) fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Nlink: 2,
+		Mode:  0555 | os.ModeDir,
+		Atime: t,
+		Mtime: t,
+		Ctime: t,
+	}
+}
+
+func (in *staticInode) sortEntries() {
+	if in.children == nil {
+		return
+	}
+
+	in.entries = in.entries[:0]
+	for name, id := range in.children {
+		in.entries = append(in.entries, Dirent{Inode: id, Name: name})
+	}
+
+	sort.Slice(in.entries, func(i, j int) bool {
+		return in.entries[i].Name < in.entries[j].Name
+	})
+
+	for i := range in.entries {
+		in.entries[i].Offset = fuseops.DirOffset(i + 1)
+	}
+}
+
+// Add the file at the supplied path, along with any missing parents.
+func (fs *staticFileSystem) add(p string, f *StaticFile, now time.Time) error {
+	n := 0
+	if f.Data != nil {
+		n++
+	}
+	if f.ReaderAt != nil {
+		n++
+	}
+	if f.Generate != nil {
+		n++
+	}
+
+	if n != 1 {
+		return fmt.Errorf("%q: exactly one of Data, ReaderAt and Generate must be set", p)
+	}
+
+	clean := path.Clean("/" + p)
+	if clean == "/" || clean != "/"+strings.TrimPrefix(p, "/") {
+		return fmt.Errorf("%q: invalid path", p)
+	}
+
+	names := strings.Split(clean[1:], "/")
+	parent := fs.inodes[fuseops.RootInodeID]
+	for i, name := range names {
+		id, ok := parent.children[name]
+		last := i == len(names)-1
+
+		switch {
+		case ok && (last || fs.inodes[id].children == nil):
+			return fmt.Errorf("%q: conflicts with %q", p, strings.Join(names[:i+1], "/"))
+
+		case !ok:
+			in := &staticInode{attrs: staticDirAttributes(now)}
+			if last {
+				in.attrs = staticFileAttributes(f, now)
+				in.file = f
+			} else {
+				in.children = make(map[string]fuseops.InodeID)
+				parent.attrs.Nlink++
+			}
+
+			id = fuseops.InodeID(len(fs.inodes))
+			fs.inodes = append(fs.inodes, in)
+			parent.children[name] = id
+		}
+
+		parent = fs.inodes[id]
+	}
+
+	return nil
+}
+
+func staticFileAttributes(f *StaticFile, now time.Time) fuseops.InodeAttributes {
+	attrs := fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  f.Mode.Perm(),
+		Uid:   f.Uid,
+		Gid:   f.Gid,
+		Atime: f.Mtime,
+		Mtime: f.Mtime,
+		Ctime: f.Mtime,
+	}
+
+	if attrs.Mode == 0 {
+		attrs.Mode = 0444
+	}
+
+	if f.Mtime.IsZero() {
+		attrs.Atime, attrs.Mtime, attrs.Ctime = now, now, now
+	}
+
+	switch {
+	case f.Data != nil:
+		attrs.Size = uint64(len(f.Data))
+	case f.ReaderAt != nil:
+		attrs.Size = uint64(f.Size)
+	}
+
+	return attrs
+}
+
+func (fs *staticFileSystem) inode(id fuseops.InodeID) (*staticInode, error) {
+	if id < fuseops.RootInodeID || id >= fuseops.InodeID(len(fs.inodes)) {
+		return nil, fuse.ENOENT
+	}
+
+	return fs.inodes[id], nil
+}
+
+// Copy the supplied content, from the op's offset, into its response.
+func readContent(op *fuseops.ReadFileOp, content []byte) {
+	if op.Offset >= int64(len(content)) {
+		return
+	}
+
+	data := content[op.Offset:]
+	if op.Dst != nil {
+		op.BytesRead = copy(op.Dst, data)
+		return
+	}
+
+	if int64(len(data)) > op.Size {
+		data = data[:op.Size]
+	}
+
+	op.Data = [][]byte{data}
+	op.BytesRead = len(data)
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *staticFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *staticFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent, err := fs.inode(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	id, ok := parent.children[op.Name]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = id
+	op.Entry.Attributes = fs.inodes[id].attrs
+	return nil
+}
+
+func (fs *staticFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes = in.attrs
+	return nil
+}
+
+func (fs *staticFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func (fs *staticFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	return nil
+}
+
+func (fs *staticFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if in.children == nil {
+		return syscall.ENOTDIR
+	}
+
+	return nil
+}
+
+func (fs *staticFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	for i := int(op.Offset); i < len(in.entries); i++ {
+		d := in.entries[i]
+		if fs.inodes[d.Inode].children != nil {
+			d.Type = DT_Directory
+		} else {
+			d.Type = DT_File
+		}
+
+		n := WriteDirent(op.Dst[op.BytesRead:], d)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *staticFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	for i := int(op.Offset); i < len(in.entries); i++ {
+		d := in.entries[i]
+		child := fs.inodes[d.Inode]
+		if child.children != nil {
+			d.Type = DT_Directory
+		} else {
+			d.Type = DT_File
+		}
+
+		n := WriteDirentPlus(op.Dst[op.BytesRead:], DirentPlus{
+			Dirent: d,
+			Entry: fuseops.ChildInodeEntry{
+				Child:      d.Inode,
+				Attributes: child.attrs,
+			},
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *staticFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *staticFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if in.file == nil {
+		return syscall.EISDIR
+	}
+
+	if in.file.Generate == nil {
+		op.KeepPageCache = true
+		return nil
+	}
+
+	content, err := in.file.Generate(ctx, op.OpContext)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.nextHandle++
+	op.Handle = fs.nextHandle
+	fs.handles[op.Handle] = content
+	op.UseDirectIO = true
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *staticFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	f := in.file
+	if f == nil {
+		return syscall.EISDIR
+	}
+
+	switch {
+	case f.Data != nil:
+		readContent(op, f.Data)
+
+	case f.ReaderAt != nil:
+		if op.Offset >= f.Size {
+			return nil
+		}
+
+		dst := op.Dst
+		if dst == nil {
+			dst = make([]byte, op.Size)
+			op.Data = [][]byte{dst}
+		}
+
+		if rest := f.Size - op.Offset; int64(len(dst)) > rest {
+			dst = dst[:rest]
+		}
+
+		op.BytesRead, err = f.ReaderAt.ReadAt(dst, op.Offset)
+		if err == io.EOF {
+			err = nil
+		}
+
+		return err
+
+	default:
+		fs.mu.Lock()
+		content, ok := fs.handles[op.Handle]
+		fs.mu.Unlock()
+
+		if !ok {
+			return fuse.EINVAL
+		}
+
+		readContent(op, content)
+	}
+
+	return nil
+}
+
+func (fs *staticFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *staticFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.handles, op.Handle)
+	return nil
+}
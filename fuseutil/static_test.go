@@ -0,0 +1,147 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fusetesting"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+func TestStaticFileSystem(t *testing.T) {
+	ctx := context.Background()
+	generation := 0
+	fs, err := fuseutil.NewStaticFileSystem(map[string]fuseutil.StaticFile{
+		"etc/app.conf": {Data: []byte("debug = true\n")},
+		"etc/big":      {ReaderAt: strings.NewReader("0123456789"), Size: 10},
+		"metrics": {
+			Generate: func(ctx context.Context, opCtx fuseops.OpContext) ([]byte, error) {
+				generation++
+				return []byte{byte('0' + generation)}, nil
+			},
+			Mode: 0400,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewStaticFileSystem: %v", err)
+	}
+
+	h := fusetesting.NewHarness(t, fs)
+	defer h.Close(ctx)
+
+	// Parents are created, and listed in order.
+	dh, err := h.OpenDir(ctx, fuseops.RootInodeID)
+	if err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	entries, err := h.ReadDir(ctx, fuseops.RootInodeID, dh)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+
+	if want := []string{"etc", "metrics"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Root entries: %v, want %v", names, want)
+	}
+
+	if entries[0].Type != fuseutil.DT_Directory || entries[1].Type != fuseutil.DT_File {
+		t.Errorf("Root entry types: %+v", entries)
+	}
+
+	if err := h.ReleaseDir(ctx, dh); err != nil {
+		t.Fatalf("ReleaseDir: %v", err)
+	}
+
+	// Fixed content and content read on demand.
+	etc, err := h.LookUp(ctx, fuseops.RootInodeID, "etc")
+	if err != nil {
+		t.Fatalf("LookUp(etc): %v", err)
+	}
+
+	if !etc.Attributes.Mode.IsDir() || etc.Attributes.Mode.Perm() != 0555 {
+		t.Errorf("etc mode: %v", etc.Attributes.Mode)
+	}
+
+	read := func(parent fuseops.InodeID, name string, offset int64) (fuseops.ChildInodeEntry, string) {
+		e, err := h.LookUp(ctx, parent, name)
+		if err != nil {
+			t.Fatalf("LookUp(%s): %v", name, err)
+		}
+
+		handle, err := h.Open(ctx, e.Child)
+		if err != nil {
+			t.Fatalf("Open(%s): %v", name, err)
+		}
+		defer h.Release(ctx, handle)
+
+		b, err := h.Read(ctx, e.Child, handle, offset, 64)
+		if err != nil {
+			t.Fatalf("Read(%s): %v", name, err)
+		}
+
+		return e, string(b)
+	}
+
+	if e, s := read(etc.Child, "app.conf", 0); s != "debug = true\n" || e.Attributes.Size != 13 || e.Attributes.Mode != 0444 {
+		t.Errorf("app.conf: %q, %+v", s, e.Attributes)
+	}
+
+	if e, s := read(etc.Child, "big", 4); s != "456789" || e.Attributes.Size != 10 {
+		t.Errorf("big: %q, %+v", s, e.Attributes)
+	}
+
+	// Generated content is fresh for each handle.
+	for _, want := range []string{"1", "2"} {
+		if e, s := read(fuseops.RootInodeID, "metrics", 0); s != want || e.Attributes.Size != 0 || e.Attributes.Mode != 0400 {
+			t.Errorf("metrics: %q, %+v; want %q", s, e.Attributes, want)
+		}
+	}
+
+	if _, err := h.LookUp(ctx, fuseops.RootInodeID, "missing"); err != syscall.ENOENT {
+		t.Errorf("LookUp(missing): %v", err)
+	}
+
+	// Modifications are refused.
+	if _, err := h.MkDir(ctx, fuseops.RootInodeID, "new", 0755); err != syscall.EROFS {
+		t.Errorf("MkDir: %v", err)
+	}
+}
+
+func TestStaticFileSystemInvalidPaths(t *testing.T) {
+	data := fuseutil.StaticFile{Data: []byte("x")}
+	for _, files := range []map[string]fuseutil.StaticFile{
+		{"": data},
+		{"a/../b": data},
+		{"a//b": data},
+		{"a/": data},
+		{"a": data, "a/b": data},
+		{"a": {}},
+	} {
+		if _, err := fuseutil.NewStaticFileSystem(files); err == nil {
+			t.Errorf("No error for %v", files)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Create a file system that exposes the directory at the given slash-separated
+// path within the wrapped file system as its root, in the manner of a bind
+// mount. This allows one file system implementation to be mounted at several
+// mount points showing different roots.
+//
+// The path is resolved with LookUpInode the first time it is needed, and the
+// lookup count of the resulting directory is held for as long as the file
+// system exists. If resolution fails, the error is returned for the op that
+// needed it and resolution is retried next time.
+//
+// Entries outside of the subtree remain reachable only through hard links that
+// already exist within it. Wrap the result with NewReadOnlyFileSystem for a
+// read-only export.
+func Subtree(wrapped FileSystem, path string) FileSystem {
+	s := &subtreeResolver{
+		wrapped: wrapped,
+	}
+
+	for _, name := range strings.Split(path, "/") {
+		if name != "" && name != "." {
+			s.names = append(s.names, name)
+		}
+	}
+
+	return &rootRemappingFileSystem{
+		FileSystem: wrapped,
+		chooseRoot: s.resolve,
+	}
+}
+
+type subtreeResolver struct {
+	wrapped FileSystem
+	names   []string
+
+	mu sync.Mutex
+
+	// The resolved root, or zero if not yet resolved.
+	//
+	// GUARDED_BY(mu)
+	root fuseops.InodeID
+}
+
+// LOCKS_EXCLUDED(s.mu)
+func (s *subtreeResolver) resolve(
+	ctx context.Context,
+	opCtx fuseops.OpContext) (fuseops.InodeID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.root != 0 {
+		return s.root, nil
+	}
+
+	id := fuseops.InodeID(fuseops.RootInodeID)
+	for _, name := range s.names {
+		op := &fuseops.LookUpInodeOp{
+			Parent:    id,
+			Name:      name,
+			OpContext: opCtx,
+		}
+
+		err := s.wrapped.LookUpInode(ctx, op)
+
+		// We only need to hold on to the final directory, so give back the lookup
+		// count of intermediate ones.
+		if id != fuseops.RootInodeID {
+			s.wrapped.ForgetInode(ctx, &fuseops.ForgetInodeOp{
+				Inode:     id,
+				N:         1,
+				OpContext: opCtx,
+			})
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		id = op.Entry.Child
+		if op.Entry.Attributes.Mode&os.ModeDir == 0 {
+			s.wrapped.ForgetInode(ctx, &fuseops.ForgetInodeOp{
+				Inode:     id,
+				N:         1,
+				OpContext: opCtx,
+			})
+
+			return 0, fuse.ENOTDIR
+		}
+	}
+
+	s.root = id
+	return id, nil
+}
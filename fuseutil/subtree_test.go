@@ -0,0 +1,143 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A file system serving a fixed tree of inodes, keeping lookup counts.
+type treeFileSystem struct {
+	fuseutil.NotImplementedFileSystem
+
+	// Children of each directory, by name.
+	children map[fuseops.InodeID]map[string]fuseops.InodeID
+
+	// Which inodes are directories.
+	dirs map[fuseops.InodeID]bool
+
+	// Lookup counts handed out and not forgotten.
+	lookups map[fuseops.InodeID]uint64
+}
+
+func (fs *treeFileSystem) attributes(id fuseops.InodeID) fuseops.InodeAttributes {
+	if fs.dirs[id] {
+		return fuseops.InodeAttributes{Nlink: 2, Mode: os.ModeDir | 0755}
+	}
+
+	return fuseops.InodeAttributes{Nlink: 1, Mode: 0644}
+}
+
+func (fs *treeFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	child, ok := fs.children[op.Parent][op.Name]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	fs.lookups[child]++
+	op.Entry.Child = child
+	op.Entry.Attributes = fs.attributes(child)
+	return nil
+}
+
+func (fs *treeFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fs.attributes(op.Inode)
+	return nil
+}
+
+func (fs *treeFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.lookups[op.Inode] -= op.N
+	return nil
+}
+
+func TestSubtree(t *testing.T) {
+	ctx := context.Background()
+
+	// /export/data/f, /export/g and /secret.
+	wrapped := &treeFileSystem{
+		children: map[fuseops.InodeID]map[string]fuseops.InodeID{
+			fuseops.RootInodeID: {"export": 2, "secret": 3},
+			2:                   {"data": 4, "g": 5},
+			4:                   {"f": 6},
+		},
+		dirs: map[fuseops.InodeID]bool{
+			fuseops.RootInodeID: true,
+			2:                   true,
+			4:                   true,
+		},
+		lookups: make(map[fuseops.InodeID]uint64),
+	}
+
+	fs := fuseutil.Subtree(wrapped, "/export/")
+
+	// The root is the exported directory.
+	attrsOp := &fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
+	if err := fs.GetInodeAttributes(ctx, attrsOp); err != nil || !attrsOp.Attributes.Mode.IsDir() {
+		t.Errorf("Root attributes: %v, %v", attrsOp.Attributes, err)
+	}
+
+	// Entries are looked up within it, and its subdirectories are served as
+	// usual.
+	lookUp := func(parent fuseops.InodeID, name string) (fuseops.InodeID, error) {
+		op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+		err := fs.LookUpInode(ctx, op)
+		return op.Entry.Child, err
+	}
+
+	data, err := lookUp(fuseops.RootInodeID, "data")
+	if err != nil || data != 4 {
+		t.Fatalf("LookUp(data): %v, %v", data, err)
+	}
+
+	if f, err := lookUp(data, "f"); err != nil || f != 6 {
+		t.Errorf("LookUp(data/f): %v, %v", f, err)
+	}
+
+	// Entries outside of it can't be reached through the root.
+	for _, name := range []string{"secret", "export"} {
+		if _, err := lookUp(fuseops.RootInodeID, name); err != fuse.ENOENT {
+			t.Errorf("LookUp(%s): got %v, want ENOENT", name, err)
+		}
+	}
+
+	// Only the exported directory's lookup count is held.
+	if n := wrapped.lookups[2]; n != 1 {
+		t.Errorf("Lookup count of the exported directory: %d", n)
+	}
+
+	// An export path that isn't a directory fails the ops needing it, without
+	// holding on to it.
+	fs = fuseutil.Subtree(wrapped, "secret")
+	attrsOp = &fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
+	if err := fs.GetInodeAttributes(ctx, attrsOp); err != fuse.ENOTDIR {
+		t.Errorf("GetAttributes with a file for root: got %v, want ENOTDIR", err)
+	}
+
+	if n := wrapped.lookups[3]; n != 0 {
+		t.Errorf("Lookup count of the file: %d", n)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Create a file system that makes changes to a file durable when it is
+// closed, for backends that only persist data when synced. Each FlushFileOp,
+// which the kernel sends for close(2), is followed by a SyncFileOp for the
+// same handle if the file's contents have changed since it was last synced,
+// as described by DescribeContentChange. An error from either is returned by
+// close(2), so that callers learn of data that didn't make it.
+//
+// Under writeback caching the kernel writes back a file's dirty pages before
+// sending FlushFileOp, so that these are synced too. A wrapped file system
+// that doesn't implement SyncFileOp (returning ENOSYS) is taken to have
+// nothing to sync.
+func NewSyncOnCloseFileSystem(wrapped FileSystem) FileSystem {
+	fs := &syncOnCloseFileSystem{
+		dirty: make(map[fuseops.InodeID]struct{}),
+	}
+
+	fs.FileSystem = NewContentChangeNotifier(wrapped, fs.changed)
+	return fs
+}
+
+type syncOnCloseFileSystem struct {
+	FileSystem
+
+	mu sync.Mutex
+
+	// The inodes whose contents have changed since they were last synced.
+	//
+	// GUARDED_BY(mu)
+	dirty map[fuseops.InodeID]struct{}
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *syncOnCloseFileSystem) changed(ctx context.Context, c ContentChange) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.dirty[c.Inode] = struct{}{}
+}
+
+// Sync the inode through the handle if it is dirty. The inode is marked clean
+// first, so that changes made while syncing aren't lost track of, and dirty
+// again if syncing fails.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *syncOnCloseFileSystem) sync(
+	ctx context.Context,
+	op *fuseops.SyncFileOp,
+	force bool) error {
+	fs.mu.Lock()
+	_, dirty := fs.dirty[op.Inode]
+	delete(fs.dirty, op.Inode)
+	fs.mu.Unlock()
+
+	if !dirty && !force {
+		return nil
+	}
+
+	err := fs.FileSystem.SyncFile(ctx, op)
+	if err == fuse.ENOSYS && !force {
+		err = nil
+	}
+
+	if err != nil && dirty {
+		fs.mu.Lock()
+		fs.dirty[op.Inode] = struct{}{}
+		fs.mu.Unlock()
+	}
+
+	return err
+}
+
+func (fs *syncOnCloseFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	return fs.sync(ctx, op, true)
+}
+
+func (fs *syncOnCloseFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	if err := fs.FileSystem.FlushFile(ctx, op); err != nil && err != fuse.ENOSYS {
+		return err
+	}
+
+	return fs.sync(ctx, &fuseops.SyncFileOp{
+		Inode:     op.Inode,
+		Handle:    op.Handle,
+		OpContext: op.OpContext,
+	}, false)
+}
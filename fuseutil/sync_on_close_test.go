@@ -0,0 +1,92 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A writable file system recording the inodes it syncs, and failing syncs
+// with syncErr.
+type syncableFS struct {
+	writableFS
+	synced  []fuseops.InodeID
+	syncErr error
+}
+
+func (fs *syncableFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fs.synced = append(fs.synced, op.Inode)
+	return fs.syncErr
+}
+
+func TestSyncOnCloseFileSystem(t *testing.T) {
+	ctx := context.Background()
+	backend := &syncableFS{}
+	fs := fuseutil.NewSyncOnCloseFileSystem(backend)
+
+	write := func(inode fuseops.InodeID) {
+		t.Helper()
+		if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: inode, Data: []byte("taco")}); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	flush := func(inode fuseops.InodeID) error {
+		return fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: inode})
+	}
+
+	// Closing a file that was written to syncs it, once.
+	write(2)
+	if err := flush(3); err != nil || len(backend.synced) != 0 {
+		t.Errorf("Flushing a clean file: %v, synced %v", err, backend.synced)
+	}
+
+	if err := flush(2); err != nil || len(backend.synced) != 1 {
+		t.Errorf("Flushing a written file: %v, synced %v", err, backend.synced)
+	}
+
+	if err := flush(2); err != nil || len(backend.synced) != 1 {
+		t.Errorf("Flushing a synced file: %v, synced %v", err, backend.synced)
+	}
+
+	// Errors are returned to close(2), and the file stays dirty.
+	write(2)
+	backend.syncErr = syscall.EIO
+	if err := flush(2); err != syscall.EIO {
+		t.Errorf("Flush with a failing sync: got %v, want EIO", err)
+	}
+
+	backend.syncErr = nil
+	if err := flush(2); err != nil || len(backend.synced) != 3 {
+		t.Errorf("Flush after a failed sync: %v, synced %v", err, backend.synced)
+	}
+
+	// An explicit sync cleans the file too.
+	write(2)
+	if err := fs.SyncFile(ctx, &fuseops.SyncFileOp{Inode: 2}); err != nil {
+		t.Fatalf("SyncFile: %v", err)
+	}
+
+	if err := flush(2); err != nil || len(backend.synced) != 4 {
+		t.Errorf("Flushing after a sync: %v, synced %v", err, backend.synced)
+	}
+}
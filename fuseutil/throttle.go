@@ -0,0 +1,247 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// Options for NewThrottlingFileSystem. Rates are in bytes per second, and a
+// rate of zero is unlimited.
+type ThrottleConfig struct {
+	// Limits on the bandwidth of all callers together.
+	ReadRate  int64
+	WriteRate int64
+
+	// Limits on the bandwidth of each UID, as reported in fuseops.OpContext.
+	// Note that page cache writeback is attributed to whichever UID the kernel
+	// reports for it, which may not be the one that wrote the data.
+	PerUIDReadRate  int64
+	PerUIDWriteRate int64
+
+	// How long a burst may run at an unlimited rate after a quiet period,
+	// expressed as a duration of transfer at the limit. Defaults to one second.
+	Burst time.Duration
+
+	// Defaults to timeutil.RealClock().
+	Clock timeutil.Clock
+}
+
+// Create a file system that enforces bandwidth limits on file reads and
+// writes by delaying responses, so that e.g. a background sync file system
+// doesn't saturate the network or disk. Reads are delayed after the wrapped
+// file system has returned, once their size is known; writes before they are
+// passed on.
+//
+// An op whose context is cancelled while it is being delayed fails with
+// EINTR. Ops other than reads and writes are never delayed.
+func NewThrottlingFileSystem(
+	wrapped FileSystem,
+	cfg ThrottleConfig) FileSystem {
+	if cfg.Burst <= 0 {
+		cfg.Burst = time.Second
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = timeutil.RealClock()
+	}
+
+	return &throttlingFileSystem{
+		FileSystem: wrapped,
+		cfg:        cfg,
+		read:       newTokenBucket(cfg.ReadRate, cfg.Burst, cfg.Clock),
+		write:      newTokenBucket(cfg.WriteRate, cfg.Burst, cfg.Clock),
+		uidRead:    make(map[uint32]*tokenBucket),
+		uidWrite:   make(map[uint32]*tokenBucket),
+	}
+}
+
+type throttlingFileSystem struct {
+	FileSystem
+	cfg ThrottleConfig
+
+	read  *tokenBucket
+	write *tokenBucket
+
+	mu sync.Mutex
+
+	// The buckets of UIDs that have transferred recently. Those that have
+	// refilled are evicted, being no different from new ones.
+	//
+	// GUARDED_BY(mu)
+	uidRead  map[uint32]*tokenBucket
+	uidWrite map[uint32]*tokenBucket
+}
+
+// A token bucket that may go into debt: a transfer is accounted for in full
+// straight away, and the caller waits until the bucket has refilled to zero.
+// Nil buckets are unlimited.
+type tokenBucket struct {
+	rate     float64 // bytes per second
+	capacity float64
+	clock    timeutil.Clock
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(
+	rate int64,
+	burst time.Duration,
+	clock timeutil.Clock) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	capacity := float64(rate) * burst.Seconds()
+	return &tokenBucket{
+		rate:     float64(rate),
+		capacity: capacity,
+		clock:    clock,
+		tokens:   capacity,
+		last:     clock.Now(),
+	}
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *tokenBucket) refill() {
+	now := b.clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+}
+
+// Report whether the bucket has refilled completely.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *tokenBucket) full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	return b.tokens >= b.capacity
+}
+
+// Take n bytes from the bucket, returning how long to wait before the
+// transfer may proceed.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *tokenBucket) take(n int) time.Duration {
+	if b == nil || n == 0 {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *throttlingFileSystem) uidBucket(
+	m map[uint32]*tokenBucket,
+	rate int64,
+	uid uint32) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	b := m[uid]
+	if b != nil {
+		return b
+	}
+
+	// Make room by evicting idle UIDs before adding another, so that the map
+	// only grows with the number of UIDs transferring at once.
+	for id, other := range m {
+		if other.full() {
+			delete(m, id)
+		}
+	}
+
+	b = newTokenBucket(rate, fs.cfg.Burst, fs.cfg.Clock)
+	m[uid] = b
+
+	return b
+}
+
+// Account for a transfer in the global and per-UID buckets, and wait for the
+// longer of the two delays.
+func (fs *throttlingFileSystem) throttle(
+	ctx context.Context,
+	global *tokenBucket,
+	perUID *tokenBucket,
+	n int) error {
+	d := global.take(n)
+	if d2 := perUID.take(n); d2 > d {
+		d = d2
+	}
+
+	if d == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return syscall.EINTR
+	}
+}
+
+func (fs *throttlingFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if err := fs.FileSystem.ReadFile(ctx, op); err != nil {
+		return err
+	}
+
+	perUID := fs.uidBucket(fs.uidRead, fs.cfg.PerUIDReadRate, op.OpContext.Uid)
+	return fs.throttle(ctx, fs.read, perUID, op.BytesRead)
+}
+
+func (fs *throttlingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	perUID := fs.uidBucket(fs.uidWrite, fs.cfg.PerUIDWriteRate, op.OpContext.Uid)
+	if err := fs.throttle(ctx, fs.write, perUID, len(op.Data)); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.WriteFile(ctx, op)
+}
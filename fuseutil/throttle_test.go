@@ -0,0 +1,92 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+// A file system whose files are all writable.
+type writableFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *writableFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return nil
+}
+
+func TestThrottlingFileSystem(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC))
+
+	fs := fuseutil.NewThrottlingFileSystem(&writableFS{}, fuseutil.ThrottleConfig{
+		PerUIDWriteRate: 100000,
+		Burst:           10 * time.Millisecond,
+		Clock:           &clock,
+	})
+
+	// Writes are made with a cancelled context, so that those that would have
+	// to wait fail with EINTR straight away and the rest succeed.
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	write := func(uid uint32, n int) error {
+		return fs.WriteFile(cancelled, &fuseops.WriteFileOp{
+			Data:      make([]byte, n),
+			OpContext: fuseops.OpContext{Uid: uid},
+		})
+	}
+
+	// The burst of 1000 bytes goes through straight away, then 5000 bytes
+	// would take 50ms.
+	if err := write(1000, 1000); err != nil {
+		t.Errorf("First write: %v", err)
+	}
+
+	if err := write(1000, 5000); err != syscall.EINTR {
+		t.Errorf("Second write: got %v, want EINTR", err)
+	}
+
+	// Other users have their own budget.
+	if err := write(1001, 1000); err != nil {
+		t.Errorf("Other user's write: %v", err)
+	}
+
+	// Once the debt has been paid off, the bucket refills.
+	clock.AdvanceTime(60 * time.Millisecond)
+	if err := write(1000, 1000); err != nil {
+		t.Errorf("Write after refilling: %v", err)
+	}
+
+	// The buckets of users that have been idle long enough to refill are
+	// evicted when another user comes along.
+	clock.AdvanceTime(time.Second)
+	if err := write(1002, 1); err != nil {
+		t.Errorf("Third user's write: %v", err)
+	}
+
+	if n := fuseutil.NumWriteBuckets(fs); n != 1 {
+		t.Errorf("%d write buckets, want 1", n)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// A function that returns the directory inode within a wrapped file system
+// that should be presented as the root of the mount to the user with the given
+// UID. Return an error (e.g. fuse.ENOENT or syscall.EACCES) to deny the user a
+// view altogether.
+//
+// The returned inode must remain valid (in the sense of ForgetInodeOp) for as
+// long as the mount exists.
+type UIDViewFunc func(ctx context.Context, uid uint32) (fuseops.InodeID, error)
+
+// Create a file system that presents a different subtree of the wrapped file
+// system as the root directory depending on the UID of the process making
+// each request, as reported in fuseops.OpContext. This allows a single mount
+// to serve per-user, home directory-like views.
+//
+// Because the kernel's dentry and attribute caches are shared by all users of
+// a mount, the wrapper disables caching of the root's attributes and of the
+// entries directly within it, so that every path resolution consults the
+// caller's view. Deeper entries may be cached as usual. Inodes reachable from
+// several views are shared between them.
+//
+// Note that operations sent by the kernel on behalf of page cache writeback
+// may not carry the UID of the user that wrote the data. This is harmless
+// because such operations never refer to the root directory.
+func NewUIDViewFileSystem(
+	wrapped FileSystem,
+	view UIDViewFunc) FileSystem {
+	return &rootRemappingFileSystem{
+		FileSystem: wrapped,
+		chooseRoot: func(
+			ctx context.Context,
+			opCtx fuseops.OpContext) (fuseops.InodeID, error) {
+			return view(ctx, opCtx.Uid)
+		},
+		perCaller: true,
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A file system that records the parent of each lookup it receives.
+type lookupRecorder struct {
+	fuseutil.NotImplementedFileSystem
+	parents []fuseops.InodeID
+}
+
+func (fs *lookupRecorder) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.parents = append(fs.parents, op.Parent)
+	op.Entry.Child = 100
+	op.Entry.EntryExpiration = time.Now().Add(time.Hour)
+	return nil
+}
+
+func TestUIDViewFileSystem(t *testing.T) {
+	ctx := context.Background()
+	inner := &lookupRecorder{}
+	fs := fuseutil.NewUIDViewFileSystem(
+		inner,
+		func(ctx context.Context, uid uint32) (fuseops.InodeID, error) {
+			if uid == 0 {
+				return 0, fuse.ENOENT
+			}
+			return fuseops.InodeID(10 + uid), nil
+		})
+
+	// Lookups within the root are redirected to the caller's view, and are not
+	// cached by the kernel.
+	op := &fuseops.LookUpInodeOp{
+		Parent:    fuseops.RootInodeID,
+		Name:      "foo",
+		OpContext: fuseops.OpContext{Uid: 7},
+	}
+
+	if err := fs.LookUpInode(ctx, op); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	if op.Parent != fuseops.RootInodeID {
+		t.Errorf("Parent not restored: %v", op.Parent)
+	}
+
+	if !op.Entry.EntryExpiration.Equal(fuseops.NoCache) {
+		t.Errorf("EntryExpiration not cleared: %v", op.Entry.EntryExpiration)
+	}
+
+	// Lookups elsewhere are untouched.
+	op = &fuseops.LookUpInodeOp{
+		Parent:    100,
+		Name:      "bar",
+		OpContext: fuseops.OpContext{Uid: 7},
+	}
+
+	if err := fs.LookUpInode(ctx, op); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	if op.Entry.EntryExpiration.IsZero() {
+		t.Errorf("EntryExpiration unexpectedly cleared")
+	}
+
+	// Users without a view are denied.
+	op = &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	}
+
+	if err := fs.LookUpInode(ctx, op); err != fuse.ENOENT {
+		t.Errorf("Expected ENOENT, got %v", err)
+	}
+
+	want := []fuseops.InodeID{17, 100}
+	if len(inner.parents) != len(want) {
+		t.Fatalf("Parents: got %v, want %v", inner.parents, want)
+	}
+
+	for i := range want {
+		if inner.parents[i] != want[i] {
+			t.Errorf("Parents: got %v, want %v", inner.parents, want)
+		}
+	}
+}
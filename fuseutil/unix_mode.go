@@ -0,0 +1,90 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// UnixMode converts the mode of an inode, as found in
+// fuseops.InodeAttributes.Mode, to the st_mode bits used on the wire by the
+// kernel and by network file system protocols.
+func UnixMode(mode os.FileMode) uint32 {
+	out := uint32(mode) & 0777
+	switch {
+	default:
+		out |= syscall.S_IFREG
+	case mode&os.ModeDir != 0:
+		out |= syscall.S_IFDIR
+	case mode&os.ModeDevice != 0:
+		if mode&os.ModeCharDevice != 0 {
+			out |= syscall.S_IFCHR
+		} else {
+			out |= syscall.S_IFBLK
+		}
+	case mode&os.ModeNamedPipe != 0:
+		out |= syscall.S_IFIFO
+	case mode&os.ModeSymlink != 0:
+		out |= syscall.S_IFLNK
+	case mode&os.ModeSocket != 0:
+		out |= syscall.S_IFSOCK
+	}
+
+	if mode&os.ModeSetuid != 0 {
+		out |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		out |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		out |= syscall.S_ISVTX
+	}
+
+	return out
+}
+
+// FileMode is the inverse of UnixMode.
+func FileMode(unixMode uint32) os.FileMode {
+	mode := os.FileMode(unixMode & 0777)
+	switch unixMode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		// nothing
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFCHR:
+		mode |= os.ModeCharDevice | os.ModeDevice
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+
+	if unixMode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if unixMode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if unixMode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return mode
+}
@@ -0,0 +1,192 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash"
+	"log"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// A FileSystem that knows the expected checksums of the blocks of its files,
+// e.g. from a manifest written when they were archived. See
+// NewVerifyingFileSystem.
+type ChecksummedFileSystem interface {
+	FileSystem
+
+	// Return the expected checksum of the index-th block of the inode's
+	// contents, as computed by VerifyConfig.NewHash over the block. All blocks
+	// are VerifyConfig.BlockSize bytes long except the last, which may be
+	// shorter.
+	BlockChecksum(
+		ctx context.Context,
+		inode fuseops.InodeID,
+		index int64) ([]byte, error)
+}
+
+// Options for NewVerifyingFileSystem.
+type VerifyConfig struct {
+	// The size of the blocks checksummed. Defaults to 64 KiB.
+	BlockSize int64
+
+	// The hash computing the checksums. Defaults to sha256.New.
+	NewHash func() hash.Hash
+
+	// Where mismatches are logged. Defaults to the standard logger.
+	ErrorLogger *log.Logger
+}
+
+// Create a file system that verifies every block read from the wrapped file
+// system against the checksum it provides, for integrity-sensitive archival
+// mounts. A read is extended to whole blocks before being passed on, and fails
+// with EIO, after logging the inode, block and checksums involved, if any
+// block doesn't match.
+func NewVerifyingFileSystem(
+	wrapped ChecksummedFileSystem,
+	cfg VerifyConfig) FileSystem {
+	if cfg.BlockSize <= 0 {
+		cfg.BlockSize = 64 << 10
+	}
+
+	if cfg.NewHash == nil {
+		cfg.NewHash = sha256.New
+	}
+
+	if cfg.ErrorLogger == nil {
+		cfg.ErrorLogger = log.Default()
+	}
+
+	return &verifyingFileSystem{
+		FileSystem: wrapped,
+		wrapped:    wrapped,
+		cfg:        cfg,
+	}
+}
+
+type verifyingFileSystem struct {
+	FileSystem
+	wrapped ChecksummedFileSystem
+	cfg     VerifyConfig
+}
+
+// Check the blocks in data, read from the start of the first-th block. A short
+// final block is taken to end the file.
+func (fs *verifyingFileSystem) verify(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	first int64,
+	data []byte) error {
+	h := fs.cfg.NewHash()
+	for i := int64(0); len(data) != 0; i++ {
+		n := int64(len(data))
+		if n > fs.cfg.BlockSize {
+			n = fs.cfg.BlockSize
+		}
+
+		block := first + i
+		want, err := fs.wrapped.BlockChecksum(ctx, inode, block)
+		if err != nil {
+			fs.cfg.ErrorLogger.Printf(
+				"verify: inode %d block %d: no checksum: %v",
+				inode,
+				block,
+				err)
+			return fuse.EIO
+		}
+
+		h.Reset()
+		h.Write(data[:n])
+		if got := h.Sum(nil); !bytes.Equal(got, want) {
+			fs.cfg.ErrorLogger.Printf(
+				"verify: inode %d block %d (bytes %d-%d): checksum %x, want %x",
+				inode,
+				block,
+				block*fs.cfg.BlockSize,
+				block*fs.cfg.BlockSize+n,
+				got,
+				want)
+			return fuse.EIO
+		}
+
+		data = data[n:]
+	}
+
+	return nil
+}
+
+func (fs *verifyingFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	bs := fs.cfg.BlockSize
+	first := op.Offset / bs
+	end := op.Offset + int64(len(op.Dst))
+	if op.Dst == nil {
+		end = op.Offset + op.Size
+	}
+
+	blocks := (end + bs - 1) / bs
+
+	// Read whole blocks into a buffer of our own.
+	wideOp := &fuseops.ReadFileOp{
+		Inode:     op.Inode,
+		Handle:    op.Handle,
+		Offset:    first * bs,
+		Size:      (blocks - first) * bs,
+		Dst:       make([]byte, (blocks-first)*bs),
+		OpenFlags: op.OpenFlags,
+		OpContext: op.OpContext,
+	}
+
+	if err := fs.wrapped.ReadFile(ctx, wideOp); err != nil {
+		return err
+	}
+
+	data := wideOp.Dst[:wideOp.BytesRead]
+	if wideOp.Data != nil {
+		data = nil
+		for _, b := range wideOp.Data {
+			data = append(data, b...)
+		}
+	}
+
+	if err := fs.verify(ctx, op.Inode, first, data); err != nil {
+		return err
+	}
+
+	// Hand back the part that was asked for.
+	skip := op.Offset - first*bs
+	if skip >= int64(len(data)) {
+		op.BytesRead = 0
+		return nil
+	}
+
+	data = data[skip:]
+	if int64(len(data)) > end-op.Offset {
+		data = data[:end-op.Offset]
+	}
+
+	if op.Dst != nil {
+		op.BytesRead = copy(op.Dst, data)
+	} else {
+		op.Data = [][]byte{data}
+	}
+
+	return nil
+}
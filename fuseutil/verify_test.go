@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A file system whose inode 2 contains "abcdefghij", checksummed in blocks of
+// four bytes as it was before corrupt was applied to it.
+type checksummedFS struct {
+	fuseutil.NotImplementedFileSystem
+	corrupt func(contents []byte)
+}
+
+const checksummedContents = "abcdefghij"
+
+func (fs *checksummedFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	contents := []byte(checksummedContents)
+	if fs.corrupt != nil {
+		fs.corrupt(contents)
+	}
+
+	if op.Offset < int64(len(contents)) {
+		op.BytesRead = copy(op.Dst, contents[op.Offset:])
+	}
+
+	return nil
+}
+
+func (fs *checksummedFS) BlockChecksum(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	index int64) ([]byte, error) {
+	block := checksummedContents[index*4:]
+	if len(block) > 4 {
+		block = block[:4]
+	}
+
+	sum := sha256.Sum256([]byte(block))
+	return sum[:], nil
+}
+
+func TestVerifyingFileSystem(t *testing.T) {
+	ctx := context.Background()
+	wrapped := &checksummedFS{}
+	logs := new(bytes.Buffer)
+	fs := fuseutil.NewVerifyingFileSystem(wrapped, fuseutil.VerifyConfig{
+		BlockSize:   4,
+		ErrorLogger: log.New(logs, "", 0),
+	})
+
+	read := func(offset int64, size int) (string, error) {
+		op := &fuseops.ReadFileOp{
+			Inode:  2,
+			Offset: offset,
+			Dst:    make([]byte, size),
+		}
+
+		err := fs.ReadFile(ctx, op)
+		return string(op.Dst[:op.BytesRead]), err
+	}
+
+	// Reads straddling blocks and running past the end of the file.
+	for _, tc := range []struct {
+		offset int64
+		size   int
+		want   string
+	}{
+		{0, 10, "abcdefghij"},
+		{3, 3, "def"},
+		{9, 4, "j"},
+		{12, 4, ""},
+	} {
+		if got, err := read(tc.offset, tc.size); err != nil || got != tc.want {
+			t.Errorf("Read(%d, %d): got %q, %v, want %q", tc.offset, tc.size, got, err, tc.want)
+		}
+	}
+
+	// A corrupt block fails reads touching it, and only those.
+	wrapped.corrupt = func(contents []byte) { contents[5] = 'X' }
+	if _, err := read(6, 1); err != syscall.EIO {
+		t.Errorf("Read of the corrupt block: got %v, want EIO", err)
+	}
+
+	if !strings.Contains(logs.String(), "inode 2 block 1 (bytes 4-8)") {
+		t.Errorf("Log: %q", logs.String())
+	}
+
+	if got, err := read(0, 4); err != nil || got != "abcd" {
+		t.Errorf("Read of another block: got %q, %v", got, err)
+	}
+}
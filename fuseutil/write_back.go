@@ -0,0 +1,465 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Options for NewWriteBackFileSystem.
+type WriteBackConfig struct {
+	// The number of bytes buffered for an inode beyond which a write flushes
+	// them straight away. Defaults to one MiB.
+	MaxDirty int
+
+	// If non-nil, each write is recorded in the journal before it is
+	// acknowledged, and acked in it once it has been passed on, so that writes
+	// lost to a crash can be recovered or reported. See WriteJournal.
+	Journal *WriteJournal
+}
+
+// Create a file system that acknowledges WriteFileOps straight away and
+// passes them on to the wrapped file system later, coalescing contiguous
+// writes through the same handle, for backends with a high cost per write.
+// Buffered writes for an inode are passed on before any op that could observe
+// them: reads, attribute lookups, truncations, fallocate, syncs, flushes, and
+// releases of the handles they were made through.
+//
+// Errors passing on writes are reported the way the kernel reports errors
+// writing back its page cache: an error is recorded against the inode, and
+// returned by the next SyncFileOp or FlushFileOp (that is, fsync(2) or
+// close(2)) through each handle that was open on the inode when it happened,
+// once per handle. Other ops that flush don't return it. The data of the
+// failed write is dropped, but stays outstanding in the journal if there is
+// one.
+func NewWriteBackFileSystem(
+	wrapped FileSystem,
+	cfg WriteBackConfig) FileSystem {
+	if cfg.MaxDirty <= 0 {
+		cfg.MaxDirty = 1 << 20
+	}
+
+	return &writeBackFileSystem{
+		FileSystem: wrapped,
+		cfg:        cfg,
+		inodes:     make(map[fuseops.InodeID]*dirtyInode),
+		handles:    make(map[fuseops.HandleID]fuseops.InodeID),
+		seen:       make(map[fuseops.HandleID]uint64),
+	}
+}
+
+type writeBackFileSystem struct {
+	FileSystem
+	cfg WriteBackConfig
+
+	mu sync.Mutex
+
+	// The inodes that have been written to, and the inode of each handle
+	// written through.
+	//
+	// GUARDED_BY(mu)
+	inodes  map[fuseops.InodeID]*dirtyInode
+	handles map[fuseops.HandleID]fuseops.InodeID
+
+	// For each open file handle, the errSeq of its inode when the last error
+	// was reported through it, or when it was opened.
+	//
+	// GUARDED_BY(mu)
+	seen map[fuseops.HandleID]uint64
+}
+
+type dirtyInode struct {
+	// Held while passing writes on, so that an op flushing the inode waits for
+	// writes taken by a concurrent flush to land.
+	flushMu sync.Mutex
+
+	// Writes not yet passed on, in the order they were made, and their total
+	// size.
+	//
+	// GUARDED_BY(writeBackFileSystem.mu)
+	writes []*bufferedWrite
+	dirty  int
+
+	// The last error passing on writes, and the number of times passing on
+	// writes has failed.
+	//
+	// GUARDED_BY(writeBackFileSystem.mu)
+	err    error
+	errSeq uint64
+}
+
+type bufferedWrite struct {
+	handle fuseops.HandleID
+	offset int64
+	data   []byte
+
+	// The journal records covering the write.
+	seqs []uint64
+
+	opCtx fuseops.OpContext
+}
+
+// Return the state of the inode, creating it if necessary.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *writeBackFileSystem) inode(id fuseops.InodeID) *dirtyInode {
+	in := fs.inodes[id]
+	if in == nil {
+		in = &dirtyInode{}
+		fs.inodes[id] = in
+	}
+
+	return in
+}
+
+// Return the inodes of which state is kept.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *writeBackFileSystem) inodeIDs() []fuseops.InodeID {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ids := make([]fuseops.InodeID, 0, len(fs.inodes))
+	for id := range fs.inodes {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// Pass the inode's buffered writes on to the wrapped file system, recording
+// the first error against the inode and returning it.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *writeBackFileSystem) flush(
+	ctx context.Context,
+	id fuseops.InodeID) error {
+	fs.mu.Lock()
+	in := fs.inodes[id]
+	fs.mu.Unlock()
+
+	if in == nil {
+		return nil
+	}
+
+	in.flushMu.Lock()
+	defer in.flushMu.Unlock()
+
+	fs.mu.Lock()
+	writes := in.writes
+	in.writes = nil
+	in.dirty = 0
+	fs.mu.Unlock()
+
+	var firstErr error
+	for _, w := range writes {
+		err := fs.FileSystem.WriteFile(ctx, &fuseops.WriteFileOp{
+			Inode:     id,
+			Handle:    w.handle,
+			Offset:    w.offset,
+			Data:      w.data,
+			OpContext: w.opCtx,
+		})
+
+		if err == nil && fs.cfg.Journal != nil {
+			err = fs.cfg.Journal.Ack(w.seqs...)
+		}
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		fs.mu.Lock()
+		in.err = firstErr
+		in.errSeq++
+		fs.mu.Unlock()
+	}
+
+	return firstErr
+}
+
+// Return the error recorded against the inode since it was last reported
+// through the handle, if any, and note that it has now been.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *writeBackFileSystem) unreportedErr(
+	id fuseops.InodeID,
+	h fuseops.HandleID) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.inodes[id]
+	if in == nil || in.errSeq == fs.seen[h] {
+		return nil
+	}
+
+	fs.seen[h] = in.errSeq
+	return in.err
+}
+
+// Note that the handle was opened on the inode, so that errors that happened
+// before aren't reported through it.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *writeBackFileSystem) opened(
+	id fuseops.InodeID,
+	h fuseops.HandleID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if in := fs.inodes[id]; in != nil {
+		fs.seen[h] = in.errSeq
+	}
+}
+
+// Flush the inode a handle was written through, if any.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *writeBackFileSystem) flushHandle(
+	ctx context.Context,
+	h fuseops.HandleID) error {
+	fs.mu.Lock()
+	id, ok := fs.handles[h]
+	fs.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return fs.flush(ctx, id)
+}
+
+func (fs *writeBackFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	// The op's buffer is reused once it has been answered.
+	data := append([]byte(nil), op.Data...)
+
+	var seqs []uint64
+	if fs.cfg.Journal != nil {
+		seq, err := fs.cfg.Journal.recordWrite(op.Inode, op.Offset, data)
+		if err != nil {
+			return err
+		}
+
+		seqs = []uint64{seq}
+	}
+
+	fs.mu.Lock()
+	fs.handles[op.Handle] = op.Inode
+	in := fs.inode(op.Inode)
+
+	// Extend the last write if this one follows on from it.
+	if n := len(in.writes); n != 0 {
+		last := in.writes[n-1]
+		if last.handle == op.Handle && last.offset+int64(len(last.data)) == op.Offset {
+			last.data = append(last.data, data...)
+			last.seqs = append(last.seqs, seqs...)
+			data = nil
+		}
+	}
+
+	if data != nil {
+		in.writes = append(in.writes, &bufferedWrite{
+			handle: op.Handle,
+			offset: op.Offset,
+			data:   data,
+			seqs:   seqs,
+			opCtx:  op.OpContext,
+		})
+	}
+
+	in.dirty += op.Written()
+	full := in.dirty >= fs.cfg.MaxDirty
+	fs.mu.Unlock()
+
+	if full {
+		fs.flush(ctx, op.Inode)
+	}
+
+	return nil
+}
+
+func (fs *writeBackFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.flush(ctx, op.Inode)
+	return fs.FileSystem.ReadFile(ctx, op)
+}
+
+func (fs *writeBackFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := fs.FileSystem.LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	// Report the size the buffered writes give the file.
+	fs.mu.Lock()
+	in := fs.inodes[op.Entry.Child]
+	dirty := in != nil && len(in.writes) != 0
+	fs.mu.Unlock()
+
+	if !dirty {
+		return nil
+	}
+
+	fs.flush(ctx, op.Entry.Child)
+	getOp := &fuseops.GetInodeAttributesOp{
+		Inode:     op.Entry.Child,
+		OpContext: op.OpContext,
+	}
+
+	if err := fs.FileSystem.GetInodeAttributes(ctx, getOp); err != nil {
+		return err
+	}
+
+	op.Entry.Attributes = getOp.Attributes
+	return nil
+}
+
+func (fs *writeBackFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.flush(ctx, op.Inode)
+	return fs.FileSystem.GetInodeAttributes(ctx, op)
+}
+
+func (fs *writeBackFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.flush(ctx, op.Inode)
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+func (fs *writeBackFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	fs.flush(ctx, op.Inode)
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+func (fs *writeBackFileSystem) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	fs.flush(ctx, op.Inode)
+	return fs.FileSystem.Lseek(ctx, op)
+}
+
+func (fs *writeBackFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if err := fs.FileSystem.OpenFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.opened(op.Inode, op.Handle)
+	return nil
+}
+
+func (fs *writeBackFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := fs.FileSystem.CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.opened(op.Entry.Child, op.Handle)
+	return nil
+}
+
+func (fs *writeBackFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fs.flush(ctx, op.Inode)
+	if err := fs.unreportedErr(op.Inode, op.Handle); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SyncFile(ctx, op)
+}
+
+func (fs *writeBackFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	fs.flush(ctx, op.Inode)
+	if err := fs.unreportedErr(op.Inode, op.Handle); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.FlushFile(ctx, op)
+}
+
+func (fs *writeBackFileSystem) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	// There is no handle to report errors through, so report the first one
+	// met while flushing, leaving it to be reported to each handle as well.
+	var firstErr error
+	for _, id := range fs.inodeIDs() {
+		if err := fs.flush(ctx, id); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return fs.FileSystem.SyncFS(ctx, op)
+}
+
+func (fs *writeBackFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	// The kernel doesn't wait for the release, so nobody would see an error.
+	fs.flushHandle(ctx, op.Handle)
+
+	fs.mu.Lock()
+	delete(fs.handles, op.Handle)
+	delete(fs.seen, op.Handle)
+	fs.mu.Unlock()
+
+	return fs.FileSystem.ReleaseFileHandle(ctx, op)
+}
+
+func (fs *writeBackFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	// Writes are made through handles, which the kernel releases before
+	// forgetting the inode, so there is nothing left to flush. But the inode
+	// may still be open if the kernel isn't forgetting it entirely, so keep
+	// any error to report.
+	fs.mu.Lock()
+	if in := fs.inodes[op.Inode]; in != nil && len(in.writes) == 0 && in.errSeq == 0 {
+		delete(fs.inodes, op.Inode)
+	}
+	fs.mu.Unlock()
+
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+func (fs *writeBackFileSystem) Destroy() {
+	for _, id := range fs.inodeIDs() {
+		fs.flush(context.Background(), id)
+	}
+
+	fs.FileSystem.Destroy()
+}
@@ -0,0 +1,249 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A file system holding the contents of any inode written to, and counting
+// the writes it receives.
+type contentsFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu       sync.Mutex
+	contents map[fuseops.InodeID][]byte
+	writes   int
+	err      error
+}
+
+func (fs *contentsFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.err != nil {
+		return fs.err
+	}
+
+	if fs.contents == nil {
+		fs.contents = make(map[fuseops.InodeID][]byte)
+	}
+
+	c := fs.contents[op.Inode]
+	if end := int(op.Offset) + len(op.Data); end > len(c) {
+		c = append(c, make([]byte, end-len(c))...)
+	}
+
+	copy(c[op.Offset:], op.Data)
+	fs.contents[op.Inode] = c
+	fs.writes++
+	return nil
+}
+
+func (fs *contentsFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if c := fs.contents[op.Inode]; op.Offset < int64(len(c)) {
+		op.BytesRead = copy(op.Dst, c[op.Offset:])
+	}
+
+	return nil
+}
+
+func (fs *contentsFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *contentsFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func (fs *contentsFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	return nil
+}
+
+func TestWriteBackFileSystem(t *testing.T) {
+	ctx := context.Background()
+	wrapped := &contentsFS{}
+	fs := fuseutil.NewWriteBackFileSystem(wrapped, fuseutil.WriteBackConfig{
+		MaxDirty: 16,
+	})
+
+	write := func(offset int64, data string) {
+		err := fs.WriteFile(ctx, &fuseops.WriteFileOp{
+			Inode:  2,
+			Handle: 1,
+			Offset: offset,
+			Data:   []byte(data),
+		})
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	// Contiguous writes are buffered, then passed on as one by a read.
+	write(0, "tac")
+	write(3, "o")
+	write(4, "s")
+	if wrapped.writes != 0 {
+		t.Errorf("%d writes passed on before the read", wrapped.writes)
+	}
+
+	readOp := &fuseops.ReadFileOp{Inode: 2, Dst: make([]byte, 16)}
+	if err := fs.ReadFile(ctx, readOp); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if got := string(readOp.Dst[:readOp.BytesRead]); got != "tacos" || wrapped.writes != 1 {
+		t.Errorf("Read %q after %d writes", got, wrapped.writes)
+	}
+
+	// Enough buffered data is flushed without waiting.
+	write(0, "0123456789abcdef")
+	if wrapped.writes != 2 {
+		t.Errorf("%d writes passed on, want 2", wrapped.writes)
+	}
+
+	// Errors passing writes on are reported by the next sync or flush through
+	// each handle open at the time, once, rather than by the op that flushes.
+	if err := fs.OpenFile(ctx, &fuseops.OpenFileOp{Inode: 2, Handle: 2}); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	wrapped.err = syscall.EIO
+	write(0, "x")
+	if err := fs.ReadFile(ctx, readOp); err != nil {
+		t.Errorf("ReadFile after a failed write: %v", err)
+	}
+
+	if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: 2, Handle: 1}); err != syscall.EIO {
+		t.Errorf("FlushFile: got %v, want EIO", err)
+	}
+
+	if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: 2, Handle: 1}); err != nil {
+		t.Errorf("Second FlushFile: %v", err)
+	}
+
+	if err := fs.SyncFile(ctx, &fuseops.SyncFileOp{Inode: 2, Handle: 2}); err != syscall.EIO {
+		t.Errorf("SyncFile through another handle: got %v, want EIO", err)
+	}
+
+	// Handles opened later don't see errors from before.
+	if err := fs.OpenFile(ctx, &fuseops.OpenFileOp{Inode: 2, Handle: 3}); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: 2, Handle: 3}); err != nil {
+		t.Errorf("FlushFile through a new handle: %v", err)
+	}
+}
+
+func TestWriteJournal(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "journal")
+
+	j, pending, err := fuseutil.OpenWriteJournal(path, fuseutil.JournalOptions{})
+	if err != nil {
+		t.Fatalf("OpenWriteJournal: %v", err)
+	}
+
+	if len(pending) != 0 {
+		t.Errorf("New journal has %d writes outstanding", len(pending))
+	}
+
+	wrapped := &contentsFS{}
+	fs := fuseutil.NewWriteBackFileSystem(wrapped, fuseutil.WriteBackConfig{
+		Journal: j,
+	})
+
+	write := func(inode fuseops.InodeID, data string) {
+		err := fs.WriteFile(ctx, &fuseops.WriteFileOp{
+			Inode:  inode,
+			Handle: fuseops.HandleID(inode),
+			Data:   []byte(data),
+		})
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	// Flushed writes are acked.
+	write(2, "taco")
+	if n := j.Outstanding(); n != 1 {
+		t.Errorf("%d writes outstanding before the flush, want 1", n)
+	}
+
+	if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: 2, Handle: 2}); err != nil {
+		t.Fatalf("FlushFile: %v", err)
+	}
+
+	if n := j.Outstanding(); n != 0 {
+		t.Errorf("%d writes outstanding after the flush", n)
+	}
+
+	// Crash with writes to two inodes buffered, one of them flushed, and part
+	// of a record appended.
+	write(2, "burrito")
+	write(3, "enchilada")
+	if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: 2, Handle: 2}); err != nil {
+		t.Fatalf("FlushFile: %v", err)
+	}
+	j.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	f.Write([]byte("W\x07"))
+	f.Close()
+
+	j, pending, err = fuseutil.OpenWriteJournal(path, fuseutil.JournalOptions{})
+	if err != nil {
+		t.Fatalf("OpenWriteJournal after the crash: %v", err)
+	}
+	defer j.Close()
+
+	if len(pending) != 1 || pending[0].Inode != 3 || string(pending[0].Data) != "enchilada" {
+		t.Fatalf("Outstanding after the crash: %+v", pending)
+	}
+
+	// Once replayed, the journal is empty.
+	if err := j.Ack(pending[0].Seq); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 0 {
+		t.Errorf("Journal after replaying: %v, %v", fi, err)
+	}
+}
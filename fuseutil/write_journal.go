@@ -0,0 +1,309 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// A write recorded in a WriteJournal that was acknowledged to the kernel but
+// not known to have reached the file system behind the journal.
+type JournaledWrite struct {
+	Seq    uint64
+	Inode  fuseops.InodeID
+	Offset int64
+	Data   []byte
+}
+
+// Options for OpenWriteJournal.
+type JournalOptions struct {
+	// Don't sync the journal after each record. The journal then survives
+	// crashes of the process but not of the machine.
+	NoSync bool
+}
+
+// A WriteJournal durably records the writes that a file system acknowledges
+// before passing them on, such as those buffered by NewWriteBackFileSystem,
+// until they have been passed on successfully. After a crash, the journal
+// tells which writes may have been lost, and holds their data so that they can
+// be replayed.
+//
+// The journal is a file of records, each synced to stable storage before the
+// write it describes is acknowledged. It is emptied whenever no write is
+// outstanding.
+type WriteJournal struct {
+	opts JournalOptions
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	f       *os.File
+	nextSeq uint64
+	pending map[uint64]struct{}
+}
+
+// The kinds of journal record. A write record holds a sequence number, inode,
+// offset, length and data; an acknowledgement record a sequence number. Each
+// ends with the CRC-32 of what precedes it.
+const (
+	journalWrite byte = 'W'
+	journalAck   byte = 'A'
+)
+
+var errCorruptRecord = errors.New("corrupt journal record")
+
+// OpenWriteJournal opens the journal at the supplied path, creating it if
+// necessary, and returns the writes it records as outstanding, in the order in
+// which they were made. A record torn by a crash while it was being appended
+// is discarded, since the write it described was never acknowledged.
+//
+// Replaying the returned writes only makes sense if the file system's inode
+// IDs are stable across restarts; otherwise they can at least be reported.
+func OpenWriteJournal(
+	path string,
+	opts JournalOptions) (*WriteJournal, []JournaledWrite, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	writes, end, err := readJournal(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+
+	// Drop any torn record, and append after what remains.
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	j := &WriteJournal{
+		opts:    opts,
+		f:       f,
+		nextSeq: 1,
+		pending: make(map[uint64]struct{}),
+	}
+
+	var pending []JournaledWrite
+	for _, w := range writes {
+		if w.Seq >= j.nextSeq {
+			j.nextSeq = w.Seq + 1
+		}
+
+		pending = append(pending, w)
+		j.pending[w.Seq] = struct{}{}
+	}
+
+	return j, pending, nil
+}
+
+// Read the outstanding writes from the journal, returning them along with the
+// offset at which its intact records end.
+func readJournal(f *os.File) (writes []JournaledWrite, end int64, err error) {
+	r := bufio.NewReader(f)
+	acked := make(map[uint64]bool)
+	for {
+		w, n, err := readJournalRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errCorruptRecord {
+			break
+		}
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		end += n
+		if w.Data == nil {
+			acked[w.Seq] = true
+			continue
+		}
+
+		writes = append(writes, w)
+	}
+
+	outstanding := writes[:0]
+	for _, w := range writes {
+		if !acked[w.Seq] {
+			outstanding = append(outstanding, w)
+		}
+	}
+
+	return outstanding, end, nil
+}
+
+// Read a record, returning an acknowledgement as a write without data, and the
+// length of the record.
+func readJournalRecord(r *bufio.Reader) (w JournaledWrite, n int64, err error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return w, 0, err
+	}
+
+	var header []byte
+	switch kind {
+	case journalWrite:
+		header = make([]byte, 1+8+8+8+4)
+	case journalAck:
+		header = make([]byte, 1+8)
+	default:
+		return w, 0, errCorruptRecord
+	}
+
+	header[0] = kind
+	if _, err := io.ReadFull(r, header[1:]); err != nil {
+		return w, 0, io.ErrUnexpectedEOF
+	}
+
+	w.Seq = binary.LittleEndian.Uint64(header[1:])
+	record := header
+	if kind == journalWrite {
+		w.Inode = fuseops.InodeID(binary.LittleEndian.Uint64(header[9:]))
+		w.Offset = int64(binary.LittleEndian.Uint64(header[17:]))
+		w.Data = make([]byte, binary.LittleEndian.Uint32(header[25:]))
+		if _, err := io.ReadFull(r, w.Data); err != nil {
+			return w, 0, io.ErrUnexpectedEOF
+		}
+
+		record = append(record, w.Data...)
+	}
+
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return w, 0, io.ErrUnexpectedEOF
+	}
+
+	if binary.LittleEndian.Uint32(sum[:]) != crc32.ChecksumIEEE(record) {
+		return w, 0, errCorruptRecord
+	}
+
+	return w, int64(len(record) + len(sum)), nil
+}
+
+// LOCKS_REQUIRED(j.mu)
+func (j *WriteJournal) appendRecord(record []byte) error {
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.ChecksumIEEE(record))
+	record = append(record, sum[:]...)
+	if _, err := j.f.Write(record); err != nil {
+		return err
+	}
+
+	if j.opts.NoSync {
+		return nil
+	}
+
+	return j.f.Sync()
+}
+
+// Record a write about to be acknowledged, returning its sequence number.
+//
+// LOCKS_EXCLUDED(j.mu)
+func (j *WriteJournal) recordWrite(
+	inode fuseops.InodeID,
+	offset int64,
+	data []byte) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	seq := j.nextSeq
+	record := make([]byte, 1+8+8+8+4, 1+8+8+8+4+len(data)+4)
+	record[0] = journalWrite
+	binary.LittleEndian.PutUint64(record[1:], seq)
+	binary.LittleEndian.PutUint64(record[9:], uint64(inode))
+	binary.LittleEndian.PutUint64(record[17:], uint64(offset))
+	binary.LittleEndian.PutUint32(record[25:], uint32(len(data)))
+	record = append(record, data...)
+
+	if err := j.appendRecord(record); err != nil {
+		return 0, err
+	}
+
+	j.nextSeq++
+	j.pending[seq] = struct{}{}
+	return seq, nil
+}
+
+// Ack records that the writes with the supplied sequence numbers have reached
+// the file system behind the journal. Callers replaying the writes returned by
+// OpenWriteJournal must ack them in turn.
+//
+// LOCKS_EXCLUDED(j.mu)
+func (j *WriteJournal) Ack(seqs ...uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, seq := range seqs {
+		delete(j.pending, seq)
+	}
+
+	// Start afresh once nothing is outstanding, so that the journal doesn't
+	// grow without bound. The truncation isn't synced: if a crash loses it,
+	// the writes are reported as outstanding, erring on the side of caution.
+	if len(j.pending) == 0 {
+		if err := j.f.Truncate(0); err != nil {
+			return err
+		}
+
+		_, err := j.f.Seek(0, io.SeekStart)
+		return err
+	}
+
+	for _, seq := range seqs {
+		record := make([]byte, 1+8, 1+8+4)
+		record[0] = journalAck
+		binary.LittleEndian.PutUint64(record[1:], seq)
+		if err := j.appendRecord(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Outstanding returns the number of writes recorded but not yet acked.
+//
+// LOCKS_EXCLUDED(j.mu)
+func (j *WriteJournal) Outstanding() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return len(j.pending)
+}
+
+// Close closes the journal's file.
+//
+// LOCKS_EXCLUDED(j.mu)
+func (j *WriteJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.f.Close()
+}
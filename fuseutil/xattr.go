@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"io"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// The largest extended attribute value Linux will get or set, XATTR_SIZE_MAX.
+// Larger values can't be read through the kernel, which clamps the buffers
+// it asks for to this size.
+const MaxXattrSize = 64 << 10
+
+// The largest read ReadXattr makes at once.
+const xattrChunkSize = 16 << 10
+
+// Respond to op with the size-byte extended attribute value read from r,
+// following the kernel's conventions: an empty destination buffer is a probe
+// for the size, to which only the size is returned without reading anything,
+// and a buffer too small for the value fails with ERANGE, again without
+// reading. Otherwise the value is read in chunks of bounded size, so that
+// large values kept in e.g. an object store or a database blob need never be
+// held in memory or fetched in one request.
+//
+// A reader returning fewer than size bytes, which suggests the value changed
+// between the probe and the read, causes EIO.
+func ReadXattr(
+	op *fuseops.GetXattrOp,
+	r io.ReaderAt,
+	size int) error {
+	op.BytesRead = size
+	if len(op.Dst) == 0 {
+		return nil
+	}
+
+	if len(op.Dst) < size {
+		return syscall.ERANGE
+	}
+
+	for off := 0; off < size; {
+		end := off + xattrChunkSize
+		if end > size {
+			end = size
+		}
+
+		n, err := r.ReadAt(op.Dst[off:end], int64(off))
+		off += n
+		if err == io.EOF && off < size {
+			return syscall.EIO
+		}
+
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Respond to op with the given attribute names, with the same size-probe and
+// ERANGE conventions as ReadXattr.
+func ListXattrNames(
+	op *fuseops.ListXattrOp,
+	names []string) error {
+	size := 0
+	for _, name := range names {
+		size += len(name) + 1
+	}
+
+	op.BytesRead = size
+	if len(op.Dst) == 0 {
+		return nil
+	}
+
+	if len(op.Dst) < size {
+		return syscall.ERANGE
+	}
+
+	dst := op.Dst
+	for _, name := range names {
+		n := copy(dst, name)
+		dst[n] = 0
+		dst = dst[n+1:]
+	}
+
+	return nil
+}
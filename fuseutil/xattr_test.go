@@ -0,0 +1,100 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"io"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A reader that records the sizes of the reads made from it.
+type recordingReaderAt struct {
+	r     io.ReaderAt
+	sizes []int
+}
+
+func (r *recordingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return r.r.ReadAt(p, off)
+}
+
+func TestReadXattr(t *testing.T) {
+	value := bytes.Repeat([]byte("taco"), fuseutil.MaxXattrSize/4)
+	r := &recordingReaderAt{r: bytes.NewReader(value)}
+
+	// A probe reads nothing.
+	op := &fuseops.GetXattrOp{}
+	if err := fuseutil.ReadXattr(op, r, len(value)); err != nil || op.BytesRead != len(value) {
+		t.Errorf("Probe: %v, %d", err, op.BytesRead)
+	}
+
+	// Nor does a buffer that is too small.
+	op = &fuseops.GetXattrOp{Dst: make([]byte, len(value)-1)}
+	if err := fuseutil.ReadXattr(op, r, len(value)); err != syscall.ERANGE {
+		t.Errorf("Small buffer: got %v, want ERANGE", err)
+	}
+
+	if len(r.sizes) != 0 {
+		t.Errorf("Reads before the real one: %v", r.sizes)
+	}
+
+	// A large enough one is filled in chunks.
+	op = &fuseops.GetXattrOp{Dst: make([]byte, len(value)+10)}
+	if err := fuseutil.ReadXattr(op, r, len(value)); err != nil {
+		t.Fatalf("ReadXattr: %v", err)
+	}
+
+	if !bytes.Equal(op.Dst[:op.BytesRead], value) {
+		t.Errorf("Wrong value read")
+	}
+
+	if len(r.sizes) < 2 {
+		t.Errorf("Value read in one go: %v", r.sizes)
+	}
+
+	// A value that shrank since the probe is an error.
+	op = &fuseops.GetXattrOp{Dst: make([]byte, len(value)+10)}
+	if err := fuseutil.ReadXattr(op, r, len(value)+1); err != syscall.EIO {
+		t.Errorf("Short value: got %v, want EIO", err)
+	}
+}
+
+func TestListXattrNames(t *testing.T) {
+	names := []string{"user.foo", "user.bar"}
+
+	op := &fuseops.ListXattrOp{}
+	if err := fuseutil.ListXattrNames(op, names); err != nil || op.BytesRead != 18 {
+		t.Errorf("Probe: %v, %d", err, op.BytesRead)
+	}
+
+	op = &fuseops.ListXattrOp{Dst: make([]byte, 17)}
+	if err := fuseutil.ListXattrNames(op, names); err != syscall.ERANGE {
+		t.Errorf("Small buffer: got %v, want ERANGE", err)
+	}
+
+	op = &fuseops.ListXattrOp{Dst: make([]byte, 18)}
+	if err := fuseutil.ListXattrNames(op, names); err != nil {
+		t.Fatalf("ListXattrNames: %v", err)
+	}
+
+	if got := string(op.Dst); got != "user.foo\x00user.bar\x00" {
+		t.Errorf("Names: %q", got)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Account for an op on a file handle in the handle's statistics, if
+// MountConfig.EnableHandleStats is set, starting them when the handle is
+// opened. Ops that may name directory handles instead, such as locks and
+// ioctls, are left out.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) noteHandleUse(op interface{}, opErr error) {
+	if !c.cfg.EnableHandleStats {
+		return
+	}
+
+	var h fuseops.HandleID
+	var read, written int
+	switch o := op.(type) {
+	case *fuseops.OpenFileOp:
+		if opErr == nil {
+			c.startHandleStats(o.Handle)
+		}
+		return
+
+	case *fuseops.CreateFileOp:
+		if opErr == nil {
+			c.startHandleStats(o.Handle)
+		}
+		return
+
+	case *fuseops.ReadFileOp:
+		h, read = o.Handle, o.BytesRead
+
+	case *fuseops.WriteFileOp:
+		h, written = o.Handle, o.Written()
+
+	case *fuseops.SetInodeAttributesOp:
+		if o.Handle == nil {
+			return
+		}
+		h = *o.Handle
+
+	case *fuseops.SyncFileOp:
+		h = o.Handle
+
+	case *fuseops.FlushFileOp:
+		h = o.Handle
+
+	case *fuseops.FallocateOp:
+		h = o.Handle
+
+	case *fuseops.LseekOp:
+		h = o.Handle
+
+	case *fuseops.PollOp:
+		h = o.Handle
+
+	default:
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.handleStats[h]
+	if !ok {
+		return
+	}
+
+	s.LastUsed = time.Now()
+	switch op.(type) {
+	case *fuseops.ReadFileOp:
+		if opErr == nil {
+			s.Reads++
+			s.BytesRead += int64(read)
+		}
+
+	case *fuseops.WriteFileOp:
+		if opErr == nil {
+			s.Writes++
+			s.BytesWritten += int64(written)
+		}
+
+	default:
+		s.OtherOps++
+	}
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) startHandleStats(h fuseops.HandleID) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.handleStats[h] = &fuseops.HandleStats{
+		Opened:   now,
+		LastUsed: now,
+	}
+}
+
+// Hand a file handle's statistics over to the op releasing it.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) releaseHandleStats(op interface{}) {
+	o, ok := op.(*fuseops.ReleaseFileHandleOp)
+	if !ok || !c.cfg.EnableHandleStats {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	o.Stats = c.handleStats[o.Handle]
+	delete(c.handleStats, o.Handle)
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system with one file handle, whose reads fail past the first page,
+// sending on the statistics of released handles.
+type statsFS struct {
+	fuseutil.NotImplementedFileSystem
+	released chan *fuseops.HandleStats
+}
+
+func (fs *statsFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.Handle = 7
+	return nil
+}
+
+func (fs *statsFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if op.Offset >= 4096 {
+		return syscall.EIO
+	}
+
+	op.BytesRead = len(op.Dst)
+	return nil
+}
+
+func (fs *statsFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func (fs *statsFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.released <- op.Stats
+	return nil
+}
+
+func TestHandleStats(t *testing.T) {
+	fs := &statsFS{released: make(chan *fuseops.HandleStats, 1)}
+	kernel, _, hangUp := serveWithConfig(
+		t,
+		&fuse.MountConfig{EnableHandleStats: true},
+		fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	open := fusekernel.OpenIn{}
+	sendRequest(t, kernel, fusekernel.OpOpen, 1, (*[unsafe.Sizeof(open)]byte)(unsafe.Pointer(&open))[:])
+
+	read := func(unique uint64, offset uint64) {
+		in := fusekernel.ReadIn{Fh: 7, Offset: offset, Size: 4096}
+		sendRequest(t, kernel, fusekernel.OpRead, unique, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+	}
+
+	flush := fusekernel.FlushIn{Fh: 7}
+	release := fusekernel.ReleaseIn{Fh: 7}
+	steps := []func(){
+		func() { read(2, 0) },
+		func() { read(3, 4096) },
+		func() {
+			sendRequest(t, kernel, fusekernel.OpFlush, 4, (*[unsafe.Sizeof(flush)]byte)(unsafe.Pointer(&flush))[:])
+		},
+		func() {
+			sendRequest(t, kernel, fusekernel.OpRelease, 5, (*[unsafe.Sizeof(release)]byte)(unsafe.Pointer(&release))[:])
+		},
+	}
+
+	// Send each op once the previous one has been replied to.
+	readReply(t, kernel)
+	for _, step := range steps {
+		step()
+		readReply(t, kernel)
+	}
+
+	s := <-fs.released
+	if s == nil {
+		t.Fatalf("No statistics for the released handle")
+	}
+
+	if s.Reads != 1 || s.BytesRead != 4096 || s.Writes != 0 || s.OtherOps != 1 {
+		t.Errorf("Statistics: %+v", s)
+	}
+
+	if s.Opened.IsZero() || s.LastUsed.Before(s.Opened) {
+		t.Errorf("Times: opened %v, last used %v", s.Opened, s.LastUsed)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+
+	"github.com/folays/jacobsa_fuse/internal/buffer"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// The kernel's INIT request, as passed to MountConfig.AdjustInit.
+type InitRequest struct {
+	// The protocol version spoken by the kernel.
+	Major uint32
+	Minor uint32
+
+	// The kernel's limit on read ahead, in bytes.
+	MaxReadahead uint32
+
+	// The FUSE_* INIT flags offered by the kernel, as in linux/fuse.h, split
+	// into the low and the high 32 bits. Flags2 is zero unless Flags has
+	// FUSE_INIT_EXT.
+	Flags  uint32
+	Flags2 uint32
+}
+
+// The reply to the kernel's INIT request, as passed to MountConfig.AdjustInit.
+type InitResponse struct {
+	// The FUSE_* INIT flags asked for, as in linux/fuse.h, split as for
+	// InitRequest. Flags2 is only sent if Flags has FUSE_INIT_EXT. On Linux,
+	// flags the kernel didn't offer are dropped.
+	Flags  uint32
+	Flags2 uint32
+
+	// The limit on read ahead, in bytes. The kernel uses the smaller of this
+	// and its own limit.
+	MaxReadahead uint32
+
+	// The number of background requests, such as read ahead and asynchronous
+	// direct I/O, the kernel may have outstanding, and the number beyond which
+	// it considers the file system congested.
+	MaxBackground       uint16
+	CongestionThreshold uint16
+
+	// The largest write, in bytes, and the largest request, in pages. MaxWrite
+	// is clamped to between 4 KiB and the size of the connection's buffers,
+	// and MaxPages to between 1 and 256. MaxPages is ignored unless Flags
+	// contains FUSE_MAX_PAGES.
+	MaxWrite uint32
+	MaxPages uint16
+}
+
+// Limits on InitResponse.MaxWrite and MaxPages.
+const (
+	minInitMaxWrite = 4096
+	maxInitMaxPages = 256
+)
+
+// Pass the init op to the config's AdjustInit, if any, and apply what it
+// returns within the limits the connection can handle.
+func (c *Connection) adjustInit(op *initOp, kernel InitRequest) {
+	if c.cfg.AdjustInit == nil {
+		return
+	}
+
+	resp := InitResponse{
+		Flags:               uint32(op.Flags),
+		Flags2:              uint32(op.Flags2),
+		MaxReadahead:        op.MaxReadahead,
+		MaxBackground:       op.MaxBackground,
+		CongestionThreshold: op.CongestionThreshold,
+		MaxWrite:            op.MaxWrite,
+		MaxPages:            op.MaxPages,
+	}
+
+	c.cfg.AdjustInit(kernel, &resp)
+
+	switch {
+	case resp.MaxWrite < minInitMaxWrite:
+		resp.MaxWrite = minInitMaxWrite
+	case resp.MaxWrite > buffer.MaxWriteSize:
+		resp.MaxWrite = buffer.MaxWriteSize
+	}
+
+	switch {
+	case resp.MaxPages < 1:
+		resp.MaxPages = 1
+	case resp.MaxPages > maxInitMaxPages:
+		resp.MaxPages = maxInitMaxPages
+	}
+
+	op.Flags = fusekernel.InitFlags(resp.Flags)
+	op.Flags2 = fusekernel.InitFlags2(resp.Flags2)
+	op.MaxReadahead = resp.MaxReadahead
+	op.MaxBackground = resp.MaxBackground
+	op.CongestionThreshold = resp.CongestionThreshold
+	op.MaxWrite = resp.MaxWrite
+	op.MaxPages = resp.MaxPages
+}
+
+// The sizes of the transfers agreed with the kernel when mounting, which
+// servers can use to size their own buffers and requests to a backend. See
+// Connection.TransferLimits.
+type TransferLimits struct {
+	// The most the kernel reads ahead of a sequential reader, in bytes: the
+	// smaller of its own limit and the one asked for, per
+	// MountConfig.MaxReadahead.
+	MaxReadahead uint32
+
+	// The largest WriteFileOp the kernel sends, in bytes, per
+	// MountConfig.MaxWrite.
+	MaxWrite uint32
+
+	// The largest request the kernel sends, in pages, per MountConfig.MaxPages,
+	// and thus the largest ReadFileOp, in bytes. Kernels without FUSE_MAX_PAGES
+	// (Linux < 4.20) send at most 32 pages.
+	MaxPages uint16
+	MaxRead  uint32
+}
+
+// The number of pages in a request for kernels that don't negotiate it.
+const defaultMaxPages = 32
+
+// Work out the limits agreed by the reply to the kernel's INIT request, which
+// offered the supplied flags.
+func agreedLimits(
+	kernel InitRequest,
+	kernelFlags fusekernel.InitFlags,
+	op *initOp) TransferLimits {
+	l := TransferLimits{
+		MaxReadahead: op.MaxReadahead,
+		MaxWrite:     op.MaxWrite,
+		MaxPages:     defaultMaxPages,
+	}
+
+	if kernel.MaxReadahead < l.MaxReadahead {
+		l.MaxReadahead = kernel.MaxReadahead
+	}
+
+	if op.Flags&kernelFlags&fusekernel.InitMaxPages != 0 {
+		l.MaxPages = op.MaxPages
+	}
+
+	l.MaxRead = uint32(l.MaxPages) * uint32(os.Getpagesize())
+	return l
+}
+
+// TransferLimits returns the transfer sizes agreed with the kernel, or zero
+// before Init.
+func (c *Connection) TransferLimits() TransferLimits {
+	return c.limits
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// Connect with the given config to a kernel sending the given init request,
+// returning the kernel's end and the reply to the request.
+func initWithConfig(
+	t *testing.T,
+	cfg *fuse.MountConfig,
+	in fusekernel.InitIn) (kernel *os.File, c *fuse.Connection, out *fusekernel.InitOut) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	dev := os.NewFile(uintptr(fds[0]), "dev")
+	kernel = os.NewFile(uintptr(fds[1]), "kernel")
+
+	in.Major = fusekernel.ProtoVersionMaxMajor
+	in.Minor = fusekernel.ProtoVersionMaxMinor
+	sendRequest(t, kernel, fusekernel.OpInit, 0, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+
+	c, err = fuse.NewConnection(cfg, dev)
+	if err != nil {
+		t.Fatalf("NewConnection: %v", err)
+	}
+
+	r := readReply(t, kernel)
+	if r.errno != 0 {
+		t.Fatalf("Init reply: %+v", r)
+	}
+
+	return kernel, c, (*fusekernel.InitOut)(unsafe.Pointer(&r.data[0]))
+}
+
+func TestAdjustInit(t *testing.T) {
+	offered := fusekernel.InitAsyncRead | fusekernel.InitWritebackCache
+
+	// The hook sees the kernel's request, and may change the reply within
+	// limits.
+	var seen fuse.InitRequest
+	cfg := &fuse.MountConfig{
+		EnableAsyncReads: true,
+		AdjustInit: func(kernel fuse.InitRequest, resp *fuse.InitResponse) {
+			seen = kernel
+			resp.Flags &^= uint32(fusekernel.InitWritebackCache)
+			resp.MaxBackground = 64
+			resp.CongestionThreshold = 48
+			resp.MaxWrite = 1 << 30
+			resp.MaxPages = 0
+		},
+	}
+
+	kernel, c, out := initWithConfig(t, cfg, fusekernel.InitIn{
+		MaxReadahead: 1 << 17,
+		Flags:        uint32(offered),
+	})
+	defer kernel.Close()
+	defer c.Close()
+
+	if seen.MaxReadahead != 1<<17 || seen.Flags != uint32(offered) {
+		t.Errorf("InitRequest: %+v", seen)
+	}
+
+	if out.Flags != uint32(fusekernel.InitAsyncRead) {
+		t.Errorf("Flags: %v", fusekernel.InitFlags(out.Flags))
+	}
+
+	if out.MaxBackground != 64 || out.CongestionThreshold != 48 {
+		t.Errorf("Background limits: %d, %d", out.MaxBackground, out.CongestionThreshold)
+	}
+
+	if out.MaxWrite != 1<<20 || out.MaxPages != 1 {
+		t.Errorf("Clamped limits: %d, %d", out.MaxWrite, out.MaxPages)
+	}
+
+	if c.WritebackCaching() {
+		t.Errorf("Writeback caching enabled despite the hook")
+	}
+}
+
+func TestMaxWrite(t *testing.T) {
+	kernel, c, out := initWithConfig(t, &fuse.MountConfig{MaxWrite: 16 << 10}, fusekernel.InitIn{})
+	defer kernel.Close()
+	defer c.Close()
+
+	if out.MaxWrite != 16<<10 {
+		t.Errorf("MaxWrite: %d", out.MaxWrite)
+	}
+
+	// Sizes the kernel wouldn't accept are refused.
+	_, err := fuse.NewConnection(&fuse.MountConfig{MaxWrite: 100}, nil)
+	if err == nil {
+		t.Errorf("NewConnection accepted a MaxWrite of 100")
+	}
+}
+
+func TestTransferLimits(t *testing.T) {
+	cfg := &fuse.MountConfig{
+		MaxReadahead: 4 << 20,
+		MaxPages:     64,
+	}
+
+	// The kernel lowers read ahead to its own limit.
+	kernel, c, out := initWithConfig(t, cfg, fusekernel.InitIn{
+		MaxReadahead: 2 << 20,
+		Flags:        uint32(fusekernel.InitMaxPages),
+	})
+	defer kernel.Close()
+	defer c.Close()
+
+	if out.MaxReadahead != 4<<20 || out.MaxPages != 64 {
+		t.Errorf("Init reply: %+v", out)
+	}
+
+	want := fuse.TransferLimits{
+		MaxReadahead: 2 << 20,
+		MaxWrite:     1 << 20,
+		MaxPages:     64,
+		MaxRead:      64 * uint32(os.Getpagesize()),
+	}
+
+	if l := c.TransferLimits(); l != want {
+		t.Errorf("TransferLimits: %+v, want %+v", l, want)
+	}
+
+	// Kernels that don't negotiate the number of pages send 32.
+	kernel2, c2, _ := initWithConfig(t, cfg, fusekernel.InitIn{MaxReadahead: 2 << 20})
+	defer kernel2.Close()
+	defer c2.Close()
+
+	if l := c2.TransferLimits(); l.MaxPages != 32 {
+		t.Errorf("TransferLimits without FUSE_MAX_PAGES: %+v", l)
+	}
+
+	if _, err := fuse.NewConnection(&fuse.MountConfig{MaxPages: 1000}, nil); err == nil {
+		t.Errorf("NewConnection accepted a MaxPages of 1000")
+	}
+}
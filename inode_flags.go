@@ -0,0 +1,339 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// The flags we enforce. See fuseops.InodeFlags.
+const enforcedInodeFlags = fuseops.InodeImmutable | fuseops.InodeAppendOnly
+
+// A directory entry.
+type dirent struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+// Local file systems have the kernel refuse to modify immutable and
+// append-only inodes, but the kernel doesn't know the flags of a fuse file
+// system's inodes. An inodeFlagTracker learns them from the replies to the
+// kernel, and refuses the ops the kernel would have refused.
+//
+// Removing or renaming an entry is refused according to the flags of its
+// inode, which the kernel names only by its parent and name. So we also
+// remember the entries of flagged inodes from the lookups that the kernel
+// must have made before removing or renaming them.
+//
+// The kernel may forget an inode in parts, so we also count the lookups it
+// holds on each inode, and drop what we know of an inode only once it has
+// forgotten all of them.
+type inodeFlagTracker struct {
+	// The number of entries in flags, so that checking ops while no inode is
+	// flagged, as is usual, needn't take the lock. Written with mu held.
+	flagged int64 // atomic
+
+	mu sync.Mutex
+
+	// The flags of every inode that has any we enforce.
+	//
+	// GUARDED_BY(mu)
+	flags map[fuseops.InodeID]fuseops.InodeFlags
+
+	// The inodes of the entries last looked up, or created, with flags.
+	//
+	// GUARDED_BY(mu)
+	entries map[dirent]fuseops.InodeID
+
+	// The kernel's lookup count of each inode returned to it in an entry.
+	//
+	// GUARDED_BY(mu)
+	lookups map[fuseops.InodeID]uint64
+}
+
+func newInodeFlagTracker() *inodeFlagTracker {
+	return &inodeFlagTracker{
+		flags:   make(map[fuseops.InodeID]fuseops.InodeFlags),
+		entries: make(map[dirent]fuseops.InodeID),
+		lookups: make(map[fuseops.InodeID]uint64),
+	}
+}
+
+// LOCKS_REQUIRED(t.mu)
+func (t *inodeFlagTracker) setFlags(
+	id fuseops.InodeID,
+	flags fuseops.InodeFlags) {
+	flags &= enforcedInodeFlags
+	if flags == 0 {
+		delete(t.flags, id)
+	} else {
+		t.flags[id] = flags
+	}
+
+	atomic.StoreInt64(&t.flagged, int64(len(t.flags)))
+}
+
+// LOCKS_REQUIRED(t.mu)
+func (t *inodeFlagTracker) setEntry(
+	parent fuseops.InodeID,
+	name string,
+	e *fuseops.ChildInodeEntry) {
+	d := dirent{parent, name}
+	if e.Child == 0 {
+		delete(t.entries, d)
+		return
+	}
+
+	t.lookups[e.Child]++
+	t.setFlags(e.Child, e.Attributes.Flags)
+
+	if e.Attributes.Flags&enforcedInodeFlags == 0 {
+		delete(t.entries, d)
+		return
+	}
+
+	t.entries[d] = e.Child
+}
+
+// Return the flags of the entry's inode, if known.
+//
+// LOCKS_REQUIRED(t.mu)
+func (t *inodeFlagTracker) entryFlags(
+	parent fuseops.InodeID,
+	name string) fuseops.InodeFlags {
+	id, ok := t.entries[dirent{parent, name}]
+	if !ok {
+		return 0
+	}
+
+	return t.flags[id]
+}
+
+// Return EPERM if the op must be refused because of the flags of the inodes
+// it would modify.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *inodeFlagTracker) check(op interface{}) error {
+	if atomic.LoadInt64(&t.flagged) == 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	const (
+		immutable = fuseops.InodeImmutable
+		frozen    = fuseops.InodeImmutable | fuseops.InodeAppendOnly
+	)
+
+	var refused bool
+	switch o := op.(type) {
+	case *fuseops.SetInodeAttributesOp:
+		// Append-only inodes may have their times set, e.g. by writes.
+		flags := t.flags[o.Inode]
+		refused = flags&immutable != 0 ||
+			flags&frozen != 0 && (o.Size != nil || o.Mode != nil || o.Uid != nil || o.Gid != nil)
+
+	case *fuseops.OpenFileOp:
+		flags := t.flags[o.Inode]
+		if !o.OpenFlags.IsReadOnly() {
+			refused = flags&immutable != 0 ||
+				flags&frozen != 0 && o.OpenFlags&fusekernel.OpenAppend == 0
+		}
+
+		if o.OpenFlags&fusekernel.OpenTruncate != 0 {
+			refused = refused || flags&frozen != 0
+		}
+
+	case *fuseops.WriteFileOp:
+		refused = t.flags[o.Inode]&immutable != 0
+
+	case *fuseops.FallocateOp:
+		flags := t.flags[o.Inode]
+		refused = flags&immutable != 0 ||
+			flags&frozen != 0 && o.Mode&^fuseops.FallocateKeepSize != 0
+
+	case *fuseops.SetXattrOp:
+		refused = t.flags[o.Inode]&frozen != 0
+
+	case *fuseops.RemoveXattrOp:
+		refused = t.flags[o.Inode]&frozen != 0
+
+	case *fuseops.MkDirOp:
+		refused = t.flags[o.Parent]&immutable != 0
+
+	case *fuseops.MkNodeOp:
+		refused = t.flags[o.Parent]&immutable != 0
+
+	case *fuseops.CreateFileOp:
+		refused = t.flags[o.Parent]&immutable != 0
+
+	case *fuseops.CreateSymlinkOp:
+		refused = t.flags[o.Parent]&immutable != 0
+
+	case *fuseops.CreateLinkOp:
+		refused = t.flags[o.Parent]&immutable != 0 || t.flags[o.Target]&frozen != 0
+
+	case *fuseops.UnlinkOp:
+		refused = t.flags[o.Parent]&frozen != 0 || t.entryFlags(o.Parent, o.Name)&frozen != 0
+
+	case *fuseops.RmDirOp:
+		refused = t.flags[o.Parent]&frozen != 0 || t.entryFlags(o.Parent, o.Name)&frozen != 0
+
+	case *fuseops.RenameOp:
+		refused = t.flags[o.OldParent]&frozen != 0 ||
+			t.flags[o.NewParent]&immutable != 0 ||
+			t.entryFlags(o.OldParent, o.OldName)&frozen != 0 ||
+			t.entryFlags(o.NewParent, o.NewName)&frozen != 0
+
+		// Exchanging also moves the entry at the new name out of its parent.
+		if o.Flags&fuseops.RenameExchange != 0 {
+			refused = refused || t.flags[o.NewParent]&frozen != 0
+		}
+	}
+
+	if refused {
+		return syscall.EPERM
+	}
+
+	return nil
+}
+
+// Learn what we can from the reply to an op that succeeded.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *inodeFlagTracker) observe(op interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		t.setEntry(o.Parent, o.Name, &o.Entry)
+
+	case *fuseops.MkDirOp:
+		t.setEntry(o.Parent, o.Name, &o.Entry)
+
+	case *fuseops.MkNodeOp:
+		t.setEntry(o.Parent, o.Name, &o.Entry)
+
+	case *fuseops.CreateFileOp:
+		t.setEntry(o.Parent, o.Name, &o.Entry)
+
+	case *fuseops.CreateSymlinkOp:
+		t.setEntry(o.Parent, o.Name, &o.Entry)
+
+	case *fuseops.CreateLinkOp:
+		t.setEntry(o.Parent, o.Name, &o.Entry)
+
+	case *fuseops.GetInodeAttributesOp:
+		t.setFlags(o.Inode, o.Attributes.Flags)
+
+	case *fuseops.SetInodeAttributesOp:
+		t.setFlags(o.Inode, o.Attributes.Flags)
+
+	case *fuseops.GetInodeFlagsOp:
+		t.setFlags(o.Inode, o.Flags)
+
+	case *fuseops.SetInodeFlagsOp:
+		t.setFlags(o.Inode, o.Flags)
+
+	case *fuseops.UnlinkOp:
+		delete(t.entries, dirent{o.Parent, o.Name})
+
+	case *fuseops.RmDirOp:
+		delete(t.entries, dirent{o.Parent, o.Name})
+
+	case *fuseops.RenameOp:
+		// Renaming a flagged entry is refused, so the entry being renamed isn't
+		// one we know, but the one it replaces may be.
+		delete(t.entries, dirent{o.NewParent, o.NewName})
+
+	case *fuseops.ReadDirPlusOp:
+		t.countDirentsPlus(o.Dst[:o.BytesRead])
+
+	case *fuseops.ForgetInodeOp:
+		t.forget(o.Inode, o.N)
+
+	case *fuseops.BatchForgetOp:
+		for _, e := range o.Entries {
+			t.forget(e.Inode, e.N)
+		}
+	}
+}
+
+// Count the lookups made by the entries of a ReadDirPlusOp's reply, which
+// carry no flags.
+//
+// LOCKS_REQUIRED(t.mu)
+func (t *inodeFlagTracker) countDirentsPlus(b []byte) {
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	const headerSize = int(unsafe.Sizeof(direntHeader{}))
+
+	for len(b) >= entrySize+headerSize {
+		var e fusekernel.EntryOut
+		copy((*[entrySize]byte)(unsafe.Pointer(&e))[:], b)
+
+		var h direntHeader
+		copy((*[headerSize]byte)(unsafe.Pointer(&h))[:], b[entrySize:])
+
+		n := entrySize + headerSize + int(h.namelen)
+		if n > len(b) {
+			return
+		}
+
+		name := string(b[entrySize+headerSize : n])
+		if e.Nodeid != 0 && name != "." && name != ".." {
+			t.lookups[fuseops.InodeID(e.Nodeid)]++
+		}
+
+		if n%direntAlignment != 0 {
+			n += direntAlignment - n%direntAlignment
+		}
+
+		if n > len(b) {
+			return
+		}
+
+		b = b[n:]
+	}
+}
+
+// Drop what we know of an inode once the kernel has forgotten all its lookups
+// of it. Inodes we saw no lookups of, such as the root, are dropped at once.
+//
+// LOCKS_REQUIRED(t.mu)
+func (t *inodeFlagTracker) forget(id fuseops.InodeID, n uint64) {
+	if count := t.lookups[id]; count > n {
+		t.lookups[id] = count - n
+		return
+	}
+
+	delete(t.lookups, id)
+	delete(t.flags, id)
+	atomic.StoreInt64(&t.flagged, int64(len(t.flags)))
+
+	// Flagged inodes are few, and so are their entries.
+	for d, child := range t.entries {
+		if child == id {
+			delete(t.entries, d)
+		}
+	}
+}
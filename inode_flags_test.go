@@ -0,0 +1,127 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+func TestInodeFlagTracker(t *testing.T) {
+	tr := newInodeFlagTracker()
+
+	// A file looked up with the append-only flag, in a plain directory.
+	tr.observe(&fuseops.LookUpInodeOp{
+		Parent: 1,
+		Name:   "log",
+		Entry: fuseops.ChildInodeEntry{
+			Child:      17,
+			Attributes: fuseops.InodeAttributes{Flags: fuseops.InodeAppendOnly},
+		},
+	})
+
+	// And a directory made immutable with chattr.
+	tr.observe(&fuseops.SetInodeFlagsOp{Inode: 19, Flags: fuseops.InodeImmutable})
+
+	testCases := []struct {
+		op      interface{}
+		refused bool
+	}{
+		{&fuseops.OpenFileOp{Inode: 17, OpenFlags: fusekernel.OpenReadOnly}, false},
+		{&fuseops.OpenFileOp{Inode: 17, OpenFlags: fusekernel.OpenWriteOnly}, true},
+		{&fuseops.OpenFileOp{Inode: 17, OpenFlags: fusekernel.OpenWriteOnly | fusekernel.OpenAppend}, false},
+		{&fuseops.WriteFileOp{Inode: 17}, false},
+		{&fuseops.SetInodeAttributesOp{Inode: 17, Size: new(uint64)}, true},
+		{&fuseops.SetXattrOp{Inode: 17}, true},
+		{&fuseops.UnlinkOp{Parent: 1, Name: "log"}, true},
+		{&fuseops.UnlinkOp{Parent: 1, Name: "other"}, false},
+		{&fuseops.RenameOp{OldParent: 1, OldName: "log", NewParent: 1, NewName: "x"}, true},
+		{&fuseops.CreateFileOp{Parent: 19, Name: "x"}, true},
+		{&fuseops.MkDirOp{Parent: 1, Name: "x"}, false},
+		{&fuseops.RmDirOp{Parent: 19, Name: "x"}, true},
+		{&fuseops.SetInodeAttributesOp{Inode: 19}, true},
+	}
+
+	for _, tc := range testCases {
+		err := tr.check(tc.op)
+		if tc.refused && err != syscall.EPERM || !tc.refused && err != nil {
+			t.Errorf("%s: got %v, refused: %v", describeRequest(tc.op), err, tc.refused)
+		}
+	}
+
+	// Clearing the flags or forgetting the inodes lifts the restrictions.
+	tr.observe(&fuseops.GetInodeAttributesOp{Inode: 19})
+	tr.observe(&fuseops.ForgetInodeOp{Inode: 17, N: 1})
+
+	if err := tr.check(&fuseops.CreateFileOp{Parent: 19, Name: "x"}); err != nil {
+		t.Errorf("CreateFile after clearing: %v", err)
+	}
+
+	if err := tr.check(&fuseops.UnlinkOp{Parent: 1, Name: "log"}); err != nil {
+		t.Errorf("Unlink after forgetting: %v", err)
+	}
+}
+
+func TestInodeFlagTrackerPartialForget(t *testing.T) {
+	tr := newInodeFlagTracker()
+
+	// An immutable file looked up twice, and returned once more by
+	// ReadDirPlus.
+	lookUp := &fuseops.LookUpInodeOp{
+		Parent: 1,
+		Name:   "frozen",
+		Entry: fuseops.ChildInodeEntry{
+			Child:      17,
+			Attributes: fuseops.InodeAttributes{Flags: fuseops.InodeImmutable},
+		},
+	}
+	tr.observe(lookUp)
+	tr.observe(lookUp)
+
+	var dst []byte
+	for i, name := range []string{".", "frozen"} {
+		e := fusekernel.EntryOut{Nodeid: 1}
+		if name == "frozen" {
+			e.Nodeid = 17
+		}
+
+		h := direntHeader{ino: e.Nodeid, off: uint64(i + 1), namelen: uint32(len(name))}
+		dst = append(dst, (*[unsafe.Sizeof(e)]byte)(unsafe.Pointer(&e))[:]...)
+		dst = append(dst, (*[unsafe.Sizeof(h)]byte)(unsafe.Pointer(&h))[:]...)
+		dst = append(dst, name...)
+		for len(dst)%direntAlignment != 0 {
+			dst = append(dst, 0)
+		}
+	}
+	tr.observe(&fuseops.ReadDirPlusOp{Inode: 1, Dst: dst, BytesRead: len(dst)})
+
+	write := &fuseops.WriteFileOp{Inode: 17}
+	for _, forget := range []uint64{1, 1} {
+		tr.observe(&fuseops.ForgetInodeOp{Inode: 17, N: forget})
+		if err := tr.check(write); err != syscall.EPERM {
+			t.Fatalf("Write after a partial forget: %v", err)
+		}
+	}
+
+	// Once the kernel has forgotten every lookup, the flags go.
+	tr.observe(&fuseops.BatchForgetOp{Entries: []fuseops.BatchForgetEntry{{Inode: 17, N: 1}}})
+	if err := tr.check(write); err != nil {
+		t.Errorf("Write after forgetting: %v", err)
+	}
+}
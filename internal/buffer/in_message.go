@@ -27,13 +27,8 @@ import (
 // this.
 var pageSize int
 
-// We size the buffer to have enough room for a fuse request plus data
-// associated with a write request.
-var bufSize int
-
 func init() {
 	pageSize = syscall.Getpagesize()
-	bufSize = pageSize + MaxWriteSize
 }
 
 // An incoming message from the kernel, including leading fusekernel.InHeader
@@ -45,10 +40,12 @@ type InMessage struct {
 	size      int
 }
 
-// NewInMessage creates a new InMessage with its storage initialized.
-func NewInMessage() *InMessage {
+// NewInMessage creates a new InMessage with its storage initialized, with
+// enough room for a fuse request plus the data of a write request of up to
+// maxWrite bytes, which must be at most MaxWriteSize.
+func NewInMessage(maxWrite int) *InMessage {
 	return &InMessage{
-		storage: make([]byte, bufSize),
+		storage: make([]byte, pageSize+maxWrite),
 	}
 }
 
@@ -81,6 +78,31 @@ func (m *InMessage) Init(r io.Reader) error {
 	return nil
 }
 
+// InitFromStream is like Init, but for a stream that doesn't preserve message
+// boundaries (e.g. fuse-t's socket): it reads the header, then exactly as many
+// more bytes as the header says the message holds.
+func (m *InMessage) InitFromStream(r io.Reader) error {
+	const headerSize = unsafe.Sizeof(fusekernel.InHeader{})
+	if _, err := io.ReadFull(r, m.storage[:headerSize]); err != nil {
+		return err
+	}
+
+	// Make sure the message fits.
+	n := int(m.Header().Len)
+	if n < int(headerSize) || n > len(m.storage) {
+		return fmt.Errorf("Header says %d bytes, which is out of range", n)
+	}
+
+	if _, err := io.ReadFull(r, m.storage[headerSize:n]); err != nil {
+		return err
+	}
+
+	m.size = n
+	m.remaining = m.storage[headerSize:n]
+
+	return nil
+}
+
 // Return a reference to the header read in the most recent call to Init.
 func (m *InMessage) Header() *fusekernel.InHeader {
 	return (*fusekernel.InHeader)(unsafe.Pointer(&m.storage[0]))
@@ -0,0 +1,76 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package buffer
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// Return a message with the supplied opcode and payload, as sent by the kernel.
+func inMessageBytes(opcode uint32, payload string) []byte {
+	h := fusekernel.InHeader{
+		Len:    uint32(unsafe.Sizeof(fusekernel.InHeader{})) + uint32(len(payload)),
+		Opcode: opcode,
+	}
+
+	b := toByteSlice(unsafe.Pointer(&h), int(unsafe.Sizeof(h)))
+	return append(append([]byte(nil), b...), payload...)
+}
+
+func TestInMessageInitFromStream(t *testing.T) {
+	// Two messages back to back, as read from a stream socket.
+	var stream bytes.Buffer
+	stream.Write(inMessageBytes(fusekernel.OpLookup, "taco\x00"))
+	stream.Write(inMessageBytes(fusekernel.OpGetattr, ""))
+
+	m := NewInMessage(MaxWriteSize)
+	if err := m.InitFromStream(&stream); err != nil {
+		t.Fatalf("InitFromStream: %v", err)
+	}
+
+	if m.Header().Opcode != fusekernel.OpLookup {
+		t.Errorf("Opcode: got %v", m.Header().Opcode)
+	}
+
+	if got := string(m.ConsumeBytes(m.Len())); got != "taco\x00" {
+		t.Errorf("Payload: got %q", got)
+	}
+
+	if err := m.InitFromStream(&stream); err != nil {
+		t.Fatalf("InitFromStream: %v", err)
+	}
+
+	if m.Header().Opcode != fusekernel.OpGetattr || m.Len() != 0 {
+		t.Errorf("Second message: opcode %v, %d bytes left", m.Header().Opcode, m.Len())
+	}
+
+	if err := m.InitFromStream(&stream); err != io.EOF {
+		t.Errorf("Expected io.EOF at the end of the stream, got %v", err)
+	}
+}
+
+func TestInMessageInitFromStreamTruncated(t *testing.T) {
+	b := inMessageBytes(fusekernel.OpLookup, "taco\x00")
+
+	m := NewInMessage(MaxWriteSize)
+	if err := m.InitFromStream(bytes.NewReader(b[:len(b)-1])); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
@@ -66,7 +66,7 @@ type Kstatfs struct {
 	Spare   [6]uint32
 }
 
-type fileLock struct {
+type FileLock struct {
 	Start uint64
 	End   uint64
 	Type  uint32
@@ -106,6 +106,7 @@ const (
 	SetattrAtimeNow  SetattrValid = 1 << 7
 	SetattrMtimeNow  SetattrValid = 1 << 8
 	SetattrLockOwner SetattrValid = 1 << 9 // http://www.mail-archive.com/git-commits-head@vger.kernel.org/msg27852.html
+	SetattrCtime     SetattrValid = 1 << 10
 
 	// OS X only
 	SetattrCrtime   SetattrValid = 1 << 28
@@ -124,6 +125,7 @@ func (fl SetattrValid) Handle() bool    { return fl&SetattrHandle != 0 }
 func (fl SetattrValid) AtimeNow() bool  { return fl&SetattrAtimeNow != 0 }
 func (fl SetattrValid) MtimeNow() bool  { return fl&SetattrMtimeNow != 0 }
 func (fl SetattrValid) LockOwner() bool { return fl&SetattrLockOwner != 0 }
+func (fl SetattrValid) Ctime() bool     { return fl&SetattrCtime != 0 }
 func (fl SetattrValid) Crtime() bool    { return fl&SetattrCrtime != 0 }
 func (fl SetattrValid) Chgtime() bool   { return fl&SetattrChgtime != 0 }
 func (fl SetattrValid) Bkuptime() bool  { return fl&SetattrBkuptime != 0 }
@@ -144,6 +146,7 @@ var setattrValidNames = []flagName{
 	{uint32(SetattrAtimeNow), "SetattrAtimeNow"},
 	{uint32(SetattrMtimeNow), "SetattrMtimeNow"},
 	{uint32(SetattrLockOwner), "SetattrLockOwner"},
+	{uint32(SetattrCtime), "SetattrCtime"},
 	{uint32(SetattrCrtime), "SetattrCrtime"},
 	{uint32(SetattrChgtime), "SetattrChgtime"},
 	{uint32(SetattrBkuptime), "SetattrBkuptime"},
@@ -164,6 +167,7 @@ const (
 	OpenExclusive OpenFlags = syscall.O_EXCL
 	OpenSync      OpenFlags = syscall.O_SYNC
 	OpenTruncate  OpenFlags = syscall.O_TRUNC
+	OpenNonblock  OpenFlags = syscall.O_NONBLOCK
 )
 
 // OpenAccessModeMask is a bitmask that separates the access mode
@@ -199,6 +203,24 @@ func (fl OpenFlags) IsReadWrite() bool {
 	return fl&OpenAccessModeMask == OpenReadWrite
 }
 
+// Return true if OpenNonblock is set, i.e. the caller doesn't want to wait for
+// reads and writes.
+func (fl OpenFlags) IsNonblock() bool {
+	return fl&OpenNonblock != 0
+}
+
+// Return true if OpenDirect is set, i.e. the file was opened with O_DIRECT.
+// Always false on OS X.
+func (fl OpenFlags) IsDirect() bool {
+	return fl&OpenDirect != 0
+}
+
+// Return true if OpenExec is set, i.e. the kernel is opening the file to
+// execute it or load it as a shared library. Always false on OS X.
+func (fl OpenFlags) IsExec() bool {
+	return fl&OpenExec != 0
+}
+
 func accModeName(flags OpenFlags) string {
 	switch flags {
 	case OpenReadOnly:
@@ -218,6 +240,8 @@ var openFlagNames = []flagName{
 	{uint32(OpenTruncate), "OpenTruncate"},
 	{uint32(OpenAppend), "OpenAppend"},
 	{uint32(OpenSync), "OpenSync"},
+	{uint32(OpenDirect), "OpenDirect"},
+	{uint32(OpenExec), "OpenExec"},
 }
 
 // The OpenResponseFlags are returned in the OpenResponse.
@@ -227,6 +251,8 @@ const (
 	OpenDirectIO    OpenResponseFlags = 1 << 0 // bypass page cache for this open file
 	OpenKeepCache   OpenResponseFlags = 1 << 1 // don't invalidate the data cache on open
 	OpenNonSeekable OpenResponseFlags = 1 << 2 // mark the file as non-seekable (not supported on OS X)
+	OpenCacheDir    OpenResponseFlags = 1 << 3 // allow caching this directory
+	OpenPassthrough OpenResponseFlags = 1 << 7 // do reads and writes on OpenOut.BackingID (Linux >= 6.9)
 
 	OpenPurgeAttr OpenResponseFlags = 1 << 30 // OS X
 	OpenPurgeUBC  OpenResponseFlags = 1 << 31 // OS X
@@ -240,6 +266,7 @@ var openResponseFlagNames = []flagName{
 	{uint32(OpenDirectIO), "OpenDirectIO"},
 	{uint32(OpenKeepCache), "OpenKeepCache"},
 	{uint32(OpenNonSeekable), "OpenNonSeekable"},
+	{uint32(OpenPassthrough), "OpenPassthrough"},
 	{uint32(OpenPurgeAttr), "OpenPurgeAttr"},
 	{uint32(OpenPurgeUBC), "OpenPurgeUBC"},
 }
@@ -273,6 +300,18 @@ const (
 	InitCaseSensitive InitFlags = 1 << 29 // OS X only
 	InitVolRename     InitFlags = 1 << 30 // OS X only
 	InitXtimes        InitFlags = 1 << 31 // OS X only
+
+	// On Linux (>= 5.17), the bit of InitVolRename says that InitIn and
+	// InitOut carry InitFlags2.
+	InitInitExt InitFlags = 1 << 30
+)
+
+// The InitFlags2 extend the InitFlags on Linux.
+type InitFlags2 uint32
+
+const (
+	InitSecurityCtx InitFlags2 = 1 << 0
+	InitPassthrough InitFlags2 = 1 << 5
 )
 
 type flagName struct {
@@ -312,6 +351,15 @@ func (fl InitFlags) String() string {
 	return flagString(uint32(fl), initFlagNames)
 }
 
+var initFlag2Names = []flagName{
+	{uint32(InitSecurityCtx), "InitSecurityCtx"},
+	{uint32(InitPassthrough), "InitPassthrough"},
+}
+
+func (fl InitFlags2) String() string {
+	return flagString(uint32(fl), initFlag2Names)
+}
+
 func flagString(f uint32, names []flagName) string {
 	var s string
 
@@ -386,8 +434,16 @@ const (
 	OpDestroy     = 38
 	OpIoctl       = 39 // Linux?
 	OpPoll        = 40 // Linux?
+	OpNotifyReply = 41
 	OpBatchForget = 42
 	OpFallocate   = 43
+	OpReaddirplus = 44
+	OpRename2     = 45
+	OpLseek       = 46
+	OpSyncfs      = 50
+
+	// Linux; sent on /dev/cuse in place of OpInit.
+	OpCuseInit = 4096
 
 	// OS X
 	OpSetvolname = 61
@@ -495,6 +551,13 @@ type RenameIn struct {
 	// "oldname\x00newname\x00" follows
 }
 
+type Rename2In struct {
+	Newdir  uint64
+	Flags   uint32
+	Padding uint32
+	// "oldname\x00newname\x00" follows
+}
+
 // OS X
 type ExchangeIn struct {
 	Olddir  uint64
@@ -514,10 +577,10 @@ type setattrInCommon struct {
 	LockOwner uint64 // unused on OS X?
 	Atime     uint64
 	Mtime     uint64
-	Unused2   uint64
+	Ctime     uint64
 	AtimeNsec uint32
 	MtimeNsec uint32
-	Unused3   uint32
+	CtimeNsec uint32
 	Mode      uint32
 	Unused4   uint32
 	Uid       uint32
@@ -533,7 +596,7 @@ type OpenIn struct {
 type OpenOut struct {
 	Fh        uint64
 	OpenFlags uint32
-	Padding   uint32
+	BackingID int32
 }
 
 type CreateIn struct {
@@ -655,6 +718,9 @@ type FsyncIn struct {
 	Padding    uint32
 }
 
+// Set in FsyncIn.FsyncFlags for fdatasync(2), which needn't sync metadata.
+const FsyncFdatasync = 1 << 0
+
 type setxattrInCommon struct {
 	Size  uint32
 	Flags uint32
@@ -691,10 +757,129 @@ type FallocateIn struct {
 	Padding uint32
 }
 
+// Set in PollIn.Flags when the kernel wants a NotifyCodePoll wakeup once the
+// events become ready.
+const PollScheduleNotify = 1 << 0
+
+type PollIn struct {
+	Fh     uint64
+	Kh     uint64
+	Flags  uint32
+	Events uint32
+}
+
+type PollOut struct {
+	Revents uint32
+	Padding uint32
+}
+
+type NotifyPollWakeupOut struct {
+	Kh uint64
+}
+
+type LseekIn struct {
+	Fh      uint64
+	Offset  uint64
+	Whence  uint32
+	Padding uint32
+}
+
+type LseekOut struct {
+	Offset uint64
+}
+
+type SyncfsIn struct {
+	Padding uint64
+}
+
+type CuseInitIn struct {
+	Major  uint32
+	Minor  uint32
+	Unused uint32
+	Flags  uint32
+}
+
+// The reply to an OpCuseInit, followed by the device's info: NUL-separated
+// KEY=value strings, of which only DEVNAME is used.
+type CuseInitOut struct {
+	Major    uint32
+	Minor    uint32
+	Unused   uint32
+	Flags    uint32
+	MaxRead  uint32
+	MaxWrite uint32
+	DevMajor uint32
+	DevMinor uint32
+	Spare    [10]uint32
+}
+
+// Flags in CuseInitOut.
+const (
+	// Pass ioctls on without the kernel copying their arguments, as
+	// IoctlUnrestricted does for file systems.
+	CuseUnrestrictedIoctl = 1 << 0
+)
+
+// Appended to the requests that create inodes once InitSecurityCtx has been
+// agreed, followed by NrSecctx contexts. Each is a Secctx, the NUL-terminated
+// name of the extended attribute, and Secctx.Size bytes of value, padded to a
+// multiple of 8 bytes.
+type SecctxHeader struct {
+	Size     uint32
+	NrSecctx uint32
+}
+
+type Secctx struct {
+	Size    uint32
+	Padding uint32
+}
+
+type IoctlIn struct {
+	Fh      uint64
+	Flags   IoctlFlags
+	Cmd     uint32
+	Arg     uint64
+	InSize  uint32
+	OutSize uint32
+}
+
+type IoctlOut struct {
+	Result  int32
+	Flags   IoctlFlags
+	InIovs  uint32
+	OutIovs uint32
+}
+
+// The IoctlFlags are passed in IoctlIn and returned in IoctlOut.
+type IoctlFlags uint32
+
+const (
+	IoctlCompat       IoctlFlags = 1 << 0 // 32-bit compat ioctl on a 64-bit machine
+	IoctlUnrestricted IoctlFlags = 1 << 1 // not restricted to well-formed ioctls, retry allowed
+	IoctlRetry        IoctlFlags = 1 << 2 // retry with new iovecs
+	Ioctl32Bit        IoctlFlags = 1 << 3 // 32-bit ioctl
+	IoctlDir          IoctlFlags = 1 << 4 // is a directory
+)
+
+// A region of the caller's memory, listed after an IoctlOut with IoctlRetry
+// set.
+type IoctlIovec struct {
+	Base uint64
+	Len  uint64
+}
+
+// The type and number bits of the FS_IOC_GETFLAGS and FS_IOC_SETFLAGS ioctl
+// commands, whose direction and size bits vary with the architecture and with
+// the 32-bit variants.
+const (
+	IoctlGetFlags uint32 = 'f'<<8 | 1
+	IoctlSetFlags uint32 = 'f'<<8 | 2
+)
+
 type LkIn struct {
 	Fh      uint64
 	Owner   uint64
-	Lk      fileLock
+	Lk      FileLock
 	LkFlags uint32
 	padding uint32
 }
@@ -708,8 +893,14 @@ func LkInSize(p Protocol) uintptr {
 	}
 }
 
+// LkIn.LkFlags
+const (
+	// The lock is a flock(2) lock rather than a POSIX record lock.
+	LkFlock uint32 = 1 << 0
+)
+
 type LkOut struct {
-	Lk fileLock
+	Lk FileLock
 }
 
 type AccessIn struct {
@@ -726,6 +917,12 @@ type InitIn struct {
 
 const InitInSize = int(unsafe.Sizeof(InitIn{}))
 
+// Follows InitIn when InitInitExt is set in its flags.
+type InitInExt struct {
+	Flags2 uint32
+	Unused [11]uint32
+}
+
 type InitOut struct {
 	Major               uint32
 	Minor               uint32
@@ -737,7 +934,21 @@ type InitOut struct {
 	TimeGran            uint32
 	MaxPages            uint16
 	MapAlignment        uint16
-	Unused              [8]uint32
+	Flags2              uint32
+	MaxStackDepth       uint32
+	Unused              [6]uint32
+}
+
+// InitOutSize returns the size of the init reply understood by kernels
+// speaking the supplied protocol. Before 7.23 the structure ended after
+// MaxWrite, and such kernels (still common on Android) reject longer replies.
+func InitOutSize(p Protocol) uintptr {
+	switch {
+	case p.LT(Protocol{7, 23}):
+		return unsafe.Offsetof(InitOut{}.TimeGran)
+	default:
+		return unsafe.Sizeof(InitOut{})
+	}
 }
 
 type InterruptIn struct {
@@ -787,6 +998,9 @@ const (
 	NotifyCodePoll       int32 = 1
 	NotifyCodeInvalInode int32 = 2
 	NotifyCodeInvalEntry int32 = 3
+	NotifyCodeStore      int32 = 4
+	NotifyCodeRetrieve   int32 = 5
+	NotifyCodeDelete     int32 = 6
 )
 
 type NotifyInvalInodeOut struct {
@@ -800,3 +1014,35 @@ type NotifyInvalEntryOut struct {
 	Namelen uint32
 	padding uint32
 }
+
+type NotifyDeleteOut struct {
+	Parent  uint64
+	Child   uint64
+	Namelen uint32
+	padding uint32
+}
+
+type NotifyStoreOut struct {
+	Nodeid  uint64
+	Offset  uint64
+	Size    uint32
+	padding uint32
+}
+
+type NotifyRetrieveOut struct {
+	NotifyUnique uint64
+	Nodeid       uint64
+	Offset       uint64
+	Size         uint32
+	padding      uint32
+}
+
+// Sent in an OpNotifyReply, followed by the data retrieved.
+type NotifyRetrieveIn struct {
+	dummy1 uint64
+	Offset uint64
+	Size   uint32
+	dummy2 uint32
+	dummy3 uint64
+	dummy4 uint64
+}
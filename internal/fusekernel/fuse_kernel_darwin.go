@@ -40,7 +40,7 @@ type SetattrIn struct {
 	// OS X only
 	Bkuptime_    uint64
 	Chgtime_     uint64
-	Crtime       uint64
+	Crtime_      uint64
 	BkuptimeNsec uint32
 	ChgtimeNsec  uint32
 	CrtimeNsec   uint32
@@ -55,10 +55,21 @@ func (in *SetattrIn) Chgtime() time.Time {
 	return time.Unix(int64(in.Chgtime_), int64(in.ChgtimeNsec))
 }
 
+func (in *SetattrIn) Crtime() time.Time {
+	return time.Unix(int64(in.Crtime_), int64(in.CrtimeNsec))
+}
+
 func (in *SetattrIn) Flags() uint32 {
 	return in.Flags_
 }
 
+// OS X has no O_DIRECT, using fcntl(2) with F_NOCACHE instead, which the
+// kernel doesn't pass on.
+const OpenDirect OpenFlags = 0
+
+// OS X doesn't tell the file system about executing a file.
+const OpenExec OpenFlags = 0
+
 func openFlags(flags uint32) OpenFlags {
 	return OpenFlags(flags)
 }
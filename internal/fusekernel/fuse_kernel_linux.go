@@ -1,6 +1,16 @@
 package fusekernel
 
-import "time"
+import (
+	"syscall"
+	"time"
+)
+
+// OpenDirect is O_DIRECT. See OpenFlags.IsDirect.
+const OpenDirect OpenFlags = syscall.O_DIRECT
+
+// OpenExec is the kernel's __FMODE_EXEC, which it sets when opening a file in
+// order to execute it. See OpenFlags.IsExec.
+const OpenExec OpenFlags = 0x20
 
 type Attr struct {
 	Ino       uint64
@@ -45,6 +55,10 @@ func (in *SetattrIn) Chgtime() time.Time {
 	return time.Time{}
 }
 
+func (in *SetattrIn) Crtime() time.Time {
+	return time.Time{}
+}
+
 func (in *SetattrIn) Flags() uint32 {
 	return 0
 }
@@ -68,3 +82,21 @@ type GetxattrIn struct {
 type SetxattrIn struct {
 	setxattrInCommon
 }
+
+// The ioctl that attaches a newly opened fuse device to the connection of
+// another, passed by fd, so that requests can be read through either (Linux >=
+// 4.2).
+const DevIocClone = 0x8004e500 // _IOR(229, 0, uint32)
+
+// The ioctls on the fuse device that register a backing file for
+// OpenPassthrough, returning its ID, and unregister it (Linux >= 6.9).
+const (
+	DevIocBackingOpen  = 0x4010e501 // _IOW(229, 1, BackingMap)
+	DevIocBackingClose = 0x4004e502 // _IOW(229, 2, uint32)
+)
+
+type BackingMap struct {
+	Fd      int32
+	Flags   uint32
+	padding uint64
+}
@@ -58,6 +58,11 @@ func (a Protocol) HasOpenNonSeekable() bool {
 	return a.is710()
 }
 
+// HasPoll returns whether PollRequest and NotifyPollWakeup are supported.
+func (a Protocol) HasPoll() bool {
+	return a.GE(Protocol{7, 11})
+}
+
 func (a Protocol) is712() bool {
 	return a.GE(Protocol{7, 12})
 }
@@ -73,3 +78,14 @@ func (a Protocol) HasUmask() bool {
 func (a Protocol) HasInvalidate() bool {
 	return a.is712()
 }
+
+// HasNotifyStore returns whether NotifyStore and NotifyRetrieve are
+// supported.
+func (a Protocol) HasNotifyStore() bool {
+	return a.GE(Protocol{7, 15})
+}
+
+// HasNotifyDelete returns whether NotifyDelete is supported.
+func (a Protocol) HasNotifyDelete() bool {
+	return a.GE(Protocol{7, 18})
+}
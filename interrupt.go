@@ -0,0 +1,218 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// What the connection does when the kernel interrupts an op that the file
+// system hasn't replied to yet, typically because the calling process got a
+// signal. See MountConfig.InterruptPolicy.
+type InterruptPolicy int
+
+const (
+	// Cancel the op's context, and reply to the kernel once the file system
+	// replies. The caller stays blocked until then.
+	InterruptCancel InterruptPolicy = iota
+
+	// Cancel the op's context, and reply EINTR to the kernel straight away,
+	// releasing the caller. The file system must still reply to the op, but
+	// its reply is dropped. Note that the op may then still be in progress
+	// when the caller carries on; in particular, Connection.Freeze doesn't
+	// wait for it. And the kernel doesn't count an inode entry returned by
+	// such an op as a lookup.
+	InterruptReply
+
+	// Like InterruptCancel, but log the op if the file system hasn't replied
+	// to it a second after it was interrupted, to find handlers that don't
+	// watch their context.
+	InterruptWarn
+)
+
+// How long after being interrupted an op is logged under InterruptWarn.
+var interruptWarnDelay = time.Second
+
+// Whether an op has been replied to, tracked for ops that may be interrupted
+// under policies other than InterruptCancel, or that may time out.
+type replyClaim struct {
+	op interface{}
+
+	// The reader that read the op, through whose device it must be replied
+	// to. See readers.go.
+	reader *deviceReader
+
+	// GUARDED_BY(c.mu)
+	replied bool
+
+	// The error replied with on the file system's behalf, if the op was
+	// abandoned.
+	//
+	// GUARDED_BY(c.mu)
+	sent syscall.Errno
+
+	// Fires when the op times out, if it may. See timeout.go.
+	//
+	// GUARDED_BY(c.mu)
+	timer *time.Timer
+}
+
+// Start tracking whether the op with the supplied request ID has been
+// replied to, if the interrupt policy calls for it. Return nil if not.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) claimable(
+	op interface{},
+	fuseID uint64,
+	reader *deviceReader) *replyClaim {
+	timeout := c.opTimeout(op)
+	if c.cfg.InterruptPolicy == InterruptCancel && timeout == 0 {
+		return nil
+	}
+
+	// Forget ops aren't replied to, and their IDs may be reused straight
+	// away. See beginOp.
+	switch op.(type) {
+	case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
+		return nil
+	}
+
+	claim := &replyClaim{op: op, reader: reader}
+
+	c.mu.Lock()
+	c.claims[fuseID] = claim
+	if timeout != 0 {
+		claim.timer = time.AfterFunc(timeout, func() {
+			c.timedOut(claim, fuseID, timeout)
+		})
+	}
+	c.mu.Unlock()
+
+	return claim
+}
+
+// Apply the interrupt policy to an op whose context has just been cancelled
+// by an interrupt. Return true if the caller must reply EINTR to it with
+// replyInterrupted, in which case it is no longer in flight.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Connection) interrupted(fuseID uint64) bool {
+	claim := c.claims[fuseID]
+	if claim == nil {
+		return false
+	}
+
+	switch c.cfg.InterruptPolicy {
+	case InterruptReply:
+		c.abandon(claim, fuseID, syscall.EINTR)
+		return true
+
+	case InterruptWarn:
+		time.AfterFunc(interruptWarnDelay, func() {
+			c.mu.Lock()
+			replied := claim.replied
+			c.mu.Unlock()
+
+			if !replied {
+				c.reportMisuse(
+					"%T not replied to %v after being interrupted; long-running "+
+						"handlers should return once ctx.Done() is closed",
+					claim.op,
+					interruptWarnDelay)
+			}
+		})
+	}
+
+	return false
+}
+
+// Stop tracking an op that the connection replies to on the file system's
+// behalf, so that the file system's own reply is dropped. Its context must
+// have been cancelled.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Connection) abandon(
+	claim *replyClaim,
+	fuseID uint64,
+	err syscall.Errno) {
+	claim.replied = true
+	claim.sent = err
+	if claim.timer != nil {
+		claim.timer.Stop()
+	}
+
+	delete(c.claims, fuseID)
+	delete(c.cancelFuncs, fuseID)
+	delete(c.debugOps, fuseID)
+	c.finishMutating(fuseID)
+	c.finishDraining()
+}
+
+// Reply EINTR to an op given up on under InterruptReply.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) replyInterrupted(fuseID uint64, claim *replyClaim) {
+	c.replyAbandoned(fuseID, claim, syscall.EINTR, "interrupted")
+}
+
+// Reply with the supplied error to an op that was abandoned, noting why in
+// the debug log.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) replyAbandoned(
+	fuseID uint64,
+	claim *replyClaim,
+	err syscall.Errno,
+	why string) {
+	outMsg := c.getOutMessage()
+	defer c.putOutMessage(outMsg)
+
+	if c.debugLogger != nil {
+		c.debugLog(fuseID, 1, "-> Error: %q (%s)", err.Error(), why)
+	}
+
+	if c.kernelResponse(outMsg, fuseID, claim.op, err) {
+		return
+	}
+
+	if err := c.writeOutMessage(c.replyDevice(claim.reader), outMsg); err != nil && c.errorLogger != nil {
+		c.errorLogger.Printf("writeMessage: %v %v", err, outMsg.OutHeaderBytes())
+	}
+}
+
+// Note that the file system is replying to an op. Return false if the
+// connection already replied to it on its being interrupted, in which case
+// the file system's reply must be dropped.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) claimReply(claim *replyClaim, fuseID uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if claim.replied {
+		return false
+	}
+
+	claim.replied = true
+	if claim.timer != nil {
+		claim.timer.Stop()
+	}
+
+	delete(c.claims, fuseID)
+	return true
+}
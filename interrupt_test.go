@@ -0,0 +1,140 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system whose StatFS blocks until interrupted.
+type blockingStatFS struct {
+	fuseutil.NotImplementedFileSystem
+	started chan struct{}
+}
+
+func (fs *blockingStatFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	close(fs.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestInterruptCancelsContext(t *testing.T) {
+	fs := &blockingStatFS{started: make(chan struct{})}
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	sendRequest(t, kernel, fusekernel.OpStatfs, 1, nil)
+	<-fs.started
+
+	sendInterrupt(t, kernel, 2, 1)
+
+	if r := readReply(t, kernel); r.unique != 1 || r.errno != -int32(syscall.EINTR) {
+		t.Errorf("Reply to the interrupted op: %+v", r)
+	}
+}
+
+// A file system whose StatFS ignores interrupts, blocking until released.
+type stubbornStatFS struct {
+	fuseutil.NotImplementedFileSystem
+	started chan struct{}
+	release chan struct{}
+}
+
+func (fs *stubbornStatFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	fs.started <- struct{}{}
+	<-fs.release
+	return nil
+}
+
+func sendInterrupt(t *testing.T, kernel *os.File, unique uint64, interrupted uint64) {
+	in := fusekernel.InterruptIn{Unique: interrupted}
+	sendRequest(t, kernel, fusekernel.OpInterrupt, unique, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+}
+
+func TestInterruptPolicy(t *testing.T) {
+	messages := make(messageWriter, 10)
+	fs := &stubbornStatFS{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	// Replying straight away releases the caller, and drops the file system's
+	// reply.
+	cfg := &fuse.MountConfig{InterruptPolicy: fuse.InterruptReply}
+	kernel, _, hangUp := serveWithConfig(t, cfg, fuseutil.NewFileSystemServer(fs))
+
+	sendRequest(t, kernel, fusekernel.OpStatfs, 1, nil)
+	<-fs.started
+	sendInterrupt(t, kernel, 2, 1)
+
+	if r := readReply(t, kernel); r.unique != 1 || r.errno != -int32(syscall.EINTR) {
+		t.Errorf("Reply to the interrupted op: %+v", r)
+	}
+
+	fs.release <- struct{}{}
+	sendRequest(t, kernel, fusekernel.OpStatfs, 3, nil)
+	<-fs.started
+	fs.release <- struct{}{}
+
+	if r := readReply(t, kernel); r.unique != 3 || r.errno != 0 {
+		t.Errorf("Reply after the interrupted op: %+v", r)
+	}
+
+	hangUp()
+
+	// Warning logs ops not replied to soon after being interrupted.
+	cfg = &fuse.MountConfig{
+		ErrorLogger:     log.New(messages, "", 0),
+		InterruptPolicy: fuse.InterruptWarn,
+	}
+
+	kernel, _, hangUp = serveWithConfig(t, cfg, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	sendRequest(t, kernel, fusekernel.OpStatfs, 1, nil)
+	<-fs.started
+	sendInterrupt(t, kernel, 2, 1)
+
+	select {
+	case m := <-messages:
+		if !strings.Contains(m, "StatFSOp not replied to") {
+			t.Errorf("Logged %q", m)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Nothing logged")
+	}
+
+	fs.release <- struct{}{}
+	if r := readReply(t, kernel); r.unique != 1 || r.errno != 0 {
+		t.Errorf("Reply to the interrupted op: %+v", r)
+	}
+}
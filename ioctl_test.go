@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// The command understood by ioctlFS, which echoes its input in upper case.
+const upperCmd = 0xc0047501
+
+// A file system implementing a single ioctl command.
+type ioctlFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *ioctlFS) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	if op.Cmd != upperCmd {
+		return syscall.ENOTTY
+	}
+
+	// Unrestricted callers must first be asked for their buffer.
+	if op.Unrestricted && len(op.Input) == 0 && op.OutSize == 0 {
+		op.RetryIn = []fuseops.IoctlIovec{{Base: op.Arg, Len: 4}}
+		op.RetryOut = []fuseops.IoctlIovec{{Base: op.Arg, Len: 4}}
+		return nil
+	}
+
+	op.Result = 7
+	op.Output = bytes.ToUpper(op.Input)
+	return nil
+}
+
+func sendIoctl(
+	t *testing.T,
+	kernel *os.File,
+	unique uint64,
+	in fusekernel.IoctlIn,
+	data []byte) {
+	b := append((*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:], data...)
+	sendRequest(t, kernel, fusekernel.OpIoctl, unique, b)
+}
+
+func TestIoctl(t *testing.T) {
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(&ioctlFS{}))
+	defer hangUp()
+
+	// A restricted ioctl comes with its input, and returns its output.
+	in := fusekernel.IoctlIn{Cmd: upperCmd, InSize: 4, OutSize: 4}
+	sendIoctl(t, kernel, 1, in, []byte("taco"))
+
+	r := readReply(t, kernel)
+	out := (*fusekernel.IoctlOut)(unsafe.Pointer(&r.data[0]))
+	data := r.data[unsafe.Sizeof(*out):]
+	if r.errno != 0 || out.Result != 7 || out.Flags != 0 || string(data) != "TACO" {
+		t.Errorf("Ioctl reply: %+v, %+v, %q", r, out, data)
+	}
+
+	// Unknown commands fail.
+	sendIoctl(t, kernel, 2, fusekernel.IoctlIn{Cmd: 0x5401}, nil)
+	if r := readReply(t, kernel); r.errno != -int32(syscall.ENOTTY) {
+		t.Errorf("Unknown ioctl reply: %+v", r)
+	}
+
+	// An unrestricted one is retried with the memory asked for.
+	in = fusekernel.IoctlIn{
+		Cmd:   upperCmd,
+		Arg:   0x1000,
+		Flags: fusekernel.IoctlUnrestricted,
+	}
+	sendIoctl(t, kernel, 3, in, nil)
+
+	r = readReply(t, kernel)
+	out = (*fusekernel.IoctlOut)(unsafe.Pointer(&r.data[0]))
+	iovs := (*[2]fusekernel.IoctlIovec)(unsafe.Pointer(&r.data[unsafe.Sizeof(*out)]))
+	want := fusekernel.IoctlIovec{Base: 0x1000, Len: 4}
+	if r.errno != 0 ||
+		out.Flags != fusekernel.IoctlRetry ||
+		out.InIovs != 1 ||
+		out.OutIovs != 1 ||
+		iovs[0] != want ||
+		iovs[1] != want {
+		t.Errorf("Unrestricted ioctl reply: %+v, %+v, %+v", r, out, iovs)
+	}
+
+	in.InSize = 4
+	in.OutSize = 4
+	sendIoctl(t, kernel, 4, in, []byte("taco"))
+	r = readReply(t, kernel)
+	if data := r.data[unsafe.Sizeof(*out):]; r.errno != 0 || string(data) != "TACO" {
+		t.Errorf("Retried ioctl reply: %+v", r)
+	}
+}
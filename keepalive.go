@@ -0,0 +1,104 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Passed to MountConfig.OnWedged when a keepalive statfs(2) of the mount point
+// hasn't returned in time.
+type WedgedError struct {
+	Dir     string
+	Timeout time.Duration
+}
+
+func (e *WedgedError) Error() string {
+	return fmt.Sprintf("statfs of %s hasn't returned after %v", e.Dir, e.Timeout)
+}
+
+// Call statfs(2) on the mount point, as a user would.
+func statfsProbe(dir string) func() {
+	return func() {
+		var st unix.Statfs_t
+		unix.Statfs(dir, &st)
+	}
+}
+
+// Run probe every MountConfig.KeepaliveInterval until done is closed,
+// reporting to OnWedged a probe that takes longer than KeepaliveTimeout, and
+// then its return. A probe failing quickly still shows that the file system is
+// responding; a lost connection is reported by OnConnectionLost instead.
+func keepalive(
+	dir string,
+	cfg *MountConfig,
+	probe func(),
+	done <-chan struct{}) {
+	timeout := cfg.KeepaliveTimeout
+	if timeout <= 0 {
+		timeout = cfg.KeepaliveInterval
+	}
+
+	report := func(err error) {
+		if cfg.OnWedged != nil {
+			cfg.OnWedged(err)
+		}
+	}
+
+	ticker := time.NewTicker(cfg.KeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		// The probe may block for good, so it gets a goroutine of its own, and
+		// no other is started until it returns.
+		returned := make(chan struct{})
+		go func() {
+			probe()
+			close(returned)
+		}()
+
+		timer := time.NewTimer(timeout)
+		select {
+		case <-returned:
+			timer.Stop()
+			continue
+
+		case <-done:
+			timer.Stop()
+			return
+
+		case <-timer.C:
+		}
+
+		report(&WedgedError{Dir: dir, Timeout: timeout})
+
+		select {
+		case <-returned:
+			report(nil)
+
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeepalive(t *testing.T) {
+	reports := make(chan error, 2)
+	cfg := &MountConfig{
+		KeepaliveInterval: time.Millisecond,
+		KeepaliveTimeout:  10 * time.Millisecond,
+		OnWedged:          func(err error) { reports <- err },
+	}
+
+	// Probes return straight away, until one is told to block.
+	probes := make(chan chan struct{}, 1)
+	probe := func() {
+		select {
+		case unblock := <-probes:
+			<-unblock
+		default:
+		}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		keepalive("/mnt", cfg, probe, done)
+		close(stopped)
+	}()
+
+	select {
+	case err := <-reports:
+		t.Fatalf("Reported %v while responsive", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A probe that blocks is reported, as is its return.
+	unblock := make(chan struct{})
+	probes <- unblock
+
+	select {
+	case err := <-reports:
+		if w, ok := err.(*WedgedError); !ok || w.Dir != "/mnt" {
+			t.Errorf("Reported %v", err)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Blocked probe not reported")
+	}
+
+	close(unblock)
+	if err := <-reports; err != nil {
+		t.Errorf("Reported %v once the probe returned", err)
+	}
+
+	close(done)
+	<-stopped
+}
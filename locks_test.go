@@ -0,0 +1,110 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system in which a write lock held by owner 1 covers bytes 0 to 9.
+type lockingFS struct {
+	fuseutil.NotImplementedFileSystem
+	set chan *fuseops.SetLkOp
+}
+
+func (fs *lockingFS) GetLk(
+	ctx context.Context,
+	op *fuseops.GetLkOp) error {
+	if op.Owner != 1 && op.Lock.Start <= 9 {
+		op.Conflict = fuseops.FileLock{End: 9, Type: fuseops.LockWrite, PID: 17}
+	}
+
+	return nil
+}
+
+func (fs *lockingFS) SetLk(
+	ctx context.Context,
+	op *fuseops.SetLkOp) error {
+	fs.set <- op
+	if op.Lock.Start <= 9 && !op.Wait {
+		return syscall.EAGAIN
+	}
+
+	return nil
+}
+
+func sendLk(
+	t *testing.T,
+	kernel *os.File,
+	opcode uint32,
+	unique uint64,
+	in fusekernel.LkIn) {
+	sendRequest(t, kernel, opcode, unique, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+}
+
+func TestLocks(t *testing.T) {
+	fs := &lockingFS{set: make(chan *fuseops.SetLkOp, 10)}
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	// Testing reports the conflicting lock, or none.
+	read := fusekernel.FileLock{Start: 5, End: 20, Type: syscall.F_RDLCK}
+	sendLk(t, kernel, fusekernel.OpGetlk, 1, fusekernel.LkIn{Owner: 2, Lk: read})
+	r := readReply(t, kernel)
+	out := (*fusekernel.LkOut)(unsafe.Pointer(&r.data[0]))
+	if r.errno != 0 || out.Lk.Type != syscall.F_WRLCK || out.Lk.End != 9 || out.Lk.Pid != 17 {
+		t.Errorf("GetLk reply: %+v, %+v", r, out.Lk)
+	}
+
+	sendLk(t, kernel, fusekernel.OpGetlk, 2, fusekernel.LkIn{Owner: 1, Lk: read})
+	r = readReply(t, kernel)
+	out = (*fusekernel.LkOut)(unsafe.Pointer(&r.data[0]))
+	if r.errno != 0 || out.Lk.Type != syscall.F_UNLCK {
+		t.Errorf("GetLk reply without a conflict: %+v, %+v", r, out.Lk)
+	}
+
+	// Setting conveys whether to wait, and which kind of lock it is.
+	sendLk(t, kernel, fusekernel.OpSetlk, 3, fusekernel.LkIn{Fh: 4, Owner: 2, Lk: read})
+	if r := readReply(t, kernel); r.errno != -int32(syscall.EAGAIN) {
+		t.Errorf("SetLk reply: %+v", r)
+	}
+
+	op := <-fs.set
+	want := fuseops.FileLock{Start: 5, End: 20, Type: fuseops.LockRead}
+	if op.Handle != 4 || op.Owner != 2 || op.Lock != want || op.Wait || op.Flock {
+		t.Errorf("SetLkOp: %+v", op)
+	}
+
+	sendLk(t, kernel, fusekernel.OpSetlkw, 4, fusekernel.LkIn{
+		Owner:   2,
+		Lk:      read,
+		LkFlags: fusekernel.LkFlock,
+	})
+	if r := readReply(t, kernel); r.errno != 0 {
+		t.Errorf("SetLk reply when waiting: %+v", r)
+	}
+
+	if op := <-fs.set; !op.Wait || !op.Flock {
+		t.Errorf("SetLkOp when waiting: %+v", op)
+	}
+}
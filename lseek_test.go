@@ -0,0 +1,66 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system whose files are 100 bytes long, with data in bytes 10 to 19.
+type sparseFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *sparseFS) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	return fuseutil.SeekExtents(op, 100, []fuseutil.ByteRange{{Offset: 10, Length: 10}})
+}
+
+func TestLseek(t *testing.T) {
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(&sparseFS{}))
+	defer hangUp()
+
+	seek := func(unique uint64, offset uint64, whence uint32) (int64, int32) {
+		in := fusekernel.LseekIn{Fh: 1, Offset: offset, Whence: whence}
+		sendRequest(t, kernel, fusekernel.OpLseek, unique, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+
+		r := readReply(t, kernel)
+		if r.errno != 0 {
+			return 0, r.errno
+		}
+
+		return int64((*fusekernel.LseekOut)(unsafe.Pointer(&r.data[0])).Offset), 0
+	}
+
+	if off, errno := seek(1, 0, fuseops.SeekData); off != 10 || errno != 0 {
+		t.Errorf("SEEK_DATA from 0: %d, %d", off, errno)
+	}
+
+	if off, errno := seek(2, 12, fuseops.SeekHole); off != 20 || errno != 0 {
+		t.Errorf("SEEK_HOLE from 12: %d, %d", off, errno)
+	}
+
+	if _, errno := seek(3, 20, fuseops.SeekData); errno != -int32(syscall.ENXIO) {
+		t.Errorf("SEEK_DATA past the data: %d", errno)
+	}
+}
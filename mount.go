@@ -16,6 +16,7 @@ package fuse
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -41,15 +42,23 @@ func Mount(
 	dir string,
 	server Server,
 	config *MountConfig) (*MountedFileSystem, error) {
-	// Sanity check: make sure the mount point exists and is a directory. This
-	// saves us from some confusing errors later on OS X.
-	if err := checkMountPoint(dir); err != nil {
+	if err := config.check(); err != nil {
 		return nil, err
 	}
 
+	// Sanity check: make sure the mount point exists and is a directory. This
+	// saves us from some confusing errors later on OS X. A mount point in
+	// another mount namespace can't be checked from here.
+	if config.MountNamespace == nil {
+		if err := checkMountPoint(dir); err != nil {
+			return nil, err
+		}
+	}
+
 	// Initialize the struct.
 	mfs := &MountedFileSystem{
 		dir:                 dir,
+		mountNamespace:      config.MountNamespace,
 		joinStatusAvailable: make(chan struct{}),
 	}
 
@@ -58,7 +67,7 @@ func Mount(
 		config.DebugLogger.Println("Beginning the mounting kickoff process")
 	}
 	ready := make(chan error, 1)
-	dev, err := mount(dir, config, ready)
+	dev, helper, err := mount(dir, config, ready)
 	if err != nil {
 		return nil, fmt.Errorf("mount: %v", err)
 	}
@@ -82,8 +91,9 @@ func Mount(
 		config.ErrorLogger,
 		dev)
 	if err != nil {
-		return nil, fmt.Errorf("newConnection: %v", err)
+		return nil, fmt.Errorf("newConnection: %w", err)
 	}
+	mfs.conn = connection
 	if config.DebugLogger != nil {
 		config.DebugLogger.Println("Successfully created the connection")
 	}
@@ -92,6 +102,27 @@ func Mount(
 	go func() {
 		server.ServeOps(connection)
 		mfs.joinStatus = connection.close()
+
+		// Let a mount helper waiting for us to go away exit.
+		if helper != nil {
+			helper.Close()
+		}
+
+		// Tell the user if the kernel went away underneath us, as opposed to the
+		// file system being unmounted.
+		lost := connection.lostError()
+		if lost == nil && config.MountNamespace == nil && isAbortedMount(dir) {
+			lost = &ConnectionLostError{Err: syscall.ENODEV}
+		}
+
+		if lost != nil {
+			if config.OnConnectionLost != nil {
+				config.OnConnectionLost(lost)
+			}
+
+			mfs.joinStatus = lost
+		}
+
 		close(mfs.joinStatusAvailable)
 	}()
 
@@ -104,9 +135,23 @@ func Mount(
 		return nil, fmt.Errorf("mount (background): %v", err)
 	}
 
+	if config.KeepaliveInterval > 0 && config.MountNamespace == nil {
+		go keepalive(dir, &cfgCopy, statfsProbe(dir), mfs.joinStatusAvailable)
+	}
+
 	return mfs, nil
 }
 
+// Report whether dir is still a mount point whose connection to the kernel is
+// gone, which is what aborting an idle connection through
+// /sys/fs/fuse/connections leaves behind. An orderly unmount, or a forced one
+// (`umount -f`), leaves no mount point to find, so the latter is
+// indistinguishable from the former unless ops were in flight.
+func isAbortedMount(dir string) bool {
+	_, err := os.Stat(dir)
+	return errors.Is(err, syscall.ENOTCONN)
+}
+
 func checkMountPoint(dir string) error {
 	if strings.HasPrefix(dir, "/dev/fd") {
 		return nil
@@ -127,14 +172,32 @@ func checkMountPoint(dir string) error {
 	return nil
 }
 
-func fusermount(binary string, argv []string, additionalEnv []string, wait bool, debugLogger *log.Logger) (*os.File, error) {
+// Run a fusermount(1)-style helper, which mounts the file system and passes
+// back the device over a socket. Unless wait is set, the helper is left
+// running in the background. If keep is set, the socket is returned too, for
+// the caller to hold open while the file system is being served, as helpers
+// monitoring the socket to unmount the file system when it closes expect.
+func fusermount(
+	binary string,
+	argv []string,
+	additionalEnv []string,
+	wait bool,
+	keep bool,
+	debugLogger *log.Logger) (dev *os.File, sock *os.File, err error) {
 	if debugLogger != nil {
 		debugLogger.Println("Creating a socket pair")
 	}
-	// Create a socket pair.
+	// Create a socket pair. Neither end is to leak into other processes, so
+	// that the helper sees our end close; its own is passed explicitly.
+	syscall.ForkLock.RLock()
 	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
 	if err != nil {
-		return nil, fmt.Errorf("Socketpair: %v", err)
+		return nil, nil, fmt.Errorf("Socketpair: %v", err)
 	}
 
 	if debugLogger != nil {
@@ -145,7 +208,11 @@ func fusermount(binary string, argv []string, additionalEnv []string, wait bool,
 	defer writeFile.Close()
 
 	readFile := os.NewFile(uintptr(fds[1]), "fusermount-parent-reads")
-	defer readFile.Close()
+	defer func() {
+		if !keep || err != nil {
+			readFile.Close()
+		}
+	}()
 
 	if debugLogger != nil {
 		debugLogger.Println("Starting fusermount/os mount")
@@ -164,7 +231,12 @@ func fusermount(binary string, argv []string, additionalEnv []string, wait bool,
 		err = cmd.Start()
 	}
 	if err != nil {
-		return nil, fmt.Errorf("running %v: %v", binary, err)
+		return nil, nil, fmt.Errorf("running %v: %v", binary, err)
+	}
+
+	// Reap the helper once it exits.
+	if !wait {
+		go cmd.Wait()
 	}
 
 	if debugLogger != nil {
@@ -173,7 +245,7 @@ func fusermount(binary string, argv []string, additionalEnv []string, wait bool,
 	// Wrap the socket file in a connection.
 	c, err := net.FileConn(readFile)
 	if err != nil {
-		return nil, fmt.Errorf("FileConn: %v", err)
+		return nil, nil, fmt.Errorf("FileConn: %v", err)
 	}
 	defer c.Close()
 
@@ -183,7 +255,7 @@ func fusermount(binary string, argv []string, additionalEnv []string, wait bool,
 	// We expect to have a Unix domain socket.
 	uc, ok := c.(*net.UnixConn)
 	if !ok {
-		return nil, fmt.Errorf("Expected UnixConn, got %T", c)
+		return nil, nil, fmt.Errorf("Expected UnixConn, got %T", c)
 	}
 
 	if debugLogger != nil {
@@ -194,18 +266,18 @@ func fusermount(binary string, argv []string, additionalEnv []string, wait bool,
 	oob := make([]byte, 32) // expect 24 bytes
 	_, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
 	if err != nil {
-		return nil, fmt.Errorf("ReadMsgUnix: %v", err)
+		return nil, nil, fmt.Errorf("ReadMsgUnix: %v", err)
 	}
 
 	// Parse the message.
 	scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
 	if err != nil {
-		return nil, fmt.Errorf("ParseSocketControlMessage: %v", err)
+		return nil, nil, fmt.Errorf("ParseSocketControlMessage: %v", err)
 	}
 
 	// We expect one message.
 	if len(scms) != 1 {
-		return nil, fmt.Errorf("expected 1 SocketControlMessage; got scms = %#v", scms)
+		return nil, nil, fmt.Errorf("expected 1 SocketControlMessage; got scms = %#v", scms)
 	}
 
 	scm := scms[0]
@@ -217,16 +289,21 @@ func fusermount(binary string, argv []string, additionalEnv []string, wait bool,
 	// Pull out the FD returned by fusermount
 	gotFds, err := syscall.ParseUnixRights(&scm)
 	if err != nil {
-		return nil, fmt.Errorf("syscall.ParseUnixRights: %v", err)
+		return nil, nil, fmt.Errorf("syscall.ParseUnixRights: %v", err)
 	}
 
 	if len(gotFds) != 1 {
-		return nil, fmt.Errorf("wanted 1 fd; got %#v", gotFds)
+		return nil, nil, fmt.Errorf("wanted 1 fd; got %#v", gotFds)
 	}
 
 	if debugLogger != nil {
 		debugLogger.Println("Converting FD into os.File")
 	}
 	// Turn the FD into an os.File.
-	return os.NewFile(uintptr(gotFds[0]), "/dev/fuse"), nil
+	dev = os.NewFile(uintptr(gotFds[0]), "/dev/fuse")
+	if keep {
+		sock = readFile
+	}
+
+	return dev, sock, nil
 }
@@ -16,10 +16,30 @@ package fuse
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/buffer"
+)
+
+// FUSEImpl selects the implementation of FUSE to mount with on OS X.
+type FUSEImpl uint8
+
+const (
+	// FUSEImplMacFUSE uses the macFUSE (formerly osxfuse) kernel extension.
+	FUSEImplMacFUSE FUSEImpl = iota
+
+	// FUSEImplFuseT uses fuse-t (https://www.fuse-t.org), which needs no kernel
+	// extension: a helper process serves the file system to the kernel's NFS
+	// client over localhost, relaying ops to us over a socket.
+	FUSEImplFuseT
 )
 
 // Optional configuration accepted by Mount.
@@ -108,11 +128,62 @@ type MountConfig struct {
 	//     spontaneously change for reasons the kernel doesn't observe. See
 	//     http://goo.gl/V5WQCN for more discussion.
 	//
+	// *   The times the kernel kept are written back with SetInodeAttributesOp,
+	//     setting Mtime and Ctime but no Handle, which the file system should
+	//     store rather than overwrite with the times of its own writes.
+	//
+	// Kernels may refuse writeback caching, e.g. to mounts made from within a
+	// user namespace; Connection.WritebackCaching reports whether it is in use.
+	//
 	// Setting DisableWritebackCaching disables this behavior. Instead the file
 	// system is called one or more times for each write(2), and the user's
 	// syscall doesn't return until the file system returns.
 	DisableWritebackCaching bool
 
+	// Linux only.
+	//
+	// Serve files so that applications mapping them with MAP_SHARED and
+	// PROT_WRITE, such as sqlite and lmdb, see the same data through their
+	// mappings as through read(2) and write(2), and can make it durable. This
+	// needs cooperation from the file system; the mode takes care of what the
+	// connection can:
+	//
+	// *   Writeback caching (see DisableWritebackCaching, which must not be set)
+	//     is required, so that the page cache backing the mappings is also the
+	//     one read(2) and write(2) go through, and the kernel's idea of the
+	//     file size and mtime is not undone by stale replies to getattr.
+	//
+	// *   OpenFileOp.UseDirectIO is ignored, because kernels before 6.6 refuse
+	//     MAP_SHARED mappings of files opened for direct IO, and later ones
+	//     bypass the mapped pages when writing. Opens with O_DIRECT still do
+	//     direct IO, as the application asked for it.
+	//
+	// The file system in turn must:
+	//
+	// *   Keep the data per inode rather than per handle. Dirty pages are
+	//     written back in WriteFileOps carrying any handle open for writing on
+	//     the inode, possibly one other than the handle that was mapped, and
+	//     possibly after the FlushFileOp for the close(2) of the mapped handle.
+	//     Only ReleaseFileHandleOp for the last handle comes after all of them.
+	//
+	// *   Make all of the inode's data durable in SyncFileOp, which is what
+	//     msync(2) with MS_SYNC sends once the kernel has written the mapped
+	//     range back. The same goes for FlushFileOp, if the file system makes
+	//     data durable on close(2).
+	//
+	// *   Call Connection.InvalidateInode (or the MountedFileSystem method of the
+	//     same name) when a file's contents change other than through the
+	//     kernel, e.g. by another client of shared storage. Otherwise mappings
+	//     keep showing the old pages for as long as the kernel caches them.
+	//     As above, the kernel keeps its own idea of the file size, so only
+	//     changes that leave it alone are fully seen.
+	//
+	// Mapped pages dirtied between two msync(2) calls are written back in
+	// page-sized WriteFileOps in no particular order, so a crash between them
+	// can leave a file with only some of them, as with local file systems.
+	// Applications rely on their own journaling for atomicity.
+	EnableSharedWritableMmap bool
+
 	// OS X only.
 	//
 	// Normally on OS X we mount with the novncache option
@@ -128,6 +199,15 @@ type MountConfig struct {
 	// entries will be cached for an arbitrarily long time.
 	EnableVnodeCaching bool
 
+	// How long the kernel may cache the entries and attributes returned by the
+	// file system when it leaves ChildInodeEntry.EntryExpiration or the
+	// AttributesExpiration of a response at the zero value, which otherwise
+	// disables caching. Negative entries, returned by LookUpInodeOp with a zero
+	// child, and those written with fuseutil.WriteDirentPlus aren't affected.
+	// Responses can still disable caching with fuseops.NoCache.
+	EntryTimeout      time.Duration
+	AttributesTimeout time.Duration
+
 	// Linux only.
 	//
 	// Linux 4.20 introduced caching symlink targets in the page cache:
@@ -151,24 +231,109 @@ type MountConfig struct {
 	// OpenDir calls at all (Linux >= 5.1):
 	EnableNoOpendirSupport bool
 
+	// Linux only.
+	//
+	// Let the kernel send ReadDirPlusOp, returning the attributes of children
+	// along with their names, when it expects them to be looked up next
+	// (Linux >= 3.9). The file system must implement ReadDirPlusOp as well as
+	// ReadDirOp, since the kernel still sends the latter otherwise.
+	EnableReadDirPlus bool
+
+	// Linux only.
+	//
+	// Send GetLkOp and SetLkOp for fcntl(2) record locks, rather than have the
+	// kernel handle them itself, which makes them visible only to processes
+	// on the same machine. File systems shared between machines need this for
+	// e.g. SQLite databases to be safe to use.
+	EnablePosixLocks bool
+
+	// Linux only.
+	//
+	// Send SetLkOp, with Flock set, for flock(2) locks, rather than have the
+	// kernel handle them itself (Linux >= 2.6.37).
+	EnableFlockLocks bool
+
+	// If set, called with the kernel's INIT request and the reply about to be
+	// sent to it, which it may change, e.g. to try out combinations of
+	// features this package has no option for. Some fields are clamped
+	// afterwards to what the connection can handle; see InitResponse. The
+	// file system must cope with whatever features are asked for.
+	AdjustInit func(kernel InitRequest, resp *InitResponse)
+
+	// Linux only.
+	//
+	// Pass renameat2(2) calls with flags on to the file system, setting
+	// fuseops.RenameOp.Flags, rather than have the kernel fail them with
+	// EINVAL. This lets RENAME_NOREPLACE and RENAME_EXCHANGE work through the
+	// mount, for atomic no-clobber renames and swaps. The file system must then
+	// fail RenameOps with EINVAL for the flags it doesn't implement.
+	EnableRenameFlags bool
+
+	// Linux only (>= 5.17).
+	//
+	// Have the kernel pass the security context computed by its security
+	// module, such as SELinux, for the inodes created by CreateFileOp, MkDirOp,
+	// MkNodeOp and CreateSymlinkOp. File systems store it as an extended
+	// attribute, so that labeled installs onto the mount work.
+	EnableSecurityContext bool
+
+	// Linux only (>= 6.9).
+	//
+	// Let the file system serve the data of files it opens from files of its
+	// own, such as those of the layer an overlay-style file system stacks on,
+	// by setting OpenFileOp.BackingFile: the kernel then reads and writes the
+	// backing file directly, without sending ReadFileOp or WriteFileOp, for
+	// close to native throughput. The kernel refuses to combine this with
+	// writeback caching, so DisableWritebackCaching must also be set.
+	//
+	// Registering backing files takes CAP_SYS_ADMIN. Opens whose backing file
+	// can't be registered, e.g. without it, are served through the file
+	// system as usual, and the error is logged to the error logger.
+	EnablePassthrough bool
+
 	// Disable FUSE default permissions.
 	// This is useful for situations where the backing data store (e.g., S3) doesn't
 	// actually utilise any form of qualifiable UNIX permissions.
+	//
+	// The kernel then leaves permission checks to the file system: it sends
+	// fuseops.AccessOp for access(2) and chdir(2), and otherwise allows
+	// whatever the file system's ops don't refuse.
 	DisableDefaultPermissions bool
 
 	// Use vectored reads.
 	// Vectored read allows file systems to avoid memory copying overhead if
 	// the data is already in memory when they return it to FUSE.
 	// When turned on, ReadFileOp.Dst is always nil and the FS must return data
-	// being read from the file as a list of slices in ReadFileOp.Data.
+	// being read from the file as a list of slices in ReadFileOp.Data. When
+	// off, it may still do so for some reads and fill Dst for others.
 	UseVectoredRead bool
 
+	// OS X only.
+	//
+	// The implementation of FUSE to mount with. Defaults to macFUSE. With fuse-t
+	// the options specific to macFUSE (EnableVnodeCaching, LocalVolume,
+	// VolumeIconPath, Options) are not honored.
+	FuseImpl FUSEImpl
+
 	// OS X only.
 	//
 	// The name of the mounted volume, as displayed in the Finder. If empty, a
 	// default name involving the string 'osxfuse' is used.
 	VolumeName string
 
+	// OS X only.
+	//
+	// Mark the volume as local rather than as a network volume, so that the
+	// Finder shows it on the desktop and in the sidebar with the disks, and
+	// Spotlight may index it. Best left unset for file systems backed by remote
+	// storage, as the Finder is then less careful with them.
+	LocalVolume bool
+
+	// OS X only.
+	//
+	// The path of an .icns file to use as the volume's icon in the Finder.
+	VolumeIconPath string
+
 	// Additional key=value options to pass unadulterated to the underlying mount
 	// command. See `man 8 mount`, the fuse documentation, etc. for
 	// system-specific information.
@@ -182,9 +347,331 @@ type MountConfig struct {
 	// If not set, /proc/mounts will show the filesystem type as fuse/fuseblk.
 	Subtype string
 
+	// Let users other than the one who mounted the file system access it, as
+	// the allow_other option does. When mounting with fusermount(1), users
+	// other than root may only set this if /etc/fuse.conf has
+	// user_allow_other. A process mounting directly as root within a user
+	// namespace, e.g. in a container, may always set it for the users mapped
+	// into that namespace.
+	AllowOther bool
+
+	// Like AllowOther, but only let root in besides the user who mounted the
+	// file system, as the allow_root option of libfuse does: ops from other
+	// users fail with EACCES, except those on files and directories they have
+	// already opened. Can't be set along with AllowOther.
+	AllowRoot bool
+
+	// Options of the form "key" or "key=value" to pass on to the mount
+	// helper. Unlike with Options, Mount refuses keys other than the generic
+	// mount flags (rw, ro, suid, nosuid, dev, nodev, exec, noexec, async,
+	// sync, atime, noatime and dirsync), max_read, and the SELinux context
+	// options (context, fscontext, defcontext and rootcontext).
+	RawOptions []string
+
 	// Flag to enable async reads that are received from
 	// the kernel
 	EnableAsyncReads bool
+
+	// Linux only.
+	//
+	// If non-nil, a handle on the mount namespace in which to mount the file
+	// system, e.g. an opened /proc/<pid>/ns/mnt of a process in a container. The
+	// mount point is resolved within that namespace, while the file system keeps
+	// being served from the current process. This requires CAP_SYS_ADMIN in the
+	// user namespace owning the mount namespace; fusermount(1) is never used.
+	//
+	// Such a file system must be unmounted using UnmountInNamespace.
+	MountNamespace *os.File
+
+	// Linux only.
+	//
+	// Have the kernel unmount the file system if the process serving it dies,
+	// rather than leave the mount point failing with ENOTCONN ("Transport
+	// endpoint is not connected") until someone unmounts it. The file system
+	// is then always mounted by fusermount(1), which must support the
+	// auto_unmount option (fuse 2.9.1 or later), and which stays running until
+	// the file system is no longer being served. Incompatible with
+	// MountNamespace.
+	EnableAutoUnmount bool
+
+	// If non-zero, how often to check that the mount point still responds, by
+	// calling statfs(2) on it from a goroutine of its own. This detects a
+	// mount that has wedged while the daemon is still alive, e.g. because of
+	// deadlocked handlers, which otherwise only users notice. The file system
+	// sees the checks as StatFSOps. Ignored along with MountNamespace.
+	KeepaliveInterval time.Duration
+
+	// How long a keepalive statfs(2) may take before the mount counts as
+	// wedged. Defaults to KeepaliveInterval.
+	KeepaliveTimeout time.Duration
+
+	// Called with a *WedgedError when a keepalive statfs(2) hasn't returned
+	// within KeepaliveTimeout, and then with nil once it returns, if it does.
+	// No further checks are made meanwhile.
+	OnWedged func(err error)
+
+	// If non-nil, called once serving has stopped because the connection to the
+	// kernel was lost rather than because the file system was unmounted, before
+	// Join returns the same error. See ConnectionLostError.
+	OnConnectionLost func(err *ConnectionLostError)
+
+	// If non-nil, called with each op (a pointer to one of the structs in
+	// package fuseops) once the file system has responded to it, along with the
+	// time at which it was read from the kernel and the error it was responded
+	// to with. This allows tools to trace or account for the ops a mount
+	// serves.
+	//
+	// It is called synchronously, after the response has been sent to the
+	// kernel but before the goroutine handling the op is released, so it must be
+	// quick. It must not modify or retain the op, whose buffers are
+	// reused once it returns.
+	//
+	// To install several observers, combine them with MultiOpObserver.
+	OpObserver func(op interface{}, start time.Time, err error)
+
+	// If non-nil, called with each op when it has been read from the kernel,
+	// before the file system sees it. Each op passed to it is later passed to
+	// OpObserver, so that the two together can track the ops in flight, as
+	// fusedebug.Metrics does. It is called synchronously on the goroutine
+	// reading ops, so it must be quick, and must not modify or retain the op.
+	OpStartObserver func(op interface{})
+
+	// Keep count of the reads, writes and other ops on each file handle, and
+	// pass them to the file system when it is released, as
+	// fuseops.ReleaseFileHandleOp.Stats, e.g. for it to log a summary or
+	// decide whether to upload the file.
+	EnableHandleStats bool
+
+	// What to do when the kernel interrupts an op that the file system hasn't
+	// replied to yet. By default (InterruptCancel), its context is cancelled
+	// and the kernel waits for the file system's reply, so a caller blocked on
+	// a handler that ignores its context stays blocked, even if killed.
+	// InterruptReply releases the caller straight away with EINTR instead.
+	InterruptPolicy InterruptPolicy
+
+	// Keep track of the ops in flight and of the errors replied with, for
+	// Connection.DebugServer to report, at the cost of a little bookkeeping
+	// for each op.
+	EnableDebugServer bool
+
+	// What to do when an op handler panics, for servers that run handlers
+	// through Connection.Recover. By default (PanicRecover), the op fails with
+	// EIO and the panic is logged to ErrorLogger; PanicCrash lets it crash the
+	// process instead.
+	PanicPolicy PanicPolicy
+
+	// If non-nil, used to start a span for each op, e.g. with OpenTelemetry,
+	// whose context is passed to the file system. See OpTracer.
+	OpTracer OpTracer
+
+	// How OpTracer is to link the spans of related ops. See OpSpan.Link.
+	TraceLinking TraceLinking
+
+	// If non-nil, sent a structured record of each op read from the kernel and
+	// of each reply to one, in addition to what is logged to DebugLogger and
+	// ErrorLogger. See OpLogger and NewJSONOpLogger.
+	OpLogger OpLogger
+
+	// The least severe records sent to OpLogger. The default, LogDebug, sends
+	// them all; LogError only those of replies with unexpected errors.
+	// OpLogLevels overrides it for the ops it names, e.g. to quiet the
+	// frequent {"LookUpInode": LogError, "GetInodeAttributes": LogNone}, or to
+	// trace only {"Rename": LogDebug} against a level of LogError.
+	OpLogLevel  LogLevel
+	OpLogLevels map[string]LogLevel
+
+	// How the fields of ops are rendered for OpLogger. By default, the data
+	// read and written and other payloads are replaced by their lengths, so
+	// that file contents don't end up in logs; RedactNames hides file names
+	// too.
+	OpLogFormat fuseops.JSONOptions
+
+	// A debugging aid that checks how the file system uses the ops it is
+	// given, and logs misuse to ErrorLogger, or the standard logger if that is
+	// nil, instead of leaving it to corrupt memory or race silently. It
+	// reports ops replied to twice (the second reply is dropped), ops replied
+	// to successfully after their context was cancelled, which suggests a
+	// handler that doesn't watch ctx.Done(), and ops whose fields change
+	// shortly after being replied to, which means that a goroutine is still
+	// using them. It makes replying slower, so is best enabled in tests, ideally
+	// along with the race detector.
+	CheckConcurrency bool
+
+	// Limits on the handling of ops by servers that use Connection.Schedule,
+	// such as fuseutil.NewFileSystemServer. By default each op is handled on a
+	// goroutine of its own as soon as it is read, so that a burst of requests
+	// starts as many handlers at once. If MaxConcurrentOps is set, at most that
+	// many are handled at once, and at most MaxQueuedOps more wait for one of
+	// them to finish; beyond that, no more ops are read until one does, which
+	// leaves the kernel to hold back further requests.
+	//
+	// Handlers that block waiting for other ops, such as those waiting on a
+	// frozen file system (see Connection.Freeze), hold their slot meanwhile, so
+	// the limit must leave room for the ops they wait for.
+	MaxConcurrentOps int
+	MaxQueuedOps     int
+
+	// Linux only.
+	//
+	// The number of goroutines reading requests from the kernel, for file
+	// systems handling more ops than a single reader keeps up with, in the
+	// order of 100k per second. Above one, each reader reads through a device
+	// of its own, cloned from the one the file system was mounted with
+	// (FUSE_DEV_IOC_CLONE, Linux >= 4.2), into buffers of its own, and passes
+	// the ops on to ReadOp; replies go back through the device each op was
+	// read from. Mounting fails if the device can't be cloned.
+	//
+	// Ops read by different readers may be delivered out of order, and an
+	// interrupt may be delivered before the op it interrupts, which is then
+	// left to finish. Defaults to one reader, being the caller of ReadOp.
+	DeviceReaders int
+
+	// Handle the ops that change a file's contents, i.e. WriteFileOp,
+	// FallocateOp and SetInodeAttributesOp with a Size, one at a time per
+	// inode, in the order in which they were read, for file systems whose
+	// backends can't take concurrent writes to a file. The ops waiting for
+	// their turn don't count towards MaxQueuedOps.
+	SerializeWritesPerInode bool
+
+	// Linux only.
+	//
+	// The largest write, in bytes, the kernel is to send in a WriteFileOp,
+	// between 4 KiB and the default of 1 MiB. Each op being handled holds a
+	// buffer of this size plus a page, so file systems handling many small
+	// ops at once use less memory with a smaller size, at the cost of larger
+	// writes being split. fusedebug.Metrics.SuggestMaxWrite suggests a size
+	// from the writes seen. Extended attribute values that don't fit the
+	// buffer fail with E2BIG.
+	MaxWrite uint32
+
+	// The limit on how far the kernel reads ahead of a sequential reader, in
+	// bytes, which it lowers to its own limit. Defaults to 1 MiB. File systems
+	// with high-latency backends, such as object stores, benefit from reading
+	// ahead further; the kernel's own limit can be raised through
+	// /sys/class/bdi/<device>/read_ahead_kb.
+	MaxReadahead uint32
+
+	// Linux only.
+	//
+	// The largest request the kernel is to send, in pages, between 1 and the
+	// default of 256. This bounds the size of ReadFileOp, which is otherwise
+	// 1 MiB with 4 KiB pages. Kernels older than 4.20 send at most 32 pages.
+	//
+	// The limits agreed with the kernel can be read with
+	// Connection.TransferLimits.
+	MaxPages uint16
+
+	// Capabilities the file system can't do without. If the kernel doesn't
+	// provide them all, the mount fails with a MissingCapabilitiesError rather
+	// than going ahead without them. Those that must be asked for, such as
+	// CapReadDirPlus, must also be enabled above.
+	RequireCapabilities []Capability
+
+	// The time each op is given to be handled, as a soft deadline that the
+	// file system can read with SoftDeadline, and from which BackendContext
+	// derives the deadlines of its calls to its backend. Ops aren't failed
+	// when it passes; see OpTimeout for that. If zero, ops are given half the
+	// time after which the kernel aborts the connection if a request is left
+	// unanswered, on Linux kernels configured to do so (see
+	// fs.fuse.default_request_timeout in sysctl(8)), and have no soft deadline
+	// otherwise.
+	SoftOpTimeout time.Duration
+
+	// If non-zero, the soft timeout of ops read while the file system is
+	// congested, i.e. while more ops are in flight than the congestion
+	// threshold agreed with the kernel (see InitResponse). A shorter timeout
+	// there lets a slow backend fail ops rather than have them pile up.
+	CongestedOpTimeout time.Duration
+
+	// If non-zero, the time after which an op the file system hasn't replied
+	// to is given up on: its context is cancelled, it is logged to
+	// ErrorLogger, and the kernel is answered with OpTimeoutErrno (EIO by
+	// default), so that a stalled backend can't leave callers blocked
+	// forever. The file system must still reply to the op, but its reply is
+	// dropped, with the same caveats as under InterruptReply. OpTimeouts
+	// overrides it for the ops it names, as OpLogLevels does, e.g.
+	// {"ReadFile": time.Minute}; a negative timeout means none. Blocking lock
+	// requests never time out.
+	OpTimeout      time.Duration
+	OpTimeouts     map[string]time.Duration
+	OpTimeoutErrno syscall.Errno
+
+	// How long ops failing with EAGAINRetry are retried for by servers that
+	// use Connection.Retry, unless their soft deadline is earlier. Defaults to
+	// 30 seconds.
+	RetryTimeout time.Duration
+}
+
+// Return an error if the config asks for a combination of features that
+// can't work together.
+func (c *MountConfig) check() error {
+	if c.EnableSharedWritableMmap && c.DisableWritebackCaching {
+		return errors.New(
+			"EnableSharedWritableMmap requires writeback caching")
+	}
+
+	if c.AllowOther && c.AllowRoot {
+		return errors.New("AllowOther and AllowRoot are mutually exclusive")
+	}
+
+	for _, o := range c.RawOptions {
+		if k, _ := splitRawOption(o); !rawOptionKeys[k] {
+			return fmt.Errorf("mount option %q is not allowed", o)
+		}
+	}
+
+	if c.EnablePassthrough && !c.DisableWritebackCaching {
+		return errors.New(
+			"EnablePassthrough requires DisableWritebackCaching")
+	}
+
+	if c.EnableAutoUnmount && c.MountNamespace != nil {
+		return errors.New(
+			"EnableAutoUnmount can't be used along with MountNamespace")
+	}
+
+	if c.MaxConcurrentOps < 0 || c.MaxQueuedOps < 0 {
+		return errors.New("MaxConcurrentOps and MaxQueuedOps must not be negative")
+	}
+
+	if c.MaxWrite != 0 && (c.MaxWrite < minInitMaxWrite || c.MaxWrite > buffer.MaxWriteSize) {
+		return fmt.Errorf(
+			"MaxWrite must be between %d and %d",
+			minInitMaxWrite,
+			buffer.MaxWriteSize)
+	}
+
+	for _, k := range c.RequireCapabilities {
+		if _, ok := capabilities[k]; !ok {
+			return fmt.Errorf("unknown capability %q", k)
+		}
+	}
+
+	if c.MaxPages > maxInitMaxPages {
+		return fmt.Errorf("MaxPages must be at most %d", maxInitMaxPages)
+	}
+
+	if c.DeviceReaders < 0 {
+		return errors.New("DeviceReaders must not be negative")
+	}
+
+	if c.MaxQueuedOps != 0 && c.MaxConcurrentOps == 0 {
+		return errors.New("MaxQueuedOps requires MaxConcurrentOps")
+	}
+
+	return nil
+}
+
+// Report whether we are running on a Linux kernel. Android is one too, but Go
+// reports it as a GOOS of its own.
+func isLinux() bool {
+	return runtime.GOOS == "linux" || runtime.GOOS == "android"
+}
+
+// Report whether we are running on FreeBSD, whose fusefs(5) speaks the Linux
+// variant of the protocol.
+func isFreeBSD() bool {
+	return runtime.GOOS == "freebsd"
 }
 
 // Create a map containing all of the key=value mount options to be given to
@@ -209,7 +696,7 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 	// Cf. https://github.com/bazil/fuse/issues/89
 	// Cf. https://bugs.freedesktop.org/show_bug.cgi?id=90907
 	fsname := c.FSName
-	if runtime.GOOS == "linux" && fsname == "" {
+	if isLinux() && fsname == "" {
 		fsname = "some_fuse_file_system"
 	}
 
@@ -228,6 +715,17 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 		opts["ro"] = ""
 	}
 
+	// Sharing the mount? AllowRoot takes allow_other too, and the connection
+	// turns away the users it doesn't cover.
+	if c.AllowOther || c.AllowRoot {
+		opts["allow_other"] = ""
+	}
+
+	for _, o := range c.RawOptions {
+		k, v := splitRawOption(o)
+		opts[k] = v
+	}
+
 	// Handle OS X options.
 	if isDarwin {
 		if !c.EnableVnodeCaching {
@@ -238,6 +736,14 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 			// Cf. https://github.com/osxfuse/osxfuse/wiki/Mount-options#volname
 			opts["volname"] = c.VolumeName
 		}
+
+		if c.LocalVolume {
+			opts["local"] = ""
+		}
+
+		if c.VolumeIconPath != "" {
+			opts["iconpath"] = c.VolumeIconPath
+		}
 	}
 
 	// OS X: disable the use of "Apple Double" (._foo and .DS_Store) files, which
@@ -257,6 +763,41 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 	return opts
 }
 
+// The keys of the options accepted in MountConfig.RawOptions, which leave
+// alone how the connection works.
+var rawOptionKeys = map[string]bool{
+	"rw":      true,
+	"ro":      true,
+	"suid":    true,
+	"nosuid":  true,
+	"dev":     true,
+	"nodev":   true,
+	"exec":    true,
+	"noexec":  true,
+	"async":   true,
+	"sync":    true,
+	"atime":   true,
+	"noatime": true,
+	"dirsync": true,
+
+	"max_read": true,
+
+	"context":     true,
+	"fscontext":   true,
+	"defcontext":  true,
+	"rootcontext": true,
+}
+
+// Split a raw mount option into its key and value, which is empty for an
+// option without one.
+func splitRawOption(o string) (key string, value string) {
+	if i := strings.IndexByte(o, '='); i >= 0 {
+		return o[:i], o[i+1:]
+	}
+
+	return o, ""
+}
+
 func escapeOptionsKey(s string) (res string) {
 	res = s
 	res = strings.Replace(res, `\`, `\\`, -1)
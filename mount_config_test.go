@@ -0,0 +1,52 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import "testing"
+
+func TestMountOptions(t *testing.T) {
+	cfg := &MountConfig{
+		AllowRoot:  true,
+		RawOptions: []string{"noexec", "max_read=131072"},
+	}
+
+	if err := cfg.check(); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+
+	opts := cfg.toMap()
+	for k, want := range map[string]string{
+		"allow_other": "",
+		"noexec":      "",
+		"max_read":    "131072",
+	} {
+		if v, ok := opts[k]; !ok || v != want {
+			t.Errorf("Option %s: %q, %v; want %q", k, v, ok, want)
+		}
+	}
+
+	// Options that would change how the connection works are refused.
+	for _, o := range []string{"user_id=0", "fd=3", "allow_other"} {
+		cfg := &MountConfig{RawOptions: []string{o}}
+		if err := cfg.check(); err == nil {
+			t.Errorf("check accepted %q", o)
+		}
+	}
+
+	cfg = &MountConfig{AllowOther: true, AllowRoot: true}
+	if err := cfg.check(); err == nil {
+		t.Errorf("check accepted AllowOther along with AllowRoot")
+	}
+}
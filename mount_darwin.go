@@ -4,13 +4,16 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"log"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/folays/jacobsa_fuse/internal/buffer"
+	"golang.org/x/sys/unix"
 )
 
 var errNoAvail = errors.New("no available fuse devices")
@@ -78,6 +81,16 @@ var (
 	}
 )
 
+// Locations of fuse-t's NFS server, which stands in for the kernel.
+var fuseTServers = []string{
+	"/Library/Application Support/fuse-t/bin/go-nfsv4",
+	"/usr/local/bin/go-nfsv4",
+}
+
+// errFuseTNotFound is returned from Mount when fuse-t was asked for but is not
+// installed.
+var errFuseTNotFound = errors.New("cannot locate fuse-t")
+
 func loadOSXFUSE(bin string) error {
 	cmd := exec.Command(bin)
 	cmd.Dir = "/"
@@ -205,7 +218,116 @@ func callMountCommFD(
 	env = append(env, "_FUSE_COMMVERS=2")
 	argv = append(argv, dir)
 
-	return fusermount(bin, argv, env, false, cfg.DebugLogger)
+	dev, _, err := fusermount(bin, argv, env, false, false, cfg.DebugLogger)
+	return dev, err
+}
+
+// Start fuse-t's NFS server, which mounts dir and relays ops to us over one
+// socket, and reports on the mount over another. Mounting completes when the
+// server sends "mount" on the latter.
+func startFuseTServer(
+	bin string,
+	argv []string,
+	env []string,
+	debugLogger *log.Logger,
+	ready chan<- error) (*os.File, error) {
+	if debugLogger != nil {
+		debugLogger.Println("Creating socket pairs for fuse-t")
+	}
+	local, remote, err := socketpairFiles("fuse-t")
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Close()
+
+	localMon, remoteMon, err := socketpairFiles("fuse-t-monitor")
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	defer remoteMon.Close()
+
+	cmd := exec.Command(bin, argv...)
+	cmd.ExtraFiles = []*os.File{remote, remoteMon}
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3", "_FUSE_MONFD=4", "_FUSE_COMMVERS=2")
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if debugLogger != nil {
+		debugLogger.Println("Starting the fuse-t server")
+	}
+	if err := cmd.Start(); err != nil {
+		local.Close()
+		localMon.Close()
+		return nil, fmt.Errorf("running %v: %v", bin, err)
+	}
+
+	// In the background, wait for the server to tell us how mounting went.
+	go func() {
+		defer localMon.Close()
+
+		buf := make([]byte, 64)
+		n, err := localMon.Read(buf)
+		switch {
+		case err != nil:
+			err = fmt.Errorf("reading fuse-t monitor: %v", err)
+
+		case string(buf[:n]) != "mount":
+			err = fmt.Errorf("fuse-t: %s", bytes.TrimRight(buf[:n], "\x00\n"))
+		}
+
+		ready <- err
+	}()
+
+	return local, nil
+}
+
+// Create a pair of connected Unix domain stream sockets wrapped in files.
+func socketpairFiles(name string) (local *os.File, remote *os.File, err error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Socketpair: %v", err)
+	}
+
+	local = os.NewFile(uintptr(fds[0]), name+"-local")
+	remote = os.NewFile(uintptr(fds[1]), name+"-remote")
+	return local, remote, nil
+}
+
+// Mount using fuse-t rather than the macFUSE kernel extension.
+func mountFuseT(
+	dir string,
+	cfg *MountConfig,
+	ready chan<- error) (*os.File, error) {
+	var bin string
+	for _, path := range fuseTServers {
+		if _, err := os.Stat(path); err == nil {
+			bin = path
+			break
+		}
+	}
+
+	if bin == "" {
+		return nil, errFuseTNotFound
+	}
+
+	argv := []string{
+		// Tell the server how large our buffer is, as for osxfuse's iosize.
+		"--rwsize=" + strconv.FormatUint(buffer.MaxWriteSize, 10),
+	}
+
+	if cfg.VolumeName != "" {
+		argv = append(argv, "--volname="+cfg.VolumeName)
+	}
+
+	if cfg.ReadOnly {
+		argv = append(argv, "-r")
+	}
+
+	argv = append(argv, dir)
+
+	return startFuseTServer(bin, argv, []string{"_FUSE_CALL_BY_LIB=1"}, cfg.DebugLogger, ready)
 }
 
 // Begin the process of mounting at the given directory, returning a connection
@@ -215,7 +337,19 @@ func callMountCommFD(
 func mount(
 	dir string,
 	cfg *MountConfig,
-	ready chan<- error) (dev *os.File, err error) {
+	ready chan<- error) (dev *os.File, helper *os.File, err error) {
+	if cfg.MountNamespace != nil {
+		return nil, nil, errNoMountNamespaces
+	}
+
+	if cfg.FuseImpl == FUSEImplFuseT {
+		dev, err = mountFuseT(dir, cfg, ready)
+		if err != nil {
+			return nil, nil, fmt.Errorf("mountFuseT: %v", err)
+		}
+		return dev, nil, nil
+	}
+
 	// Find the version of osxfuse installed on this machine.
 	for _, loc := range osxfuseInstallations {
 		if _, err := os.Stat(loc.Mount); os.IsNotExist(err) {
@@ -228,9 +362,9 @@ func mount(
 			ready <- nil
 			dev, err = callMountCommFD(loc.Mount, loc.DaemonVar, loc.LibVar, dir, cfg)
 			if err != nil {
-				return nil, fmt.Errorf("callMount: %v", err)
+				return nil, nil, fmt.Errorf("callMount: %v", err)
 			}
-			return
+			return dev, nil, nil
 		}
 
 		// Open the device.
@@ -241,7 +375,7 @@ func mount(
 		if err == errNotLoaded {
 			err = loadOSXFUSE(loc.Load)
 			if err != nil {
-				return nil, fmt.Errorf("loadOSXFUSE: %v", err)
+				return nil, nil, fmt.Errorf("loadOSXFUSE: %v", err)
 			}
 
 			dev, err = openOSXFUSEDev(loc.DevicePrefix)
@@ -249,17 +383,33 @@ func mount(
 
 		// Propagate errors.
 		if err != nil {
-			return nil, fmt.Errorf("openOSXFUSEDev: %v", err)
+			return nil, nil, fmt.Errorf("openOSXFUSEDev: %v", err)
 		}
 
 		// Call the mount binary with the device.
 		if err := callMount(loc.Mount, loc.DaemonVar, loc.LibVar, dir, cfg, dev, ready); err != nil {
 			dev.Close()
-			return nil, fmt.Errorf("callMount: %v", err)
+			return nil, nil, fmt.Errorf("callMount: %v", err)
 		}
 
-		return dev, nil
+		return dev, nil, nil
+	}
+
+	return nil, nil, errOSXFUSENotFound
+}
+
+// Report whether the file system mounted at dir forbids executing files, as
+// the noexec option does.
+func isNoexec(dir string) (bool, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return false, err
 	}
 
-	return nil, errOSXFUSENotFound
+	return st.Flags&unix.MNT_NOEXEC != 0, nil
+}
+
+// The kernel doesn't time requests out.
+func kernelRequestTimeout() time.Duration {
+	return 0
 }
@@ -0,0 +1,79 @@
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The mount helper shipped with FreeBSD's fusefs(5).
+const mountFusefs = "/sbin/mount_fusefs"
+
+// Begin the process of mounting at the given directory, returning a connection
+// to the kernel. Mounting continues in the background, and is complete when an
+// error is written to the supplied channel. The file system may need to
+// service the connection in order for mounting to complete.
+func mount(dir string, cfg *MountConfig, ready chan<- error) (dev *os.File, helper *os.File, err error) {
+	if cfg.MountNamespace != nil {
+		return nil, nil, errNoMountNamespaces
+	}
+
+	// As on Linux, open the device in blocking mode, since the Go runtime's
+	// poller doesn't work with it.
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening /dev/fuse (is fusefs loaded?): %v", err)
+	}
+	dev = os.NewFile(uintptr(fd), "/dev/fuse")
+
+	// Hand the device to mount_fusefs(8) as its "special" argument, as libfuse
+	// does. The kernel sends the init op once the mount is in place, without
+	// waiting for it, so the helper can run to completion before we serve.
+	argv := []string{
+		"-o", cfg.toOptionsString(),
+		// refers to fd passed in cmd.ExtraFiles
+		"3",
+		dir,
+	}
+
+	cmd := exec.Command(mountFusefs, argv...)
+	cmd.ExtraFiles = []*os.File{dev}
+
+	// Have the helper ignore the options it doesn't know, rather than fail.
+	cmd.Env = append(os.Environ(), "MOUNT_FUSEFS_SAFE=1", "MOUNT_FUSEFS_CALL_BY_LIB=1")
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		dev.Close()
+		if len(output) > 0 {
+			output = bytes.TrimRight(output, "\n")
+			return nil, nil, fmt.Errorf("%s: %v: %s", mountFusefs, err, output)
+		}
+
+		return nil, nil, fmt.Errorf("%s: %v", mountFusefs, err)
+	}
+
+	ready <- nil
+	return dev, nil, nil
+}
+
+// Report whether the file system mounted at dir forbids executing files, as
+// the noexec option does.
+func isNoexec(dir string) (bool, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return false, err
+	}
+
+	return st.Flags&unix.MNT_NOEXEC != 0, nil
+}
+
+// The kernel doesn't time requests out.
+func kernelRequestTimeout() time.Duration {
+	return 0
+}
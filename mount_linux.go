@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -17,12 +20,35 @@ func findFusermount() (string, error) {
 	if err != nil {
 		path, err = exec.LookPath("fusermount")
 	}
+	if err != nil && runtime.GOOS == "android" {
+		path, err = findTermuxFusermount()
+	}
 	if err != nil {
 		return "", err
 	}
 	return path, nil
 }
 
+// Android has no system-wide fusermount(1). Termux installs one under its
+// prefix, which daemons started outside of a Termux shell (e.g. through su)
+// don't have on their PATH.
+func findTermuxFusermount() (string, error) {
+	prefix := os.Getenv("PREFIX")
+	if prefix == "" {
+		prefix = "/data/data/com.termux/files/usr"
+	}
+
+	var err error
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		var path string
+		if path, err = exec.LookPath(prefix + "/bin/" + name); err == nil {
+			return path, nil
+		}
+	}
+
+	return "", err
+}
+
 func enableFunc(flag uintptr) func(uintptr) uintptr {
 	return func(v uintptr) uintptr {
 		return v | flag
@@ -57,6 +83,9 @@ var errFallback = errors.New("sentinel: fallback to fusermount(1)")
 func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 	if cfg.DebugLogger != nil {
 		cfg.DebugLogger.Println("Preparing for direct mounting")
+		if inUserNamespace() {
+			cfg.DebugLogger.Println("Running within a user namespace")
+		}
 	}
 	// We use syscall.Open + os.NewFile instead of os.OpenFile so that the file
 	// is opened in blocking mode. When opened in non-blocking mode, the Go
@@ -95,13 +124,24 @@ func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 	if cfg.DebugLogger != nil {
 		cfg.DebugLogger.Println("Starting the unix mounting")
 	}
-	if err := unix.Mount(
-		cfg.FSName, // source
-		dir,        // target
-		fstype,     // fstype
-		mountflag,  // mountflag
-		data,       // data
-	); err != nil {
+	doMount := func() error {
+		return unix.Mount(
+			cfg.FSName, // source
+			dir,        // target
+			fstype,     // fstype
+			mountflag,  // mountflag
+			data,       // data
+		)
+	}
+
+	if cfg.MountNamespace != nil {
+		err = inMountNamespace(cfg.MountNamespace, doMount)
+	} else {
+		err = doMount()
+	}
+
+	if err != nil {
+		dev.Close()
 		if err == syscall.EPERM {
 			return nil, errFallback
 
@@ -114,11 +154,43 @@ func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 	return dev, nil
 }
 
+// Run f on a dedicated OS thread that has joined the mount namespace ns. Go
+// threads share their file system attributes, which setns(2) refuses for mount
+// namespaces, so the thread first unshares them. The thread is never handed
+// back to the runtime, since it can't leave the namespace again.
+func inMountNamespace(ns *os.File, f func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		// No UnlockOSThread: the thread exits along with this goroutine.
+		runtime.LockOSThread()
+
+		if err := unix.Unshare(unix.CLONE_FS); err != nil {
+			errc <- fmt.Errorf("unshare: %v", err)
+			return
+		}
+
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNS); err != nil {
+			errc <- fmt.Errorf("setns: %v", err)
+			return
+		}
+
+		errc <- f()
+	}()
+
+	return <-errc
+}
+
 // Begin the process of mounting at the given directory, returning a connection
 // to the kernel. Mounting continues in the background, and is complete when an
 // error is written to the supplied channel. The file system may need to
 // service the connection in order for mounting to complete.
-func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
+//
+// If non-nil, helper must be held open while the file system is being served,
+// and closed afterwards.
+func mount(
+	dir string,
+	cfg *MountConfig,
+	ready chan<- error) (dev *os.File, helper *os.File, err error) {
 	// On linux, mounting is never delayed.
 	ready <- nil
 
@@ -130,28 +202,87 @@ func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
 	// other part of the mount dance.
 	if fd, err := parseFuseFd(dir); err == nil {
 		dev := os.NewFile(uintptr(fd), "/dev/fuse")
-		return dev, nil
+		return dev, nil, nil
 	}
 
 	// Try mounting without fusermount(1) first: we might be running as root or
-	// have the CAP_SYS_ADMIN capability.
-	dev, err := directmount(dir, cfg)
+	// have the CAP_SYS_ADMIN capability. Only fusermount(1) can unmount the
+	// file system once we are gone, though.
+	err = errFallback
+	if !cfg.EnableAutoUnmount {
+		dev, err = directmount(dir, cfg)
+	}
+
+	if err == errFallback && cfg.MountNamespace != nil {
+		return nil, nil, errors.New(
+			"mounting in another mount namespace requires CAP_SYS_ADMIN")
+	}
+
 	if err == errFallback {
 		if cfg.DebugLogger != nil {
 			cfg.DebugLogger.Println("Directmount failed. Trying fallback.")
 		}
 		fusermountPath, err := findFusermount()
 		if err != nil {
-			return nil, err
+			// Rootless containers commonly ship without fusermount(1); say why
+			// mounting directly didn't work either.
+			if inUserNamespace() {
+				return nil, nil, fmt.Errorf(
+					"%v; mounting directly from within a user namespace requires "+
+						"access to /dev/fuse and CAP_SYS_ADMIN in the namespace, "+
+						"and Linux 4.18 or later",
+					err)
+			}
+			return nil, nil, err
+		}
+
+		// With auto_unmount, fusermount(1) stays behind, and unmounts the file
+		// system once we close our end of the socket, or exit.
+		opts := cfg.toMap()
+		if cfg.EnableAutoUnmount {
+			opts["auto_unmount"] = ""
 		}
+
 		argv := []string{
-			"-o", cfg.toOptionsString(),
+			"-o", mapToOptionsString(opts),
 			"--",
 			dir,
 		}
-		return fusermount(fusermountPath, argv, []string{}, true, cfg.DebugLogger)
+		return fusermount(
+			fusermountPath,
+			argv,
+			[]string{},
+			!cfg.EnableAutoUnmount,
+			cfg.EnableAutoUnmount,
+			cfg.DebugLogger)
 	}
-	return dev, err
+	return dev, nil, err
+}
+
+// Report whether we are running within a user namespace other than the
+// initial one, as is the case for rootless containers.
+func inUserNamespace() bool {
+	uidMap, err := os.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+
+	return !isIdentityUIDMap(string(uidMap))
+}
+
+// Report whether the supplied contents of /proc/self/uid_map map the whole
+// range of user IDs onto itself, which only the initial user namespace does.
+func isIdentityUIDMap(uidMap string) bool {
+	lines := strings.Split(strings.TrimSpace(uidMap), "\n")
+	if len(lines) != 1 {
+		return false
+	}
+
+	fields := strings.Fields(lines[0])
+	return len(fields) == 3 &&
+		fields[0] == "0" &&
+		fields[1] == "0" &&
+		fields[2] == "4294967295"
 }
 
 func parseFuseFd(dir string) (int, error) {
@@ -166,3 +297,86 @@ func parseFuseFd(dir string) (int, error) {
 
 	return int(fd), nil
 }
+
+// Report whether the file system mounted at dir forbids executing files, as
+// the noexec option does.
+func isNoexec(dir string) (bool, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+
+	mountinfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+
+	noexec, ok := mountinfoNoexec(string(mountinfo), dir)
+	if !ok {
+		return false, fmt.Errorf("%s is not a mount point", dir)
+	}
+
+	return noexec, nil
+}
+
+// Look up the mount at dir in the supplied contents of /proc/self/mountinfo,
+// reporting whether its options include noexec. The last mount listed wins,
+// as it hides those below it.
+func mountinfoNoexec(mountinfo string, dir string) (noexec bool, ok bool) {
+	for _, line := range strings.Split(mountinfo, "\n") {
+		// See proc(5): the fifth field is the mount point, with white space and
+		// backslashes escaped in octal, and the sixth the per-mount options.
+		fields := strings.Fields(line)
+		if len(fields) < 6 || unescapeMountinfo(fields[4]) != dir {
+			continue
+		}
+
+		noexec, ok = false, true
+		for _, o := range strings.Split(fields[5], ",") {
+			if o == "noexec" {
+				noexec = true
+			}
+		}
+	}
+
+	return noexec, ok
+}
+
+func unescapeMountinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// Return how long the kernel leaves a request unanswered before aborting the
+// connection, or zero if it doesn't (the default, and always before Linux
+// 6.14). A non-zero fs.fuse.max_request_timeout caps the default.
+func kernelRequestTimeout() time.Duration {
+	read := func(name string) uint64 {
+		b, err := os.ReadFile("/proc/sys/fs/fuse/" + name)
+		if err != nil {
+			return 0
+		}
+
+		n, _ := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 32)
+		return n
+	}
+
+	secs := read("default_request_timeout")
+	if limit := read("max_request_timeout"); limit != 0 && (secs == 0 || secs > limit) {
+		secs = limit
+	}
+
+	return time.Duration(secs) * time.Second
+}
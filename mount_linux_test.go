@@ -1,6 +1,9 @@
 package fuse
 
 import (
+	"errors"
+	"os"
+	"syscall"
 	"testing"
 )
 
@@ -35,3 +38,124 @@ func Test_parseFuseFd(t *testing.T) {
 		}
 	})
 }
+
+func Test_isIdentityUIDMap(t *testing.T) {
+	testCases := []struct {
+		name   string
+		uidMap string
+		want   bool
+	}{
+		{"initial namespace", "         0          0 4294967295\n", true},
+		{"rootless container", "         0       1000          1\n         1     100000      65536\n", false},
+		{"single user", "      1000       1000          1\n", false},
+		{"empty", "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isIdentityUIDMap(tc.uidMap); got != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// Open our own mount namespace, skipping the test if we may not join it.
+func openOwnMountNamespace(t *testing.T) *os.File {
+	ns, err := os.Open("/proc/self/ns/mnt")
+	if err != nil {
+		t.Skipf("Open: %v", err)
+	}
+
+	t.Cleanup(func() { ns.Close() })
+
+	if err := inMountNamespace(ns, func() error { return nil }); err != nil {
+		t.Skipf("Joining our own mount namespace: %v", err)
+	}
+
+	return ns
+}
+
+func Test_inMountNamespace(t *testing.T) {
+	ns := openOwnMountNamespace(t)
+
+	want, err := os.Readlink("/proc/self/ns/mnt")
+	if err != nil {
+		t.Fatalf("Readlink: %v", err)
+	}
+
+	// f runs on a thread in the namespace, and its error is passed through.
+	sentinel := errors.New("taco")
+	var got string
+	err = inMountNamespace(ns, func() error {
+		got, _ = os.Readlink("/proc/thread-self/ns/mnt")
+		return sentinel
+	})
+
+	if err != sentinel {
+		t.Errorf("expected the error returned by f, got %v", err)
+	}
+
+	if got != want {
+		t.Errorf("f ran in namespace %q, want %q", got, want)
+	}
+
+	// A file that isn't a namespace is refused.
+	notNS, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer notNS.Close()
+
+	ran := false
+	err = inMountNamespace(notNS, func() error {
+		ran = true
+		return nil
+	})
+
+	if err == nil || ran {
+		t.Errorf("expected setns to fail without running f, got %v", err)
+	}
+}
+
+func TestUnmountInNamespace(t *testing.T) {
+	ns := openOwnMountNamespace(t)
+
+	// A directory that isn't a mount point can't be unmounted, and the error
+	// says which one.
+	dir := t.TempDir()
+	err := UnmountInNamespace(dir, ns)
+
+	var pe *os.PathError
+	if !errors.As(err, &pe) || pe.Path != dir || pe.Err != syscall.EINVAL {
+		t.Errorf("expected EINVAL for %s, got %v", dir, err)
+	}
+}
+
+func Test_mountinfoNoexec(t *testing.T) {
+	const mountinfo = "" +
+		"22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n" +
+		"40 22 0:35 / /mnt/a\\040b rw,nosuid,nodev,noexec,relatime shared:20 - fuse.memfs memfs rw\n" +
+		"41 22 0:36 / /mnt/c rw,noexec shared:21 - fuse.memfs memfs rw\n" +
+		"42 41 0:37 / /mnt/c rw,nosuid shared:22 - fuse.memfs memfs rw\n"
+
+	testCases := []struct {
+		dir    string
+		noexec bool
+		ok     bool
+	}{
+		{"/", false, true},
+		{"/mnt/a b", true, true},
+		{"/mnt/c", false, true},
+		{"/mnt", false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.dir, func(t *testing.T) {
+			noexec, ok := mountinfoNoexec(mountinfo, tc.dir)
+			if noexec != tc.noexec || ok != tc.ok {
+				t.Errorf("expected %v, %v, got %v, %v", tc.noexec, tc.ok, noexec, ok)
+			}
+		})
+	}
+}
@@ -16,13 +16,22 @@ package fuse
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
 )
 
 // MountedFileSystem represents the status of a mount operation, with a method
 // that waits for unmounting.
 type MountedFileSystem struct {
-	dir string
+	dir  string
+	conn *Connection
+
+	// The mount namespace dir is in, if other than ours.
+	mountNamespace *os.File
 
 	// The result to return from Join. Not valid until the channel is closed.
 	joinStatus          error
@@ -41,7 +50,8 @@ func (mfs *MountedFileSystem) Dir() string {
 // in-flight ops).
 //
 // The return value will be non-nil if anything unexpected happened while
-// serving. May be called multiple times.
+// serving. In particular it is a *ConnectionLostError if the connection to the
+// kernel was torn down from outside the daemon. May be called multiple times.
 func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 	select {
 	case <-mfs.joinStatusAvailable:
@@ -51,6 +61,133 @@ func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 	}
 }
 
+// Returned when sending notifications through a MountedFileSystem that wasn't
+// obtained from Mount.
+var errNoConnection = errors.New("MountedFileSystem has no connection")
+
+// InvalidateInode calls Connection.InvalidateInode on the connection serving
+// the file system.
+func (mfs *MountedFileSystem) InvalidateInode(
+	inode fuseops.InodeID,
+	off int64,
+	length int64) error {
+	if mfs.conn == nil {
+		return errNoConnection
+	}
+
+	return mfs.conn.InvalidateInode(inode, off, length)
+}
+
+// InvalidateEntry calls Connection.InvalidateEntry on the connection serving
+// the file system.
+func (mfs *MountedFileSystem) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	if mfs.conn == nil {
+		return errNoConnection
+	}
+
+	return mfs.conn.InvalidateEntry(parent, name)
+}
+
+// NotifyDelete calls Connection.NotifyDelete on the connection serving the
+// file system.
+func (mfs *MountedFileSystem) NotifyDelete(
+	parent fuseops.InodeID,
+	child fuseops.InodeID,
+	name string) error {
+	if mfs.conn == nil {
+		return errNoConnection
+	}
+
+	return mfs.conn.NotifyDelete(parent, child, name)
+}
+
+// InvalidateRename calls Connection.InvalidateRename on the connection serving
+// the file system.
+func (mfs *MountedFileSystem) InvalidateRename(r RenamedEntry) error {
+	if mfs.conn == nil {
+		return errNoConnection
+	}
+
+	return mfs.conn.InvalidateRename(r)
+}
+
+// NotifyStore calls Connection.NotifyStore on the connection serving the file
+// system.
+func (mfs *MountedFileSystem) NotifyStore(
+	inode fuseops.InodeID,
+	off int64,
+	data []byte) error {
+	if mfs.conn == nil {
+		return errNoConnection
+	}
+
+	return mfs.conn.NotifyStore(inode, off, data)
+}
+
+// RetrieveCache calls Connection.RetrieveCache on the connection serving the
+// file system.
+func (mfs *MountedFileSystem) RetrieveCache(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	off int64,
+	dst []byte) (int, error) {
+	if mfs.conn == nil {
+		return 0, errNoConnection
+	}
+
+	return mfs.conn.RetrieveCache(ctx, inode, off, dst)
+}
+
+// WritebackCaching calls Connection.WritebackCaching on the connection serving
+// the file system, returning false if there is none.
+func (mfs *MountedFileSystem) WritebackCaching() bool {
+	return mfs.conn != nil && mfs.conn.WritebackCaching()
+}
+
+// DebugServer returns a handler reporting what the connection to the kernel
+// is up to. See Connection.DebugServer.
+func (mfs *MountedFileSystem) DebugServer() http.Handler {
+	return mfs.conn.DebugServer()
+}
+
+// SignalReady calls the package-level SignalReady with no error, to tell the
+// process waiting in Daemonize that the file system is mounted.
+func (mfs *MountedFileSystem) SignalReady() {
+	SignalReady(nil)
+}
+
+// NoExec reports whether the mount forbids executing the files on it, in which
+// case execve(2) fails with EACCES whatever their permissions. This is the
+// case with the noexec option, which is also implied by the user and users
+// options of fstab(5) entries.
+func (mfs *MountedFileSystem) NoExec() (bool, error) {
+	if mfs.mountNamespace != nil {
+		return false, errors.New("NoExec isn't supported in another mount namespace")
+	}
+
+	return isNoexec(mfs.dir)
+}
+
+// Freeze calls Connection.Freeze on the connection serving the file system.
+func (mfs *MountedFileSystem) Freeze(
+	ctx context.Context,
+	policy FreezePolicy) error {
+	if mfs.conn == nil {
+		return errNoConnection
+	}
+
+	return mfs.conn.Freeze(ctx, policy)
+}
+
+// Thaw calls Connection.Thaw on the connection serving the file system.
+func (mfs *MountedFileSystem) Thaw() {
+	if mfs.conn != nil {
+		mfs.conn.Thaw()
+	}
+}
+
 // GetFuseContext implements the equiv. of FUSE-C fuse_get_context() and thus
 // returns the UID / GID / PID associated with all FUSE requests send by the kernel.
 // ctx parameter must be one of the context from the fuseops handlers (e.g.: CreateFile)
@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+func tooLong(names ...string) bool {
+	for _, n := range names {
+		if len(n) > fuseops.MaxNameLength {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return ENAMETOOLONG for an op carrying a name longer than
+// fuseops.MaxNameLength, or a symlink target longer than MaxTargetLength. The
+// kernel lets names of up to 1024 bytes through, which is more than we tell it
+// in StatFSOp replies that file systems support, and more than file systems
+// backed by local ones can store.
+func checkNameLengths(op interface{}) error {
+	var long bool
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		long = tooLong(o.Name)
+
+	case *fuseops.MkDirOp:
+		long = tooLong(o.Name)
+
+	case *fuseops.MkNodeOp:
+		long = tooLong(o.Name)
+
+	case *fuseops.CreateFileOp:
+		long = tooLong(o.Name)
+
+	case *fuseops.CreateSymlinkOp:
+		long = tooLong(o.Name) || len(o.Target) > fuseops.MaxTargetLength
+
+	case *fuseops.CreateLinkOp:
+		long = tooLong(o.Name)
+
+	case *fuseops.RenameOp:
+		long = tooLong(o.OldName, o.NewName)
+
+	case *fuseops.RmDirOp:
+		long = tooLong(o.Name)
+
+	case *fuseops.UnlinkOp:
+		long = tooLong(o.Name)
+	}
+
+	if long {
+		return syscall.ENAMETOOLONG
+	}
+
+	return nil
+}
+
+// Report whether the op is a ReadSymlinkOp replying with a target longer than
+// fuseops.MaxTargetLength. The kernel reads targets into a page, failing
+// readlink(2) with EIO if one doesn't fit.
+func targetTooLong(op interface{}) bool {
+	o, ok := op.(*fuseops.ReadSymlinkOp)
+	return ok && len(o.Target) > fuseops.MaxTargetLength
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system in which every name exists, and whose symlinks' targets
+// grow by one byte from the longest allowed each time they are read.
+type longNamesFS struct {
+	fuseutil.NotImplementedFileSystem
+	reads int32
+}
+
+func (fs *longNamesFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	op.Entry.Child = 3
+	return nil
+}
+
+func (fs *longNamesFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	op.Entry.Child = 3
+	return nil
+}
+
+func (fs *longNamesFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	n := fuseops.MaxTargetLength + int(atomic.AddInt32(&fs.reads, 1)) - 1
+	op.Target = strings.Repeat("t", n)
+	return nil
+}
+
+func TestNameLengths(t *testing.T) {
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(&longNamesFS{}))
+	defer hangUp()
+
+	expect := func(unique uint64, errno syscall.Errno) []byte {
+		t.Helper()
+
+		r := readReply(t, kernel)
+		if r.unique != unique || r.errno != -int32(errno) {
+			t.Errorf("Reply %d: %+v, want errno %v", unique, r, errno)
+		}
+
+		return r.data
+	}
+
+	name := strings.Repeat("n", fuseops.MaxNameLength)
+	target := strings.Repeat("t", fuseops.MaxTargetLength)
+
+	// Names and targets up to the limits get through.
+	sendRequest(t, kernel, fusekernel.OpLookup, 1, []byte(name+"\x00"))
+	expect(1, 0)
+
+	sendRequest(t, kernel, fusekernel.OpSymlink, 2, []byte(name+"\x00"+target+"\x00"))
+	expect(2, 0)
+
+	// One byte more and they don't.
+	sendRequest(t, kernel, fusekernel.OpLookup, 3, []byte(name+"n\x00"))
+	expect(3, syscall.ENAMETOOLONG)
+
+	sendRequest(t, kernel, fusekernel.OpSymlink, 4, []byte(name+"\x00"+target+"t\x00"))
+	expect(4, syscall.ENAMETOOLONG)
+
+	sendRequest(t, kernel, fusekernel.OpUnlink, 5, []byte(name+"n\x00"))
+	expect(5, syscall.ENAMETOOLONG)
+
+	// Likewise for targets read back.
+	sendRequest(t, kernel, fusekernel.OpReadlink, 6, nil)
+	if data := expect(6, 0); string(data) != target {
+		t.Errorf("Readlink replied with %d bytes", len(data))
+	}
+
+	sendRequest(t, kernel, fusekernel.OpReadlink, 7, nil)
+	expect(7, syscall.ENAMETOOLONG)
+}
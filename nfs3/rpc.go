@@ -0,0 +1,106 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nfs3
+
+import (
+	"errors"
+)
+
+// ONC RPC constants (RFC 5531).
+const (
+	rpcVersion = 2
+
+	msgCall  = 0
+	msgReply = 1
+
+	msgAccepted = 0
+
+	acceptSuccess      = 0
+	acceptProgUnavail  = 1
+	acceptProgMismatch = 2
+	acceptProcUnavail  = 3
+	acceptGarbageArgs  = 4
+
+	authNone = 0
+	authUnix = 1
+)
+
+// Programs we serve.
+const (
+	progNFS   = 100003
+	progMount = 100005
+
+	versNFS   = 3
+	versMount = 3
+)
+
+// A decoded RPC call.
+type call struct {
+	xid  uint32
+	prog uint32
+	vers uint32
+	proc uint32
+
+	// The caller's credentials, if it sent AUTH_UNIX ones.
+	uid uint32
+	gid uint32
+
+	// The procedure's arguments.
+	args *decoder
+}
+
+var errNotCall = errors.New("not an RPC call")
+
+func parseCall(rec []byte) (*call, error) {
+	d := &decoder{b: rec}
+	c := &call{xid: d.u32()}
+	if d.u32() != msgCall || d.u32() != rpcVersion {
+		return nil, errNotCall
+	}
+
+	c.prog = d.u32()
+	c.vers = d.u32()
+	c.proc = d.u32()
+
+	flavor := d.u32()
+	cred := &decoder{b: d.opaque(400)}
+	if flavor == authUnix {
+		cred.u32()    // stamp
+		cred.str(255) // machine name
+		c.uid = cred.u32()
+		c.gid = cred.u32()
+	}
+
+	d.u32()       // verifier flavor
+	d.opaque(400) // verifier body
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	c.args = d
+	return c, nil
+}
+
+// Start the reply to a call, with the supplied accept status.
+func (c *call) reply(stat uint32) *encoder {
+	e := &encoder{}
+	e.u32(c.xid)
+	e.u32(msgReply)
+	e.u32(msgAccepted)
+	e.u32(authNone) // verifier
+	e.u32(0)
+	e.u32(stat)
+	return e
+}
@@ -0,0 +1,1211 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nfs3 is an experimental user-space NFSv3 server (RFC 1813) backed by
+// a fuseutil.FileSystem, offering a fallback on platforms where FUSE is not
+// available: the kernel's NFS client mounts the file system instead.
+//
+// The MOUNT and NFS programs are served on the same TCP port, and no
+// portmapper is registered with, so clients must be told where to go and not
+// to use the network lock manager. On Linux:
+//
+//	mount -t nfs -o vers=3,tcp,port=N,mountport=N,nolock 127.0.0.1:/ /mnt
+//
+// NFS is stateless: files are opened and released around each read or write,
+// and since a client may present a file handle at any time, inodes handed out
+// by the file system are never forgotten.
+package nfs3
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// Sizes we advertise in FSINFO.
+const (
+	maxReadSize  = 1 << 20
+	maxWriteSize = 1 << 20
+)
+
+// Server serves a file system to NFSv3 clients. The file system is shared by
+// all connections, and is not destroyed by the server.
+type Server struct {
+	fs fuseutil.FileSystem
+
+	// Returned by WRITE and COMMIT. It changes when the server restarts, telling
+	// clients to resend unstable writes.
+	writeVerf [8]byte
+
+	mu sync.Mutex
+
+	// The generation of each inode handed out by the file system, used to
+	// recognize stale file handles.
+	//
+	// GUARDED_BY(mu)
+	generations map[fuseops.InodeID]fuseops.GenerationNumber
+}
+
+// NewServer returns a server serving the supplied file system.
+func NewServer(fs fuseutil.FileSystem) *Server {
+	s := &Server{
+		fs: fs,
+		generations: map[fuseops.InodeID]fuseops.GenerationNumber{
+			fuseops.RootInodeID: 0,
+		},
+	}
+
+	binary.BigEndian.PutUint64(s.writeVerf[:], uint64(time.Now().UnixNano()))
+	return s
+}
+
+// Serve accepts connections from l and serves each on its own goroutine,
+// until Accept fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer c.Close()
+			s.ServeConn(c)
+		}()
+	}
+}
+
+// ServeConn serves RPC calls read from rw until the client hangs up, returning
+// nil in that case. Calls are served concurrently.
+func (s *Server) ServeConn(rw io.ReadWriter) error {
+	var wmu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		rec, err := readRecord(rw)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		c, err := parseCall(rec)
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply := s.handle(context.Background(), c).record()
+
+			wmu.Lock()
+			defer wmu.Unlock()
+			rw.Write(reply)
+		}()
+	}
+}
+
+func (s *Server) handle(ctx context.Context, c *call) *encoder {
+	var progVers uint32
+	var procs map[uint32]func(*Server, context.Context, *call, *encoder)
+	switch c.prog {
+	case progNFS:
+		progVers, procs = versNFS, nfsProcs
+	case progMount:
+		progVers, procs = versMount, mountProcs
+	default:
+		return c.reply(acceptProgUnavail)
+	}
+
+	if c.vers != progVers {
+		e := c.reply(acceptProgMismatch)
+		e.u32(progVers)
+		e.u32(progVers)
+		return e
+	}
+
+	proc, ok := procs[c.proc]
+	if !ok {
+		return c.reply(acceptProcUnavail)
+	}
+
+	e := c.reply(acceptSuccess)
+	proc(s, ctx, c, e)
+	if c.args.err != nil {
+		return c.reply(acceptGarbageArgs)
+	}
+
+	return e
+}
+
+////////////////////////////////////////////////////////////////////////
+// File handles
+////////////////////////////////////////////////////////////////////////
+
+// Record an inode handed out by the file system.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *Server) noteEntry(entry *fuseops.ChildInodeEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generations[entry.Child] = entry.Generation
+}
+
+// Encode the handle of an inode: its ID followed by its generation.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *Server) handleFor(id fuseops.InodeID) []byte {
+	s.mu.Lock()
+	gen := s.generations[id]
+	s.mu.Unlock()
+
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	binary.BigEndian.PutUint64(b[8:], uint64(gen))
+	return b
+}
+
+// Decode a file handle, returning an error unless it refers to an inode we
+// know of.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *Server) inodeFor(fh []byte) (fuseops.InodeID, error) {
+	if len(fh) != 16 {
+		return 0, errBadHandle
+	}
+
+	id := fuseops.InodeID(binary.BigEndian.Uint64(fh))
+	gen := fuseops.GenerationNumber(binary.BigEndian.Uint64(fh[8:]))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if known, ok := s.generations[id]; !ok || known != gen {
+		return 0, syscall.ESTALE
+	}
+
+	return id, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Status codes
+////////////////////////////////////////////////////////////////////////
+
+const (
+	nfsOK           = 0
+	nfsErrIO        = 5
+	nfsErrNotSupp   = 10004
+	nfsErrBadHandle = 10001
+)
+
+// Stands for NFS3ERR_BADHANDLE, which has no errno.
+var errBadHandle = syscall.Errno(0x7fff)
+
+// The nfsstat3 values for errors, cf. RFC 1813 section 2.6. Many coincide with
+// Linux's errno values, but not all, nor on all systems.
+var nfsStatus = map[syscall.Errno]uint32{
+	syscall.EPERM:        1,
+	syscall.ENOENT:       2,
+	syscall.EIO:          5,
+	syscall.ENXIO:        6,
+	syscall.EACCES:       13,
+	syscall.EEXIST:       17,
+	syscall.EXDEV:        18,
+	syscall.ENODEV:       19,
+	syscall.ENOTDIR:      20,
+	syscall.EISDIR:       21,
+	syscall.EINVAL:       22,
+	syscall.EFBIG:        27,
+	syscall.ENOSPC:       28,
+	syscall.EROFS:        30,
+	syscall.EMLINK:       31,
+	syscall.ENAMETOOLONG: 63,
+	syscall.ENOTEMPTY:    66,
+	syscall.EDQUOT:       69,
+	syscall.ESTALE:       70,
+	syscall.ENOSYS:       nfsErrNotSupp,
+	syscall.ENOTSUP:      nfsErrNotSupp,
+	errBadHandle:         nfsErrBadHandle,
+}
+
+func statusFor(err error) uint32 {
+	if err == nil {
+		return nfsOK
+	}
+
+	if errno, ok := err.(syscall.Errno); ok {
+		if st, ok := nfsStatus[errno]; ok {
+			return st
+		}
+	}
+
+	return nfsErrIO
+}
+
+////////////////////////////////////////////////////////////////////////
+// Attributes
+////////////////////////////////////////////////////////////////////////
+
+// ftype3 values.
+const (
+	nf3Reg  = 1
+	nf3Dir  = 2
+	nf3Blk  = 3
+	nf3Chr  = 4
+	nf3Lnk  = 5
+	nf3Sock = 6
+	nf3Fifo = 7
+)
+
+func fileType(mode os.FileMode) uint32 {
+	switch {
+	case mode&os.ModeDir != 0:
+		return nf3Dir
+	case mode&os.ModeSymlink != 0:
+		return nf3Lnk
+	case mode&os.ModeNamedPipe != 0:
+		return nf3Fifo
+	case mode&os.ModeSocket != 0:
+		return nf3Sock
+	case mode&os.ModeCharDevice != 0:
+		return nf3Chr
+	case mode&os.ModeDevice != 0:
+		return nf3Blk
+	default:
+		return nf3Reg
+	}
+}
+
+func encodeTime(e *encoder, t time.Time) {
+	e.u32(uint32(t.Unix()))
+	e.u32(uint32(t.Nanosecond()))
+}
+
+func encodeFattr(e *encoder, id fuseops.InodeID, a *fuseops.InodeAttributes) {
+	e.u32(fileType(a.Mode))
+	e.u32(fuseutil.UnixMode(a.Mode) & 07777)
+	e.u32(a.Nlink)
+	e.u32(a.Uid)
+	e.u32(a.Gid)
+	e.u64(a.Size)
+	e.u64((a.Size + 511) &^ 511) // used
+	e.u32(0)                     // rdev
+	e.u32(0)
+	e.u64(0) // fsid
+	e.u64(uint64(id))
+	encodeTime(e, a.Atime)
+	encodeTime(e, a.Mtime)
+	encodeTime(e, a.Ctime)
+}
+
+func (s *Server) getAttributes(
+	ctx context.Context,
+	c *call,
+	id fuseops.InodeID) (*fuseops.InodeAttributes, error) {
+	op := &fuseops.GetInodeAttributesOp{
+		Inode:     id,
+		OpContext: opContext(c),
+	}
+
+	if err := s.fs.GetInodeAttributes(ctx, op); err != nil {
+		return nil, err
+	}
+
+	return &op.Attributes, nil
+}
+
+// Encode a post_op_attr for the inode, which is left out if its attributes
+// can't be had.
+func (s *Server) postOpAttr(
+	ctx context.Context,
+	c *call,
+	e *encoder,
+	id fuseops.InodeID) {
+	if id == 0 {
+		e.bool(false)
+		return
+	}
+
+	attrs, err := s.getAttributes(ctx, c, id)
+	if err != nil {
+		e.bool(false)
+		return
+	}
+
+	e.bool(true)
+	encodeFattr(e, id, attrs)
+}
+
+// Encode a wcc_data for the inode, without attributes from before the
+// operation, which we don't have.
+func (s *Server) wccData(
+	ctx context.Context,
+	c *call,
+	e *encoder,
+	id fuseops.InodeID) {
+	e.bool(false)
+	s.postOpAttr(ctx, c, e, id)
+}
+
+func opContext(c *call) fuseops.OpContext {
+	return fuseops.OpContext{Uid: c.uid, Gid: c.gid}
+}
+
+// A decoded sattr3.
+type sattr struct {
+	mode  *os.FileMode
+	uid   *uint32
+	gid   *uint32
+	size  *uint64
+	atime *time.Time
+	mtime *time.Time
+
+	// Whether the times are set to the server's.
+	atimeNow bool
+	mtimeNow bool
+}
+
+// Values of time_how.
+const (
+	setToServerTime = 1
+	setToClientTime = 2
+)
+
+func decodeSattr(d *decoder) (a sattr) {
+	if d.bool() {
+		m := fuseutil.FileMode(d.u32())
+		a.mode = &m
+	}
+
+	if d.bool() {
+		uid := d.u32()
+		a.uid = &uid
+	}
+
+	if d.bool() {
+		gid := d.u32()
+		a.gid = &gid
+	}
+
+	if d.bool() {
+		size := d.u64()
+		a.size = &size
+	}
+
+	a.atime, a.atimeNow = decodeSetTime(d)
+	a.mtime, a.mtimeNow = decodeSetTime(d)
+
+	return a
+}
+
+// Decode a set_atime or set_mtime, returning the time if one is to be set,
+// and whether it is the server's.
+func decodeSetTime(d *decoder) (*time.Time, bool) {
+	switch d.u32() {
+	case setToServerTime:
+		now := time.Now()
+		return &now, true
+
+	case setToClientTime:
+		t := time.Unix(int64(d.u32()), int64(d.u32()))
+		return &t, false
+	}
+
+	return nil, false
+}
+
+// Apply attributes decoded by decodeSattr, if any are set.
+func (s *Server) setAttributes(
+	ctx context.Context,
+	c *call,
+	id fuseops.InodeID,
+	a sattr) error {
+	if a == (sattr{}) {
+		return nil
+	}
+
+	return s.fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{
+		Inode:     id,
+		Mode:      a.mode,
+		Uid:       a.uid,
+		Gid:       a.gid,
+		Size:      a.size,
+		Atime:     a.atime,
+		Mtime:     a.mtime,
+		AtimeNow:  a.atimeNow,
+		MtimeNow:  a.mtimeNow,
+		OpContext: opContext(c),
+	})
+}
+
+////////////////////////////////////////////////////////////////////////
+// MOUNT
+////////////////////////////////////////////////////////////////////////
+
+var mountProcs = map[uint32]func(*Server, context.Context, *call, *encoder){
+	0: func(*Server, context.Context, *call, *encoder) {},
+	1: (*Server).mnt,
+	3: func(s *Server, ctx context.Context, c *call, e *encoder) {
+		c.args.str(1024)
+	},
+	5: (*Server).export,
+}
+
+// Every path mounts the root of the file system.
+func (s *Server) mnt(ctx context.Context, c *call, e *encoder) {
+	c.args.str(1024)
+
+	e.u32(nfsOK)
+	e.opaque(s.handleFor(fuseops.RootInodeID))
+	e.u32(1)
+	e.u32(authUnix)
+}
+
+func (s *Server) export(ctx context.Context, c *call, e *encoder) {
+	e.bool(true)
+	e.str("/")
+	e.bool(false) // groups
+	e.bool(false)
+}
+
+////////////////////////////////////////////////////////////////////////
+// NFS
+////////////////////////////////////////////////////////////////////////
+
+var nfsProcs = map[uint32]func(*Server, context.Context, *call, *encoder){
+	0:  func(*Server, context.Context, *call, *encoder) {},
+	1:  (*Server).getattr,
+	2:  (*Server).setattr,
+	3:  (*Server).lookup,
+	4:  (*Server).access,
+	5:  (*Server).readlink,
+	6:  (*Server).read,
+	7:  (*Server).write,
+	8:  (*Server).create,
+	9:  (*Server).mkdir,
+	10: (*Server).symlink,
+	11: (*Server).mknod,
+	12: (*Server).remove,
+	13: (*Server).rmdir,
+	14: (*Server).rename,
+	15: (*Server).link,
+	16: (*Server).readdir,
+	17: (*Server).readdirplus,
+	18: (*Server).fsstat,
+	19: (*Server).fsinfo,
+	20: (*Server).pathconf,
+	21: (*Server).commit,
+}
+
+// Decode a file handle argument.
+func (s *Server) fhArg(c *call) (fuseops.InodeID, error) {
+	fh := c.args.opaque(64)
+	if c.args.err != nil {
+		return 0, c.args.err
+	}
+
+	return s.inodeFor(fh)
+}
+
+func (s *Server) getattr(ctx context.Context, c *call, e *encoder) {
+	id, err := s.fhArg(c)
+	var attrs *fuseops.InodeAttributes
+	if err == nil {
+		attrs, err = s.getAttributes(ctx, c, id)
+	}
+
+	e.u32(statusFor(err))
+	if err == nil {
+		encodeFattr(e, id, attrs)
+	}
+}
+
+func (s *Server) setattr(ctx context.Context, c *call, e *encoder) {
+	id, err := s.fhArg(c)
+	a := decodeSattr(c.args)
+	if c.args.bool() {
+		c.args.u32() // guard ctime
+		c.args.u32()
+	}
+
+	if err == nil {
+		err = s.setAttributes(ctx, c, id, a)
+	}
+
+	e.u32(statusFor(err))
+	s.wccData(ctx, c, e, id)
+}
+
+func (s *Server) lookup(ctx context.Context, c *call, e *encoder) {
+	dir, err := s.fhArg(c)
+	name := c.args.str(255)
+
+	op := &fuseops.LookUpInodeOp{
+		Parent:    dir,
+		Name:      name,
+		OpContext: opContext(c),
+	}
+
+	if err == nil {
+		err = s.fs.LookUpInode(ctx, op)
+	}
+
+	e.u32(statusFor(err))
+	if err != nil {
+		s.postOpAttr(ctx, c, e, dir)
+		return
+	}
+
+	s.noteEntry(&op.Entry)
+	e.opaque(s.handleFor(op.Entry.Child))
+	e.bool(true)
+	encodeFattr(e, op.Entry.Child, &op.Entry.Attributes)
+	s.postOpAttr(ctx, c, e, dir)
+}
+
+// ACCESS bits.
+const (
+	accessRead    = 0x01
+	accessLookup  = 0x02
+	accessModify  = 0x04
+	accessExtend  = 0x08
+	accessDelete  = 0x10
+	accessExecute = 0x20
+)
+
+func (s *Server) access(ctx context.Context, c *call, e *encoder) {
+	id, err := s.fhArg(c)
+	want := c.args.u32()
+
+	var attrs *fuseops.InodeAttributes
+	if err == nil {
+		attrs, err = s.getAttributes(ctx, c, id)
+	}
+
+	e.u32(statusFor(err))
+	if err != nil {
+		e.bool(false)
+		return
+	}
+
+	e.bool(true)
+	encodeFattr(e, id, attrs)
+
+	// Grant what the permission bits applying to the caller allow, as the
+	// kernel would with default_permissions. Root may do anything.
+	perm := uint32(attrs.Mode.Perm())
+	switch {
+	case c.uid == 0:
+		perm = 7
+	case c.uid == attrs.Uid:
+		perm >>= 6
+	case c.gid == attrs.Gid:
+		perm >>= 3
+	}
+
+	var granted uint32
+	if perm&4 != 0 {
+		granted |= accessRead
+	}
+	if perm&2 != 0 {
+		granted |= accessModify | accessExtend | accessDelete
+	}
+	if perm&1 != 0 {
+		granted |= accessLookup | accessExecute
+	}
+
+	e.u32(want & granted)
+}
+
+func (s *Server) readlink(ctx context.Context, c *call, e *encoder) {
+	id, err := s.fhArg(c)
+	op := &fuseops.ReadSymlinkOp{Inode: id, OpContext: opContext(c)}
+	if err == nil {
+		err = s.fs.ReadSymlink(ctx, op)
+	}
+
+	e.u32(statusFor(err))
+	s.postOpAttr(ctx, c, e, id)
+	if err == nil {
+		e.str(op.Target)
+	}
+}
+
+// Open the file, call f with the handle, and release it.
+func (s *Server) withFile(
+	ctx context.Context,
+	c *call,
+	id fuseops.InodeID,
+	flags int,
+	f func(fuseops.HandleID) error) error {
+	openOp := &fuseops.OpenFileOp{
+		Inode:     id,
+		OpenFlags: fusekernel.OpenFlags(flags),
+		OpContext: opContext(c),
+	}
+
+	if err := s.fs.OpenFile(ctx, openOp); err != nil {
+		return err
+	}
+
+	err := f(openOp.Handle)
+
+	flushErr := s.fs.FlushFile(ctx, &fuseops.FlushFileOp{
+		Inode:     id,
+		Handle:    openOp.Handle,
+		OpContext: opContext(c),
+	})
+
+	if err == nil && flushErr != syscall.ENOSYS {
+		err = flushErr
+	}
+
+	s.fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{
+		Handle:    openOp.Handle,
+		OpContext: opContext(c),
+	})
+
+	return err
+}
+
+func (s *Server) read(ctx context.Context, c *call, e *encoder) {
+	id, err := s.fhArg(c)
+	offset := c.args.u64()
+	count := c.args.u32()
+	if count > maxReadSize {
+		count = maxReadSize
+	}
+
+	var data []byte
+	if err == nil {
+		err = s.withFile(ctx, c, id, os.O_RDONLY, func(h fuseops.HandleID) error {
+			op := &fuseops.ReadFileOp{
+				Inode:     id,
+				Handle:    h,
+				Offset:    int64(offset),
+				Size:      int64(count),
+				Dst:       make([]byte, count),
+				OpContext: opContext(c),
+			}
+
+			if err := s.fs.ReadFile(ctx, op); err != nil {
+				return err
+			}
+
+			data = op.Dst[:op.BytesRead]
+			if op.Data != nil {
+				data = nil
+				for _, b := range op.Data {
+					data = append(data, b...)
+				}
+			}
+
+			return nil
+		})
+	}
+
+	var attrs *fuseops.InodeAttributes
+	if err == nil {
+		attrs, err = s.getAttributes(ctx, c, id)
+	}
+
+	e.u32(statusFor(err))
+	if err != nil {
+		e.bool(false)
+		return
+	}
+
+	e.bool(true)
+	encodeFattr(e, id, attrs)
+	e.u32(uint32(len(data)))
+	e.bool(offset+uint64(len(data)) >= attrs.Size)
+	e.opaque(data)
+}
+
+// stable_how values.
+const fileSync = 2
+
+func (s *Server) write(ctx context.Context, c *call, e *encoder) {
+	id, err := s.fhArg(c)
+	offset := c.args.u64()
+	c.args.u32() // count
+	c.args.u32() // stable
+	data := c.args.opaque(maxWriteSize)
+
+	if err == nil {
+		err = s.withFile(ctx, c, id, os.O_WRONLY, func(h fuseops.HandleID) error {
+			return s.fs.WriteFile(ctx, &fuseops.WriteFileOp{
+				Inode:     id,
+				Handle:    h,
+				Offset:    int64(offset),
+				Data:      data,
+				OpContext: opContext(c),
+			})
+		})
+	}
+
+	// The file was flushed and released, which is as stable as we can make it.
+	e.u32(statusFor(err))
+	s.wccData(ctx, c, e, id)
+	if err == nil {
+		e.u32(uint32(len(data)))
+		e.u32(fileSync)
+		e.fixed(s.writeVerf[:])
+	}
+}
+
+// Finish the reply to a call creating an entry.
+func (s *Server) created(
+	ctx context.Context,
+	c *call,
+	e *encoder,
+	dir fuseops.InodeID,
+	entry *fuseops.ChildInodeEntry,
+	err error) {
+	e.u32(statusFor(err))
+	if err == nil {
+		s.noteEntry(entry)
+		e.bool(true)
+		e.opaque(s.handleFor(entry.Child))
+		e.bool(true)
+		encodeFattr(e, entry.Child, &entry.Attributes)
+	}
+
+	s.wccData(ctx, c, e, dir)
+}
+
+// createhow3 values.
+const (
+	createUnchecked = 0
+	createGuarded   = 1
+	createExclusive = 2
+)
+
+func (s *Server) create(ctx context.Context, c *call, e *encoder) {
+	dir, err := s.fhArg(c)
+	name := c.args.str(255)
+	how := c.args.u32()
+
+	var a sattr
+	if how == createExclusive {
+		c.args.take(8) // verifier
+	} else {
+		a = decodeSattr(c.args)
+	}
+
+	mode := os.FileMode(0644)
+	if a.mode != nil {
+		mode = *a.mode & os.ModePerm
+	}
+
+	// Unchecked creation of an existing file truncates it, if asked to.
+	if err == nil && how == createUnchecked {
+		lookUpOp := &fuseops.LookUpInodeOp{
+			Parent:    dir,
+			Name:      name,
+			OpContext: opContext(c),
+		}
+
+		if s.fs.LookUpInode(ctx, lookUpOp) == nil {
+			s.noteEntry(&lookUpOp.Entry)
+			a.mode = nil
+			err = s.setAttributes(ctx, c, lookUpOp.Entry.Child, a)
+			s.created(ctx, c, e, dir, &lookUpOp.Entry, err)
+			return
+		}
+	}
+
+	op := &fuseops.CreateFileOp{
+		Parent:    dir,
+		Name:      name,
+		Mode:      mode,
+		OpContext: opContext(c),
+	}
+
+	if err == nil {
+		err = s.fs.CreateFile(ctx, op)
+	}
+
+	// NFS has no notion of the file being opened.
+	if err == nil {
+		s.fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{
+			Handle:    op.Handle,
+			OpContext: opContext(c),
+		})
+	}
+
+	s.created(ctx, c, e, dir, &op.Entry, err)
+}
+
+func (s *Server) mkdir(ctx context.Context, c *call, e *encoder) {
+	dir, err := s.fhArg(c)
+	name := c.args.str(255)
+	a := decodeSattr(c.args)
+
+	mode := os.FileMode(0755)
+	if a.mode != nil {
+		mode = *a.mode & os.ModePerm
+	}
+
+	op := &fuseops.MkDirOp{
+		Parent:    dir,
+		Name:      name,
+		Mode:      mode | os.ModeDir,
+		OpContext: opContext(c),
+	}
+
+	if err == nil {
+		err = s.fs.MkDir(ctx, op)
+	}
+
+	s.created(ctx, c, e, dir, &op.Entry, err)
+}
+
+func (s *Server) symlink(ctx context.Context, c *call, e *encoder) {
+	dir, err := s.fhArg(c)
+	name := c.args.str(255)
+	decodeSattr(c.args)
+	target := c.args.str(4096)
+
+	op := &fuseops.CreateSymlinkOp{
+		Parent:    dir,
+		Name:      name,
+		Target:    target,
+		OpContext: opContext(c),
+	}
+
+	if err == nil {
+		err = s.fs.CreateSymlink(ctx, op)
+	}
+
+	s.created(ctx, c, e, dir, &op.Entry, err)
+}
+
+func (s *Server) mknod(ctx context.Context, c *call, e *encoder) {
+	dir, err := s.fhArg(c)
+	if err == nil {
+		err = syscall.ENOTSUP
+	}
+
+	e.u32(statusFor(err))
+	s.wccData(ctx, c, e, dir)
+}
+
+func (s *Server) remove(ctx context.Context, c *call, e *encoder) {
+	dir, err := s.fhArg(c)
+	name := c.args.str(255)
+	if err == nil {
+		err = s.fs.Unlink(ctx, &fuseops.UnlinkOp{
+			Parent:    dir,
+			Name:      name,
+			OpContext: opContext(c),
+		})
+	}
+
+	e.u32(statusFor(err))
+	s.wccData(ctx, c, e, dir)
+}
+
+func (s *Server) rmdir(ctx context.Context, c *call, e *encoder) {
+	dir, err := s.fhArg(c)
+	name := c.args.str(255)
+	if err == nil {
+		err = s.fs.RmDir(ctx, &fuseops.RmDirOp{
+			Parent:    dir,
+			Name:      name,
+			OpContext: opContext(c),
+		})
+	}
+
+	e.u32(statusFor(err))
+	s.wccData(ctx, c, e, dir)
+}
+
+func (s *Server) rename(ctx context.Context, c *call, e *encoder) {
+	from, err1 := s.fhArg(c)
+	fromName := c.args.str(255)
+	to, err2 := s.fhArg(c)
+	toName := c.args.str(255)
+
+	err := err1
+	if err == nil {
+		err = err2
+	}
+
+	if err == nil {
+		err = s.fs.Rename(ctx, &fuseops.RenameOp{
+			OldParent: from,
+			OldName:   fromName,
+			NewParent: to,
+			NewName:   toName,
+			OpContext: opContext(c),
+		})
+	}
+
+	e.u32(statusFor(err))
+	s.wccData(ctx, c, e, from)
+	s.wccData(ctx, c, e, to)
+}
+
+func (s *Server) link(ctx context.Context, c *call, e *encoder) {
+	id, err1 := s.fhArg(c)
+	dir, err2 := s.fhArg(c)
+	name := c.args.str(255)
+
+	err := err1
+	if err == nil {
+		err = err2
+	}
+
+	op := &fuseops.CreateLinkOp{
+		Parent:    dir,
+		Name:      name,
+		Target:    id,
+		OpContext: opContext(c),
+	}
+
+	if err == nil {
+		err = s.fs.CreateLink(ctx, op)
+	}
+
+	e.u32(statusFor(err))
+	s.postOpAttr(ctx, c, e, id)
+	s.wccData(ctx, c, e, dir)
+}
+
+// Read directory entries from the supplied cookie on, calling f for each
+// until it returns false.
+func (s *Server) readDir(
+	ctx context.Context,
+	c *call,
+	dir fuseops.InodeID,
+	cookie uint64,
+	size int,
+	f func(fuseutil.Dirent) bool) (eof bool, err error) {
+	openOp := &fuseops.OpenDirOp{Inode: dir, OpContext: opContext(c)}
+	if err := s.fs.OpenDir(ctx, openOp); err != nil {
+		return false, err
+	}
+
+	defer s.fs.ReleaseDirHandle(ctx, &fuseops.ReleaseDirHandleOp{
+		Handle:    openOp.Handle,
+		OpContext: opContext(c),
+	})
+
+	for {
+		op := &fuseops.ReadDirOp{
+			Inode:     dir,
+			Handle:    openOp.Handle,
+			Offset:    fuseops.DirOffset(cookie),
+			Dst:       make([]byte, size),
+			OpContext: opContext(c),
+		}
+
+		if err := s.fs.ReadDir(ctx, op); err != nil {
+			return false, err
+		}
+
+		if op.BytesRead == 0 {
+			return true, nil
+		}
+
+		b := op.Dst[:op.BytesRead]
+		for len(b) > 0 {
+			d, n := fuseutil.ReadDirent(b)
+			if n == 0 {
+				break
+			}
+			b = b[n:]
+
+			if !f(d) {
+				return false, nil
+			}
+
+			cookie = uint64(d.Offset)
+		}
+	}
+}
+
+func (s *Server) readdir(ctx context.Context, c *call, e *encoder) {
+	s.readdirCommon(ctx, c, e, false)
+}
+
+func (s *Server) readdirplus(ctx context.Context, c *call, e *encoder) {
+	s.readdirCommon(ctx, c, e, true)
+}
+
+// Serve READDIR or READDIRPLUS. The latter returns neither attributes nor
+// handles, leaving the client to look entries up.
+func (s *Server) readdirCommon(
+	ctx context.Context,
+	c *call,
+	e *encoder,
+	plus bool) {
+	dir, err := s.fhArg(c)
+	cookie := c.args.u64()
+	c.args.take(8) // cookie verifier
+	if plus {
+		c.args.u32() // dircount
+	}
+	count := c.args.u32()
+
+	if err != nil {
+		e.u32(statusFor(err))
+		e.bool(false)
+		return
+	}
+
+	// Encode entries to the side, so as to stop once count is reached.
+	var entries encoder
+	limit := int(count) - 128
+	eof, err := s.readDir(ctx, c, dir, cookie, int(count), func(d fuseutil.Dirent) bool {
+		var entry encoder
+		entry.bool(true)
+		entry.u64(uint64(d.Inode))
+		entry.str(d.Name)
+		entry.u64(uint64(d.Offset))
+		if plus {
+			entry.bool(false) // name_attributes
+			entry.bool(false) // name_handle
+		}
+
+		if len(entries.b)+len(entry.b) > limit {
+			return false
+		}
+
+		entries.b = append(entries.b, entry.b...)
+		return true
+	})
+
+	e.u32(statusFor(err))
+	s.postOpAttr(ctx, c, e, dir)
+	if err != nil {
+		return
+	}
+
+	e.u64(0) // cookie verifier
+	e.b = append(e.b, entries.b...)
+	e.bool(false)
+	e.bool(eof)
+}
+
+func (s *Server) fsstat(ctx context.Context, c *call, e *encoder) {
+	id, err := s.fhArg(c)
+	op := &fuseops.StatFSOp{}
+	if err == nil {
+		err = s.fs.StatFS(ctx, op)
+	}
+
+	e.u32(statusFor(err))
+	s.postOpAttr(ctx, c, e, id)
+	if err != nil {
+		return
+	}
+
+	bs := uint64(op.BlockSize)
+	e.u64(op.Blocks * bs)
+	e.u64(op.BlocksFree * bs)
+	e.u64(op.BlocksAvailable * bs)
+	e.u64(op.Inodes)
+	e.u64(op.InodesFree)
+	e.u64(op.InodesFree)
+	e.u32(0) // invarsec
+}
+
+// FSINFO properties.
+const (
+	fsfLink        = 0x0001
+	fsfSymlink     = 0x0002
+	fsfHomogeneous = 0x0008
+	fsfCanSetTime  = 0x0010
+)
+
+func (s *Server) fsinfo(ctx context.Context, c *call, e *encoder) {
+	id, err := s.fhArg(c)
+	e.u32(statusFor(err))
+	s.postOpAttr(ctx, c, e, id)
+	if err != nil {
+		return
+	}
+
+	e.u32(maxReadSize)  // rtmax
+	e.u32(maxReadSize)  // rtpref
+	e.u32(4096)         // rtmult
+	e.u32(maxWriteSize) // wtmax
+	e.u32(maxWriteSize) // wtpref
+	e.u32(4096)         // wtmult
+	e.u32(64 << 10)     // dtpref
+	e.u64(1<<63 - 1)    // maxfilesize
+	e.u32(0)            // time_delta
+	e.u32(1)
+	e.u32(fsfLink | fsfSymlink | fsfHomogeneous | fsfCanSetTime)
+}
+
+func (s *Server) pathconf(ctx context.Context, c *call, e *encoder) {
+	id, err := s.fhArg(c)
+	e.u32(statusFor(err))
+	s.postOpAttr(ctx, c, e, id)
+	if err != nil {
+		return
+	}
+
+	e.u32(1 << 16) // linkmax
+	e.u32(255)     // name_max
+	e.bool(true)   // no_trunc
+	e.bool(true)   // chown_restricted
+	e.bool(false)  // case_insensitive
+	e.bool(true)   // case_preserving
+}
+
+func (s *Server) commit(ctx context.Context, c *call, e *encoder) {
+	id, err := s.fhArg(c)
+	c.args.u64() // offset
+	c.args.u32() // count
+
+	if err == nil {
+		err = s.withFile(ctx, c, id, os.O_WRONLY, func(h fuseops.HandleID) error {
+			err := s.fs.SyncFile(ctx, &fuseops.SyncFileOp{
+				Inode:     id,
+				Handle:    h,
+				OpContext: opContext(c),
+			})
+
+			if err == syscall.ENOSYS {
+				err = nil
+			}
+
+			return err
+		})
+	}
+
+	e.u32(statusFor(err))
+	s.wccData(ctx, c, e, id)
+	if err == nil {
+		e.fixed(s.writeVerf[:])
+	}
+}
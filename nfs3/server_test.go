@@ -0,0 +1,392 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nfs3
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A file system with a root directory holding files.
+type flatFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu      sync.Mutex
+	names   []string
+	content map[fuseops.InodeID][]byte
+	opened  int
+}
+
+func newFlatFS() *flatFS {
+	return &flatFS{
+		names:   []string{"", "", "taco"},
+		content: map[fuseops.InodeID][]byte{2: []byte("burrito")},
+	}
+}
+
+func (fs *flatFS) attributes(id fuseops.InodeID) fuseops.InodeAttributes {
+	if id == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{Mode: 0755 | os.ModeDir, Nlink: 1}
+	}
+
+	return fuseops.InodeAttributes{
+		Mode:  0644,
+		Nlink: 1,
+		Size:  uint64(len(fs.content[id])),
+	}
+}
+
+func (fs *flatFS) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for i, name := range fs.names {
+		if i > 1 && name == op.Name {
+			op.Entry.Child = fuseops.InodeID(i)
+			op.Entry.Attributes = fs.attributes(op.Entry.Child)
+			return nil
+		}
+	}
+
+	return syscall.ENOENT
+}
+
+func (fs *flatFS) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Attributes = fs.attributes(op.Inode)
+	return nil
+}
+
+func (fs *flatFS) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *flatFS) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for i := int(op.Offset) + 2; i < len(fs.names); i++ {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i - 1),
+			Inode:  fuseops.InodeID(i),
+			Name:   fs.names[i],
+			Type:   fuseutil.DT_File,
+		})
+		if n == 0 {
+			break
+		}
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *flatFS) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.opened++
+	return nil
+}
+
+func (fs *flatFS) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.opened--
+	return nil
+}
+
+func (fs *flatFS) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.opened++
+	fs.names = append(fs.names, op.Name)
+	op.Entry.Child = fuseops.InodeID(len(fs.names) - 1)
+	op.Entry.Attributes = fs.attributes(op.Entry.Child)
+	return nil
+}
+
+func (fs *flatFS) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	b := fs.content[op.Inode]
+	if op.Offset < int64(len(b)) {
+		op.BytesRead = copy(op.Dst, b[op.Offset:])
+	}
+
+	return nil
+}
+
+func (fs *flatFS) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	b := fs.content[op.Inode]
+	for int64(len(b)) < op.Offset+int64(len(op.Data)) {
+		b = append(b, 0)
+	}
+	copy(b[op.Offset:], op.Data)
+	fs.content[op.Inode] = b
+	return nil
+}
+
+// A synchronous client, sending one call at a time.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	xid  uint32
+}
+
+// Make a call and return the results, failing the test unless it succeeded at
+// the RPC level.
+func (c *client) rpc(prog, proc uint32, build func(e *encoder)) *decoder {
+	c.t.Helper()
+
+	c.xid++
+	e := &encoder{}
+	e.u32(c.xid)
+	e.u32(msgCall)
+	e.u32(rpcVersion)
+	e.u32(prog)
+	e.u32(3)
+	e.u32(proc)
+
+	var cred encoder
+	cred.u32(0)
+	cred.str("localhost")
+	cred.u32(1000)
+	cred.u32(1000)
+	cred.u32(0)
+	e.u32(authUnix)
+	e.opaque(cred.b)
+	e.u32(authNone)
+	e.u32(0)
+
+	if build != nil {
+		build(e)
+	}
+
+	if _, err := c.conn.Write(e.record()); err != nil {
+		c.t.Fatalf("Write: %v", err)
+	}
+
+	rec, err := readRecord(c.conn)
+	if err != nil {
+		c.t.Fatalf("readRecord: %v", err)
+	}
+
+	d := &decoder{b: rec}
+	if xid := d.u32(); xid != c.xid {
+		c.t.Fatalf("Reply to xid %d, expected %d", xid, c.xid)
+	}
+
+	d.u32() // REPLY
+	d.u32() // MSG_ACCEPTED
+	d.u32() // verifier
+	d.opaque(400)
+	if stat := d.u32(); stat != acceptSuccess {
+		c.t.Fatalf("Call %d/%d: accept status %d", prog, proc, stat)
+	}
+
+	return d
+}
+
+func startServer(t *testing.T, fs fuseutil.FileSystem) (c *client, root []byte, hangUp func()) {
+	local, remote := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		NewServer(fs).ServeConn(remote)
+		close(done)
+	}()
+
+	c = &client{t: t, conn: local}
+	d := c.rpc(progMount, 1, func(e *encoder) { e.str("/") })
+	if st := d.u32(); st != nfsOK {
+		t.Fatalf("MNT: status %d", st)
+	}
+	root = d.opaque(64)
+
+	return c, root, func() {
+		local.Close()
+		<-done
+	}
+}
+
+// Look up a name in the directory, returning the status and the handle.
+func (c *client) lookup(dir []byte, name string) (uint32, []byte) {
+	d := c.rpc(progNFS, 3, func(e *encoder) {
+		e.opaque(dir)
+		e.str(name)
+	})
+
+	st := d.u32()
+	if st != nfsOK {
+		return st, nil
+	}
+
+	return st, d.opaque(64)
+}
+
+func TestLookUpRead(t *testing.T) {
+	fs := newFlatFS()
+	c, root, hangUp := startServer(t, fs)
+	defer hangUp()
+
+	st, fh := c.lookup(root, "taco")
+	if st != nfsOK {
+		t.Fatalf("LOOKUP: status %d", st)
+	}
+
+	d := c.rpc(progNFS, 6, func(e *encoder) {
+		e.opaque(fh)
+		e.u64(2)
+		e.u32(100)
+	})
+
+	if st := d.u32(); st != nfsOK {
+		t.Fatalf("READ: status %d", st)
+	}
+
+	if d.bool() {
+		d.take(84) // fattr3
+	}
+
+	d.u32() // count
+	eof := d.bool()
+	if got := string(d.opaque(100)); got != "rrito" || !eof {
+		t.Errorf("Read %q, eof %v", got, eof)
+	}
+
+	if fs.opened != 0 {
+		t.Errorf("%d files left open", fs.opened)
+	}
+}
+
+func TestLookUpMissing(t *testing.T) {
+	c, root, hangUp := startServer(t, newFlatFS())
+	defer hangUp()
+
+	if st, _ := c.lookup(root, "enchilada"); st != 2 {
+		t.Errorf("Expected NFS3ERR_NOENT, got %d", st)
+	}
+}
+
+func TestStaleHandle(t *testing.T) {
+	c, _, hangUp := startServer(t, newFlatFS())
+	defer hangUp()
+
+	// A handle for an inode the server never handed out.
+	var fh encoder
+	fh.u64(17)
+	fh.u64(0)
+
+	d := c.rpc(progNFS, 1, func(e *encoder) { e.opaque(fh.b) })
+	if st := d.u32(); st != 70 {
+		t.Errorf("Expected NFS3ERR_STALE, got %d", st)
+	}
+}
+
+func TestCreateWriteReadDir(t *testing.T) {
+	fs := newFlatFS()
+	c, root, hangUp := startServer(t, fs)
+
+	d := c.rpc(progNFS, 8, func(e *encoder) {
+		e.opaque(root)
+		e.str("queso")
+		e.u32(createGuarded)
+		e.bool(true) // mode
+		e.u32(0644)
+		e.bool(false)
+		e.bool(false)
+		e.bool(false)
+		e.u32(0) // atime
+		e.u32(0) // mtime
+	})
+
+	if st := d.u32(); st != nfsOK {
+		t.Fatalf("CREATE: status %d", st)
+	}
+
+	if !d.bool() {
+		t.Fatalf("CREATE returned no handle")
+	}
+	fh := d.opaque(64)
+
+	d = c.rpc(progNFS, 7, func(e *encoder) {
+		e.opaque(fh)
+		e.u64(0)
+		e.u32(4)
+		e.u32(0) // UNSTABLE
+		e.str("dip!")
+	})
+
+	if st := d.u32(); st != nfsOK {
+		t.Fatalf("WRITE: status %d", st)
+	}
+
+	// List the root.
+	d = c.rpc(progNFS, 16, func(e *encoder) {
+		e.opaque(root)
+		e.u64(0)
+		e.u64(0)
+		e.u32(4096)
+	})
+
+	if st := d.u32(); st != nfsOK {
+		t.Fatalf("READDIR: status %d", st)
+	}
+
+	if d.bool() {
+		d.take(84)
+	}
+	d.u64() // cookie verifier
+
+	var names []string
+	for d.bool() {
+		d.u64() // fileid
+		names = append(names, d.str(255))
+		d.u64() // cookie
+	}
+
+	if eof := d.bool(); !eof {
+		t.Errorf("READDIR not at EOF")
+	}
+
+	if len(names) != 2 || names[0] != "taco" || names[1] != "queso" {
+		t.Errorf("Entries: %q", names)
+	}
+
+	hangUp()
+
+	if got := string(fs.content[3]); got != "dip!" {
+		t.Errorf("Content: %q", got)
+	}
+
+	if fs.opened != 0 {
+		t.Errorf("%d files left open", fs.opened)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nfs3
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errShortMessage = errors.New("short message")
+
+// The largest RPC record we accept.
+const maxRecordSize = 2 << 20
+
+// Read an RPC record, made of one or more fragments each preceded by a 4-byte
+// marker holding its length and, in its top bit, whether it is the last one
+// (RFC 5531, section 11).
+func readRecord(r io.Reader) ([]byte, error) {
+	var rec []byte
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil {
+			if err == io.EOF && rec != nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		m := binary.BigEndian.Uint32(marker[:])
+		n := int(m &^ (1 << 31))
+		if len(rec)+n > maxRecordSize {
+			return nil, fmt.Errorf("record too large")
+		}
+
+		frag := make([]byte, n)
+		if _, err := io.ReadFull(r, frag); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		rec = append(rec, frag...)
+		if m&(1<<31) != 0 {
+			return rec, nil
+		}
+	}
+}
+
+// Decodes XDR data (RFC 4506) in order. The first decoding error is sticky,
+// and reported by err.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	// Items are padded to a multiple of four bytes.
+	padded := (n + 3) &^ 3
+	if n < 0 || len(d.b) < padded {
+		d.err = errShortMessage
+		return nil
+	}
+
+	b := d.b[:n]
+	d.b = d.b[padded:]
+	return b
+}
+
+func (d *decoder) u32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) u64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) bool() bool {
+	return d.u32() != 0
+}
+
+// Decode variable-length opaque data, of at most max bytes.
+func (d *decoder) opaque(max int) []byte {
+	n := d.u32()
+	if d.err == nil && n > uint32(max) {
+		d.err = fmt.Errorf("opaque of %d bytes exceeds %d", n, max)
+	}
+	return d.take(int(n))
+}
+
+func (d *decoder) str(max int) string {
+	return string(d.opaque(max))
+}
+
+// Encodes XDR data.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) u32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) u64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.u32(1)
+	} else {
+		e.u32(0)
+	}
+}
+
+// Encode fixed-length opaque data.
+func (e *encoder) fixed(b []byte) {
+	e.b = append(e.b, b...)
+	for len(e.b)%4 != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+// Encode variable-length opaque data.
+func (e *encoder) opaque(b []byte) {
+	e.u32(uint32(len(b)))
+	e.fixed(b)
+}
+
+func (e *encoder) str(s string) {
+	e.opaque([]byte(s))
+}
+
+// Return the encoded data as a single-fragment record.
+func (e *encoder) record() []byte {
+	rec := make([]byte, 4, 4+len(e.b))
+	binary.BigEndian.PutUint32(rec, uint32(len(e.b))|1<<31)
+	return append(rec, e.b...)
+}
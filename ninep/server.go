@@ -0,0 +1,1556 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ninep serves a fuseutil.FileSystem over 9P2000.L, the dialect of
+// the Plan 9 file protocol spoken by the Linux v9fs client, QEMU's virtio-9p
+// transport and WSL. This lets one file system implementation back both FUSE
+// mounts and 9p shares.
+//
+// The server translates each 9P request into the ops the kernel would have
+// sent over /dev/fuse, including the lookup counts ForgetInode relies on: an
+// inode is forgotten once no fid refers to it any longer.
+package ninep
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// The largest message we agree to exchange, comfortably larger than the 512
+// KiB the Linux client asks for by default.
+const maxMessageSize = 1<<20 + 4096
+
+// The overhead of an Rread or Twrite message beyond its data.
+const ioHeaderSize = headerSize + 4 + 8 + 4
+
+// The largest value, as read with ListXattr or GetXattr.
+const maxXattrSize = 64 << 10
+
+// Server serves a file system to 9P2000.L clients. The file system is shared
+// by all connections, and is not destroyed by the server.
+type Server struct {
+	fs fuseutil.FileSystem
+
+	mu sync.Mutex
+
+	// Lookup counts owed to the file system for inodes returned by it, and the
+	// number of fids referring to each. When the latter drops to zero the
+	// former are given back with ForgetInode.
+	//
+	// GUARDED_BY(mu)
+	refs map[fuseops.InodeID]*inodeRef
+}
+
+type inodeRef struct {
+	lookups uint64
+	fids    int
+}
+
+// NewServer returns a server serving the supplied file system.
+func NewServer(fs fuseutil.FileSystem) *Server {
+	return &Server{
+		fs:   fs,
+		refs: make(map[fuseops.InodeID]*inodeRef),
+	}
+}
+
+// Serve accepts connections from l and serves each on its own goroutine,
+// until Accept fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer c.Close()
+			s.ServeConn(c)
+		}()
+	}
+}
+
+// ServeConn serves requests read from rw until the client hangs up, returning
+// nil in that case. Requests are served concurrently. All fids of the
+// connection are clunked before returning.
+func (s *Server) ServeConn(rw io.ReadWriter) error {
+	c := &conn{
+		s:        s,
+		rw:       rw,
+		msize:    maxMessageSize,
+		fids:     make(map[uint32]*fid),
+		inFlight: make(map[uint16]*request),
+	}
+
+	defer c.clunkAll()
+
+	for {
+		typ, tag, body, err := readMessage(rw, c.maxSize())
+		if err == io.EOF {
+			c.wg.Wait()
+			return nil
+		}
+
+		if err != nil {
+			c.wg.Wait()
+			return err
+		}
+
+		// Versions are negotiated alone, and flushes are answered in order.
+		switch typ {
+		case tversion:
+			c.wg.Wait()
+			c.reply(c.version(tag, body))
+			continue
+
+		case tflush:
+			c.flush(tag, body)
+			continue
+		}
+
+		r := c.begin(tag)
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			msg := c.handle(r.ctx, typ, tag, body)
+
+			// A Tflush for this request must be answered after it.
+			c.reply(msg)
+			c.finish(tag, r)
+		}()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Lookup counts
+////////////////////////////////////////////////////////////////////////
+
+// Record that the file system handed out a lookup count for the inode.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *Server) noteLookup(id fuseops.InodeID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ref(id).lookups++
+}
+
+// Record that a fid refers to the inode.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *Server) retain(id fuseops.InodeID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ref(id).fids++
+}
+
+// Record that a fid no longer refers to the inode, forgetting it if no others
+// do.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *Server) release(id fuseops.InodeID) {
+	s.mu.Lock()
+	s.ref(id).fids--
+	s.mu.Unlock()
+
+	s.settle(id)
+}
+
+// Forget the inode if no fid refers to it.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *Server) settle(id fuseops.InodeID) {
+	s.mu.Lock()
+	r := s.ref(id)
+	if r.fids > 0 {
+		s.mu.Unlock()
+		return
+	}
+
+	delete(s.refs, id)
+	n := r.lookups
+	s.mu.Unlock()
+
+	if n > 0 {
+		s.fs.ForgetInode(context.Background(), &fuseops.ForgetInodeOp{
+			Inode: id,
+			N:     n,
+		})
+	}
+}
+
+// EXCLUSIVE_LOCKS_REQUIRED(s.mu)
+func (s *Server) ref(id fuseops.InodeID) *inodeRef {
+	r, ok := s.refs[id]
+	if !ok {
+		r = &inodeRef{}
+		s.refs[id] = r
+	}
+
+	return r
+}
+
+////////////////////////////////////////////////////////////////////////
+// Connections
+////////////////////////////////////////////////////////////////////////
+
+// The state of a fid, a client's handle on an inode. The fids in the table are
+// only changed with conn.mu held, through updateFid; requests work on the
+// copies handed out by lookUpFid.
+type fid struct {
+	inode fuseops.InodeID
+
+	// The directory entry through which the inode was reached, for requests
+	// that name the fid rather than the entry. Zero for the root.
+	parent fuseops.InodeID
+	name   string
+
+	// The credentials supplied when attaching.
+	uid uint32
+
+	// Set once the fid has been opened.
+	opened bool
+	isDir  bool
+	handle fuseops.HandleID
+
+	// Set for fids created by Txattrwalk, holding the value to be read.
+	xattr []byte
+
+	// Set for fids turned into a new extended attribute by Txattrcreate.
+	xattrCreate *xattrCreate
+}
+
+type xattrCreate struct {
+	name  string
+	size  uint64
+	flags uint32
+	value []byte
+}
+
+// An in-flight request, which may be flushed.
+type request struct {
+	ctx    context.Context
+	cancel func()
+	done   chan struct{}
+}
+
+type conn struct {
+	s  *Server
+	rw io.ReadWriter
+
+	wmu sync.Mutex
+	wg  sync.WaitGroup
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	msize    uint32
+	fids     map[uint32]*fid
+	inFlight map[uint16]*request
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *conn) maxSize() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.msize
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *conn) begin(tag uint16) *request {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &request{
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	c.inFlight[tag] = r
+	c.mu.Unlock()
+
+	return r
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *conn) finish(tag uint16, r *request) {
+	c.mu.Lock()
+	if c.inFlight[tag] == r {
+		delete(c.inFlight, tag)
+	}
+	c.mu.Unlock()
+
+	r.cancel()
+	close(r.done)
+}
+
+// Send the supplied reply.
+func (c *conn) reply(msg []byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.rw.Write(msg)
+}
+
+// Cancel the request with the tag named by a Tflush, and reply once it has
+// been answered, as the protocol requires.
+func (c *conn) flush(tag uint16, body []byte) {
+	d := decoder{b: body}
+	oldTag := d.u16()
+
+	c.mu.Lock()
+	r := c.inFlight[oldTag]
+	c.mu.Unlock()
+
+	if r != nil {
+		r.cancel()
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		if r != nil {
+			<-r.done
+		}
+
+		c.reply(newEncoder(tflush+1, tag).finish())
+	}()
+}
+
+func (c *conn) version(tag uint16, body []byte) []byte {
+	d := decoder{b: body}
+	msize := d.u32()
+	version := d.str()
+	if d.err != nil {
+		return errorReply(tag, syscall.EINVAL)
+	}
+
+	// A new session starts: all fids are implicitly clunked.
+	c.clunkAll()
+
+	if msize > maxMessageSize {
+		msize = maxMessageSize
+	}
+
+	if version != "9P2000.L" {
+		version = "unknown"
+	}
+
+	c.mu.Lock()
+	c.msize = msize
+	c.mu.Unlock()
+
+	e := newEncoder(tversion+1, tag)
+	e.u32(msize)
+	e.str(version)
+	return e.finish()
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *conn) clunkAll() {
+	c.mu.Lock()
+	fids := c.fids
+	c.fids = make(map[uint32]*fid)
+	c.mu.Unlock()
+
+	for _, f := range fids {
+		c.closeFid(context.Background(), f)
+	}
+}
+
+// Return a copy of the state of fid n.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *conn) lookUpFid(n uint32) (*fid, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.fids[n]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	cp := *f
+	return &cp, nil
+}
+
+// Call update with the state of fid n, with c.mu held.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *conn) updateFid(n uint32, update func(f *fid) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.fids[n]
+	if !ok {
+		return syscall.EBADF
+	}
+
+	return update(f)
+}
+
+// Install f as fid n, which must not be in use, unless replace is set.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *conn) installFid(n uint32, f *fid, replace bool) error {
+	c.mu.Lock()
+	old, ok := c.fids[n]
+	if ok && !replace {
+		c.mu.Unlock()
+		return syscall.EBADF
+	}
+
+	c.fids[n] = f
+	c.mu.Unlock()
+
+	c.s.retain(f.inode)
+	if ok {
+		c.closeFid(context.Background(), old)
+	}
+
+	return nil
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *conn) removeFid(n uint32) (*fid, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.fids[n]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	delete(c.fids, n)
+	return f, nil
+}
+
+// Release everything held by a fid that has been removed from the table.
+func (c *conn) closeFid(ctx context.Context, f *fid) error {
+	var err error
+	fs := c.s.fs
+	op := fuseops.OpContext{Uid: f.uid}
+
+	switch {
+	case f.xattrCreate != nil:
+		x := f.xattrCreate
+		if x.size == 0 {
+			err = fs.RemoveXattr(ctx, &fuseops.RemoveXattrOp{
+				Inode:     f.inode,
+				Name:      x.name,
+				OpContext: op,
+			})
+		} else if uint64(len(x.value)) != x.size {
+			err = syscall.EINVAL
+		} else {
+			err = fs.SetXattr(ctx, &fuseops.SetXattrOp{
+				Inode:     f.inode,
+				Name:      x.name,
+				Value:     x.value,
+				Flags:     x.flags,
+				OpContext: op,
+			})
+		}
+
+	case f.opened && f.isDir:
+		fs.ReleaseDirHandle(ctx, &fuseops.ReleaseDirHandleOp{
+			Handle:    f.handle,
+			OpContext: op,
+		})
+
+	case f.opened:
+		err = fs.FlushFile(ctx, &fuseops.FlushFileOp{
+			Inode:     f.inode,
+			Handle:    f.handle,
+			OpContext: op,
+		})
+		if err == syscall.ENOSYS {
+			err = nil
+		}
+
+		fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{
+			Handle:    f.handle,
+			OpContext: op,
+		})
+	}
+
+	c.s.release(f.inode)
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////
+// Requests
+////////////////////////////////////////////////////////////////////////
+
+func errorReply(tag uint16, err error) []byte {
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		errno = syscall.EIO
+	}
+
+	e := newEncoder(rlerror, tag)
+	e.u32(uint32(errno))
+	return e.finish()
+}
+
+// Handle a request, returning the reply to send. Replies to flushed requests
+// are sent too: the client honors those that arrive before the Rflush.
+func (c *conn) handle(
+	ctx context.Context,
+	typ uint8,
+	tag uint16,
+	body []byte) []byte {
+	d := &decoder{b: body}
+	e := newEncoder(typ+1, tag)
+
+	var err error
+	switch typ {
+	default:
+		err = syscall.EOPNOTSUPP
+
+	case tauth, tlock, tgetlock:
+		err = syscall.EOPNOTSUPP
+
+	case tattach:
+		err = c.attach(ctx, d, e)
+
+	case twalk:
+		err = c.walk(ctx, d, e)
+
+	case tgetattr:
+		err = c.getattr(ctx, d, e)
+
+	case tsetattr:
+		err = c.setattr(ctx, d, e)
+
+	case tstatfs:
+		err = c.statfs(ctx, d, e)
+
+	case tlopen:
+		err = c.lopen(ctx, d, e)
+
+	case tlcreate:
+		err = c.lcreate(ctx, d, e)
+
+	case tsymlink:
+		err = c.symlink(ctx, d, e)
+
+	case tmknod:
+		err = c.mknod(ctx, d, e)
+
+	case tmkdir:
+		err = c.mkdir(ctx, d, e)
+
+	case tlink:
+		err = c.link(ctx, d, e)
+
+	case treadlink:
+		err = c.readlink(ctx, d, e)
+
+	case trename:
+		err = c.rename(ctx, d, e)
+
+	case trenameat:
+		err = c.renameat(ctx, d, e)
+
+	case tunlinkat:
+		err = c.unlinkat(ctx, d, e)
+
+	case tremove:
+		err = c.remove(ctx, d, e)
+
+	case tread:
+		err = c.read(ctx, d, e)
+
+	case twrite:
+		err = c.write(ctx, d, e)
+
+	case treaddir:
+		err = c.readdir(ctx, d, e)
+
+	case tfsync:
+		err = c.fsync(ctx, d, e)
+
+	case tclunk:
+		err = c.clunk(ctx, d, e)
+
+	case txattrwalk:
+		err = c.xattrwalk(ctx, d, e)
+
+	case txattrcreate:
+		err = c.xattrcreate(ctx, d, e)
+	}
+
+	if err == nil && d.err != nil {
+		err = syscall.EINVAL
+	}
+
+	if err != nil {
+		return errorReply(tag, err)
+	}
+
+	return e.finish()
+}
+
+// Return the qid for an inode with the supplied attributes.
+func qidFor(id fuseops.InodeID, attrs *fuseops.InodeAttributes) qid {
+	q := qid{Type: qidTypeFile, Path: uint64(id)}
+	switch {
+	case attrs.Mode&os.ModeDir != 0:
+		q.Type = qidTypeDir
+	case attrs.Mode&os.ModeSymlink != 0:
+		q.Type = qidTypeSymlink
+	}
+
+	return q
+}
+
+func (c *conn) getAttributes(
+	ctx context.Context,
+	f *fid) (*fuseops.InodeAttributes, error) {
+	op := &fuseops.GetInodeAttributesOp{
+		Inode:     f.inode,
+		OpContext: fuseops.OpContext{Uid: f.uid},
+	}
+
+	if err := c.s.fs.GetInodeAttributes(ctx, op); err != nil {
+		return nil, err
+	}
+
+	return &op.Attributes, nil
+}
+
+func (c *conn) attach(ctx context.Context, d *decoder, e *encoder) error {
+	n := d.u32()
+	d.u32() // afid
+	d.str() // uname
+	d.str() // aname
+	uid := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	f := &fid{inode: fuseops.RootInodeID, uid: uid}
+	attrs, err := c.getAttributes(ctx, f)
+	if err != nil {
+		return err
+	}
+
+	if err := c.installFid(n, f, false); err != nil {
+		return err
+	}
+
+	e.qid(qidFor(f.inode, attrs))
+	return nil
+}
+
+func (c *conn) walk(ctx context.Context, d *decoder, e *encoder) error {
+	n := d.u32()
+	newN := d.u32()
+	names := make([]string, d.u16())
+	for i := range names {
+		names[i] = d.str()
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.lookUpFid(n)
+	if err != nil {
+		return err
+	}
+
+	// Look up each name in turn, settling the intermediate inodes as we go.
+	cur := fid{inode: f.inode, parent: f.parent, name: f.name, uid: f.uid}
+	var qids []qid
+	for _, name := range names {
+		if name == ".." && cur.inode == fuseops.RootInodeID {
+			var attrs *fuseops.InodeAttributes
+			attrs, err = c.getAttributes(ctx, &cur)
+			if err != nil {
+				break
+			}
+
+			qids = append(qids, qidFor(cur.inode, attrs))
+			continue
+		}
+
+		op := &fuseops.LookUpInodeOp{
+			Parent:    cur.inode,
+			Name:      name,
+			OpContext: fuseops.OpContext{Uid: f.uid},
+		}
+
+		err = c.s.fs.LookUpInode(ctx, op)
+		if err != nil {
+			break
+		}
+
+		c.s.noteLookup(op.Entry.Child)
+		if cur.inode != f.inode {
+			c.s.settle(cur.inode)
+		}
+
+		cur.parent, cur.name, cur.inode = cur.inode, name, op.Entry.Child
+		qids = append(qids, qidFor(cur.inode, &op.Entry.Attributes))
+	}
+
+	// Failing to walk the first name is an error; failing later is reported
+	// with the qids walked so far, without setting up the new fid.
+	if len(qids) < len(names) {
+		if cur.inode != f.inode {
+			c.s.settle(cur.inode)
+		}
+
+		if len(qids) == 0 {
+			return err
+		}
+	} else {
+		nf := &fid{inode: cur.inode, parent: cur.parent, name: cur.name, uid: f.uid}
+		err := c.installFid(newN, nf, newN == n)
+		if cur.inode != f.inode {
+			c.s.settle(cur.inode)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	e.u16(uint16(len(qids)))
+	for _, q := range qids {
+		e.qid(q)
+	}
+
+	return nil
+}
+
+// Bits of the request mask and valid fields of Tgetattr and Rgetattr.
+const getattrBasic = 0x000007ff
+
+func (c *conn) getattr(ctx context.Context, d *decoder, e *encoder) error {
+	f, err := c.lookUpFid(d.u32())
+	if err != nil {
+		return err
+	}
+
+	attrs, err := c.getAttributes(ctx, f)
+	if err != nil {
+		return err
+	}
+
+	e.u64(getattrBasic)
+	e.qid(qidFor(f.inode, attrs))
+	e.u32(fuseutil.UnixMode(attrs.Mode))
+	e.u32(attrs.Uid)
+	e.u32(attrs.Gid)
+	e.u64(uint64(attrs.Nlink))
+	e.u64(uint64(attrs.Rdev))
+	e.u64(attrs.Size)
+	e.u64(4096)                     // blksize
+	e.u64((attrs.Size + 511) / 512) // blocks
+	for _, t := range []time.Time{attrs.Atime, attrs.Mtime, attrs.Ctime, attrs.Crtime} {
+		e.u64(uint64(t.Unix()))
+		e.u64(uint64(t.Nanosecond()))
+	}
+	e.u64(0) // gen
+	e.u64(0) // data_version
+
+	return nil
+}
+
+// Bits of the valid field of Tsetattr.
+const (
+	setattrMode     = 0x001
+	setattrUid      = 0x002
+	setattrGid      = 0x004
+	setattrSize     = 0x008
+	setattrAtime    = 0x010
+	setattrMtime    = 0x020
+	setattrAtimeSet = 0x080
+	setattrMtimeSet = 0x100
+)
+
+func (c *conn) setattr(ctx context.Context, d *decoder, e *encoder) error {
+	f, err := c.lookUpFid(d.u32())
+	valid := d.u32()
+	mode := d.u32()
+	uid := d.u32()
+	gid := d.u32()
+	size := d.u64()
+	atime := time.Unix(int64(d.u64()), int64(d.u64()))
+	mtime := time.Unix(int64(d.u64()), int64(d.u64()))
+	if err != nil {
+		return err
+	}
+
+	op := &fuseops.SetInodeAttributesOp{
+		Inode:     f.inode,
+		OpContext: fuseops.OpContext{Uid: f.uid},
+	}
+
+	if f.opened && !f.isDir {
+		h := f.handle
+		op.Handle = &h
+	}
+
+	if valid&setattrMode != 0 {
+		m := fuseutil.FileMode(mode)
+		op.Mode = &m
+	}
+
+	if valid&setattrUid != 0 {
+		op.Uid = &uid
+	}
+
+	if valid&setattrGid != 0 {
+		op.Gid = &gid
+	}
+
+	if valid&setattrSize != 0 {
+		op.Size = &size
+	}
+
+	// Without the _SET bits, times are set to the current time.
+	now := time.Now()
+	if valid&setattrAtime != 0 {
+		if valid&setattrAtimeSet == 0 {
+			atime = now
+			op.AtimeNow = true
+		}
+		op.Atime = &atime
+	}
+
+	if valid&setattrMtime != 0 {
+		if valid&setattrMtimeSet == 0 {
+			mtime = now
+			op.MtimeNow = true
+		}
+		op.Mtime = &mtime
+	}
+
+	return c.s.fs.SetInodeAttributes(ctx, op)
+}
+
+// The magic number of v9fs in statfs(2).
+const v9fsMagic = 0x01021997
+
+func (c *conn) statfs(ctx context.Context, d *decoder, e *encoder) error {
+	if _, err := c.lookUpFid(d.u32()); err != nil {
+		return err
+	}
+
+	op := &fuseops.StatFSOp{}
+	if err := c.s.fs.StatFS(ctx, op); err != nil {
+		return err
+	}
+
+	e.u32(v9fsMagic)
+	e.u32(op.BlockSize)
+	e.u64(op.Blocks)
+	e.u64(op.BlocksFree)
+	e.u64(op.BlocksAvailable)
+	e.u64(op.Inodes)
+	e.u64(op.InodesFree)
+	e.u64(0)   // fsid
+	e.u32(255) // namelen
+
+	return nil
+}
+
+// Return the iounit to advertise for opened files.
+func (c *conn) iounit() uint32 {
+	return c.maxSize() - ioHeaderSize
+}
+
+func (c *conn) lopen(ctx context.Context, d *decoder, e *encoder) error {
+	n := d.u32()
+	f, err := c.lookUpFid(n)
+	flags := d.u32()
+	if err != nil {
+		return err
+	}
+
+	if f.opened {
+		return syscall.EBADF
+	}
+
+	attrs, err := c.getAttributes(ctx, f)
+	if err != nil {
+		return err
+	}
+
+	op := fuseops.OpContext{Uid: f.uid}
+	var handle fuseops.HandleID
+	isDir := attrs.Mode&os.ModeDir != 0
+	if isDir {
+		openOp := &fuseops.OpenDirOp{Inode: f.inode, OpContext: op}
+		if err := c.s.fs.OpenDir(ctx, openOp); err != nil {
+			return err
+		}
+
+		handle = openOp.Handle
+	} else {
+		openOp := &fuseops.OpenFileOp{
+			Inode:     f.inode,
+			OpenFlags: fusekernel.OpenFlags(flags),
+			OpContext: op,
+		}
+
+		if err := c.s.fs.OpenFile(ctx, openOp); err != nil {
+			return err
+		}
+
+		handle = openOp.Handle
+
+		// The kernel truncates with a separate setattr, and so must we.
+		if flags&syscall.O_TRUNC != 0 && attrs.Size != 0 {
+			var zero uint64
+			err := c.s.fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{
+				Inode:     f.inode,
+				Handle:    &openOp.Handle,
+				Size:      &zero,
+				OpContext: op,
+			})
+
+			if err != nil {
+				c.s.fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{
+					Handle:    openOp.Handle,
+					OpContext: op,
+				})
+				return err
+			}
+		}
+	}
+
+	// The fid may have been opened or clunked concurrently.
+	err = c.updateFid(n, func(f *fid) error {
+		if f.opened {
+			return syscall.EBADF
+		}
+
+		f.opened, f.isDir, f.handle = true, isDir, handle
+		return nil
+	})
+
+	if err != nil {
+		if isDir {
+			c.s.fs.ReleaseDirHandle(ctx, &fuseops.ReleaseDirHandleOp{
+				Handle:    handle,
+				OpContext: op,
+			})
+		} else {
+			c.s.fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{
+				Handle:    handle,
+				OpContext: op,
+			})
+		}
+
+		return err
+	}
+
+	e.qid(qidFor(f.inode, attrs))
+	e.u32(c.iounit())
+	return nil
+}
+
+func (c *conn) lcreate(ctx context.Context, d *decoder, e *encoder) error {
+	n := d.u32()
+	name := d.str()
+	d.u32() // flags
+	mode := d.u32()
+	gid := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.lookUpFid(n)
+	if err != nil {
+		return err
+	}
+
+	if f.opened {
+		return syscall.EBADF
+	}
+
+	op := &fuseops.CreateFileOp{
+		Parent:    f.inode,
+		Name:      name,
+		Mode:      fuseutil.FileMode(mode) &^ os.ModeType,
+		OpContext: fuseops.OpContext{Uid: f.uid, Gid: gid},
+	}
+
+	if err := c.s.fs.CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	// The fid now stands for the new, opened file, unless it was opened or
+	// clunked concurrently.
+	c.s.noteLookup(op.Entry.Child)
+	dir := f.inode
+	err = c.updateFid(n, func(f *fid) error {
+		if f.opened || f.inode != dir {
+			return syscall.EBADF
+		}
+
+		f.parent, f.name, f.inode = dir, name, op.Entry.Child
+		f.handle = op.Handle
+		f.opened = true
+		return nil
+	})
+
+	if err != nil {
+		c.s.fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{
+			Handle:    op.Handle,
+			OpContext: fuseops.OpContext{Uid: f.uid},
+		})
+		c.s.settle(op.Entry.Child)
+		return err
+	}
+
+	c.s.retain(op.Entry.Child)
+	c.s.release(dir)
+
+	e.qid(qidFor(op.Entry.Child, &op.Entry.Attributes))
+	e.u32(c.iounit())
+	return nil
+}
+
+// Reply with the qid of a newly created entry, forgetting it right away since
+// no fid refers to it.
+func (c *conn) created(e *encoder, entry *fuseops.ChildInodeEntry) {
+	c.s.noteLookup(entry.Child)
+	c.s.settle(entry.Child)
+	e.qid(qidFor(entry.Child, &entry.Attributes))
+}
+
+func (c *conn) symlink(ctx context.Context, d *decoder, e *encoder) error {
+	f, err := c.lookUpFid(d.u32())
+	name := d.str()
+	target := d.str()
+	gid := d.u32()
+	if err != nil || d.err != nil {
+		return firstErr(err, d.err)
+	}
+
+	op := &fuseops.CreateSymlinkOp{
+		Parent:    f.inode,
+		Name:      name,
+		Target:    target,
+		OpContext: fuseops.OpContext{Uid: f.uid, Gid: gid},
+	}
+
+	if err := c.s.fs.CreateSymlink(ctx, op); err != nil {
+		return err
+	}
+
+	c.created(e, &op.Entry)
+	return nil
+}
+
+func (c *conn) mknod(ctx context.Context, d *decoder, e *encoder) error {
+	f, err := c.lookUpFid(d.u32())
+	name := d.str()
+	mode := d.u32()
+	major := d.u32()
+	minor := d.u32()
+	gid := d.u32()
+	if err != nil || d.err != nil {
+		return firstErr(err, d.err)
+	}
+
+	op := &fuseops.MkNodeOp{
+		Parent:    f.inode,
+		Name:      name,
+		Mode:      fuseutil.FileMode(mode),
+		Rdev:      fuseops.Mkdev(major, minor),
+		OpContext: fuseops.OpContext{Uid: f.uid, Gid: gid},
+	}
+
+	if err := c.s.fs.MkNode(ctx, op); err != nil {
+		return err
+	}
+
+	c.created(e, &op.Entry)
+	return nil
+}
+
+func (c *conn) mkdir(ctx context.Context, d *decoder, e *encoder) error {
+	f, err := c.lookUpFid(d.u32())
+	name := d.str()
+	mode := d.u32()
+	gid := d.u32()
+	if err != nil || d.err != nil {
+		return firstErr(err, d.err)
+	}
+
+	op := &fuseops.MkDirOp{
+		Parent:    f.inode,
+		Name:      name,
+		Mode:      fuseutil.FileMode(mode)&os.ModePerm | os.ModeDir,
+		OpContext: fuseops.OpContext{Uid: f.uid, Gid: gid},
+	}
+
+	if err := c.s.fs.MkDir(ctx, op); err != nil {
+		return err
+	}
+
+	c.created(e, &op.Entry)
+	return nil
+}
+
+func (c *conn) link(ctx context.Context, d *decoder, e *encoder) error {
+	dir, err1 := c.lookUpFid(d.u32())
+	f, err2 := c.lookUpFid(d.u32())
+	name := d.str()
+	if err := firstErr(err1, err2, d.err); err != nil {
+		return err
+	}
+
+	op := &fuseops.CreateLinkOp{
+		Parent:    dir.inode,
+		Name:      name,
+		Target:    f.inode,
+		OpContext: fuseops.OpContext{Uid: dir.uid},
+	}
+
+	if err := c.s.fs.CreateLink(ctx, op); err != nil {
+		return err
+	}
+
+	c.s.noteLookup(op.Entry.Child)
+	c.s.settle(op.Entry.Child)
+	return nil
+}
+
+func (c *conn) readlink(ctx context.Context, d *decoder, e *encoder) error {
+	f, err := c.lookUpFid(d.u32())
+	if err != nil {
+		return err
+	}
+
+	op := &fuseops.ReadSymlinkOp{
+		Inode:     f.inode,
+		OpContext: fuseops.OpContext{Uid: f.uid},
+	}
+
+	if err := c.s.fs.ReadSymlink(ctx, op); err != nil {
+		return err
+	}
+
+	e.str(op.Target)
+	return nil
+}
+
+func (c *conn) rename(ctx context.Context, d *decoder, e *encoder) error {
+	n := d.u32()
+	f, err1 := c.lookUpFid(n)
+	dir, err2 := c.lookUpFid(d.u32())
+	name := d.str()
+	if err := firstErr(err1, err2, d.err); err != nil {
+		return err
+	}
+
+	if f.parent == 0 {
+		return syscall.EBUSY
+	}
+
+	err := c.s.fs.Rename(ctx, &fuseops.RenameOp{
+		OldParent: f.parent,
+		OldName:   f.name,
+		NewParent: dir.inode,
+		NewName:   name,
+		OpContext: fuseops.OpContext{Uid: f.uid},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// The fid now names the new entry, unless it was clunked meanwhile.
+	c.updateFid(n, func(f *fid) error {
+		f.parent, f.name = dir.inode, name
+		return nil
+	})
+
+	return nil
+}
+
+func (c *conn) renameat(ctx context.Context, d *decoder, e *encoder) error {
+	oldDir, err1 := c.lookUpFid(d.u32())
+	oldName := d.str()
+	newDir, err2 := c.lookUpFid(d.u32())
+	newName := d.str()
+	if err := firstErr(err1, err2, d.err); err != nil {
+		return err
+	}
+
+	return c.s.fs.Rename(ctx, &fuseops.RenameOp{
+		OldParent: oldDir.inode,
+		OldName:   oldName,
+		NewParent: newDir.inode,
+		NewName:   newName,
+		OpContext: fuseops.OpContext{Uid: oldDir.uid},
+	})
+}
+
+// The flag of Tunlinkat asking for a directory to be removed.
+const atRemoveDir = 0x200
+
+func (c *conn) unlinkat(ctx context.Context, d *decoder, e *encoder) error {
+	dir, err := c.lookUpFid(d.u32())
+	name := d.str()
+	flags := d.u32()
+	if err != nil || d.err != nil {
+		return firstErr(err, d.err)
+	}
+
+	return c.unlink(ctx, dir.inode, name, flags&atRemoveDir != 0, dir.uid)
+}
+
+func (c *conn) unlink(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string,
+	isDir bool,
+	uid uint32) error {
+	op := fuseops.OpContext{Uid: uid}
+	if isDir {
+		return c.s.fs.RmDir(ctx, &fuseops.RmDirOp{
+			Parent:    parent,
+			Name:      name,
+			OpContext: op,
+		})
+	}
+
+	return c.s.fs.Unlink(ctx, &fuseops.UnlinkOp{
+		Parent:    parent,
+		Name:      name,
+		OpContext: op,
+	})
+}
+
+func (c *conn) remove(ctx context.Context, d *decoder, e *encoder) error {
+	// The fid is clunked even if removing fails.
+	f, err := c.removeFid(d.u32())
+	if err != nil {
+		return err
+	}
+
+	if f.parent == 0 {
+		err = syscall.EBUSY
+	} else if attrs, attrErr := c.getAttributes(ctx, f); attrErr != nil {
+		err = attrErr
+	} else {
+		err = c.unlink(ctx, f.parent, f.name, attrs.Mode&os.ModeDir != 0, f.uid)
+	}
+
+	c.closeFid(ctx, f)
+	return err
+}
+
+func (c *conn) read(ctx context.Context, d *decoder, e *encoder) error {
+	f, err := c.lookUpFid(d.u32())
+	offset := d.u64()
+	count := d.u32()
+	if err != nil || d.err != nil {
+		return firstErr(err, d.err)
+	}
+
+	if max := c.iounit(); count > max {
+		count = max
+	}
+
+	// Extended attribute values are read from what Txattrwalk found.
+	if f.xattr != nil {
+		var data []byte
+		if offset < uint64(len(f.xattr)) {
+			data = f.xattr[offset:]
+		}
+
+		if uint32(len(data)) > count {
+			data = data[:count]
+		}
+
+		e.u32(uint32(len(data)))
+		e.b = append(e.b, data...)
+		return nil
+	}
+
+	if !f.opened || f.isDir {
+		return syscall.EBADF
+	}
+
+	op := &fuseops.ReadFileOp{
+		Inode:     f.inode,
+		Handle:    f.handle,
+		Offset:    int64(offset),
+		Size:      int64(count),
+		Dst:       make([]byte, count),
+		OpContext: fuseops.OpContext{Uid: f.uid},
+	}
+
+	if err := c.s.fs.ReadFile(ctx, op); err != nil {
+		return err
+	}
+
+	data := op.Dst[:op.BytesRead]
+	if op.Data != nil {
+		data = nil
+		for _, b := range op.Data {
+			data = append(data, b...)
+		}
+	}
+
+	e.u32(uint32(len(data)))
+	e.b = append(e.b, data...)
+	return nil
+}
+
+func (c *conn) write(ctx context.Context, d *decoder, e *encoder) error {
+	f, err := c.lookUpFid(d.u32())
+	offset := d.u64()
+	data := d.take(int(d.u32()))
+	if err != nil || d.err != nil {
+		return firstErr(err, d.err)
+	}
+
+	// Values of new extended attributes are collected until the fid is
+	// clunked.
+	if x := f.xattrCreate; x != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if offset != uint64(len(x.value)) || offset+uint64(len(data)) > x.size {
+			return syscall.EINVAL
+		}
+
+		x.value = append(x.value, data...)
+		e.u32(uint32(len(data)))
+		return nil
+	}
+
+	if !f.opened || f.isDir {
+		return syscall.EBADF
+	}
+
+	err = c.s.fs.WriteFile(ctx, &fuseops.WriteFileOp{
+		Inode:     f.inode,
+		Handle:    f.handle,
+		Offset:    int64(offset),
+		Data:      data,
+		OpContext: fuseops.OpContext{Uid: f.uid},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	e.u32(uint32(len(data)))
+	return nil
+}
+
+func (c *conn) readdir(ctx context.Context, d *decoder, e *encoder) error {
+	f, err := c.lookUpFid(d.u32())
+	offset := d.u64()
+	count := d.u32()
+	if err != nil || d.err != nil {
+		return firstErr(err, d.err)
+	}
+
+	if !f.opened || !f.isDir {
+		return syscall.EBADF
+	}
+
+	if max := c.iounit(); count > max {
+		count = max
+	}
+
+	op := &fuseops.ReadDirOp{
+		Inode:     f.inode,
+		Handle:    f.handle,
+		Offset:    fuseops.DirOffset(offset),
+		Dst:       make([]byte, count),
+		OpContext: fuseops.OpContext{Uid: f.uid},
+	}
+
+	if err := c.s.fs.ReadDir(ctx, op); err != nil {
+		return err
+	}
+
+	// Each entry takes no more room in 9P than in the kernel's format, so
+	// everything the file system returned fits.
+	countAt := len(e.b)
+	e.u32(0)
+	start := len(e.b)
+
+	b := op.Dst[:op.BytesRead]
+	for len(b) > 0 {
+		de, n := fuseutil.ReadDirent(b)
+		if n == 0 {
+			break
+		}
+		b = b[n:]
+
+		q := qid{Type: qidTypeFile, Path: uint64(de.Inode)}
+		switch de.Type {
+		case fuseutil.DT_Directory:
+			q.Type = qidTypeDir
+		case fuseutil.DT_Link:
+			q.Type = qidTypeSymlink
+		}
+
+		e.qid(q)
+		e.u64(uint64(de.Offset))
+		e.u8(uint8(de.Type))
+		e.str(de.Name)
+	}
+
+	size := uint32(len(e.b) - start)
+	e.b[countAt] = byte(size)
+	e.b[countAt+1] = byte(size >> 8)
+	e.b[countAt+2] = byte(size >> 16)
+	e.b[countAt+3] = byte(size >> 24)
+
+	return nil
+}
+
+func (c *conn) fsync(ctx context.Context, d *decoder, e *encoder) error {
+	f, err := c.lookUpFid(d.u32())
+	if err != nil {
+		return err
+	}
+
+	if !f.opened || f.isDir {
+		return nil
+	}
+
+	err = c.s.fs.SyncFile(ctx, &fuseops.SyncFileOp{
+		Inode:     f.inode,
+		Handle:    f.handle,
+		OpContext: fuseops.OpContext{Uid: f.uid},
+	})
+
+	if err == syscall.ENOSYS {
+		err = nil
+	}
+
+	return err
+}
+
+func (c *conn) clunk(ctx context.Context, d *decoder, e *encoder) error {
+	f, err := c.removeFid(d.u32())
+	if err != nil {
+		return err
+	}
+
+	return c.closeFid(ctx, f)
+}
+
+func (c *conn) xattrwalk(ctx context.Context, d *decoder, e *encoder) error {
+	n := d.u32()
+	newN := d.u32()
+	name := d.str()
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := c.lookUpFid(n)
+	if err != nil {
+		return err
+	}
+
+	// An empty name asks for the list of names.
+	var value []byte
+	op := fuseops.OpContext{Uid: f.uid}
+	if name == "" {
+		listOp := &fuseops.ListXattrOp{
+			Inode:     f.inode,
+			Dst:       make([]byte, maxXattrSize),
+			OpContext: op,
+		}
+
+		err = c.s.fs.ListXattr(ctx, listOp)
+		value = listOp.Dst[:listOp.BytesRead]
+	} else {
+		getOp := &fuseops.GetXattrOp{
+			Inode:     f.inode,
+			Name:      name,
+			Dst:       make([]byte, maxXattrSize),
+			OpContext: op,
+		}
+
+		err = c.s.fs.GetXattr(ctx, getOp)
+		value = getOp.Dst[:getOp.BytesRead]
+	}
+
+	if err != nil {
+		return err
+	}
+
+	nf := &fid{
+		inode: f.inode,
+		uid:   f.uid,
+		xattr: append([]byte{}, value...),
+	}
+
+	if err := c.installFid(newN, nf, newN == n); err != nil {
+		return err
+	}
+
+	e.u64(uint64(len(value)))
+	return nil
+}
+
+func (c *conn) xattrcreate(ctx context.Context, d *decoder, e *encoder) error {
+	n := d.u32()
+	name := d.str()
+	size := d.u64()
+	flags := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+
+	return c.updateFid(n, func(f *fid) error {
+		if f.opened || size > maxXattrSize {
+			return syscall.EINVAL
+		}
+
+		f.xattrCreate = &xattrCreate{name: name, size: size, flags: flags}
+		return nil
+	})
+}
+
+// Return the first non-nil error.
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,448 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ninep
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A file system with a root directory holding files, recording forgets.
+type flatFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu      sync.Mutex
+	names   []string
+	content map[fuseops.InodeID][]byte
+	forgets map[fuseops.InodeID]uint64
+}
+
+func newFlatFS() *flatFS {
+	return &flatFS{
+		names:   []string{"", "", "taco"},
+		content: map[fuseops.InodeID][]byte{2: []byte("burrito")},
+		forgets: make(map[fuseops.InodeID]uint64),
+	}
+}
+
+func (fs *flatFS) attributes(id fuseops.InodeID) fuseops.InodeAttributes {
+	if id == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{Mode: 0755 | os.ModeDir, Nlink: 1}
+	}
+
+	return fuseops.InodeAttributes{
+		Mode:  0644,
+		Nlink: 1,
+		Size:  uint64(len(fs.content[id])),
+	}
+}
+
+func (fs *flatFS) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for i, name := range fs.names {
+		if i > 1 && name == op.Name {
+			op.Entry.Child = fuseops.InodeID(i)
+			op.Entry.Attributes = fs.attributes(op.Entry.Child)
+			return nil
+		}
+	}
+
+	return syscall.ENOENT
+}
+
+func (fs *flatFS) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Attributes = fs.attributes(op.Inode)
+	return nil
+}
+
+func (fs *flatFS) ForgetInode(ctx context.Context, op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.forgets[op.Inode] += op.N
+	return nil
+}
+
+func (fs *flatFS) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *flatFS) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for i := int(op.Offset) + 2; i < len(fs.names); i++ {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i - 1),
+			Inode:  fuseops.InodeID(i),
+			Name:   fs.names[i],
+			Type:   fuseutil.DT_File,
+		})
+		if n == 0 {
+			break
+		}
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *flatFS) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *flatFS) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.names = append(fs.names, op.Name)
+	op.Entry.Child = fuseops.InodeID(len(fs.names) - 1)
+	op.Entry.Attributes = fs.attributes(op.Entry.Child)
+	return nil
+}
+
+func (fs *flatFS) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	b := fs.content[op.Inode]
+	if op.Offset < int64(len(b)) {
+		op.BytesRead = copy(op.Dst, b[op.Offset:])
+	}
+
+	return nil
+}
+
+func (fs *flatFS) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	b := fs.content[op.Inode]
+	for int64(len(b)) < op.Offset+int64(len(op.Data)) {
+		b = append(b, 0)
+	}
+	copy(b[op.Offset:], op.Data)
+	fs.content[op.Inode] = b
+	return nil
+}
+
+func (fs *flatFS) Forgets() map[fuseops.InodeID]uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	m := make(map[fuseops.InodeID]uint64)
+	for k, v := range fs.forgets {
+		m[k] = v
+	}
+	return m
+}
+
+// A synchronous client, sending one request at a time.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// Send a request and return the body of the reply, failing the test unless
+// it has the type that answers the request.
+func (c *client) rpc(typ uint8, build func(e *encoder)) *decoder {
+	c.t.Helper()
+
+	e := newEncoder(typ, 1)
+	if build != nil {
+		build(e)
+	}
+
+	if _, err := c.conn.Write(e.finish()); err != nil {
+		c.t.Fatalf("Write: %v", err)
+	}
+
+	rtyp, _, body, err := readMessage(c.conn, maxMessageSize)
+	if err != nil {
+		c.t.Fatalf("readMessage: %v", err)
+	}
+
+	d := &decoder{b: body}
+	if rtyp == rlerror {
+		c.t.Fatalf("Request %d failed: %v", typ, syscall.Errno(d.u32()))
+	}
+
+	if rtyp != typ+1 {
+		c.t.Fatalf("Reply type %d to request %d", rtyp, typ)
+	}
+
+	return d
+}
+
+// Like rpc, but expects an Rlerror and returns its error.
+func (c *client) rpcErr(typ uint8, build func(e *encoder)) syscall.Errno {
+	c.t.Helper()
+
+	e := newEncoder(typ, 1)
+	build(e)
+	c.conn.Write(e.finish())
+
+	rtyp, _, body, err := readMessage(c.conn, maxMessageSize)
+	if err != nil {
+		c.t.Fatalf("readMessage: %v", err)
+	}
+
+	if rtyp != rlerror {
+		c.t.Fatalf("Expected Rlerror to request %d, got %d", typ, rtyp)
+	}
+
+	d := &decoder{b: body}
+	return syscall.Errno(d.u32())
+}
+
+func startServer(t *testing.T, fs fuseutil.FileSystem) (c *client, hangUp func()) {
+	local, remote := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		NewServer(fs).ServeConn(remote)
+		close(done)
+	}()
+
+	c = &client{t: t, conn: local}
+	d := c.rpc(tversion, func(e *encoder) {
+		e.u32(8192)
+		e.str("9P2000.L")
+	})
+
+	if msize, version := d.u32(), d.str(); msize != 8192 || version != "9P2000.L" {
+		t.Fatalf("Rversion: %d %q", msize, version)
+	}
+
+	c.rpc(tattach, func(e *encoder) {
+		e.u32(0)
+		e.u32(noFid)
+		e.str("")
+		e.str("")
+		e.u32(1000)
+	})
+
+	return c, func() {
+		local.Close()
+		<-done
+	}
+}
+
+func TestWalkOpenRead(t *testing.T) {
+	fs := newFlatFS()
+	c, hangUp := startServer(t, fs)
+
+	d := c.rpc(twalk, func(e *encoder) {
+		e.u32(0)
+		e.u32(1)
+		e.u16(1)
+		e.str("taco")
+	})
+
+	if n := d.u16(); n != 1 {
+		t.Fatalf("Walked %d names", n)
+	}
+
+	c.rpc(tlopen, func(e *encoder) {
+		e.u32(1)
+		e.u32(0)
+	})
+
+	d = c.rpc(tread, func(e *encoder) {
+		e.u32(1)
+		e.u64(2)
+		e.u32(100)
+	})
+
+	if got := string(d.take(int(d.u32()))); got != "rrito" {
+		t.Errorf("Read %q", got)
+	}
+
+	// Clunking the only fid referring to the file forgets it.
+	c.rpc(tclunk, func(e *encoder) { e.u32(1) })
+
+	if f := fs.Forgets(); f[2] != 1 {
+		t.Errorf("Forgets: %v", f)
+	}
+
+	hangUp()
+}
+
+func TestWalkMissing(t *testing.T) {
+	c, hangUp := startServer(t, newFlatFS())
+	defer hangUp()
+
+	errno := c.rpcErr(twalk, func(e *encoder) {
+		e.u32(0)
+		e.u32(1)
+		e.u16(1)
+		e.str("enchilada")
+	})
+
+	if errno != syscall.ENOENT {
+		t.Errorf("Expected ENOENT, got %v", errno)
+	}
+}
+
+func TestCreateWriteReadDir(t *testing.T) {
+	fs := newFlatFS()
+	c, hangUp := startServer(t, fs)
+
+	// Clone the root, and create a file through the clone.
+	c.rpc(twalk, func(e *encoder) {
+		e.u32(0)
+		e.u32(1)
+		e.u16(0)
+	})
+
+	c.rpc(tlcreate, func(e *encoder) {
+		e.u32(1)
+		e.str("queso")
+		e.u32(uint32(os.O_RDWR))
+		e.u32(0644)
+		e.u32(1000)
+	})
+
+	d := c.rpc(twrite, func(e *encoder) {
+		e.u32(1)
+		e.u64(0)
+		e.u32(4)
+		e.b = append(e.b, "dip!"...)
+	})
+
+	if n := d.u32(); n != 4 {
+		t.Errorf("Wrote %d bytes", n)
+	}
+
+	// List the root.
+	c.rpc(twalk, func(e *encoder) {
+		e.u32(0)
+		e.u32(2)
+		e.u16(0)
+	})
+
+	c.rpc(tlopen, func(e *encoder) {
+		e.u32(2)
+		e.u32(0)
+	})
+
+	d = c.rpc(treaddir, func(e *encoder) {
+		e.u32(2)
+		e.u64(0)
+		e.u32(4096)
+	})
+
+	entries := &decoder{b: d.take(int(d.u32()))}
+	var names []string
+	for len(entries.b) > 0 && entries.err == nil {
+		entries.take(13) // qid
+		entries.u64()    // offset
+		entries.u8()     // type
+		names = append(names, entries.str())
+	}
+
+	if len(names) != 2 || names[0] != "taco" || names[1] != "queso" {
+		t.Errorf("Entries: %q", names)
+	}
+
+	hangUp()
+
+	// Hanging up clunks everything.
+	if got := string(fs.content[3]); got != "dip!" {
+		t.Errorf("Content: %q", got)
+	}
+
+	if f := fs.Forgets(); f[3] != 1 {
+		t.Errorf("Forgets: %v", f)
+	}
+}
+
+// A file system whose reads block until cancelled.
+type blockingFS struct {
+	*flatFS
+	started chan struct{}
+}
+
+func (fs *blockingFS) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
+	close(fs.started)
+	<-ctx.Done()
+	return syscall.EINTR
+}
+
+func TestFlush(t *testing.T) {
+	fs := &blockingFS{flatFS: newFlatFS(), started: make(chan struct{})}
+	c, hangUp := startServer(t, fs)
+	defer hangUp()
+
+	c.rpc(twalk, func(e *encoder) {
+		e.u32(0)
+		e.u32(1)
+		e.u16(1)
+		e.str("taco")
+	})
+
+	c.rpc(tlopen, func(e *encoder) {
+		e.u32(1)
+		e.u32(0)
+	})
+
+	// Start a read, and flush it once the file system has it.
+	e := newEncoder(tread, 5)
+	e.u32(1)
+	e.u64(0)
+	e.u32(100)
+	if _, err := c.conn.Write(e.finish()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	<-fs.started
+
+	e = newEncoder(tflush, 6)
+	e.u16(5)
+	if _, err := c.conn.Write(e.finish()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// The flushed request is answered first, then the flush.
+	want := []struct {
+		typ uint8
+		tag uint16
+	}{
+		{rlerror, 5},
+		{tflush + 1, 6},
+	}
+
+	for _, w := range want {
+		typ, tag, _, err := readMessage(c.conn, maxMessageSize)
+		if err != nil {
+			t.Fatalf("readMessage: %v", err)
+		}
+
+		if typ != w.typ || tag != w.tag {
+			t.Errorf("Got type %d with tag %d, want type %d with tag %d", typ, tag, w.typ, w.tag)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Message types of 9P2000.L, cf. include/net/9p/9p.h in the Linux kernel.
+const (
+	rlerror      = 7
+	tstatfs      = 8
+	tlopen       = 12
+	tlcreate     = 14
+	tsymlink     = 16
+	tmknod       = 18
+	trename      = 20
+	treadlink    = 22
+	tgetattr     = 24
+	tsetattr     = 26
+	txattrwalk   = 30
+	txattrcreate = 32
+	treaddir     = 40
+	tfsync       = 50
+	tlock        = 52
+	tgetlock     = 54
+	tlink        = 70
+	tmkdir       = 72
+	trenameat    = 74
+	tunlinkat    = 76
+	tversion     = 100
+	tauth        = 102
+	tattach      = 104
+	tflush       = 108
+	twalk        = 110
+	tread        = 116
+	twrite       = 118
+	tclunk       = 120
+	tremove      = 122
+)
+
+// The fid value meaning "no fid".
+const noFid = ^uint32(0)
+
+// The size of the header common to all messages: size[4] type[1] tag[2].
+const headerSize = 4 + 1 + 2
+
+// Qid types.
+const (
+	qidTypeDir     = 0x80
+	qidTypeSymlink = 0x02
+	qidTypeFile    = 0x00
+)
+
+// A server's unique identification for a file.
+type qid struct {
+	Type    uint8
+	Version uint32
+	Path    uint64
+}
+
+var errShortMessage = errors.New("short message")
+
+// Read the next message from r, returning its type, tag and body.
+func readMessage(r io.Reader, msize uint32) (typ uint8, tag uint16, body []byte, err error) {
+	var h [headerSize]byte
+	if _, err = io.ReadFull(r, h[:]); err != nil {
+		return
+	}
+
+	size := binary.LittleEndian.Uint32(h[0:])
+	if size < headerSize || size > msize {
+		err = fmt.Errorf("message size %d out of range", size)
+		return
+	}
+
+	typ = h[4]
+	tag = binary.LittleEndian.Uint16(h[5:])
+	body = make([]byte, size-headerSize)
+	if _, err = io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	return
+}
+
+// Decodes the fields of a message body in order. The first decoding error is
+// sticky, and reported by err.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if len(d.b) < n {
+		d.err = errShortMessage
+		return nil
+	}
+
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) u16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) u32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) u64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) str() string {
+	return string(d.take(int(d.u16())))
+}
+
+// Encodes a reply message. The size field is filled in by finish.
+type encoder struct {
+	b []byte
+}
+
+func newEncoder(typ uint8, tag uint16) *encoder {
+	e := &encoder{b: make([]byte, 4, 64)}
+	e.u8(typ)
+	e.u16(tag)
+	return e
+}
+
+func (e *encoder) u8(v uint8) {
+	e.b = append(e.b, v)
+}
+
+func (e *encoder) u16(v uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) u32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) u64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) qid(q qid) {
+	e.u8(q.Type)
+	e.u32(q.Version)
+	e.u64(q.Path)
+}
+
+func (e *encoder) finish() []byte {
+	binary.LittleEndian.PutUint32(e.b, uint32(len(e.b)))
+	return e.b
+}
@@ -0,0 +1,319 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"syscall"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/buffer"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// InvalidateInode tells the kernel that the contents of the given inode have
+// changed behind its back, e.g. because another client of the backing store
+// wrote to it. The kernel drops its cached attributes for the inode, and the
+// cached pages covering [off, off+length) of its data, or those from off to
+// the end of the file if length is zero or negative. Pages mapped into
+// processes are unmapped, so that their next access reads the new contents.
+// A negative off drops only the attributes.
+//
+// With writeback caching the kernel writes back dirty pages in the range
+// before dropping them, which means this may block on WriteFileOps for the
+// inode. It must therefore not be called from within the handler for an op,
+// nor while holding a lock that such a handler takes.
+//
+// It is not an error to invalidate an inode the kernel doesn't know of.
+func (c *Connection) InvalidateInode(
+	inode fuseops.InodeID,
+	off int64,
+	length int64) error {
+	if !c.protocol.HasInvalidate() {
+		return syscall.ENOSYS
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	out := (*fusekernel.NotifyInvalInodeOut)(m.Grow(int(unsafe.Sizeof(fusekernel.NotifyInvalInodeOut{}))))
+	out.Ino = uint64(inode)
+	out.Off = off
+	out.Len = length
+
+	return c.notify(m, fusekernel.NotifyCodeInvalInode)
+}
+
+// InvalidateEntry tells the kernel that the entry for the given name in the
+// given directory has changed behind its back, so that the next access
+// through it looks the name up afresh rather than using a cached entry.
+//
+// The same restrictions as for InvalidateInode apply: the kernel takes the
+// directory's lock, so this must not be called from within the handler for an
+// op on that directory.
+//
+// It is not an error to invalidate an entry the kernel doesn't know of.
+func (c *Connection) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	if !c.protocol.HasInvalidate() {
+		return syscall.ENOSYS
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	out := (*fusekernel.NotifyInvalEntryOut)(m.Grow(int(unsafe.Sizeof(fusekernel.NotifyInvalEntryOut{}))))
+	out.Parent = uint64(parent)
+	out.Namelen = uint32(len(name))
+	m.AppendString(name)
+	m.Append([]byte{0})
+
+	return c.notify(m, fusekernel.NotifyCodeInvalEntry)
+}
+
+// NotifyDelete tells the kernel that the entry for the given name in the
+// given directory, which referred to the given child inode, has been removed
+// behind its back. Unlike InvalidateEntry, this also drops the entry if it is
+// a mount point or the current directory of a process, and, if the child is a
+// directory, marks it as deleted so that lookups within it fail.
+//
+// The kernel ignores the notification if the entry no longer refers to the
+// child. The same restrictions as for InvalidateEntry apply.
+func (c *Connection) NotifyDelete(
+	parent fuseops.InodeID,
+	child fuseops.InodeID,
+	name string) error {
+	if !c.protocol.HasNotifyDelete() {
+		return syscall.ENOSYS
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	out := (*fusekernel.NotifyDeleteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.NotifyDeleteOut{}))))
+	out.Parent = uint64(parent)
+	out.Child = uint64(child)
+	out.Namelen = uint32(len(name))
+	m.AppendString(name)
+	m.Append([]byte{0})
+
+	return c.notify(m, fusekernel.NotifyCodeDelete)
+}
+
+// A rename made behind the kernel's back, e.g. by another client of the
+// backing store, for InvalidateRename.
+type RenamedEntry struct {
+	OldParent fuseops.InodeID
+	OldName   string
+	NewParent fuseops.InodeID
+	NewName   string
+
+	// Also drop the cached attributes and directory contents of the parents,
+	// whose modification times and listings the rename changed. Only needed if
+	// the file system lets the kernel cache those.
+	Parents bool
+}
+
+// InvalidateRename tells the kernel about a rename made behind its back, by
+// invalidating the entries for both the old and the new name, the latter of
+// which the kernel may know as a different inode or as a negative entry. It
+// is a convenience for a sequence of calls to InvalidateEntry and, if
+// r.Parents is set, InvalidateInode, and the same restrictions apply.
+//
+// Every invalidation is attempted, and the first error returned.
+func (c *Connection) InvalidateRename(r RenamedEntry) error {
+	errs := []error{
+		c.InvalidateEntry(r.OldParent, r.OldName),
+	}
+
+	if r.NewParent != r.OldParent || r.NewName != r.OldName {
+		errs = append(errs, c.InvalidateEntry(r.NewParent, r.NewName))
+	}
+
+	if r.Parents {
+		errs = append(errs, c.InvalidateInode(r.OldParent, 0, 0))
+		if r.NewParent != r.OldParent {
+			errs = append(errs, c.InvalidateInode(r.NewParent, 0, 0))
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NotifyStore pushes data into the kernel's page cache for the given inode,
+// as the contents of the file at offset off, e.g. when the file system has
+// prefetched it from its backing store, so that reading it doesn't cost a
+// ReadFileOp. The file's size as known to the kernel grows if the data
+// extends beyond it. Pages only partly covered by the data, other than the
+// file's last, are left to be read as usual, so off should be a multiple of
+// the page size.
+//
+// It is not an error to store data for an inode the kernel doesn't know of;
+// nothing happens then. The same restrictions as for InvalidateInode apply.
+func (c *Connection) NotifyStore(
+	inode fuseops.InodeID,
+	off int64,
+	data []byte) error {
+	if !c.protocol.HasNotifyStore() {
+		return syscall.ENOSYS
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	out := (*fusekernel.NotifyStoreOut)(m.Grow(int(unsafe.Sizeof(fusekernel.NotifyStoreOut{}))))
+	out.Nodeid = uint64(inode)
+	out.Offset = uint64(off)
+	out.Size = uint32(len(data))
+	m.Append(data)
+
+	return c.notify(m, fusekernel.NotifyCodeStore)
+}
+
+// A call to RetrieveCache waiting for the kernel's answer.
+type retrieval struct {
+	dst []byte
+
+	// Receives the number of bytes copied into dst.
+	done chan int
+}
+
+// RetrieveCache reads into dst what the kernel's page cache holds for the
+// given inode from offset off, e.g. to save dirty pages before the file
+// system drops the backing data. It returns the number of bytes read, which
+// stops short of len(dst) at the first page not in the cache, at the end of
+// the file as known to the kernel, or at the largest write size agreed with
+// it. It reads nothing if the kernel doesn't know of the inode.
+//
+// The kernel answers with a message read by ReadOp, so RetrieveCache must not
+// be called from a goroutine that ReadOp waits on, nor while ops aren't
+// being read. It returns ctx's error if ctx is cancelled first.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) RetrieveCache(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	off int64,
+	dst []byte) (int, error) {
+	if !c.protocol.HasNotifyStore() {
+		return 0, syscall.ENOSYS
+	}
+
+	r := &retrieval{
+		dst:  dst,
+		done: make(chan int, 1),
+	}
+
+	c.mu.Lock()
+	c.nextRetrieval++
+	unique := c.nextRetrieval
+	c.retrievals[unique] = r
+	c.mu.Unlock()
+
+	forget := func() {
+		c.mu.Lock()
+		delete(c.retrievals, unique)
+		c.mu.Unlock()
+	}
+
+	m := c.getOutMessage()
+	out := (*fusekernel.NotifyRetrieveOut)(m.Grow(int(unsafe.Sizeof(fusekernel.NotifyRetrieveOut{}))))
+	out.NotifyUnique = unique
+	out.Nodeid = uint64(inode)
+	out.Offset = uint64(off)
+	out.Size = uint32(len(dst))
+
+	h := m.OutHeader()
+	h.Error = fusekernel.NotifyCodeRetrieve
+	h.Len = uint32(m.Len())
+
+	// The kernel answers only if it knows of the inode.
+	err := c.writeOutMessage(c.dev, m)
+	c.putOutMessage(m)
+	if err != nil {
+		forget()
+		if err == syscall.ENOENT {
+			err = nil
+		}
+
+		return 0, err
+	}
+
+	select {
+	case n := <-r.done:
+		return n, nil
+
+	case <-ctx.Done():
+		forget()
+		return 0, ctx.Err()
+	}
+}
+
+// Pass on the kernel's answer to RetrieveCache.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) handleNotifyReply(op *notifyReplyOp) {
+	c.mu.Lock()
+	r := c.retrievals[op.Unique]
+	delete(c.retrievals, op.Unique)
+	c.mu.Unlock()
+
+	if r != nil {
+		r.done <- copy(r.dst, op.Data)
+	}
+}
+
+// NotifyPollWakeup wakes up the callers of poll(2) and similar waiting on a
+// file, once one of the events they asked for in a PollOp with
+// ScheduleNotify set has become ready. They then poll the file again. kh is
+// the PollOp's Kh.
+//
+// It is not an error to wake up a poller that has since gone away.
+func (c *Connection) NotifyPollWakeup(kh fuseops.PollHandle) error {
+	if !c.protocol.HasPoll() {
+		return syscall.ENOSYS
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	out := (*fusekernel.NotifyPollWakeupOut)(m.Grow(int(unsafe.Sizeof(fusekernel.NotifyPollWakeupOut{}))))
+	out.Kh = uint64(kh)
+
+	return c.notify(m, fusekernel.NotifyCodePoll)
+}
+
+// Send the notification in m, which carries no request ID and the
+// notification code in place of an error.
+func (c *Connection) notify(m *buffer.OutMessage, code int32) error {
+	h := m.OutHeader()
+	h.Error = code
+	h.Len = uint32(m.Len())
+
+	err := c.writeOutMessage(c.dev, m)
+	if err == syscall.ENOENT {
+		err = nil
+	}
+
+	return err
+}
@@ -0,0 +1,335 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+func TestInvalidateNotifications(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	c := &Connection{dev: w, protocol: fusekernel.Protocol{Major: 7, Minor: 31}}
+
+	readNotification := func() []byte {
+		buf := make([]byte, 4096)
+		n, err := r.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		return buf[:n]
+	}
+
+	if err := c.InvalidateInode(17, 4096, -1); err != nil {
+		t.Fatalf("InvalidateInode: %v", err)
+	}
+
+	want := new(bytes.Buffer)
+	binary.Write(want, binary.LittleEndian, fusekernel.OutHeader{
+		Len:   16 + 24,
+		Error: fusekernel.NotifyCodeInvalInode,
+	})
+	binary.Write(want, binary.LittleEndian, fusekernel.NotifyInvalInodeOut{
+		Ino: 17,
+		Off: 4096,
+		Len: -1,
+	})
+
+	if got := readNotification(); !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("InvalidateInode wrote %x, want %x", got, want.Bytes())
+	}
+
+	if err := c.InvalidateEntry(1, "taco"); err != nil {
+		t.Fatalf("InvalidateEntry: %v", err)
+	}
+
+	want.Reset()
+	binary.Write(want, binary.LittleEndian, fusekernel.OutHeader{
+		Len:   16 + 16 + 5,
+		Error: fusekernel.NotifyCodeInvalEntry,
+	})
+	binary.Write(want, binary.LittleEndian, []uint64{1, 4})
+	want.WriteString("taco\x00")
+
+	if got := readNotification(); !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("InvalidateEntry wrote %x, want %x", got, want.Bytes())
+	}
+
+	// Kernels too old to know of notifications.
+	c.protocol.Minor = 11
+	if err := c.InvalidateInode(17, 0, 0); err != syscall.ENOSYS {
+		t.Errorf("InvalidateInode on 7.11: %v", err)
+	}
+}
+
+func TestNotifyDelete(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	c := &Connection{dev: w, protocol: fusekernel.Protocol{Major: 7, Minor: 31}}
+	if err := c.NotifyDelete(1, 17, "taco"); err != nil {
+		t.Fatalf("NotifyDelete: %v", err)
+	}
+
+	want := new(bytes.Buffer)
+	binary.Write(want, binary.LittleEndian, fusekernel.OutHeader{
+		Len:   16 + 24 + 5,
+		Error: fusekernel.NotifyCodeDelete,
+	})
+	binary.Write(want, binary.LittleEndian, []uint64{1, 17, 4})
+	want.WriteString("taco\x00")
+
+	buf := make([]byte, 4096)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if got := buf[:n]; !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("NotifyDelete wrote %x, want %x", got, want.Bytes())
+	}
+
+	// Kernels older than 7.18 don't know of it.
+	c.protocol.Minor = 17
+	if err := c.NotifyDelete(1, 17, "taco"); err != syscall.ENOSYS {
+		t.Errorf("NotifyDelete on 7.17: %v", err)
+	}
+}
+
+func TestInvalidateRename(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	c := &Connection{dev: w, protocol: fusekernel.Protocol{Major: 7, Minor: 31}}
+
+	// Describe each notification written by f as its code and the inode it is
+	// about, followed by the name for entries.
+	notifications := func(f func() error) []string {
+		if err := f(); err != nil {
+			t.Fatalf("InvalidateRename: %v", err)
+		}
+
+		buf := make([]byte, 4096)
+		n, err := r.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		var got []string
+		for b := buf[:n]; len(b) != 0; {
+			l := binary.LittleEndian.Uint32(b)
+			code := int32(binary.LittleEndian.Uint32(b[4:]))
+			ino := binary.LittleEndian.Uint64(b[16:])
+			switch code {
+			case fusekernel.NotifyCodeInvalEntry:
+				got = append(got, fmt.Sprintf("entry %d %s", ino, b[32:l-1]))
+			default:
+				got = append(got, fmt.Sprintf("inode %d", ino))
+			}
+
+			b = b[l:]
+		}
+
+		return got
+	}
+
+	got := notifications(func() error {
+		return c.InvalidateRename(RenamedEntry{
+			OldParent: 1,
+			OldName:   "taco",
+			NewParent: 2,
+			NewName:   "burrito",
+			Parents:   true,
+		})
+	})
+
+	want := []string{"entry 1 taco", "entry 2 burrito", "inode 1", "inode 2"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Notifications: got %q, want %q", got, want)
+	}
+
+	// Within a single directory, the parent is invalidated once.
+	got = notifications(func() error {
+		return c.InvalidateRename(RenamedEntry{
+			OldParent: 1,
+			OldName:   "taco",
+			NewParent: 1,
+			NewName:   "burrito",
+			Parents:   true,
+		})
+	})
+
+	want = []string{"entry 1 taco", "entry 1 burrito", "inode 1"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Notifications: got %q, want %q", got, want)
+	}
+}
+
+func TestNotifyStore(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	c := &Connection{dev: w, protocol: fusekernel.Protocol{Major: 7, Minor: 31}}
+	if err := c.NotifyStore(17, 4096, []byte("taco")); err != nil {
+		t.Fatalf("NotifyStore: %v", err)
+	}
+
+	want := new(bytes.Buffer)
+	binary.Write(want, binary.LittleEndian, fusekernel.OutHeader{
+		Len:   16 + 24 + 4,
+		Error: fusekernel.NotifyCodeStore,
+	})
+	binary.Write(want, binary.LittleEndian, []uint64{17, 4096, 4})
+	want.WriteString("taco")
+
+	buf := make([]byte, 4096)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if got := buf[:n]; !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("NotifyStore wrote %x, want %x", got, want.Bytes())
+	}
+
+	// Kernels older than 7.15 don't know of it.
+	c.protocol.Minor = 14
+	if err := c.NotifyStore(17, 0, nil); err != syscall.ENOSYS {
+		t.Errorf("NotifyStore on 7.14: %v", err)
+	}
+}
+
+func TestRetrieveCache(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	c := &Connection{
+		dev:        w,
+		protocol:   fusekernel.Protocol{Major: 7, Minor: 31},
+		retrievals: make(map[uint64]*retrieval),
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	dst := make([]byte, 8)
+	done := make(chan result)
+	go func() {
+		n, err := c.RetrieveCache(context.Background(), 17, 4096, dst)
+		done <- result{n, err}
+	}()
+
+	buf := make([]byte, 4096)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	want := new(bytes.Buffer)
+	binary.Write(want, binary.LittleEndian, fusekernel.OutHeader{
+		Len:   16 + 32,
+		Error: fusekernel.NotifyCodeRetrieve,
+	})
+	binary.Write(want, binary.LittleEndian, []uint64{1, 17, 4096, 8})
+
+	if got := buf[:n]; !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("RetrieveCache wrote %x, want %x", got, want.Bytes())
+	}
+
+	// The kernel answers with what it has cached.
+	c.handleNotifyReply(&notifyReplyOp{Unique: 1, Offset: 4096, Data: []byte("taco")})
+
+	res := <-done
+	if res.err != nil || string(dst[:res.n]) != "taco" {
+		t.Errorf("RetrieveCache: %d, %v, read %q", res.n, res.err, dst[:res.n])
+	}
+
+	// Answers to calls given up on are ignored.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.RetrieveCache(ctx, 17, 0, dst); err != context.Canceled {
+		t.Errorf("RetrieveCache with a cancelled context: %v", err)
+	}
+
+	c.handleNotifyReply(&notifyReplyOp{Unique: 2, Data: []byte("taco")})
+}
+
+func TestNotifyPollWakeup(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	c := &Connection{dev: w, protocol: fusekernel.Protocol{Major: 7, Minor: 31}}
+	if err := c.NotifyPollWakeup(17); err != nil {
+		t.Fatalf("NotifyPollWakeup: %v", err)
+	}
+
+	want := new(bytes.Buffer)
+	binary.Write(want, binary.LittleEndian, fusekernel.OutHeader{
+		Len:   16 + 8,
+		Error: fusekernel.NotifyCodePoll,
+	})
+	binary.Write(want, binary.LittleEndian, uint64(17))
+
+	buf := make([]byte, 4096)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if got := buf[:n]; !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("NotifyPollWakeup wrote %x, want %x", got, want.Bytes())
+	}
+
+	c.protocol.Minor = 10
+	if err := c.NotifyPollWakeup(17); err != syscall.ENOSYS {
+		t.Errorf("NotifyPollWakeup on 7.10: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system opening files as pipes that bypass the page cache, and
+// directories with their entries cached.
+type openFlagsFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *openFlagsFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.KeepPageCache = true
+	op.NonSeekable = true
+	return nil
+}
+
+func (fs *openFlagsFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	op.Entry.Child = 3
+	op.UseDirectIO = true
+	op.NonSeekable = true
+	return nil
+}
+
+func (fs *openFlagsFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	op.CacheDir = true
+	op.KeepCache = true
+	return nil
+}
+
+func TestOpenFlags(t *testing.T) {
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(&openFlagsFS{}))
+	defer hangUp()
+
+	// Read the FOPEN_* flags of the reply to a request, found at the supplied
+	// offset within it.
+	reply := func(offset uintptr) fusekernel.OpenResponseFlags {
+		t.Helper()
+
+		r := readReply(t, kernel)
+		if r.errno != 0 {
+			t.Fatalf("Reply: %+v", r)
+		}
+
+		return fusekernel.OpenResponseFlags((*fusekernel.OpenOut)(unsafe.Pointer(&r.data[offset])).OpenFlags)
+	}
+
+	open := fusekernel.OpenIn{Flags: uint32(fusekernel.OpenReadOnly)}
+	sendRequest(t, kernel, fusekernel.OpOpen, 1, (*[unsafe.Sizeof(open)]byte)(unsafe.Pointer(&open))[:])
+	if got, want := reply(0), fusekernel.OpenKeepCache|fusekernel.OpenNonSeekable; got != want {
+		t.Errorf("Open: %v, want %v", got, want)
+	}
+
+	create := fusekernel.CreateIn{Flags: uint32(fusekernel.OpenReadWrite), Mode: 0644}
+	body := append((*[unsafe.Sizeof(create)]byte)(unsafe.Pointer(&create))[:], "foo\x00"...)
+	sendRequest(t, kernel, fusekernel.OpCreate, 2, body)
+	entrySize := fusekernel.EntryOutSize(fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	})
+	if got, want := reply(entrySize), fusekernel.OpenDirectIO|fusekernel.OpenNonSeekable; got != want {
+		t.Errorf("Create: %v, want %v", got, want)
+	}
+
+	sendRequest(t, kernel, fusekernel.OpOpendir, 3, (*[unsafe.Sizeof(open)]byte)(unsafe.Pointer(&open))[:])
+	if got, want := reply(0), fusekernel.OpenCacheDir|fusekernel.OpenKeepCache; got != want {
+		t.Errorf("OpenDir: %v, want %v", got, want)
+	}
+}
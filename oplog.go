@@ -0,0 +1,202 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// The severity of an OpLogRecord, and the threshold below which records are
+// dropped. See MountConfig.OpLogLevel.
+type LogLevel int
+
+const (
+	// Ops read from the kernel, and replies that are successful or fail in the
+	// usual course of things, such as a lookup of a name that doesn't exist.
+	LogDebug LogLevel = iota
+
+	// Replies with errors that are worth someone's attention, as logged to
+	// MountConfig.ErrorLogger.
+	LogError
+
+	// As a threshold, drops every record.
+	LogNone
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogError:
+		return "error"
+	case LogNone:
+		return "none"
+	}
+
+	return "unknown"
+}
+
+// What an OpLogger is told about an op being read or replied to.
+type OpLogRecord struct {
+	Level LogLevel
+
+	// The name of the op, e.g. "ReadFile".
+	Op string
+
+	// The ID the kernel gave the op, which the records of its request and of
+	// its reply share.
+	FuseID uint64
+
+	// Set for the record of the reply to the op, clear for that of the op
+	// being read from the kernel.
+	Reply bool
+
+	// The op's fields, as rendered by fuseops.OpFields with
+	// MountConfig.OpLogFormat. Those of a reply include what the file system
+	// filled in.
+	Fields map[string]interface{}
+
+	// For a reply, the error the op was replied to with, if any, and how long
+	// the op took from being read to being replied to.
+	Err      error
+	Duration time.Duration
+}
+
+// An OpLogger receives a structured record of the ops a connection serves,
+// typically to pass on to a logging library such as log/slog or zap, whose
+// integration thus stays out of this package's dependencies. For example:
+//
+//	type slogOpLogger struct{ logger *slog.Logger }
+//
+//	func (l slogOpLogger) LogOp(r fuse.OpLogRecord) {
+//		level := slog.LevelDebug
+//		if r.Level == fuse.LogError {
+//			level = slog.LevelError
+//		}
+//
+//		l.logger.Log(context.Background(), level, r.Op,
+//			"fuse_id", r.FuseID, "reply", r.Reply, "err", r.Err,
+//			"fields", r.Fields)
+//	}
+//
+// LogOp is called synchronously on the goroutine reading or replying to the
+// op, so it should be quick. It may retain the record.
+type OpLogger interface {
+	LogOp(r OpLogRecord)
+}
+
+// NewJSONOpLogger returns an OpLogger that writes each record to w as a JSON
+// object on a line of its own. Errors writing to w are ignored.
+func NewJSONOpLogger(w io.Writer) OpLogger {
+	return &jsonOpLogger{enc: json.NewEncoder(w)}
+}
+
+type jsonOpLogger struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	enc *json.Encoder
+}
+
+// LOCKS_EXCLUDED(l.mu)
+func (l *jsonOpLogger) LogOp(r OpLogRecord) {
+	line := struct {
+		Time     time.Time              `json:"time"`
+		Level    string                 `json:"level"`
+		Op       string                 `json:"op"`
+		FuseID   uint64                 `json:"fuse_id"`
+		Reply    bool                   `json:"reply,omitempty"`
+		Err      string                 `json:"error,omitempty"`
+		Duration time.Duration          `json:"duration_ns,omitempty"`
+		Fields   map[string]interface{} `json:"fields,omitempty"`
+	}{
+		Time:     time.Now(),
+		Level:    r.Level.String(),
+		Op:       r.Op,
+		FuseID:   r.FuseID,
+		Reply:    r.Reply,
+		Duration: r.Duration,
+		Fields:   r.Fields,
+	}
+
+	if r.Err != nil {
+		line.Err = r.Err.Error()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.enc.Encode(line)
+}
+
+// Report whether a record of the given level about the op is to be logged to
+// the configured OpLogger.
+func (c *Connection) opLogEnabled(level LogLevel, op interface{}) bool {
+	if c.cfg.OpLogger == nil {
+		return false
+	}
+
+	threshold := c.cfg.OpLogLevel
+	if l, ok := c.cfg.OpLogLevels[opName(op)]; ok {
+		threshold = l
+	}
+
+	return level >= threshold && level < LogNone
+}
+
+// Log the op being read from the kernel, if so configured.
+func (c *Connection) logRequest(op interface{}, fuseID uint64) {
+	if !c.opLogEnabled(LogDebug, op) {
+		return
+	}
+
+	c.cfg.OpLogger.LogOp(OpLogRecord{
+		Level:  LogDebug,
+		Op:     opName(op),
+		FuseID: fuseID,
+		Fields: fuseops.OpFields(op, c.cfg.OpLogFormat),
+	})
+}
+
+// Log the reply to an op read at the given time, if so configured.
+func (c *Connection) logReply(
+	op interface{},
+	fuseID uint64,
+	start time.Time,
+	opErr error) {
+	level := LogDebug
+	if opErr != nil && !isExpectedError(op, opErr) {
+		level = LogError
+	}
+
+	if !c.opLogEnabled(level, op) {
+		return
+	}
+
+	c.cfg.OpLogger.LogOp(OpLogRecord{
+		Level:    level,
+		Op:       opName(op),
+		FuseID:   fuseID,
+		Reply:    true,
+		Fields:   fuseops.OpFields(op, c.cfg.OpLogFormat),
+		Err:      opErr,
+		Duration: time.Since(start),
+	})
+}
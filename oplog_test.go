@@ -0,0 +1,113 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A file system whose files all contain "data", and from which nothing can be
+// unlinked.
+type opLogFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *opLogFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	op.BytesRead = copy(op.Dst, "data")
+	return nil
+}
+
+func (fs *opLogFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return syscall.EIO
+}
+
+type chanOpLogger chan fuse.OpLogRecord
+
+func (l chanOpLogger) LogOp(r fuse.OpLogRecord) {
+	l <- r
+}
+
+func TestOpLogger(t *testing.T) {
+	records := make(chanOpLogger, 10)
+	cfg := &fuse.MountConfig{
+		OpLogger:    records,
+		OpLogLevels: map[string]fuse.LogLevel{"Unlink": fuse.LogError},
+	}
+
+	kernel, _, hangUp := serveWithConfig(t, cfg, fuseutil.NewFileSystemServer(&opLogFS{}))
+	defer hangUp()
+
+	next := func() fuse.OpLogRecord {
+		select {
+		case r := <-records:
+			return r
+		default:
+			t.Fatalf("No record logged")
+			return fuse.OpLogRecord{}
+		}
+	}
+
+	// Skip the init op's records.
+	next()
+	next()
+
+	// Reads are logged as they arrive and when replied to, without their data.
+	sendRead(t, kernel, 1, 0)
+	if r := readReply(t, kernel); r.errno != 0 || string(r.data) != "data" {
+		t.Fatalf("Read reply: %+v", r)
+	}
+
+	r := next()
+	if r.Level != fuse.LogDebug || r.Op != "ReadFile" || r.FuseID != 1 || r.Reply {
+		t.Errorf("Request record: %+v", r)
+	}
+
+	r = next()
+	if r.Level != fuse.LogDebug || r.Op != "ReadFile" || !r.Reply || r.Err != nil {
+		t.Errorf("Reply record: %+v", r)
+	}
+
+	if got, want := r.Fields["Dst"], map[string]int{"Len": 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Dst logged as %v, want %v", got, want)
+	}
+
+	// Only the failure of an unlink is logged.
+	sendUnlink(t, kernel, 2, "foo")
+	if r := readReply(t, kernel); r.errno != -int32(syscall.EIO) {
+		t.Fatalf("Unlink reply: %+v", r)
+	}
+
+	r = next()
+	if r.Level != fuse.LogError || r.Op != "Unlink" || r.Err != syscall.EIO || r.Fields["Name"] != "foo" {
+		t.Errorf("Unlink record: %+v", r)
+	}
+
+	select {
+	case r := <-records:
+		t.Errorf("Unexpected record: %+v", r)
+	default:
+	}
+}
@@ -31,18 +31,46 @@ type interruptOp struct {
 	FuseID uint64
 }
 
+// The kernel's answer to Connection.RetrieveCache, handled by the connection.
+type notifyReplyOp struct {
+	Unique uint64
+	Offset uint64
+
+	// Points into the message's buffer.
+	Data []byte
+}
+
 // Required in order to mount on Linux and OS X.
 type initOp struct {
 	// In
 	Kernel fusekernel.Protocol
 
 	// In/out
-	Flags fusekernel.InitFlags
+	Flags  fusekernel.InitFlags
+	Flags2 fusekernel.InitFlags2
+
+	// Out
+	Library             fusekernel.Protocol
+	MaxReadahead        uint32
+	MaxBackground       uint16
+	CongestionThreshold uint16
+	MaxWrite            uint32
+	MaxPages            uint16
+	MaxStackDepth       uint32
+}
+
+// Required in order to register a character device with CUSE.
+type cuseInitOp struct {
+	// In
+	Kernel fusekernel.Protocol
+	Flags  uint32
 
 	// Out
-	Library       fusekernel.Protocol
-	MaxReadahead  uint32
-	MaxBackground uint16
-	MaxWrite      uint32
-	MaxPages      uint16
+	Library  fusekernel.Protocol
+	OutFlags uint32
+	MaxRead  uint32
+	MaxWrite uint32
+	DevMajor uint32
+	DevMinor uint32
+	DevName  string
 }
@@ -0,0 +1,64 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"runtime/debug"
+	"syscall"
+)
+
+// What the connection does when an op handler run through Connection.Recover
+// panics. See MountConfig.PanicPolicy.
+type PanicPolicy int
+
+const (
+	// Recover from the panic, log it along with the handler's stack to
+	// MountConfig.ErrorLogger, and fail the op with EIO, so that a bug hit by
+	// some ops leaves the mount usable by processes making others. A handler
+	// that panics may leave the file system inconsistent, e.g. with a mutex
+	// held, so later ops may fail or block too.
+	PanicRecover PanicPolicy = iota
+
+	// Let the panic crash the process, as it would without Recover, so that
+	// the mount fails fast and a supervisor can restart it with a clean state.
+	PanicCrash
+)
+
+// Recover calls f, which handles op, and returns its error. If f panics under
+// PanicRecover, the panic is logged and EIO returned, for the server to reply
+// to the op with as usual; under PanicCrash it carries on up the stack.
+// Servers call it around their handlers, as fuseutil.NewFileSystemServer does,
+// since a panic on a goroutine handling an op otherwise crashes the process
+// and leaves callers blocked on the mount until it is unmounted.
+func (c *Connection) Recover(op interface{}, f func() error) (err error) {
+	if c.cfg.PanicPolicy == PanicCrash {
+		return f()
+	}
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		if c.errorLogger != nil {
+			c.errorLogger.Printf("%T handler panicked: %v\n%s", op, r, debug.Stack())
+		}
+
+		err = syscall.EIO
+	}()
+
+	return f()
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system that panics on its first StatFS.
+type panickyStatFS struct {
+	fuseutil.NotImplementedFileSystem
+	calls int
+}
+
+func (fs *panickyStatFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	fs.calls++
+	if fs.calls == 1 {
+		panic("taking the mount down")
+	}
+
+	return nil
+}
+
+func TestPanicRecover(t *testing.T) {
+	messages := make(messageWriter, 10)
+	cfg := &fuse.MountConfig{ErrorLogger: log.New(messages, "", 0)}
+
+	kernel, _, hangUp := serveWithConfig(t, cfg, fuseutil.NewFileSystemServer(&panickyStatFS{}))
+	defer hangUp()
+
+	// The op on which the file system panics fails, and the panic is logged
+	// with its stack.
+	sendRequest(t, kernel, fusekernel.OpStatfs, 1, nil)
+	if r := readReply(t, kernel); r.unique != 1 || r.errno != -int32(syscall.EIO) {
+		t.Errorf("Reply to the op panicking: %+v", r)
+	}
+
+	select {
+	case m := <-messages:
+		if !strings.Contains(m, "StatFSOp handler panicked: taking the mount down") || !strings.Contains(m, "panickyStatFS") {
+			t.Errorf("Logged %q", m)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Nothing logged")
+	}
+
+	// Later ops are served as usual.
+	sendRequest(t, kernel, fusekernel.OpStatfs, 2, nil)
+	if r := readReply(t, kernel); r.unique != 2 || r.errno != 0 {
+		t.Errorf("Reply to the next op: %+v", r)
+	}
+}
+
+func TestPanicCrash(t *testing.T) {
+	cfg := &fuse.MountConfig{PanicPolicy: fuse.PanicCrash}
+	_, c, hangUp := serveWithConfig(t, cfg, fuseutil.NewFileSystemServer(&panickyStatFS{}))
+	defer hangUp()
+
+	// Errors are passed through, and panics carry on.
+	want := errors.New("taco")
+	if err := c.Recover(&fuseops.StatFSOp{}, func() error { return want }); err != want {
+		t.Errorf("Recover returned %v", err)
+	}
+
+	defer func() {
+		if r := recover(); r != "taking the mount down" {
+			t.Errorf("Recovered %v", r)
+		}
+	}()
+
+	c.Recover(&fuseops.StatFSOp{}, func() error { panic("taking the mount down") })
+	t.Errorf("Recover returned from a panic")
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/buffer"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// Register the backing file of a successful open, if any, and have the reply
+// about to be sent tell the kernel to do I/O on it. Return the backing ID, or
+// zero if the handle is served by the file system as usual. See
+// MountConfig.EnablePassthrough.
+//
+// The reply must have been filled in by kernelResponse, leaving the OpenOut as
+// its last segment.
+func (c *Connection) openPassthrough(
+	op interface{},
+	opErr error,
+	m *buffer.OutMessage) int32 {
+	var f *os.File
+	switch o := op.(type) {
+	case *fuseops.OpenFileOp:
+		if !o.UseDirectIO {
+			f = o.BackingFile
+		}
+
+	case *fuseops.CreateFileOp:
+		if !o.UseDirectIO {
+			f = o.BackingFile
+		}
+	}
+
+	if f == nil || opErr != nil || c.initFlags2&fusekernel.InitPassthrough == 0 {
+		return 0
+	}
+
+	id, err := openBacking(c.dev, f)
+	if err != nil {
+		if c.errorLogger != nil {
+			c.errorLogger.Printf("%T: %v", op, err)
+		}
+
+		return 0
+	}
+
+	out := (*fusekernel.OpenOut)(unsafe.Pointer(&m.Sglist[len(m.Sglist)-1][0]))
+	out.OpenFlags |= uint32(fusekernel.OpenPassthrough)
+	out.BackingID = id
+
+	return id
+}
+
+// Keep track of the backing files registered for open handles, given the
+// backing ID returned by openPassthrough and the error from sending the reply.
+//
+// The kernel looks the ID up after it has received the reply, from the thread
+// doing the open, so the ID must stay registered until then. It is
+// unregistered when the handle is released, or straight away if the reply
+// couldn't be sent because the open was interrupted.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) noteBacking(
+	op interface{},
+	backingID int32,
+	writeErr error) {
+	var h fuseops.HandleID
+	switch o := op.(type) {
+	case *fuseops.OpenFileOp:
+		h = o.Handle
+
+	case *fuseops.CreateFileOp:
+		h = o.Handle
+
+	case *fuseops.ReleaseFileHandleOp:
+		c.mu.Lock()
+		id, ok := c.backingIDs[o.Handle]
+		delete(c.backingIDs, o.Handle)
+		c.mu.Unlock()
+
+		if ok {
+			c.closeBackingID(id)
+		}
+
+		return
+	}
+
+	if backingID == 0 {
+		return
+	}
+
+	if writeErr != nil {
+		c.closeBackingID(backingID)
+		return
+	}
+
+	// A handle reissued while still open, which file systems mustn't do for
+	// handles with backing files, would otherwise leak the previous ID.
+	c.mu.Lock()
+	prev, ok := c.backingIDs[h]
+	c.backingIDs[h] = backingID
+	c.mu.Unlock()
+
+	if ok {
+		c.closeBackingID(prev)
+	}
+}
+
+func (c *Connection) closeBackingID(id int32) {
+	if err := closeBacking(c.dev, id); err != nil && c.errorLogger != nil {
+		c.errorLogger.Printf("closing backing file %d: %v", id, err)
+	}
+}
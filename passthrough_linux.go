@@ -0,0 +1,44 @@
+package fuse
+
+import (
+	"os"
+	"runtime"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// Register the file with the kernel as a backing file for passthrough,
+// returning the ID to reply to the open with.
+func openBacking(dev *os.File, f *os.File) (int32, error) {
+	m := fusekernel.BackingMap{Fd: int32(f.Fd())}
+	id, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		dev.Fd(),
+		fusekernel.DevIocBackingOpen,
+		uintptr(unsafe.Pointer(&m)))
+	runtime.KeepAlive(f)
+
+	if errno != 0 {
+		return 0, &os.SyscallError{Syscall: "FUSE_DEV_IOC_BACKING_OPEN", Err: errno}
+	}
+
+	return int32(id), nil
+}
+
+// Unregister a backing file. Files already opened with it keep using it.
+func closeBacking(dev *os.File, id int32) error {
+	arg := uint32(id)
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		dev.Fd(),
+		fusekernel.DevIocBackingClose,
+		uintptr(unsafe.Pointer(&arg)))
+
+	if errno != 0 {
+		return &os.SyscallError{Syscall: "FUSE_DEV_IOC_BACKING_CLOSE", Err: errno}
+	}
+
+	return nil
+}
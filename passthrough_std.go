@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package fuse
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoPassthrough = errors.New("passthrough is only supported on Linux")
+
+func openBacking(dev *os.File, f *os.File) (int32, error) {
+	return 0, errNoPassthrough
+}
+
+func closeBacking(dev *os.File, id int32) error {
+	return errNoPassthrough
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// A file system serving files from a backing file.
+type backingFS struct {
+	fuseutil.NotImplementedFileSystem
+	backing *os.File
+}
+
+func (fs *backingFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.Handle = 7
+	op.BackingFile = fs.backing
+	return nil
+}
+
+func TestPassthrough(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("passthrough is only supported on Linux")
+	}
+
+	// Writeback caching must be disabled.
+	if _, err := fuse.NewConnection(&fuse.MountConfig{EnablePassthrough: true}, nil); err == nil {
+		t.Errorf("NewConnection accepted passthrough with writeback caching")
+	}
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	dev := os.NewFile(uintptr(fds[0]), "dev")
+	kernel := os.NewFile(uintptr(fds[1]), "kernel")
+
+	// A kernel offering passthrough.
+	in := struct {
+		fusekernel.InitIn
+		fusekernel.InitInExt
+	}{}
+	in.Major = fusekernel.ProtoVersionMaxMajor
+	in.Minor = fusekernel.ProtoVersionMaxMinor
+	in.Flags = uint32(fusekernel.InitInitExt)
+	in.Flags2 = uint32(fusekernel.InitPassthrough)
+	sendRequest(t, kernel, fusekernel.OpInit, 0, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+
+	messages := make(messageWriter, 10)
+	cfg := &fuse.MountConfig{
+		EnablePassthrough:       true,
+		DisableWritebackCaching: true,
+		ErrorLogger:             log.New(messages, "", 0),
+	}
+
+	c, err := fuse.NewConnection(cfg, dev)
+	if err != nil {
+		t.Fatalf("NewConnection: %v", err)
+	}
+
+	r := readReply(t, kernel)
+	out := (*fusekernel.InitOut)(unsafe.Pointer(&r.data[0]))
+	if fusekernel.InitFlags2(out.Flags2)&fusekernel.InitPassthrough == 0 || out.MaxStackDepth != 1 {
+		t.Errorf("Init reply: Flags2 %#x, MaxStackDepth %d", out.Flags2, out.MaxStackDepth)
+	}
+
+	if !c.Capabilities()[fuse.CapPassthrough] {
+		t.Errorf("Passthrough not reported as a capability")
+	}
+
+	backing, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer backing.Close()
+
+	done := make(chan struct{})
+	go func() {
+		fuseutil.NewFileSystemServer(&backingFS{backing: backing}).ServeOps(c)
+		close(done)
+	}()
+
+	defer func() {
+		kernel.Close()
+		<-done
+		c.Close()
+	}()
+
+	// A socket can't register backing files, so the open falls back to being
+	// served by the file system, and the error is logged.
+	open := fusekernel.OpenIn{Flags: uint32(fusekernel.OpenReadOnly)}
+	sendRequest(t, kernel, fusekernel.OpOpen, 1, (*[unsafe.Sizeof(open)]byte)(unsafe.Pointer(&open))[:])
+
+	r = readReply(t, kernel)
+	oo := (*fusekernel.OpenOut)(unsafe.Pointer(&r.data[0]))
+	if r.errno != 0 || oo.Fh != 7 || oo.OpenFlags&uint32(fusekernel.OpenPassthrough) != 0 || oo.BackingID != 0 {
+		t.Errorf("Open reply: %+v, %+v", r, *oo)
+	}
+
+	if msg := <-messages; !strings.Contains(msg, "FUSE_DEV_IOC_BACKING_OPEN") {
+		t.Errorf("Logged error: %q", msg)
+	}
+}
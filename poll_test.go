@@ -0,0 +1,65 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// A file system whose files are writable but have nothing to read.
+type pollingFS struct {
+	fuseutil.NotImplementedFileSystem
+	polled chan *fuseops.PollOp
+}
+
+func (fs *pollingFS) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	fs.polled <- op
+	op.Revents = op.Events & unix.POLLOUT
+	return nil
+}
+
+func TestPoll(t *testing.T) {
+	fs := &pollingFS{polled: make(chan *fuseops.PollOp, 1)}
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	in := fusekernel.PollIn{
+		Fh:     3,
+		Kh:     17,
+		Flags:  fusekernel.PollScheduleNotify,
+		Events: unix.POLLIN | unix.POLLOUT,
+	}
+	sendRequest(t, kernel, fusekernel.OpPoll, 1, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+
+	r := readReply(t, kernel)
+	out := (*fusekernel.PollOut)(unsafe.Pointer(&r.data[0]))
+	if r.errno != 0 || out.Revents != unix.POLLOUT {
+		t.Errorf("Poll reply: %+v, %+v", r, out)
+	}
+
+	op := <-fs.polled
+	if op.Handle != 3 || op.Kh != 17 || !op.ScheduleNotify || op.Events != in.Events {
+		t.Errorf("PollOp: %+v", op)
+	}
+}
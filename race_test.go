@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package fuse_test
+
+// Whether tests are built with the race detector, which reports the races
+// that some tests provoke on purpose.
+const raceEnabled = true
@@ -0,0 +1,52 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Set ReadFileOp.Readahead on reads that continue sequentially from the
+// previous read on their handle, and forget handles as they are released.
+// The kernel queues the reads it has in flight in the order it issues them,
+// so the previous read is usually the one issued just before.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) noteRead(op interface{}) {
+	switch o := op.(type) {
+	case *fuseops.ReadFileOp:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		end, ok := c.readEnds[o.Handle]
+		c.readEnds[o.Handle] = o.Offset + o.Size
+
+		// Without readahead, or with direct IO, every read has a caller waiting.
+		if c.limits.MaxReadahead == 0 || o.OpenFlags.IsDirect() {
+			return
+		}
+
+		if _, direct := c.directIO[o.Handle]; direct {
+			return
+		}
+
+		o.Readahead = ok && o.Offset == end
+
+	case *fuseops.ReleaseFileHandleOp:
+		c.mu.Lock()
+		delete(c.readEnds, o.Handle)
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+func TestReadahead(t *testing.T) {
+	c := &Connection{
+		limits:   TransferLimits{MaxReadahead: 1 << 17},
+		directIO: map[fuseops.HandleID]struct{}{3: {}},
+		readEnds: make(map[fuseops.HandleID]int64),
+	}
+
+	read := func(h fuseops.HandleID, offset int64, flags fusekernel.OpenFlags) bool {
+		op := &fuseops.ReadFileOp{Handle: h, Offset: offset, Size: 4096, OpenFlags: flags}
+		c.noteRead(op)
+		return op.Readahead
+	}
+
+	testCases := []struct {
+		handle    fuseops.HandleID
+		offset    int64
+		flags     fusekernel.OpenFlags
+		readahead bool
+	}{
+		// A sequential run on one handle, interleaved with another's.
+		{1, 0, 0, false},
+		{1, 4096, 0, true},
+		{2, 8192, 0, false},
+		{1, 8192, 0, true},
+
+		// A seek.
+		{1, 65536, 0, false},
+		{1, 69632, 0, true},
+
+		// Direct IO.
+		{3, 0, 0, false},
+		{3, 4096, 0, false},
+		{4, 0, fusekernel.OpenDirect, false},
+		{4, 4096, fusekernel.OpenDirect, false},
+	}
+
+	for i, tc := range testCases {
+		if got := read(tc.handle, tc.offset, tc.flags); got != tc.readahead {
+			t.Errorf("Read %d (%+v): readahead %v", i, tc, got)
+		}
+	}
+
+	// Released handles start afresh.
+	c.noteRead(&fuseops.ReleaseFileHandleOp{Handle: 1})
+	if read(1, 73728, 0) {
+		t.Errorf("Read after release taken for readahead")
+	}
+
+	// Without readahead, nothing is.
+	c.limits.MaxReadahead = 0
+	if read(1, 77824, 0) {
+		t.Errorf("Read taken for readahead with readahead disabled")
+	}
+}
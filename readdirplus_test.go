@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system whose directories each hold a single file.
+type oneEntryFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *oneEntryFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	if op.Offset != 0 {
+		return nil
+	}
+
+	op.BytesRead = fuseutil.WriteDirentPlus(op.Dst, fuseutil.DirentPlus{
+		Dirent: fuseutil.Dirent{
+			Offset: 1,
+			Inode:  17,
+			Name:   "taco",
+			Type:   fuseutil.DT_File,
+		},
+		Entry: fuseops.ChildInodeEntry{
+			Child:      17,
+			Attributes: fuseops.InodeAttributes{Size: 100, Mode: 0644},
+		},
+	})
+
+	return nil
+}
+
+func TestReadDirPlus(t *testing.T) {
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(&oneEntryFS{}))
+	defer hangUp()
+
+	in := fusekernel.ReadIn{Size: 4096}
+	sendRequest(t, kernel, fusekernel.OpReaddirplus, 1, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+
+	r := readReply(t, kernel)
+	if r.errno != 0 {
+		t.Fatalf("Reply: %+v", r)
+	}
+
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	if len(r.data) != entrySize+32 {
+		t.Fatalf("Reply is %d bytes", len(r.data))
+	}
+
+	var e fusekernel.EntryOut
+	copy((*[entrySize]byte)(unsafe.Pointer(&e))[:], r.data)
+	if e.Nodeid != 17 || e.Attr.Size != 100 {
+		t.Errorf("Entry: %+v", e)
+	}
+
+	d, _ := fuseutil.ReadDirent(r.data[entrySize:])
+	if d.Inode != 17 || d.Name != "taco" {
+		t.Errorf("Dirent: %+v", d)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/folays/jacobsa_fuse/internal/buffer"
+	"github.com/folays/jacobsa_fuse/internal/freelist"
+)
+
+// Replaced by tests, which stand in for the kernel with socket pairs.
+var cloneDevice = cloneFuseDevice
+
+// A goroutine reading requests from the kernel through a device of its own,
+// if MountConfig.DeviceReaders is above one.
+type deviceReader struct {
+	// The connection's device or a clone of it, which replies to the requests
+	// read through it must be written to.
+	dev *os.File
+
+	mu sync.Mutex
+
+	// Buffers for the requests read through dev, which are returned here once
+	// the requests are replied to.
+	inMessages freelist.Freelist // GUARDED_BY(mu)
+}
+
+// A message read by a deviceReader, or the error that stopped it.
+type readResult struct {
+	m   *buffer.InMessage
+	r   *deviceReader
+	err error
+}
+
+// Start the readers asked for by MountConfig.DeviceReaders, the first reading
+// through the connection's device and the others through clones of it.
+func (c *Connection) startReaders() error {
+	n := c.cfg.DeviceReaders
+	if !isLinux() || n <= 1 {
+		return nil
+	}
+
+	readers := []*deviceReader{{dev: c.dev}}
+	for len(readers) < n {
+		dev, err := cloneDevice(c.dev)
+		if err != nil {
+			for _, r := range readers[1:] {
+				r.dev.Close()
+			}
+
+			return fmt.Errorf("cloning the device: %w", err)
+		}
+
+		readers = append(readers, &deviceReader{dev: dev})
+	}
+
+	c.readers = readers
+	c.reads = make(chan readResult)
+	c.stopReading = make(chan struct{})
+
+	c.readersDone.Add(len(readers))
+	for _, r := range readers {
+		go c.read(r)
+	}
+
+	return nil
+}
+
+// Read messages through the supplied reader and pass them on to ReadOp, until
+// reading fails or the connection is closed.
+func (c *Connection) read(r *deviceReader) {
+	defer c.readersDone.Done()
+
+	for {
+		m, err := c.readMessage(r)
+		select {
+		case c.reads <- readResult{m: m, r: r, err: err}:
+		case <-c.stopReading:
+			if m != nil {
+				c.putInMessage(r, m)
+			}
+
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Return the next message from the kernel and the reader that read it, which
+// is nil unless MountConfig.DeviceReaders is above one.
+func (c *Connection) nextMessage() (*buffer.InMessage, *deviceReader, error) {
+	if c.reads == nil {
+		m, err := c.readMessage(nil)
+		return m, nil, err
+	}
+
+	res := <-c.reads
+	return res.m, res.r, res.err
+}
+
+// Return the device that ops read by the supplied reader, or by ReadOp itself
+// if nil, are replied to through.
+func (c *Connection) replyDevice(r *deviceReader) *os.File {
+	if r == nil {
+		return c.dev
+	}
+
+	return r.dev
+}
+
+// Stop the readers and close the devices cloned for them. The readers must
+// have failed to read or be about to, as they do once the kernel has hung up.
+func (c *Connection) stopReaders() {
+	if c.readers == nil {
+		return
+	}
+
+	close(c.stopReading)
+	c.readersDone.Wait()
+
+	for _, r := range c.readers[1:] {
+		r.dev.Close()
+	}
+}
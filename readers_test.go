@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+type statFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *statFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	op.Blocks = 17
+	return nil
+}
+
+func TestDeviceReaders(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("DeviceReaders is Linux only")
+	}
+
+	// Stand in for the kernel at the other end of each clone too.
+	var clones []*os.File
+	defer fuse.SetCloneDevice(func(dev *os.File) (*os.File, error) {
+		fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		clones = append(clones, os.NewFile(uintptr(fds[1]), "kernel"))
+		return os.NewFile(uintptr(fds[0]), "dev"), nil
+	})()
+
+	cfg := &fuse.MountConfig{DeviceReaders: 3}
+	kernel, _, hangUp := serveWithConfig(t, cfg, fuseutil.NewFileSystemServer(&statFS{}))
+	defer hangUp()
+
+	if len(clones) != 2 {
+		t.Fatalf("%d clones, want 2", len(clones))
+	}
+
+	// Each op is replied to through the device it was read from.
+	devices := append([]*os.File{kernel}, clones...)
+	for i, dev := range devices {
+		sendRequest(t, dev, fusekernel.OpStatfs, uint64(i+1), nil)
+	}
+
+	for i, dev := range devices {
+		if r := readReply(t, dev); r.unique != uint64(i+1) || r.errno != 0 {
+			t.Errorf("Reply through device %d: %+v", i, r)
+		}
+	}
+
+	// The kernel hangs up all of the devices at once.
+	for _, dev := range clones {
+		dev.Close()
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system that records the renames it is sent, and implements no
+// flags but RenameNoReplace.
+type renameFS struct {
+	fuseutil.NotImplementedFileSystem
+	renames chan fuseops.RenameOp
+}
+
+func (fs *renameFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	fs.renames <- *op
+	if op.Flags&^fuseops.RenameNoReplace != 0 {
+		return syscall.EINVAL
+	}
+
+	return nil
+}
+
+func sendRename2(
+	t *testing.T,
+	kernel *os.File,
+	unique uint64,
+	flags fuseops.RenameFlags) {
+	in := fusekernel.Rename2In{Newdir: 3, Flags: uint32(flags)}
+	b := (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:]
+	sendRequest(t, kernel, fusekernel.OpRename2, unique, append(b, "old\x00new\x00"...))
+}
+
+func TestRenameFlags(t *testing.T) {
+	// Without the option, the kernel is told the op isn't implemented.
+	fs := &renameFS{renames: make(chan fuseops.RenameOp, 1)}
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(fs))
+	sendRename2(t, kernel, 1, fuseops.RenameNoReplace)
+	if r := readReply(t, kernel); r.unique != 1 || r.errno != -int32(syscall.ENOSYS) {
+		t.Errorf("Reply without the option: %+v", r)
+	}
+
+	hangUp()
+
+	// With it, the flags reach the file system, which may refuse them.
+	cfg := &fuse.MountConfig{EnableRenameFlags: true}
+	kernel, _, hangUp = serveWithConfig(t, cfg, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	sendRename2(t, kernel, 2, fuseops.RenameNoReplace)
+	if r := readReply(t, kernel); r.unique != 2 || r.errno != 0 {
+		t.Errorf("Reply to RenameNoReplace: %+v", r)
+	}
+
+	want := fuseops.RenameOp{
+		OldParent: 2,
+		OldName:   "old",
+		NewParent: 3,
+		NewName:   "new",
+		Flags:     fuseops.RenameNoReplace,
+	}
+
+	op := <-fs.renames
+	op.OpContext = fuseops.OpContext{}
+	if op != want {
+		t.Errorf("RenameOp: %+v", op)
+	}
+
+	sendRename2(t, kernel, 3, fuseops.RenameExchange)
+	if r := readReply(t, kernel); r.unique != 3 || r.errno != -int32(syscall.EINVAL) {
+		t.Errorf("Reply to RenameExchange: %+v", r)
+	}
+
+	<-fs.renames
+}
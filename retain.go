@@ -0,0 +1,98 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Lets the buffer of an incoming message outlive the reply to its op. See
+// RetainWriteData.
+type retention struct {
+	c *Connection
+
+	// GUARDED_BY(c.mu)
+	held    bool
+	replied bool
+}
+
+// RetainWriteData lets the file system keep using the Data of the
+// fuseops.WriteFileOp with the supplied context after replying to it, e.g. to
+// send it to its backend in the background, instead of copying it. Data
+// refers to the pooled buffer that the kernel's request was read into, which
+// is otherwise reused for another request as soon as the op is replied to.
+//
+// RetainWriteData must be called before replying, at most once per op. The
+// function returned must be called exactly once when Data is no longer
+// needed, to return the buffer to the pool.
+//
+// LOCKS_EXCLUDED(c.mu)
+func RetainWriteData(ctx context.Context) (release func()) {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok || state.retain == nil {
+		panic(fmt.Sprintf("RetainWriteData called with invalid context: %#v", ctx))
+	}
+
+	r := state.retain
+	r.c.mu.Lock()
+	defer r.c.mu.Unlock()
+
+	if r.held || r.replied {
+		panic("RetainWriteData called twice or after replying")
+	}
+
+	r.held = true
+	return func() {
+		r.c.mu.Lock()
+		done := r.replied
+		r.held = false
+		r.c.mu.Unlock()
+
+		if done {
+			r.c.putInMessage(state.reader, state.inMsg)
+		}
+	}
+}
+
+// Return the buffer of an op that has been replied to to the pool, unless the
+// file system still holds on to it.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) releaseInMessage(state opState) {
+	if r := state.retain; r != nil {
+		c.mu.Lock()
+		r.replied = true
+		held := r.held
+		c.mu.Unlock()
+
+		if held {
+			return
+		}
+	}
+
+	c.putInMessage(state.reader, state.inMsg)
+}
+
+// Set up retention for ops whose buffers may be retained.
+func (c *Connection) retainable(op interface{}) *retention {
+	if _, ok := op.(*fuseops.WriteFileOp); ok {
+		return &retention{c: c}
+	}
+
+	return nil
+}
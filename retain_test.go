@@ -0,0 +1,74 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+type retainedWrite struct {
+	data    []byte
+	release func()
+}
+
+// A file system holding on to the data of the writes it is sent.
+type retainingFS struct {
+	fuseutil.NotImplementedFileSystem
+	writes chan retainedWrite
+}
+
+func (fs *retainingFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.writes <- retainedWrite{op.Data, fuse.RetainWriteData(ctx)}
+	return nil
+}
+
+func sendWrite(t *testing.T, kernel *os.File, unique uint64, data string) {
+	in := fusekernel.WriteIn{Size: uint32(len(data))}
+	b := (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:]
+	sendRequest(t, kernel, fusekernel.OpWrite, unique, append(b, data...))
+}
+
+func TestRetainWriteData(t *testing.T) {
+	fs := &retainingFS{writes: make(chan retainedWrite, 10)}
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	// Retained data survives the replies to this and later ops.
+	for i, s := range []string{"taco", "burrito", "enchilada"} {
+		sendWrite(t, kernel, uint64(i+1), s)
+		if r := readReply(t, kernel); r.errno != 0 {
+			t.Fatalf("Write reply: %+v", r)
+		}
+	}
+
+	for _, want := range []string{"taco", "burrito", "enchilada"} {
+		w := <-fs.writes
+		if string(w.data) != want {
+			t.Errorf("Retained %q, want %q", w.data, want)
+		}
+
+		w.release()
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// EAGAINRetry is returned, possibly wrapped, by a file system that can't
+// handle an op for the time being, e.g. because its backend is shedding load,
+// and hasn't started to. Servers that handle ops through Connection.Retry,
+// as fuseutil.NewFileSystemServer does, handle the op again after a delay,
+// so that the caller sees it take longer rather than fail. Ops still failing
+// with it when replied to fail with EAGAIN.
+var EAGAINRetry = errors.New("resource temporarily unavailable, try again")
+
+// The delay before the first retry of an op failing with EAGAINRetry, and the
+// longest between retries.
+const (
+	minRetryDelay = 10 * time.Millisecond
+	maxRetryDelay = time.Second
+)
+
+// Retry calls f, which handles the op read with ctx, and calls it again for as
+// long as it fails with EAGAINRetry, after delays growing from 10 ms to a
+// second. It gives up and returns the error once MountConfig.RetryTimeout has
+// passed since the op was read, or the op's soft deadline if it has an earlier
+// one (see SoftDeadline), and returns EINTR if ctx is cancelled while waiting.
+//
+// Ops whose callers expect EAGAIN rather than to wait are not retried: reads
+// and writes on handles opened with O_NONBLOCK, and lock requests that don't
+// wait for conflicting locks.
+func (c *Connection) Retry(
+	ctx context.Context,
+	op interface{},
+	f func() error) error {
+	err := f()
+	if !errors.Is(err, EAGAINRetry) || !mayRetry(op) {
+		return err
+	}
+
+	deadline := time.Now().Add(c.retryTimeout())
+	if d, ok := SoftDeadline(ctx); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	for delay := minRetryDelay; errors.Is(err, EAGAINRetry); delay *= 2 {
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			break
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return syscall.EINTR
+		}
+
+		err = f()
+	}
+
+	return err
+}
+
+// Return MountConfig.RetryTimeout, or its default.
+func (c *Connection) retryTimeout() time.Duration {
+	if c.cfg.RetryTimeout > 0 {
+		return c.cfg.RetryTimeout
+	}
+
+	return 30 * time.Second
+}
+
+// Report whether the caller waiting for the op is prepared to wait for it to
+// be retried.
+func mayRetry(op interface{}) bool {
+	switch o := op.(type) {
+	case *fuseops.ReadFileOp:
+		return !o.OpenFlags.IsNonblock()
+
+	case *fuseops.WriteFileOp:
+		return !o.OpenFlags.IsNonblock()
+
+	case *fuseops.SetLkOp:
+		return o.Wait
+	}
+
+	return true
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system whose backend sheds the first few reads, and every statfs.
+type sheddingFS struct {
+	fuseutil.NotImplementedFileSystem
+	reads int32
+}
+
+func (fs *sheddingFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if atomic.AddInt32(&fs.reads, 1) <= 2 {
+		return fmt.Errorf("backend: %w", fuse.EAGAINRetry)
+	}
+
+	op.BytesRead = copy(op.Dst, "data")
+	return nil
+}
+
+func (fs *sheddingFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return fuse.EAGAINRetry
+}
+
+func TestRetry(t *testing.T) {
+	fs := &sheddingFS{}
+	cfg := &fuse.MountConfig{RetryTimeout: 50 * time.Millisecond}
+	kernel, _, hangUp := serveWithConfig(t, cfg, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	// Reads are retried until they succeed...
+	sendRead(t, kernel, 1, 0)
+	if r := readReply(t, kernel); r.errno != 0 || string(r.data) != "data" {
+		t.Errorf("Read reply: %+v", r)
+	}
+
+	if n := atomic.LoadInt32(&fs.reads); n != 3 {
+		t.Errorf("%d reads, want 3", n)
+	}
+
+	// ...unless the caller doesn't want to wait.
+	atomic.StoreInt32(&fs.reads, 0)
+	in := fusekernel.ReadIn{Size: 4, Flags: uint32(fusekernel.OpenNonblock)}
+	sendRequest(t, kernel, fusekernel.OpRead, 2, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+	if r := readReply(t, kernel); r.errno != -int32(syscall.EAGAIN) {
+		t.Errorf("Non-blocking read reply: %+v", r)
+	}
+
+	// Ops are failed with EAGAIN once the retry timeout has passed.
+	start := time.Now()
+	sendRequest(t, kernel, fusekernel.OpStatfs, 3, nil)
+	if r := readReply(t, kernel); r.errno != -int32(syscall.EAGAIN) {
+		t.Errorf("StatFS reply: %+v", r)
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("StatFS took %v", d)
+	}
+}
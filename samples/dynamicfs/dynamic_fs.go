@@ -38,7 +38,7 @@ func NewDynamicFS(clock timeutil.Clock) (fuse.Server, error) {
 	fs := &dynamicFS{
 		clock:       clock,
 		createTime:  createTime,
-		fileHandles: make(map[fuseops.HandleID]string),
+		fileHandles: fuseutil.NewHandleTable(),
 	}
 	return fuseutil.NewFileSystemServer(fs), nil
 }
@@ -48,8 +48,7 @@ type dynamicFS struct {
 	mu          sync.Mutex
 	clock       timeutil.Clock
 	createTime  time.Time
-	nextHandle  fuseops.HandleID
-	fileHandles map[fuseops.HandleID]string
+	fileHandles *fuseutil.HandleTable
 }
 
 const (
@@ -123,16 +122,6 @@ func findChildInode(
 	return 0, fuse.ENOENT
 }
 
-func (fs *dynamicFS) findUnusedHandle() fuseops.HandleID {
-	// TODO: Mutex annotation?
-	handle := fs.nextHandle
-	for _, exists := fs.fileHandles[handle]; exists; _, exists = fs.fileHandles[handle] {
-		handle++
-	}
-	fs.nextHandle = handle + 1
-	return handle
-}
-
 func (fs *dynamicFS) GetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.GetInodeAttributesOp) error {
@@ -227,24 +216,20 @@ func (fs *dynamicFS) OpenFile(
 	default:
 		return fuse.EINVAL
 	}
-	handle := fs.findUnusedHandle()
-	fs.fileHandles[handle] = contents
 	op.UseDirectIO = true
-	op.Handle = handle
+	op.Handle = fs.fileHandles.Allocate(op.Inode, contents)
 	return nil
 }
 
 func (fs *dynamicFS) ReadFile(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-	contents, ok := fs.fileHandles[op.Handle]
+	contents, ok := fs.fileHandles.Lookup(op.Handle)
 	if !ok {
 		log.Printf("ReadFile: no open file handle: %d", op.Handle)
 		return fuse.EIO
 	}
-	reader := strings.NewReader(contents)
+	reader := strings.NewReader(contents.(string))
 	var err error
 	op.BytesRead, err = reader.ReadAt(op.Dst, op.Offset)
 	if err == io.EOF {
@@ -256,17 +241,19 @@ func (fs *dynamicFS) ReadFile(
 func (fs *dynamicFS) ReleaseFileHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseFileHandleOp) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-	_, ok := fs.fileHandles[op.Handle]
-	if !ok {
+	if _, ok := fs.fileHandles.Release(op.Handle); !ok {
 		log.Printf("ReleaseFileHandle: bad handle: %d", op.Handle)
 		return fuse.EIO
 	}
-	delete(fs.fileHandles, op.Handle)
 	return nil
 }
 
+func (fs *dynamicFS) Destroy() {
+	if err := fs.fileHandles.Check(); err != nil {
+		log.Printf("Destroy: %v", err)
+	}
+}
+
 func (fs *dynamicFS) StatFS(ctx context.Context,
 	op *fuseops.StatFSOp) error {
 	return nil
@@ -201,14 +201,19 @@ func (fs *errorFS) ReadDir(
 		return err
 	}
 
-	if op.Inode != fuseops.RootInodeID || op.Offset != 0 {
+	if op.Inode != fuseops.RootInodeID || op.Offset > 1 {
 		return fmt.Errorf("Unexpected request: %#v", op)
 	}
 
+	// The end of the listing.
+	if op.Offset == 1 {
+		return nil
+	}
+
 	op.BytesRead = fuseutil.WriteDirent(
 		op.Dst,
 		fuseutil.Dirent{
-			Offset: 0,
+			Offset: 1,
 			Inode:  fooInodeID,
 			Name:   "foo",
 			Type:   fuseutil.DT_File,
@@ -0,0 +1,395 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ftpfs
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// An entry of a directory listing.
+type entry struct {
+	name  string
+	dir   bool
+	size  uint64
+	mtime time.Time
+}
+
+// A control connection to an FTP server, speaking just enough of RFC 959 and
+// its extensions for passive data connections (RFC 2428), machine-readable
+// listings and restarted transfers (RFC 3659) and TLS (RFC 4217). Not safe for
+// concurrent use.
+type conn struct {
+	cfg  *Config
+	raw  net.Conn
+	text *textproto.Conn
+}
+
+func dial(ctx context.Context, cfg *Config) (_ *conn, err error) {
+	d := net.Dialer{Timeout: cfg.Timeout}
+	raw, err := d.DialContext(ctx, "tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			raw.Close()
+		}
+	}()
+
+	c := &conn{cfg: cfg, raw: raw, text: textproto.NewConn(raw)}
+
+	c.raw.SetDeadline(time.Now().Add(cfg.Timeout))
+	if _, _, err = c.text.ReadResponse(2); err != nil {
+		return nil, err
+	}
+
+	// Secure the control connection, then have data connections secured too.
+	if cfg.TLS != nil {
+		if _, err = c.cmd(2, "AUTH TLS"); err != nil {
+			return nil, err
+		}
+
+		c.raw = tls.Client(raw, cfg.TLS)
+		c.text = textproto.NewConn(c.raw)
+		if _, err = c.cmd(2, "PBSZ 0"); err != nil {
+			return nil, err
+		}
+
+		if _, err = c.cmd(2, "PROT P"); err != nil {
+			return nil, err
+		}
+	}
+
+	code, err := c.cmd(0, "USER %s", cfg.User)
+	if err == nil && code/100 == 3 {
+		code, err = c.cmd(0, "PASS %s", cfg.Password)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if code/100 != 2 {
+		return nil, fmt.Errorf("logging in: %w", syscall.EACCES)
+	}
+
+	if _, err = c.cmd(2, "TYPE I"); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *conn) close() {
+	c.raw.Close()
+}
+
+// Send a command, and read the reply, whose code must start with the
+// supplied digit unless it is zero.
+func (c *conn) cmd(expect int, format string, args ...interface{}) (int, error) {
+	code, _, err := c.cmdMsg(expect, format, args...)
+	return code, err
+}
+
+func (c *conn) cmdMsg(
+	expect int,
+	format string,
+	args ...interface{}) (code int, msg string, err error) {
+	c.raw.SetDeadline(time.Now().Add(c.cfg.Timeout))
+	if _, err = c.text.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+
+	return c.text.ReadResponse(expect)
+}
+
+// Open a passive data connection, for a transfer started by the next command.
+func (c *conn) openData() (net.Conn, error) {
+	_, msg, err := c.cmdMsg(2, "EPSV")
+	if err != nil {
+		return nil, err
+	}
+
+	// 229 Entering Extended Passive Mode (|||port|)
+	open := strings.Index(msg, "(|||")
+	end := strings.LastIndex(msg, "|)")
+	if open < 0 || end < open+4 {
+		return nil, fmt.Errorf("malformed EPSV reply: %q", msg)
+	}
+
+	port, err := strconv.Atoi(msg[open+4 : end])
+	if err != nil {
+		return nil, fmt.Errorf("malformed EPSV reply: %q", msg)
+	}
+
+	host, _, _ := net.SplitHostPort(c.raw.RemoteAddr().String())
+	data, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), c.cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	data.SetDeadline(time.Now().Add(c.cfg.Timeout))
+	if c.cfg.TLS != nil {
+		data = tls.Client(data, c.cfg.TLS)
+	}
+
+	return data, nil
+}
+
+// List the directory at the supplied path.
+func (c *conn) list(path string) ([]entry, error) {
+	data, err := c.openData()
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	if _, err := c.cmd(1, "MLSD %s", path); err != nil {
+		return nil, err
+	}
+
+	var entries []entry
+	s := bufio.NewScanner(data)
+	for s.Scan() {
+		if e, ok := parseMLSD(s.Text()); ok {
+			entries = append(entries, e)
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	data.Close()
+	if _, _, err := c.text.ReadResponse(2); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Parse a line of an MLSD listing, e.g. "type=file;size=3;modify=20150301120000; f",
+// skipping those for the directory itself and its parent.
+func parseMLSD(line string) (e entry, ok bool) {
+	facts, name, found := strings.Cut(line, " ")
+	if !found || name == "" {
+		return e, false
+	}
+
+	e.name = name
+	for _, fact := range strings.Split(facts, ";") {
+		k, v, _ := strings.Cut(fact, "=")
+		switch strings.ToLower(k) {
+		case "type":
+			switch strings.ToLower(v) {
+			case "dir":
+				e.dir = true
+			case "cdir", "pdir":
+				return e, false
+			}
+
+		case "size":
+			e.size, _ = strconv.ParseUint(v, 10, 64)
+
+		case "modify":
+			e.mtime, _ = time.Parse("20060102150405", v)
+		}
+	}
+
+	return e, true
+}
+
+// Read the contents of the file at the supplied path from the offset into
+// dst, returning the number of bytes read, which is short only at the end of
+// the file.
+func (c *conn) retrieve(path string, offset int64, dst []byte) (int, error) {
+	data, err := c.openData()
+	if err != nil {
+		return 0, err
+	}
+	defer data.Close()
+
+	if _, err := c.cmd(3, "REST %d", offset); err != nil {
+		return 0, err
+	}
+
+	if _, err := c.cmd(1, "RETR %s", path); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(data, dst)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	// Having stopped reading early, the server may report the transfer as
+	// aborted.
+	data.Close()
+	if code, _, err := c.text.ReadResponse(0); err != nil {
+		return 0, err
+	} else if code/100 != 2 && code/100 != 4 {
+		return 0, &textproto.Error{Code: code, Msg: "transfer failed"}
+	}
+
+	return n, nil
+}
+
+// Return the errno that best describes an error from a connection, keeping
+// that of errors that have one.
+func errno(err error) error {
+	var protoErr *textproto.Error
+	var netErr net.Error
+	var errno syscall.Errno
+
+	switch {
+	case err == nil:
+		return nil
+
+	case errors.As(err, &protoErr):
+		// 550 Requested action not taken. File unavailable.
+		if protoErr.Code == 550 {
+			return syscall.ENOENT
+		}
+
+		return syscall.EIO
+
+	case errors.As(err, &errno):
+		return errno
+
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return syscall.ETIMEDOUT
+
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return syscall.ECONNRESET
+	}
+
+	return syscall.EIO
+}
+
+// A pool of idle connections, through which commands are retried on fresh
+// connections when theirs breaks.
+type pool struct {
+	cfg *Config
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	idle []*conn
+}
+
+// LOCKS_EXCLUDED(p.mu)
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+
+	return dial(ctx, p.cfg)
+}
+
+// LOCKS_EXCLUDED(p.mu)
+func (p *pool) put(c *conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.idle = append(p.idle, c)
+}
+
+// Run f with a connection, retrying up to cfg.Retries times with exponential
+// backoff while connections break. Errors replied by the server aren't
+// retried. The error returned is an errno, as described by errno.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *pool) do(ctx context.Context, f func(c *conn) error) error {
+	backoff := 50 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		c, err := p.get(ctx)
+		if err == nil {
+			err = f(c)
+
+			var protoErr *textproto.Error
+			if err == nil || errors.As(err, &protoErr) {
+				p.put(c)
+				return errno(err)
+			}
+
+			c.close()
+		}
+
+		if attempt >= p.cfg.Retries {
+			return errno(err)
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+	}
+}
+
+// Check that the server can be reached, without retrying.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *pool) probe(ctx context.Context) error {
+	c, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.cmd(2, "NOOP"); err != nil {
+		c.close()
+		return err
+	}
+
+	p.put(c)
+	return nil
+}
+
+// LOCKS_EXCLUDED(p.mu)
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, c := range p.idle {
+		c.cmd(0, "QUIT")
+		c.close()
+	}
+
+	p.idle = nil
+}
@@ -0,0 +1,405 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ftpfs contains a read-only file system serving a directory of an
+// FTP or FTPS server. It composes the wrappers of fuseutil that suit a slow,
+// unreliable backend: the commands of each op are retried on a fresh
+// connection when theirs breaks, directory listings are cached by the kernel
+// for longer the longer they go without changing
+// (fuseutil.NewAdaptiveTTLFileSystem), and the file system keeps answering
+// from the listings it has while the server can't be reached
+// (fuseutil.NewOfflineAwareFileSystem).
+package ftpfs
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// Options for NewFileSystem.
+type Config struct {
+	// The server's address, as host:port.
+	Addr string
+
+	// Default to anonymous login.
+	User     string
+	Password string
+
+	// If non-nil, secure the control and data connections with explicit TLS.
+	// Servers commonly require data connections to resume the control
+	// connection's TLS session, which takes a ClientSessionCache.
+	TLS *tls.Config
+
+	// The directory on the server to serve. Defaults to "/".
+	Root string
+
+	// How many times the commands of an op are retried when the connection
+	// breaks. Defaults to three.
+	Retries int
+
+	// How long to wait for the server to reply. Defaults to ten seconds.
+	Timeout time.Duration
+
+	// How often to check whether the server can be reached again while it
+	// can't. Defaults to five seconds.
+	ProbeInterval time.Duration
+}
+
+// Create a read-only file system serving the directory cfg.Root of the
+// server. Files are read with a restarted transfer per ReadFileOp, so the
+// kernel's read ahead and page cache make all the difference.
+func NewFileSystem(cfg Config) fuseutil.FileSystem {
+	if cfg.User == "" {
+		cfg.User = "anonymous"
+		cfg.Password = "anonymous@"
+	}
+
+	if cfg.Root == "" {
+		cfg.Root = "/"
+	}
+
+	if cfg.Retries == 0 {
+		cfg.Retries = 3
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	fs := &ftpFS{
+		pool:     &pool{cfg: &cfg},
+		uid:      uint32(os.Getuid()),
+		gid:      uint32(os.Getgid()),
+		nextID:   fuseops.RootInodeID + 1,
+		listings: make(map[string][]entry),
+		inodes: map[fuseops.InodeID]*inode{
+			fuseops.RootInodeID: {path: cfg.Root, entry: entry{dir: true}},
+		},
+		ids: map[string]fuseops.InodeID{
+			cfg.Root: fuseops.RootInodeID,
+		},
+	}
+
+	fs.ttl = fuseutil.NewAdaptiveTTLFileSystem(fs, fuseutil.AdaptiveTTLConfig{})
+	return fuseutil.NewOfflineAwareFileSystem(fs.ttl, fuseutil.OfflineConfig{
+		Probe:         fs.pool.probe,
+		ProbeInterval: cfg.ProbeInterval,
+		OnStateChange: fs.setState,
+	})
+}
+
+// Create a server for the file system created by NewFileSystem.
+func NewServer(cfg Config) fuse.Server {
+	return fuseutil.NewFileSystemServer(NewFileSystem(cfg))
+}
+
+type inode struct {
+	path  string
+	entry entry
+}
+
+type ftpFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	pool *pool
+	ttl  *fuseutil.AdaptiveTTLFileSystem
+	uid  uint32
+	gid  uint32
+
+	mu sync.Mutex
+
+	// Whether the server can't be reached, according to the offline wrapper.
+	//
+	// GUARDED_BY(mu)
+	offline bool
+
+	// The inodes handed out so far, never forgotten, and their IDs by path.
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*inode
+	ids    map[string]fuseops.InodeID
+	nextID fuseops.InodeID
+
+	// The last listing of each directory, by path.
+	//
+	// GUARDED_BY(mu)
+	listings map[string][]entry
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *ftpFS) setState(state fuseutil.BackendState) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.offline = state == fuseutil.BackendOffline
+}
+
+// Return a copy of the inode with the supplied ID.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *ftpFS) lookUp(id fuseops.InodeID) (inode, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.inodes[id]
+	if in == nil {
+		return inode{}, fuse.ENOENT
+	}
+
+	return *in, nil
+}
+
+// Return the ID of the inode for the entry of the directory, updating its
+// attributes.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *ftpFS) idFor(dir string, e entry) fuseops.InodeID {
+	p := path.Join(dir, e.name)
+	id, ok := fs.ids[p]
+	if !ok {
+		id = fs.nextID
+		fs.nextID++
+		fs.ids[p] = id
+		fs.inodes[id] = &inode{path: p}
+	}
+
+	fs.inodes[id].entry = e
+	return id
+}
+
+// List the directory, from the last listing while offline. Tell the kernel's
+// caches about changes since the last listing.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *ftpFS) list(
+	ctx context.Context,
+	id fuseops.InodeID,
+	dir string) ([]entry, error) {
+	fs.mu.Lock()
+	cached, ok := fs.listings[dir]
+	offline := fs.offline
+	fs.mu.Unlock()
+
+	if offline {
+		if !ok {
+			return nil, syscall.ENETUNREACH
+		}
+
+		return cached, nil
+	}
+
+	var entries []entry
+	err := fs.pool.do(ctx, func(c *conn) (err error) {
+		entries, err = c.list(dir)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	fs.listings[dir] = entries
+	fs.mu.Unlock()
+
+	if ok && !reflect.DeepEqual(cached, entries) {
+		fs.ttl.Invalidated(id)
+	}
+
+	return entries, nil
+}
+
+func (fs *ftpFS) attributes(e entry) fuseops.InodeAttributes {
+	attrs := fuseops.InodeAttributes{
+		Size:  e.size,
+		Nlink: 1,
+		Mode:  0444,
+		Atime: e.mtime,
+		Mtime: e.mtime,
+		Ctime: e.mtime,
+		Uid:   fs.uid,
+		Gid:   fs.gid,
+	}
+
+	if e.dir {
+		attrs.Size = 0
+		attrs.Mode = os.ModeDir | 0555
+	}
+
+	return attrs
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *ftpFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *ftpFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent, err := fs.lookUp(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	entries, err := fs.list(ctx, op.Parent, parent.path)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.name == op.Name {
+			fs.mu.Lock()
+			op.Entry.Child = fs.idFor(parent.path, e)
+			fs.mu.Unlock()
+
+			op.Entry.Attributes = fs.attributes(e)
+			return nil
+		}
+	}
+
+	return fuse.ENOENT
+}
+
+func (fs *ftpFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	in, err := fs.lookUp(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes = fs.attributes(in.entry)
+	return nil
+}
+
+func (fs *ftpFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *ftpFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	dir, err := fs.lookUp(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	entries, err := fs.list(ctx, op.Inode, dir.path)
+	if err != nil {
+		return err
+	}
+
+	if op.Offset > fuseops.DirOffset(len(entries)) {
+		return fuse.EINVAL
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for i := int(op.Offset); i < len(entries); i++ {
+		e := entries[i]
+		d := fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  fs.idFor(dir.path, e),
+			Name:   e.name,
+			Type:   fuseutil.DT_File,
+		}
+
+		if e.dir {
+			d.Type = fuseutil.DT_Directory
+		}
+
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], d)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *ftpFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+func (fs *ftpFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.KeepPageCache = true
+	return nil
+}
+
+func (fs *ftpFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	in, err := fs.lookUp(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	offline := fs.offline
+	fs.mu.Unlock()
+
+	if offline {
+		return syscall.ENETUNREACH
+	}
+
+	if op.Offset >= int64(in.entry.size) {
+		return nil
+	}
+
+	return fs.pool.do(ctx, func(c *conn) (err error) {
+		op.BytesRead, err = c.retrieve(in.path, op.Offset, op.Dst)
+		return err
+	})
+}
+
+func (fs *ftpFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+func (fs *ftpFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func (fs *ftpFS) Destroy() {
+	fs.pool.close()
+}
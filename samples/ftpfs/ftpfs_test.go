@@ -0,0 +1,284 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ftpfs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// An FTP server serving files from memory, which can be told to drop
+// connections.
+type fakeServer struct {
+	l     net.Listener
+	files map[string]string
+
+	mu sync.Mutex
+
+	// Drop the control connection instead of replying to every n-th command
+	// after logging in, or to all commands while down.
+	//
+	// GUARDED_BY(mu)
+	dropEvery int
+	commands  int
+	down      bool
+}
+
+func newFakeServer(t *testing.T, files map[string]string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	s := &fakeServer{l: l, files: files}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(c)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeServer) set(dropEvery int, down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dropEvery = dropEvery
+	s.down = down
+}
+
+func (s *fakeServer) shouldDrop(cmd string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.down {
+		return true
+	}
+
+	switch cmd {
+	case "USER", "PASS", "TYPE":
+		return false
+	}
+
+	s.commands++
+	return s.dropEvery != 0 && s.commands%s.dropEvery == 0
+}
+
+// Return the MLSD lines for the children of the directory.
+func (s *fakeServer) list(dir string) []string {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	children := make(map[string]bool)
+	for p := range s.files {
+		if rest := strings.TrimPrefix(p, prefix); rest != p {
+			name, _, isDir := strings.Cut(rest, "/")
+			children[name] = children[name] || isDir
+		}
+	}
+
+	var names []string
+	for name := range children {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		if children[name] {
+			lines = append(lines, "type=dir; "+name)
+		} else {
+			contents := s.files[prefix+name]
+			lines = append(lines, fmt.Sprintf("type=file;size=%d;modify=20150301120000; %s", len(contents), name))
+		}
+	}
+
+	return lines
+}
+
+func (s *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+
+	text := textproto.NewConn(c)
+	text.PrintfLine("220 Fake FTP server")
+
+	var data net.Listener
+	var rest int
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd, arg, _ := strings.Cut(line, " ")
+		if s.shouldDrop(cmd) {
+			return
+		}
+
+		switch cmd {
+		case "USER":
+			text.PrintfLine("331 Password required")
+
+		case "PASS":
+			text.PrintfLine("230 Logged in")
+
+		case "TYPE", "NOOP":
+			text.PrintfLine("200 OK")
+
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+
+		case "EPSV":
+			data, _ = net.Listen("tcp", "127.0.0.1:0")
+			defer data.Close()
+
+			port := data.Addr().(*net.TCPAddr).Port
+			text.PrintfLine("229 Entering Extended Passive Mode (|||%d|)", port)
+
+		case "REST":
+			rest, _ = strconv.Atoi(arg)
+			text.PrintfLine("350 Restarting")
+
+		case "MLSD", "RETR":
+			contents, ok := s.files[arg]
+			if cmd == "MLSD" {
+				contents = strings.Join(append(s.list(arg), ""), "\r\n")
+			} else if !ok {
+				text.PrintfLine("550 No such file")
+				continue
+			} else {
+				contents = contents[rest:]
+			}
+
+			text.PrintfLine("150 Opening data connection")
+			if dc, err := data.Accept(); err == nil {
+				dc.Write([]byte(contents))
+				dc.Close()
+			}
+
+			text.PrintfLine("226 Transfer complete")
+
+		default:
+			text.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func TestFlakyServer(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeServer(t, map[string]string{
+		"/dir/a":     "taco",
+		"/dir/sub/b": "burrito",
+	})
+
+	fs := NewFileSystem(Config{
+		Addr:          s.l.Addr().String(),
+		ProbeInterval: 10 * time.Millisecond,
+	})
+	defer fs.Destroy()
+
+	lookUp := func(parent fuseops.InodeID, name string) fuseops.InodeID {
+		t.Helper()
+		op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+		if err := fs.LookUpInode(ctx, op); err != nil {
+			t.Fatalf("LookUpInode(%q): %v", name, err)
+		}
+
+		return op.Entry.Child
+	}
+
+	readDir := func(dir fuseops.InodeID) (names []string, err error) {
+		op := &fuseops.ReadDirOp{Inode: dir, Dst: make([]byte, 4096)}
+		if err := fs.ReadDir(ctx, op); err != nil {
+			return nil, err
+		}
+
+		for b := op.Dst[:op.BytesRead]; len(b) > 0; {
+			d, n := fuseutil.ReadDirent(b)
+			names = append(names, d.Name)
+			b = b[n:]
+		}
+
+		return names, nil
+	}
+
+	readFile := func(inode fuseops.InodeID) (string, error) {
+		op := &fuseops.ReadFileOp{Inode: inode, Dst: make([]byte, 4096)}
+		err := fs.ReadFile(ctx, op)
+		return string(op.Dst[:op.BytesRead]), err
+	}
+
+	// Ops succeed while connections keep breaking.
+	s.set(4, false)
+	dir := lookUp(fuseops.RootInodeID, "dir")
+	a := lookUp(dir, "a")
+
+	for i := 0; i < 5; i++ {
+		if got, err := readFile(a); err != nil || got != "taco" {
+			t.Fatalf("ReadFile: %q, %v", got, err)
+		}
+	}
+
+	if names, err := readDir(dir); err != nil || strings.Join(names, ",") != "a,sub" {
+		t.Fatalf("ReadDir: %q, %v", names, err)
+	}
+
+	// Once the server is down, listings are served from cache, but contents
+	// can't be read.
+	s.set(0, true)
+	if _, err := readDir(dir); err != syscall.ECONNRESET {
+		t.Fatalf("ReadDir with the server down: %v", err)
+	}
+
+	if names, err := readDir(dir); err != nil || strings.Join(names, ",") != "a,sub" {
+		t.Errorf("ReadDir while offline: %q, %v", names, err)
+	}
+
+	if _, err := readFile(a); err != syscall.ENETUNREACH {
+		t.Errorf("ReadFile while offline: %v", err)
+	}
+
+	// Once it is back, contents can be read again.
+	s.set(0, false)
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if got, err := readFile(a); err == nil && got == "taco" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("ReadFile failing after the server came back")
+		}
+	}
+}
@@ -52,7 +52,8 @@ type SampleTest struct {
 	// fail if closing fails.
 	ToClose []io.Closer
 
-	mfs *fuse.MountedFileSystem
+	// The mounted file system, e.g. for sending it invalidations.
+	MFS *fuse.MountedFileSystem
 }
 
 // Mount t.Server and initialize the other exported fields of the struct.
@@ -96,7 +97,7 @@ func (t *SampleTest) initialize(
 	}
 
 	// Mount the file system.
-	t.mfs, err = fuse.Mount(t.Dir, server, config)
+	t.MFS, err = fuse.Mount(t.Dir, server, config)
 	if err != nil {
 		return fmt.Errorf("Mount: %v", err)
 	}
@@ -124,7 +125,7 @@ func (t *SampleTest) destroy() (err error) {
 	}
 
 	// Was the file system mounted?
-	if t.mfs == nil {
+	if t.MFS == nil {
 		return nil
 	}
 
@@ -139,7 +140,7 @@ func (t *SampleTest) destroy() (err error) {
 	}
 
 	// Join the file system.
-	if err := t.mfs.Join(t.Ctx); err != nil {
+	if err := t.MFS.Join(t.Ctx); err != nil {
 		return fmt.Errorf("mfs.Join: %v", err)
 	}
 
@@ -18,9 +18,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"syscall"
 	"time"
 
-	"github.com/folays/jacobsa_fuse"
 	"github.com/folays/jacobsa_fuse/fuseops"
 	"github.com/folays/jacobsa_fuse/fuseutil"
 )
@@ -147,6 +147,15 @@ func (in *inode) CheckInvariants() {
 	return
 }
 
+// Store the security contexts of a new inode as extended attributes.
+func (in *inode) setSecurityContext(ctxs []fuseops.SecurityContext) {
+	for _, c := range ctxs {
+		value := make([]byte, len(c.Value))
+		copy(value, c.Value)
+		in.xattrs[c.Name] = value
+	}
+}
+
 func (in *inode) isDir() bool {
 	return in.attrs.Mode&os.ModeDir != 0
 }
@@ -387,9 +396,30 @@ func (in *inode) SetAttributes(
 }
 
 func (in *inode) Fallocate(mode uint32, offset uint64, length uint64) error {
-	if mode != 0 {
-		return fuse.ENOSYS
+	switch mode {
+	case 0, fuseops.FallocateKeepSize:
+
+	case fuseops.FallocatePunchHole | fuseops.FallocateKeepSize:
+		// Zero whatever part of the range lies within the file.
+		end := offset + length
+		if end > uint64(len(in.contents)) {
+			end = uint64(len(in.contents))
+		}
+
+		for i := offset; i < end; i++ {
+			in.contents[i] = 0
+		}
+
+		return nil
+
+	default:
+		return syscall.EOPNOTSUPP
 	}
+
+	if mode&fuseops.FallocateKeepSize != 0 {
+		return nil
+	}
+
 	newSize := int(offset + length)
 	if newSize > len(in.contents) {
 		padding := make([]byte, newSize-len(in.contents))
@@ -27,7 +27,6 @@ import (
 	"github.com/folays/jacobsa_fuse/fuseops"
 	"github.com/folays/jacobsa_fuse/fuseutil"
 	"github.com/jacobsa/syncutil"
-	"golang.org/x/sys/unix"
 )
 
 const (
@@ -77,6 +76,13 @@ type memFS struct {
 func NewMemFS(
 	uid uint32,
 	gid uint32) fuse.Server {
+	return fuseutil.NewFileSystemServer(NewMemFileSystem(uid, gid))
+}
+
+// Like NewMemFS, but return the file system itself, e.g. for wrapping it.
+func NewMemFileSystem(
+	uid uint32,
+	gid uint32) fuseutil.FileSystem {
 	// Set up the basic struct.
 	fs := &memFS{
 		inodes: make([]*inode, fuseops.RootInodeID+1),
@@ -96,7 +102,7 @@ func NewMemFS(
 	// Set up invariant checking.
 	fs.mu = syncutil.NewInvariantMutex(fs.checkInvariants)
 
-	return fuseutil.NewFileSystemServer(fs)
+	return fs
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -301,6 +307,7 @@ func (fs *memFS) MkDir(
 
 	// Allocate a child.
 	childID, child := fs.allocateInode(childAttrs, op.Name)
+	child.setSecurityContext(op.SecurityContext)
 
 	// Add an entry in the parent.
 	parent.AddChild(childID, op.Name, fuseutil.DT_Directory)
@@ -325,7 +332,16 @@ func (fs *memFS) MkNode(
 
 	var err error
 	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
-	return err
+	if err != nil {
+		return err
+	}
+
+	child := fs.getInodeOrDie(op.Entry.Child)
+	child.attrs.Rdev = op.Rdev
+	child.setSecurityContext(op.SecurityContext)
+	op.Entry.Attributes = child.attrs
+
+	return nil
 }
 
 // LOCKS_REQUIRED(fs.mu)
@@ -359,8 +375,9 @@ func (fs *memFS) createFile(
 	// Allocate a child.
 	childID, child := fs.allocateInode(childAttrs, name)
 
-	// Add an entry in the parent.
-	parent.AddChild(childID, name, fuseutil.DT_File)
+	// Add an entry in the parent. MkNode may create FIFOs, sockets and device
+	// nodes as well as regular files.
+	parent.AddChild(childID, name, fuseutil.DirentTypeForMode(mode))
 
 	// Fill in the response entry.
 	var entry fuseops.ChildInodeEntry
@@ -382,7 +399,12 @@ func (fs *memFS) CreateFile(
 	defer fs.mu.Unlock()
 
 	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
-	return err
+	if err != nil {
+		return err
+	}
+
+	fs.getInodeOrDie(op.Entry.Child).setSecurityContext(op.SecurityContext)
+	return nil
 }
 
 func (fs *memFS) CreateSymlink(
@@ -419,6 +441,7 @@ func (fs *memFS) CreateSymlink(
 
 	// Set up its target.
 	child.target = op.Target
+	child.setSecurityContext(op.SecurityContext)
 
 	// Add an entry in the parent.
 	parent.AddChild(childID, op.Name, fuseutil.DT_Link)
@@ -480,6 +503,10 @@ func (fs *memFS) Rename(
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
+	if op.Flags&^(fuseops.RenameNoReplace|fuseops.RenameExchange) != 0 {
+		return fuse.EINVAL
+	}
+
 	// Ask the old parent for the child's inode ID and type.
 	oldParent := fs.getInodeOrDie(op.OldParent)
 	childID, childType, ok := oldParent.LookUpChild(op.OldName)
@@ -488,10 +515,28 @@ func (fs *memFS) Rename(
 		return fuse.ENOENT
 	}
 
+	newParent := fs.getInodeOrDie(op.NewParent)
+	existingID, existingType, ok := newParent.LookUpChild(op.NewName)
+
+	switch {
+	case ok && op.Flags&fuseops.RenameNoReplace != 0:
+		return fuse.EEXIST
+
+	case op.Flags&fuseops.RenameExchange != 0:
+		if !ok {
+			return fuse.ENOENT
+		}
+
+		// Swap the two entries.
+		oldParent.RemoveChild(op.OldName)
+		newParent.RemoveChild(op.NewName)
+		oldParent.AddChild(existingID, op.OldName, existingType)
+		newParent.AddChild(childID, op.NewName, childType)
+		return nil
+	}
+
 	// If the new name exists already in the new parent, make sure it's not a
 	// non-empty directory, then delete it.
-	newParent := fs.getInodeOrDie(op.NewParent)
-	existingID, _, ok := newParent.LookUpChild(op.NewName)
 	if ok {
 		existing := fs.getInodeOrDie(existingID)
 
@@ -768,11 +813,11 @@ func (fs *memFS) setXattrHelper(inode *inode, op *fuseops.SetXattrOp) error {
 	_, ok := inode.xattrs[op.Name]
 
 	switch op.Flags {
-	case unix.XATTR_CREATE:
+	case xattrCreate:
 		if ok {
 			return fuse.EEXIST
 		}
-	case unix.XATTR_REPLACE:
+	case xattrReplace:
 		if !ok {
 			return fuse.ENOATTR
 		}
@@ -792,3 +837,25 @@ func (fs *memFS) Fallocate(ctx context.Context,
 	inode.Fallocate(op.Mode, op.Offset, op.Length)
 	return nil
 }
+
+func (fs *memFS) GetInodeFlags(ctx context.Context,
+	op *fuseops.GetInodeFlagsOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	inode := fs.getInodeOrDie(op.Inode)
+	op.Flags = inode.attrs.Flags
+	return nil
+}
+
+func (fs *memFS) SetInodeFlags(ctx context.Context,
+	op *fuseops.SetInodeFlagsOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	inode := fs.getInodeOrDie(op.Inode)
+	if op.Flags&^(fuseops.InodeImmutable|fuseops.InodeAppendOnly) != 0 {
+		return syscall.EOPNOTSUPP
+	}
+
+	inode.attrs.Flags = op.Flags
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/sys/unix"
+)
+
+func (t *MemFSTest) ImmutableFlag() {
+	// Setting the flag requires CAP_LINUX_IMMUTABLE.
+	if os.Getuid() != 0 {
+		return
+	}
+
+	var err error
+
+	// Create a file
+	filePath := path.Join(t.Dir, "foo")
+	err = ioutil.WriteFile(filePath, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.Open(filePath)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	// Make it immutable, as chattr +i does.
+	err = unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(fuseops.InodeImmutable))
+	AssertEq(nil, err)
+
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	AssertEq(nil, err)
+	ExpectEq(uint32(fuseops.InodeImmutable), flags)
+
+	// It can no longer be modified or removed.
+	err = ioutil.WriteFile(filePath, []byte("burrito"), 0600)
+	ExpectThat(err, Error(HasSubstr("operation not permitted")))
+
+	err = os.Chmod(filePath, 0644)
+	ExpectThat(err, Error(HasSubstr("operation not permitted")))
+
+	err = os.Remove(filePath)
+	ExpectThat(err, Error(HasSubstr("operation not permitted")))
+
+	// Until the flag is cleared.
+	err = unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, 0)
+	AssertEq(nil, err)
+
+	err = os.Remove(filePath)
+	ExpectEq(nil, err)
+}
+
+func (t *MemFSTest) ExecuteBinary() {
+	// Copy a binary onto the file system.
+	src, err := exec.LookPath("true")
+	if err != nil {
+		return
+	}
+
+	contents, err := ioutil.ReadFile(src)
+	AssertEq(nil, err)
+
+	binPath := path.Join(t.Dir, "true")
+	err = ioutil.WriteFile(binPath, contents, 0755)
+	AssertEq(nil, err)
+
+	// The mount allows executing it, and so does the kernel, which maps it
+	// with PROT_EXEC.
+	noexec, err := t.MFS.NoExec()
+	AssertEq(nil, err)
+	ExpectFalse(noexec)
+
+	err = exec.Command(binPath).Run()
+	ExpectEq(nil, err)
+
+	// Without the permission to, it can't be executed.
+	err = os.Chmod(binPath, 0644)
+	AssertEq(nil, err)
+
+	err = exec.Command(binPath).Run()
+	ExpectThat(err, Error(HasSubstr("permission denied")))
+}
@@ -1807,6 +1807,11 @@ func (t *MemFSTest) RenameNonExistentFile() {
 }
 
 func (t *MemFSTest) NoXattrs() {
+	// FreeBSD only supports names within the user and system namespaces.
+	if runtime.GOOS == "freebsd" {
+		return
+	}
+
 	var err error
 	var sz int
 	var smallBuf [1]byte
@@ -1836,6 +1841,11 @@ func (t *MemFSTest) NoXattrs() {
 }
 
 func (t *MemFSTest) SetXAttr() {
+	// FreeBSD only supports names within the user and system namespaces.
+	if runtime.GOOS == "freebsd" {
+		return
+	}
+
 	var err error
 	var sz int
 	var buf [1024]byte
@@ -1845,10 +1855,10 @@ func (t *MemFSTest) SetXAttr() {
 	err = ioutil.WriteFile(filePath, []byte("taco"), 0600)
 	AssertEq(nil, err)
 
-	err = unix.Setxattr(filePath, "foo", []byte("bar"), unix.XATTR_REPLACE)
+	err = unix.Setxattr(filePath, "foo", []byte("bar"), xattrReplace)
 	AssertEq(fuse.ENOATTR, err)
 
-	err = unix.Setxattr(filePath, "foo", []byte("bar"), unix.XATTR_CREATE)
+	err = unix.Setxattr(filePath, "foo", []byte("bar"), xattrCreate)
 	AssertEq(nil, err)
 
 	// List xattr with a buf that is too small.
@@ -1883,6 +1893,11 @@ func (t *MemFSTest) SetXAttr() {
 }
 
 func (t *MemFSTest) RemoveXAttr() {
+	// FreeBSD only supports names within the user and system namespaces.
+	if runtime.GOOS == "freebsd" {
+		return
+	}
+
 	var err error
 
 	// Create a file
@@ -1893,7 +1908,7 @@ func (t *MemFSTest) RemoveXAttr() {
 	err = unix.Removexattr(filePath, "foo")
 	AssertEq(fuse.ENOATTR, err)
 
-	err = unix.Setxattr(filePath, "foo", []byte("bar"), unix.XATTR_CREATE)
+	err = unix.Setxattr(filePath, "foo", []byte("bar"), xattrCreate)
 	AssertEq(nil, err)
 
 	err = unix.Removexattr(filePath, "foo")
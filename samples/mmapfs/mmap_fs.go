@@ -0,0 +1,256 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mmapfs
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// The inode ID of the file named "foo".
+const FooID = fuseops.RootInodeID + 1
+
+// A file system whose sole contents are a file named "foo", initially empty,
+// written the way fuse.MountConfig.EnableSharedWritableMmap requires:
+//
+//   - Its contents belong to the inode, and WriteFileOps are accepted through
+//     any handle open for writing.
+//
+//   - SyncFileOp makes all of them durable.
+//
+// Each open asks for direct IO, which the mode must override for the file to
+// be mapped.
+type MmapFS interface {
+	fuseutil.FileSystem
+
+	// Return the contents of the file as of the last SyncFileOp.
+	DurableContents() []byte
+
+	// Overwrite the start of the file's contents as another client of the
+	// backing store would, without telling the kernel. The size of the file
+	// doesn't change.
+	WriteExternally(p []byte)
+}
+
+func NewMmapFS() MmapFS {
+	return &mmapFS{
+		handles: fuseutil.NewHandleTable(),
+	}
+}
+
+type mmapFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu sync.Mutex
+
+	// The current and durable contents of the file.
+	//
+	// GUARDED_BY(mu)
+	contents []byte
+	durable  []byte
+
+	// The open handles, associated with whether they are open for writing.
+	handles *fuseutil.HandleTable
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *mmapFS) getAttributes(id fuseops.InodeID) (fuseops.InodeAttributes, error) {
+	switch id {
+	case fuseops.RootInodeID:
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0777 | os.ModeDir,
+		}, nil
+
+	case FooID:
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0666,
+			Size:  uint64(len(fs.contents)),
+		}, nil
+
+	default:
+		return fuseops.InodeAttributes{}, fuse.ENOENT
+	}
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *mmapFS) resize(size int) {
+	if size <= len(fs.contents) {
+		fs.contents = fs.contents[:size]
+		return
+	}
+
+	fs.contents = append(fs.contents, make([]byte, size-len(fs.contents))...)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *mmapFS) DurableContents() []byte {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return append([]byte(nil), fs.durable...)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *mmapFS) WriteExternally(p []byte) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	copy(fs.contents, p)
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *mmapFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *mmapFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = FooID
+	op.Entry.Attributes, _ = fs.getAttributes(FooID)
+
+	return nil
+}
+
+func (fs *mmapFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var err error
+	op.Attributes, err = fs.getAttributes(op.Inode)
+	return err
+}
+
+func (fs *mmapFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Size != nil && op.Inode == FooID {
+		fs.resize(int(*op.Size))
+	}
+
+	var err error
+	op.Attributes, err = fs.getAttributes(op.Inode)
+	return err
+}
+
+func (fs *mmapFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Inode != FooID {
+		return fuse.ENOSYS
+	}
+
+	op.Handle = fs.handles.Allocate(op.Inode, !op.OpenFlags.IsReadOnly())
+	op.UseDirectIO = true
+
+	return nil
+}
+
+func (fs *mmapFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Offset < int64(len(fs.contents)) {
+		op.BytesRead = copy(op.Dst, fs.contents[op.Offset:])
+	}
+
+	return nil
+}
+
+func (fs *mmapFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Write back from the page cache may come through any writable handle.
+	v, _ := fs.handles.Lookup(op.Handle)
+	if writable, _ := v.(bool); !writable {
+		return fuse.EINVAL
+	}
+
+	if end := int(op.Offset) + len(op.Data); end > len(fs.contents) {
+		fs.resize(end)
+	}
+
+	copy(fs.contents[op.Offset:], op.Data)
+
+	return nil
+}
+
+func (fs *mmapFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.durable = append(fs.durable[:0], fs.contents...)
+
+	return nil
+}
+
+func (fs *mmapFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func (fs *mmapFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.handles.Release(op.Handle)
+
+	return nil
+}
+
+func (fs *mmapFS) Destroy() {
+	if err := fs.handles.Check(); err != nil {
+		log.Printf("mmapfs: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mmapfs_test
+
+import (
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/samples"
+	"github.com/folays/jacobsa_fuse/samples/mmapfs"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestMmapFS(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const fileSize = 8192
+
+type MmapFSTest struct {
+	samples.SampleTest
+	fs mmapfs.MmapFS
+
+	// The file, open for reading and writing and sized to fileSize, and a
+	// shared writable mapping of it. Both are released in TearDown.
+	f    *os.File
+	data []byte
+}
+
+func init() { RegisterTestSuite(&MmapFSTest{}) }
+
+func (t *MmapFSTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.MountConfig.EnableSharedWritableMmap = true
+	t.fs = mmapfs.NewMmapFS()
+	t.Server = fuseutil.NewFileSystemServer(t.fs)
+	t.SampleTest.SetUp(ti)
+
+	t.f, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	err = t.f.Truncate(fileSize)
+	AssertEq(nil, err)
+
+	t.data = t.mmap(t.f)
+}
+
+func (t *MmapFSTest) TearDown() {
+	if t.data != nil {
+		ExpectEq(nil, syscall.Munmap(t.data))
+	}
+
+	if t.f != nil {
+		ExpectEq(nil, t.f.Close())
+	}
+
+	t.SampleTest.TearDown()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func (t *MmapFSTest) mmap(f *os.File) []byte {
+	data, err := syscall.Mmap(
+		int(f.Fd()), 0, fileSize,
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_SHARED)
+
+	AssertEq(nil, err)
+	return data
+}
+
+// Call msync(2) with the MS_SYNC flag on a slice previously returned by
+// mmap(2).
+func msync(p []byte) error {
+	_, _, errno := unix.Syscall(
+		unix.SYS_MSYNC,
+		uintptr(unsafe.Pointer(&p[0])),
+		uintptr(len(p)),
+		unix.MS_SYNC)
+
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func (t *MmapFSTest) readAt(off int64, n int) string {
+	f, err := os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	defer f.Close()
+
+	buf := make([]byte, n)
+	_, err = f.ReadAt(buf, off)
+	AssertEq(nil, err)
+
+	return string(buf)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MmapFSTest) WriteSyscall_VisibleThroughMapping() {
+	_, err := t.f.WriteAt([]byte("taco"), 4096)
+	AssertEq(nil, err)
+
+	ExpectEq("taco", string(t.data[4096:4100]))
+}
+
+func (t *MmapFSTest) WriteThroughMapping_VisibleToRead() {
+	copy(t.data[10:], "burrito")
+
+	// Without any msync, through another handle.
+	ExpectEq("burrito", t.readAt(10, 7))
+}
+
+func (t *MmapFSTest) TwoMappings_Coherent() {
+	f, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	other := t.mmap(f)
+	defer syscall.Munmap(other)
+
+	copy(t.data[100:], "enchilada")
+	ExpectEq("enchilada", string(other[100:109]))
+
+	copy(other[5000:], "queso")
+	ExpectEq("queso", string(t.data[5000:5005]))
+}
+
+func (t *MmapFSTest) Msync_MakesDurable() {
+	copy(t.data[0:], "taco")
+	copy(t.data[fileSize-4:], "paco")
+
+	err := msync(t.data)
+	AssertEq(nil, err)
+
+	durable := t.fs.DurableContents()
+	AssertEq(fileSize, len(durable))
+	ExpectEq("taco", string(durable[0:4]))
+	ExpectEq("paco", string(durable[fileSize-4:]))
+}
+
+func (t *MmapFSTest) DirtyPagesOutliveClose() {
+	copy(t.data[200:], "taco")
+
+	// Close the mapped handle, then unmap. The dirty page is still written back
+	// by the time another handle is synced.
+	err := t.f.Close()
+	t.f = nil
+	AssertEq(nil, err)
+
+	err = syscall.Munmap(t.data)
+	t.data = nil
+	AssertEq(nil, err)
+
+	f, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	err = f.Sync()
+	AssertEq(nil, err)
+
+	ExpectEq("taco", string(t.fs.DurableContents()[200:204]))
+}
+
+func (t *MmapFSTest) ExternalChange_VisibleAfterInvalidation() {
+	// Fault the pages in.
+	ExpectEq(0, t.data[0])
+
+	t.fs.WriteExternally([]byte("burrito"))
+
+	err := t.MFS.InvalidateInode(mmapfs.FooID, 0, 0)
+	AssertEq(nil, err)
+
+	ExpectEq("burrito", string(t.data[0:7]))
+	ExpectEq("burrito", t.readAt(0, 7))
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/samples/ftpfs"
+)
+
+var fAddr = flag.String("addr", "", "FTP server address, as host:port.")
+var fUser = flag.String("user", "", "User name. Defaults to anonymous.")
+var fPassword = flag.String("password", "", "Password.")
+var fRoot = flag.String("root", "/", "Directory on the server to mount.")
+var fTLS = flag.Bool("tls", false, "Use explicit FTPS.")
+var fMountPoint = flag.String("mount_point", "", "Path to mount point.")
+
+var fDebug = flag.Bool("debug", false, "Enable debug logging.")
+
+func main() {
+	flag.Parse()
+
+	debugLogger := log.New(os.Stdout, "fuse: ", 0)
+	errorLogger := log.New(os.Stderr, "fuse: ", 0)
+
+	if *fAddr == "" {
+		log.Fatalf("You must set --addr.")
+	}
+
+	if *fMountPoint == "" {
+		log.Fatalf("You must set --mount_point.")
+	}
+
+	cfg := ftpfs.Config{
+		Addr:     *fAddr,
+		User:     *fUser,
+		Password: *fPassword,
+		Root:     *fRoot,
+	}
+
+	if *fTLS {
+		host, _, _ := net.SplitHostPort(*fAddr)
+		cfg.TLS = &tls.Config{
+			ServerName:         host,
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		}
+	}
+
+	mountCfg := &fuse.MountConfig{
+		FSName:      *fAddr,
+		Subtype:     "ftpfs",
+		ReadOnly:    true,
+		ErrorLogger: errorLogger,
+	}
+
+	if *fDebug {
+		mountCfg.DebugLogger = debugLogger
+	}
+
+	mfs, err := fuse.Mount(*fMountPoint, ftpfs.NewServer(cfg), mountCfg)
+	if err != nil {
+		log.Fatalf("Mount: %v", err)
+	}
+
+	// Wait for it to be unmounted.
+	if err = mfs.Join(context.Background()); err != nil {
+		log.Fatalf("Join: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A tool that mounts the root file system of a container image from an OCI
+// image layout, such as one created by:
+//
+//	skopeo copy docker://alpine oci:/tmp/alpine:latest
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/samples/ocifs"
+)
+
+var fLayout = flag.String("layout", "", "Path to the OCI image layout.")
+var fRef = flag.String("ref", "", "Name of the image in the layout, if it holds several.")
+var fMountPoint = flag.String("mount_point", "", "Path to mount point.")
+
+var fDebug = flag.Bool("debug", false, "Enable debug logging.")
+
+func main() {
+	flag.Parse()
+
+	debugLogger := log.New(os.Stdout, "fuse: ", 0)
+	errorLogger := log.New(os.Stderr, "fuse: ", 0)
+
+	if *fLayout == "" {
+		log.Fatalf("You must set --layout.")
+	}
+
+	if *fMountPoint == "" {
+		log.Fatalf("You must set --mount_point.")
+	}
+
+	layers, err := ocifs.ReadLayout(*fLayout, *fRef)
+	if err != nil {
+		log.Fatalf("ReadLayout: %v", err)
+	}
+
+	server, err := ocifs.NewServer(layers)
+	if err != nil {
+		log.Fatalf("NewServer: %v", err)
+	}
+
+	cfg := &fuse.MountConfig{
+		FSName:      *fLayout,
+		Subtype:     "ocifs",
+		ReadOnly:    true,
+		ErrorLogger: errorLogger,
+	}
+
+	if *fDebug {
+		cfg.DebugLogger = debugLogger
+	}
+
+	mfs, err := fuse.Mount(*fMountPoint, server, cfg)
+	if err != nil {
+		log.Fatalf("Mount: %v", err)
+	}
+
+	// Wait for it to be unmounted.
+	if err = mfs.Join(context.Background()); err != nil {
+		log.Fatalf("Join: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A tool that mounts a multi-user scratch file system with per-user quotas.
+// Other users can only use it if it is mounted by root, or if user_allow_other
+// is set in /etc/fuse.conf.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/samples/scratchfs"
+)
+
+var fMaxBytes = flag.Uint64("max_bytes", 1<<30, "Most bytes each user may store, or zero.")
+var fMaxInodes = flag.Uint64("max_inodes", 0, "Most inodes each user may create, or zero.")
+var fMountPoint = flag.String("mount_point", "", "Path to mount point.")
+
+var fDebug = flag.Bool("debug", false, "Enable debug logging.")
+
+func main() {
+	flag.Parse()
+
+	debugLogger := log.New(os.Stdout, "fuse: ", 0)
+	errorLogger := log.New(os.Stderr, "fuse: ", 0)
+
+	if *fMountPoint == "" {
+		log.Fatalf("You must set --mount_point.")
+	}
+
+	server := scratchfs.NewServer(
+		uint32(os.Getuid()),
+		uint32(os.Getgid()),
+		scratchfs.Config{
+			MaxBytes:  *fMaxBytes,
+			MaxInodes: *fMaxInodes,
+		})
+
+	cfg := &fuse.MountConfig{
+		FSName:                  "scratch",
+		Subtype:                 "scratchfs",
+		DisableWritebackCaching: true,
+		Options: map[string]string{
+			"allow_other": "",
+		},
+		ErrorLogger: errorLogger,
+	}
+
+	if *fDebug {
+		cfg.DebugLogger = debugLogger
+	}
+
+	mfs, err := fuse.Mount(*fMountPoint, server, cfg)
+	if err != nil {
+		log.Fatalf("Mount: %v", err)
+	}
+
+	// Wait for it to be unmounted.
+	if err = mfs.Join(context.Background()); err != nil {
+		log.Fatalf("Join: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// A layer of an image: a tar archive, possibly compressed with gzip, of the
+// files it adds, changes or removes.
+type Layer struct {
+	// The path of the layer's blob.
+	Path string
+
+	// Whether the blob is compressed with gzip.
+	Gzip bool
+}
+
+// The parts of OCI descriptors, indexes and manifests that matter here. See
+// https://github.com/opencontainers/image-spec.
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform"`
+}
+
+type imageIndex struct {
+	Manifests []descriptor `json:"manifests"`
+}
+
+type imageManifest struct {
+	Layers []descriptor `json:"layers"`
+}
+
+// The annotation naming an image in the index of a layout, as set by e.g.
+// skopeo copy docker://busybox oci:dir:busybox.
+const refAnnotation = "org.opencontainers.image.ref.name"
+
+// Return the layers of the image called ref in the OCI image layout at dir,
+// bottom first, or of the layout's only image if ref is empty. For an image
+// built for several platforms, these are the layers for the running OS and
+// architecture.
+//
+// Blobs aren't checked against their digests.
+func ReadLayout(dir string, ref string) ([]Layer, error) {
+	var index imageIndex
+	if err := readJSON(filepath.Join(dir, "index.json"), &index); err != nil {
+		return nil, err
+	}
+
+	var desc *descriptor
+	for i, d := range index.Manifests {
+		if ref == "" || d.Annotations[refAnnotation] == ref {
+			if desc != nil {
+				return nil, fmt.Errorf("%s holds several images; choose one by name", dir)
+			}
+
+			desc = &index.Manifests[i]
+		}
+	}
+
+	if desc == nil {
+		return nil, fmt.Errorf("%s holds no image called %q", dir, ref)
+	}
+
+	for {
+		p, err := blobPath(dir, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		switch desc.MediaType {
+		case "application/vnd.oci.image.index.v1+json",
+			"application/vnd.docker.distribution.manifest.list.v2+json":
+			var nested imageIndex
+			if err := readJSON(p, &nested); err != nil {
+				return nil, err
+			}
+
+			if desc = forPlatform(nested.Manifests); desc == nil {
+				return nil, fmt.Errorf("no image for %s/%s", runtime.GOOS, runtime.GOARCH)
+			}
+
+		case "application/vnd.oci.image.manifest.v1+json",
+			"application/vnd.docker.distribution.manifest.v2+json":
+			var manifest imageManifest
+			if err := readJSON(p, &manifest); err != nil {
+				return nil, err
+			}
+
+			return layers(dir, manifest.Layers)
+
+		default:
+			return nil, fmt.Errorf("unsupported manifest type %q", desc.MediaType)
+		}
+	}
+}
+
+// Return the descriptor of the image for the running platform, if any.
+func forPlatform(manifests []descriptor) *descriptor {
+	for i, d := range manifests {
+		if d.Platform == nil ||
+			d.Platform.OS == runtime.GOOS && d.Platform.Architecture == runtime.GOARCH {
+			return &manifests[i]
+		}
+	}
+
+	return nil
+}
+
+func layers(dir string, descs []descriptor) ([]Layer, error) {
+	var layers []Layer
+	for _, d := range descs {
+		p, err := blobPath(dir, d.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case strings.HasSuffix(d.MediaType, ".tar"):
+			layers = append(layers, Layer{Path: p})
+
+		case strings.HasSuffix(d.MediaType, ".tar+gzip"),
+			strings.HasSuffix(d.MediaType, ".tar.gzip"):
+			layers = append(layers, Layer{Path: p, Gzip: true})
+
+		default:
+			return nil, fmt.Errorf("unsupported layer type %q", d.MediaType)
+		}
+	}
+
+	return layers, nil
+}
+
+// Return the path of the blob with the supplied digest, such as
+// "sha256:e3b0c442...".
+func blobPath(dir string, digest string) (string, error) {
+	alg, hex, ok := strings.Cut(digest, ":")
+	if !ok || alg == "" || hex == "" || strings.ContainsAny(digest, `/\`) {
+		return "", fmt.Errorf("malformed digest %q", digest)
+	}
+
+	return filepath.Join(dir, "blobs", alg, hex), nil
+}
+
+func readJSON(p string, v interface{}) error {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+
+	return nil
+}
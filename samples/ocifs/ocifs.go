@@ -0,0 +1,630 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocifs contains a read-only file system serving the root file system
+// of a container image from its layers, as found in an OCI image layout.
+//
+// The layers are merged the way container runtimes merge them, including the
+// whiteout files with which a layer removes what lower layers hold, when the
+// file system is created; only the layers' tar headers are read then. File
+// contents are read on demand, much as a lazily pulled image fetches them:
+// straight from the blob for uncompressed layers, and by decompressing
+// gzipped layers up to the file, whose contents are then kept in memory.
+package ocifs
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// The names with which a layer hides an entry of lower layers (as in
+// .wh.name), or all entries of a directory of lower layers.
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// An image never changes, so the kernel may cache what it is told for long.
+const cacheFor = 24 * time.Hour
+
+type node struct {
+	id     fuseops.InodeID
+	attrs  fuseops.InodeAttributes
+	xattrs map[string][]byte
+
+	// The index of the highest layer holding the node.
+	layer int
+
+	// For directories: the children by name, and their names in order once all
+	// layers have been merged.
+	children map[string]*node
+	names    []string
+
+	// For symlinks.
+	target string
+
+	// For regular files: the offset of the contents in an uncompressed layer,
+	// or -1, and the index of the file's entry in the layer.
+	offset int64
+	entry  int
+
+	// For regular files in gzipped layers: the contents, once read.
+	load    sync.Once
+	data    []byte
+	loadErr error
+}
+
+func newDir(layer int) *node {
+	return &node{
+		attrs: fuseops.InodeAttributes{
+			Nlink: 2,
+			Mode:  os.ModeDir | 0755,
+		},
+		layer:    layer,
+		children: make(map[string]*node),
+	}
+}
+
+func (n *node) isDir() bool {
+	return n.children != nil
+}
+
+// Create a read-only file system serving the image made of the supplied
+// layers, bottom first. See ReadLayout.
+func NewFileSystem(layers []Layer) (fuseutil.FileSystem, error) {
+	fs := &ociFS{
+		layers: layers,
+		inodes: make(map[fuseops.InodeID]*node),
+	}
+
+	root := newDir(-1)
+	for i, l := range layers {
+		f, err := os.Open(l.Path)
+		if err != nil {
+			fs.Destroy()
+			return nil, err
+		}
+
+		fs.files = append(fs.files, f)
+		if err := fs.apply(root, i, f); err != nil {
+			fs.Destroy()
+			return nil, fmt.Errorf("layer %d: %w", i, err)
+		}
+	}
+
+	fs.number(root, fuseops.RootInodeID)
+	return fuseutil.NewReadOnlyFileSystem(fs), nil
+}
+
+// Create a server for the file system created by NewFileSystem.
+func NewServer(layers []Layer) (fuse.Server, error) {
+	fs, err := NewFileSystem(layers)
+	if err != nil {
+		return nil, err
+	}
+
+	return fuseutil.NewFileSystemServer(fs), nil
+}
+
+type ociFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	layers []Layer
+	files  []*os.File
+
+	// The inodes of the merged tree, which doesn't change once built.
+	inodes map[fuseops.InodeID]*node
+	nextID fuseops.InodeID
+}
+
+////////////////////////////////////////////////////////////////////////
+// Merging layers
+////////////////////////////////////////////////////////////////////////
+
+// Apply the entries of the layer with the supplied index to the tree.
+func (fs *ociFS) apply(root *node, layer int, f *os.File) error {
+	var r io.Reader = f
+	if fs.layers[layer].Gzip {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+
+		r = zr
+	}
+
+	tr := tar.NewReader(r)
+	for entry := 0; ; entry++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// The tar reader reads exactly up to the contents of an entry of an
+		// uncompressed layer, and seeks past them.
+		offset := int64(-1)
+		if r == f {
+			if offset, err = f.Seek(0, io.SeekCurrent); err != nil {
+				return err
+			}
+		}
+
+		if err := fs.add(root, layer, entry, hdr, offset); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+func (fs *ociFS) add(
+	root *node,
+	layer int,
+	entry int,
+	hdr *tar.Header,
+	offset int64) error {
+	name := path.Clean("/" + hdr.Name)
+	attrs := fuseops.InodeAttributes{
+		Size:  uint64(hdr.Size),
+		Nlink: 1,
+		Mode:  hdr.FileInfo().Mode(),
+		Atime: hdr.AccessTime,
+		Mtime: hdr.ModTime,
+		Ctime: hdr.ChangeTime,
+		Uid:   uint32(hdr.Uid),
+		Gid:   uint32(hdr.Gid),
+	}
+
+	if attrs.Atime.IsZero() {
+		attrs.Atime = attrs.Mtime
+	}
+
+	if attrs.Ctime.IsZero() {
+		attrs.Ctime = attrs.Mtime
+	}
+
+	var xattrs map[string][]byte
+	for k, v := range hdr.PAXRecords {
+		if name := strings.TrimPrefix(k, "SCHILY.xattr."); name != k {
+			if xattrs == nil {
+				xattrs = make(map[string][]byte)
+			}
+
+			xattrs[name] = []byte(v)
+		}
+	}
+
+	if name == "/" {
+		if hdr.Typeflag == tar.TypeDir {
+			attrs.Nlink = 2
+			root.attrs, root.xattrs = attrs, xattrs
+		}
+
+		return nil
+	}
+
+	dir, base := path.Split(name)
+	parent := mkdirAll(root, layer, dir)
+
+	switch {
+	case base == opaqueWhiteout:
+		for name, child := range parent.children {
+			if child.layer < layer {
+				unlink(parent, name)
+			}
+		}
+
+		return nil
+
+	case strings.HasPrefix(base, whiteoutPrefix):
+		name := strings.TrimPrefix(base, whiteoutPrefix)
+		if child := parent.children[name]; child != nil && child.layer < layer {
+			unlink(parent, name)
+		}
+
+		return nil
+	}
+
+	n := &node{
+		attrs:  attrs,
+		xattrs: xattrs,
+		layer:  layer,
+		offset: -1,
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		// A directory of a lower layer keeps its children.
+		if old := parent.children[base]; old != nil && old.isDir() {
+			n.children = old.children
+		} else {
+			n.children = make(map[string]*node)
+		}
+
+		n.attrs.Nlink = 2
+
+	case tar.TypeReg:
+		n.offset = offset
+		n.entry = entry
+
+	case tar.TypeSymlink:
+		n.target = hdr.Linkname
+		n.attrs.Size = uint64(len(n.target))
+
+	case tar.TypeLink:
+		n = lookUpPath(root, path.Clean("/"+hdr.Linkname))
+		if n == nil || n.isDir() {
+			return fmt.Errorf("bad hard link target %q", hdr.Linkname)
+		}
+
+		if parent.children[base] == n {
+			return nil
+		}
+
+		n.attrs.Nlink++
+
+	case tar.TypeChar, tar.TypeBlock:
+		n.attrs.Rdev = fuseops.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+
+	case tar.TypeFifo:
+
+	default:
+		// Ignore what can't be represented, such as sockets.
+		return nil
+	}
+
+	unlink(parent, base)
+	parent.children[base] = n
+	return nil
+}
+
+// Return the directory with the supplied path, creating it and its ancestors
+// as needed. Note that the layer holds them.
+func mkdirAll(root *node, layer int, dir string) *node {
+	n := root
+	for _, name := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		child := n.children[name]
+		if child == nil || !child.isDir() {
+			unlink(n, name)
+			child = newDir(layer)
+			n.children[name] = child
+		}
+
+		child.layer = layer
+		n = child
+	}
+
+	return n
+}
+
+func lookUpPath(root *node, p string) *node {
+	n := root
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		if n = n.children[name]; n == nil {
+			return nil
+		}
+	}
+
+	return n
+}
+
+// Remove the child with the supplied name from the directory, if any.
+func unlink(dir *node, name string) {
+	child := dir.children[name]
+	if child == nil {
+		return
+	}
+
+	if !child.isDir() {
+		child.attrs.Nlink--
+	}
+
+	delete(dir.children, name)
+}
+
+// Give IDs to the supplied directory and the nodes below it, and finish
+// their attributes.
+func (fs *ociFS) number(dir *node, id fuseops.InodeID) {
+	dir.id = id
+	fs.inodes[id] = dir
+	if fs.nextID <= id {
+		fs.nextID = id + 1
+	}
+
+	for name, child := range dir.children {
+		dir.names = append(dir.names, name)
+		if child.isDir() {
+			dir.attrs.Nlink++
+		}
+	}
+
+	sort.Strings(dir.names)
+	for _, name := range dir.names {
+		child := dir.children[name]
+		switch {
+		case child.isDir():
+			fs.number(child, fs.nextID)
+
+		// Hard links share a node.
+		case child.id == 0:
+			child.id = fs.nextID
+			fs.inodes[child.id] = child
+			fs.nextID++
+		}
+	}
+}
+
+// Return the contents of a regular file of a gzipped layer.
+func (fs *ociFS) contents(n *node) ([]byte, error) {
+	n.load.Do(func() {
+		f := fs.files[n.layer]
+		zr, err := gzip.NewReader(io.NewSectionReader(f, 0, 1<<63-1))
+		if err != nil {
+			n.loadErr = err
+			return
+		}
+
+		tr := tar.NewReader(zr)
+		for i := 0; i <= n.entry; i++ {
+			if _, err := tr.Next(); err != nil {
+				n.loadErr = err
+				return
+			}
+		}
+
+		n.data = make([]byte, n.attrs.Size)
+		_, n.loadErr = io.ReadFull(tr, n.data)
+	})
+
+	return n.data, n.loadErr
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *ociFS) lookUp(id fuseops.InodeID) (*node, error) {
+	n := fs.inodes[id]
+	if n == nil {
+		return nil, fuse.ENOENT
+	}
+
+	return n, nil
+}
+
+func (fs *ociFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *ociFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent, err := fs.lookUp(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	child := parent.children[op.Name]
+	if child == nil {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = child.id
+	op.Entry.Attributes = child.attrs
+	op.Entry.AttributesExpiration = time.Now().Add(cacheFor)
+	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+	return nil
+}
+
+func (fs *ociFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	n, err := fs.lookUp(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes = n.attrs
+	op.AttributesExpiration = time.Now().Add(cacheFor)
+	return nil
+}
+
+func (fs *ociFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *ociFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	dir, err := fs.lookUp(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if op.Offset > fuseops.DirOffset(len(dir.names)) {
+		return fuse.EINVAL
+	}
+
+	for i := int(op.Offset); i < len(dir.names); i++ {
+		child := dir.children[dir.names[i]]
+		d := fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  child.id,
+			Name:   dir.names[i],
+			Type:   fuseutil.DirentTypeForMode(child.attrs.Mode),
+		}
+
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], d)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *ociFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+func (fs *ociFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.KeepPageCache = true
+	return nil
+}
+
+func (fs *ociFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	n, err := fs.lookUp(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if op.Offset >= int64(n.attrs.Size) {
+		return nil
+	}
+
+	dst := op.Dst
+	if rest := int64(n.attrs.Size) - op.Offset; int64(len(dst)) > rest {
+		dst = dst[:rest]
+	}
+
+	if n.offset >= 0 {
+		op.BytesRead, err = fs.files[n.layer].ReadAt(dst, n.offset+op.Offset)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return err
+	}
+
+	data, err := fs.contents(n)
+	if err != nil {
+		return err
+	}
+
+	op.BytesRead = copy(dst, data[op.Offset:])
+	return nil
+}
+
+func (fs *ociFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+func (fs *ociFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	n, err := fs.lookUp(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Target = n.target
+	return nil
+}
+
+func (fs *ociFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	n, err := fs.lookUp(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	value, ok := n.xattrs[op.Name]
+	if !ok {
+		return fuse.ENOATTR
+	}
+
+	op.BytesRead = len(value)
+	if len(op.Dst) >= len(value) {
+		copy(op.Dst, value)
+	} else if len(op.Dst) != 0 {
+		return syscall.ERANGE
+	}
+
+	return nil
+}
+
+func (fs *ociFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	n, err := fs.lookUp(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	dst := op.Dst
+	for name := range n.xattrs {
+		nameLen := len(name) + 1
+		if len(dst) >= nameLen {
+			copy(dst, name)
+			dst = dst[nameLen:]
+		} else if len(op.Dst) != 0 {
+			return syscall.ERANGE
+		}
+
+		op.BytesRead += nameLen
+	}
+
+	return nil
+}
+
+func (fs *ociFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func (fs *ociFS) Destroy() {
+	for _, f := range fs.files {
+		f.Close()
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// An entry of a test layer: a directory if name ends with a slash, a hard
+// link if link is set, and a file otherwise.
+type tarEntry struct {
+	name     string
+	contents string
+	link     string
+}
+
+func makeTar(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.contents))}
+		switch {
+		case e.link != "":
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = e.link
+
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+
+		default:
+			hdr.Typeflag = tar.TypeReg
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader: %v", err)
+		}
+
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+// Write a blob to the layout, returning its descriptor.
+func writeBlob(t *testing.T, dir string, mediaType string, b []byte) descriptor {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+	p, err := blobPath(dir, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return descriptor{MediaType: mediaType, Digest: digest}
+}
+
+func writeJSONBlob(t *testing.T, dir string, mediaType string, v interface{}) descriptor {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return writeBlob(t, dir, mediaType, b)
+}
+
+// Create a layout holding an image with an uncompressed layer, topped with a
+// gzipped one that removes and replaces some of its files.
+func makeLayout(t *testing.T) string {
+	dir := t.TempDir()
+	lower := makeTar(t, []tarEntry{
+		{name: "etc/"},
+		{name: "etc/hostname", contents: "lower"},
+		{name: "etc/passwd", contents: "root:x:0:0"},
+		{name: "etc/group", link: "etc/passwd"},
+		{name: "var/cache/"},
+		{name: "var/cache/a", contents: "a"},
+	})
+
+	upper := makeTar(t, []tarEntry{
+		{name: "etc/.wh.hostname"},
+		{name: "etc/motd", contents: "hello from above"},
+		{name: "var/cache/"},
+		{name: "var/cache/.wh..wh..opq"},
+		{name: "var/cache/b", contents: "b"},
+	})
+
+	manifest := writeJSONBlob(t, dir, "application/vnd.oci.image.manifest.v1+json", imageManifest{
+		Layers: []descriptor{
+			writeBlob(t, dir, "application/vnd.oci.image.layer.v1.tar", lower),
+			writeBlob(t, dir, "application/vnd.oci.image.layer.v1.tar+gzip", gzipped(t, upper)),
+		},
+	})
+
+	manifest.Annotations = map[string]string{refAnnotation: "test"}
+	b, err := json.Marshal(imageIndex{Manifests: []descriptor{manifest}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestImage(t *testing.T) {
+	ctx := context.Background()
+	layers, err := ReadLayout(makeLayout(t), "test")
+	if err != nil {
+		t.Fatalf("ReadLayout: %v", err)
+	}
+
+	if len(layers) != 2 || layers[0].Gzip || !layers[1].Gzip {
+		t.Fatalf("Layers: %+v", layers)
+	}
+
+	fs, err := NewFileSystem(layers)
+	if err != nil {
+		t.Fatalf("NewFileSystem: %v", err)
+	}
+	defer fs.Destroy()
+
+	lookUp := func(p ...string) (fuseops.ChildInodeEntry, error) {
+		op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID}
+		for _, name := range p {
+			op.Name = name
+			if err := fs.LookUpInode(ctx, op); err != nil {
+				return op.Entry, err
+			}
+
+			op.Parent = op.Entry.Child
+		}
+
+		return op.Entry, nil
+	}
+
+	read := func(p ...string) string {
+		t.Helper()
+		e, err := lookUp(p...)
+		if err != nil {
+			t.Fatalf("LookUpInode(%v): %v", p, err)
+		}
+
+		op := &fuseops.ReadFileOp{Inode: e.Child, Offset: 1, Dst: make([]byte, 64)}
+		if err := fs.ReadFile(ctx, op); err != nil {
+			t.Fatalf("ReadFile(%v): %v", p, err)
+		}
+
+		return string(op.Dst[:op.BytesRead])
+	}
+
+	// Contents come from both layers, from offsets within them.
+	if got := read("etc", "passwd"); got != "oot:x:0:0" {
+		t.Errorf("etc/passwd: %q", got)
+	}
+
+	if got := read("etc", "motd"); got != "ello from above" {
+		t.Errorf("etc/motd: %q", got)
+	}
+
+	// Hard links share an inode.
+	passwd, _ := lookUp("etc", "passwd")
+	group, _ := lookUp("etc", "group")
+	if group.Child != passwd.Child || group.Attributes.Nlink != 2 {
+		t.Errorf("etc/group: %+v, etc/passwd: %+v", group, passwd)
+	}
+
+	// Whiteouts hide what lower layers hold.
+	if _, err := lookUp("etc", "hostname"); err != fuse.ENOENT {
+		t.Errorf("etc/hostname: %v", err)
+	}
+
+	if _, err := lookUp("var", "cache", "a"); err != fuse.ENOENT {
+		t.Errorf("var/cache/a: %v", err)
+	}
+
+	if _, err := lookUp("var", "cache", "b"); err != nil {
+		t.Errorf("var/cache/b: %v", err)
+	}
+
+	if _, err := lookUp("etc", ".wh.hostname"); err != fuse.ENOENT {
+		t.Errorf("Whiteout file: %v", err)
+	}
+
+	// Directory listings are of the merged tree.
+	etc, _ := lookUp("etc")
+	op := &fuseops.ReadDirOp{Inode: etc.Child, Dst: make([]byte, 1024)}
+	if err := fs.ReadDir(ctx, op); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	var want []byte
+	for i, name := range []string{"group", "motd", "passwd"} {
+		e, _ := lookUp("etc", name)
+		want = append(want, make([]byte, 64)...)
+		n := fuseutil.WriteDirent(want[len(want)-64:], fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  e.Child,
+			Name:   name,
+			Type:   fuseutil.DT_File,
+		})
+		want = want[:len(want)-64+n]
+	}
+
+	if !bytes.Equal(op.Dst[:op.BytesRead], want) {
+		t.Errorf("ReadDir: %q, want %q", op.Dst[:op.BytesRead], want)
+	}
+
+	// The image can't be modified.
+	err = fs.MkDir(ctx, &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "tmp"})
+	if err != syscall.EROFS {
+		t.Errorf("MkDir: %v", err)
+	}
+}
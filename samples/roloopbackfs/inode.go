@@ -21,10 +21,12 @@ import (
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/folays/jacobsa_fuse/fuseops"
 	"github.com/folays/jacobsa_fuse/fuseutil"
+	"golang.org/x/sys/unix"
 )
 
 var (
@@ -111,9 +113,22 @@ func (in *inodeEntry) Attributes() (*fuseops.InodeAttributes, error) {
 		Crtime: time.Now(),
 		Uid:    uid,
 		Gid:    gid,
+		Rdev:   rdev(fileInfo),
 	}, nil
 }
 
+// Return the device a device node stands for, so that it can be opened
+// through the mount when that is mounted with the "dev" option.
+func rdev(fileInfo os.FileInfo) uint32 {
+	st, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok || fileInfo.Mode()&os.ModeDevice == 0 {
+		return 0
+	}
+
+	dev := uint64(st.Rdev)
+	return fuseops.Mkdev(unix.Major(dev), unix.Minor(dev))
+}
+
 func (in *inodeEntry) ListChildren(inodes *sync.Map) ([]*fuseutil.Dirent, error) {
 	children, err := ioutil.ReadDir(in.path)
 	if err != nil {
@@ -127,20 +142,11 @@ func (in *inodeEntry) ListChildren(inodes *sync.Map) ([]*fuseutil.Dirent, error)
 			return nil, nil
 		}
 
-		var childType fuseutil.DirentType
-		if child.IsDir() {
-			childType = fuseutil.DT_Directory
-		} else if child.Mode()&os.ModeSymlink != 0 {
-			childType = fuseutil.DT_Link
-		} else {
-			childType = fuseutil.DT_File
-		}
-
 		dirents[i] = &fuseutil.Dirent{
 			Offset: fuseops.DirOffset(i + 1),
 			Inode:  childInode.Id(),
 			Name:   child.Name(),
-			Type:   childType,
+			Type:   fuseutil.DirentTypeForMode(child.Mode()),
 		}
 	}
 	return dirents, nil
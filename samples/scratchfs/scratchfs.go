@@ -0,0 +1,452 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scratchfs contains a multi-user scratch file system kept in
+// memory, in the manner of a tmpfs with per-user quotas. It composes memfs
+// with wrappers of fuseutil:
+//
+//   - Each user sees a directory of their own as the root of the mount
+//     (fuseutil.NewUIDViewFileSystem), created when they first use it. Root
+//     sees all of them.
+//
+//   - Inodes are owned by the user and group of the process creating them,
+//     rather than all by the owner of the mount as in memfs, so that the
+//     kernel's permission checks (the default_permissions mount option) let
+//     users share what they choose to with chmod(2).
+//
+//   - What is stored in a user's directory counts towards their quota, as
+//     tracked by fuseutil.UsageTracker. Ops that would take it beyond fail with
+//     EDQUOT. The usage can be read with getfattr -n user.fuse.du.
+//
+// Quotas are only checked for ops carrying the UID of the user, which is
+// not the case of the writes the kernel caches and writes back later: mount
+// with fuse.MountConfig.DisableWritebackCaching set.
+package scratchfs
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/samples/memfs"
+)
+
+// Options for NewFileSystem.
+type Config struct {
+	// The most bytes, as apparent file sizes, and the most inodes, including
+	// their directory, each user may store. Zero means no limit.
+	MaxBytes  uint64
+	MaxInodes uint64
+}
+
+// Create a scratch file system owned by the supplied user and group, who are
+// those of root's view.
+func NewFileSystem(uid uint32, gid uint32, cfg Config) fuseutil.FileSystem {
+	tracker := fuseutil.NewUsageTracker()
+	fs := &scratchFS{
+		FileSystem: fuseutil.NewUsageTrackingFileSystem(
+			memfs.NewMemFileSystem(uid, gid),
+			tracker),
+		cfg:     cfg,
+		gid:     gid,
+		tracker: tracker,
+		owners:  make(map[fuseops.InodeID]owner),
+		dirs:    make(map[uint32]fuseops.InodeID),
+	}
+
+	return fuseutil.NewUIDViewFileSystem(fs, fs.userDir)
+}
+
+// Create a server for the file system created by NewFileSystem.
+func NewServer(uid uint32, gid uint32, cfg Config) fuse.Server {
+	return fuseutil.NewFileSystemServer(NewFileSystem(uid, gid, cfg))
+}
+
+type owner struct {
+	uid uint32
+	gid uint32
+}
+
+type scratchFS struct {
+	fuseutil.FileSystem
+
+	cfg     Config
+	gid     uint32
+	tracker *fuseutil.UsageTracker
+
+	// Held while checking a quota and storing what it allows, so that
+	// concurrent ops can't together exceed it.
+	quota sync.Mutex
+
+	mu sync.Mutex
+
+	// The owners of the inodes created through the file system.
+	//
+	// GUARDED_BY(mu)
+	owners map[fuseops.InodeID]owner
+
+	// The directory of each user, by UID.
+	//
+	// GUARDED_BY(mu)
+	dirs map[uint32]fuseops.InodeID
+}
+
+// Return the directory of the user, creating it if needed.
+//
+// LOCKS_EXCLUDED(fs.quota, fs.mu)
+func (fs *scratchFS) userDir(
+	ctx context.Context,
+	uid uint32) (fuseops.InodeID, error) {
+	if uid == 0 {
+		return fuseops.RootInodeID, nil
+	}
+
+	fs.mu.Lock()
+	dir, ok := fs.dirs[uid]
+	fs.mu.Unlock()
+
+	if ok {
+		return dir, nil
+	}
+
+	// Create it once only.
+	fs.quota.Lock()
+	defer fs.quota.Unlock()
+
+	fs.mu.Lock()
+	dir, ok = fs.dirs[uid]
+	fs.mu.Unlock()
+
+	if ok {
+		return dir, nil
+	}
+
+	// Root may have created it already.
+	name := strconv.FormatUint(uint64(uid), 10)
+	lookUpOp := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   name,
+	}
+
+	err := fs.FileSystem.LookUpInode(ctx, lookUpOp)
+	dir = lookUpOp.Entry.Child
+
+	if err == fuse.ENOENT {
+		mkDirOp := &fuseops.MkDirOp{
+			Parent:    fuseops.RootInodeID,
+			Name:      name,
+			Mode:      os.ModeDir | 0700,
+			OpContext: fuseops.OpContext{Uid: uid, Gid: fs.gid},
+		}
+
+		if err = fs.FileSystem.MkDir(ctx, mkDirOp); err == nil {
+			fs.created(mkDirOp.OpContext, &mkDirOp.Entry)
+		}
+
+		dir = mkDirOp.Entry.Child
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	fs.mu.Lock()
+	fs.dirs[uid] = dir
+	fs.mu.Unlock()
+
+	return dir, nil
+}
+
+// Return EDQUOT if storing the supplied numbers of bytes and inodes more
+// would take the caller beyond their quota.
+//
+// LOCKS_REQUIRED(fs.quota)
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *scratchFS) check(
+	opCtx fuseops.OpContext,
+	bytes uint64,
+	inodes uint64) error {
+	fs.mu.Lock()
+	dir, ok := fs.dirs[opCtx.Uid]
+	fs.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	u, _ := fs.tracker.Usage(dir)
+	if fs.cfg.MaxBytes != 0 && u.Bytes+bytes > fs.cfg.MaxBytes ||
+		fs.cfg.MaxInodes != 0 && u.Inodes+inodes > fs.cfg.MaxInodes {
+		return syscall.EDQUOT
+	}
+
+	return nil
+}
+
+// Return how many bytes an inode would grow by if it were to become the
+// supplied size.
+func (fs *scratchFS) growth(
+	ctx context.Context,
+	id fuseops.InodeID,
+	size uint64) (uint64, error) {
+	op := &fuseops.GetInodeAttributesOp{Inode: id}
+	if err := fs.FileSystem.GetInodeAttributes(ctx, op); err != nil {
+		return 0, err
+	}
+
+	if size <= op.Attributes.Size {
+		return 0, nil
+	}
+
+	return size - op.Attributes.Size, nil
+}
+
+// Record that the caller owns a new inode, and show it in its attributes.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *scratchFS) created(opCtx fuseops.OpContext, e *fuseops.ChildInodeEntry) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.owners[e.Child] = owner{uid: opCtx.Uid, gid: opCtx.Gid}
+	fs.fixOwner(e.Child, &e.Attributes)
+}
+
+// Show the owner of the inode in its attributes.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *scratchFS) fixOwner(id fuseops.InodeID, attrs *fuseops.InodeAttributes) {
+	if o, ok := fs.owners[id]; ok {
+		attrs.Uid = o.uid
+		attrs.Gid = o.gid
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *scratchFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := fs.FileSystem.LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.fixOwner(op.Entry.Child, &op.Entry.Attributes)
+	return nil
+}
+
+func (fs *scratchFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if err := fs.FileSystem.GetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.fixOwner(op.Inode, &op.Attributes)
+	return nil
+}
+
+func (fs *scratchFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if op.Size != nil {
+		fs.quota.Lock()
+		defer fs.quota.Unlock()
+
+		n, err := fs.growth(ctx, op.Inode, *op.Size)
+		if err != nil {
+			return err
+		}
+
+		if err := fs.check(op.OpContext, n, 0); err != nil {
+			return err
+		}
+	}
+
+	err := fs.FileSystem.SetInodeAttributes(ctx, op)
+
+	// The kernel has checked that the caller may change the owner.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Uid != nil || op.Gid != nil {
+		o, ok := fs.owners[op.Inode]
+		if !ok {
+			o = owner{uid: op.Attributes.Uid, gid: op.Attributes.Gid}
+		}
+
+		if op.Uid != nil {
+			o.uid = *op.Uid
+		}
+
+		if op.Gid != nil {
+			o.gid = *op.Gid
+		}
+
+		fs.owners[op.Inode] = o
+	}
+
+	fs.fixOwner(op.Inode, &op.Attributes)
+	return err
+}
+
+func (fs *scratchFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.quota.Lock()
+	defer fs.quota.Unlock()
+
+	if err := fs.check(op.OpContext, 0, 1); err != nil {
+		return err
+	}
+
+	if err := fs.FileSystem.MkDir(ctx, op); err != nil {
+		return err
+	}
+
+	fs.created(op.OpContext, &op.Entry)
+	return nil
+}
+
+func (fs *scratchFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	fs.quota.Lock()
+	defer fs.quota.Unlock()
+
+	if err := fs.check(op.OpContext, 0, 1); err != nil {
+		return err
+	}
+
+	if err := fs.FileSystem.MkNode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.created(op.OpContext, &op.Entry)
+	return nil
+}
+
+func (fs *scratchFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.quota.Lock()
+	defer fs.quota.Unlock()
+
+	if err := fs.check(op.OpContext, 0, 1); err != nil {
+		return err
+	}
+
+	if err := fs.FileSystem.CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.created(op.OpContext, &op.Entry)
+	return nil
+}
+
+func (fs *scratchFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	fs.quota.Lock()
+	defer fs.quota.Unlock()
+
+	if err := fs.check(op.OpContext, uint64(len(op.Target)), 1); err != nil {
+		return err
+	}
+
+	if err := fs.FileSystem.CreateSymlink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.created(op.OpContext, &op.Entry)
+	return nil
+}
+
+func (fs *scratchFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	fs.quota.Lock()
+	defer fs.quota.Unlock()
+
+	// Each link counts towards the usage.
+	getOp := &fuseops.GetInodeAttributesOp{Inode: op.Target}
+	if err := fs.FileSystem.GetInodeAttributes(ctx, getOp); err != nil {
+		return err
+	}
+
+	if err := fs.check(op.OpContext, getOp.Attributes.Size, 1); err != nil {
+		return err
+	}
+
+	if err := fs.FileSystem.CreateLink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.fixOwner(op.Entry.Child, &op.Entry.Attributes)
+	return nil
+}
+
+func (fs *scratchFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.quota.Lock()
+	defer fs.quota.Unlock()
+
+	n, err := fs.growth(ctx, op.Inode, uint64(op.Offset)+uint64(len(op.Data)))
+	if err != nil {
+		return err
+	}
+
+	if err := fs.check(op.OpContext, n, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+func (fs *scratchFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	fs.quota.Lock()
+	defer fs.quota.Unlock()
+
+	if op.Mode&fuseops.FallocateKeepSize == 0 {
+		n, err := fs.growth(ctx, op.Inode, op.Offset+op.Length)
+		if err != nil {
+			return err
+		}
+
+		if err := fs.check(op.OpContext, n, 0); err != nil {
+			return err
+		}
+	}
+
+	return fs.FileSystem.Fallocate(ctx, op)
+}
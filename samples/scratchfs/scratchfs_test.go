@@ -0,0 +1,146 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scratchfs_test
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/samples/scratchfs"
+)
+
+var (
+	alice = fuseops.OpContext{Uid: 1000, Gid: 100}
+	bob   = fuseops.OpContext{Uid: 1001, Gid: 100}
+	root  = fuseops.OpContext{}
+)
+
+func TestQuotas(t *testing.T) {
+	ctx := context.Background()
+	fs := scratchfs.NewFileSystem(0, 0, scratchfs.Config{
+		MaxBytes:  100,
+		MaxInodes: 3,
+	})
+
+	create := func(opCtx fuseops.OpContext, name string) (fuseops.ChildInodeEntry, error) {
+		op := &fuseops.CreateFileOp{
+			Parent:    fuseops.RootInodeID,
+			Name:      name,
+			Mode:      0644,
+			OpContext: opCtx,
+		}
+
+		err := fs.CreateFile(ctx, op)
+		return op.Entry, err
+	}
+
+	write := func(opCtx fuseops.OpContext, id fuseops.InodeID, offset int64, n int) error {
+		return fs.WriteFile(ctx, &fuseops.WriteFileOp{
+			Inode:     id,
+			Offset:    offset,
+			Data:      make([]byte, n),
+			OpContext: opCtx,
+		})
+	}
+
+	// Files are owned by their creator.
+	a, err := create(alice, "a")
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	if a.Attributes.Uid != alice.Uid || a.Attributes.Gid != alice.Gid {
+		t.Errorf("Attributes: %+v", a.Attributes)
+	}
+
+	// Growing files counts towards the quota, overwriting them doesn't.
+	if err := write(alice, a.Child, 0, 60); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := write(alice, a.Child, 60, 50); err != syscall.EDQUOT {
+		t.Errorf("Growing beyond the quota: %v", err)
+	}
+
+	if err := write(alice, a.Child, 0, 60); err != nil {
+		t.Errorf("Overwriting: %v", err)
+	}
+
+	// So do inodes, including the user's directory.
+	err = fs.MkDir(ctx, &fuseops.MkDirOp{
+		Parent:    fuseops.RootInodeID,
+		Name:      "d",
+		Mode:      os.ModeDir | 0755,
+		OpContext: alice,
+	})
+	if err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	if _, err := create(alice, "b"); err != syscall.EDQUOT {
+		t.Errorf("Creating beyond the quota: %v", err)
+	}
+
+	// Other users have a directory and a quota of their own.
+	lookUp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a", OpContext: bob}
+	if err := fs.LookUpInode(ctx, lookUp); err != fuse.ENOENT {
+		t.Errorf("Looking up another user's file: %v", err)
+	}
+
+	b, err := create(bob, "a")
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	if err := write(bob, b.Child, 0, 100); err != nil {
+		t.Errorf("WriteFile: %v", err)
+	}
+
+	// Root sees the users' directories, owned by them.
+	lookUp = &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "1000", OpContext: root}
+	if err := fs.LookUpInode(ctx, lookUp); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	if attrs := lookUp.Entry.Attributes; attrs.Uid != alice.Uid || attrs.Mode != os.ModeDir|0700 {
+		t.Errorf("User directory: %+v", attrs)
+	}
+
+	// Root may give files away.
+	uid := bob.Uid
+	setOp := &fuseops.SetInodeAttributesOp{Inode: a.Child, Uid: &uid, OpContext: root}
+	if err := fs.SetInodeAttributes(ctx, setOp); err != nil {
+		t.Fatalf("SetInodeAttributes: %v", err)
+	}
+
+	getOp := &fuseops.GetInodeAttributesOp{Inode: a.Child, OpContext: alice}
+	if err := fs.GetInodeAttributes(ctx, getOp); err != nil || getOp.Attributes.Uid != bob.Uid {
+		t.Errorf("Owner after chown: %v, %+v", err, getOp.Attributes)
+	}
+
+	// Removing files frees their usage.
+	unlink := &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "a", OpContext: alice}
+	if err := fs.Unlink(ctx, unlink); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	if _, err := create(alice, "b"); err != nil {
+		t.Errorf("Creating after unlinking: %v", err)
+	}
+}
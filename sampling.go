@@ -0,0 +1,92 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Configuration for NewOpSampler. The zero value samples every op.
+type SamplingConfig struct {
+	// Sample one op in OneIn, counting ops in the order they complete. Values
+	// below 2 sample every op.
+	OneIn uint64
+
+	// Additionally sample every op that failed, except with errors that are a
+	// matter of course (such as ENOENT when looking up a name that doesn't
+	// exist).
+	Errors bool
+
+	// If positive, additionally sample every op that took at least this long
+	// to respond to.
+	SlowerThan time.Duration
+}
+
+// An OpSampler decides which ops to trace, so that a mount can be traced in
+// production without drowning the collector.
+type OpSampler struct {
+	cfg SamplingConfig
+
+	// The number of ops seen.
+	n uint64 // ATOMIC
+}
+
+// NewOpSampler creates a sampler with the supplied configuration.
+func NewOpSampler(cfg SamplingConfig) *OpSampler {
+	return &OpSampler{cfg: cfg}
+}
+
+// Sample reports whether an op, read at start and responded to with err just
+// now, should be traced. It is safe to call concurrently.
+func (s *OpSampler) Sample(op interface{}, start time.Time, err error) bool {
+	n := atomic.AddUint64(&s.n, 1)
+	if s.cfg.OneIn < 2 || n%s.cfg.OneIn == 1 {
+		return true
+	}
+
+	if s.cfg.Errors && err != nil && !isExpectedError(op, err) {
+		return true
+	}
+
+	if s.cfg.SlowerThan > 0 && time.Since(start) >= s.cfg.SlowerThan {
+		return true
+	}
+
+	return false
+}
+
+// Observer wraps an op observer (see MountConfig.OpObserver) such that it only
+// sees sampled ops.
+func (s *OpSampler) Observer(
+	observer func(op interface{}, start time.Time, err error)) func(op interface{}, start time.Time, err error) {
+	return func(op interface{}, start time.Time, err error) {
+		if s.Sample(op, start, err) {
+			observer(op, start, err)
+		}
+	}
+}
+
+// MultiOpObserver returns an op observer (see MountConfig.OpObserver) that
+// passes each op to all of the supplied observers in turn, e.g. to account for
+// every op while publishing only a sample of them.
+func MultiOpObserver(
+	observers ...func(op interface{}, start time.Time, err error)) func(op interface{}, start time.Time, err error) {
+	return func(op interface{}, start time.Time, err error) {
+		for _, o := range observers {
+			o(op, start, err)
+		}
+	}
+}
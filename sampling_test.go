@@ -0,0 +1,74 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+func TestOpSampler(t *testing.T) {
+	s := NewOpSampler(SamplingConfig{
+		OneIn:      4,
+		Errors:     true,
+		SlowerThan: time.Hour,
+	})
+
+	var sampled int
+	observe := s.Observer(func(op interface{}, start time.Time, err error) {
+		sampled++
+	})
+
+	now := time.Now()
+	for i := 0; i < 8; i++ {
+		observe(&fuseops.GetInodeAttributesOp{}, now, nil)
+	}
+
+	if sampled != 2 {
+		t.Errorf("Sampled %d of 8 ops, want 2", sampled)
+	}
+
+	// The ninth op is sampled by count, the next three aren't.
+	observe(&fuseops.GetInodeAttributesOp{}, now, nil)
+	sampled = 0
+
+	// Unexpected errors and slow ops are sampled, expected errors aren't.
+	observe(&fuseops.ReadFileOp{}, now, syscall.EIO)
+	observe(&fuseops.LookUpInodeOp{}, now, syscall.ENOENT)
+	observe(&fuseops.ReadFileOp{}, now.Add(-2*time.Hour), nil)
+
+	if sampled != 2 {
+		t.Errorf("Sampled %d ops, want 2", sampled)
+	}
+}
+
+func TestMultiOpObserver(t *testing.T) {
+	var seen []string
+	observer := func(name string) func(interface{}, time.Time, error) {
+		return func(op interface{}, start time.Time, err error) {
+			seen = append(seen, name)
+		}
+	}
+
+	observe := MultiOpObserver(observer("a"), observer("b"))
+	observe(&fuseops.StatFSOp{}, time.Now(), nil)
+
+	if len(seen) != 2 || seen[0] != "a" || seen[1] != "b" {
+		t.Errorf("Observers called: %v", seen)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"sync"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// A scheduler runs the handlers of ops within the limits set by MountConfig.
+// Each running handler has a goroutine of its own, which goes on to run the
+// handlers queued behind it before exiting, so that no goroutines are left
+// over when the connection is idle.
+type scheduler struct {
+	// The most handlers to run at once, or zero for no limit, and the most to
+	// queue beyond that.
+	workers int
+	queued  int
+
+	// Whether to serialize the ops that change a file's contents per inode.
+	perInode bool
+
+	mu sync.Mutex
+
+	// Signalled with mu held when a handler finishes or leaves the queue.
+	cond sync.Cond
+
+	// The number of goroutines running handlers, and the handlers waiting for
+	// one, in order.
+	//
+	// GUARDED_BY(mu)
+	running int
+	pending []func()
+
+	// For each inode with a content-changing op being handled, the ops for it
+	// received since, in order.
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID][]func()
+}
+
+func newScheduler(cfg *MountConfig) *scheduler {
+	s := &scheduler{
+		workers:  cfg.MaxConcurrentOps,
+		queued:   cfg.MaxQueuedOps,
+		perInode: cfg.SerializeWritesPerInode,
+		inodes:   make(map[fuseops.InodeID][]func()),
+	}
+
+	s.cond.L = &s.mu
+	return s
+}
+
+// Return the inode whose contents the op changes, if it is one of the ops to
+// serialize per inode.
+func writtenInode(op interface{}) (fuseops.InodeID, bool) {
+	switch typed := op.(type) {
+	case *fuseops.WriteFileOp:
+		return typed.Inode, true
+
+	case *fuseops.FallocateOp:
+		return typed.Inode, true
+
+	case *fuseops.SetInodeAttributesOp:
+		return typed.Inode, typed.Size != nil
+	}
+
+	return 0, false
+}
+
+// Run f, the handler for op, once the limits allow, blocking while the queue
+// is full.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *scheduler) schedule(op interface{}, f func()) {
+	if id, ok := writtenInode(op); ok && s.perInode {
+		s.mu.Lock()
+		if q, busy := s.inodes[id]; busy {
+			s.inodes[id] = append(q, f)
+			s.mu.Unlock()
+			return
+		}
+
+		s.inodes[id] = nil
+		s.mu.Unlock()
+
+		f = s.serialized(id, f)
+	}
+
+	if s.workers <= 0 {
+		go f()
+		return
+	}
+
+	s.mu.Lock()
+	for s.running >= s.workers && len(s.pending) >= s.queued {
+		s.cond.Wait()
+	}
+
+	if s.running < s.workers {
+		s.running++
+		s.mu.Unlock()
+		go s.work(f)
+		return
+	}
+
+	s.pending = append(s.pending, f)
+	s.mu.Unlock()
+}
+
+// Run f, then the handlers queued behind it while there are any.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *scheduler) work(f func()) {
+	for f != nil {
+		f()
+
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			s.running--
+			f = nil
+		} else {
+			f = s.pending[0]
+			s.pending = s.pending[1:]
+		}
+
+		s.cond.Signal()
+		s.mu.Unlock()
+	}
+}
+
+// Wrap the handler of the content-changing op being handled for the given
+// inode, so that it goes on to run those received for the inode since.
+func (s *scheduler) serialized(id fuseops.InodeID, f func()) func() {
+	return func() {
+		for f != nil {
+			f()
+
+			s.mu.Lock()
+			q := s.inodes[id]
+			if len(q) == 0 {
+				delete(s.inodes, id)
+				f = nil
+			} else {
+				f = q[0]
+				s.inodes[id] = q[1:]
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Return the number of handlers waiting to be run, whether for a goroutine
+// or for the ops ahead of them for the same inode.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *scheduler) waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.pending)
+	for _, q := range s.inodes {
+		n += len(q)
+	}
+
+	return n
+}
+
+// Schedule runs f, which handles op, on a goroutine of its own, within the
+// limits set by MountConfig.MaxConcurrentOps, MaxQueuedOps and
+// SerializeWritesPerInode. Servers call it for each op they read with ReadOp,
+// from the goroutine reading them, in the order they are read; it blocks
+// while the queue is full, so that no more ops are read until a handler
+// finishes.
+func (c *Connection) Schedule(op interface{}, f func()) {
+	c.sched.schedule(op, f)
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+func TestScheduler(t *testing.T) {
+	s := newScheduler(&MountConfig{MaxConcurrentOps: 2, MaxQueuedOps: 1})
+
+	release := make(chan struct{})
+	started := make(chan int, 10)
+	handler := func(i int) func() {
+		return func() {
+			started <- i
+			<-release
+		}
+	}
+
+	// Two handlers run, and a third waits for them.
+	for i := 0; i < 3; i++ {
+		s.schedule(&fuseops.ReadFileOp{}, handler(i))
+	}
+
+	for i := 0; i < 2; i++ {
+		<-started
+	}
+
+	// A fourth blocks the caller until one of them finishes.
+	scheduled := make(chan struct{})
+	go func() {
+		s.schedule(&fuseops.ReadFileOp{}, handler(3))
+		close(scheduled)
+	}()
+
+	select {
+	case i := <-started:
+		t.Fatalf("Handler %d started beyond the limit", i)
+	case <-scheduled:
+		t.Fatalf("Scheduling didn't block with a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	release <- struct{}{}
+	<-scheduled
+	if i := <-started; i != 2 {
+		t.Errorf("Handler %d started before the queued one", i)
+	}
+
+	close(release)
+	if i := <-started; i != 3 {
+		t.Errorf("Last handler: %d", i)
+	}
+}
+
+func TestSchedulerSerializesWrites(t *testing.T) {
+	s := newScheduler(&MountConfig{SerializeWritesPerInode: true})
+
+	var mu sync.Mutex
+	var order []int
+	running := make(map[fuseops.InodeID]bool)
+
+	var wg sync.WaitGroup
+	write := func(inode fuseops.InodeID, i int) {
+		wg.Add(1)
+		s.schedule(&fuseops.WriteFileOp{Inode: inode}, func() {
+			defer wg.Done()
+
+			mu.Lock()
+			if running[inode] {
+				t.Errorf("Concurrent writes to inode %d", inode)
+			}
+			running[inode] = true
+			if inode == 2 {
+				order = append(order, i)
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			running[inode] = false
+			mu.Unlock()
+		})
+	}
+
+	for i := 0; i < 10; i++ {
+		write(2, i)
+		write(3, i)
+	}
+
+	wg.Wait()
+
+	for i, j := range order {
+		if i != j {
+			t.Fatalf("Writes handled out of order: %v", order)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"syscall"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// Keep track of the file handles opened with direct IO, whose reads may be
+// short without meaning the end of the file.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) noteDirectIO(op interface{}, opErr error) {
+	switch o := op.(type) {
+	case *fuseops.OpenFileOp:
+		c.noteDirectIOHandle(o.Handle, o.UseDirectIO, opErr)
+
+	case *fuseops.CreateFileOp:
+		c.noteDirectIOHandle(o.Handle, o.UseDirectIO, opErr)
+
+	case *fuseops.ReleaseFileHandleOp:
+		c.mu.Lock()
+		delete(c.directIO, o.Handle)
+		c.mu.Unlock()
+	}
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) noteDirectIOHandle(
+	h fuseops.HandleID,
+	useDirectIO bool,
+	opErr error) {
+	// See MountConfig.EnableSharedWritableMmap.
+	if opErr != nil || !useDirectIO || c.cfg.EnableSharedWritableMmap {
+		return
+	}
+
+	c.mu.Lock()
+	c.directIO[h] = struct{}{}
+	c.mu.Unlock()
+}
+
+// Report whether reads on the handle, opened with the supplied flags, bypass
+// the page cache.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) isDirectIO(
+	h fuseops.HandleID,
+	flags fusekernel.OpenFlags) bool {
+	if flags.IsDirect() {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.directIO[h]
+	return ok
+}
+
+// Return the error to reply to a successful read or write with, given what
+// the file system says it read or wrote. See ReadFileOp.Incomplete and
+// WriteFileOp.BytesWritten.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) checkShortIO(op interface{}) error {
+	switch o := op.(type) {
+	case *fuseops.ReadFileOp:
+		size := o.Size
+		if o.Dst != nil {
+			size = int64(len(o.Dst))
+		}
+
+		if o.BytesRead < 0 || int64(o.BytesRead) > size {
+			if c.errorLogger != nil {
+				c.errorLogger.Printf(
+					"ReadFileOp: BytesRead %d out of range for a read of %d bytes",
+					o.BytesRead,
+					size)
+			}
+
+			return syscall.EIO
+		}
+
+		if o.Incomplete &&
+			int64(o.BytesRead) < size &&
+			!c.isDirectIO(o.Handle, o.OpenFlags) {
+			return syscall.EINTR
+		}
+
+	case *fuseops.WriteFileOp:
+		if o.BytesWritten < 0 || o.BytesWritten > len(o.Data) {
+			if c.errorLogger != nil {
+				c.errorLogger.Printf(
+					"WriteFileOp: BytesWritten %d out of range for a write of %d bytes",
+					o.BytesWritten,
+					len(o.Data))
+			}
+
+			return syscall.EIO
+		}
+
+		if o.FromPageCache && o.BytesWritten != 0 && o.BytesWritten < len(o.Data) {
+			if c.errorLogger != nil {
+				c.errorLogger.Printf(
+					"WriteFileOp: short write of %d bytes out of %d from the page cache",
+					o.BytesWritten,
+					len(o.Data))
+			}
+
+			return syscall.EIO
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system whose reads fill two bytes and report the read incomplete,
+// except at offset 1 where they claim more than was asked for, and whose
+// writes accept two bytes. Handle 7 is opened with direct IO.
+type shortIOFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *shortIOFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.Handle = 7
+	op.UseDirectIO = true
+	return nil
+}
+
+func (fs *shortIOFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if op.Offset == 1 {
+		op.BytesRead = len(op.Dst) + 1
+		return nil
+	}
+
+	op.BytesRead = copy(op.Dst, "ab")
+	op.Incomplete = true
+	return nil
+}
+
+func (fs *shortIOFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	op.BytesWritten = 2
+	return nil
+}
+
+func sendReadHandle(
+	t *testing.T,
+	kernel *os.File,
+	unique uint64,
+	handle uint64,
+	offset int64) {
+	in := fusekernel.ReadIn{Fh: handle, Offset: uint64(offset), Size: 4}
+	sendRequest(t, kernel, fusekernel.OpRead, unique, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+}
+
+func TestShortIO(t *testing.T) {
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(&shortIOFS{}))
+	defer hangUp()
+
+	// An incomplete read through the page cache is interrupted...
+	sendReadHandle(t, kernel, 1, 0, 0)
+	if r := readReply(t, kernel); r.errno != -int32(syscall.EINTR) {
+		t.Errorf("Incomplete read: %+v", r)
+	}
+
+	// ...while one with direct IO is returned short.
+	in := fusekernel.OpenIn{}
+	sendRequest(t, kernel, fusekernel.OpOpen, 2, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+	if r := readReply(t, kernel); r.errno != 0 {
+		t.Fatalf("Open: %+v", r)
+	}
+
+	sendReadHandle(t, kernel, 3, 7, 0)
+	if r := readReply(t, kernel); r.errno != 0 || string(r.data) != "ab" {
+		t.Errorf("Incomplete direct read: %+v", r)
+	}
+
+	// Reading more than asked for is an error.
+	sendReadHandle(t, kernel, 4, 7, 1)
+	if r := readReply(t, kernel); r.errno != -int32(syscall.EIO) {
+		t.Errorf("Overlong read: %+v", r)
+	}
+
+	// A short write is passed on...
+	sendWrite(t, kernel, 5, "taco")
+	r := readReply(t, kernel)
+	if r.errno != 0 || len(r.data) < 4 || binary.LittleEndian.Uint32(r.data) != 2 {
+		t.Errorf("Short write: %+v", r)
+	}
+
+	// ...unless it writes back the page cache.
+	w := fusekernel.WriteIn{Size: 4, WriteFlags: uint32(fusekernel.WriteCache)}
+	b := (*[unsafe.Sizeof(w)]byte)(unsafe.Pointer(&w))[:]
+	sendRequest(t, kernel, fusekernel.OpWrite, 6, append(b, "taco"...))
+	if r := readReply(t, kernel); r.errno != -int32(syscall.EIO) {
+		t.Errorf("Short write from the page cache: %+v", r)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Shutdown stops serving the file system gracefully: ops read from now on are
+// failed with ENOTCONN, those already being handled are given until ctx is
+// done to be replied to, and the file system is then unmounted, lazily if it
+// is still busy after a few attempts over a second. Ops still in flight when ctx is done have their contexts
+// cancelled, and ctx's error is returned after unmounting.
+//
+// Shutdown returns once the server has returned, as for Join. Servers created
+// with fuseutil.NewFileSystemServer call the file system's Destroy method at
+// that point, which is where any final flushing of state belongs.
+func (mfs *MountedFileSystem) Shutdown(ctx context.Context) error {
+	if mfs.conn == nil {
+		return errNoConnection
+	}
+
+	var err error
+	select {
+	case <-mfs.conn.drain():
+	case <-ctx.Done():
+		mfs.conn.cancelInFlight()
+		err = ctx.Err()
+	}
+
+	if uerr := mfs.unmount(); uerr != nil {
+		return uerr
+	}
+
+	// The kernel tears the connection down on unmounting, so the server doesn't
+	// take long to notice. Don't let an expired ctx stop us from waiting.
+	if jerr := mfs.Join(context.Background()); jerr != nil && err == nil {
+		err = jerr
+	}
+
+	return err
+}
+
+// How many times Shutdown tries to unmount the file system before falling
+// back to a lazy unmount, and how long it waits in between, for processes to
+// close the files they have open on it.
+const (
+	unmountAttempts   = 5
+	unmountRetryDelay = 200 * time.Millisecond
+)
+
+// Unmount the file system, falling back to a lazy unmount if it stays busy.
+func (mfs *MountedFileSystem) unmount() error {
+	if mfs.mountNamespace != nil {
+		return UnmountInNamespace(mfs.dir, mfs.mountNamespace)
+	}
+
+	for i := 0; i < unmountAttempts; i++ {
+		if i > 0 {
+			time.Sleep(unmountRetryDelay)
+		}
+
+		if Unmount(mfs.dir) == nil {
+			return nil
+		}
+	}
+
+	return UnmountLazy(mfs.dir)
+}
+
+// How long ServeUntilSignal lets ops in flight finish after a signal.
+const signalGracePeriod = 10 * time.Second
+
+// ServeUntilSignal waits until the file system is unmounted, or one of the
+// supplied signals is received, SIGINT or SIGTERM if none are supplied. In the
+// latter case it shuts the file system down with Shutdown, giving ops in
+// flight ten seconds to finish, or until a second signal arrives. It returns
+// the signal received, nil if the file system was unmounted by other means,
+// along with the error returned by Shutdown or Join.
+func ServeUntilSignal(
+	mfs *MountedFileSystem,
+	signals ...os.Signal) (os.Signal, error) {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, signals...)
+	defer signal.Stop(c)
+
+	var sig os.Signal
+	select {
+	case <-mfs.joinStatusAvailable:
+		return nil, mfs.joinStatus
+
+	case sig = <-c:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), signalGracePeriod)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-c:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return sig, mfs.Shutdown(ctx)
+}
+
+// Start turning away new ops, returning a channel closed once those already
+// in flight have been replied to.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) drain() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.idle == nil {
+		c.idle = make(chan struct{})
+		c.finishDraining()
+	}
+
+	return c.idle
+}
+
+// Report whether Shutdown has been called and the op must be turned away.
+// Forgets are still let through, as the kernel expects no reply to them.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) shuttingDown(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.idle != nil
+}
+
+// Close the channel returned by drain if no ops are left in flight.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Connection) finishDraining() {
+	if c.idle == nil || len(c.cancelFuncs) != 0 {
+		return
+	}
+
+	select {
+	case <-c.idle:
+	default:
+		close(c.idle)
+	}
+}
+
+// Cancel the contexts of all ops in flight.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) cancelInFlight() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, cancel := range c.cancelFuncs {
+		cancel()
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+func TestShutdownDrain(t *testing.T) {
+	fs := &slowUnlinkFS{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	kernel, c, hangUp := serve(t, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	sendUnlink(t, kernel, 1, "slow")
+	<-fs.started
+
+	// Draining waits for the op in flight, while turning away new ones.
+	idle := c.Drain()
+	sendRequest(t, kernel, fusekernel.OpStatfs, 2, nil)
+	if r := readReply(t, kernel); r.unique != 2 || r.errno != -int32(syscall.ENOTCONN) {
+		t.Errorf("Reply while draining: %+v", r)
+	}
+
+	select {
+	case <-idle:
+		t.Fatalf("Drained with an unlink in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(fs.release)
+	if r := readReply(t, kernel); r.unique != 1 || r.errno != 0 {
+		t.Errorf("Unlink reply: %+v", r)
+	}
+
+	select {
+	case <-idle:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Not drained after the unlink was replied to")
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeUntilSignal(t *testing.T) {
+	// Unmounting by other means is reported without a signal.
+	mfs := &MountedFileSystem{
+		joinStatus:          errors.New("taco"),
+		joinStatusAvailable: make(chan struct{}),
+	}
+
+	close(mfs.joinStatusAvailable)
+	if sig, err := ServeUntilSignal(mfs); sig != nil || err != mfs.joinStatus {
+		t.Errorf("ServeUntilSignal after unmounting: %v, %v", sig, err)
+	}
+
+	// Signals are reported along with the outcome of shutting down.
+	// Keep the signal from killing us before ServeUntilSignal handles it, and
+	// repeat it until it has.
+	ignored := make(chan os.Signal, 1)
+	signal.Notify(ignored, syscall.SIGUSR1)
+	defer signal.Stop(ignored)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+
+	mfs = &MountedFileSystem{joinStatusAvailable: make(chan struct{})}
+	sig, err := ServeUntilSignal(mfs, syscall.SIGUSR1)
+	if sig != syscall.SIGUSR1 || err != errNoConnection {
+		t.Errorf("ServeUntilSignal on a signal: %v, %v", sig, err)
+	}
+}
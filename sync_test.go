@@ -0,0 +1,92 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system recording the sync and flush ops it receives.
+type syncRecorder struct {
+	fuseutil.NotImplementedFileSystem
+	ops chan interface{}
+}
+
+func (fs *syncRecorder) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fs.ops <- op
+	return nil
+}
+
+func (fs *syncRecorder) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	fs.ops <- op
+	return nil
+}
+
+func (fs *syncRecorder) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	fs.ops <- op
+	return nil
+}
+
+func TestSyncAndFlush(t *testing.T) {
+	fs := &syncRecorder{ops: make(chan interface{}, 1)}
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	send := func(opcode uint32, unique uint64, b []byte) interface{} {
+		sendRequest(t, kernel, opcode, unique, b)
+		op := <-fs.ops
+		if r := readReply(t, kernel); r.unique != unique || r.errno != 0 {
+			t.Fatalf("Reply: %+v", r)
+		}
+
+		return op
+	}
+
+	// fsync(2) and fdatasync(2) are told apart.
+	for _, datasync := range []bool{false, true} {
+		in := fusekernel.FsyncIn{Fh: 7}
+		if datasync {
+			in.FsyncFlags = fusekernel.FsyncFdatasync
+		}
+
+		op, ok := send(fusekernel.OpFsync, 1, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:]).(*fuseops.SyncFileOp)
+		if !ok || op.Handle != 7 || op.Datasync != datasync {
+			t.Errorf("Fsync with datasync %v: %+v", datasync, op)
+		}
+	}
+
+	// The owner of the file descriptor being closed is passed on.
+	flush := fusekernel.FlushIn{Fh: 7, LockOwner: 0x1234}
+	if op, ok := send(fusekernel.OpFlush, 2, (*[unsafe.Sizeof(flush)]byte)(unsafe.Pointer(&flush))[:]).(*fuseops.FlushFileOp); !ok || op.Handle != 7 || op.LockOwner != 0x1234 {
+		t.Errorf("Flush: %+v", op)
+	}
+
+	syncfs := fusekernel.SyncfsIn{}
+	if op, ok := send(fusekernel.OpSyncfs, 3, (*[unsafe.Sizeof(syncfs)]byte)(unsafe.Pointer(&syncfs))[:]).(*fuseops.SyncFSOp); !ok {
+		t.Errorf("Syncfs: %+v", op)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// Return how long the file system is given to reply to the op before the
+// connection replies on its behalf, as set by MountConfig.OpTimeout and
+// OpTimeouts, or zero if there is no limit.
+func (c *Connection) opTimeout(op interface{}) time.Duration {
+	// A blocking lock request waits for as long as the lock is held.
+	if lk, ok := op.(*fuseops.SetLkOp); ok && lk.Wait {
+		return 0
+	}
+
+	timeout := c.cfg.OpTimeout
+	if t, ok := c.cfg.OpTimeouts[opName(op)]; ok {
+		timeout = t
+	}
+
+	if timeout < 0 {
+		return 0
+	}
+
+	return timeout
+}
+
+// Give up on an op the file system hasn't replied to in time: cancel its
+// context, log it, and reply with MountConfig.OpTimeoutErrno.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) timedOut(
+	claim *replyClaim,
+	fuseID uint64,
+	timeout time.Duration) {
+	c.mu.Lock()
+	if claim.replied || c.claims[fuseID] != claim {
+		c.mu.Unlock()
+		return
+	}
+
+	if cancel, ok := c.cancelFuncs[fuseID]; ok {
+		cancel()
+	}
+
+	errno := c.cfg.OpTimeoutErrno
+	if errno == 0 {
+		errno = syscall.EIO
+	}
+
+	c.abandon(claim, fuseID, errno)
+	c.mu.Unlock()
+
+	if c.errorLogger != nil {
+		c.errorLogger.Printf(
+			"%s (%s) not replied to after %v; replying %v",
+			opName(claim.op),
+			describeRequest(claim.op),
+			timeout,
+			errno)
+	}
+
+	c.replyAbandoned(fuseID, claim, errno, "timed out")
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+func TestOpTimeout(t *testing.T) {
+	messages := make(messageWriter, 10)
+	fs := &stubbornStatFS{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	cfg := &fuse.MountConfig{
+		ErrorLogger:    log.New(messages, "", 0),
+		OpTimeout:      100 * time.Millisecond,
+		OpTimeoutErrno: syscall.EAGAIN,
+	}
+
+	kernel, _, hangUp := serveWithConfig(t, cfg, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	// An op not replied to in time is answered on the file system's behalf,
+	// and logged.
+	sendRequest(t, kernel, fusekernel.OpStatfs, 1, nil)
+	<-fs.started
+
+	if r := readReply(t, kernel); r.unique != 1 || r.errno != -int32(syscall.EAGAIN) {
+		t.Errorf("Reply to the op timing out: %+v", r)
+	}
+
+	select {
+	case m := <-messages:
+		if !strings.Contains(m, "StatFS") || !strings.Contains(m, "not replied to after 100ms") {
+			t.Errorf("Logged %q", m)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Nothing logged")
+	}
+
+	// The file system's late reply is dropped, and ops replied to in time
+	// are answered as usual.
+	fs.release <- struct{}{}
+	sendRequest(t, kernel, fusekernel.OpStatfs, 2, nil)
+	<-fs.started
+	fs.release <- struct{}{}
+
+	if r := readReply(t, kernel); r.unique != 2 || r.errno != 0 {
+		t.Errorf("Reply to the op replied to in time: %+v", r)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+)
+
+// How the spans of ops are grouped for linking. See OpSpan.Link.
+type TraceLinking int
+
+const (
+	// Spans are not grouped.
+	TraceLinkNone TraceLinking = iota
+
+	// Spans of ops caused by the same process are grouped.
+	TraceLinkPID
+
+	// Spans of ops on the same file or directory handle are grouped. Ops
+	// without a handle are not.
+	TraceLinkHandle
+)
+
+// What a tracer is told about an op when starting a span for it.
+type OpSpan struct {
+	// The name of the op, e.g. "ReadFile".
+	Op string
+
+	// The inode the op is about, or the parent directory for ops about a name
+	// within one. Zero if neither applies.
+	Inode fuseops.InodeID
+
+	// The handle the op is about, if any.
+	Handle fuseops.HandleID
+
+	// The process that caused the op, when known.
+	PID uint32
+
+	// A key shared by the spans of ops that should be linked together, per
+	// MountConfig.TraceLinking, e.g. "pid 1234". Empty if the span isn't
+	// grouped.
+	Link string
+}
+
+// An OpTracer starts a span for each op served, typically by wrapping a
+// tracing library such as OpenTelemetry, whose integration thus stays out of
+// this package's dependencies. For example:
+//
+//	type otelTracer struct{ tracer trace.Tracer }
+//
+//	func (t otelTracer) StartSpan(
+//		ctx context.Context,
+//		s fuse.OpSpan) (context.Context, func(error, int)) {
+//		ctx, span := t.tracer.Start(ctx, s.Op, trace.WithAttributes(
+//			attribute.Int64("fuse.inode", int64(s.Inode)),
+//			attribute.Int64("fuse.pid", int64(s.PID))))
+//
+//		return ctx, func(err error, bytes int) {
+//			span.SetAttributes(attribute.Int("fuse.bytes", bytes))
+//			if err != nil {
+//				span.SetStatus(codes.Error, err.Error())
+//			}
+//
+//			span.End()
+//		}
+//	}
+type OpTracer interface {
+	// StartSpan starts a span for an op that has just been read from the
+	// kernel. It returns the context the file system is to handle the op
+	// with, which must be derived from ctx, so that the file system's own
+	// spans are children of the op's, and a function that ends the span. That
+	// function is called once the op has been replied to, with the error it
+	// was replied to with and the number of bytes of file contents that it
+	// read or wrote.
+	//
+	// StartSpan is called on the goroutine reading ops, so it must be quick.
+	StartSpan(ctx context.Context, s OpSpan) (context.Context, func(err error, bytes int))
+}
+
+// Describe an op for MountConfig.OpTracer.
+func (c *Connection) opSpan(op interface{}) OpSpan {
+	s := OpSpan{Op: opName(op)}
+
+	v := reflect.ValueOf(op).Elem()
+	for _, name := range []string{"Inode", "Parent", "OldParent"} {
+		if f := v.FieldByName(name); f.IsValid() && f.Kind() == reflect.Uint64 {
+			s.Inode = fuseops.InodeID(f.Uint())
+			break
+		}
+	}
+
+	hasHandle := false
+	if f := v.FieldByName("Handle"); f.IsValid() && f.Kind() == reflect.Uint64 {
+		s.Handle = fuseops.HandleID(f.Uint())
+		hasHandle = true
+	}
+
+	if f := v.FieldByName("OpContext"); f.IsValid() {
+		if meta, ok := f.Interface().(fuseops.OpContext); ok {
+			s.PID = meta.Pid
+		}
+	}
+
+	switch c.cfg.TraceLinking {
+	case TraceLinkPID:
+		s.Link = fmt.Sprintf("pid %d", s.PID)
+
+	case TraceLinkHandle:
+		if hasHandle {
+			s.Link = fmt.Sprintf("handle %d", s.Handle)
+		}
+	}
+
+	return s
+}
+
+// Return the number of bytes of file contents that an op replied to with the
+// supplied error read or wrote.
+func opBytes(op interface{}, err error) int {
+	if err != nil {
+		return 0
+	}
+
+	switch typed := op.(type) {
+	case *fuseops.ReadFileOp:
+		return typed.BytesRead
+	case *fuseops.WriteFileOp:
+		return typed.Written()
+	}
+
+	return 0
+}
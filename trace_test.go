@@ -0,0 +1,89 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+type spanKey struct{}
+
+// A span recorded by recordingTracer.
+type recordedSpan struct {
+	fuse.OpSpan
+	err   error
+	bytes int
+}
+
+// A tracer sending each span once ended.
+type recordingTracer chan recordedSpan
+
+func (t recordingTracer) StartSpan(
+	ctx context.Context,
+	s fuse.OpSpan) (context.Context, func(error, int)) {
+	ctx = context.WithValue(ctx, spanKey{}, s.Op)
+	return ctx, func(err error, bytes int) {
+		t <- recordedSpan{OpSpan: s, err: err, bytes: bytes}
+	}
+}
+
+// A file system that checks that ops are handled within their span.
+type spanCheckingFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *spanCheckingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if ctx.Value(spanKey{}) != "GetInodeAttributes" {
+		return syscall.EINVAL
+	}
+
+	return syscall.ENOENT
+}
+
+func TestOpTracer(t *testing.T) {
+	tracer := make(recordingTracer, 2)
+	cfg := &fuse.MountConfig{
+		OpTracer:     tracer,
+		TraceLinking: fuse.TraceLinkPID,
+	}
+
+	kernel, _, hangUp := serveWithConfig(t, cfg, fuseutil.NewFileSystemServer(&spanCheckingFS{}))
+	defer hangUp()
+
+	if s := <-tracer; s.Op != "init" {
+		t.Errorf("First span: %+v", s)
+	}
+
+	sendRequest(t, kernel, fusekernel.OpGetattr, 1, make([]byte, unsafe.Sizeof(fusekernel.GetattrIn{})))
+	if r := readReply(t, kernel); r.errno != -int32(syscall.ENOENT) {
+		t.Errorf("Reply: %+v", r)
+	}
+
+	s := <-tracer
+	want := fuse.OpSpan{Op: "GetInodeAttributes", Inode: 2, Link: "pid 0"}
+	if s.OpSpan != want || s.err != syscall.ENOENT {
+		t.Errorf("Span: %+v", s)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse"
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system leaving expirations unset except for "live", whose entry is
+// never to be cached, and in which "missing" doesn't exist.
+type ttlFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *ttlFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	switch op.Name {
+	case "live":
+		op.Entry.Child = 4
+		op.Entry.EntryExpiration = fuseops.NoCache
+		op.Entry.AttributesExpiration = fuseops.NoCache
+
+	case "missing":
+		// Leave the child zero, for a negative entry.
+
+	default:
+		op.Entry.Child = 3
+	}
+
+	return nil
+}
+
+func (fs *ttlFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return nil
+}
+
+func TestDefaultTimeouts(t *testing.T) {
+	cfg := &fuse.MountConfig{
+		EntryTimeout:      time.Hour,
+		AttributesTimeout: time.Minute,
+	}
+
+	kernel, _, hangUp := serveWithConfig(t, cfg, fuseutil.NewFileSystemServer(&ttlFS{}))
+	defer hangUp()
+
+	lookUp := func(unique uint64, name string) *fusekernel.EntryOut {
+		t.Helper()
+
+		sendRequest(t, kernel, fusekernel.OpLookup, unique, []byte(name+"\x00"))
+		r := readReply(t, kernel)
+		if r.errno != 0 {
+			t.Fatalf("LookUp(%q): %+v", name, r)
+		}
+
+		return (*fusekernel.EntryOut)(unsafe.Pointer(&r.data[0]))
+	}
+
+	// Unset expirations get the defaults, less the time taken to reply.
+	if out := lookUp(1, "cached"); out.EntryValid != 3599 || out.AttrValid != 59 {
+		t.Errorf("Cached entry valid for %ds, attributes for %ds", out.EntryValid, out.AttrValid)
+	}
+
+	if out := lookUp(2, "live"); out.EntryValid != 0 || out.AttrValid != 0 {
+		t.Errorf("Live entry valid for %ds, attributes for %ds", out.EntryValid, out.AttrValid)
+	}
+
+	if out := lookUp(3, "missing"); out.EntryValid != 0 {
+		t.Errorf("Negative entry valid for %ds", out.EntryValid)
+	}
+
+	in := fusekernel.GetattrIn{}
+	sendRequest(t, kernel, fusekernel.OpGetattr, 4, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+	r := readReply(t, kernel)
+	if out := (*fusekernel.AttrOut)(unsafe.Pointer(&r.data[0])); r.errno != 0 || out.AttrValid != 59 {
+		t.Errorf("GetInodeAttributes: %+v, valid for %ds", r, out.AttrValid)
+	}
+}
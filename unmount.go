@@ -14,8 +14,25 @@
 
 package fuse
 
+import "os"
+
 // Unmount attempts to unmount the file system whose mount point is the
 // supplied directory.
 func Unmount(dir string) error {
 	return unmount(dir)
 }
+
+// UnmountLazy detaches the file system whose mount point is the supplied
+// directory straight away, even if it is busy, as `umount -l` does. The kernel
+// keeps serving files already open on it, and completes the unmount once they
+// are closed. On Linux, unprivileged processes do so through fusermount(1);
+// elsewhere it is the same as Unmount.
+func UnmountLazy(dir string) error {
+	return unmountLazy(dir)
+}
+
+// UnmountInNamespace is like Unmount, for a file system mounted with
+// MountConfig.MountNamespace set to ns. Linux only.
+func UnmountInNamespace(dir string, ns *os.File) error {
+	return unmountInNamespace(dir, ns)
+}
@@ -3,15 +3,36 @@ package fuse
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"os/exec"
+
+	"golang.org/x/sys/unix"
 )
 
 func unmount(dir string) error {
+	return fusermountUnmount("-u", dir)
+}
+
+func unmountLazy(dir string) error {
+	// Processes with CAP_SYS_ADMIN can detach the mount themselves.
+	err := unix.Unmount(dir, unix.MNT_DETACH)
+	if err == unix.EPERM {
+		return fusermountUnmount("-u", "-z", dir)
+	}
+
+	if err != nil {
+		return &os.PathError{Op: "unmount", Path: dir, Err: err}
+	}
+
+	return nil
+}
+
+func fusermountUnmount(args ...string) error {
 	fusermount, err := findFusermount()
 	if err != nil {
 		return err
 	}
-	cmd := exec.Command(fusermount, "-u", dir)
+	cmd := exec.Command(fusermount, args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		if len(output) > 0 {
@@ -23,3 +44,13 @@ func unmount(dir string) error {
 	}
 	return nil
 }
+
+func unmountInNamespace(dir string, ns *os.File) error {
+	return inMountNamespace(ns, func() error {
+		if err := unix.Unmount(dir, 0); err != nil {
+			return &os.PathError{Op: "unmount", Path: dir, Err: err}
+		}
+
+		return nil
+	})
+}
@@ -4,6 +4,7 @@
 package fuse
 
 import (
+	"errors"
 	"os"
 	"syscall"
 )
@@ -15,3 +16,13 @@ func unmount(dir string) error {
 
 	return nil
 }
+
+func unmountLazy(dir string) error {
+	return unmount(dir)
+}
+
+var errNoMountNamespaces = errors.New("mount namespaces are only supported on Linux")
+
+func unmountInNamespace(dir string, ns *os.File) error {
+	return errNoMountNamespaces
+}
@@ -0,0 +1,47 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+)
+
+// A file system answering reads with chunks of data rather than filling Dst.
+type chunkedReadFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *chunkedReadFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	op.Data = [][]byte{[]byte("ab"), []byte("cd"), []byte("ef")}
+	op.BytesRead = 3
+	return nil
+}
+
+func TestVectoredReadWithoutConfig(t *testing.T) {
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(&chunkedReadFS{}))
+	defer hangUp()
+
+	// The chunks are sent even though Dst was provided, up to BytesRead.
+	sendReadHandle(t, kernel, 1, 0, 0)
+	if r := readReply(t, kernel); r.errno != 0 || string(r.data) != "abc" {
+		t.Errorf("Read reply: %+v", r)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/folays/jacobsa_fuse/fuseops"
+	"github.com/folays/jacobsa_fuse/fuseutil"
+	"github.com/folays/jacobsa_fuse/internal/fusekernel"
+)
+
+// A file system recording the attribute changes it is sent.
+type setattrRecorder struct {
+	fuseutil.NotImplementedFileSystem
+	ops chan *fuseops.SetInodeAttributesOp
+}
+
+func (fs *setattrRecorder) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.ops <- op
+	return nil
+}
+
+func TestWritebackTimes(t *testing.T) {
+	fs := &setattrRecorder{ops: make(chan *fuseops.SetInodeAttributesOp, 1)}
+	kernel, c, hangUp := serve(t, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	// The kernel offered no writeback caching.
+	if c.WritebackCaching() {
+		t.Errorf("WritebackCaching with a kernel not offering it")
+	}
+
+	// Times written back by the kernel include the ctime.
+	in := fusekernel.SetattrIn{}
+	in.Valid = uint32(fusekernel.SetattrMtime | fusekernel.SetattrCtime)
+	in.Mtime, in.MtimeNsec = 1425168000, 1
+	in.Ctime, in.CtimeNsec = 1425168001, 2
+	sendRequest(t, kernel, fusekernel.OpSetattr, 1, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+
+	op := <-fs.ops
+	if r := readReply(t, kernel); r.errno != 0 {
+		t.Fatalf("Reply: %+v", r)
+	}
+
+	if op.Mtime == nil || !op.Mtime.Equal(time.Unix(1425168000, 1)) {
+		t.Errorf("Mtime: %v", op.Mtime)
+	}
+
+	if op.Ctime == nil || !op.Ctime.Equal(time.Unix(1425168001, 2)) {
+		t.Errorf("Ctime: %v", op.Ctime)
+	}
+}
+
+func TestSetattrTimesNow(t *testing.T) {
+	fs := &setattrRecorder{ops: make(chan *fuseops.SetInodeAttributesOp, 1)}
+	kernel, _, hangUp := serve(t, fuseutil.NewFileSystemServer(fs))
+	defer hangUp()
+
+	// touch(1) sets the atime to now and the mtime to a given time, through a
+	// handle.
+	in := fusekernel.SetattrIn{}
+	in.Valid = uint32(fusekernel.SetattrAtime |
+		fusekernel.SetattrAtimeNow |
+		fusekernel.SetattrMtime |
+		fusekernel.SetattrHandle)
+	in.Atime = 1425168000
+	in.Mtime = 1425168001
+	in.Fh = 7
+	sendRequest(t, kernel, fusekernel.OpSetattr, 1, (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+
+	op := <-fs.ops
+	if r := readReply(t, kernel); r.errno != 0 {
+		t.Fatalf("Reply: %+v", r)
+	}
+
+	if op.Atime == nil || !op.AtimeNow {
+		t.Errorf("Atime: %v, now %v", op.Atime, op.AtimeNow)
+	}
+
+	if op.Mtime == nil || op.MtimeNow {
+		t.Errorf("Mtime: %v, now %v", op.Mtime, op.MtimeNow)
+	}
+
+	if op.Handle == nil || *op.Handle != 7 {
+		t.Errorf("Handle: %v", op.Handle)
+	}
+}